@@ -77,15 +77,15 @@ func main() {
 		fmt.Fprintf(os.Stderr, `Demo REPL for Skycfg, a library for building complex typed configs.
 
 usage: %s FILENAME
-       %s [ repl | json | yaml ] FILENAME
+       %s [ repl | json | yaml | dot | graphml ] FILENAME
 `, os.Args[0], os.Args[0])
 		os.Exit(1)
 	}
 
 	switch mode {
-	case "repl", "json", "yaml":
+	case "repl", "json", "yaml", "dot", "graphml":
 	default:
-		fmt.Fprintf(os.Stderr, "Unknown subcommand %q: expected `repl', `json', or `yaml'\n")
+		fmt.Fprintf(os.Stderr, "Unknown subcommand %q: expected `repl', `json', `yaml', `dot', or `graphml'\n", mode)
 		os.Exit(1)
 	}
 
@@ -111,6 +111,25 @@ usage: %s FILENAME
 		return
 	}
 
+	if mode == "dot" || mode == "graphml" {
+		graph := config.LoadGraph()
+		graph.Symbols, err = skycfg.IndexSymbols(context.Background(), []string{filename})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error indexing symbols of %q: %v\n", filename, err)
+			os.Exit(1)
+		}
+		if mode == "dot" {
+			err = graph.WriteDOT(os.Stdout)
+		} else {
+			err = graph.WriteGraphML(os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error writing load graph: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var jsonMarshaler = &jsonpb.Marshaler{OrigName: true}
 	protos, err := config.Main(context.Background())
 	if err != nil {
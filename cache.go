@@ -0,0 +1,158 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A Cache stores the results of work Skycfg can skip on later runs: compiled
+// modules with WithProgramCache(), and module content fetched by a
+// CachingFileReader with WithModuleCache(). Keys are digests computed with
+// CacheKey(), so a stored value never needs to be invalidated; a Cache may
+// evict entries at any time.
+//
+// The outputs of main() aren't cached. It can read the environment, the
+// clock, and other inputs that aren't part of any cache key, so a cached
+// output could be stale.
+//
+// Implementations must be safe for concurrent use. Values passed to Put()
+// and returned by Get() belong to the caller, so an implementation must
+// not keep or return a slice that the caller could modify.
+type Cache interface {
+	// Get returns the value stored for key, or (nil, false, nil) if there
+	// is none.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+
+	// Put stores a value for key.
+	Put(ctx context.Context, key string, value []byte) error
+}
+
+// CacheKey returns a digest of the given parts, suitable for use as a Cache
+// key. Parts are length-prefixed, so different splits of the same bytes
+// produce different keys.
+func CacheKey(parts ...[]byte) string {
+	h := sha256.New()
+	for _, part := range parts {
+		fmt.Fprintf(h, "%d:", len(part))
+		h.Write(part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type memoryCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+// MemoryCache returns a Cache that stores values in memory, for sharing work
+// between Loads within a single process. Values are copied on Put() and
+// Get().
+func MemoryCache() Cache {
+	return &memoryCache{entries: make(map[string][]byte)}
+}
+
+func (c *memoryCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	return append([]byte(nil), value...), true, nil
+}
+
+func (c *memoryCache) Put(ctx context.Context, key string, value []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = append([]byte(nil), value...)
+	return nil
+}
+
+type dirCache struct {
+	dir string
+}
+
+// DirCache returns a Cache that stores values as files in a directory, so
+// work can be shared between processes (for example, across CI runs). The
+// directory is created if it doesn't exist.
+func DirCache(dir string) (Cache, error) {
+	if dir == "" {
+		panic("DirCache: empty directory path")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &dirCache{dir}, nil
+}
+
+func (c *dirCache) path(key string) (string, error) {
+	if _, err := hex.DecodeString(key); err != nil || len(key) < 4 {
+		return "", fmt.Errorf("DirCache: invalid key %q", key)
+	}
+	return filepath.Join(c.dir, key[:2], key), nil
+}
+
+func (c *dirCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	path, err := c.path(key)
+	if err != nil {
+		return nil, false, err
+	}
+	value, err := ioutil.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (c *dirCache) Put(ctx context.Context, key string, value []byte) error {
+	path, err := c.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so concurrent readers never see a
+	// partially written value.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,262 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CacheStats reports how often a CachingReader was able to answer a request
+// without calling its inner FileReader.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+
+	// Revalidations counts expired files that were found to be unchanged by
+	// the inner reader's Stat() method, and so weren't read again. These
+	// are also counted as hits.
+	Revalidations uint64
+}
+
+type resolveKey struct {
+	name, fromPath string
+}
+
+type cachedString struct {
+	value   string
+	expires time.Time
+}
+
+type cachedBytes struct {
+	value   []byte
+	info    FileInfo
+	expires time.Time
+}
+
+// A CachingFileReaderOption adjusts how a CachingReader stores modules.
+type CachingFileReaderOption interface {
+	applyCaching(*CachingReader)
+}
+
+type fnCachingFileReaderOption func(*CachingReader)
+
+func (fn fnCachingFileReaderOption) applyCaching(r *CachingReader) { fn(r) }
+
+// WithModuleCache also stores the content of files in cache, keyed by their
+// path and the version reported by the inner reader's Stat() method, so
+// readers in other processes sharing the cache (for example, later CI runs
+// using a DirCache) don't need to fetch unchanged files. It has no effect
+// unless the inner reader is a FileStater.
+//
+// Cache errors are ignored, and the file is read from the inner reader.
+func WithModuleCache(cache Cache) CachingFileReaderOption {
+	if cache == nil {
+		panic("WithModuleCache: nil cache")
+	}
+	return fnCachingFileReaderOption(func(r *CachingReader) {
+		r.store = cache
+	})
+}
+
+// A CachingReader is a FileReader that memoizes the results of another
+// FileReader, so repeated calls to Load() don't need to re-fetch modules.
+type CachingReader struct {
+	inner FileReader
+	ttl   time.Duration
+	store Cache
+
+	mu       sync.Mutex
+	resolved map[resolveKey]cachedString
+	files    map[string]cachedBytes
+	stats    CacheStats
+}
+
+var _ FileStater = (*CachingReader)(nil)
+
+// CachingFileReader returns a FileReader that caches successful results of
+// inner.Resolve() and inner.ReadFile() for the given TTL. A TTL of zero or
+// less caches results until they're explicitly invalidated.
+//
+// If inner is a FileStater, expired files are revalidated with Stat() and
+// only read again if they've changed. A TTL of time.Nanosecond then checks
+// every file for changes on each Load(), without re-reading unchanged
+// files.
+func CachingFileReader(inner FileReader, ttl time.Duration, opts ...CachingFileReaderOption) *CachingReader {
+	if inner == nil {
+		panic("CachingFileReader: nil reader")
+	}
+	r := &CachingReader{
+		inner:    inner,
+		ttl:      ttl,
+		resolved: make(map[resolveKey]cachedString),
+		files:    make(map[string]cachedBytes),
+	}
+	for _, opt := range opts {
+		opt.applyCaching(r)
+	}
+	return r
+}
+
+func (r *CachingReader) expiry() time.Time {
+	if r.ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(r.ttl)
+}
+
+func isExpired(expires time.Time) bool {
+	return !expires.IsZero() && time.Now().After(expires)
+}
+
+func (r *CachingReader) Resolve(ctx context.Context, name, fromPath string) (string, error) {
+	key := resolveKey{name, fromPath}
+	r.mu.Lock()
+	if cached, ok := r.resolved[key]; ok && !isExpired(cached.expires) {
+		r.stats.Hits++
+		r.mu.Unlock()
+		return cached.value, nil
+	}
+	r.stats.Misses++
+	r.mu.Unlock()
+
+	resolved, err := r.inner.Resolve(ctx, name, fromPath)
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	r.resolved[key] = cachedString{resolved, r.expiry()}
+	r.mu.Unlock()
+	return resolved, nil
+}
+
+func (r *CachingReader) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	r.mu.Lock()
+	cached, ok := r.files[path]
+	if ok && !isExpired(cached.expires) {
+		r.stats.Hits++
+		r.mu.Unlock()
+		return cached.value, nil
+	}
+	r.mu.Unlock()
+
+	// Stat before reading, so that if the file changes in between, the next
+	// revalidation sees a different version and reads it again.
+	info, err := statFile(ctx, r.inner, path)
+	if err != nil {
+		return nil, err
+	}
+	if ok && sameVersion(cached.info, info) {
+		r.mu.Lock()
+		r.stats.Hits++
+		r.stats.Revalidations++
+		r.files[path] = cachedBytes{cached.value, cached.info, r.expiry()}
+		r.mu.Unlock()
+		return cached.value, nil
+	}
+
+	storeKey := moduleCacheKey(path, info)
+	if r.store != nil && storeKey != "" {
+		content, ok, err := r.store.Get(ctx, storeKey)
+		if err == nil && ok && (info.Hash == "" || moduleHash(content) == info.Hash) {
+			r.mu.Lock()
+			r.stats.Hits++
+			r.files[path] = cachedBytes{content, info, r.expiry()}
+			r.mu.Unlock()
+			return content, nil
+		}
+	}
+
+	r.mu.Lock()
+	r.stats.Misses++
+	r.mu.Unlock()
+	content, err := r.inner.ReadFile(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if r.store != nil && storeKey != "" {
+		r.store.Put(ctx, storeKey, content)
+	}
+	r.mu.Lock()
+	r.files[path] = cachedBytes{content, info, r.expiry()}
+	r.mu.Unlock()
+	return content, nil
+}
+
+// moduleCacheKey returns the key a file's content is stored under in a
+// module cache, or "" if info doesn't identify a version. As in
+// sameVersion(), the most precise field is used.
+func moduleCacheKey(path string, info FileInfo) string {
+	var version string
+	switch {
+	case info.Hash != "":
+		version = "hash:" + info.Hash
+	case info.ETag != "":
+		version = "etag:" + info.ETag
+	case !info.ModTime.IsZero():
+		version = fmt.Sprintf("mtime:%d:%d", info.ModTime.UnixNano(), info.Size)
+	default:
+		return ""
+	}
+	return CacheKey([]byte("skycfg.module"), []byte(path), []byte(version))
+}
+
+// Stat returns the metadata of a cached file, including its hash, if the
+// cache entry hasn't expired. Otherwise it returns the inner reader's
+// metadata, if it's a FileStater.
+func (r *CachingReader) Stat(ctx context.Context, path string) (FileInfo, error) {
+	r.mu.Lock()
+	cached, ok := r.files[path]
+	r.mu.Unlock()
+	if ok && !isExpired(cached.expires) {
+		info := cached.info
+		info.Size = int64(len(cached.value))
+		info.Hash = moduleHash(cached.value)
+		return info, nil
+	}
+	return statFile(ctx, r.inner, path)
+}
+
+// Stats returns the number of cache hits and misses so far.
+func (r *CachingReader) Stats() CacheStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// Invalidate removes a single resolved path from the cache, along with any
+// cached name resolutions that pointed to it.
+func (r *CachingReader) Invalidate(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.files, path)
+	for key, cached := range r.resolved {
+		if cached.value == path {
+			delete(r.resolved, key)
+		}
+	}
+}
+
+// InvalidateAll empties the cache.
+func (r *CachingReader) InvalidateAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resolved = make(map[resolveKey]cachedString)
+	r.files = make(map[string]cachedBytes)
+}
@@ -0,0 +1,246 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+
+	impl "github.com/stripe/skycfg/internal/go/skycfg"
+)
+
+// A CapabilityReport lists what a config reached outside of itself while
+// it was loaded and executed: the modules it loaded, the builtins provided
+// by the host program that it called, and the vars and environment
+// variables it read.
+//
+// Builtins are those added with WithGlobals(), WithModule(), and
+// WithCtxAttrs(), and ctx.assert_live(). The builtins that every config
+// has, such as proto and json, are not reported.
+type CapabilityReport struct {
+	Filename string
+
+	// Modules are the edges of the config's load graph, as returned by
+	// Config.Dependencies(). It's empty if the config failed to load.
+	Modules []Dependency
+
+	// BuiltinModules are the names of the modules registered with
+	// WithModule() that the config loaded.
+	BuiltinModules []string
+
+	// Builtins are the host builtins that the config called, sorted by
+	// name.
+	Builtins []BuiltinCalls
+
+	// Vars are the keys of ctx.vars that main() and placeholder expansion
+	// read.
+	Vars []VarUsage
+
+	// VarsIterated is true if main() iterated over ctx.vars, in which case
+	// it may depend on keys that aren't listed.
+	VarsIterated bool
+
+	// Env are the names of the environment variables that
+	// WithPlaceholderExpansion() read, sorted.
+	Env []string
+}
+
+// BuiltinCalls counts the calls of a host builtin. The name is the path by
+// which the config reached it, for example "k8s.get" for a global, or
+// "ctx.lookup" for a ctx attribute, or "@builtin//secrets.read" for a
+// member of a module registered with WithModule().
+type BuiltinCalls struct {
+	Name  string
+	Calls int
+}
+
+// JSON renders the report as an indented JSON document, for tools that
+// audit configs.
+func (r *CapabilityReport) JSON() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+// A CapabilityRecorder records the capabilities that a config exercises.
+// Pass it to Load() and Exec() with WithCapabilityRecorder(), and then call
+// Report(). Only the code paths taken during those calls are recorded.
+type CapabilityRecorder struct {
+	mu             sync.Mutex
+	filename       string
+	modules        []Dependency
+	builtinModules map[string]bool
+	calls          map[string]int
+	vars           *impl.VarsRecorder
+	env            map[string]bool
+}
+
+// NewCapabilityRecorder returns an empty CapabilityRecorder.
+func NewCapabilityRecorder() *CapabilityRecorder {
+	return &CapabilityRecorder{
+		builtinModules: make(map[string]bool),
+		calls:          make(map[string]int),
+		env:            make(map[string]bool),
+	}
+}
+
+// A CapabilityOption can be passed to both Load() and Exec().
+type CapabilityOption interface {
+	LoadOption
+	ExecOption
+}
+
+type capabilityOption struct {
+	recorder *CapabilityRecorder
+}
+
+func (o capabilityOption) applyLoad(opts *loadOptions) { opts.capabilities = o.recorder }
+func (o capabilityOption) applyExec(opts *execOptions) {
+	opts.capabilities = o.recorder
+	opts.wrapVars = func(vars *starlark.Dict) starlark.Value {
+		o.recorder.mu.Lock()
+		defer o.recorder.mu.Unlock()
+		o.recorder.vars = impl.NewVarsRecorder(vars)
+		return o.recorder.vars
+	}
+}
+
+// WithCapabilityRecorder records the capabilities exercised by the config
+// in r.
+func WithCapabilityRecorder(r *CapabilityRecorder) CapabilityOption {
+	if r == nil {
+		panic("WithCapabilityRecorder: nil recorder")
+	}
+	return capabilityOption{r}
+}
+
+// AuditCapabilities loads a config and executes its main(), discarding the
+// messages it produces, and reports the capabilities it exercised. If
+// loading or executing fails, AuditCapabilities returns the capabilities
+// exercised before the failure along with the error.
+func AuditCapabilities(ctx context.Context, filename string, loadOpts []LoadOption, execOpts ...ExecOption) (*CapabilityReport, error) {
+	r := NewCapabilityRecorder()
+	config, err := Load(ctx, filename, append(loadOpts, WithCapabilityRecorder(r))...)
+	if err != nil {
+		return r.Report(), err
+	}
+	discard := fnExecOption(func(opts *execOptions) {
+		opts.handler = func(msg proto.Message, annotations map[string]string) error { return nil }
+	})
+	_, err = config.Exec(ctx, append(execOpts, WithCapabilityRecorder(r), discard)...)
+	return r.Report(), err
+}
+
+// Report returns the capabilities recorded so far.
+func (r *CapabilityRecorder) Report() *CapabilityReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := &CapabilityReport{
+		Filename: r.filename,
+		Modules:  append([]Dependency(nil), r.modules...),
+	}
+	for name := range r.builtinModules {
+		report.BuiltinModules = append(report.BuiltinModules, name)
+	}
+	sort.Strings(report.BuiltinModules)
+	for name, calls := range r.calls {
+		report.Builtins = append(report.Builtins, BuiltinCalls{Name: name, Calls: calls})
+	}
+	sort.Slice(report.Builtins, func(i, j int) bool { return report.Builtins[i].Name < report.Builtins[j].Name })
+	if r.vars != nil {
+		report.Vars = r.vars.Usages()
+		report.VarsIterated = r.vars.Iterated()
+	}
+	for name := range r.env {
+		report.Env = append(report.Env, name)
+	}
+	sort.Strings(report.Env)
+	return report
+}
+
+// instrumentLoad wraps the host globals and builtin modules of a Load()
+// so that their calls are recorded.
+func (r *CapabilityRecorder) instrumentLoad(filename string, opts *loadOptions) {
+	r.mu.Lock()
+	r.filename = filename
+	r.mu.Unlock()
+	for name := range opts.hostGlobals {
+		opts.globals[name] = impl.RecordCalls(opts.globals[name], name, r.recordCall)
+	}
+	modules := make(map[string]starlark.StringDict, len(opts.modules))
+	for moduleName, members := range opts.modules {
+		wrapped := make(starlark.StringDict, len(members))
+		for key, value := range members {
+			value = impl.RecordCalls(value, builtinModulePrefix+moduleName+"."+key, r.recordCall)
+			value.Freeze()
+			wrapped[key] = value
+		}
+		modules[moduleName] = wrapped
+	}
+	opts.modules = modules
+	opts.loadFilters = append(opts.loadFilters, func(moduleName, fromPath string) error {
+		if strings.HasPrefix(moduleName, builtinModulePrefix) {
+			r.mu.Lock()
+			r.builtinModules[strings.TrimPrefix(moduleName, builtinModulePrefix)] = true
+			r.mu.Unlock()
+		}
+		return nil
+	})
+}
+
+// instrumentCtx wraps the host builtins of a ctx value.
+func (r *CapabilityRecorder) instrumentCtx(ctxModule *impl.Module) {
+	for key, value := range ctxModule.Attrs {
+		if key == "vars" || key == "log" {
+			continue
+		}
+		ctxModule.Attrs[key] = impl.RecordCalls(value, "ctx."+key, r.recordCall)
+	}
+}
+
+func (r *CapabilityRecorder) recordModules(deps []Dependency) {
+	r.mu.Lock()
+	r.modules = deps
+	r.mu.Unlock()
+}
+
+func (r *CapabilityRecorder) recordCall(name string) {
+	r.mu.Lock()
+	r.calls[name]++
+	r.mu.Unlock()
+}
+
+func (r *CapabilityRecorder) recordEnv(name string) {
+	r.mu.Lock()
+	r.env[name] = true
+	r.mu.Unlock()
+}
+
+// varsView returns the view of ctx.vars that records reads, so that vars
+// read outside of main() are reported too.
+func (r *CapabilityRecorder) varsView(vars *starlark.Dict) starlark.Mapping {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.vars == nil {
+		return vars
+	}
+	return r.vars
+}
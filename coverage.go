@@ -0,0 +1,242 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+
+	impl "github.com/stripe/skycfg/internal/go/skycfg"
+)
+
+// coverageProbe is the name of the builtin called by instrumented modules.
+const coverageProbe = "__skycfg_coverage__"
+
+// A CoverageReport lists the function bodies and branches of the modules
+// in a config's load graph, and how many times each was executed. Blocks
+// that were never executed may be dead code, or may only be reached by
+// inputs that the config's tests don't cover.
+type CoverageReport struct {
+	Filename string
+
+	// Blocks are sorted by path and position.
+	Blocks []CoverageBlock
+
+	// FailedTests are the names of tests that failed. Their coverage is
+	// still recorded, up to the point of failure.
+	FailedTests []string `json:",omitempty"`
+}
+
+// A CoverageBlock is a function body or branch of a module.
+type CoverageBlock struct {
+	// Path is the resolved path of the module.
+	Path string
+
+	// Line and Col locate the def, if, elif, else, or for keyword that
+	// introduces the block.
+	Line int
+	Col  int
+
+	// Kind is "def", "if", "elif", "else", or "for".
+	Kind string
+
+	// Func is the name of the function, for a "def" block, or of the
+	// function containing a branch. It's empty for top-level branches.
+	Func string `json:",omitempty"`
+
+	// Hits counts the times the block was entered.
+	Hits int
+}
+
+func (b CoverageBlock) String() string {
+	var desc string
+	switch {
+	case b.Kind == "def":
+		desc = "function " + b.Func
+	case b.Func != "":
+		desc = fmt.Sprintf("%s branch in %s", b.Kind, b.Func)
+	default:
+		desc = b.Kind + " branch"
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", b.Path, b.Line, b.Col, desc)
+}
+
+// Unexecuted returns the blocks that were never executed.
+func (r *CoverageReport) Unexecuted() []CoverageBlock {
+	var blocks []CoverageBlock
+	for _, block := range r.Blocks {
+		if block.Hits == 0 {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// JSON renders the report as an indented JSON document.
+func (r *CoverageReport) JSON() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+// A CoverageRecorder records which parts of a config's modules are
+// executed. Pass it to Load() with WithCoverageRecorder(), run the config's
+// main() or tests, and then call Report().
+//
+// Modules are instrumented by rewriting their source when they're loaded,
+// so WithProgramCache() is ignored when recording coverage. Configs loaded
+// again with the same recorder, such as by Watch(), add to the counts of
+// modules whose content is unchanged.
+type CoverageRecorder struct {
+	mu       sync.Mutex
+	filename string
+	modules  []*coverageModule
+	byPath   map[string]int // resolved path -> index of current module
+}
+
+type coverageModule struct {
+	path   string
+	hash   string
+	src    []byte // instrumented source
+	blocks []impl.CoverageBlock
+	hits   []int
+}
+
+// NewCoverageRecorder returns an empty CoverageRecorder.
+func NewCoverageRecorder() *CoverageRecorder {
+	return &CoverageRecorder{byPath: make(map[string]int)}
+}
+
+// WithCoverageRecorder records the coverage of the config's modules in r.
+func WithCoverageRecorder(r *CoverageRecorder) LoadOption {
+	if r == nil {
+		panic("WithCoverageRecorder: nil recorder")
+	}
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.coverage = r
+	})
+}
+
+// AnalyzeCoverage loads a config, runs its tests and then its main() if it
+// has one, discarding the messages it produces, and reports which parts of
+// the modules in its load graph were executed. The exec options are used
+// for both the tests and main().
+//
+// Test failures are listed in the report rather than returned. If loading
+// the config or executing main() fails, AnalyzeCoverage returns the
+// coverage recorded before the failure along with the error.
+func AnalyzeCoverage(ctx context.Context, filename string, loadOpts []LoadOption, execOpts ...ExecOption) (*CoverageReport, error) {
+	r := NewCoverageRecorder()
+	config, err := Load(ctx, filename, append(loadOpts, WithCoverageRecorder(r))...)
+	if err != nil {
+		return r.Report(), err
+	}
+	var failed []string
+	for _, test := range config.Tests() {
+		result, err := test.Run(ctx, WithTestExecOptions(execOpts...))
+		if err != nil {
+			return r.Report(), err
+		}
+		if result.Failure != nil {
+			failed = append(failed, result.TestName)
+		}
+	}
+	if _, ok := config.locals["main"]; ok {
+		discard := fnExecOption(func(opts *execOptions) {
+			opts.handler = func(msg proto.Message, annotations map[string]string) error { return nil }
+		})
+		_, err = config.Exec(ctx, append(execOpts, discard)...)
+	}
+	report := r.Report()
+	report.FailedTests = failed
+	return report, err
+}
+
+// Report returns the coverage recorded so far.
+func (r *CoverageRecorder) Report() *CoverageReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := &CoverageReport{Filename: r.filename}
+	for _, index := range r.byPath {
+		m := r.modules[index]
+		for ii, block := range m.blocks {
+			report.Blocks = append(report.Blocks, CoverageBlock{
+				Path: m.path,
+				Line: int(block.Pos.Line),
+				Col:  int(block.Pos.Col),
+				Kind: block.Kind,
+				Func: block.Func,
+				Hits: m.hits[ii],
+			})
+		}
+	}
+	sort.Slice(report.Blocks, func(i, j int) bool {
+		a, b := report.Blocks[i], report.Blocks[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return report
+}
+
+// instrumentLoad adds the probe builtin to the globals of a Load().
+func (r *CoverageRecorder) instrumentLoad(filename string, opts *loadOptions) {
+	r.mu.Lock()
+	r.filename = filename
+	r.mu.Unlock()
+	opts.programCache = nil
+	opts.globals[coverageProbe] = starlark.NewBuiltin(coverageProbe, r.probe)
+}
+
+// instrument returns the instrumented source of a module.
+func (r *CoverageRecorder) instrument(f *syntax.File, modulePath string, src []byte) []byte {
+	hash := moduleHash(src)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if index, ok := r.byPath[modulePath]; ok && r.modules[index].hash == hash {
+		return r.modules[index].src
+	}
+	m := &coverageModule{path: modulePath, hash: hash}
+	m.src, m.blocks = impl.InstrumentCoverage(f, src, coverageProbe, len(r.modules))
+	m.hits = make([]int, len(m.blocks))
+	r.byPath[modulePath] = len(r.modules)
+	r.modules = append(r.modules, m)
+	return m.src
+}
+
+func (r *CoverageRecorder) probe(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var module, block int
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &module, &block); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if module < 0 || module >= len(r.modules) || block < 0 || block >= len(r.modules[module].hits) {
+		return nil, fmt.Errorf("%s: no block %d in module %d", fn.Name(), block, module)
+	}
+	r.modules[module].hits[block]++
+	return starlark.False, nil
+}
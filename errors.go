@@ -0,0 +1,128 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"errors"
+)
+
+// A ParseError reports that a module couldn't be parsed or compiled, such
+// as for a syntax error or a reference to an undefined name.
+//
+// Errors returned by Load() and Main() are classified by their cause as a
+// ParseError, LoadError, ExecError, TimeoutError, or ValidationError, so
+// that callers can respond to them without matching error messages:
+//
+//	var parseErr *skycfg.ParseError
+//	if errors.As(err, &parseErr) {
+//		// The config has a syntax error.
+//	}
+//
+// Each wraps the underlying error, such as a *starlark.EvalError, which can
+// also be retrieved with errors.As(). An error raised while loading a
+// dependency keeps the classification of its cause in each module that
+// loads it. Errors in the options passed to Load() or Main() aren't
+// classified.
+type ParseError struct {
+	Err error
+}
+
+func (e *ParseError) Error() string { return e.Err.Error() }
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// A LoadError reports that a module couldn't be read or linked to the
+// modules it loads: a file that doesn't exist, a cycle in the load graph,
+// a mismatched pin or lockfile hash, or a load() that a policy forbids.
+type LoadError struct {
+	Err error
+}
+
+func (e *LoadError) Error() string { return e.Err.Error() }
+func (e *LoadError) Unwrap() error { return e.Err }
+
+// An ExecError reports that a module's top-level code or main() failed
+// with a Starlark runtime error.
+type ExecError struct {
+	Err error
+}
+
+func (e *ExecError) Error() string { return e.Err.Error() }
+func (e *ExecError) Unwrap() error { return e.Err }
+
+// A TimeoutError reports that loading or executing a config was stopped
+// by WithLoadTimeout, or because its context was cancelled or reached its
+// deadline. If the context was, its error can be retrieved with
+// errors.Is().
+type TimeoutError struct {
+	Err error
+}
+
+func (e *TimeoutError) Error() string { return e.Err.Error() }
+func (e *TimeoutError) Unwrap() error { return e.Err }
+
+// A ValidationError reports that a config ran, but its output isn't valid:
+// it has no main() function, or main() returned something other than a
+// list of messages.
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string { return e.Err.Error() }
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// As lets a LoadCycleError, which Load() returns directly, be retrieved as
+// a LoadError.
+func (e *LoadCycleError) As(target interface{}) bool {
+	if target, ok := target.(**LoadError); ok {
+		*target = &LoadError{Err: e}
+		return true
+	}
+	return false
+}
+
+// classifyAs returns err with the same classification as cause, for errors
+// that report a failure in another module. The cause stays in the error's
+// chain, since the interpreter reports it only as text.
+func classifyAs(err, cause error) error {
+	if cause != nil {
+		err = &causedError{err: err, cause: cause}
+	}
+	var (
+		parseErr   *ParseError
+		loadErr    *LoadError
+		timeoutErr *TimeoutError
+	)
+	switch {
+	case errors.As(cause, &timeoutErr):
+		return &TimeoutError{Err: err}
+	case errors.As(cause, &parseErr):
+		return &ParseError{Err: err}
+	case errors.As(cause, &loadErr):
+		return &LoadError{Err: err}
+	}
+	return &ExecError{Err: err}
+}
+
+// A causedError is an error from executing a module that was caused by a
+// failure to load another module.
+type causedError struct {
+	err   error
+	cause error
+}
+
+func (e *causedError) Error() string   { return e.err.Error() }
+func (e *causedError) Unwrap() []error { return []error{e.err, e.cause} }
@@ -0,0 +1,119 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+)
+
+// An ExecPool executes a config's main() repeatedly with the same options,
+// for servers that render a config per request. The ctx value and vars dict
+// of each execution are reused by later ones, rather than being built from
+// scratch as they are by Exec(). Each execution has its own thread.
+//
+// The options passed to NewExecPool() apply to every execution; only vars
+// differ between them. Because the vars dict is reused, host builtins must
+// not keep references to ctx.vars after an execution finishes.
+//
+// An ExecPool is safe for concurrent use.
+type ExecPool struct {
+	config *Config
+	main   starlark.Callable
+	opts   []ExecOption
+	err    error
+
+	// vars holds the vars set by opts, which each execution starts with.
+	vars  []starlark.Tuple
+	state sync.Pool
+}
+
+// NewExecPool returns an ExecPool for the config's main(). An error in the
+// options, or a config without main(), is returned by each execution.
+func (c *Config) NewExecPool(opts ...ExecOption) *ExecPool {
+	p := &ExecPool{config: c, opts: opts}
+	parsedOpts, err := parseExecOptions(opts)
+	if err != nil {
+		p.err = err
+		return p
+	}
+	p.vars = parsedOpts.vars.Items()
+	p.main, p.err = c.mainFunc()
+	return p
+}
+
+// Exec executes main() like Config.Exec(), with vars added to ctx.vars.
+func (p *ExecPool) Exec(ctx context.Context, vars starlark.StringDict) (*ExecResult, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	s, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	defer p.state.Put(s)
+	for key, value := range vars {
+		s.opts.vars.SetKey(starlark.String(key), value)
+	}
+	if err := checkVarSizes(s.opts); err != nil {
+		return nil, err
+	}
+	return s.run(ctx, p.main)
+}
+
+// Main executes main() like Config.Main(), with vars added to ctx.vars.
+func (p *ExecPool) Main(ctx context.Context, vars starlark.StringDict) ([]proto.Message, error) {
+	result, err := p.Exec(ctx, vars)
+	if result == nil {
+		return nil, err
+	}
+	return result.Messages, err
+}
+
+// get returns an idle execState, with its vars reset to those set by the
+// pool's options.
+func (p *ExecPool) get() (*execState, error) {
+	if s, ok := p.state.Get().(*execState); ok {
+		// A dict that's been frozen can't be cleared, so the state is
+		// discarded.
+		if err := s.opts.vars.Clear(); err == nil {
+			for _, item := range p.vars {
+				s.opts.vars.SetKey(item[0], item[1])
+			}
+			s.reset()
+			return s, nil
+		}
+	}
+	parsedOpts, err := parseExecOptions(p.opts)
+	if err != nil {
+		return nil, err
+	}
+	return p.config.newExecState(parsedOpts), nil
+}
+
+// reset prepares a state for another execution. The thread is replaced,
+// since its locals hold the field errors and other state of the previous
+// execution, and so is the view of ctx.vars that records which keys it read.
+func (s *execState) reset() {
+	s.thread = newExecThread(context.Background(), s.opts)
+	if s.opts.wrapVars != nil {
+		s.mainCtx.Attrs["vars"] = s.opts.wrapVars(s.opts.vars)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// exportsGlobal is the name of the module global that lists which of its
+// symbols may be loaded by other modules:
+//
+//  exports = ["make_service", "DEFAULT_PORT"]
+//
+// Modules that don't define it export every symbol.
+const exportsGlobal = "exports"
+
+// moduleExports returns the globals of a module that other modules may
+// load, or nil if the module doesn't restrict its exports.
+func moduleExports(modulePath string, globals starlark.StringDict) (starlark.StringDict, error) {
+	val, ok := globals[exportsGlobal]
+	if !ok {
+		return nil, nil
+	}
+	iterable, ok := val.(starlark.Iterable)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s must be a list of strings, got %s", modulePath, exportsGlobal, val.Type())
+	}
+	exported := make(starlark.StringDict)
+	iter := iterable.Iterate()
+	defer iter.Done()
+	var item starlark.Value
+	for iter.Next(&item) {
+		name, ok := item.(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s must be a list of strings, got %s in list", modulePath, exportsGlobal, item.Type())
+		}
+		member, ok := globals[string(name)]
+		if !ok {
+			return nil, fmt.Errorf("%s: %s lists %s, which isn't defined", modulePath, exportsGlobal, name)
+		}
+		exported[string(name)] = member
+	}
+	return exported, nil
+}
+
+// checkExports returns an error if a load() statement names a symbol that
+// the loaded module doesn't export.
+func checkExports(stmt *syntax.LoadStmt, modulePath string, exported starlark.StringDict) error {
+	if exported == nil {
+		return nil
+	}
+	for _, from := range stmt.From {
+		if _, ok := exported[from.Name]; !ok {
+			return fmt.Errorf("%s: load(%q): %q is not exported by %s (see its %s)", from.NamePos, stmt.Module.Value, from.Name, modulePath, exportsGlobal)
+		}
+	}
+	return nil
+}
+
+// findReExports returns the names in a load() statement that the loaded
+// module bound with its own load() statements. Names listed in the
+// module's exports are re-exported deliberately, so they aren't reported.
+func findReExports(stmt *syntax.LoadStmt, imported map[string]bool, exported starlark.StringDict) []*syntax.Ident {
+	if exported != nil {
+		return nil
+	}
+	var found []*syntax.Ident
+	for _, from := range stmt.From {
+		if imported[from.Name] {
+			found = append(found, from)
+		}
+	}
+	return found
+}
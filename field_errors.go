@@ -0,0 +1,84 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"unicode/utf8"
+
+	"go.starlark.net/starlark"
+
+	impl "github.com/stripe/skycfg/internal/go/skycfg"
+)
+
+// recoverFieldError returns the *FieldError behind a Starlark error from
+// assigning a Protobuf field, with its position in the config, or err if it
+// has none. The interpreter only tracks lines, so the column is found by
+// looking for the field on that line of the module's source, if source has
+// it.
+func recoverFieldError(thread *starlark.Thread, err error, source func(path string) []byte) error {
+	fieldErr, ok := impl.FieldErrorOf(thread, err)
+	if !ok {
+		return err
+	}
+	if fieldErr.Pos.IsValid() && fieldErr.Pos.Col == 0 {
+		if src := source(fieldErr.Pos.Filename()); src != nil {
+			fieldErr.Pos.Col = fieldColumn(src, int(fieldErr.Pos.Line), fieldErr.FieldName())
+		}
+	}
+	return fieldErr
+}
+
+// fieldColumn returns the column at which a field is assigned on a line,
+// either as an attribute or as a keyword argument, or 0 if it isn't found.
+func fieldColumn(source []byte, line int, field string) int32 {
+	lines := lineOffsets(source)
+	if field == "" || line < 1 || line > len(lines) {
+		return 0
+	}
+	text := source[lines[line-1]:]
+	if end := bytes.IndexByte(text, '\n'); end >= 0 {
+		text = text[:end]
+	}
+	re := regexp.MustCompile(`(?:^|[^\w])(` + regexp.QuoteMeta(field) + `)\s*(?:[-+*/%|&^]?=(?:[^=]|$)|\.|\[)`)
+	match := re.FindSubmatchIndex(text)
+	if match == nil {
+		return 0
+	}
+	return int32(utf8.RuneCount(text[:match[2]])) + 1
+}
+
+// moduleSource returns the source of one of the config's modules, if it
+// can still be read and hasn't changed since the config was loaded.
+func (c *Config) moduleSource(ctx context.Context, path string) []byte {
+	if c.fileReader == nil {
+		return nil
+	}
+	for _, module := range c.Modules() {
+		if module.Path != path {
+			continue
+		}
+		source, err := c.fileReader.ReadFile(ctx, path)
+		if err != nil || moduleHash(source) != module.Hash {
+			return nil
+		}
+		return source
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"time"
+)
+
+// A FileStater is a FileReader that can report which version of a file it
+// would read, without reading it. CachingFileReader uses this to reuse
+// cached modules that haven't changed, Watch to poll for changes, and
+// Lockfile.Changed to compare modules against their recorded hashes.
+type FileStater interface {
+	FileReader
+
+	// Stat returns metadata for the file at the given path, which was
+	// returned from Resolve(). Fields the reader can't determine are left
+	// empty, and a zero FileInfo means the version is unknown.
+	Stat(ctx context.Context, path string) (FileInfo, error)
+}
+
+// FileInfo identifies a version of a file's content.
+type FileInfo struct {
+	// ModTime and Size are the modification time and length of the file.
+	ModTime time.Time
+	Size    int64
+
+	// ETag is an opaque version identifier, such as an HTTP entity tag or a
+	// git object ID.
+	ETag string
+
+	// Hash is a digest of the content, of the form "sha256:<hex>".
+	Hash string
+}
+
+// sameVersion reports whether two FileInfos are known to describe the same
+// content, using the most precise field that both of them have.
+func sameVersion(a, b FileInfo) bool {
+	switch {
+	case a.Hash != "" && b.Hash != "":
+		return a.Hash == b.Hash
+	case a.ETag != "" && b.ETag != "":
+		return a.ETag == b.ETag
+	case !a.ModTime.IsZero() && !b.ModTime.IsZero():
+		return a.ModTime.Equal(b.ModTime) && a.Size == b.Size
+	}
+	return false
+}
+
+// statFile calls r.Stat() if r is a FileStater, and otherwise reports that
+// the version is unknown.
+func statFile(ctx context.Context, r FileReader, path string) (FileInfo, error) {
+	if stater, ok := r.(FileStater); ok {
+		return stater.Stat(ctx, path)
+	}
+	return FileInfo{}, nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// +build go1.16
+
+package skycfg
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+)
+
+type fsFileReader struct {
+	fsys fs.FS
+}
+
+// NewFSFileReader returns a FileReader that resolves and loads files from
+// an fs.FS, such as an embed.FS compiled into the binary. Module names are
+// slash-separated paths relative to the root of fsys.
+func NewFSFileReader(fsys fs.FS) FileReader {
+	if fsys == nil {
+		panic("NewFSFileReader: nil filesystem")
+	}
+	return &fsFileReader{fsys}
+}
+
+func (r *fsFileReader) Resolve(ctx context.Context, name, fromPath string) (string, error) {
+	resolved := path.Clean("/" + name)[1:]
+	if !fs.ValidPath(resolved) {
+		return "", fmt.Errorf("load(%q): invalid module path", name)
+	}
+	return resolved, nil
+}
+
+func (r *fsFileReader) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	return fs.ReadFile(r.fsys, path)
+}
+
+func (r *fsFileReader) Stat(ctx context.Context, path string) (FileInfo, error) {
+	info, err := fs.Stat(r.fsys, path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{ModTime: info.ModTime(), Size: info.Size()}, nil
+}
@@ -0,0 +1,229 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+)
+
+var errGitReaderClosed = errors.New("git file reader is closed")
+
+// A GitReader is a FileReader that loads files from a git repository at a
+// pinned revision. Readers of a remote repository should be closed when
+// they're no longer needed, to remove their clone.
+type GitReader struct {
+	repo       string
+	defaultRef string
+
+	cloneMu sync.Mutex
+	gitDir  string // set once the repository is available
+	closed  bool
+
+	mu       sync.Mutex
+	resolved map[string]string // ref -> commit
+}
+
+var (
+	_ FileStater = (*GitReader)(nil)
+	_ io.Closer  = (*GitReader)(nil)
+)
+
+// GitFileReader returns a FileReader that loads files from a git repository
+// at a pinned revision, using the `git` command.
+//
+// Module names have the form "//path/to/file.sky@ref", where ref is a tag,
+// branch, or commit. If the ref is omitted, modules loaded from another git
+// module use the same commit as their importer, and the root module uses
+// defaultRef. Refs are resolved to commits once per reader, so all modules
+// loaded through the same reader see a consistent snapshot.
+//
+// The repo may be the path to a local clone, or a remote URL that will be
+// cloned (without a working tree) into a temporary directory on first use.
+// A clone that fails, for example because the caller's context was
+// canceled, is retried by the next call. Close removes the clone.
+func GitFileReader(repo, defaultRef string) *GitReader {
+	if repo == "" {
+		panic("GitFileReader: empty repository")
+	}
+	if defaultRef == "" {
+		defaultRef = "HEAD"
+	}
+	r := &GitReader{
+		repo:       repo,
+		defaultRef: defaultRef,
+		resolved:   make(map[string]string),
+	}
+	if !isRemoteGitRepo(repo) {
+		r.gitDir = repo
+	}
+	return r
+}
+
+func isRemoteGitRepo(repo string) bool {
+	return strings.Contains(repo, "://") || strings.HasPrefix(repo, "git@")
+}
+
+func (r *GitReader) ensureRepo(ctx context.Context) error {
+	r.cloneMu.Lock()
+	defer r.cloneMu.Unlock()
+	if r.closed {
+		return errGitReaderClosed
+	}
+	if r.gitDir != "" {
+		return nil
+	}
+	dir, err := ioutil.TempDir("", "skycfg-git-")
+	if err != nil {
+		return err
+	}
+	if _, err := r.git(ctx, "", "clone", "--quiet", "--bare", r.repo, dir); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	r.gitDir = dir
+	return nil
+}
+
+// Close removes the reader's clone of a remote repository. It has no
+// effect on a local repository. The reader can't be used after Close.
+func (r *GitReader) Close() error {
+	r.cloneMu.Lock()
+	defer r.cloneMu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if !isRemoteGitRepo(r.repo) || r.gitDir == "" {
+		return nil
+	}
+	return os.RemoveAll(r.gitDir)
+}
+
+func (r *GitReader) git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// splitGitRef splits "path@ref" into its path and ref components.
+func splitGitRef(name string) (string, string) {
+	if idx := strings.LastIndex(name, "@"); idx >= 0 {
+		return name[:idx], name[idx+1:]
+	}
+	return name, ""
+}
+
+func (r *GitReader) resolveRef(ctx context.Context, ref string) (string, error) {
+	r.mu.Lock()
+	commit, ok := r.resolved[ref]
+	r.mu.Unlock()
+	if ok {
+		return commit, nil
+	}
+	if strings.HasPrefix(ref, "-") {
+		return "", fmt.Errorf("invalid git ref %q", ref)
+	}
+	out, err := r.git(ctx, r.gitDir, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("unknown git ref %q", ref)
+	}
+	commit = strings.TrimSpace(string(out))
+	r.mu.Lock()
+	r.resolved[ref] = commit
+	r.mu.Unlock()
+	return commit, nil
+}
+
+func (r *GitReader) Resolve(ctx context.Context, name, fromPath string) (string, error) {
+	if err := r.ensureRepo(ctx); err != nil {
+		return "", err
+	}
+	modulePath, ref := splitGitRef(strings.TrimPrefix(name, "//"))
+	if ref == "" {
+		if _, fromRef := splitGitRef(fromPath); fromRef != "" {
+			ref = fromRef
+		} else {
+			ref = r.defaultRef
+		}
+	}
+	commit, err := r.resolveRef(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("load(%q): %v", name, err)
+	}
+	return fmt.Sprintf("%s@%s", path.Clean("/" + modulePath)[1:], commit), nil
+}
+
+func (r *GitReader) ReadFile(ctx context.Context, filename string) ([]byte, error) {
+	if err := r.ensureRepo(ctx); err != nil {
+		return nil, err
+	}
+	modulePath, commit := splitGitRef(filename)
+	content, err := r.git(ctx, r.gitDir, "show", fmt.Sprintf("%s:%s", commit, modulePath))
+	if err != nil {
+		if _, statErr := r.blobID(ctx, filename); errors.Is(statErr, fs.ErrNotExist) {
+			return nil, statErr
+		}
+		return nil, err
+	}
+	return content, nil
+}
+
+// Stat reports the ID of the blob at the file's pinned commit.
+func (r *GitReader) Stat(ctx context.Context, filename string) (FileInfo, error) {
+	if err := r.ensureRepo(ctx); err != nil {
+		return FileInfo{}, err
+	}
+	blob, err := r.blobID(ctx, filename)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{ETag: blob}, nil
+}
+
+// blobID returns the ID of the blob at the file's pinned commit. If the
+// commit has no such file, the error wraps fs.ErrNotExist.
+func (r *GitReader) blobID(ctx context.Context, filename string) (string, error) {
+	modulePath, commit := splitGitRef(filename)
+	out, err := r.git(ctx, r.gitDir, "rev-parse", "--verify", "--quiet", fmt.Sprintf("%s:%s", commit, modulePath))
+	// With --quiet, rev-parse reports a missing object only by its exit
+	// status.
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return "", fmt.Errorf("open %s: %w", filename, fs.ErrNotExist)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
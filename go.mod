@@ -1,13 +1,25 @@
 module github.com/stripe/skycfg
 
+go 1.23
+
 require (
+	github.com/bufbuild/protocompile v0.14.1
+	github.com/fsnotify/fsnotify v1.10.1
 	github.com/gogo/protobuf v1.1.1
-	github.com/golang/protobuf v1.2.0
+	github.com/golang/protobuf v1.5.4
 	github.com/kylelemons/godebug v0.0.0-20170820004349-d65d576e9348
 	go.starlark.net v0.0.0-20181108041844-f4938bde4080
-	golang.org/x/net v0.0.0-20180911220305-26e67e76b6c3 // indirect
-	golang.org/x/sync v0.0.0-20180314180146-1d60e4601c6f // indirect
+	google.golang.org/grpc v1.54.0
+	google.golang.org/protobuf v1.36.10
 	gopkg.in/yaml.v2 v2.2.1
 )
 
+require (
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.8.0 // indirect
+	google.golang.org/genproto v0.0.0-20230110181048-76db0878b65f // indirect
+)
+
 replace github.com/kylelemons/godebug => github.com/jmillikin-stripe/godebug v0.0.0-20180620173319-8279e1966bc1
@@ -0,0 +1,93 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+
+// Package grpcreflection provides a skycfg.ReflectionClient that uses a
+// gRPC connection, for skycfg.NewReflectionRegistry().
+//
+// It's a separate package so that programs that don't use it don't link
+// the gRPC client.
+package grpcreflection
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+
+	"github.com/stripe/skycfg"
+)
+
+// Client fetches file descriptors with the grpc.reflection.v1alpha
+// ServerReflection service, which servers registered with
+// google.golang.org/grpc/reflection provide.
+type Client struct {
+	client rpb.ServerReflectionClient
+}
+
+var _ skycfg.ReflectionClient = (*Client)(nil)
+
+// NewClient returns a Client for the server that conn is connected to.
+func NewClient(conn grpc.ClientConnInterface) *Client {
+	return &Client{client: rpb.NewServerReflectionClient(conn)}
+}
+
+// FileContainingSymbol implements skycfg.ReflectionClient.
+func (c *Client) FileContainingSymbol(ctx context.Context, symbol string) ([][]byte, error) {
+	return c.request(ctx, &rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol},
+	})
+}
+
+// FileByFilename implements skycfg.ReflectionClient.
+func (c *Client) FileByFilename(ctx context.Context, filename string) ([][]byte, error) {
+	return c.request(ctx, &rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: filename},
+	})
+}
+
+// request sends a request on its own ServerReflectionInfo stream, so that
+// the stream has the request's context. An ErrorResponse is returned as an
+// error with its status code.
+func (c *Client) request(ctx context.Context, req *rpb.ServerReflectionRequest) ([][]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.client.ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(req); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	switch msg := resp.MessageResponse.(type) {
+	case *rpb.ServerReflectionResponse_FileDescriptorResponse:
+		return msg.FileDescriptorResponse.GetFileDescriptorProto(), nil
+	case *rpb.ServerReflectionResponse_ErrorResponse:
+		return nil, status.Error(codes.Code(msg.ErrorResponse.GetErrorCode()), msg.ErrorResponse.GetErrorMessage())
+	default:
+		return nil, fmt.Errorf("unexpected reflection response %T", msg)
+	}
+}
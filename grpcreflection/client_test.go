@@ -0,0 +1,91 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+
+package grpcreflection_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/golang/protobuf/jsonpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/stripe/skycfg"
+	"github.com/stripe/skycfg/grpcreflection"
+)
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	reflection.Register(server)
+	go server.Serve(lis)
+	defer server.Stop()
+	conn, err := grpc.DialContext(ctx, "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := grpcreflection.NewClient(conn)
+
+	if _, err := client.FileContainingSymbol(ctx, "no.such.Symbol"); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+	if _, err := client.FileByFilename(ctx, "no/such/file.proto"); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+
+	// The server describes its reflection service, whose request type is
+	// constructed from the fetched descriptors.
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+reflection = proto.package("grpc.reflection.v1alpha")
+
+def main(ctx):
+	method = reflection.ServerReflection.methods[0]
+	return [method.input_type(host = "example.com")]
+`),
+	})
+	config, err := skycfg.Load(ctx, "main.sky",
+		skycfg.WithFileReader(reader),
+		skycfg.WithProtoRegistry(skycfg.NewReflectionRegistry(client, 0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := config.Main(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := (&jsonpb.Marshaler{}).MarshalToString(msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"host":"example.com"}`; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
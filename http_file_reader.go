@@ -0,0 +1,246 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+// An HTTPFileReaderOption adjusts details of how an HTTPFileReader fetches
+// modules.
+type HTTPFileReaderOption interface {
+	applyHTTP(*httpFileReader)
+}
+
+type fnHTTPFileReaderOption func(*httpFileReader)
+
+func (fn fnHTTPFileReaderOption) applyHTTP(r *httpFileReader) { fn(r) }
+
+// WithHTTPClient changes the client used to fetch modules. The default is
+// http.DefaultClient.
+func WithHTTPClient(client *http.Client) HTTPFileReaderOption {
+	if client == nil {
+		panic("WithHTTPClient: nil client")
+	}
+	return fnHTTPFileReaderOption(func(r *httpFileReader) {
+		r.client = client
+	})
+}
+
+// WithHTTPHeader adds a header to every request, for example to pass an
+// authentication token.
+func WithHTTPHeader(key, value string) HTTPFileReaderOption {
+	return fnHTTPFileReaderOption(func(r *httpFileReader) {
+		r.header.Add(key, value)
+	})
+}
+
+type httpCacheEntry struct {
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+type httpFileReader struct {
+	base   *url.URL
+	client *http.Client
+	header http.Header
+
+	mu    sync.Mutex
+	cache map[string]*httpCacheEntry
+}
+
+// HTTPFileReader returns a FileReader that resolves and loads files from an
+// HTTP or HTTPS server. Module names are resolved relative to baseURL, unless
+// they are themselves absolute URLs. Absolute URLs must have the same scheme
+// and host as baseURL, so that headers added with WithHTTPHeader are only
+// sent to that server.
+//
+// Responses are cached for the lifetime of the reader, and revalidated with
+// the server using their ETag or Last-Modified headers. Timeouts and
+// cancellation are controlled by the context passed to Load().
+func HTTPFileReader(baseURL string, opts ...HTTPFileReaderOption) (FileReader, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("HTTPFileReader: %v", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("HTTPFileReader: unsupported URL scheme %q", base.Scheme)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	r := &httpFileReader{
+		base:   base,
+		client: http.DefaultClient,
+		header: make(http.Header),
+		cache:  make(map[string]*httpCacheEntry),
+	}
+	for _, opt := range opts {
+		opt.applyHTTP(r)
+	}
+	return r, nil
+}
+
+func (r *httpFileReader) Resolve(ctx context.Context, name, fromPath string) (string, error) {
+	if u, err := url.Parse(name); err == nil && u.IsAbs() {
+		if !r.sameOrigin(u) {
+			return "", fmt.Errorf("load(%q): URL is not on %s://%s", name, r.base.Scheme, r.base.Host)
+		}
+		return u.String(), nil
+	}
+	rel, err := url.Parse(strings.TrimPrefix(path.Clean("/"+name), "/"))
+	if err != nil {
+		return "", fmt.Errorf("load(%q): %v", name, err)
+	}
+	return r.base.ResolveReference(rel).String(), nil
+}
+
+// Stat sends a HEAD request for the file, reporting its ETag and
+// Last-Modified headers.
+func (r *httpFileReader) Stat(ctx context.Context, path string) (FileInfo, error) {
+	req, err := r.newRequest(ctx, "HEAD", path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp, err := r.do(req)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return FileInfo{}, statusError("HEAD", path, resp)
+	}
+	info := FileInfo{ETag: resp.Header.Get("ETag")}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+		// A negative ContentLength means the server didn't report one.
+		if resp.ContentLength >= 0 {
+			info.Size = resp.ContentLength
+		}
+	}
+	return info, nil
+}
+
+// statusError reports an unsuccessful response. A 404 or 410 wraps
+// fs.ErrNotExist, so that callers can tell a missing module from an
+// unavailable server.
+func statusError(method, path string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return fmt.Errorf("%s %s: %s: %w", method, path, resp.Status, fs.ErrNotExist)
+	}
+	return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+}
+
+func (r *httpFileReader) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	req, err := r.newRequest(ctx, "GET", path)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	cached := r.cache[path]
+	r.mu.Unlock()
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, err := r.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached.body, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError("GET", path, resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &httpCacheEntry{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		body:         body,
+	}
+	if entry.etag != "" || entry.lastModified != "" {
+		r.mu.Lock()
+		r.cache[path] = entry
+		r.mu.Unlock()
+	}
+	return body, nil
+}
+
+func (r *httpFileReader) sameOrigin(u *url.URL) bool {
+	return strings.EqualFold(u.Scheme, r.base.Scheme) && strings.EqualFold(u.Host, r.base.Host)
+}
+
+// newRequest creates a request for path, adding the configured headers only
+// if path is on the base URL's server.
+func (r *httpFileReader) newRequest(ctx context.Context, method, path string) (*http.Request, error) {
+	req, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if r.sameOrigin(req.URL) {
+		for key, values := range r.header {
+			req.Header[key] = values
+		}
+	}
+	return req, nil
+}
+
+// do sends req, removing the configured headers from any redirect to
+// another server. The client copies most headers onto redirects itself.
+func (r *httpFileReader) do(req *http.Request) (*http.Response, error) {
+	client := *r.client
+	checkRedirect := client.CheckRedirect
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !r.sameOrigin(req.URL) {
+			for key := range r.header {
+				req.Header.Del(key)
+			}
+		}
+		if checkRedirect != nil {
+			return checkRedirect(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return client.Do(req)
+}
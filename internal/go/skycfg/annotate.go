@@ -0,0 +1,86 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+)
+
+// Annotate returns the `annotate()` built-in, which attaches string
+// metadata to a message so the program executing the config can route it.
+//
+//  def annotate(msg, **annotations) -> msg
+//
+// Annotations are merged with any set by earlier calls. They're attached
+// to the message value rather than its content, so copies made by
+// proto.clone() aren't annotated.
+func Annotate() starlark.Value {
+	return starlark.NewBuiltin("annotate", fnAnnotate)
+}
+
+func fnAnnotate(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var val starlark.Value
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, nil, 1, &val); err != nil {
+		return nil, err
+	}
+	msg, ok := val.(*skyProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.Message", fn.Name(), val.Type())
+	}
+	annotations := make(map[string]string, len(kwargs))
+	for _, kwarg := range kwargs {
+		key := string(kwarg[0].(starlark.String))
+		value, ok := kwarg[1].(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("%s: for parameter %s: got %s, want string", fn.Name(), key, kwarg[1].Type())
+		}
+		annotations[key] = string(value)
+	}
+	if err := msg.checkMutable("annotate"); err != nil {
+		return nil, err
+	}
+	msg.attrMu.Lock()
+	defer msg.attrMu.Unlock()
+	if msg.annotations == nil {
+		msg.annotations = make(map[string]string, len(annotations))
+	}
+	for key, value := range annotations {
+		msg.annotations[key] = value
+	}
+	return msg, nil
+}
+
+// MessageAnnotations returns a copy of the annotations attached to a
+// message value with `annotate()`, or nil if it has none.
+func MessageAnnotations(val starlark.Value) map[string]string {
+	msg, ok := val.(*skyProtoMessage)
+	if !ok {
+		return nil
+	}
+	msg.attrMu.Lock()
+	defer msg.attrMu.Unlock()
+	if len(msg.annotations) == 0 {
+		return nil
+	}
+	annotations := make(map[string]string, len(msg.annotations))
+	for key, value := range msg.annotations {
+		annotations[key] = value
+	}
+	return annotations
+}
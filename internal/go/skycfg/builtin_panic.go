@@ -0,0 +1,90 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// RecoverPanics returns a copy of val in which every builtin function,
+// including those in modules and structs, converts a panic into an error
+// instead of crashing the process. The error includes the panic value and
+// the Go stack of the panicking goroutine.
+//
+// Other values are returned unchanged.
+func RecoverPanics(val starlark.Value) starlark.Value {
+	return wrapBuiltins(val, "", recoverBuiltin)
+}
+
+// RecoverPanicsInDict applies RecoverPanics to each value of a StringDict,
+// returning a new StringDict.
+func RecoverPanicsInDict(dict starlark.StringDict) starlark.StringDict {
+	return wrapBuiltinsInDict(dict, "", recoverBuiltin)
+}
+
+func recoverBuiltin(b *starlark.Builtin, name string) *starlark.Builtin {
+	return replaceBuiltin(b, func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (result starlark.Value, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				result = nil
+				err = fmt.Errorf("%s: panic in Go builtin: %v\n\n%s", b.Name(), r, debug.Stack())
+			}
+		}()
+		return b.CallInternal(t, args, kwargs)
+	})
+}
+
+// wrapBuiltins returns a copy of val in which every builtin function,
+// including those in modules and structs, is replaced by the result of
+// wrap. The name passed to wrap is the dotted path from val, which is bound
+// to name, to the builtin; for example "k8s.get" for the builtin `get` of a
+// module bound to "k8s".
+func wrapBuiltins(val starlark.Value, name string, wrap func(b *starlark.Builtin, name string) *starlark.Builtin) starlark.Value {
+	switch val := val.(type) {
+	case *starlark.Builtin:
+		return wrap(val, name)
+	case *Module:
+		return &Module{Name: val.Name, Attrs: wrapBuiltinsInDict(val.Attrs, name+".", wrap)}
+	case *starlarkstruct.Struct:
+		attrs := make(starlark.StringDict)
+		val.ToStringDict(attrs)
+		return starlarkstruct.FromStringDict(val.Constructor(), wrapBuiltinsInDict(attrs, name+".", wrap))
+	}
+	return val
+}
+
+func wrapBuiltinsInDict(dict starlark.StringDict, prefix string, wrap func(b *starlark.Builtin, name string) *starlark.Builtin) starlark.StringDict {
+	wrapped := make(starlark.StringDict, len(dict))
+	for key, val := range dict {
+		wrapped[key] = wrapBuiltins(val, prefix+key, wrap)
+	}
+	return wrapped
+}
+
+// replaceBuiltin returns a builtin that calls fn, keeping the name and
+// receiver of b.
+func replaceBuiltin(b *starlark.Builtin, fn func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error)) *starlark.Builtin {
+	wrapped := starlark.NewBuiltin(b.Name(), fn)
+	if recv := b.Receiver(); recv != nil {
+		return wrapped.BindReceiver(recv)
+	}
+	return wrapped
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	"github.com/stripe/skycfg"
+	pb "github.com/stripe/skycfg/test_proto"
+)
+
+func TestCaches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skycfg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dirCache, err := skycfg.DirCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if skycfg.CacheKey([]byte("ab"), []byte("c")) == skycfg.CacheKey([]byte("a"), []byte("bc")) {
+		t.Error("expected CacheKey to distinguish how parts are split")
+	}
+	key := skycfg.CacheKey([]byte("module source"))
+	ctx := context.Background()
+	for name, cache := range map[string]skycfg.Cache{
+		"memory": skycfg.MemoryCache(),
+		"dir":    dirCache,
+	} {
+		if _, ok, err := cache.Get(ctx, key); ok || err != nil {
+			t.Errorf("%s: expected miss on empty cache, got (%v, %v)", name, ok, err)
+		}
+		put := []byte("value")
+		if err := cache.Put(ctx, key, put); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		put[0] = 'X'
+		value, ok, err := cache.Get(ctx, key)
+		if !ok || err != nil || string(value) != "value" {
+			t.Errorf("%s: expected hit, got (%q, %v, %v)", name, value, ok, err)
+			continue
+		}
+		// Values belong to the caller, so modifying one doesn't affect
+		// the cache.
+		value[0] = 'X'
+		if value, _, _ := cache.Get(ctx, key); string(value) != "value" {
+			t.Errorf("%s: expected stored value to be unchanged, got %q", name, value)
+		}
+	}
+
+	if _, _, err := dirCache.Get(ctx, "../escape"); err == nil {
+		t.Error("expected DirCache to reject keys that aren't digests")
+	}
+}
+
+type countingCache struct {
+	skycfg.Cache
+	hits, puts int
+}
+
+func (c *countingCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, ok, err := c.Cache.Get(ctx, key)
+	if ok {
+		c.hits++
+	}
+	return value, ok, err
+}
+
+func (c *countingCache) Put(ctx context.Context, key string, value []byte) error {
+	c.puts++
+	return c.Cache.Put(ctx, key, value)
+}
+
+func TestWithProgramCache(t *testing.T) {
+	ctx := context.Background()
+	files := map[string][]byte{
+		"main.sky": []byte(`load("lib.sky", "double")
+
+def main(ctx):
+	return [proto.package("skycfg.test_proto").MessageV3(f_int32 = double(ctx.vars["x"]))]
+`),
+		"lib.sky":          []byte("exports = [\"double\"]\n\ndef double(x):\n\treturn x * 2\n"),
+		"broken.sky":       []byte("load(\"lib.sky\", \"double\")\n\nX = double(None)\n"),
+		"uses_private.sky": []byte("load(\"lib.sky\", \"exports\")\n"),
+	}
+	cache := &countingCache{Cache: skycfg.MemoryCache()}
+	opts := []skycfg.LoadOption{
+		skycfg.WithFileReader(skycfg.MapFileReader(files)),
+		skycfg.WithProgramCache(cache),
+	}
+	for ii := 0; ii < 2; ii++ {
+		config, err := skycfg.Load(ctx, "main.sky", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs, err := config.Main(ctx, skycfg.WithVars(starlark.StringDict{"x": starlark.MakeInt(21)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := msgs[0].(*pb.MessageV3).GetFInt32(); got != 42 {
+			t.Errorf("load %d: got f_int32 = %d, want 42", ii, got)
+		}
+	}
+	if cache.puts != 2 || cache.hits != 2 {
+		t.Errorf("expected 2 puts and 2 hits, got %d puts and %d hits", cache.puts, cache.hits)
+	}
+
+	// Cached programs still enforce exports, and report positions in the
+	// original source.
+	_, err := skycfg.Load(ctx, "uses_private.sky", opts...)
+	if err == nil || !strings.Contains(err.Error(), "is not exported by lib.sky") {
+		t.Errorf("expected export error, got %v", err)
+	}
+	for ii := 0; ii < 2; ii++ {
+		_, err := skycfg.Load(ctx, "broken.sky", opts...)
+		var evalErr *starlark.EvalError
+		if !errors.As(err, &evalErr) || !strings.Contains(evalErr.Backtrace(), "broken.sky:3: in <toplevel>") {
+			t.Errorf("load %d: expected error with position, got %v", ii, err)
+		}
+	}
+}
+
+func TestProgramCacheKeysByContent(t *testing.T) {
+	ctx := context.Background()
+	main := []byte(`load("lib/common.sky", "value")
+
+def main(ctx):
+	return [proto.package("skycfg.test_proto").MessageV3(f_int32 = value)]
+`)
+	cache := skycfg.MemoryCache()
+	var hashes []string
+	for _, version := range []string{"1", "2"} {
+		reader := skycfg.MapFileReader(map[string][]byte{
+			"main.sky":       main,
+			"lib/common.sky": []byte("value = " + version + "\n"),
+		})
+		config, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(reader), skycfg.WithProgramCache(cache))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs, err := config.Main(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(msgs[0].(*pb.MessageV3).GetFInt32()); got != version {
+			t.Errorf("expected lib/common.sky version %s, got %s", version, got)
+		}
+		modules := config.Modules()
+		if len(modules) != 2 || modules[0].Path != "lib/common.sky" || modules[1].Path != "main.sky" {
+			t.Fatalf("unexpected modules: %+v", modules)
+		}
+		if !strings.HasPrefix(modules[0].Hash, "sha256:") {
+			t.Errorf("unexpected hash %q", modules[0].Hash)
+		}
+		hashes = append(hashes, modules[0].Hash, modules[1].Hash)
+	}
+	if hashes[0] == hashes[2] || hashes[1] != hashes[3] {
+		t.Errorf("expected hashes to match module content, got %q", hashes)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"go.starlark.net/syntax"
+)
+
+// A CoverageBlock is a function body or branch of a module that was
+// instrumented by InstrumentCoverage.
+type CoverageBlock struct {
+	// Pos is the position of the def, if, elif, else, or for keyword that
+	// introduces the block.
+	Pos syntax.Position
+
+	// Kind is "def", "if", "elif", "else", or "for".
+	Kind string
+
+	// Func is the name of the function the block is in, or of the function
+	// itself for a "def" block. It's empty for branches at the top level.
+	Func string
+}
+
+type coverageInsert struct {
+	pos  syntax.Position
+	text string
+}
+
+// InstrumentCoverage returns the source of a parsed module with a call to
+// the probe function inserted at the start of each function body and
+// branch, so that the blocks executed can be recorded. The probe is called
+// as probe(id, index), where index locates the block in the returned slice,
+// and must return False.
+//
+// Calls are inserted on the same line as the code they precede, so the
+// positions of errors are unchanged except for their columns. A block's
+// call precedes its first statement or, if that's an if or for statement,
+// is part of its condition or iterable.
+func InstrumentCoverage(f *syntax.File, src []byte, probe string, id int) ([]byte, []CoverageBlock) {
+	var blocks []CoverageBlock
+	var inserts []coverageInsert
+	addBlock := func(body []syntax.Stmt, block CoverageBlock) {
+		call := fmt.Sprintf("%s(%d, %d)", probe, id, len(blocks))
+		// A compound statement can't follow a semicolon.
+		switch stmt := body[0].(type) {
+		case *syntax.IfStmt:
+			inserts = append(inserts,
+				coverageInsert{syntax.Start(stmt.Cond), call + " or ("},
+				coverageInsert{syntax.End(stmt.Cond), ")"})
+		case *syntax.ForStmt:
+			inserts = append(inserts,
+				coverageInsert{syntax.Start(stmt.X), call + " or ("},
+				coverageInsert{syntax.End(stmt.X), ")"})
+		default:
+			inserts = append(inserts, coverageInsert{syntax.Start(stmt), call + "; "})
+		}
+		blocks = append(blocks, block)
+	}
+	var walk func(stmts []syntax.Stmt, funcName string)
+	walk = func(stmts []syntax.Stmt, funcName string) {
+		for _, stmt := range stmts {
+			switch stmt := stmt.(type) {
+			case *syntax.DefStmt:
+				addBlock(stmt.Body, CoverageBlock{Pos: stmt.Def, Kind: "def", Func: stmt.Name.Name})
+				walk(stmt.Body, stmt.Name.Name)
+			case *syntax.ForStmt:
+				addBlock(stmt.Body, CoverageBlock{Pos: stmt.For, Kind: "for", Func: funcName})
+				walk(stmt.Body, funcName)
+			case *syntax.IfStmt:
+				walkIf(stmt, "if", funcName, addBlock, walk)
+			}
+		}
+	}
+	walk(f.Stmts, "")
+	return applyInserts(src, inserts), blocks
+}
+
+func walkIf(stmt *syntax.IfStmt, kind, funcName string, addBlock func([]syntax.Stmt, CoverageBlock), walk func([]syntax.Stmt, string)) {
+	addBlock(stmt.True, CoverageBlock{Pos: stmt.If, Kind: kind, Func: funcName})
+	walk(stmt.True, funcName)
+	if len(stmt.False) == 0 {
+		return
+	}
+	// An elif is parsed as an if statement that's the only statement of
+	// the else branch, starting at the else position.
+	if elif, ok := stmt.False[0].(*syntax.IfStmt); ok && len(stmt.False) == 1 && elif.If == stmt.ElsePos {
+		walkIf(elif, "elif", funcName, addBlock, walk)
+		return
+	}
+	addBlock(stmt.False, CoverageBlock{Pos: stmt.ElsePos, Kind: "else", Func: funcName})
+	walk(stmt.False, funcName)
+}
+
+// applyInserts returns src with text inserted at each position.
+func applyInserts(src []byte, inserts []coverageInsert) []byte {
+	sort.SliceStable(inserts, func(i, j int) bool {
+		a, b := inserts[i].pos, inserts[j].pos
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	var out bytes.Buffer
+	offset := 0
+	line, col := int32(1), int32(1)
+	for _, insert := range inserts {
+		// Advance to the insert's position, counting columns in runes as
+		// the scanner does.
+		for offset < len(src) && (line < insert.pos.Line || line == insert.pos.Line && col < insert.pos.Col) {
+			r, size := utf8.DecodeRune(src[offset:])
+			out.Write(src[offset : offset+size])
+			offset += size
+			if r == '\n' {
+				line, col = line+1, 1
+			} else if r != '\r' {
+				col++
+			}
+		}
+		out.WriteString(insert.text)
+	}
+	out.Write(src[offset:])
+	return out.Bytes()
+}
@@ -0,0 +1,239 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// A FieldError reports a Starlark value that couldn't be assigned to a
+// Protobuf field, or a field that the message doesn't have. The other
+// fields let tools such as editors report the error in more detail than
+// its message.
+type FieldError struct {
+	// MessageType is the full name of the message containing the field.
+	MessageType string
+
+	// Field describes the field being assigned, or is nil if the message
+	// has no such field.
+	Field protoreflect.FieldDescriptor
+
+	// Path locates the rejected value, starting from the outermost message
+	// it was assigned through. For example, "f_submsg.r_string[2]".
+	Path string
+
+	// ExpectedType is the name of the type the value needed to have, such
+	// as "int32" or "skycfg.test_proto.MessageV3", and ExpectedKind is the
+	// Go kind of that type.
+	ExpectedType string
+	ExpectedKind reflect.Kind
+
+	// Value is the rejected value.
+	Value starlark.Value
+
+	// Pos is where the value was assigned in the config, if the error was
+	// recovered from a Starlark error by FieldErrorOf(). Its column is
+	// only known if it's been filled in from the source.
+	Pos syntax.Position
+
+	err error
+
+	// cause is the Starlark error that the FieldError was recovered from.
+	cause error
+}
+
+func (e *FieldError) Error() string {
+	msg := e.err.Error()
+	// Paths are only mentioned when the value was assigned through a
+	// submessage, where the field name alone would be ambiguous.
+	if strings.Contains(e.Path, ".") {
+		msg = fmt.Sprintf("%s (field %s)", msg, e.Path)
+	}
+	if e.Pos.IsValid() {
+		return fmt.Sprintf("%s: %s", e.Pos, msg)
+	}
+	return msg
+}
+
+// Unwrap returns the *starlark.EvalError that the FieldError was recovered
+// from, if any, so that its backtrace is still available.
+func (e *FieldError) Unwrap() error { return e.cause }
+
+// FieldName returns the name of the field being assigned, which is the
+// last element of its Path.
+func (e *FieldError) FieldName() string {
+	name := e.Path
+	if idx := strings.LastIndex(name, "."); idx >= 0 {
+		name = name[idx+1:]
+	}
+	if idx := strings.Index(name, "["); idx >= 0 {
+		name = name[:idx]
+	}
+	return name
+}
+
+// unknownFieldError reports an attempt to set a field that a message
+// doesn't have.
+func unknownFieldError(msgType, path string, value starlark.Value, format string, args ...interface{}) *FieldError {
+	return &FieldError{
+		MessageType: msgType,
+		Path:        path,
+		Value:       value,
+		err:         fmt.Errorf(format, args...),
+	}
+}
+
+// A fieldErrorLog records the latest FieldError from the messages created
+// by a thread. Starlark reports errors from built-ins and from setting
+// attributes as plain messages, so the log lets FieldErrorOf() recover the
+// details.
+type fieldErrorLog struct {
+	mu   sync.Mutex
+	last *FieldError
+}
+
+// RecordFieldErrors sets the thread to record the FieldErrors of messages
+// it creates, so that FieldErrorOf() can recover them from its errors.
+func RecordFieldErrors(t *starlark.Thread) {
+	t.SetLocal("field_errors", &fieldErrorLog{})
+}
+
+func fieldErrors(t *starlark.Thread) *fieldErrorLog {
+	if t == nil {
+		return nil
+	}
+	log, _ := t.Local("field_errors").(*fieldErrorLog)
+	return log
+}
+
+func (log *fieldErrorLog) record(err error) error {
+	if fieldErr, ok := err.(*FieldError); ok && log != nil {
+		log.mu.Lock()
+		log.last = fieldErr
+		log.mu.Unlock()
+	}
+	return err
+}
+
+// FieldErrorOf returns the FieldError that caused an error from a thread
+// that records them, with its Pos set to the line of the Starlark code
+// that assigned the field.
+func FieldErrorOf(t *starlark.Thread, err error) (*FieldError, bool) {
+	log := fieldErrors(t)
+	var evalErr *starlark.EvalError
+	if log == nil || !errors.As(err, &evalErr) {
+		return nil, false
+	}
+	log.mu.Lock()
+	last := log.last
+	log.mu.Unlock()
+	if last == nil || !strings.HasSuffix(evalErr.Msg, last.Error()) {
+		return nil, false
+	}
+	recovered := *last
+	recovered.cause = err
+	// Errors from built-ins, such as message constructors, are reported
+	// in the built-in's frame; the assignment is in its caller's.
+	for fr := evalErr.Frame; fr != nil; fr = fr.Parent() {
+		if _, ok := fr.Callable().(*starlark.Function); ok {
+			recovered.Pos = fr.Position()
+			break
+		}
+	}
+	return &recovered, true
+}
+
+// A conversionError is a TypeError or ValueError from converting a Starlark
+// value to Go, before it's been associated with a field.
+type conversionError struct {
+	expectedType string
+	expectedKind reflect.Kind
+	value        starlark.Value
+
+	// suffix locates the value within a list or dict, such as "[2]".
+	suffix string
+	err    error
+}
+
+func (e *conversionError) Error() string { return e.err.Error() }
+
+func newConversionError(t reflect.Type, sky starlark.Value, format string, args ...interface{}) error {
+	kind := t.Kind()
+	if kind == reflect.Ptr {
+		kind = t.Elem().Kind()
+	}
+	return &conversionError{
+		expectedType: typeName(t),
+		expectedKind: kind,
+		value:        sky,
+		err:          fmt.Errorf(format, args...),
+	}
+}
+
+// withIndex records that a conversion error happened within a list element
+// or dict entry.
+func withIndex(err error, index string) error {
+	if convErr, ok := err.(*conversionError); ok {
+		convErr.suffix = "[" + index + "]" + convErr.suffix
+	}
+	return err
+}
+
+// A fieldRef locates a field, for reporting conversion errors.
+type fieldRef struct {
+	msgType string
+	field   protoreflect.FieldDescriptor
+	path    string
+	log     *fieldErrorLog
+}
+
+func joinFieldPath(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// wrap converts a conversion error into a *FieldError. Other errors are
+// returned unchanged.
+func (ref fieldRef) wrap(err error, index string) error {
+	convErr, ok := err.(*conversionError)
+	if !ok || ref.field == nil {
+		return err
+	}
+	path := ref.path
+	if index != "" {
+		path += "[" + index + "]"
+	}
+	return ref.log.record(&FieldError{
+		MessageType:  ref.msgType,
+		Field:        ref.field,
+		Path:         path + convErr.suffix,
+		ExpectedType: convErr.expectedType,
+		ExpectedKind: convErr.expectedKind,
+		Value:        convErr.value,
+		err:          convErr.err,
+	})
+}
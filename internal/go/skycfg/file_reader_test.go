@@ -0,0 +1,901 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stripe/skycfg"
+)
+
+func TestHTTPFileReader(t *testing.T) {
+	var requests, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		switch req.URL.Path {
+		case "/libs/main.sky":
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(`load("common/helper.sky", "helper")` + "\ndef main(ctx):\n  return helper()\n"))
+		case "/libs/common/helper.sky":
+			w.Write([]byte("def helper():\n  return []\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	reader, err := skycfg.HTTPFileReader(srv.URL+"/libs", skycfg.WithHTTPHeader("Authorization", "Bearer token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for ii := 0; ii < 2; ii++ {
+		config, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(reader))
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		if _, err := config.Main(ctx); err != nil {
+			t.Fatalf("Main: %v", err)
+		}
+	}
+	if requests != 4 || notModified != 1 {
+		t.Errorf("expected 4 requests with 1 cache revalidation, got %d requests and %d revalidations", requests, notModified)
+	}
+
+	if _, err := skycfg.Load(ctx, "missing.sky", skycfg.WithFileReader(reader)); err == nil {
+		t.Error("expected error loading a missing module")
+	}
+	missing, err := reader.Resolve(ctx, "missing.sky", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.ReadFile(ctx, missing); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a 404 to wrap fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestHTTPFileReaderOrigin(t *testing.T) {
+	var leaked []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if token := req.Header.Get("X-Token"); token != "" {
+			leaked = append(leaked, req.URL.Path)
+		}
+		w.Write([]byte("def helper():\n  return []\n"))
+	}))
+	defer other.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/absolute.sky":
+			fmt.Fprintf(w, "load(%q, \"helper\")\n", other.URL+"/helper.sky")
+		case "/redirect.sky":
+			w.Write([]byte(`load("moved.sky", "helper")` + "\n"))
+		case "/moved.sky":
+			http.Redirect(w, req, other.URL+"/helper.sky", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	reader, err := skycfg.HTTPFileReader(srv.URL, skycfg.WithHTTPHeader("X-Token", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	_, err = skycfg.Load(ctx, "absolute.sky", skycfg.WithFileReader(reader))
+	if err == nil || !strings.Contains(err.Error(), "URL is not on "+srv.URL) {
+		t.Errorf("expected error loading from another server, got %v", err)
+	}
+	if _, err := skycfg.Load(ctx, "redirect.sky", skycfg.WithFileReader(reader)); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(leaked) != 0 {
+		t.Errorf("headers were sent to another server for %v", leaked)
+	}
+}
+
+func TestMapFileReader(t *testing.T) {
+	files := map[string][]byte{
+		"main.sky": []byte(`
+load("/libs/helper.sky", "helper")
+
+def main(ctx):
+	return helper()
+`),
+		"libs/helper.sky": []byte(`
+def helper():
+	return []
+`),
+	}
+	reader := skycfg.MapFileReader(files)
+	delete(files, "libs/helper.sky")
+
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Main(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := skycfg.Load(ctx, "missing.sky", skycfg.WithFileReader(reader)); err == nil {
+		t.Error("expected error loading a missing module")
+	}
+}
+
+func TestGitFileReader(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	repo, err := ioutil.TempDir("", "skycfg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repo)
+
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	writeFile := func(name, content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(repo, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	git("init", "--quiet")
+	writeFile("main.sky", "load(\"//lib.sky\", \"VALUE\")\ndef main(ctx):\n  return [] if VALUE == \"v1\" else fail(VALUE)\n")
+	writeFile("lib.sky", "VALUE = \"v1\"\n")
+	git("add", ".")
+	git("commit", "--quiet", "-m", "v1")
+	git("tag", "v1.0.0")
+	writeFile("lib.sky", "VALUE = \"v2\"\n")
+	git("commit", "--quiet", "-a", "-m", "v2")
+
+	ctx := context.Background()
+	reader := skycfg.GitFileReader(repo, "HEAD")
+	config, err := skycfg.Load(ctx, "//main.sky@v1.0.0", skycfg.WithFileReader(reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Main(ctx); err != nil {
+		t.Errorf("expected modules to be loaded at the pinned ref: %v", err)
+	}
+
+	config, err = skycfg.Load(ctx, "//main.sky", skycfg.WithFileReader(reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Main(ctx); err == nil {
+		t.Error("expected modules to be loaded at the default ref")
+	}
+
+	if _, err := skycfg.Load(ctx, "//main.sky@no-such-ref", skycfg.WithFileReader(reader)); err == nil {
+		t.Error("expected error loading an unknown ref")
+	}
+	missing, err := reader.Resolve(ctx, "//missing.sky", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.ReadFile(ctx, missing); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a missing file to wrap fs.ErrNotExist, got %v", err)
+	}
+
+	// A remote repository is cloned into a temporary directory, which Close
+	// removes. A clone that fails isn't remembered.
+	tmp, err := ioutil.TempDir("", "skycfg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	t.Setenv("TMPDIR", tmp)
+	remote := skycfg.GitFileReader("file://"+repo, "v1.0.0")
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := skycfg.Load(canceled, "//main.sky", skycfg.WithFileReader(remote)); err == nil {
+		t.Error("expected error cloning with a canceled context")
+	}
+	config, err = skycfg.Load(ctx, "//main.sky", skycfg.WithFileReader(remote))
+	if err != nil {
+		t.Fatalf("expected a failed clone to be retried: %v", err)
+	}
+	if _, err := config.Main(ctx); err != nil {
+		t.Error(err)
+	}
+	if clones, _ := filepath.Glob(filepath.Join(tmp, "skycfg-git-*")); len(clones) != 1 {
+		t.Errorf("expected one clone, got %v", clones)
+	}
+	if err := remote.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if clones, _ := filepath.Glob(filepath.Join(tmp, "skycfg-git-*")); len(clones) != 0 {
+		t.Errorf("expected Close to remove the clone, got %v", clones)
+	}
+	if _, err := skycfg.Load(ctx, "//main.sky", skycfg.WithFileReader(remote)); err == nil {
+		t.Error("expected error loading through a closed reader")
+	}
+}
+
+func TestObjectStoreFileReaders(t *testing.T) {
+	var failures int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") && auth != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// Fail the first request to each object, to exercise retries.
+		if failures%2 == 0 {
+			failures++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		failures++
+		switch req.URL.EscapedPath() {
+		case "/bucket/main.sky", "/storage/v1/b/bucket/o/main.sky":
+			w.Header().Set("ETag", `"main-v1"`)
+			w.Write([]byte("load(\"lib/helper.sky\", \"helper\")\ndef main(ctx):\n  return helper()\n"))
+		case "/bucket/lib/helper.sky", "/storage/v1/b/bucket/o/lib%2Fhelper.sky":
+			w.Write([]byte("def helper():\n  return []\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	awsCreds := func(ctx context.Context) (skycfg.AWSCredentials, error) {
+		return skycfg.AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+	}
+	gcsToken := func(ctx context.Context) (string, error) {
+		return "token", nil
+	}
+	readers := map[string]skycfg.FileReader{
+		"s3":  skycfg.S3FileReader("bucket", "us-east-1", awsCreds, skycfg.WithObjectStoreEndpoint(srv.URL)),
+		"gcs": skycfg.GCSFileReader("bucket", gcsToken, skycfg.WithObjectStoreEndpoint(srv.URL)),
+	}
+	ctx := context.Background()
+	for name, reader := range readers {
+		config, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(reader))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if _, err := config.Main(ctx); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if _, err := skycfg.Load(ctx, "missing.sky", skycfg.WithFileReader(reader)); err == nil {
+			t.Errorf("%s: expected error loading a missing module", name)
+		}
+		missing, err := reader.Resolve(ctx, "missing.sky", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reader.ReadFile(ctx, missing); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: expected a 404 to wrap fs.ErrNotExist, got %v", name, err)
+		}
+		path, err := reader.Resolve(ctx, "main.sky", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := reader.(skycfg.FileStater).Stat(ctx, path)
+		if err != nil {
+			t.Errorf("%s: Stat: %v", name, err)
+		} else if info.ETag != `"main-v1"` {
+			t.Errorf("%s: Stat: got ETag %q, want %q", name, info.ETag, `"main-v1"`)
+		}
+	}
+}
+
+func TestMultiFileReader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/lib.sky":
+			w.Write([]byte("load(\"helper.sky\", \"helper\")\nlib = helper\n"))
+		case "/helper.sky":
+			w.Write([]byte("def helper():\n  return []\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	httpReader, err := skycfg.HTTPFileReader(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := skycfg.MultiFileReader(
+		map[string]skycfg.FileReader{"http": httpReader},
+		skycfg.MapFileReader(map[string][]byte{
+			"main.sky": []byte("load(\"" + srv.URL + "/lib.sky\", \"lib\")\ndef main(ctx):\n  return lib()\n"),
+			"bad.sky":  []byte("load(\"ftp://example.com/lib.sky\", \"lib\")\n"),
+		}),
+	)
+
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Main(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := skycfg.Load(ctx, "bad.sky", skycfg.WithFileReader(reader)); err == nil {
+		t.Error("expected error loading a module with an unknown scheme")
+	}
+}
+
+type countingReader struct {
+	skycfg.FileReader
+	reads int
+}
+
+func (r *countingReader) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	r.reads++
+	return r.FileReader.ReadFile(ctx, path)
+}
+
+func TestCachingFileReader(t *testing.T) {
+	inner := &countingReader{FileReader: skycfg.MapFileReader(map[string][]byte{
+		"main.sky":   []byte("load(\"helper.sky\", \"helper\")\ndef main(ctx):\n  return helper()\n"),
+		"helper.sky": []byte("def helper():\n  return []\n"),
+	})}
+	ctx := context.Background()
+	load := func(reader skycfg.FileReader) {
+		t.Helper()
+		if _, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(reader)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader := skycfg.CachingFileReader(inner, 0)
+	load(reader)
+	load(reader)
+	if inner.reads != 2 {
+		t.Errorf("expected 2 reads of the inner reader, got %d", inner.reads)
+	}
+	if stats := reader.Stats(); stats.Hits != 4 || stats.Misses != 4 {
+		t.Errorf("expected 4 hits and 4 misses, got %+v", stats)
+	}
+
+	reader.Invalidate("helper.sky")
+	load(reader)
+	if inner.reads != 3 {
+		t.Errorf("expected invalidated module to be re-read, got %d reads", inner.reads)
+	}
+
+	reader.InvalidateAll()
+	load(reader)
+	if inner.reads != 5 {
+		t.Errorf("expected all modules to be re-read, got %d reads", inner.reads)
+	}
+
+	expiring := skycfg.CachingFileReader(inner, time.Millisecond)
+	load(expiring)
+	time.Sleep(5 * time.Millisecond)
+	load(expiring)
+	if inner.reads != 9 {
+		t.Errorf("expected expired entries to be re-read, got %d reads", inner.reads)
+	}
+
+	// Like zero, a negative TTL never expires.
+	forever := skycfg.CachingFileReader(inner, -time.Second)
+	load(forever)
+	load(forever)
+	if inner.reads != 11 {
+		t.Errorf("expected 2 more reads with a negative TTL, got %d reads", inner.reads)
+	}
+}
+
+// countingStater is a countingReader that also implements Stat().
+type countingStater struct {
+	countingReader
+	stater skycfg.FileStater
+}
+
+func (r *countingStater) Stat(ctx context.Context, path string) (skycfg.FileInfo, error) {
+	return r.stater.Stat(ctx, path)
+}
+
+func TestCachingFileReaderRevalidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skycfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "main.sky")
+	if err := ioutil.WriteFile(path, []byte("X = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	local := skycfg.LocalFileReader(dir).(skycfg.FileStater)
+	inner := &countingStater{countingReader{FileReader: local}, local}
+	reader := skycfg.CachingFileReader(inner, time.Nanosecond)
+	ctx := context.Background()
+	read := func() string {
+		t.Helper()
+		content, err := reader.ReadFile(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	read()
+	read()
+	if inner.reads != 1 {
+		t.Errorf("expected unchanged file to be read once, got %d reads", inner.reads)
+	}
+	if stats := reader.Stats(); stats.Revalidations != 1 {
+		t.Errorf("expected 1 revalidation, got %+v", stats)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("X = 12345\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); got != "X = 12345\n" {
+		t.Errorf("expected changed file to be re-read, got %q", got)
+	}
+	if inner.reads != 2 {
+		t.Errorf("expected 2 reads of the inner reader, got %d", inner.reads)
+	}
+}
+
+func TestCachingFileReaderModuleCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skycfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "main.sky")
+	if err := ioutil.WriteFile(path, []byte("X = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	local := skycfg.LocalFileReader(dir).(skycfg.FileStater)
+	inner := &countingStater{countingReader{FileReader: local}, local}
+	cache := skycfg.MemoryCache()
+	ctx := context.Background()
+	read := func() string {
+		t.Helper()
+		// Each reader starts empty, like one in a new process.
+		reader := skycfg.CachingFileReader(inner, 0, skycfg.WithModuleCache(cache))
+		content, err := reader.ReadFile(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	read()
+	if got := read(); got != "X = 1\n" {
+		t.Errorf("expected cached content, got %q", got)
+	}
+	if inner.reads != 1 {
+		t.Errorf("expected unchanged file to be read once, got %d reads", inner.reads)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("X = 12345\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); got != "X = 12345\n" {
+		t.Errorf("expected changed file to be re-read, got %q", got)
+	}
+	if inner.reads != 2 {
+		t.Errorf("expected 2 reads of the inner reader, got %d", inner.reads)
+	}
+}
+
+func TestLocalFileReaderContainment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skycfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	files := map[string]string{
+		"root/main.sky":      "load(\"lib.sky\", \"X\")\nRESULT = X\n",
+		"root/lib.sky":       "X = 1\n",
+		"root/leak.sky":      "load(\"link.sky\", \"SECRET\")\nRESULT = SECRET\n",
+		"outside/secret.sky": "SECRET = \"hunter2\"\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join("..", "outside", "secret.sky"), filepath.Join(root, "link.sky")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	ctx := context.Background()
+
+	if _, err := skycfg.Load(ctx, filepath.Join(root, "leak.sky")); err != nil {
+		t.Fatalf("expected symlink to be followed by default, got %v", err)
+	}
+
+	var audited []string
+	reader := skycfg.LocalFileReader(root, skycfg.WithContainment(), skycfg.WithReadAudit(func(path string, err error) {
+		rel, _ := filepath.Rel(dir, path)
+		audited = append(audited, fmt.Sprintf("%s %v", filepath.ToSlash(rel), err == nil))
+	}))
+	if _, err := skycfg.Load(ctx, filepath.Join(root, "main.sky"), skycfg.WithFileReader(reader)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = skycfg.Load(ctx, filepath.Join(root, "leak.sky"), skycfg.WithFileReader(reader))
+	if err == nil || !strings.Contains(err.Error(), "link.sky: path is outside of") {
+		t.Errorf("expected error loading through a symlink out of root, got %v", err)
+	}
+	_, err = skycfg.Load(ctx, filepath.Join(dir, "outside", "secret.sky"), skycfg.WithFileReader(reader))
+	if err == nil || !strings.Contains(err.Error(), "path is outside of") {
+		t.Errorf("expected error loading a top-level module outside of root, got %v", err)
+	}
+
+	want := []string{
+		"root/main.sky true",
+		"root/lib.sky true",
+		"root/leak.sky true",
+		"root/link.sky false",
+		"outside/secret.sky false",
+	}
+	if !reflect.DeepEqual(audited, want) {
+		t.Errorf("audited reads: got %v, want %v", audited, want)
+	}
+}
+
+func TestLocalFileReaderRelativeLoads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skycfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"main.sky":               "load(\"apps/web/web.sky\", \"WEB\")\nRESULT = WEB\n",
+		"apps/web/web.sky":       "load(\"./ports.sky\", \"PORT\")\nload(\"../../shared/lib.sky\", \"NAME\")\nWEB = NAME + \":\" + str(PORT)\n",
+		"apps/web/ports.sky":     "PORT = 8080\n",
+		"shared/lib.sky":         "NAME = \"web\"\n",
+		"escape.sky":             "load(\"../outside.sky\", \"X\")\n",
+		"apps/root_relative.sky": "load(\"./shared/lib.sky\", \"NAME\")\nRESULT = NAME\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+
+	config, err := skycfg.Load(ctx, filepath.Join(dir, "main.sky"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Locals()["RESULT"].String(); got != `"web:8080"` {
+		t.Errorf("got RESULT = %s, want \"web:8080\"", got)
+	}
+
+	_, err = skycfg.Load(ctx, filepath.Join(dir, "escape.sky"))
+	if err == nil || !strings.Contains(err.Error(), `load("../outside.sky"): path is outside of`) {
+		t.Errorf("expected error for load() outside of root, got %v", err)
+	}
+
+	rootRelative := skycfg.WithFileReader(skycfg.LocalFileReader(dir, skycfg.WithRootRelativeLoads()))
+	config, err = skycfg.Load(ctx, filepath.Join(dir, "apps/root_relative.sky"), rootRelative)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Locals()["RESULT"].String(); got != `"web"` {
+		t.Errorf("got RESULT = %s, want \"web\"", got)
+	}
+	if _, err := skycfg.Load(ctx, filepath.Join(dir, "apps/root_relative.sky")); err == nil {
+		t.Errorf("expected apps/root_relative.sky to fail without WithRootRelativeLoads")
+	}
+}
+
+func TestLocalFileReaderPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skycfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"project/main.sky":        "load(\"lib/common.sky\", \"NAME\", \"PORT\")\nRESULT = NAME + \":\" + str(PORT)\n",
+		"project/lib/common.sky":  "load(\"./defaults.sky\", \"PORT\")\nNAME = \"project\"\n",
+		"shared/lib/common.sky":   "load(\"./defaults.sky\", \"PORT\")\nNAME = \"shared\"\n",
+		"shared/lib/defaults.sky": "PORT = 8080\n",
+		"project/missing.sky":     "load(\"lib/missing.sky\", \"X\")\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	reader := skycfg.WithFileReader(skycfg.LocalFileReaderPath(
+		filepath.Join(dir, "project"),
+		filepath.Join(dir, "shared"),
+	))
+
+	// ./defaults.sky is relative to project/lib, so it isn't found in shared/lib.
+	_, err = skycfg.Load(ctx, filepath.Join(dir, "project/main.sky"), reader)
+	if err == nil || !strings.Contains(err.Error(), "defaults.sky") {
+		t.Fatalf("expected error loading ./defaults.sky, got %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "project/lib/common.sky")); err != nil {
+		t.Fatal(err)
+	}
+	config, err := skycfg.Load(ctx, filepath.Join(dir, "project/main.sky"), reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Locals()["RESULT"].String(); got != `"shared:8080"` {
+		t.Errorf("got RESULT = %s, want \"shared:8080\"", got)
+	}
+
+	_, err = skycfg.Load(ctx, filepath.Join(dir, "project/missing.sky"), reader)
+	if err == nil || !strings.Contains(err.Error(), `load("lib/missing.sky"): module not found in search path`) {
+		t.Errorf("expected search path error, got %v", err)
+	}
+}
+
+// flakyReader fails the first `failures` calls to ReadFile, or blocks until
+// the context is done if `hang` is set.
+type flakyReader struct {
+	skycfg.FileReader
+	failures int
+	hang     bool
+	calls    int
+}
+
+func (r *flakyReader) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	r.calls++
+	if r.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if r.calls <= r.failures {
+		return nil, fmt.Errorf("flaky failure %d", r.calls)
+	}
+	return r.FileReader.ReadFile(ctx, path)
+}
+
+// fakeClock is a skycfg.Clock whose time only moves when a test advances
+// it. Waits end immediately, and are recorded.
+type fakeClock struct {
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.waits = append(c.waits, d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func TestResilientFileReader(t *testing.T) {
+	ctx := context.Background()
+	files := skycfg.MapFileReader(map[string][]byte{"main.sky": []byte("X = 1\n")})
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+
+	flaky := &flakyReader{FileReader: files, failures: 2}
+	reader := skycfg.ResilientFileReader(flaky,
+		skycfg.WithRetries(2, time.Second),
+		skycfg.WithClock(clock),
+	)
+	if _, err := reader.ReadFile(ctx, "main.sky"); err != nil {
+		t.Errorf("expected success after retries, got %v", err)
+	}
+	if flaky.calls != 3 {
+		t.Errorf("expected 3 calls, got %d", flaky.calls)
+	}
+	if want := []time.Duration{time.Second, 2 * time.Second}; !reflect.DeepEqual(clock.waits, want) {
+		t.Errorf("expected backoff %v, got %v", want, clock.waits)
+	}
+
+	missing := &flakyReader{FileReader: files}
+	reader = skycfg.ResilientFileReader(missing,
+		skycfg.WithRetries(2, time.Second),
+		skycfg.WithCircuitBreaker(1, time.Minute),
+		skycfg.WithClock(clock),
+	)
+	for ii := 0; ii < 2; ii++ {
+		if _, err := reader.ReadFile(ctx, "missing.sky"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected missing file, got %v", err)
+		}
+	}
+	if missing.calls != 2 {
+		t.Errorf("expected missing files not to be retried, got %d calls", missing.calls)
+	}
+
+	hanging := &flakyReader{FileReader: files, hang: true}
+	reader = skycfg.ResilientFileReader(hanging,
+		skycfg.WithCallTimeout(10*time.Millisecond),
+		skycfg.WithRetries(1, time.Second),
+		skycfg.WithClock(clock),
+	)
+	if _, err := reader.ReadFile(ctx, "main.sky"); err != context.DeadlineExceeded {
+		t.Errorf("expected timeout, got %v", err)
+	}
+	if hanging.calls != 2 {
+		t.Errorf("expected 2 calls, got %d", hanging.calls)
+	}
+
+	broken := &flakyReader{FileReader: files, failures: 3}
+	reader = skycfg.ResilientFileReader(broken,
+		skycfg.WithRetries(0, 0),
+		skycfg.WithCircuitBreaker(2, time.Minute),
+		skycfg.WithClock(clock),
+	)
+	for ii := 0; ii < 2; ii++ {
+		if _, err := reader.ReadFile(ctx, "main.sky"); err == nil || !strings.Contains(err.Error(), "flaky failure") {
+			t.Errorf("expected flaky failure, got %v", err)
+		}
+	}
+	_, err := reader.ReadFile(ctx, "main.sky")
+	if err == nil || !strings.Contains(err.Error(), "unavailable after 2 consecutive failures") {
+		t.Errorf("expected open circuit, got %v", err)
+	}
+	if broken.calls != 2 {
+		t.Errorf("expected open circuit to skip the inner reader, got %d calls", broken.calls)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if _, err := reader.ReadFile(ctx, "main.sky"); err == nil {
+		t.Errorf("expected failed probe")
+	}
+	if _, err := reader.ReadFile(ctx, "main.sky"); err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Errorf("expected circuit to reopen after failed probe, got %v", err)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if _, err := reader.ReadFile(ctx, "main.sky"); err != nil {
+		t.Errorf("expected successful probe, got %v", err)
+	}
+	if _, err := reader.ReadFile(ctx, "main.sky"); err != nil {
+		t.Errorf("expected closed circuit, got %v", err)
+	}
+}
+
+func TestLockfile(t *testing.T) {
+	files := map[string][]byte{
+		"main.sky":   []byte("load(\"helper.sky\", \"helper\")\ndef main(ctx):\n  return helper()\n"),
+		"helper.sky": []byte("def helper():\n  return []\n"),
+	}
+	ctx := context.Background()
+	lock := &skycfg.Lockfile{}
+	if _, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(skycfg.MapFileReader(files)), skycfg.WithLockfile(lock)); err != nil {
+		t.Fatal(err)
+	}
+	if len(lock.Modules) != 2 {
+		t.Fatalf("expected 2 modules in lockfile, got %v", lock.Modules)
+	}
+	data, err := lock.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock, err = skycfg.ParseLockfile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(skycfg.MapFileReader(files)), skycfg.WithLockfileVerification(lock)); err != nil {
+		t.Errorf("expected unchanged modules to verify: %v", err)
+	}
+	files["helper.sky"] = []byte("def helper():\n  return None\n")
+	_, err = skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(skycfg.MapFileReader(files)), skycfg.WithLockfileVerification(lock))
+	if err == nil || !strings.Contains(err.Error(), "doesn't match lockfile") {
+		t.Errorf("expected hash mismatch error, got %v", err)
+	}
+
+	// MapFileReader reports content hashes, so Changed() doesn't read files,
+	// but a reader without Stat() must be read in full.
+	changed, err := lock.Changed(ctx, skycfg.MapFileReader(files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || changed[0] != "helper.sky" {
+		t.Errorf("Changed(): got %v, want [helper.sky]", changed)
+	}
+	reader := &countingReader{FileReader: skycfg.MapFileReader(files)}
+	if changed, err = lock.Changed(ctx, reader); err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || reader.reads != 2 {
+		t.Errorf("Changed() without Stat: got %v after %d reads", changed, reader.reads)
+	}
+}
+
+func TestWorkspaceFileReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skycfg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"main/configs/main.sky": "load(\"@rules//lib:defs.sky\", \"helper\")\ndef main(ctx):\n  return helper()\n",
+		"rules/lib/defs.sky":    "load(\":impl.sky\", _helper = \"helper\")\nhelper = _helper\n",
+		"rules/lib/impl.sky":    "load(\"//lib:empty.sky\", \"EMPTY\")\ndef helper():\n  return EMPTY\n",
+		"rules/lib/empty.sky":   "EMPTY = []\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader := skycfg.WorkspaceFileReader(map[string]string{
+		"":      filepath.Join(dir, "main"),
+		"rules": filepath.Join(dir, "rules"),
+	})
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "//configs:main.sky", skycfg.WithFileReader(reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Main(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"@unknown//lib:defs.sky", "//configs:../../rules/lib/defs.sky", "configs/main.sky"} {
+		if _, err := skycfg.Load(ctx, name, skycfg.WithFileReader(reader)); err == nil {
+			t.Errorf("expected error loading %q", name)
+		}
+	}
+}
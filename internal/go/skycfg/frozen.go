@@ -0,0 +1,458 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// FrozenValues records where the dicts and lists in a config's modules
+// were defined, so errors from mutating them can say where they came from.
+// Messages keep their own provenance, but Starlark's values have nowhere
+// to put it.
+type FrozenValues struct {
+	mu     sync.Mutex
+	values map[starlark.Value]string // frozen dict or list -> provenance
+	files  map[string]*syntax.File   // module path -> parsed source
+}
+
+// NewFrozenValues returns an empty FrozenValues.
+func NewFrozenValues() *FrozenValues {
+	return &FrozenValues{
+		values: make(map[starlark.Value]string),
+		files:  make(map[string]*syntax.File),
+	}
+}
+
+// MarkFrozen records that the values in a module's globals were frozen
+// when that module finished loading, so later attempts to mutate them can
+// report where they came from. The module's parsed source, if not nil, is
+// used to find where its globals were assigned and which value a failed
+// statement was modifying.
+//
+// A nil FrozenValues only records the provenance of messages.
+func (fv *FrozenValues) MarkFrozen(globals starlark.StringDict, module string, f *syntax.File) {
+	m := &frozenMarker{
+		reason: fmt.Sprintf("frozen when module %q finished loading", module),
+		seen:   make(map[starlark.Value]bool),
+	}
+	positions := globalPositions(f)
+	names := make([]string, 0, len(globals))
+	for name := range globals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if fv != nil {
+		fv.mu.Lock()
+		defer fv.mu.Unlock()
+		if f != nil {
+			fv.files[module] = f
+		}
+	}
+	for _, name := range names {
+		if fv != nil {
+			desc := "global " + name
+			if pos, ok := positions[name]; ok {
+				desc += " created at " + pos.String()
+			}
+			m.record = func(val starlark.Value, nested bool) {
+				if _, ok := fv.values[val]; ok {
+					return
+				}
+				if nested {
+					fv.values[val] = "part of " + desc + ", " + m.reason
+				} else {
+					fv.values[val] = desc + ", " + m.reason
+				}
+			}
+		}
+		m.mark(globals[name], false)
+	}
+}
+
+// globalPositions returns where each of a module's globals was last
+// assigned at the top level.
+func globalPositions(f *syntax.File) map[string]syntax.Position {
+	positions := make(map[string]syntax.Position)
+	if f == nil {
+		return positions
+	}
+	for _, stmt := range f.Stmts {
+		if assign, ok := stmt.(*syntax.AssignStmt); ok && assign.Op == syntax.EQ {
+			for _, id := range assignedIdents(assign.LHS) {
+				// Match the line-only positions of values created at
+				// runtime.
+				filename := id.NamePos.Filename()
+				positions[id.Name] = syntax.MakePosition(&filename, id.NamePos.Line, 0)
+			}
+		}
+	}
+	return positions
+}
+
+// assignedIdents returns the identifiers bound by the target of an
+// assignment or for loop.
+func assignedIdents(lhs syntax.Expr) []*syntax.Ident {
+	switch lhs := lhs.(type) {
+	case *syntax.Ident:
+		return []*syntax.Ident{lhs}
+	case *syntax.ParenExpr:
+		return assignedIdents(lhs.X)
+	case *syntax.TupleExpr:
+		var ids []*syntax.Ident
+		for _, elem := range lhs.List {
+			ids = append(ids, assignedIdents(elem)...)
+		}
+		return ids
+	case *syntax.ListExpr:
+		var ids []*syntax.Ident
+		for _, elem := range lhs.List {
+			ids = append(ids, assignedIdents(elem)...)
+		}
+		return ids
+	}
+	return nil
+}
+
+// A frozenMarker records why values and the values within them were
+// frozen, unless they already were.
+type frozenMarker struct {
+	reason string
+	seen   map[starlark.Value]bool
+
+	// record, if set, is called with each dict and list that's marked.
+	// nested is false for the value passed to the outermost mark().
+	record func(val starlark.Value, nested bool)
+}
+
+func (m *frozenMarker) mark(val starlark.Value, nested bool) {
+	switch val := val.(type) {
+	case *skyProtoMessage:
+		if m.seen[val] {
+			return
+		}
+		m.seen[val] = true
+		val.attrMu.Lock()
+		if val.frozenBy == "" {
+			val.frozenBy = m.reason
+		}
+		attrs := make([]starlark.Value, 0, len(val.attrCache))
+		for _, attr := range val.attrCache {
+			attrs = append(attrs, attr)
+		}
+		val.attrMu.Unlock()
+		for _, attr := range attrs {
+			m.mark(attr, true)
+		}
+	case *starlark.Dict:
+		if m.seen[val] {
+			return
+		}
+		m.seen[val] = true
+		if m.record != nil {
+			m.record(val, nested)
+		}
+		for _, item := range val.Items() {
+			m.mark(item[1], true)
+		}
+	case *starlark.List:
+		if m.seen[val] {
+			return
+		}
+		m.seen[val] = true
+		if m.record != nil {
+			m.record(val, nested)
+		}
+		for ii := 0; ii < val.Len(); ii++ {
+			m.mark(val.Index(ii), true)
+		}
+	case starlark.Tuple:
+		for _, item := range val {
+			m.mark(item, true)
+		}
+	case *starlarkstruct.Struct:
+		if m.seen[val] {
+			return
+		}
+		m.seen[val] = true
+		for _, name := range val.AttrNames() {
+			attr, _ := val.Attr(name)
+			m.mark(attr, true)
+		}
+	case *protoRepeated:
+		if m.seen[val] {
+			return
+		}
+		m.seen[val] = true
+		val.mu.Lock()
+		if val.frozenBy == "" {
+			val.frozenBy = m.reason
+		}
+		val.mu.Unlock()
+		for _, elem := range val.converted() {
+			if elem != nil {
+				m.mark(elem, true)
+			}
+		}
+	case *protoMap:
+		m.mark(val.dict, true)
+	}
+}
+
+// Implementation of the `proto.freeze()` built-in function. Freezes a
+// message and the values within it, so that a template shared by several
+// configs can't be changed by one of them, and returns it. Messages are
+// frozen anyway when their module finishes loading, along with the other
+// values at the top level and the defaults of functions; proto.freeze()
+// also protects them while the module is loading. Use proto.clone() to get
+// a copy that can be modified.
+//
+//  def proto.freeze(msg)
+func fnProtoFreeze(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msg *skyProtoMessage
+	if err := wantSingleProtoMessage("proto.freeze", args, kwargs, &msg); err != nil {
+		return nil, err
+	}
+	if !msg.frozen {
+		reason := "frozen by proto.freeze()"
+		if pos := callerPosition(t); pos.IsValid() {
+			reason = fmt.Sprintf("frozen by proto.freeze() at %s", pos)
+		}
+		msg.Freeze()
+		(&frozenMarker{reason: reason, seen: make(map[starlark.Value]bool)}).mark(msg, false)
+	}
+	return msg, nil
+}
+
+// Implementation of the `proto.is_frozen()` built-in function. Returns
+// whether a message is frozen.
+//
+//  def proto.is_frozen(msg)
+func fnProtoIsFrozen(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msg *skyProtoMessage
+	if err := wantSingleProtoMessage("proto.is_frozen", args, kwargs, &msg); err != nil {
+		return nil, err
+	}
+	return starlark.Bool(msg.frozen), nil
+}
+
+const frozenErrorHint = "values defined at the top level of a module are frozen " +
+	"once it has finished loading, and the fields of messages passed to " +
+	"proto.freeze() with them; make a copy (for example with dict(), " +
+	"list(), or proto.clone()) before modifying it"
+
+// AddFrozenErrorHint extends errors caused by mutating a frozen Starlark
+// dict or list with an explanation of how the value came to be frozen, and
+// with where it was defined if fv knows. fv may be nil.
+func AddFrozenErrorHint(err error, fv *FrozenValues) error {
+	evalErr, ok := err.(*starlark.EvalError)
+	if !ok {
+		return err
+	}
+	if !strings.Contains(evalErr.Msg, "frozen hash table") && !strings.Contains(evalErr.Msg, "frozen list") {
+		return err
+	}
+	if strings.Contains(evalErr.Msg, frozenErrorHint) {
+		return err
+	}
+	if provenance := fv.provenance(evalErr); provenance != "" {
+		evalErr.Msg += " (" + provenance + "; " + frozenErrorHint + ")"
+	} else {
+		evalErr.Msg += " (" + frozenErrorHint + ")"
+	}
+	return evalErr
+}
+
+// mutatingMethods are the names of the dict and list methods that fail if
+// their receiver is frozen.
+var mutatingMethods = map[string]bool{
+	"append":     true,
+	"clear":      true,
+	"extend":     true,
+	"insert":     true,
+	"pop":        true,
+	"popitem":    true,
+	"remove":     true,
+	"setdefault": true,
+	"update":     true,
+}
+
+// provenance returns where the frozen value that err failed to modify was
+// defined, if it can be found. The interpreter doesn't say which value it
+// was, so the statement that failed is inspected for values it modifies
+// that can be looked up without side effects: globals, and their fields
+// and elements at constant indexes.
+func (fv *FrozenValues) provenance(err *starlark.EvalError) string {
+	if fv == nil {
+		return ""
+	}
+	var fn *starlark.Function
+	var pos syntax.Position
+	for _, fr := range err.Stack() {
+		if f, ok := fr.Callable().(*starlark.Function); ok {
+			fn, pos = f, fr.Position()
+			break
+		}
+	}
+	if fn == nil {
+		return ""
+	}
+	fv.mu.Lock()
+	f := fv.files[pos.Filename()]
+	fv.mu.Unlock()
+	if f == nil {
+		return ""
+	}
+
+	locals := make(map[string]bool)
+	var targets []syntax.Expr
+	for _, stmt := range f.Stmts {
+		start, end := stmt.Span()
+		if pos.Line < start.Line || pos.Line > end.Line {
+			continue
+		}
+		if def, ok := stmt.(*syntax.DefStmt); ok {
+			locals = definedLocals(def)
+		}
+		syntax.Walk(stmt, func(n syntax.Node) bool {
+			if n == nil {
+				return false
+			}
+			if start, _ := n.Span(); start.Line != pos.Line {
+				return true
+			}
+			switch n := n.(type) {
+			case *syntax.AssignStmt:
+				if index, ok := n.LHS.(*syntax.IndexExpr); ok {
+					targets = append(targets, index.X)
+				}
+			case *syntax.CallExpr:
+				if dot, ok := n.Fn.(*syntax.DotExpr); ok && mutatingMethods[dot.Name.Name] {
+					targets = append(targets, dot.X)
+				}
+			}
+			return true
+		})
+	}
+
+	globals := fn.Globals()
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	for _, target := range targets {
+		val := staticValue(target, globals, locals)
+		if val == nil {
+			continue
+		}
+		if provenance, ok := fv.values[val]; ok {
+			return provenance
+		}
+	}
+	return ""
+}
+
+// definedLocals returns the names of a function's parameters and the
+// variables it assigns, which shadow globals of the same name.
+func definedLocals(def *syntax.DefStmt) map[string]bool {
+	locals := make(map[string]bool)
+	for _, param := range def.Function.Params {
+		switch param := param.(type) {
+		case *syntax.Ident:
+			locals[param.Name] = true
+		case *syntax.BinaryExpr:
+			if id, ok := param.X.(*syntax.Ident); ok {
+				locals[id.Name] = true
+			}
+		case *syntax.UnaryExpr:
+			if id, ok := param.X.(*syntax.Ident); ok {
+				locals[id.Name] = true
+			}
+		}
+	}
+	for _, stmt := range def.Function.Body {
+		syntax.Walk(stmt, func(n syntax.Node) bool {
+			switch n := n.(type) {
+			case *syntax.AssignStmt:
+				for _, id := range assignedIdents(n.LHS) {
+					locals[id.Name] = true
+				}
+			case *syntax.ForStmt:
+				for _, id := range assignedIdents(n.Vars) {
+					locals[id.Name] = true
+				}
+			}
+			return n != nil
+		})
+	}
+	return locals
+}
+
+// staticValue evaluates an expression made of globals, attribute
+// accesses, and constant indexes, or returns nil if it has any other
+// parts.
+func staticValue(expr syntax.Expr, globals starlark.StringDict, locals map[string]bool) starlark.Value {
+	switch expr := expr.(type) {
+	case *syntax.Ident:
+		if locals[expr.Name] {
+			return nil
+		}
+		return globals[expr.Name]
+	case *syntax.ParenExpr:
+		return staticValue(expr.X, globals, locals)
+	case *syntax.DotExpr:
+		x, ok := staticValue(expr.X, globals, locals).(starlark.HasAttrs)
+		if !ok {
+			return nil
+		}
+		val, err := x.Attr(expr.Name.Name)
+		if err != nil {
+			return nil
+		}
+		return val
+	case *syntax.IndexExpr:
+		lit, ok := expr.Y.(*syntax.Literal)
+		if !ok {
+			return nil
+		}
+		switch x := staticValue(expr.X, globals, locals).(type) {
+		case *starlark.Dict:
+			key, ok := lit.Value.(string)
+			if !ok {
+				return nil
+			}
+			val, found, err := x.Get(starlark.String(key))
+			if err != nil || !found {
+				return nil
+			}
+			return val
+		case *starlark.List:
+			idx, ok := lit.Value.(int64)
+			if !ok || idx < 0 || idx >= int64(x.Len()) {
+				return nil
+			}
+			return x.Index(int(idx))
+		}
+	}
+	return nil
+}
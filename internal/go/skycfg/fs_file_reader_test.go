@@ -0,0 +1,54 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// +build go1.16
+
+package skycfg_test
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stripe/skycfg"
+)
+
+func TestFSFileReader(t *testing.T) {
+	fsys := fstest.MapFS{
+		"configs/main.sky": &fstest.MapFile{Data: []byte(`
+load("libs/helper.sky", "helper")
+
+def main(ctx):
+	return helper()
+`)},
+		"libs/helper.sky": &fstest.MapFile{Data: []byte(`
+def helper():
+	return []
+`)},
+	}
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "configs/main.sky", skycfg.WithFileReader(skycfg.NewFSFileReader(fsys)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Main(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := skycfg.Load(ctx, "configs/missing.sky", skycfg.WithFileReader(skycfg.NewFSFileReader(fsys))); err == nil {
+		t.Error("expected error loading a missing module")
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+)
+
+// ValueFromGo converts a plain Go value to Starlark. Maps with string keys
+// and structs become dicts, slices and arrays become lists, and Protobuf
+// messages are wrapped as with NewSkyProtoMessage. Struct fields are named
+// according to their `json` tags, if present.
+func ValueFromGo(v interface{}) (starlark.Value, error) {
+	if v == nil {
+		return starlark.None, nil
+	}
+	return valueFromGo(reflect.ValueOf(v))
+}
+
+func valueFromGo(val reflect.Value) (starlark.Value, error) {
+	if !val.IsValid() {
+		return starlark.None, nil
+	}
+	if val.CanInterface() {
+		switch v := val.Interface().(type) {
+		case starlark.Value:
+			return v, nil
+		case proto.Message:
+			if val.Kind() == reflect.Ptr && val.IsNil() {
+				return starlark.None, nil
+			}
+			return NewSkyProtoMessage(v), nil
+		}
+	}
+
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if val.IsNil() {
+			return starlark.None, nil
+		}
+		return valueFromGo(val.Elem())
+	case reflect.Bool:
+		return starlark.Bool(val.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return starlark.MakeInt64(val.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return starlark.MakeUint64(val.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return starlark.Float(val.Float()), nil
+	case reflect.String:
+		return starlark.String(val.String()), nil
+	case reflect.Slice, reflect.Array:
+		if val.Kind() == reflect.Slice && val.Type().Elem().Kind() == reflect.Uint8 {
+			return starlark.String(val.Bytes()), nil
+		}
+		items := make([]starlark.Value, 0, val.Len())
+		for ii := 0; ii < val.Len(); ii++ {
+			item, err := valueFromGo(val.Index(ii))
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return starlark.NewList(items), nil
+	case reflect.Map:
+		if val.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("TypeError: map key type `%s' can't be converted to Starlark (want string keys)", val.Type().Key())
+		}
+		keys := val.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		dict := &starlark.Dict{}
+		for _, key := range keys {
+			item, err := valueFromGo(val.MapIndex(key))
+			if err != nil {
+				return nil, err
+			}
+			dict.SetKey(starlark.String(key.String()), item)
+		}
+		return dict, nil
+	case reflect.Struct:
+		dict := &starlark.Dict{}
+		t := val.Type()
+		for ii := 0; ii < t.NumField(); ii++ {
+			field := t.Field(ii)
+			if field.PkgPath != "" {
+				continue // unexported
+			}
+			name := field.Name
+			omitEmpty := false
+			if tag, ok := field.Tag.Lookup("json"); ok {
+				tagParts := strings.Split(tag, ",")
+				if tagParts[0] == "-" {
+					continue
+				}
+				if tagParts[0] != "" {
+					name = tagParts[0]
+				}
+				for _, opt := range tagParts[1:] {
+					omitEmpty = omitEmpty || opt == "omitempty"
+				}
+			}
+			fieldVal := val.Field(ii)
+			if omitEmpty && isEmptyGoValue(fieldVal) {
+				continue
+			}
+			item, err := valueFromGo(fieldVal)
+			if err != nil {
+				return nil, err
+			}
+			dict.SetKey(starlark.String(name), item)
+		}
+		return dict, nil
+	}
+	return nil, fmt.Errorf("TypeError: value of type `%s' can't be converted to Starlark", val.Type())
+}
+
+func isEmptyGoValue(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return val.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return val.IsNil()
+	}
+	return reflect.DeepEqual(val.Interface(), reflect.Zero(val.Type()).Interface())
+}
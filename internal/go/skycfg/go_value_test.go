@@ -0,0 +1,67 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"testing"
+
+	pb "github.com/stripe/skycfg/test_proto"
+)
+
+func TestValueFromGo(t *testing.T) {
+	type region struct {
+		Name     string   `json:"name"`
+		Zones    []string `json:"zones,omitempty"`
+		Replicas *int
+		Internal string `json:"-"`
+		private  string
+	}
+	replicas := 3
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{nil, `None`},
+		{true, `True`},
+		{int32(-5), `-5`},
+		{uint64(1 << 63), `9223372036854775808`},
+		{1.5, `1.5`},
+		{"str", `"str"`},
+		{[]byte("bytes"), `"bytes"`},
+		{[]interface{}{1, "a", nil}, `[1, "a", None]`},
+		{map[string]interface{}{"b": 2, "a": []int{1}}, `{"a": [1], "b": 2}`},
+		{region{Name: "us-east-1", Replicas: &replicas, Internal: "x", private: "y"}, `{"name": "us-east-1", "Replicas": 3}`},
+		{&region{Name: "eu", Zones: []string{"a"}}, `{"name": "eu", "zones": ["a"], "Replicas": None}`},
+		{&pb.MessageV3{FString: "msg"}, `<skycfg.test_proto.MessageV3 f_string:"msg" >`},
+	}
+	for _, test := range tests {
+		got, err := ValueFromGo(test.value)
+		if err != nil {
+			t.Errorf("ValueFromGo(%#v): %v", test.value, err)
+			continue
+		}
+		if got.String() != test.want {
+			t.Errorf("ValueFromGo(%#v): want %s, got %s", test.value, test.want, got.String())
+		}
+	}
+
+	for _, bad := range []interface{}{make(chan int), map[int]string{1: "a"}} {
+		if _, err := ValueFromGo(bad); err == nil {
+			t.Errorf("ValueFromGo(%#v): expected error", bad)
+		}
+	}
+}
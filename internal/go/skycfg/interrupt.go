@@ -0,0 +1,155 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// The Starlark interpreter can't be stopped from outside, and an iterator
+// can't fail a loop. Instead, once a thread's context is done, ranges
+// created by the thread stop early, so that its loops run out quickly. The
+// thread then finishes with a meaningless result, which the caller must
+// discard if Interrupted() reports true.
+
+// SetContext sets the context of a thread, which builtins called from the
+// thread check with CheckContext().
+func SetContext(t *starlark.Thread, ctx context.Context) {
+	t.SetLocal("context", ctx)
+	t.SetLocal("interrupted", new(bool))
+}
+
+// Interrupted reports whether the thread's execution failed because its
+// context was done.
+func Interrupted(t *starlark.Thread) bool {
+	interrupted, _ := t.Local("interrupted").(*bool)
+	return interrupted != nil && *interrupted
+}
+
+// CheckContext returns the error of the thread's context if it's done,
+// recording that the thread was interrupted.
+func CheckContext(t *starlark.Thread) error {
+	ctx, ok := t.Local("context").(context.Context)
+	if !ok || ctx.Err() == nil {
+		return nil
+	}
+	if interrupted, ok := t.Local("interrupted").(*bool); ok {
+		*interrupted = true
+	}
+	return ctx.Err()
+}
+
+// rangeCheckInterval is how many elements of a range are iterated over
+// between checks of the thread's context.
+const rangeCheckInterval = 1024
+
+// Range returns a replacement for the range() builtin whose ranges stop
+// being iterated over once the context of the thread that created them is
+// done. Frozen ranges don't check, since they may outlive their thread.
+func Range() *starlark.Builtin {
+	universal := starlark.Universe["range"]
+	return starlark.NewBuiltin("range", func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		r, err := starlark.Call(t, universal, args, kwargs)
+		if err != nil {
+			return nil, err
+		}
+		return &interruptibleRange{Value: r, thread: t}, nil
+	})
+}
+
+type interruptibleRange struct {
+	starlark.Value
+	thread *starlark.Thread
+	frozen bool
+}
+
+var (
+	_ starlark.Indexable  = (*interruptibleRange)(nil)
+	_ starlark.Sequence   = (*interruptibleRange)(nil)
+	_ starlark.Sliceable  = (*interruptibleRange)(nil)
+	_ starlark.Comparable = (*interruptibleRange)(nil)
+	_ starlark.HasBinary  = (*interruptibleRange)(nil)
+)
+
+func (r *interruptibleRange) Freeze()  { r.frozen = true }
+func (r *interruptibleRange) Len() int { return r.Value.(starlark.Indexable).Len() }
+func (r *interruptibleRange) Index(i int) starlark.Value {
+	return r.Value.(starlark.Indexable).Index(i)
+}
+
+func (r *interruptibleRange) Slice(start, end, step int) starlark.Value {
+	return &interruptibleRange{
+		Value:  r.Value.(starlark.Sliceable).Slice(start, end, step),
+		thread: r.thread,
+		frozen: r.frozen,
+	}
+}
+
+// CompareSameType compares the underlying ranges, since the interpreter
+// also considers a range created by the starlark package's range() to be
+// of the same type.
+func (r *interruptibleRange) CompareSameType(op syntax.Token, y starlark.Value, depth int) (bool, error) {
+	if yr, ok := y.(*interruptibleRange); ok {
+		y = yr.Value
+	}
+	return starlark.CompareDepth(op, r.Value, y, depth)
+}
+
+// WrapRange returns val, unless it's a range created by the starlark
+// package's range() rather than by Range(), which it returns as a frozen
+// range of Range(). Those ranges can't compare with the ranges of Range()
+// when they're on the left, so values that Go code passes to a config are
+// wrapped. Ranges within other values, such as lists, aren't.
+func WrapRange(val starlark.Value) starlark.Value {
+	if _, ok := val.(*interruptibleRange); ok || val == nil || val.Type() != "range" {
+		return val
+	}
+	if _, ok := val.(starlark.Sliceable); !ok {
+		return val
+	}
+	return &interruptibleRange{Value: val, frozen: true}
+}
+
+// Binary implements `x in range(...)`, which the interpreter only
+// recognizes for its own ranges.
+func (r *interruptibleRange) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	if op != syntax.IN || side != starlark.Right {
+		return nil, nil
+	}
+	return starlark.Binary(op, y, r.Value)
+}
+
+func (r *interruptibleRange) Iterate() starlark.Iterator {
+	return &interruptibleIterator{Iterator: starlark.Iterate(r.Value), r: r}
+}
+
+type interruptibleIterator struct {
+	starlark.Iterator
+	r     *interruptibleRange
+	count int
+}
+
+func (it *interruptibleIterator) Next(p *starlark.Value) bool {
+	if it.count%rangeCheckInterval == 0 && !it.r.frozen && CheckContext(it.r.thread) != nil {
+		return false
+	}
+	it.count++
+	return it.Iterator.Next(p)
+}
@@ -35,18 +35,24 @@ func JsonModule() starlark.Value {
 // jsonMarshal returns a Starlark function for marshaling plain values
 // (dicts, lists, etc) to JSON.
 //
-//  def json.marshal(value) -> str
+//  def json.marshal(value, big_ints_as_strings=False, float_precision=-1, allow_nan=True) -> str
+//
+// Integers beyond 2^53 lose precision in parsers that decode numbers as
+// floats; big_ints_as_strings writes them as quoted strings instead.
+// float_precision sets the number of significant digits of floats, and
+// allow_nan=False rejects NaN and infinities, which aren't valid JSON.
 func jsonMarshal() starlark.Callable {
 	return starlark.NewBuiltin("json.marshal", fnJsonMarshal)
 }
 
 func fnJsonMarshal(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var v starlark.Value
-	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "value", &v); err != nil {
+	opts, err := unpackJSONArgs(t, fn, args, kwargs, &v)
+	if err != nil {
 		return nil, err
 	}
 	var buf bytes.Buffer
-	if err := writeJSON(&buf, v); err != nil {
+	if err := writeJSON(&buf, v, &opts); err != nil {
 		return nil, err
 	}
 	return starlark.String(buf.String()), nil
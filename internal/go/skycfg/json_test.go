@@ -71,3 +71,57 @@ func TestSkyToJson(t *testing.T) {
 		}
 	}
 }
+
+func TestSkyToJsonNumbers(t *testing.T) {
+	thread := new(starlark.Thread)
+	env := starlark.StringDict{
+		"json": JsonModule(),
+	}
+
+	testCases := []JSONTestCase{
+		JSONTestCase{
+			skyExpr:   `[9007199254740991, 9007199254740992, 0.1 + 0.2, float("nan"), -float("inf")]`,
+			expOutput: `[9007199254740991, 9007199254740992, 0.30000000000000004, NaN, -Inf]`,
+		},
+		JSONTestCase{
+			skyExpr:   `[9007199254740991, 9007199254740992, -9007199254740992, 1180591620717411303424], big_ints_as_strings = True`,
+			expOutput: `[9007199254740991, "9007199254740992", "-9007199254740992", "1180591620717411303424"]`,
+		},
+		JSONTestCase{
+			skyExpr:   `{"a": 0.1 + 0.2, "b": 1.0 / 3}, float_precision = 3`,
+			expOutput: `{"a": 0.3, "b": 0.333}`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		v, err := starlark.Eval(
+			thread,
+			"<expr>",
+			fmt.Sprintf("json.marshal(%s)", testCase.skyExpr),
+			env,
+		)
+		if err != nil {
+			t.Error("Error from eval", "\nExpected nil", "\nGot", err)
+		}
+		exp := starlark.String(testCase.expOutput)
+		if v != exp {
+			t.Error(
+				"Bad return value from json.marshal",
+				"\nExpected",
+				exp,
+				"\nGot",
+				v,
+			)
+		}
+	}
+
+	for _, expr := range []string{
+		`json.marshal([float("nan")], allow_nan = False)`,
+		`json.marshal({"a": float("inf")}, allow_nan = False)`,
+		`json.marshal(1.5, float_precision = 0)`,
+	} {
+		if _, err := starlark.Eval(thread, "<expr>", expr, env); err == nil {
+			t.Errorf("Expected error from %s", expr)
+		}
+	}
+}
@@ -36,13 +36,79 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
+	"strconv"
 
+	"github.com/golang/protobuf/jsonpb"
 	"go.starlark.net/starlark"
 )
 
+// jsonWriteOptions controls how values are written by json.marshal() and
+// yaml.marshal().
+type jsonWriteOptions struct {
+	// Write integers outside the range that a float64 can represent
+	// exactly as quoted strings, for parsers that decode numbers as floats.
+	bigIntsAsStrings bool
+
+	// Number of significant digits for floats, or -1 for the fewest
+	// digits that round-trip.
+	floatPrecision int
+
+	// Write NaN and infinities, which are not valid JSON, instead of
+	// returning an error.
+	allowNaN bool
+
+	// Write NaN and infinities in YAML syntax, for yaml.marshal().
+	yaml bool
+
+	// The encoding of protobuf messages, from the thread's output schema.
+	messages *jsonpb.Marshaler
+}
+
+var defaultJSONWriteOptions = jsonWriteOptions{
+	floatPrecision: -1,
+	allowNaN:       true,
+}
+
+// maxSafeJSONInt is the largest integer such that it and every smaller
+// integer can be represented exactly by a float64.
+const maxSafeJSONInt = 1<<53 - 1
+
+func isSafeJSONInt(v starlark.Int) bool {
+	i, ok := v.Int64()
+	return ok && -maxSafeJSONInt <= i && i <= maxSafeJSONInt
+}
+
+// unpackJSONArgs unpacks the arguments shared by json.marshal() and
+// yaml.marshal().
+func unpackJSONArgs(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple, v *starlark.Value) (jsonWriteOptions, error) {
+	opts := defaultJSONWriteOptions
+	opts.messages = outputSchemaMarshaler(t)
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+		"value", v,
+		"big_ints_as_strings?", &opts.bigIntsAsStrings,
+		"float_precision?", &opts.floatPrecision,
+		"allow_nan?", &opts.allowNaN,
+	); err != nil {
+		return opts, err
+	}
+	if opts.floatPrecision < -1 || opts.floatPrecision == 0 {
+		return opts, fmt.Errorf("%s: float_precision must be positive or -1, got %d", fn.Name(), opts.floatPrecision)
+	}
+	return opts, nil
+}
+
 // Adapted from struct-specific JSON function:
 // https://github.com/google/starlark-go/blob/67717b5898061eb621519a94a4b89cedede9bca0/skylarkstruct/struct.go#L321
-func writeJSON(out *bytes.Buffer, v starlark.Value) error {
+func writeJSON(out *bytes.Buffer, v starlark.Value, opts *jsonWriteOptions) error {
+	if msg, ok := v.(*skyProtoMessage); ok && opts.messages != nil {
+		jsonData, err := msg.marshalJSON(opts.messages)
+		if err != nil {
+			return err
+		}
+		out.Write(jsonData)
+		return nil
+	}
 	if marshaler, ok := v.(json.Marshaler); ok {
 		jsonData, err := marshaler.MarshalJSON()
 		if err != nil {
@@ -58,9 +124,30 @@ func writeJSON(out *bytes.Buffer, v starlark.Value) error {
 	case starlark.Bool:
 		fmt.Fprintf(out, "%t", v)
 	case starlark.Int:
-		out.WriteString(v.String())
+		if opts.bigIntsAsStrings && !isSafeJSONInt(v) {
+			fmt.Fprintf(out, "%q", v.String())
+		} else {
+			out.WriteString(v.String())
+		}
 	case starlark.Float:
-		fmt.Fprintf(out, "%g", v)
+		f := float64(v)
+		if !opts.allowNaN && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			return fmt.Errorf("ValueError: value %s can't be converted to JSON.", v.String())
+		}
+		if opts.yaml {
+			switch {
+			case math.IsNaN(f):
+				out.WriteString(".nan")
+				return nil
+			case math.IsInf(f, 1):
+				out.WriteString(".inf")
+				return nil
+			case math.IsInf(f, -1):
+				out.WriteString("-.inf")
+				return nil
+			}
+		}
+		out.WriteString(strconv.FormatFloat(f, 'g', opts.floatPrecision, 64))
 	case starlark.String:
 		s := string(v)
 		if goQuoteIsSafe(s) {
@@ -76,7 +163,7 @@ func writeJSON(out *bytes.Buffer, v starlark.Value) error {
 			if i > 0 {
 				out.WriteString(", ")
 			}
-			if err := writeJSON(out, v.Index(i)); err != nil {
+			if err := writeJSON(out, v.Index(i), opts); err != nil {
 				return err
 			}
 		}
@@ -89,11 +176,11 @@ func writeJSON(out *bytes.Buffer, v starlark.Value) error {
 			if i > 0 {
 				out.WriteString(", ")
 			}
-			if err := writeJSON(out, key); err != nil {
+			if err := writeJSON(out, key, opts); err != nil {
 				return err
 			}
 			out.WriteString(": ")
-			if err := writeJSON(out, value); err != nil {
+			if err := writeJSON(out, value, opts); err != nil {
 				return err
 			}
 		}
@@ -0,0 +1,76 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+)
+
+// LiveStateFunc fetches the current state of an object matching the given
+// rendered message. It returns (nil, nil) if no such object exists.
+type LiveStateFunc func(ctx context.Context, msg proto.Message) (proto.Message, error)
+
+// AssertLive returns a Starlark function for comparing a rendered message
+// against the current state of the same object in a live system.
+//
+//  def assert_live(msg: proto.Message, exact: bool = False) -> None
+//
+// By default only fields set in `msg` are compared, so server-populated
+// fields in the live object are ignored. Pass `exact = True` to require
+// the two messages to be equal.
+func AssertLive(getLive LiveStateFunc) starlark.Callable {
+	return starlark.NewBuiltin("assert_live", func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var val starlark.Value
+		var exact bool
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "msg", &val, "exact?", &exact); err != nil {
+			return nil, err
+		}
+		msg, ok := val.(*skyProtoMessage)
+		if !ok {
+			return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.Message", fn.Name(), val.Type())
+		}
+		ctx, ok := t.Local("context").(context.Context)
+		if !ok {
+			ctx = context.Background()
+		}
+		live, err := getLive(ctx, msg.msg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+		}
+		if live == nil {
+			return nil, fmt.Errorf("%s: no live object found for %s", fn.Name(), msg.String())
+		}
+		if reflect.TypeOf(live) != reflect.TypeOf(msg.msg) {
+			return nil, fmt.Errorf("%s: live object has type %s, want %s", fn.Name(), messageTypeName(live), msg.Type())
+		}
+		diffs := diffProtoMessages(msg.msg, live, !exact)
+		if len(diffs) == 0 {
+			return starlark.None, nil
+		}
+		var lines []string
+		for _, diff := range diffs {
+			lines = append(lines, "  "+diff.String())
+		}
+		return nil, fmt.Errorf("%s: %s differs from live state (rendered -> live):\n%s", fn.Name(), msg.Type(), strings.Join(lines, "\n"))
+	})
+}
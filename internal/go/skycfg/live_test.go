@@ -0,0 +1,76 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+
+	pb "github.com/stripe/skycfg/test_proto"
+)
+
+func TestAssertLive(t *testing.T) {
+	live := &pb.MessageV3{
+		FInt32:  1,
+		FString: "live",
+		FSubmsg: &pb.MessageV3{FInt64: 2},
+	}
+	getLive := func(ctx context.Context, msg proto.Message) (proto.Message, error) {
+		return live, nil
+	}
+	globals := starlark.StringDict{
+		"proto":       NewProtoModule(nil),
+		"assert_live": AssertLive(getLive),
+		"pb":          newProtoPackage(nil, "skycfg.test_proto"),
+	}
+
+	tests := []struct {
+		src     string
+		wantErr string
+	}{
+		{src: `assert_live(pb.MessageV3(f_int32 = 1))`},
+		{src: `assert_live(pb.MessageV3(f_submsg = pb.MessageV3(f_int64 = 2)))`},
+		{
+			src:     `assert_live(pb.MessageV3(f_int32 = 1), exact = True)`,
+			wantErr: "f_string: <unset> -> live",
+		},
+		{
+			src:     `assert_live(pb.MessageV3(f_submsg = pb.MessageV3(f_int64 = 3)))`,
+			wantErr: "f_submsg.f_int64: 3 -> 2",
+		},
+		{
+			src:     `assert_live(pb.MessageV2())`,
+			wantErr: "live object has type skycfg.test_proto.MessageV3",
+		},
+	}
+	for _, test := range tests {
+		_, err := starlark.Eval(&starlark.Thread{}, "", test.src, globals)
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("eval(%q): unexpected error: %v", test.src, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("eval(%q): expected error containing %q, got %v", test.src, test.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// LogFunc receives messages logged by the Starlark `log` module.
+type LogFunc func(level string, msg string, fields map[string]string, pos syntax.Position)
+
+// LogLevels lists the log levels, from least to most severe.
+var LogLevels = []string{"debug", "info", "warn", "error"}
+
+// SetLogger sets the LogFunc used by `log` functions called from a thread.
+func SetLogger(t *starlark.Thread, fn LogFunc) {
+	t.SetLocal("logger", fn)
+}
+
+// LogModule returns a Starlark module for leveled logging.
+//
+//  def log.debug(*args, **fields) -> None
+//  def log.info(*args, **fields) -> None
+//  def log.warn(*args, **fields) -> None
+//  def log.error(*args, **fields) -> None
+//
+// Arguments are formatted as with print(). Keyword arguments are passed to
+// the logger as structured fields.
+func LogModule() starlark.Value {
+	attrs := make(starlark.StringDict, len(LogLevels))
+	for _, level := range LogLevels {
+		attrs[level] = logFn(level)
+	}
+	return &Module{
+		Name:  "log",
+		Attrs: attrs,
+	}
+}
+
+func logFn(level string) starlark.Callable {
+	return starlark.NewBuiltin("log."+level, func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var parts []string
+		for _, arg := range args {
+			parts = append(parts, logString(arg))
+		}
+		var fields map[string]string
+		if len(kwargs) > 0 {
+			fields = make(map[string]string, len(kwargs))
+			for _, kwarg := range kwargs {
+				fields[string(kwarg[0].(starlark.String))] = logString(kwarg[1])
+			}
+		}
+		Log(t, level, strings.Join(parts, " "), fields, t.Caller().Position())
+		return starlark.None, nil
+	})
+}
+
+// Log sends a message to the thread's logger, or to stderr if it has none.
+func Log(t *starlark.Thread, level string, msg string, fields map[string]string, pos syntax.Position) {
+	if logger, ok := t.Local("logger").(LogFunc); ok && logger != nil {
+		logger(level, msg, fields, pos)
+	} else {
+		defaultLogger(level, msg, fields, pos)
+	}
+}
+
+func logString(v starlark.Value) string {
+	if s, ok := v.(starlark.String); ok {
+		return string(s)
+	}
+	return v.String()
+}
+
+func defaultLogger(level string, msg string, fields map[string]string, pos syntax.Position) {
+	var keys []string
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "[%v] %s: %s", pos, strings.ToUpper(level), msg)
+	for _, key := range keys {
+		fmt.Fprintf(&buf, " %s=%q", key, fields[key])
+	}
+	fmt.Fprintln(os.Stderr, buf.String())
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/golang/protobuf/jsonpb"
+	"go.starlark.net/starlark"
+)
+
+// An output schema is a named version of the JSON encoding of messages by
+// proto.to_json(), proto.to_yaml(), json.marshal(), and yaml.marshal():
+// the style of field names, how enums are rendered, and whether default
+// values are emitted. A version's encoding never changes; if the default
+// encoding changes, it becomes a new version, and configs pinned to an
+// older version keep their output.
+var outputSchemas = map[string]jsonpb.Marshaler{
+	// Field names from the .proto file, enums as names, and defaults
+	// omitted.
+	"1": {OrigName: true},
+}
+
+// LatestOutputSchema is the output schema used by configs that don't pin
+// one.
+const LatestOutputSchema = "1"
+
+// OutputSchemas returns the names of the known output schemas, sorted.
+func OutputSchemas() []string {
+	names := make([]string, 0, len(outputSchemas))
+	for name := range outputSchemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckOutputSchema returns an error if name isn't a known output schema.
+func CheckOutputSchema(name string) error {
+	if _, ok := outputSchemas[name]; !ok {
+		return fmt.Errorf("unknown output schema %q (known schemas: %q)", name, OutputSchemas())
+	}
+	return nil
+}
+
+// SetOutputSchema sets the output schema used by functions called from a
+// thread. The name must be a known output schema.
+func SetOutputSchema(t *starlark.Thread, name string) {
+	t.SetLocal("output_schema", name)
+}
+
+// outputSchemaMarshaler returns a new jsonpb.Marshaler for the output
+// schema of a thread, or of LatestOutputSchema if it hasn't been set. It
+// resolves the types of Any values with the thread's registry, if it has
+// one.
+func outputSchemaMarshaler(t *starlark.Thread) *jsonpb.Marshaler {
+	name, ok := t.Local("output_schema").(string)
+	if !ok {
+		name = LatestOutputSchema
+	}
+	m := outputSchemas[name]
+	if registry := threadProtoRegistry(t); registry != nil {
+		m.AnyResolver = registryAnyResolver{registry}
+	}
+	return &m
+}
+
+// SetDeterministic sets whether messages encoded by functions called from a
+// thread, such as proto.encode(), have their map entries written in a
+// deterministic order, so that the encoding of equal messages can be
+// compared or hashed.
+func SetDeterministic(t *starlark.Thread, deterministic bool) {
+	t.SetLocal("deterministic", deterministic)
+}
+
+func isDeterministic(t *starlark.Thread) bool {
+	deterministic, _ := t.Local("deterministic").(bool)
+	return deterministic
+}
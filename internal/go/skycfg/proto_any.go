@@ -0,0 +1,149 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	anypb "github.com/golang/protobuf/ptypes/any"
+	"go.starlark.net/starlark"
+	protov2 "google.golang.org/protobuf/proto"
+)
+
+// anyTypeURLPrefix is the prefix of the type URLs written by
+// `proto.pack_any()`, as used by the protobuf runtimes.
+const anyTypeURLPrefix = "type.googleapis.com/"
+
+// Implementation of the `proto.pack_any()` built-in function.
+// Returns a google.protobuf.Any containing the serialized message. The
+// message's type must be known to the module's registry, so that it can be
+// unpacked again.
+func (mod *ProtoModule) fnProtoPackAny(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msg *skyProtoMessage
+	if err := wantSingleProtoMessage("proto.pack_any", args, kwargs, &msg); err != nil {
+		return nil, err
+	}
+	typeName := msg.Type()
+	registry := mod.Registry
+	if registry == nil {
+		registry = &defaultProtoRegistry{}
+	}
+	if _, err := newMessageType(registry, typeName); err != nil {
+		return nil, fmt.Errorf("%s: %v", "proto.pack_any", err)
+	}
+	value, err := protov2.MarshalOptions{Deterministic: isDeterministic(t)}.Marshal(proto.MessageV2(msg.msg))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", "proto.pack_any", err)
+	}
+	wrapper := NewSkyProtoMessage(&anypb.Any{
+		TypeUrl: anyTypeURLPrefix + typeName,
+		Value:   value,
+	})
+	wrapper.setOrigin(t)
+	return wrapper, nil
+}
+
+// Implementation of the `proto.unpack_any()` built-in function.
+// Returns the message contained in a google.protobuf.Any, which must have
+// the given message type.
+func fnProtoUnpackAny(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var val, msgType starlark.Value
+	if err := starlark.UnpackPositionalArgs("proto.unpack_any", args, kwargs, 2, &val, &msgType); err != nil {
+		return nil, err
+	}
+	anyMsg, ok := val.(*skyProtoMessage)
+	if !ok || anyMsg.Type() != "google.protobuf.Any" {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want google.protobuf.Any", "proto.unpack_any", val.Type())
+	}
+	protoMsgType, ok := msgType.(*skyProtoMessageType)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 2: got %s, want proto.MessageType", "proto.unpack_any", msgType.Type())
+	}
+	typeURL, err := anyMsg.Attr("type_url")
+	if err != nil {
+		return nil, err
+	}
+	value, err := anyMsg.Attr("value")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAnyTypeURL(string(typeURL.(starlark.String)), protoMsgType.Name()); err != nil {
+		return nil, fmt.Errorf("%s: %v", "proto.unpack_any", err)
+	}
+	msg := proto.Clone(protoMsgType.emptyMsg)
+	msg.Reset()
+	if err := proto.Unmarshal([]byte(value.(starlark.String)), msg); err != nil {
+		return nil, fmt.Errorf("%s: %v", "proto.unpack_any", err)
+	}
+	wrapper := NewSkyProtoMessage(msg)
+	wrapper.setOrigin(t)
+	return wrapper, nil
+}
+
+// SetProtoRegistry sets the registry that functions called from a thread
+// use to resolve the types of the google.protobuf.Any values they encode as
+// JSON or YAML, such as proto.to_json(). By default, they use the types
+// registered with go-protobuf.
+func SetProtoRegistry(t *starlark.Thread, registry ProtoRegistry) {
+	t.SetLocal("proto_registry", registry)
+}
+
+func threadProtoRegistry(t *starlark.Thread) ProtoRegistry {
+	registry, _ := t.Local("proto_registry").(ProtoRegistry)
+	return registry
+}
+
+// registryAnyResolver resolves the types of google.protobuf.Any values
+// encoded or decoded as JSON with a registry, rather than with the types
+// registered with go-protobuf.
+//
+// Text and binary encodings don't use it. The text encoder and parser of
+// go-protobuf have no way to resolve types other than their own registry,
+// and the binary encoding keeps the contents of an Any as bytes.
+type registryAnyResolver struct {
+	registry ProtoRegistry
+}
+
+func (r registryAnyResolver) Resolve(typeURL string) (proto.Message, error) {
+	registry := r.registry
+	if registry == nil {
+		registry = &defaultProtoRegistry{}
+	}
+	msgType, err := newMessageType(registry, typeURL[strings.LastIndex(typeURL, "/")+1:])
+	if err != nil {
+		return nil, err
+	}
+	msg := proto.Clone(msgType.(*skyProtoMessageType).emptyMsg)
+	msg.Reset()
+	return msg, nil
+}
+
+// checkAnyTypeURL returns an error unless typeURL is a well-formed type
+// URL naming typeName. Any prefix is accepted, since the protobuf runtimes
+// only look at the part after the last slash.
+func checkAnyTypeURL(typeURL, typeName string) error {
+	slash := strings.LastIndex(typeURL, "/")
+	if slash < 0 || slash == len(typeURL)-1 {
+		return fmt.Errorf("ValueError: invalid type URL %q", typeURL)
+	}
+	if got := typeURL[slash+1:]; got != typeName {
+		return fmt.Errorf("TypeError: type URL %q names `%s', not `%s'", typeURL, got, typeName)
+	}
+	return nil
+}
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"reflect"
 	"sort"
+	"strings"
 
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
@@ -41,23 +42,61 @@ type ProtoRegistry interface {
 	UnstableEnumValueMap(name string) map[string]int32
 }
 
+// A ProtoNameResolver is a ProtoRegistry that customizes how the names of
+// types in a proto.package() are resolved, such as to alias a renamed type
+// to its new name so that configs can be migrated gradually.
+//
+// This will be stabilized after the go-protobuf v2 API has reached GA.
+type ProtoNameResolver interface {
+	// UNSTABLE lookup from a type name within a package, such as "Foo"
+	// in package "my.pkg", to the full name of the type it refers to.
+	// Returns false for names resolved as "<package>.<name>".
+	UnstableResolveProtoName(packageName, name string) (string, bool)
+}
+
 func NewProtoModule(registry ProtoRegistry) *ProtoModule {
 	mod := &ProtoModule{
 		Registry: registry,
 		attrs: starlark.StringDict{
-			"clear":        starlark.NewBuiltin("proto.clear", fnProtoClear),
-			"clone":        starlark.NewBuiltin("proto.clone", fnProtoClone),
-			"from_json":    starlark.NewBuiltin("proto.from_json", fnProtoFromJson),
-			"from_text":    starlark.NewBuiltin("proto.from_text", fnProtoFromText),
-			"from_yaml":    starlark.NewBuiltin("proto.from_yaml", fnProtoFromYaml),
-			"merge":        starlark.NewBuiltin("proto.merge", fnProtoMerge),
-			"set_defaults": starlark.NewBuiltin("proto.set_defaults", fnProtoSetDefaults),
-			"to_json":      starlark.NewBuiltin("proto.to_json", fnProtoToJson),
-			"to_text":      starlark.NewBuiltin("proto.to_text", fnProtoToText),
-			"to_yaml":      starlark.NewBuiltin("proto.to_yaml", fnProtoToYaml),
+			"apply_mask":    starlark.NewBuiltin("proto.apply_mask", fnProtoApplyMask),
+			"clear":         starlark.NewBuiltin("proto.clear", fnProtoClear),
+			"clone":         starlark.NewBuiltin("proto.clone", fnProtoClone),
+			"decode":        starlark.NewBuiltin("proto.decode", fnProtoDecode),
+			"default":       starlark.NewBuiltin("proto.default", fnProtoDefault),
+			"diff":          starlark.NewBuiltin("proto.diff", fnProtoDiff),
+			"encode":        starlark.NewBuiltin("proto.encode", fnProtoEncode),
+			"enum_value":    starlark.NewBuiltin("proto.enum_value", fnProtoEnumValue),
+			"enum_values":   starlark.NewBuiltin("proto.enum_values", fnProtoEnumValues),
+			"equal":         starlark.NewBuiltin("proto.equal", fnProtoEqual),
+			"field_mask":    starlark.NewBuiltin("proto.field_mask", fnProtoFieldMask),
+			"freeze":        starlark.NewBuiltin("proto.freeze", fnProtoFreeze),
+			"from_dict":     starlark.NewBuiltin("proto.from_dict", fnProtoFromDict),
+			"from_json":     starlark.NewBuiltin("proto.from_json", fnProtoFromJson),
+			"from_text":     starlark.NewBuiltin("proto.from_text", fnProtoFromText),
+			"from_yaml":     starlark.NewBuiltin("proto.from_yaml", fnProtoFromYaml),
+			"get_extension": starlark.NewBuiltin("proto.get_extension", fnProtoGetExtension),
+			"get_path":      starlark.NewBuiltin("proto.get_path", fnProtoGetPath),
+			"has":           starlark.NewBuiltin("proto.has", fnProtoHas),
+			"is_frozen":     starlark.NewBuiltin("proto.is_frozen", fnProtoIsFrozen),
+			"is_instance":   starlark.NewBuiltin("proto.is_instance", fnProtoIsInstance),
+			"merge":         starlark.NewBuiltin("proto.merge", fnProtoMerge),
+			"options":       starlark.NewBuiltin("proto.options", fnProtoOptions),
+			"set_defaults":  starlark.NewBuiltin("proto.set_defaults", fnProtoSetDefaults),
+			"set_path":      starlark.NewBuiltin("proto.set_path", fnProtoSetPath),
+			"to_dict":       starlark.NewBuiltin("proto.to_dict", fnProtoToDict),
+			"to_json":       starlark.NewBuiltin("proto.to_json", fnProtoToJson),
+			"to_text":       starlark.NewBuiltin("proto.to_text", fnProtoToText),
+			"to_yaml":       starlark.NewBuiltin("proto.to_yaml", fnProtoToYaml),
+			"type_name":     starlark.NewBuiltin("proto.type_name", fnProtoTypeName),
+			"unpack_any":    starlark.NewBuiltin("proto.unpack_any", fnProtoUnpackAny),
+			"validate":      starlark.NewBuiltin("proto.validate", fnProtoValidate),
+			"which_oneof":   starlark.NewBuiltin("proto.which_oneof", fnProtoWhichOneof),
 		},
 	}
+	mod.attrs["list_packages"] = starlark.NewBuiltin("proto.list_packages", mod.fnProtoListPackages)
+	mod.attrs["message_type"] = starlark.NewBuiltin("proto.message_type", mod.fnProtoMessageType)
 	mod.attrs["package"] = starlark.NewBuiltin("proto.package", mod.fnProtoPackage)
+	mod.attrs["pack_any"] = starlark.NewBuiltin("proto.pack_any", mod.fnProtoPackAny)
 	return mod
 }
 
@@ -94,7 +133,14 @@ func (mod *ProtoModule) AttrNames() []string {
 
 // Implementation of the `proto.clear()` built-in function.
 // Reset protobuf state to the default values.
+//
+// If field names are given, returns a copy of the message with only those
+// fields reset, leaving the original unchanged. This also works on frozen
+// messages, such as templates loaded from another module.
 func fnProtoClear(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) > 1 {
+		return protoClearFields(t, args, kwargs)
+	}
 	var msg *skyProtoMessage
 	if err := wantSingleProtoMessage("proto.clear", args, kwargs, &msg); err != nil {
 		return nil, err
@@ -102,10 +148,35 @@ func fnProtoClear(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple,
 	if err := msg.checkMutable("clear"); err != nil {
 		return nil, err
 	}
+	msg.dropSharedFields()
 	msg.msg.Reset()
+	msg.unknownJSON = nil
 	return msg, nil
 }
 
+func protoClearFields(t *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("proto.clear: unexpected keyword arguments")
+	}
+	msg, ok := args[0].(*skyProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.Message", "proto.clear", args[0].Type())
+	}
+	wrapper := NewSkyProtoMessage(proto.Clone(msg.msg))
+	wrapper.setOrigin(t)
+	wrapper.unknownJSON = msg.currentUnknownJSON()
+	for ii, arg := range args[1:] {
+		name, ok := arg.(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("%s: for parameter %d: got %s, want string", "proto.clear", ii+2, arg.Type())
+		}
+		if err := wrapper.clearField(string(name)); err != nil {
+			return nil, fmt.Errorf("%s: %v", "proto.clear", err)
+		}
+	}
+	return wrapper, nil
+}
+
 // Implementation of the `proto.clone()` built-in function.
 // Creates a deep copy of a protobuf.
 func fnProtoClone(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
@@ -113,7 +184,113 @@ func fnProtoClone(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple,
 	if err := wantSingleProtoMessage("proto.clone", args, kwargs, &msg); err != nil {
 		return nil, err
 	}
-	return NewSkyProtoMessage(proto.Clone(msg.msg)), nil
+	wrapper := NewSkyProtoMessage(proto.Clone(msg.msg))
+	wrapper.setOrigin(t)
+	wrapper.unknownJSON = msg.currentUnknownJSON()
+	return wrapper, nil
+}
+
+// Implementation of the `proto.default()` built-in function.
+// Returns a frozen message of the given type with no fields set, for
+// comparing other messages against. Use proto.clone() to get a copy that
+// can be modified.
+//
+//  def proto.default(type)
+func fnProtoDefault(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msgType starlark.Value
+	if err := starlark.UnpackPositionalArgs("proto.default", args, kwargs, 1, &msgType); err != nil {
+		return nil, err
+	}
+	protoMsgType, ok := msgType.(*skyProtoMessageType)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.MessageType", "proto.default", msgType.Type())
+	}
+	msg := proto.Clone(protoMsgType.emptyMsg)
+	msg.Reset()
+	wrapper := NewSkyProtoMessage(msg)
+	wrapper.setOrigin(t)
+	wrapper.Freeze()
+	return wrapper, nil
+}
+
+// Implementation of the `proto.equal()` built-in function.
+// Reports whether two messages have the same type and field values.
+func fnProtoEqual(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var a, b starlark.Value
+	if err := starlark.UnpackPositionalArgs("proto.equal", args, kwargs, 2, &a, &b); err != nil {
+		return nil, err
+	}
+	msgA, ok := a.(*skyProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.Message", "proto.equal", a.Type())
+	}
+	msgB, ok := b.(*skyProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 2: got %s, want proto.Message", "proto.equal", b.Type())
+	}
+	return starlark.Bool(proto.Equal(msgA.msg, msgB.msg)), nil
+}
+
+// Implementation of the `proto.has()` built-in function.
+// Reports whether a field with explicit presence, such as a submessage or a
+// proto3 `optional` field, is set. The `in` operator is more lenient, and
+// also accepts fields without explicit presence.
+func fnProtoHas(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var val starlark.Value
+	var name string
+	if err := starlark.UnpackPositionalArgs("proto.has", args, kwargs, 2, &val, &name); err != nil {
+		return nil, err
+	}
+	msg, ok := val.(*skyProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.Message", "proto.has", val.Type())
+	}
+	has, err := msg.hasField(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", "proto.has", err)
+	}
+	return starlark.Bool(has), nil
+}
+
+// Implementation of the `proto.is_instance()` built-in function.
+// Reports whether a value is a message of the given message type, or an
+// enum value of the given enum type. Other values, including messages of
+// other types, aren't instances.
+func fnProtoIsInstance(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var val, typ starlark.Value
+	if err := starlark.UnpackPositionalArgs("proto.is_instance", args, kwargs, 2, &val, &typ); err != nil {
+		return nil, err
+	}
+	switch typ := typ.(type) {
+	case *skyProtoMessageType:
+		msg, ok := val.(*skyProtoMessage)
+		return starlark.Bool(ok && msg.Type() == typ.Name()), nil
+	case *skyProtoEnumType:
+		enum, ok := val.(*skyProtoEnumValue)
+		return starlark.Bool(ok && enum.typeName == typ.name), nil
+	}
+	return nil, fmt.Errorf("%s: for parameter 2: got %s, want proto.MessageType or proto.EnumType", "proto.is_instance", typ.Type())
+}
+
+// Implementation of the `proto.type_name()` built-in function.
+// Returns the full name of the type of a message or enum value, or of a
+// message or enum type, such as "google.protobuf.Duration".
+func fnProtoTypeName(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var val starlark.Value
+	if err := starlark.UnpackPositionalArgs("proto.type_name", args, kwargs, 1, &val); err != nil {
+		return nil, err
+	}
+	switch val := val.(type) {
+	case *skyProtoMessage:
+		return starlark.String(val.Type()), nil
+	case *skyProtoEnumValue:
+		return starlark.String(val.typeName), nil
+	case *skyProtoMessageType:
+		return starlark.String(val.Name()), nil
+	case *skyProtoEnumType:
+		return starlark.String(val.name), nil
+	}
+	return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.Message or proto.MessageType", "proto.type_name", val.Type())
 }
 
 // Implementation of the `proto.merge()` built-in function.
@@ -137,6 +314,7 @@ func fnProtoMerge(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple,
 	if err := dst.checkMutable("merge into"); err != nil {
 		return nil, err
 	}
+	dst.unshareFields()
 	proto.Merge(dst.msg, src.msg)
 	return dst, nil
 }
@@ -151,6 +329,7 @@ func fnProtoSetDefaults(t *starlark.Thread, fn *starlark.Builtin, args starlark.
 	if err := msg.checkMutable("set field defaults of"); err != nil {
 		return nil, err
 	}
+	msg.unshareFields()
 	proto.SetDefaults(msg.msg)
 	return msg, nil
 }
@@ -171,6 +350,42 @@ func (mod *ProtoModule) fnProtoPackage(t *starlark.Thread, fn *starlark.Builtin,
 	}, nil
 }
 
+// Implementation of the `proto.list_packages()` built-in function. Returns
+// the sorted names of the Protobuf packages that have types in the
+// registry, if it can list them.
+//
+//  def proto.list_packages() -> list
+func (mod *ProtoModule) fnProtoListPackages(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs("proto.list_packages", args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	var names []starlark.Value
+	for _, name := range protoPackageNames(mod.Registry) {
+		names = append(names, starlark.String(name))
+	}
+	return starlark.NewList(names), nil
+}
+
+// Implementation of the `proto.message_type()` built-in function. Returns
+// the message type of a fully-qualified name, such as
+// "google.protobuf.Timestamp", for code that's given type names at runtime.
+//
+//  def proto.message_type(name)
+func (mod *ProtoModule) fnProtoMessageType(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	if err := starlark.UnpackPositionalArgs("proto.message_type", args, kwargs, 1, &name); err != nil {
+		return nil, err
+	}
+	val, err := lookupProtoName(mod.Registry, name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", "proto.message_type", err)
+	}
+	if _, ok := val.(*skyProtoMessageType); !ok {
+		return nil, fmt.Errorf("%s: %q is a %s, not a proto.MessageType", "proto.message_type", name, val.Type())
+	}
+	return val, nil
+}
+
 func wantSingleProtoMessage(fnName string, args starlark.Tuple, kwargs []starlark.Tuple, msg **skyProtoMessage) error {
 	var val starlark.Value
 	if err := starlark.UnpackPositionalArgs(fnName, args, kwargs, 1, &val); err != nil {
@@ -186,6 +401,12 @@ func wantSingleProtoMessage(fnName string, args starlark.Tuple, kwargs []starlar
 
 // Implementation of the `proto.to_text()` built-in function. Returns the
 // text-formatted content of a protobuf message.
+//
+//  def proto.to_text(msg, compact=True, expand_any=False) -> str
+//
+// With `expand_any = True`, google.protobuf.Any fields whose type is
+// registered with go-protobuf are written as their unpacked message. Types
+// known only to the config's registry are written packed.
 func fnProtoToText(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var msg *skyProtoMessage
 	if err := wantSingleProtoMessage("proto.to_text", args, []starlark.Tuple{}, &msg); err != nil {
@@ -193,15 +414,12 @@ func fnProtoToText(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple
 	}
 	var textMarshaler = &proto.TextMarshaler{Compact: true}
 	if len(kwargs) > 0 {
-		compact := true
-		if err := starlark.UnpackArgs("proto.to_text", nil, kwargs, "compact", &compact); err != nil {
+		if err := starlark.UnpackArgs("proto.to_text", nil, kwargs,
+			"compact?", &textMarshaler.Compact,
+			"expand_any?", &textMarshaler.ExpandAny,
+		); err != nil {
 			return nil, err
 		}
-		if compact {
-			textMarshaler.Compact = true
-		} else {
-			textMarshaler.Compact = false
-		}
 	}
 	text := (textMarshaler).Text(msg.msg)
 	return starlark.String(text), nil
@@ -209,24 +427,50 @@ func fnProtoToText(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple
 
 // Implementation of the `proto.to_json()` built-in function. Returns the
 // JSON-formatted content of a protobuf message.
+//
+//  def proto.to_json(msg, compact=True, indent="\t", emit_defaults=False,
+//                    use_proto_names=True, enums_as_ints=False) -> str
+//
+// Setting `indent` implies `compact = False`. The encoding options default
+// to those of the config's output schema, which for the latest schema are
+// shown above; field names are those of the .proto file unless
+// `use_proto_names = False`, in which case they're lowerCamelCase. The encoding options don't apply to Kubernetes types,
+// which have their own JSON encoding.
 func fnProtoToJson(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var msg *skyProtoMessage
 	if err := wantSingleProtoMessage("proto.to_json", args, []starlark.Tuple{}, &msg); err != nil {
 		return nil, err
 	}
 	compact := true
+	var indent starlark.Value = starlark.None
+	jsonMarshaler := outputSchemaMarshaler(t)
 	if len(kwargs) > 0 {
-		if err := starlark.UnpackArgs("proto.to_json", nil, kwargs, "compact", &compact); err != nil {
+		if err := starlark.UnpackArgs("proto.to_json", nil, kwargs,
+			"compact?", &compact,
+			"indent?", &indent,
+			"emit_defaults?", &jsonMarshaler.EmitDefaults,
+			"use_proto_names?", &jsonMarshaler.OrigName,
+			"enums_as_ints?", &jsonMarshaler.EnumsAsInts,
+		); err != nil {
 			return nil, err
 		}
 	}
-	jsonData, err := msg.MarshalJSON()
+	indentStr := "\t"
+	switch indent := indent.(type) {
+	case starlark.NoneType:
+	case starlark.String:
+		indentStr = string(indent)
+		compact = false
+	default:
+		return nil, fmt.Errorf("proto.to_json: for parameter indent: got %s, want string", indent.Type())
+	}
+	jsonData, err := msg.marshalJSON(jsonMarshaler)
 	if err != nil {
 		return nil, err
 	}
 	if !compact {
 		var buf bytes.Buffer
-		if err := json.Indent(&buf, jsonData, "", "\t"); err != nil {
+		if err := json.Indent(&buf, jsonData, "", indentStr); err != nil {
 			return nil, err
 		}
 		jsonData = buf.Bytes()
@@ -241,12 +485,16 @@ func fnProtoToYaml(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple
 	if err := wantSingleProtoMessage("proto.to_yaml", args, kwargs, &msg); err != nil {
 		return nil, err
 	}
-	jsonData, err := (&jsonpb.Marshaler{OrigName: true}).MarshalToString(msg.msg)
+	jsonData, err := outputSchemaMarshaler(t).MarshalToString(msg.msg)
+	if err != nil {
+		return nil, err
+	}
+	withUnknown, err := msg.withUnknownJSON([]byte(jsonData), "")
 	if err != nil {
 		return nil, err
 	}
 	var yamlMap yaml.MapSlice
-	if err := yaml.Unmarshal([]byte(jsonData), &yamlMap); err != nil {
+	if err := yaml.Unmarshal(withUnknown, &yamlMap); err != nil {
 		return nil, err
 	}
 	yamlData, err := yaml.Marshal(yamlMap)
@@ -257,7 +505,9 @@ func fnProtoToYaml(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple
 }
 
 // Implementation of the `proto.from_text()` built-in function.
-// Returns the Protobuf message for text-formatted content.
+// Returns the Protobuf message for text-formatted content. Expanded
+// google.protobuf.Any values and extensions must have types registered
+// with go-protobuf, rather than only known to the config's registry.
 func fnProtoFromText(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var msgType starlark.Value
 	var value starlark.String
@@ -273,46 +523,49 @@ func fnProtoFromText(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tup
 	if err := proto.UnmarshalText(string(value), msg); err != nil {
 		return nil, err
 	}
-	return NewSkyProtoMessage(msg), nil
+	wrapper := NewSkyProtoMessage(msg)
+	wrapper.setOrigin(t)
+	return wrapper, nil
 }
 
 // Implementation of the `proto.from_json()` built-in function.
-// Returns the Protobuf message for JSON-formatted content.
+// Returns the Protobuf message for JSON-formatted content. By default
+// unknown fields are an error; with `strict = False` they're ignored, so
+// that documents with extra keys can be decoded. Configs loaded with
+// lenient decoding default to `strict = False`.
+//
+// With `preserve_unknown = True`, unknown fields are kept instead, and
+// written back out when the message is encoded as JSON or YAML, so that
+// documents written for a newer version of the schema can be modified
+// without losing data. They're kept by the Starlark value, not the
+// protobuf message, so they're dropped by operations that build a new
+// message, such as assigning the message to a field of another message.
+//
+//  def proto.from_json(type, value, strict=True, preserve_unknown=False)
 func fnProtoFromJson(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	var msgType starlark.Value
-	var value starlark.String
-	if err := starlark.UnpackPositionalArgs("proto.from_json", args, kwargs, 2, &msgType, &value); err != nil {
-		return nil, err
-	}
-	protoMsgType, ok := msgType.(*skyProtoMessageType)
-	if !ok {
-		return nil, fmt.Errorf("%s: for parameter 2: got %s, want proto.MessageType", "proto.from_json", msgType.Type())
-	}
-	msg := proto.Clone(protoMsgType.emptyMsg)
-	msg.Reset()
-	if err := jsonpb.UnmarshalString(string(value), msg); err != nil {
+	protoMsgType, value, opts, err := unpackProtoDecodeArgs(t, "proto.from_json", args, kwargs)
+	if err != nil {
 		return nil, err
 	}
-	return NewSkyProtoMessage(msg), nil
+	return decodeProtoJSON(t, protoMsgType, value, opts)
 }
 
 // Implementation of the `proto.from_yaml()` built-in function.
-// Returns the Protobuf message for YAML-formatted content.
+// Returns the Protobuf message for YAML-formatted content. Later keys
+// replace earlier ones. As for proto.from_json(), unknown fields are an
+// error unless `strict = False`, configs loaded with lenient decoding
+// default to `strict = False`, and unknown fields can be kept with
+// `preserve_unknown = True`.
 func fnProtoFromYaml(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	var msgType starlark.Value
-	var value starlark.String
-	if err := starlark.UnpackPositionalArgs("proto.from_yaml", args, kwargs, 2, &msgType, &value); err != nil {
+	protoMsgType, value, opts, err := unpackProtoDecodeArgs(t, "proto.from_yaml", args, kwargs)
+	if err != nil {
 		return nil, err
 	}
-	protoMsgType, ok := msgType.(*skyProtoMessageType)
-	if !ok {
-		return nil, fmt.Errorf("%s: for parameter 2: got %s, want proto.MessageType", "proto.from_yaml", msgType.Type())
-	}
 	var msgBody interface{}
 	if err := yaml.Unmarshal([]byte(value), &msgBody); err != nil {
 		return nil, err
 	}
-	msgBody, err := convertMapStringInterface("proto.from_yaml", msgBody)
+	msgBody, err = convertMapStringInterface("proto.from_yaml", msgBody)
 	if err != nil {
 		return nil, err
 	}
@@ -320,12 +573,68 @@ func fnProtoFromYaml(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tup
 	if err != nil {
 		return nil, err
 	}
+	return decodeProtoJSON(t, protoMsgType, string(jsonData), opts)
+}
+
+type protoDecodeOptions struct {
+	strict          bool
+	preserveUnknown bool
+}
+
+// SetLenientDecoding sets whether proto.from_json() and proto.from_yaml()
+// called from a thread ignore unknown fields unless they're passed
+// `strict = True`. By default unknown fields are an error.
+func SetLenientDecoding(t *starlark.Thread, lenient bool) {
+	t.SetLocal("lenient_decoding", lenient)
+}
+
+func lenientDecoding(t *starlark.Thread) bool {
+	if t == nil {
+		return false
+	}
+	lenient, _ := t.Local("lenient_decoding").(bool)
+	return lenient
+}
+
+func unpackProtoDecodeArgs(t *starlark.Thread, fnName string, args starlark.Tuple, kwargs []starlark.Tuple) (*skyProtoMessageType, string, protoDecodeOptions, error) {
+	var msgType starlark.Value
+	var value starlark.String
+	opts := protoDecodeOptions{strict: !lenientDecoding(t)}
+	if err := starlark.UnpackArgs(fnName, args, kwargs,
+		"type", &msgType,
+		"value", &value,
+		"strict?", &opts.strict,
+		"preserve_unknown?", &opts.preserveUnknown,
+	); err != nil {
+		return nil, "", opts, err
+	}
+	protoMsgType, ok := msgType.(*skyProtoMessageType)
+	if !ok {
+		return nil, "", opts, fmt.Errorf("%s: for parameter 2: got %s, want proto.MessageType", fnName, msgType.Type())
+	}
+	return protoMsgType, string(value), opts, nil
+}
+
+func decodeProtoJSON(t *starlark.Thread, protoMsgType *skyProtoMessageType, value string, opts protoDecodeOptions) (*skyProtoMessage, error) {
 	msg := proto.Clone(protoMsgType.emptyMsg)
 	msg.Reset()
-	if err := jsonpb.UnmarshalString(string(jsonData), msg); err != nil {
+	unmarshaler := &jsonpb.Unmarshaler{
+		AllowUnknownFields: !opts.strict || opts.preserveUnknown,
+		AnyResolver:        registryAnyResolver{protoMsgType.registry},
+	}
+	if err := unmarshaler.Unmarshal(strings.NewReader(value), msg); err != nil {
 		return nil, err
 	}
-	return NewSkyProtoMessage(msg), nil
+	wrapper := NewSkyProtoMessage(msg)
+	wrapper.setOrigin(t)
+	if opts.preserveUnknown {
+		unknown, err := collectUnknownJSON(proto.MessageV2(msg).ProtoReflect().Descriptor(), json.RawMessage(value))
+		if err != nil {
+			return nil, err
+		}
+		wrapper.unknownJSON = unknown
+	}
+	return wrapper, nil
 }
 
 // Coverts map[interface{}]interface{} into map[string]interface{} for json.Marshaler
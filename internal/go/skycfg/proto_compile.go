@@ -0,0 +1,86 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// CompileProtoFiles compiles .proto source files, and the files they import,
+// into a FileDescriptorSet. Sources are read with readFile; imports that it
+// can't read, such as the well-known types, are resolved to the files
+// linked into the binary, which are left out of the set.
+func CompileProtoFiles(ctx context.Context, readFile func(ctx context.Context, path string) ([]byte, error), paths []string) (*descriptorpb.FileDescriptorSet, error) {
+	var mu sync.Mutex
+	sources := make(map[string]bool)
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.CompositeResolver{
+			&protocompile.SourceResolver{
+				Accessor: func(path string) (io.ReadCloser, error) {
+					content, err := readFile(ctx, path)
+					if err != nil {
+						return nil, err
+					}
+					mu.Lock()
+					sources[path] = true
+					mu.Unlock()
+					return ioutil.NopCloser(bytes.NewReader(content)), nil
+				},
+			},
+			protocompile.ResolverFunc(func(path string) (protocompile.SearchResult, error) {
+				file, err := protoregistry.GlobalFiles.FindFileByPath(path)
+				if err != nil {
+					return protocompile.SearchResult{}, err
+				}
+				return protocompile.SearchResult{Desc: file}, nil
+			}),
+		},
+	}
+	compiled, err := compiler.Compile(ctx, paths...)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := make(map[string]bool)
+	var add func(file protoreflect.FileDescriptor)
+	add = func(file protoreflect.FileDescriptor) {
+		if seen[file.Path()] || !sources[file.Path()] {
+			return
+		}
+		seen[file.Path()] = true
+		imports := file.Imports()
+		for ii := 0; ii < imports.Len(); ii++ {
+			add(imports.Get(ii).FileDescriptor)
+		}
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(file))
+	}
+	for _, file := range compiled {
+		add(file)
+	}
+	return set, nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// A protoDescriptorRegistry is a ProtoRegistry that can also describe
+// message types that have no generated Go code. Messages of those types are
+// dynamic messages.
+type protoDescriptorRegistry interface {
+	ProtoRegistry
+
+	// UNSTABLE lookup from full protobuf message name to its descriptor,
+	// for types that UnstableProtoMessageType() doesn't find.
+	UnstableProtoMessageDescriptor(name string) (protoreflect.MessageDescriptor, error)
+}
+
+// DescriptorSetRegistry is a ProtoRegistry for the types in a
+// FileDescriptorSet. Types that have generated Go code linked into the
+// binary are looked up in the default registry; the others are backed by
+// dynamicpb.
+type DescriptorSetRegistry struct {
+	files *protoregistry.Files
+}
+
+var _ protoDescriptorRegistry = (*DescriptorSetRegistry)(nil)
+
+// NewDescriptorSetRegistry builds a registry from the files in set. Files
+// may import files that aren't in the set if they're linked into the
+// binary, such as the well-known types.
+func NewDescriptorSetRegistry(set *descriptorpb.FileDescriptorSet) (*DescriptorSetRegistry, error) {
+	b := &descriptorSetBuilder{
+		protos: make(map[string]*descriptorpb.FileDescriptorProto),
+		files:  new(protoregistry.Files),
+	}
+	for _, file := range set.GetFile() {
+		if _, ok := b.protos[file.GetName()]; ok {
+			return nil, fmt.Errorf("file %q appears more than once in the descriptor set", file.GetName())
+		}
+		b.protos[file.GetName()] = file
+	}
+	for _, file := range set.GetFile() {
+		if _, err := b.build(file.GetName(), nil); err != nil {
+			return nil, err
+		}
+	}
+	return &DescriptorSetRegistry{files: b.files}, nil
+}
+
+type descriptorSetBuilder struct {
+	protos map[string]*descriptorpb.FileDescriptorProto
+	files  *protoregistry.Files
+}
+
+// build registers a file after the files it imports. The chain of files
+// being built is used to report import cycles.
+func (b *descriptorSetBuilder) build(path string, chain []string) (protoreflect.FileDescriptor, error) {
+	if file, err := b.files.FindFileByPath(path); err == nil {
+		return file, nil
+	}
+	file, ok := b.protos[path]
+	if !ok {
+		return protoregistry.GlobalFiles.FindFileByPath(path)
+	}
+	for _, prev := range chain {
+		if prev == path {
+			return nil, fmt.Errorf("import cycle in descriptor set: %v", append(chain, path))
+		}
+	}
+	for _, dep := range file.GetDependency() {
+		if _, err := b.build(dep, append(chain, path)); err != nil {
+			return nil, fmt.Errorf("%s: import %q: %v", path, dep, err)
+		}
+	}
+	desc, err := protodesc.NewFile(file, descriptorSetResolver{b.files})
+	if err != nil {
+		return nil, err
+	}
+	if err := b.files.RegisterFile(desc); err != nil {
+		return nil, err
+	}
+	return desc, nil
+}
+
+// descriptorSetResolver resolves imports to the files in the set, falling
+// back to those linked into the binary.
+type descriptorSetResolver struct {
+	files *protoregistry.Files
+}
+
+func (r descriptorSetResolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if file, err := r.files.FindFileByPath(path); err == nil {
+		return file, nil
+	}
+	return protoregistry.GlobalFiles.FindFileByPath(path)
+}
+
+func (r descriptorSetResolver) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if desc, err := r.files.FindDescriptorByName(name); err == nil {
+		return desc, nil
+	}
+	return protoregistry.GlobalFiles.FindDescriptorByName(name)
+}
+
+func (r *DescriptorSetRegistry) UnstableProtoMessageType(name string) (reflect.Type, error) {
+	return proto.MessageType(name), nil
+}
+
+func (r *DescriptorSetRegistry) UnstableProtoMessageDescriptor(name string) (protoreflect.MessageDescriptor, error) {
+	desc, err := r.files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, nil
+	}
+	msgDesc, _ := desc.(protoreflect.MessageDescriptor)
+	return msgDesc, nil
+}
+
+func (r *DescriptorSetRegistry) UnstableProtoServiceDescriptor(name string) protoreflect.ServiceDescriptor {
+	desc, err := r.files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return lookupProtoService(nil, name)
+	}
+	svcDesc, _ := desc.(protoreflect.ServiceDescriptor)
+	return svcDesc
+}
+
+// UnstableRangeProtoFiles iterates over the files in the set, and then
+// those linked into the binary that aren't.
+func (r *DescriptorSetRegistry) UnstableRangeProtoFiles(f func(protoreflect.FileDescriptor) bool) {
+	stopped := false
+	r.files.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		stopped = !f(file)
+		return !stopped
+	})
+	if stopped {
+		return
+	}
+	protoregistry.GlobalFiles.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		if _, err := r.files.FindFileByPath(file.Path()); err == nil {
+			return true
+		}
+		return f(file)
+	})
+}
+
+func (r *DescriptorSetRegistry) UnstableEnumValueMap(name string) map[string]int32 {
+	desc, err := r.files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return proto.EnumValueMap(name)
+	}
+	enumDesc, ok := desc.(protoreflect.EnumDescriptor)
+	if !ok {
+		return nil
+	}
+	return enumValueMap(enumDesc)
+}
+
+func enumValueMap(desc protoreflect.EnumDescriptor) map[string]int32 {
+	values := desc.Values()
+	valueMap := make(map[string]int32, values.Len())
+	for ii := 0; ii < values.Len(); ii++ {
+		valueMap[string(values.Get(ii).Name())] = int32(values.Get(ii).Number())
+	}
+	return valueMap
+}
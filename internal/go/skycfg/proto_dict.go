@@ -0,0 +1,329 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Implementation of the `proto.to_dict()` built-in function.
+// Converts a message into a dict of its set fields, keyed by field name.
+// Submessages become dicts, repeated fields become lists, and enum values
+// become their names. Durations, timestamps, and wrappers become the strings
+// and scalars that their fields can be assigned, such as "1m30s".
+func fnProtoToDict(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msg *skyProtoMessage
+	if err := wantSingleProtoMessage("proto.to_dict", args, kwargs, &msg); err != nil {
+		return nil, err
+	}
+	return messageToDict(msg)
+}
+
+// Implementation of the `proto.from_dict()` built-in function.
+// Builds a message from a dict in the format returned by `proto.to_dict()`.
+// Nested dicts and lists of dicts are converted to submessages, and enum
+// fields accept either names or numbers. Errors in nested values name the
+// path of the field, such as "r_submsg[1].f_int32".
+func fnProtoFromDict(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msgType starlark.Value
+	var value *starlark.Dict
+	if err := starlark.UnpackPositionalArgs("proto.from_dict", args, kwargs, 2, &msgType, &value); err != nil {
+		return nil, err
+	}
+	protoMsgType, ok := msgType.(*skyProtoMessageType)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.MessageType", "proto.from_dict", msgType.Type())
+	}
+	d := &dictDecoder{registry: protoMsgType.registry}
+	if d.registry == nil {
+		d.registry = &defaultProtoRegistry{}
+	}
+	wrapper, err := d.message(newEmptyMessage(protoMsgType.emptyMsg), value, "")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", "proto.from_dict", err)
+	}
+	wrapper.setOrigin(t)
+	return wrapper, nil
+}
+
+func messageToDict(msg *skyProtoMessage) (*starlark.Dict, error) {
+	dict := &starlark.Dict{}
+	for _, name := range msg.fieldNames() {
+		isSet, err := msg.isSet(name)
+		if err != nil {
+			return nil, err
+		}
+		if !isSet {
+			continue
+		}
+		val, err := msg.Attr(name)
+		if err != nil {
+			return nil, err
+		}
+		converted, err := valueToDictValue(val)
+		if err != nil {
+			return nil, err
+		}
+		if err := dict.SetKey(starlark.String(name), converted); err != nil {
+			return nil, err
+		}
+	}
+	return dict, nil
+}
+
+func valueToDictValue(val starlark.Value) (starlark.Value, error) {
+	switch val := val.(type) {
+	case *skyProtoMessage:
+		if converted, ok := wellKnownToDictValue(proto.MessageReflect(val.msg)); ok {
+			return converted, nil
+		}
+		return messageToDict(val)
+	case *skyProtoEnumValue:
+		return starlark.String(val.valueName), nil
+	case *protoRepeated:
+		items := make([]starlark.Value, val.Len())
+		for ii := range items {
+			item, err := valueToDictValue(val.Index(ii))
+			if err != nil {
+				return nil, err
+			}
+			items[ii] = item
+		}
+		return starlark.NewList(items), nil
+	case *starlark.List:
+		// Structs and lists of values are read as frozen values, which
+		// are copied so the dict can be modified.
+		items := make([]starlark.Value, val.Len())
+		for ii := range items {
+			item, err := valueToDictValue(val.Index(ii))
+			if err != nil {
+				return nil, err
+			}
+			items[ii] = item
+		}
+		return starlark.NewList(items), nil
+	case *starlark.Dict:
+		dict := &starlark.Dict{}
+		for _, item := range val.Items() {
+			itemVal, err := valueToDictValue(item[1])
+			if err != nil {
+				return nil, err
+			}
+			if err := dict.SetKey(item[0], itemVal); err != nil {
+				return nil, err
+			}
+		}
+		return dict, nil
+	case *protoMap:
+		dict := &starlark.Dict{}
+		for _, item := range val.dict.Items() {
+			itemVal, err := valueToDictValue(item[1])
+			if err != nil {
+				return nil, err
+			}
+			if err := dict.SetKey(item[0], itemVal); err != nil {
+				return nil, err
+			}
+		}
+		return dict, nil
+	}
+	return val, nil
+}
+
+type dictDecoder struct {
+	registry ProtoRegistry
+}
+
+// message sets the fields of msg, an empty message, from a dict. The path
+// locates nested messages within the outermost one, for error reporting.
+func (d *dictDecoder) message(msg proto.Message, dict *starlark.Dict, path string) (*skyProtoMessage, error) {
+	wrapper := NewSkyProtoMessage(msg)
+	wrapper.path = path
+	for _, item := range dict.Items() {
+		name, ok := item[0].(starlark.String)
+		if !ok {
+			err := fmt.Errorf("TypeError: keys of a `%s' dict must be field names, got %s", wrapper.Type(), item[0].Type())
+			if path != "" {
+				err = fmt.Errorf("%v (field %s)", err, path)
+			}
+			return nil, err
+		}
+		fieldPath := joinFieldPath(path, string(name))
+		fd := wrapper.fields.descriptor(string(name))
+		if fd == nil {
+			return nil, unknownFieldError(wrapper.Type(), fieldPath, item[1], "AttributeError: `%s' value has no field %q", wrapper.Type(), string(name))
+		}
+		var val starlark.Value
+		var err error
+		switch fields := wrapper.fields.(type) {
+		case *reflectFields:
+			val, err = d.reflectValue(fields.refl, fd, item[1], fieldPath)
+		case *structFields:
+			fieldType, _ := fields.fieldType(string(name))
+			val, err = d.value(fieldType, item[1], fieldPath)
+		}
+		if err != nil {
+			return nil, fieldRef{wrapper.Type(), fd, fieldPath, nil}.wrap(err, "")
+		}
+		if err := wrapper.SetField(string(name), val); err != nil {
+			return nil, err
+		}
+	}
+	return wrapper, nil
+}
+
+// value converts plain dicts, lists, and enum names or numbers into values
+// that can be assigned to a field of type t.
+func (d *dictDecoder) value(t reflect.Type, val starlark.Value, path string) (starlark.Value, error) {
+	messageType := reflect.TypeOf((*proto.Message)(nil)).Elem()
+	enumType := reflect.TypeOf((*protoEnum)(nil)).Elem()
+	switch val := val.(type) {
+	case *starlark.Dict:
+		if t.Implements(messageType) {
+			msg := reflect.New(t.Elem()).Interface().(proto.Message)
+			if m, ok := msg.(protoreflect.ProtoMessage); ok && isStructType(m.ProtoReflect().Descriptor().FullName()) {
+				return val, nil
+			}
+			return d.message(msg, val, path)
+		}
+		if t.Kind() == reflect.Struct && reflect.PtrTo(t).Implements(messageType) {
+			return d.message(reflect.New(t).Interface().(proto.Message), val, path)
+		}
+		if t.Kind() == reflect.Map {
+			dict := &starlark.Dict{}
+			for _, item := range val.Items() {
+				itemVal, err := d.value(t.Elem(), item[1], fmt.Sprintf("%s[%s]", path, item[0]))
+				if err != nil {
+					return nil, withIndex(err, item[0].String())
+				}
+				if err := dict.SetKey(item[0], itemVal); err != nil {
+					return nil, err
+				}
+			}
+			return dict, nil
+		}
+	case *starlark.List:
+		if t.Kind() == reflect.Slice {
+			items := make([]starlark.Value, val.Len())
+			for ii := range items {
+				item, err := d.value(t.Elem(), val.Index(ii), fmt.Sprintf("%s[%d]", path, ii))
+				if err != nil {
+					return nil, withIndex(err, fmt.Sprint(ii))
+				}
+				items[ii] = item
+			}
+			return starlark.NewList(items), nil
+		}
+	case starlark.String, starlark.Int:
+		elemType := t
+		if elemType.Kind() == reflect.Ptr {
+			elemType = elemType.Elem()
+		}
+		if elemType.Implements(enumType) {
+			return d.enum(elemType, val)
+		}
+	}
+	return val, nil
+}
+
+func (d *dictDecoder) enum(t reflect.Type, val starlark.Value) (starlark.Value, error) {
+	typeName := enumTypeName(reflect.Zero(t).Interface().(protoEnum))
+	if name, ok := val.(starlark.String); ok {
+		value, ok := d.registry.UnstableEnumValueMap(typeName)[string(name)]
+		if !ok {
+			return nil, newConversionError(t, val, "ValueError: %s is not a value of enum `%s'", name, typeName)
+		}
+		return &skyProtoEnumValue{typeName, string(name), value}, nil
+	}
+	number, ok := val.(starlark.Int).Int64()
+	if !ok || int64(int32(number)) != number {
+		return nil, newConversionError(t, val, "ValueError: value %v overflows type `int32'.", val)
+	}
+	enum := reflect.ValueOf(int32(number)).Convert(t).Interface().(protoEnum)
+	return &skyProtoEnumValue{typeName, enum.String(), int32(number)}, nil
+}
+
+// reflectValue is like value, for a field of an APIv2 message.
+func (d *dictDecoder) reflectValue(parent protoreflect.Message, fd protoreflect.FieldDescriptor, val starlark.Value, path string) (starlark.Value, error) {
+	switch {
+	case fd.IsMap():
+		dict, ok := val.(*starlark.Dict)
+		if !ok {
+			return val, nil
+		}
+		newMessage := func() protoreflect.Message { return parent.NewField(fd).Map().NewValue().Message() }
+		converted := &starlark.Dict{}
+		for _, item := range dict.Items() {
+			itemVal, err := d.reflectElem(fd.MapValue(), newMessage, item[1], fmt.Sprintf("%s[%s]", path, item[0]))
+			if err != nil {
+				return nil, withIndex(err, item[0].String())
+			}
+			if err := converted.SetKey(item[0], itemVal); err != nil {
+				return nil, err
+			}
+		}
+		return converted, nil
+	case fd.IsList():
+		list, ok := val.(*starlark.List)
+		if !ok {
+			return val, nil
+		}
+		newMessage := func() protoreflect.Message { return parent.NewField(fd).List().NewElement().Message() }
+		items := make([]starlark.Value, list.Len())
+		for ii := range items {
+			item, err := d.reflectElem(fd, newMessage, list.Index(ii), fmt.Sprintf("%s[%d]", path, ii))
+			if err != nil {
+				return nil, withIndex(err, fmt.Sprint(ii))
+			}
+			items[ii] = item
+		}
+		return starlark.NewList(items), nil
+	}
+	return d.reflectElem(fd, func() protoreflect.Message { return parent.NewField(fd).Message() }, val, path)
+}
+
+// reflectElem converts a singular value, or an element of a list or map.
+func (d *dictDecoder) reflectElem(fd protoreflect.FieldDescriptor, newMessage func() protoreflect.Message, val starlark.Value, path string) (starlark.Value, error) {
+	switch val := val.(type) {
+	case *starlark.Dict:
+		if fd.Message() != nil && !isStructType(fd.Message().FullName()) {
+			return d.message(proto.MessageV1(newMessage().Interface()), val, path)
+		}
+	case starlark.String:
+		if ed := fd.Enum(); ed != nil {
+			value := ed.Values().ByName(protoreflect.Name(val))
+			if value == nil {
+				return nil, reflectElemType(fd).errorf(val, "ValueError: %s is not a value of enum `%s'", val, ed.FullName())
+			}
+			return reflectEnumValue(ed, value.Number()), nil
+		}
+	case starlark.Int:
+		if ed := fd.Enum(); ed != nil {
+			number, ok := val.Int64()
+			if !ok || int64(int32(number)) != number {
+				return nil, reflectElemType(fd).errorf(val, "ValueError: value %v overflows type `int32'.", val)
+			}
+			return reflectEnumValue(ed, protoreflect.EnumNumber(number)), nil
+		}
+	}
+	return val, nil
+}
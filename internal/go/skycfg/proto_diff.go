@@ -0,0 +1,343 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Implementation of the `proto.diff()` built-in function. Returns the
+// fields that differ between two messages of the same type, as a list of
+// proto.FieldDiff values with the `path` of each field and its `old` and
+// `new` values, which are None if the field is unset. Submessages set in
+// both are compared field by field; repeated and map fields are compared
+// as a whole.
+//
+//  def proto.diff(a, b) -> list
+func fnProtoDiff(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var aVal, bVal starlark.Value
+	if err := starlark.UnpackPositionalArgs("proto.diff", args, kwargs, 2, &aVal, &bVal); err != nil {
+		return nil, err
+	}
+	a, ok := aVal.(*skyProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.Message", "proto.diff", aVal.Type())
+	}
+	b, ok := bVal.(*skyProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 2: got %s, want proto.Message", "proto.diff", bVal.Type())
+	}
+	if a.Type() != b.Type() {
+		return nil, fmt.Errorf("%s: can't compare a %s to a %s", "proto.diff", a.Type(), b.Type())
+	}
+	var items []starlark.Value
+	for _, d := range diffProtoMessages(a.msg, b.msg, false) {
+		diff := &skyProtoFieldDiff{path: d.path, text: d.String(), old: starlark.None, new: starlark.None}
+		var err error
+		if d.a.IsValid() {
+			diff.old, err = diffFieldValue(a, d.path)
+		}
+		if err == nil && d.b.IsValid() {
+			diff.new, err = diffFieldValue(b, d.path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", "proto.diff", err)
+		}
+		items = append(items, diff)
+	}
+	return starlark.NewList(items), nil
+}
+
+// diffFieldValue returns the value of the field at a path of a diff.
+func diffFieldValue(msg *skyProtoMessage, path string) (starlark.Value, error) {
+	steps, err := parseProtoPath(path)
+	if err != nil {
+		return nil, err
+	}
+	container, err := walkProtoPath(msg, steps, false)
+	if err != nil || container.val == nil {
+		return starlark.None, err
+	}
+	return container.get(steps[len(steps)-1])
+}
+
+// skyProtoFieldDiff is a field that differs between two messages, as
+// returned by proto.diff().
+type skyProtoFieldDiff struct {
+	path     string
+	text     string
+	old, new starlark.Value
+}
+
+var _ starlark.HasAttrs = (*skyProtoFieldDiff)(nil)
+
+func (d *skyProtoFieldDiff) String() string        { return d.text }
+func (d *skyProtoFieldDiff) Type() string          { return "proto.FieldDiff" }
+func (d *skyProtoFieldDiff) Truth() starlark.Bool  { return starlark.True }
+func (d *skyProtoFieldDiff) AttrNames() []string   { return []string{"new", "old", "path"} }
+func (d *skyProtoFieldDiff) Hash() (uint32, error) { return starlark.String(d.text).Hash() }
+
+// Freeze freezes the old and new values, which are the fields of the
+// compared messages rather than copies of them.
+func (d *skyProtoFieldDiff) Freeze() {
+	d.old.Freeze()
+	d.new.Freeze()
+}
+
+func (d *skyProtoFieldDiff) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "path":
+		return starlark.String(d.path), nil
+	case "old":
+		return d.old, nil
+	case "new":
+		return d.new, nil
+	}
+	return nil, nil
+}
+
+// A single field-level difference between two protobuf messages of the
+// same type. Values are invalid (zero reflect.Value) when the field is
+// unset on that side.
+type protoFieldDiff struct {
+	path string
+	a, b reflect.Value
+}
+
+// diffProtoMessages reports the fields that differ between two messages of
+// the same Go type. If setOnly is true, fields that are unset in `a` are
+// skipped, which is useful for comparing a sparse message against a fully
+// populated one.
+func diffProtoMessages(a, b proto.Message, setOnly bool) []protoFieldDiff {
+	var diffs []protoFieldDiff
+	if _, ok := a.(protoreflect.ProtoMessage); ok {
+		diffReflectMessages("", proto.MessageReflect(a), proto.MessageReflect(b), setOnly, &diffs)
+		return diffs
+	}
+	diffProtoStructs("", reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem(), setOnly, &diffs)
+	return diffs
+}
+
+func diffProtoStructs(prefix string, a, b reflect.Value, setOnly bool, diffs *[]protoFieldDiff) {
+	props := protoGetProperties(a.Type())
+	for _, prop := range props.Prop {
+		if prop.Tag == 0 {
+			continue
+		}
+		diffProtoField(prefix+prop.OrigName, a.FieldByName(prop.Name), b.FieldByName(prop.Name), setOnly, diffs)
+	}
+	var oneofNames []string
+	for name := range props.OneofTypes {
+		oneofNames = append(oneofNames, name)
+	}
+	sort.Strings(oneofNames)
+	for _, name := range oneofNames {
+		prop := props.OneofTypes[name]
+		aVal := oneofFieldValue(a, prop)
+		bVal := oneofFieldValue(b, prop)
+		if !aVal.IsValid() && !bVal.IsValid() {
+			continue
+		}
+		if !aVal.IsValid() || !bVal.IsValid() {
+			if !aVal.IsValid() && setOnly {
+				continue
+			}
+			*diffs = append(*diffs, protoFieldDiff{prefix + name, aVal, bVal})
+			continue
+		}
+		diffProtoField(prefix+name, aVal, bVal, setOnly, diffs)
+	}
+}
+
+// diffReflectMessages is like diffProtoStructs, for APIv2 messages. The
+// values in its diffs are converted to the Go types that protoc-gen-go
+// would generate, so that they're formatted consistently.
+func diffReflectMessages(prefix string, a, b protoreflect.Message, setOnly bool, diffs *[]protoFieldDiff) {
+	fields := a.Descriptor().Fields()
+	for ii := 0; ii < fields.Len(); ii++ {
+		fd := fields.Get(ii)
+		path := prefix + string(fd.Name())
+		aSet, bSet := a.Has(fd), b.Has(fd)
+		if setOnly && !aSet {
+			continue
+		}
+		if aSet && bSet && fd.Message() != nil && !fd.IsList() && !fd.IsMap() {
+			diffReflectMessages(path+".", a.Get(fd).Message(), b.Get(fd).Message(), setOnly, diffs)
+			continue
+		}
+		if aSet == bSet && (!aSet || reflectFieldsEqual(fd, a.Get(fd), b.Get(fd))) {
+			continue
+		}
+		*diffs = append(*diffs, protoFieldDiff{path, reflectDiffValue(a, fd), reflectDiffValue(b, fd)})
+	}
+}
+
+func reflectFieldsEqual(fd protoreflect.FieldDescriptor, a, b protoreflect.Value) bool {
+	switch {
+	case fd.IsList():
+		aList, bList := a.List(), b.List()
+		if aList.Len() != bList.Len() {
+			return false
+		}
+		for ii := 0; ii < aList.Len(); ii++ {
+			if !reflectValuesEqual(fd, aList.Get(ii), bList.Get(ii)) {
+				return false
+			}
+		}
+		return true
+	case fd.IsMap():
+		aMap, bMap := a.Map(), b.Map()
+		if aMap.Len() != bMap.Len() {
+			return false
+		}
+		equal := true
+		aMap.Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+			equal = bMap.Has(k) && reflectValuesEqual(fd.MapValue(), v, bMap.Get(k))
+			return equal
+		})
+		return equal
+	}
+	return reflectValuesEqual(fd, a, b)
+}
+
+func reflectValuesEqual(fd protoreflect.FieldDescriptor, a, b protoreflect.Value) bool {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return proto.Equal(proto.MessageV1(a.Message().Interface()), proto.MessageV1(b.Message().Interface()))
+	case protoreflect.BytesKind:
+		return bytes.Equal(a.Bytes(), b.Bytes())
+	}
+	return a.Interface() == b.Interface()
+}
+
+func reflectDiffValue(msg protoreflect.Message, fd protoreflect.FieldDescriptor) reflect.Value {
+	if !msg.Has(fd) {
+		return reflect.Value{}
+	}
+	val := msg.Get(fd)
+	switch {
+	case fd.IsList():
+		list := val.List()
+		items := make([]interface{}, list.Len())
+		for ii := range items {
+			items[ii] = reflectGoValue(fd, list.Get(ii))
+		}
+		return reflect.ValueOf(items)
+	case fd.IsMap():
+		items := make(map[interface{}]interface{})
+		val.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+			items[k.Interface()] = reflectGoValue(fd.MapValue(), v)
+			return true
+		})
+		return reflect.ValueOf(items)
+	}
+	return reflect.ValueOf(reflectGoValue(fd, val))
+}
+
+func reflectGoValue(fd protoreflect.FieldDescriptor, val protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return proto.MessageV1(val.Message().Interface())
+	case protoreflect.EnumKind:
+		return reflectEnumValue(fd.Enum(), val.Enum()).valueName
+	}
+	return val.Interface()
+}
+
+func diffProtoField(path string, a, b reflect.Value, setOnly bool, diffs *[]protoFieldDiff) {
+	if setOnly && isZeroProtoField(a) {
+		return
+	}
+	if isProtoMessageValue(a) {
+		aNil := a.Kind() == reflect.Ptr && a.IsNil()
+		bNil := b.Kind() == reflect.Ptr && b.IsNil()
+		if aNil || bNil {
+			if aNil != bNil {
+				*diffs = append(*diffs, protoFieldDiff{path, fieldOrInvalid(a), fieldOrInvalid(b)})
+			}
+			return
+		}
+		diffProtoStructs(path+".", reflect.Indirect(a), reflect.Indirect(b), setOnly, diffs)
+		return
+	}
+	if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+		*diffs = append(*diffs, protoFieldDiff{path, fieldOrInvalid(a), fieldOrInvalid(b)})
+	}
+}
+
+// Returns the value of a oneof member if it's the currently selected
+// member, or an invalid reflect.Value otherwise.
+func oneofFieldValue(msg reflect.Value, prop *proto.OneofProperties) reflect.Value {
+	ifaceField := msg.Field(prop.Field)
+	if ifaceField.IsNil() || ifaceField.Elem().Type() != prop.Type {
+		return reflect.Value{}
+	}
+	return ifaceField.Elem().Elem().Field(0)
+}
+
+func isProtoMessageValue(val reflect.Value) bool {
+	messageType := reflect.TypeOf((*proto.Message)(nil)).Elem()
+	t := val.Type()
+	if t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct {
+		return t.Implements(messageType)
+	}
+	if t.Kind() == reflect.Struct {
+		return reflect.PtrTo(t).Implements(messageType)
+	}
+	return false
+}
+
+func isZeroProtoField(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return val.IsNil()
+	case reflect.Slice, reflect.Map:
+		return val.Len() == 0
+	}
+	return reflect.DeepEqual(val.Interface(), reflect.Zero(val.Type()).Interface())
+}
+
+func fieldOrInvalid(val reflect.Value) reflect.Value {
+	if isZeroProtoField(val) {
+		return reflect.Value{}
+	}
+	return val
+}
+
+func (d protoFieldDiff) String() string {
+	return fmt.Sprintf("%s: %s -> %s", d.path, formatDiffValue(d.a), formatDiffValue(d.b))
+}
+
+func formatDiffValue(val reflect.Value) string {
+	if !val.IsValid() {
+		return "<unset>"
+	}
+	val = reflect.Indirect(val)
+	if val.CanAddr() {
+		if msg, ok := val.Addr().Interface().(proto.Message); ok {
+			return fmt.Sprintf("<%s %s>", messageTypeName(msg), proto.CompactTextString(msg))
+		}
+	}
+	return fmt.Sprintf("%v", val.Interface())
+}
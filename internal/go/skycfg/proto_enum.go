@@ -74,6 +74,92 @@ func (v *skyProtoEnumValue) Hash() (uint32, error) {
 	return starlark.MakeInt64(int64(v.value)).Hash()
 }
 
+var _ starlark.HasAttrs = (*skyProtoEnumValue)(nil)
+
+func (v *skyProtoEnumValue) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "name":
+		return starlark.String(v.valueName), nil
+	case "number":
+		return starlark.MakeInt64(int64(v.value)), nil
+	}
+	return nil, nil
+}
+
+func (v *skyProtoEnumValue) AttrNames() []string {
+	return []string{"name", "number"}
+}
+
+// values returns the values of an enum type, sorted by number. Aliases
+// for the same number are sorted by name.
+func (t *skyProtoEnumType) values() []*skyProtoEnumValue {
+	values := make([]*skyProtoEnumValue, 0, len(t.valueMap))
+	for name, value := range t.valueMap {
+		values = append(values, &skyProtoEnumValue{t.name, name, value})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].value != values[j].value {
+			return values[i].value < values[j].value
+		}
+		return values[i].valueName < values[j].valueName
+	})
+	return values
+}
+
+// Implementation of the `proto.enum_values()` built-in function.
+// Returns the values of an enum type, sorted by number.
+//
+//  def proto.enum_values(enum_type) -> list
+func fnProtoEnumValues(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var typ starlark.Value
+	if err := starlark.UnpackPositionalArgs("proto.enum_values", args, kwargs, 1, &typ); err != nil {
+		return nil, err
+	}
+	enumType, ok := typ.(*skyProtoEnumType)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.EnumType", "proto.enum_values", typ.Type())
+	}
+	values := enumType.values()
+	items := make([]starlark.Value, len(values))
+	for ii, value := range values {
+		items[ii] = value
+	}
+	return starlark.NewList(items), nil
+}
+
+// Implementation of the `proto.enum_value()` built-in function.
+// Returns the value of an enum type with the given name or number. If
+// several names alias the same number, the first by name is returned.
+//
+//  def proto.enum_value(enum_type, name_or_number)
+func fnProtoEnumValue(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var typ, key starlark.Value
+	if err := starlark.UnpackPositionalArgs("proto.enum_value", args, kwargs, 2, &typ, &key); err != nil {
+		return nil, err
+	}
+	enumType, ok := typ.(*skyProtoEnumType)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.EnumType", "proto.enum_value", typ.Type())
+	}
+	switch key := key.(type) {
+	case starlark.String:
+		if value, ok := enumType.valueMap[string(key)]; ok {
+			return &skyProtoEnumValue{enumType.name, string(key), value}, nil
+		}
+		return nil, fmt.Errorf("%s: %s is not a value of enum `%s'", "proto.enum_value", key, enumType.name)
+	case starlark.Int:
+		if number, ok := key.Int64(); ok {
+			for _, value := range enumType.values() {
+				if int64(value.value) == number {
+					return value, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("%s: %s is not a number of enum `%s'", "proto.enum_value", key, enumType.name)
+	}
+	return nil, fmt.Errorf("%s: for parameter 2: got %s, want string or int", "proto.enum_value", key.Type())
+}
+
 // Interface for generated enum types.
 type protoEnum interface {
 	String() string
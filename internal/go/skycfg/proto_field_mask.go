@@ -0,0 +1,154 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// Implementation of the `proto.field_mask()` built-in function.
+// Returns a google.protobuf.FieldMask with the given paths. If a message
+// type is given, each path must name a field of it.
+//
+//  def proto.field_mask(paths, msg_type=None) -> google.protobuf.FieldMask
+func fnProtoFieldMask(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pathsVal starlark.Iterable
+	var msgType starlark.Value = starlark.None
+	if err := starlark.UnpackArgs("proto.field_mask", args, kwargs, "paths", &pathsVal, "msg_type?", &msgType); err != nil {
+		return nil, err
+	}
+	paths, err := fieldMaskPaths(pathsVal)
+	if err != nil {
+		return nil, fmt.Errorf("%s: for parameter 1: %v", "proto.field_mask", err)
+	}
+	if msgType != starlark.None {
+		protoMsgType, ok := msgType.(*skyProtoMessageType)
+		if !ok {
+			return nil, fmt.Errorf("%s: for parameter 2: got %s, want proto.MessageType", "proto.field_mask", msgType.Type())
+		}
+		desc := proto.MessageV2(protoMsgType.emptyMsg).ProtoReflect().Descriptor()
+		for _, path := range paths {
+			if err := checkFieldMaskPath(desc, path); err != nil {
+				return nil, fmt.Errorf("%s: %v", "proto.field_mask", err)
+			}
+		}
+	}
+	wrapper := NewSkyProtoMessage(&fieldmaskpb.FieldMask{Paths: paths})
+	wrapper.setOrigin(t)
+	return wrapper, nil
+}
+
+// Implementation of the `proto.apply_mask()` built-in function.
+// Returns a copy of the message with only the fields named by the mask,
+// which is a google.protobuf.FieldMask or a list of paths.
+//
+//  def proto.apply_mask(msg, mask) -> msg
+func fnProtoApplyMask(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var val, maskVal starlark.Value
+	if err := starlark.UnpackPositionalArgs("proto.apply_mask", args, kwargs, 2, &val, &maskVal); err != nil {
+		return nil, err
+	}
+	msg, ok := val.(*skyProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.Message", "proto.apply_mask", val.Type())
+	}
+	var paths []string
+	switch mask := maskVal.(type) {
+	case *skyProtoMessage:
+		fieldMask, ok := mask.msg.(*fieldmaskpb.FieldMask)
+		if !ok {
+			return nil, fmt.Errorf("%s: for parameter 2: got %s, want google.protobuf.FieldMask", "proto.apply_mask", mask.Type())
+		}
+		paths = fieldMask.Paths
+	case starlark.Iterable:
+		var err error
+		if paths, err = fieldMaskPaths(mask); err != nil {
+			return nil, fmt.Errorf("%s: for parameter 2: %v", "proto.apply_mask", err)
+		}
+	default:
+		return nil, fmt.Errorf("%s: for parameter 2: got %s, want google.protobuf.FieldMask", "proto.apply_mask", maskVal.Type())
+	}
+
+	// Values are taken from a copy of the message, so that the result
+	// doesn't share them.
+	src := proto.MessageV2(proto.Clone(msg.msg)).ProtoReflect()
+	dst := src.New()
+	for _, path := range paths {
+		if err := checkFieldMaskPath(src.Descriptor(), path); err != nil {
+			return nil, fmt.Errorf("%s: %v", "proto.apply_mask", err)
+		}
+		copyFieldMaskPath(dst, src, strings.Split(path, "."))
+	}
+	wrapper := NewSkyProtoMessage(proto.MessageV1(dst.Interface()))
+	wrapper.setOrigin(t)
+	return wrapper, nil
+}
+
+func fieldMaskPaths(val starlark.Iterable) ([]string, error) {
+	var paths []string
+	iter := val.Iterate()
+	defer iter.Done()
+	var item starlark.Value
+	for iter.Next(&item) {
+		path, ok := item.(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("got %s in paths, want string", item.Type())
+		}
+		paths = append(paths, string(path))
+	}
+	return paths, nil
+}
+
+// checkFieldMaskPath returns an error unless path names a field of desc.
+// Each field in the path but the last must be a singular message field.
+func checkFieldMaskPath(desc protoreflect.MessageDescriptor, path string) error {
+	parts := strings.Split(path, ".")
+	for ii, part := range parts {
+		fd := desc.Fields().ByName(protoreflect.Name(part))
+		if fd == nil {
+			return fmt.Errorf("ValueError: field mask path %q: `%s' has no field %q", path, desc.FullName(), part)
+		}
+		if ii == len(parts)-1 {
+			break
+		}
+		if fd.Message() == nil || fd.IsList() || fd.IsMap() {
+			return fmt.Errorf("ValueError: field mask path %q: field %q of `%s' isn't a singular message", path, part, desc.FullName())
+		}
+		desc = fd.Message()
+	}
+	return nil
+}
+
+// copyFieldMaskPath copies the field at path from src to dst, creating the
+// messages that contain it. Nothing is copied if the field isn't set.
+func copyFieldMaskPath(dst, src protoreflect.Message, path []string) {
+	fd := src.Descriptor().Fields().ByName(protoreflect.Name(path[0]))
+	if !src.Has(fd) {
+		return
+	}
+	if len(path) == 1 {
+		dst.Set(fd, src.Get(fd))
+		return
+	}
+	copyFieldMaskPath(dst.Mutable(fd).Message(), src.Get(fd).Message(), path[1:])
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"reflect"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// NewIsolatedProtoRegistry returns a registry that resolves types like
+// base, except that message types base describes with descriptors, such as
+// those of a DescriptorSetRegistry, are backed by those descriptors even if
+// generated code for a type of the same name is linked into the binary.
+// Configs loaded with registries for different versions of a schema then
+// each see their own version.
+//
+// Isolation only applies to the types base has descriptors for. A nil base,
+// which resolves the types registered with go-protobuf, or a base that only
+// resolves Go types is used as is, so its types aren't isolated from other
+// configs. The types of google.protobuf.Any values are resolved with the
+// registry when they're encoded as JSON or YAML, but not as text or binary,
+// and extensions registered with go-protobuf take precedence over those
+// declared by base's files.
+func NewIsolatedProtoRegistry(base ProtoRegistry) ProtoRegistry {
+	if base == nil {
+		base = &defaultProtoRegistry{}
+	}
+	return &isolatedProtoRegistry{ProtoRegistry: base}
+}
+
+type isolatedProtoRegistry struct {
+	ProtoRegistry
+}
+
+var _ protoDescriptorRegistry = (*isolatedProtoRegistry)(nil)
+
+func (r *isolatedProtoRegistry) UnstableProtoMessageType(name string) (reflect.Type, error) {
+	// Errors are reported by newMessageType() if base has no Go type for
+	// the name either, when it looks up the descriptor again.
+	if desc, err := r.UnstableProtoMessageDescriptor(name); err == nil && desc != nil {
+		return nil, nil
+	}
+	return r.ProtoRegistry.UnstableProtoMessageType(name)
+}
+
+func (r *isolatedProtoRegistry) UnstableProtoMessageDescriptor(name string) (protoreflect.MessageDescriptor, error) {
+	if descRegistry, ok := r.ProtoRegistry.(protoDescriptorRegistry); ok {
+		return descRegistry.UnstableProtoMessageDescriptor(name)
+	}
+	return nil, nil
+}
+
+func (r *isolatedProtoRegistry) UnstableRangeProtoFiles(f func(protoreflect.FileDescriptor) bool) {
+	rangeProtoFiles(r.ProtoRegistry, f)
+}
+
+func (r *isolatedProtoRegistry) UnstableProtoServiceDescriptor(name string) protoreflect.ServiceDescriptor {
+	return lookupProtoService(r.ProtoRegistry, name)
+}
+
+func (r *isolatedProtoRegistry) UnstableResolveProtoName(packageName, name string) (string, bool) {
+	if resolver, ok := r.ProtoRegistry.(ProtoNameResolver); ok {
+		return resolver.UnstableResolveProtoName(packageName, name)
+	}
+	return "", false
+}
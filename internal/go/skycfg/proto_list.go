@@ -0,0 +1,514 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"sync"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+type protoRepeated struct {
+	field listField
+	ref   fieldRef
+
+	// Submessages of the field inherit these from the message that the
+	// field belongs to.
+	strictOneofs bool
+	thread       *starlark.Thread
+	frozenBy     string
+
+	// unknown JSON keys within the field's elements, by their index when
+	// the field was accessed (see proto_unknown.go). Once an element is
+	// converted, it keeps its own keys.
+	unknown []*unknownJSON
+
+	// Elements are converted to Starlark values when they're first used,
+	// so that reading a few elements of a large field doesn't convert the
+	// rest. elems caches the converted elements until an operation needs
+	// all of them as a list, which is then kept in list.
+	mu        sync.Mutex
+	elems     []starlark.Value
+	list      *starlark.List
+	frozen    bool
+	itercount int
+}
+
+func newProtoRepeated(field listField) *protoRepeated {
+	return &protoRepeated{field: field}
+}
+
+// A listField holds the Go side of a repeated field, which protoRepeated
+// keeps in sync with its Starlark list.
+type listField interface {
+	elemTypeName() string
+
+	// convert checks that v can be stored in the list, and returns it in
+	// the form expected by append() and set().
+	convert(v starlark.Value) (interface{}, error)
+
+	// elemToStarlark returns the Starlark value of an element returned by
+	// convert, which for messages wraps the copy stored in the list.
+	elemToStarlark(val interface{}) starlark.Value
+
+	// len and get return the number of elements in the field, and the
+	// Starlark value of the element at an index.
+	len() int
+	get(i int) starlark.Value
+	append(vals ...interface{})
+	insert(i int, val interface{})
+	set(i int, val interface{})
+	delete(i int)
+	clear()
+}
+
+
+var _ starlark.Value = (*protoRepeated)(nil)
+var _ starlark.Iterable = (*protoRepeated)(nil)
+var _ starlark.Sequence = (*protoRepeated)(nil)
+var _ starlark.Indexable = (*protoRepeated)(nil)
+var _ starlark.HasAttrs = (*protoRepeated)(nil)
+var _ starlark.HasSetIndex = (*protoRepeated)(nil)
+var _ starlark.HasBinary = (*protoRepeated)(nil)
+
+func (r *protoRepeated) Attr(name string) (starlark.Value, error) {
+	wrapper, ok := listMethods[name]
+	if !ok {
+		return nil, nil
+	}
+	if wrapper != nil {
+		return wrapper(r), nil
+	}
+	return r.elements().Attr(name)
+}
+
+func (r *protoRepeated) AttrNames() []string                 { return new(starlark.List).AttrNames() }
+func (r *protoRepeated) Hash() (uint32, error)               { return 0, fmt.Errorf("unhashable type: list") }
+func (r *protoRepeated) Slice(x, y, step int) starlark.Value { return r.elements().Slice(x, y, step) }
+func (r *protoRepeated) String() string                      { return r.elements().String() }
+func (r *protoRepeated) Truth() starlark.Bool                { return r.Len() > 0 }
+
+func (r *protoRepeated) Freeze() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.frozen {
+		return
+	}
+	r.frozen = true
+	if r.list != nil {
+		r.list.Freeze()
+	}
+	for _, elem := range r.elems {
+		if elem != nil {
+			elem.Freeze()
+		}
+	}
+}
+
+func (r *protoRepeated) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.list != nil {
+		return r.list.Len()
+	}
+	return r.field.len()
+}
+
+func (r *protoRepeated) Index(i int) starlark.Value {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.elem(i)
+}
+
+// elem returns the element at index i, converting it if it hasn't been
+// used before. It's called with mu held.
+func (r *protoRepeated) elem(i int) starlark.Value {
+	if r.list != nil {
+		return r.list.Index(i)
+	}
+	for len(r.elems) <= i {
+		r.elems = append(r.elems, nil)
+	}
+	if r.elems[i] == nil {
+		elem := r.field.get(i)
+		r.initElem(i, elem)
+		if sub, ok := elem.(*skyProtoMessage); ok && i < len(r.unknown) {
+			sub.unknownJSON = r.unknown[i]
+		}
+		if r.frozen {
+			elem.Freeze()
+		}
+		r.elems[i] = elem
+	}
+	return r.elems[i]
+}
+
+// initElem records where a submessage element came from.
+func (r *protoRepeated) initElem(i int, elem starlark.Value) {
+	if sub, ok := elem.(*skyProtoMessage); ok {
+		sub.path = fmt.Sprintf("%s[%d]", r.ref.path, i)
+		sub.strictOneofs = r.strictOneofs
+		sub.thread = r.thread
+		sub.fieldErrors = r.ref.log
+		if r.frozen {
+			sub.frozenBy = r.frozenBy
+		}
+	}
+}
+
+// converted returns the elements that have been converted so far, indexed
+// as in the field. Elements that haven't been used are nil.
+func (r *protoRepeated) converted() []starlark.Value {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.list == nil {
+		return append([]starlark.Value(nil), r.elems...)
+	}
+	items := make([]starlark.Value, r.list.Len())
+	for ii := range items {
+		items[ii] = r.list.Index(ii)
+	}
+	return items
+}
+
+func (r *protoRepeated) setRef(ref fieldRef, msg *skyProtoMessage) {
+	r.ref = ref
+	r.strictOneofs = msg.strictOneofs
+	r.thread = msg.thread
+	for ii, elem := range r.converted() {
+		r.initElem(ii, elem)
+	}
+}
+
+// elements returns all of the field's elements as a list, which r keeps in
+// sync with the field from then on.
+func (r *protoRepeated) elements() *starlark.List {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.list == nil {
+		items := make([]starlark.Value, r.field.len())
+		for ii := range items {
+			items[ii] = r.elem(ii)
+		}
+		r.list = starlark.NewList(items)
+		r.elems = nil
+		if r.frozen {
+			r.list.Freeze()
+		}
+	}
+	return r.list
+}
+
+// Iterate returns an iterator that converts each element as it's reached,
+// until the field's elements are needed as a list.
+func (r *protoRepeated) Iterate() starlark.Iterator {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.list != nil {
+		return r.list.Iterate()
+	}
+	if !r.frozen {
+		r.itercount++
+	}
+	return &repeatedIterator{r: r}
+}
+
+// checkMutable returns an error if r is being iterated over lazily. Once
+// its elements are in a list, the list checks this itself.
+func (r *protoRepeated) checkMutable(verb string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.itercount > 0 {
+		return fmt.Errorf("cannot %s list during iteration", verb)
+	}
+	return nil
+}
+
+type repeatedIterator struct {
+	r *protoRepeated
+	i int
+}
+
+func (it *repeatedIterator) Next(p *starlark.Value) bool {
+	if it.i >= it.r.Len() {
+		return false
+	}
+	*p = it.r.Index(it.i)
+	it.i++
+	return true
+}
+
+func (it *repeatedIterator) Done() {
+	it.r.mu.Lock()
+	defer it.r.mu.Unlock()
+	if !it.r.frozen {
+		it.r.itercount--
+	}
+}
+
+func (r *protoRepeated) Type() string {
+	return fmt.Sprintf("list<%s>", r.field.elemTypeName())
+}
+
+func (r *protoRepeated) wrapClear() starlark.Value {
+	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		if err := starlark.UnpackPositionalArgs("clear", args, kwargs, 0); err != nil {
+			return nil, err
+		}
+		if err := r.Clear(); err != nil {
+			return nil, err
+		}
+		return starlark.None, nil
+	}
+	return starlark.NewBuiltin("clear", impl).BindReceiver(r)
+}
+
+func (r *protoRepeated) wrapAppend() starlark.Value {
+	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var val starlark.Value
+		if err := starlark.UnpackPositionalArgs("append", args, kwargs, 1, &val); err != nil {
+			return nil, err
+		}
+		if err := r.Append(val); err != nil {
+			return nil, err
+		}
+		return starlark.None, nil
+	}
+	return starlark.NewBuiltin("append", impl).BindReceiver(r)
+}
+
+func (r *protoRepeated) wrapExtend() starlark.Value {
+	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var val starlark.Iterable
+		if err := starlark.UnpackPositionalArgs("extend", args, kwargs, 1, &val); err != nil {
+			return nil, err
+		}
+		if err := r.implExtend(thread, val); err != nil {
+			return nil, err
+		}
+		return starlark.None, nil
+	}
+	return starlark.NewBuiltin("extend", impl).BindReceiver(r)
+}
+
+func (r *protoRepeated) wrapInsert() starlark.Value {
+	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var index int
+		var val starlark.Value
+		if err := starlark.UnpackPositionalArgs("insert", args, kwargs, 2, &index, &val); err != nil {
+			return nil, err
+		}
+		if err := r.implInsert(thread, index, val); err != nil {
+			return nil, err
+		}
+		return starlark.None, nil
+	}
+	return starlark.NewBuiltin("insert", impl).BindReceiver(r)
+}
+
+func (r *protoRepeated) wrapPop() starlark.Value {
+	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		n := r.Len()
+		index := n - 1
+		if err := starlark.UnpackPositionalArgs("pop", args, kwargs, 0, &index); err != nil {
+			return nil, err
+		}
+		if index < 0 {
+			index += n
+		}
+		if index < 0 || index >= n {
+			return nil, fmt.Errorf("pop: index %d is out of range [0:%d]", index, n)
+		}
+		return r.implPop(thread, index)
+	}
+	return starlark.NewBuiltin("pop", impl).BindReceiver(r)
+}
+
+func (r *protoRepeated) wrapRemove() starlark.Value {
+	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var val starlark.Value
+		if err := starlark.UnpackPositionalArgs("remove", args, kwargs, 1, &val); err != nil {
+			return nil, err
+		}
+		for ii := 0; ii < r.Len(); ii++ {
+			if eq, err := starlark.Equal(r.Index(ii), val); err != nil {
+				return nil, fmt.Errorf("remove: %v", err)
+			} else if eq {
+				if _, err := r.implPop(thread, ii); err != nil {
+					return nil, err
+				}
+				return starlark.None, nil
+			}
+		}
+		return nil, fmt.Errorf("remove: element not found")
+	}
+	return starlark.NewBuiltin("remove", impl).BindReceiver(r)
+}
+
+var listMethods = map[string]func(*protoRepeated) starlark.Value{
+	"clear":  (*protoRepeated).wrapClear,
+	"append": (*protoRepeated).wrapAppend,
+	"extend": (*protoRepeated).wrapExtend,
+	"index":  nil,
+	"insert": (*protoRepeated).wrapInsert,
+	"pop":    (*protoRepeated).wrapPop,
+	"remove": (*protoRepeated).wrapRemove,
+}
+
+func (r *protoRepeated) Clear() error {
+	if err := r.checkMutable("clear"); err != nil {
+		return err
+	}
+	if err := r.elements().Clear(); err != nil {
+		return err
+	}
+	r.field.clear()
+	return nil
+}
+
+func (r *protoRepeated) Append(v starlark.Value) error {
+	if err := r.checkMutable("append to"); err != nil {
+		return err
+	}
+	list := r.elements()
+	goVal, err := r.field.convert(v)
+	if err != nil {
+		return r.ref.wrap(err, fmt.Sprint(list.Len()))
+	}
+	if err := list.Append(r.elemToStarlark(list.Len(), goVal)); err != nil {
+		return err
+	}
+	r.field.append(goVal)
+	return nil
+}
+
+// elemToStarlark returns the value to store in the list for an element
+// that was set at index i. Messages are copied when they're set, so the
+// list holds the copy, and changing it changes the field.
+func (r *protoRepeated) elemToStarlark(i int, goVal interface{}) starlark.Value {
+	elem := r.field.elemToStarlark(goVal)
+	r.initElem(i, elem)
+	return elem
+}
+
+func (r *protoRepeated) implInsert(t *starlark.Thread, index int, v starlark.Value) error {
+	if err := r.checkMutable("insert into"); err != nil {
+		return err
+	}
+	list := r.elements()
+	n := list.Len()
+	if index < 0 {
+		index += n
+	}
+	if index < 0 {
+		index = 0
+	} else if index > n {
+		index = n
+	}
+	goVal, err := r.field.convert(v)
+	if err != nil {
+		return r.ref.wrap(err, fmt.Sprint(index))
+	}
+	listInsert, _ := list.Attr("insert")
+	args := starlark.Tuple{starlark.MakeInt(index), r.elemToStarlark(index, goVal)}
+	if _, err := starlark.Call(t, listInsert, args, nil); err != nil {
+		return err
+	}
+	r.field.insert(index, goVal)
+	return nil
+}
+
+func (r *protoRepeated) implPop(t *starlark.Thread, index int) (starlark.Value, error) {
+	if err := r.checkMutable("pop from"); err != nil {
+		return nil, err
+	}
+	listPop, _ := r.elements().Attr("pop")
+	val, err := starlark.Call(t, listPop, starlark.Tuple{starlark.MakeInt(index)}, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.field.delete(index)
+	return val, nil
+}
+
+func (r *protoRepeated) implExtend(t *starlark.Thread, iterable starlark.Iterable) error {
+	if err := r.checkMutable("extend"); err != nil {
+		return err
+	}
+	list := r.elements()
+	var skyValues []starlark.Value
+	var goValues []interface{}
+	iter := iterable.Iterate()
+	defer iter.Done()
+	var skyVal starlark.Value
+	for iter.Next(&skyVal) {
+		goVal, err := r.field.convert(skyVal)
+		if err != nil {
+			return r.ref.wrap(err, fmt.Sprint(list.Len()+len(skyValues)))
+		}
+		skyValues = append(skyValues, r.elemToStarlark(list.Len()+len(skyValues), goVal))
+		goValues = append(goValues, goVal)
+	}
+
+	listExtend, _ := list.Attr("extend")
+	args := starlark.Tuple([]starlark.Value{
+		starlark.NewList(skyValues),
+	})
+	if _, err := starlark.Call(t, listExtend, args, nil); err != nil {
+		return err
+	}
+	r.field.append(goValues...)
+	return nil
+}
+
+func (r *protoRepeated) SetIndex(i int, v starlark.Value) error {
+	if err := r.checkMutable("assign to element of"); err != nil {
+		return err
+	}
+	goVal, err := r.field.convert(v)
+	if err != nil {
+		return r.ref.wrap(err, fmt.Sprint(i))
+	}
+	if err := r.elements().SetIndex(i, r.elemToStarlark(i, goVal)); err != nil {
+		return err
+	}
+	r.field.set(i, goVal)
+	return nil
+}
+
+func (r *protoRepeated) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	if op == syntax.PLUS {
+		if side == starlark.Left {
+			switch y := y.(type) {
+			case *starlark.List:
+				return starlark.Binary(op, r.elements(), y)
+			case *protoRepeated:
+				return starlark.Binary(op, r.elements(), y.elements())
+			}
+			return nil, nil
+		}
+		if side == starlark.Right {
+			if _, ok := y.(*starlark.List); ok {
+				return starlark.Binary(op, y, r.elements())
+			}
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,263 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"sort"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+type protoMap struct {
+	field mapField
+	dict  *starlark.Dict
+	ref   fieldRef
+}
+
+// newProtoMap wraps a map field with the given entries. They're sorted by
+// key, so that iterating over the map and methods such as popitem() behave
+// the same on every run, rather than following Go's map order.
+func newProtoMap(field mapField, items []starlark.Tuple) *protoMap {
+	sort.SliceStable(items, func(i, j int) bool {
+		less, _ := starlark.Compare(syntax.LT, items[i][0], items[j][0])
+		return less
+	})
+	dict := &starlark.Dict{}
+	for _, item := range items {
+		if err := dict.SetKey(item[0], item[1]); err != nil {
+			panic(fmt.Sprintf("dict.SetKey(%s, %s): %v", item[0], item[1], err))
+		}
+	}
+	return &protoMap{field: field, dict: dict}
+}
+
+// A mapField holds the Go side of a map field, which protoMap keeps in
+// sync with its Starlark dict.
+type mapField interface {
+	keyTypeName() string
+	elemTypeName() string
+
+	// convertKey and convertElem check that a key or value can be stored
+	// in the map, and return it in the form expected by set().
+	convertKey(k starlark.Value) (interface{}, error)
+	convertElem(v starlark.Value) (interface{}, error)
+
+	// elemToStarlark returns the Starlark value of an element returned by
+	// convertElem, which for messages wraps the copy stored in the map.
+	elemToStarlark(v interface{}) starlark.Value
+	set(k, v interface{})
+	delete(k interface{})
+	clear()
+}
+
+var _ starlark.Value = (*protoMap)(nil)
+var _ starlark.Iterable = (*protoMap)(nil)
+var _ starlark.Sequence = (*protoMap)(nil)
+var _ starlark.HasAttrs = (*protoMap)(nil)
+var _ starlark.HasSetKey = (*protoMap)(nil)
+
+func (m *protoMap) Attr(name string) (starlark.Value, error) {
+	wrapper, ok := dictMethods[name]
+	if !ok {
+		return nil, nil
+	}
+	if wrapper != nil {
+		return wrapper(m), nil
+	}
+	return m.dict.Attr(name)
+}
+
+func (m *protoMap) AttrNames() []string                                { return m.dict.AttrNames() }
+func (m *protoMap) Freeze()                                            { m.dict.Freeze() }
+func (m *protoMap) Hash() (uint32, error)                              { return m.dict.Hash() }
+func (m *protoMap) Get(k starlark.Value) (starlark.Value, bool, error) { return m.dict.Get(k) }
+func (m *protoMap) Iterate() starlark.Iterator                         { return m.dict.Iterate() }
+func (m *protoMap) Len() int                                           { return m.dict.Len() }
+func (m *protoMap) String() string                                     { return m.dict.String() }
+func (m *protoMap) Truth() starlark.Bool                               { return m.dict.Truth() }
+
+func (m *protoMap) Type() string {
+	return fmt.Sprintf("map<%s, %s>", m.field.keyTypeName(), m.field.elemTypeName())
+}
+
+func (m *protoMap) wrapClear() starlark.Value {
+	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		if err := starlark.UnpackPositionalArgs("clear", args, kwargs, 0); err != nil {
+			return nil, err
+		}
+		if err := m.dict.Clear(); err != nil {
+			return nil, err
+		}
+		m.field.clear()
+		return starlark.None, nil
+	}
+	return starlark.NewBuiltin("clear", impl).BindReceiver(m)
+}
+
+func (m *protoMap) wrapSetDefault() starlark.Value {
+	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var key, defaultValue starlark.Value = nil, starlark.None
+		if err := starlark.UnpackPositionalArgs("setdefault", args, kwargs, 1, &key, &defaultValue); err != nil {
+			return nil, err
+		}
+		if val, ok, err := m.dict.Get(key); err != nil {
+			return nil, err
+		} else if ok {
+			return val, nil
+		}
+		if err := m.SetKey(key, defaultValue); err != nil {
+			return nil, err
+		}
+		val, _, err := m.dict.Get(key)
+		return val, err
+	}
+	return starlark.NewBuiltin("setdefault", impl).BindReceiver(m)
+}
+
+func (m *protoMap) wrapPop() starlark.Value {
+	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var key, defaultValue starlark.Value
+		if err := starlark.UnpackPositionalArgs("pop", args, kwargs, 1, &key, &defaultValue); err != nil {
+			return nil, err
+		}
+		val, found, err := m.delete(key)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return val, nil
+		}
+		if defaultValue != nil {
+			return defaultValue, nil
+		}
+		return nil, fmt.Errorf("pop: missing key")
+	}
+	return starlark.NewBuiltin("pop", impl).BindReceiver(m)
+}
+
+func (m *protoMap) wrapPopItem() starlark.Value {
+	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		if err := starlark.UnpackPositionalArgs("popitem", args, kwargs, 0); err != nil {
+			return nil, err
+		}
+		items := m.dict.Items()
+		if len(items) == 0 {
+			return nil, fmt.Errorf("popitem: empty dict")
+		}
+		if _, _, err := m.delete(items[0][0]); err != nil {
+			return nil, err
+		}
+		return items[0], nil
+	}
+	return starlark.NewBuiltin("popitem", impl).BindReceiver(m)
+}
+
+// delete removes a key from the map, returning its value if it was present.
+func (m *protoMap) delete(k starlark.Value) (starlark.Value, bool, error) {
+	val, found, err := m.dict.Delete(k)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	// Keys in the dict were converted when they were set, so this can't fail.
+	goKey, err := m.field.convertKey(k)
+	if err != nil {
+		return nil, false, m.ref.wrap(err, "")
+	}
+	m.field.delete(goKey)
+	return val, true, nil
+}
+
+// elemToStarlark returns the value to store in the dict for an element
+// that was set in the map. Messages are copied when they're set, so the
+// dict holds the copy, and changing it changes the map.
+func (m *protoMap) elemToStarlark(k starlark.Value, goVal interface{}) starlark.Value {
+	elem := m.field.elemToStarlark(goVal)
+	if sub, ok := elem.(*skyProtoMessage); ok {
+		sub.path = fmt.Sprintf("%s[%s]", m.ref.path, k.String())
+		sub.fieldErrors = m.ref.log
+	}
+	return elem
+}
+
+func (m *protoMap) wrapUpdate() starlark.Value {
+	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		// Use the underlying starlark `dict.update()` to get a Dict containing
+		// all the new values, so we don't have to recreate the API here. After
+		// the temp dict is constructed, type check.
+		tempDict := &starlark.Dict{}
+		tempUpdate, _ := tempDict.Attr("update")
+		if _, err := starlark.Call(thread, tempUpdate, args, kwargs); err != nil {
+			return nil, err
+		}
+		items := tempDict.Items()
+		goKeys := make([]interface{}, len(items))
+		goVals := make([]interface{}, len(items))
+		for ii, item := range items {
+			goKey, err := m.field.convertKey(item[0])
+			if err != nil {
+				return nil, m.ref.wrap(err, "")
+			}
+			goVal, err := m.field.convertElem(item[1])
+			if err != nil {
+				return nil, m.ref.wrap(err, item[0].String())
+			}
+			goKeys[ii], goVals[ii] = goKey, goVal
+		}
+
+		// Update the Dict first to catch potential immutability.
+		for ii, item := range items {
+			if err := m.dict.SetKey(item[0], m.elemToStarlark(item[0], goVals[ii])); err != nil {
+				return nil, err
+			}
+		}
+		for ii := range items {
+			m.field.set(goKeys[ii], goVals[ii])
+		}
+		return starlark.None, nil
+	}
+	return starlark.NewBuiltin("update", impl).BindReceiver(m)
+}
+
+func (m *protoMap) SetKey(k, v starlark.Value) error {
+	goKey, err := m.field.convertKey(k)
+	if err != nil {
+		return m.ref.wrap(err, "")
+	}
+	goVal, err := m.field.convertElem(v)
+	if err != nil {
+		return m.ref.wrap(err, k.String())
+	}
+	if err := m.dict.SetKey(k, m.elemToStarlark(k, goVal)); err != nil {
+		return err
+	}
+	m.field.set(goKey, goVal)
+	return nil
+}
+
+var dictMethods = map[string]func(*protoMap) starlark.Value{
+	"clear":      (*protoMap).wrapClear,
+	"get":        nil,
+	"items":      nil,
+	"keys":       nil,
+	"pop":        (*protoMap).wrapPop,
+	"popitem":    (*protoMap).wrapPopItem,
+	"setdefault": (*protoMap).wrapSetDefault,
+	"update":     (*protoMap).wrapUpdate,
+	"values":     nil,
+}
@@ -17,37 +17,140 @@
 package skycfg
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"math"
 	"reflect"
 	"sort"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
-	"github.com/golang/protobuf/ptypes"
-	dpb "github.com/golang/protobuf/ptypes/duration"
 	"go.starlark.net/starlark"
 	"go.starlark.net/syntax"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 // A Starlark built-in type representing a Protobuf message. Provides attributes
 // for accessing message fields using their original protobuf names.
 type skyProtoMessage struct {
 	msg    proto.Message
-	val    reflect.Value
-	fields []*proto.Properties
-	oneofs map[string]*proto.OneofProperties
+	fields messageFields
 	frozen bool
 
+	// where the message was created, if it was created by a Starlark call.
+	pos syntax.Position
+
+	// whether setting a oneof member may replace a different member.
+	strictOneofs bool
+
+	// where fields were last assigned, if known, for reporting conflicting
+	// oneof members and broken validation rules. thread is the thread that
+	// created the message, which is the one that assigns to its fields.
+	fieldSetAt map[string]string
+	thread     *starlark.Thread
+
+	// whether frozen messages assigned to fields are shared rather than
+	// copied (see proto_share.go).
+	shareSubmessages bool
+
+	// how this message came to be frozen, such as by its module finishing
+	// loading or by proto.freeze(), for error messages.
+	frozenBy string
+
+	// the path to this message from the message it was accessed through,
+	// such as "f_submsg", for error reporting.
+	path string
+
+	// records the FieldErrors from setting fields of this message and its
+	// submessages, for the thread that created it.
+	fieldErrors *fieldErrorLog
+
 	// lets the message wrapper keep track of per-field wrappers, for freezing.
+	// Frozen messages may be shared between modules that are loaded in
+	// parallel, so access is guarded by attrMu.
+	attrMu    sync.Mutex
 	attrCache map[string]starlark.Value
+
+	// metadata attached with annotate(), also guarded by attrMu.
+	annotations map[string]string
+
+	// keys of the JSON object the message was decoded from that aren't
+	// fields of the message, if they were preserved (see proto_unknown.go).
+	// The cached wrappers of fields keep the keys within them, which take
+	// precedence.
+	unknownJSON *unknownJSON
+
+	// set if the message is shared with other messages, and the names of
+	// fields holding shared submessages (see proto_share.go).
+	cow          *cowRef
+	sharedFields map[string]bool
+}
+
+// A messageFields accesses the fields of the message that a skyProtoMessage
+// wraps. Messages that implement the protobuf APIv2 reflection interface,
+// such as those generated by protoc-gen-go v1.20+ and dynamic messages, use
+// reflectFields (see proto_reflect.go). Other messages, including those
+// generated by gogo-protobuf, use structFields (see proto_struct.go).
+//
+// Only descriptor checks that a field exists; the other methods are only
+// called with the names of fields that it describes. Methods that are
+// passed the wrapper use it to check that the message can be modified and
+// to keep its cached field wrappers up to date.
+type messageFields interface {
+	// names returns the names of the fields, in the order that they're
+	// defined.
+	names() []string
+
+	// descriptor describes a field, or returns nil if there's no such
+	// field.
+	descriptor(name string) protoreflect.FieldDescriptor
+
+	// get returns the Starlark value of a field. It's called with
+	// msg.attrMu held.
+	get(msg *skyProtoMessage, name string) starlark.Value
+
+	// set assigns a Starlark value to a field, and clear resets a field
+	// to its default value, after checking that msg is mutable.
+	set(msg *skyProtoMessage, name string, sky starlark.Value) error
+	clear(msg *skyProtoMessage, name string)
+
+	// has reports whether a field with explicit presence is set, or
+	// returns false for ok if the field doesn't track presence. isSet
+	// reports whether any field is set, as `"name" in msg` does.
+	has(name string) (isSet, ok bool)
+	isSet(name string) bool
+
+	// whichOneof returns the name of the field that's set in a oneof, or
+	// "" if none is. It returns false if there's no such oneof.
+	whichOneof(oneof string) (string, bool)
+
+	// oneofOf returns the name of the oneof that a field is a member of,
+	// and the name of the oneof's currently set field. It returns false
+	// if the field isn't a member of a oneof.
+	oneofOf(name string) (oneof, current string, ok bool)
+
+	// rebind points the fields at a copy of the message, of the same type
+	// (see proto_share.go).
+	rebind(msg proto.Message)
+}
+
+// newMessageFields returns the messageFields that accesses the fields of
+// msg.
+func newMessageFields(msg proto.Message) messageFields {
+	if m, ok := msg.(protoreflect.ProtoMessage); ok {
+		return &reflectFields{m.ProtoReflect()}
+	}
+	return newStructFields(msg)
 }
 
 var _ starlark.HasAttrs = (*skyProtoMessage)(nil)
 var _ starlark.HasSetField = (*skyProtoMessage)(nil)
+var _ starlark.HasBinary = (*skyProtoMessage)(nil)
+var _ starlark.Comparable = (*skyProtoMessage)(nil)
 
 func (msg *skyProtoMessage) String() string {
 	return fmt.Sprintf("<%s %s>", msg.Type(), proto.CompactTextString(msg.msg))
@@ -64,49 +167,91 @@ func (msg *skyProtoMessage) Freeze() {
 	}
 }
 
+// Hash hashes the message's deterministic encoding, so that frozen messages
+// can be used as dict keys. Like lists, messages that can still be modified
+// are unhashable.
 func (msg *skyProtoMessage) Hash() (uint32, error) {
-	return 0, fmt.Errorf("skyProtoMessage.Hash: TODO")
+	if !msg.frozen {
+		return 0, fmt.Errorf("unhashable type: %s (use proto.freeze() to make it a key)", msg.Type())
+	}
+	data, err := protov2.MarshalOptions{Deterministic: true}.Marshal(proto.MessageV2(msg.msg))
+	if err != nil {
+		return 0, fmt.Errorf("unhashable type: %s: %v", msg.Type(), err)
+	}
+	return starlark.String(data).Hash()
+}
+
+// CompareSameType implements `==` and `!=`, which compare messages by
+// value, as proto.Equal does.
+func (msg *skyProtoMessage) CompareSameType(op syntax.Token, y starlark.Value, depth int) (bool, error) {
+	other := y.(*skyProtoMessage)
+	switch op {
+	case syntax.EQL:
+		return proto.Equal(msg.msg, other.msg), nil
+	case syntax.NEQ:
+		return !proto.Equal(msg.msg, other.msg), nil
+	}
+	return false, fmt.Errorf("%s %s %s not implemented", msg.Type(), op, y.Type())
 }
 
+// MarshalJSON encodes the message with the latest output schema. Since it
+// isn't called from a thread, the types of Any values are those registered
+// with go-protobuf.
 func (msg *skyProtoMessage) MarshalJSON() ([]byte, error) {
+	return msg.marshalJSON(&jsonpb.Marshaler{OrigName: true})
+}
+
+// marshalJSON is like MarshalJSON, with the given jsonpb options. The
+// options are ignored for Kubernetes types, which have their own JSON
+// encoding.
+func (msg *skyProtoMessage) marshalJSON(jsonMarshaler *jsonpb.Marshaler) ([]byte, error) {
 	if msg.looksLikeKubernetesGogo() {
 		return json.Marshal(msg.msg)
 	}
-
-	var jsonMarshaler = &jsonpb.Marshaler{OrigName: true}
 	jsonData, err := jsonMarshaler.MarshalToString(msg.msg)
 	if err != nil {
 		return nil, err
 	}
-	return []byte(jsonData), nil
+	return msg.withUnknownJSON([]byte(jsonData), jsonMarshaler.Indent)
+}
+
+// withUnknownJSON adds the message's preserved unknown JSON keys to its
+// JSON encoding.
+func (msg *skyProtoMessage) withUnknownJSON(jsonData []byte, indent string) ([]byte, error) {
+	unknown := msg.currentUnknownJSON()
+	if unknown == nil {
+		return jsonData, nil
+	}
+	merged, err := mergeUnknownJSON(jsonData, unknown)
+	if err != nil || indent == "" {
+		return merged, err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, merged, "", indent); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 func (msg *skyProtoMessage) looksLikeKubernetesGogo() bool {
-	path := msg.val.Type().PkgPath()
+	path := reflect.TypeOf(msg.msg).Elem().PkgPath()
 	return strings.HasPrefix(path, "k8s.io/api/") || strings.HasPrefix(path, "k8s.io/apimachinery/")
 }
 
 func NewSkyProtoMessage(msg proto.Message) *skyProtoMessage {
-	wrapper := &skyProtoMessage{
+	return &skyProtoMessage{
 		msg:       msg,
-		val:       reflect.ValueOf(msg).Elem(),
-		oneofs:    make(map[string]*proto.OneofProperties),
+		fields:    newMessageFields(msg),
 		attrCache: make(map[string]starlark.Value),
 	}
+}
 
-	protoProps := protoGetProperties(wrapper.val.Type())
-	for _, prop := range protoProps.Prop {
-		if prop.Tag == 0 {
-			// Skip attributes that don't correspond to a protobuf field.
-			continue
-		}
-		wrapper.fields = append(wrapper.fields, prop)
-	}
-	for fieldName, prop := range protoProps.OneofTypes {
-		wrapper.fields = append(wrapper.fields, prop.Prop)
-		wrapper.oneofs[fieldName] = prop
+// newEmptyMessage returns a new, empty message of the same type as msg.
+func newEmptyMessage(msg proto.Message) proto.Message {
+	if m, ok := msg.(protoreflect.ProtoMessage); ok {
+		return proto.MessageV1(m.ProtoReflect().New().Interface())
 	}
-	return wrapper
+	return reflect.New(reflect.TypeOf(msg).Elem()).Interface().(proto.Message)
 }
 
 func ToProtoMessage(val starlark.Value) (proto.Message, bool) {
@@ -116,737 +261,252 @@ func ToProtoMessage(val starlark.Value) (proto.Message, bool) {
 	return nil, false
 }
 
-func (msg *skyProtoMessage) checkMutable(verb string) error {
-	if msg.frozen {
-		return fmt.Errorf("cannot %s frozen message", verb)
-	}
-	return nil
-}
-
-func (msg *skyProtoMessage) Attr(name string) (starlark.Value, error) {
-	if attr, ok := msg.attrCache[name]; ok {
-		return attr, nil
-	}
-	for _, field := range msg.fields {
-		if field.OrigName != name {
-			continue
-		}
-		var out starlark.Value
-		if oneofProp, isOneof := msg.oneofs[name]; isOneof {
-			out = msg.getOneofField(name, oneofProp)
-		} else {
-			out = valueToStarlark(msg.val.FieldByName(field.Name))
-		}
-		if msg.frozen {
-			out.Freeze()
-		}
-		msg.attrCache[name] = out
-		return out, nil
-	}
-	return nil, nil
-}
-
-func (msg *skyProtoMessage) getOneofField(name string, prop *proto.OneofProperties) starlark.Value {
-	ifaceField := msg.val.Field(prop.Field)
-	if ifaceField.IsNil() {
-		return starlark.None
-	}
-	if ifaceField.Elem().Type() == prop.Type {
-		return valueToStarlark(ifaceField.Elem().Elem().Field(0))
-	}
-	return starlark.None
+// setOrigin records where a message was created by a Starlark call, and
+// applies the calling thread's settings for how the message may be changed.
+func (msg *skyProtoMessage) setOrigin(t *starlark.Thread) {
+	msg.pos = callerPosition(t)
+	msg.strictOneofs = strictOneofs(t)
+	msg.thread = t
+	msg.shareSubmessages = shareSubmessages(t)
+	msg.fieldErrors = fieldErrors(t)
 }
 
-func (msg *skyProtoMessage) AttrNames() []string {
-	var names []string
-	for _, field := range msg.fields {
-		names = append(names, field.OrigName)
+// callerPosition returns the position of the Starlark code calling the
+// current built-in, or an invalid position if called from Go.
+func callerPosition(t *starlark.Thread) syntax.Position {
+	if t == nil || t.TopFrame() == nil || t.Caller() == nil {
+		return syntax.Position{}
 	}
-	sort.Strings(names)
-	return names
+	return t.Caller().Position()
 }
 
-func (msg *skyProtoMessage) SetField(name string, sky starlark.Value) error {
-	var prop *proto.Properties
-	for _, fieldProp := range msg.fields {
-		if name != fieldProp.OrigName {
-			continue
-		}
-		prop = fieldProp
-		break
-	}
-	if prop == nil {
-		return fmt.Errorf("AttributeError: `%s' value has no field %q", msg.Type(), name)
-	}
-	if oneofProp, isOneof := msg.oneofs[name]; isOneof {
-		return msg.setOneofField(name, oneofProp, sky)
+// ValuePosition returns the source position where a value was created,
+// if known. Only message values and functions record their position.
+func ValuePosition(v starlark.Value) (syntax.Position, bool) {
+	switch v := v.(type) {
+	case *skyProtoMessage:
+		return v.pos, v.pos.IsValid()
+	case *starlark.Function:
+		return v.Position(), true
 	}
-	return msg.setSingleField(name, prop, sky)
+	return syntax.Position{}, false
 }
 
-func (msg *skyProtoMessage) setOneofField(name string, prop *proto.OneofProperties, sky starlark.Value) error {
-	// Oneofs are stored in a two-part format, where `msg.val` has a field of an intermediate interface
-	// type that can be constructed from the property type.
-	ifaceField := msg.val.Field(prop.Field)
-
-	field, ok := prop.Type.Elem().FieldByName(prop.Prop.Name)
-	if !ok {
-		return fmt.Errorf("InternalError: field %q not found in generated type %v", name, prop.Type)
-	}
-	val, err := valueFromStarlark(field.Type, sky)
-	if err != nil {
-		return err
-	}
-	if err := msg.checkMutable("set field of"); err != nil {
-		return err
+// checkMutable returns an error if msg is frozen. Callers are about to
+// modify msg, so if it's shared it's first replaced with a private copy.
+func (msg *skyProtoMessage) checkMutable(verb string) error {
+	if !msg.frozen {
+		msg.unshare()
+		return nil
 	}
-
-	// Construct the intermediate per-field struct.
-	box := reflect.New(prop.Type.Elem())
-	box.Elem().Field(0).Set(val)
-
-	delete(msg.attrCache, name)
-	ifaceField.Set(box)
-	return nil
-}
-
-func (msg *skyProtoMessage) setSingleField(name string, prop *proto.Properties, sky starlark.Value) error {
-	field, ok := msg.val.Type().FieldByName(prop.Name)
-	if !ok {
-		return fmt.Errorf("InternalError: field %q not found in generated type %v", prop.OrigName, msg.val.Type())
+	var provenance []string
+	if msg.pos.IsValid() {
+		provenance = append(provenance, fmt.Sprintf("created at %s", msg.pos))
 	}
-
-	val, err := valueFromStarlark(field.Type, sky)
-	if err != nil {
-		return err
+	if msg.frozenBy != "" {
+		provenance = append(provenance, msg.frozenBy)
 	}
-	if err := msg.checkMutable("set field of"); err != nil {
-		return err
+	if len(provenance) == 0 {
+		return fmt.Errorf("cannot %s frozen message", verb)
 	}
-	delete(msg.attrCache, name)
-	msg.val.FieldByName(prop.Name).Set(val)
-	return nil
+	return fmt.Errorf("cannot %s frozen message (%s)", verb, strings.Join(provenance, ", "))
 }
 
-func valueToStarlark(val reflect.Value) starlark.Value {
-	if scalar := scalarToStarlark(val); scalar != nil {
-		return scalar
-	}
-	iface := val.Interface()
-	if msg, ok := iface.(proto.Message); ok {
-		return NewSkyProtoMessage(msg)
-	}
-	t := val.Type()
-	if t.Kind() == reflect.Struct {
-		// Might have been generated by gogo-protobuf
-		//
-		// Need to check if this is a non-pointer map value, which
-		// cannot be addressed and therefore can never become a
-		// `proto.Message`.
-		if val.CanAddr() {
-			if msg, ok := val.Addr().Interface().(proto.Message); ok {
-				return NewSkyProtoMessage(msg)
-			}
-		}
-	}
-	// Handle []byte ([]uint8) -> string special case.
-	if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
-		return starlark.String(string(val.Interface().([]byte)))
-	}
-	if t.Kind() == reflect.Slice {
-		var items []starlark.Value
-		for ii := 0; ii < val.Len(); ii++ {
-			items = append(items, valueToStarlark(val.Index(ii)))
-		}
-		return &protoRepeated{
-			field: val,
-			list:  starlark.NewList(items),
-		}
+func (msg *skyProtoMessage) Attr(name string) (starlark.Value, error) {
+	msg.attrMu.Lock()
+	defer msg.attrMu.Unlock()
+	if attr, ok := msg.attrCache[name]; ok {
+		return attr, nil
 	}
-	if t.Kind() == reflect.Map {
-		dict := &starlark.Dict{}
-		for _, keyVal := range val.MapKeys() {
-			elemVal := val.MapIndex(keyVal)
-			key := valueToStarlark(keyVal)
-			elem := valueToStarlark(elemVal)
-			if err := dict.SetKey(key, elem); err != nil {
-				panic(fmt.Sprintf("dict.SetKey(%s, %s): %v", key, elem, err))
-			}
-		}
-		return &protoMap{
-			field: val,
-			dict:  dict,
-		}
+	fd := msg.fields.descriptor(name)
+	if fd == nil {
+		return nil, nil
 	}
-	// This should be impossible, because the set of types present
-	// in a generated protobuf struct is small and limited.
-	panic(fmt.Errorf("valueToStarlark: unknown type %v", val.Type()))
-}
-
-func scalarToStarlark(val reflect.Value) starlark.Value {
-	if val.Kind() == reflect.Ptr {
-		if val.IsNil() {
-			return starlark.None
-		}
-		val = val.Elem()
-	}
-	iface := val.Interface()
-	switch f := iface.(type) {
-	case int32:
-		return starlark.MakeInt64(int64(f))
-	case int64:
-		return starlark.MakeInt64(f)
-	case uint32:
-		return starlark.MakeUint64(uint64(f))
-	case uint64:
-		return starlark.MakeUint64(f)
-	case float32:
-		return starlark.Float(f)
-	case float64:
-		return starlark.Float(f)
-	case string:
-		return starlark.String(f)
-	case bool:
-		return starlark.Bool(f)
-	case time.Duration:
-		return NewSkyProtoMessage(ptypes.DurationProto(f))
-	}
-	if enum, ok := iface.(protoEnum); ok {
-		return &skyProtoEnumValue{
-			typeName:  enumTypeName(enum),
-			valueName: enum.String(),
-			value:     val.Convert(reflect.TypeOf(int32(0))).Interface().(int32),
+	out := msg.fields.get(msg, name)
+	msg.setFieldRef(out, fieldRef{msg.Type(), fd, joinFieldPath(msg.path, name), msg.fieldErrors})
+	msg.unknownJSON.attach(name, out)
+	if msg.frozen {
+		out.Freeze()
+		switch sub := out.(type) {
+		case *skyProtoMessage:
+			sub.frozenBy = msg.frozenBy
+		case *protoRepeated:
+			sub.frozenBy = msg.frozenBy
 		}
 	}
-	return nil
+	msg.attrCache[name] = out
+	return out, nil
 }
 
-func valueFromStarlark(t reflect.Type, sky starlark.Value) (reflect.Value, error) {
-	switch sky := sky.(type) {
-	case starlark.Int, starlark.Float, starlark.String, starlark.Bool:
-		scalar, err := scalarFromStarlark(t, sky)
-		if err != nil {
-			return reflect.Value{}, err
-		}
-
-		// Handle the use of typedefs in Kubernetes and "string" ->
-		// "bytes" conversion.
-		if scalarType := scalar.Type(); !scalarType.AssignableTo(t) {
-			if scalarType.Kind() != reflect.String || !scalarType.ConvertibleTo(t) {
-				return reflect.Value{}, typeError(t, sky)
-			}
-			scalar = scalar.Convert(t)
-		}
-		return scalar, nil
-	case starlark.NoneType:
-		if t.Kind() == reflect.Ptr {
-			return reflect.Zero(t), nil
-		}
-		// Give a better error message for true type mismatch, instead of
-		// "pointer or non-pointer" caused by Go's different representation
-		// of proto3 messages.
-		if t.Kind() == reflect.Slice || t.Kind() == reflect.Map {
-			return reflect.Value{}, typeError(t, sky)
-		}
-		return reflect.Value{}, fmt.Errorf("TypeError: value None can't be assigned to type `%s' in proto3 mode.", t)
-	case *skyProtoEnumValue:
-		return enumFromStarlark(t, sky)
+// setFieldRef records where a field value came from, so errors from
+// assigning to it or its contents can report a path. Submessages also
+// inherit how their oneofs may be set.
+func (msg *skyProtoMessage) setFieldRef(val starlark.Value, ref fieldRef) {
+	switch val := val.(type) {
 	case *skyProtoMessage:
-		if reflect.TypeOf(sky.msg) == t {
-			val := reflect.New(t.Elem())
-			val.Elem().Set(reflect.ValueOf(sky.msg).Elem())
-			return val, nil
-		}
-		if reflect.TypeOf(sky.msg) == reflect.PtrTo(t) {
-			val := reflect.New(t)
-			val.Elem().Set(reflect.ValueOf(sky.msg).Elem())
-			return val.Elem(), nil
-		}
-
-		dpb, ok := sky.msg.(*dpb.Duration)
-		if ok && t == reflect.TypeOf(time.Duration(0)) {
-			d, err := ptypes.Duration(dpb)
-			if err != nil {
-				return reflect.Value{}, fmt.Errorf("ValueError: %v (type `%s') can't be coverted to `time.Duration': %v", dpb, reflect.TypeOf(dpb), err)
-			}
-
-			return reflect.ValueOf(d), nil
-		}
+		val.path = ref.path
+		val.strictOneofs = msg.strictOneofs
+		val.thread = msg.thread
+		val.shareSubmessages = msg.shareSubmessages
+		val.fieldErrors = msg.fieldErrors
 	case *protoRepeated:
-		return valueFromStarlark(t, sky.list)
-	case *starlark.List:
-		if t.Kind() == reflect.Slice {
-			elemType := t.Elem()
-			val := reflect.MakeSlice(t, sky.Len(), sky.Len())
-			for ii := 0; ii < sky.Len(); ii++ {
-				elem, err := valueFromStarlark(elemType, sky.Index(ii))
-				if err != nil {
-					return reflect.Value{}, err
-				}
-				val.Index(ii).Set(elem)
-			}
-			return val, nil
-		}
+		val.setRef(ref, msg)
 	case *protoMap:
-		return valueFromStarlark(t, sky.dict)
-	case *starlark.Dict:
-		if t.Kind() == reflect.Map {
-			keyType := t.Key()
-			elemType := t.Elem()
-			val := reflect.MakeMapWithSize(t, sky.Len())
-			for _, item := range sky.Items() {
-				key, err := valueFromStarlark(keyType, item[0])
-				if err != nil {
-					return reflect.Value{}, err
-				}
-				elem, err := valueFromStarlark(elemType, item[1])
-				if err != nil {
-					return reflect.Value{}, err
-				}
-				val.SetMapIndex(key, elem)
-			}
-			return val, nil
-		}
-	}
-	return reflect.Value{}, typeError(t, sky)
-}
-
-func scalarFromStarlark(t reflect.Type, sky starlark.Value) (reflect.Value, error) {
-	k := t.Kind()
-	// Handling special case of Starlark string to []byte (aka []uint8 aka
-	// proto "bytes") assigment.
-	if k == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
-		val, ok := sky.(starlark.String)
-		if !ok {
-			return reflect.Value{}, typeError(t, sky)
-		}
-		return reflect.ValueOf([]byte(val)), nil
-	}
-
-	switch k {
-	case reflect.Ptr:
-		val := reflect.New(t.Elem())
-		elem, err := scalarFromStarlark(t.Elem(), sky)
-		if err != nil {
-			// Recompute the type error based on the pointer type.
-			return reflect.Value{}, typeError(t, sky)
-		}
-		val.Elem().Set(elem)
-		return val, nil
-	case reflect.Bool:
-		if val, ok := sky.(starlark.Bool); ok {
-			return reflect.ValueOf(bool(val)), nil
-		}
-	case reflect.String:
-		if val, ok := sky.(starlark.String); ok {
-			return reflect.ValueOf(string(val)), nil
-		}
-	case reflect.Float64:
-		if val, ok := starlark.AsFloat(sky); ok {
-			return reflect.ValueOf(val), nil
-		}
-	case reflect.Float32:
-		if val, ok := starlark.AsFloat(sky); ok {
-			return reflect.ValueOf(float32(val)), nil
-		}
-	case reflect.Int64:
-		if skyInt, ok := sky.(starlark.Int); ok {
-			if val, ok := skyInt.Int64(); ok {
-				return reflect.ValueOf(val), nil
+		val.ref = ref
+		for _, item := range val.dict.Items() {
+			if sub, ok := item[1].(*skyProtoMessage); ok {
+				sub.path = fmt.Sprintf("%s[%s]", ref.path, item[0].String())
+				sub.strictOneofs = msg.strictOneofs
+				sub.thread = msg.thread
+				sub.fieldErrors = msg.fieldErrors
 			}
-			return reflect.Value{}, fmt.Errorf("ValueError: value %v overflows type `int64'.", skyInt)
-		}
-	case reflect.Uint64:
-		if skyInt, ok := sky.(starlark.Int); ok {
-			if val, ok := skyInt.Uint64(); ok {
-				return reflect.ValueOf(val), nil
-			}
-			return reflect.Value{}, fmt.Errorf("ValueError: value %v overflows type `uint64'.", skyInt)
-		}
-	case reflect.Int32:
-		if skyInt, ok := sky.(starlark.Int); ok {
-			if val, ok := skyInt.Int64(); ok && val >= math.MinInt32 && val <= math.MaxInt32 {
-				return reflect.ValueOf(int32(val)), nil
-			}
-			return reflect.Value{}, fmt.Errorf("ValueError: value %v overflows type `int32'.", skyInt)
-		}
-	case reflect.Uint32:
-		if skyInt, ok := sky.(starlark.Int); ok {
-			if val, ok := skyInt.Uint64(); ok && val <= math.MaxUint32 {
-				return reflect.ValueOf(uint32(val)), nil
-			}
-			return reflect.Value{}, fmt.Errorf("ValueError: value %v overflows type `uint32'.", skyInt)
 		}
 	}
-	return reflect.Value{}, typeError(t, sky)
 }
 
-func enumFromStarlark(t reflect.Type, sky *skyProtoEnumValue) (reflect.Value, error) {
-	if t.Kind() == reflect.Ptr {
-		val := reflect.New(t.Elem())
-		elem, err := enumFromStarlark(t.Elem(), sky)
-		if err != nil {
-			return reflect.Value{}, err
-		}
-		val.Elem().Set(elem)
-		return val, nil
-	}
-	if t.Kind() == reflect.Int32 {
-		if enum, ok := reflect.Zero(t).Interface().(protoEnum); ok {
-			if enumTypeName(enum) == sky.typeName {
-				return reflect.ValueOf(sky.value).Convert(t), nil
-			}
-		}
-	}
-	return reflect.Value{}, typeError(t, sky)
-}
-
-func typeName(t reflect.Type) string {
-	// Special-case protobuf types to get more useful error messages when
-	// the wrong protobuf type is assigned.
-	messageType := reflect.TypeOf((*proto.Message)(nil)).Elem()
-	if t.Implements(messageType) {
-		return messageTypeName(reflect.Zero(t).Interface().(proto.Message))
-	}
-	enumType := reflect.TypeOf((*protoEnum)(nil)).Elem()
-	if t.Implements(enumType) {
-		return enumTypeName(reflect.Zero(t).Interface().(protoEnum))
-	}
-	if t.PkgPath() == "" {
-		return t.String()
-	}
-	return fmt.Sprintf("%q.%s", t.PkgPath(), t.Name())
+func (msg *skyProtoMessage) AttrNames() []string {
+	names := msg.fieldNames()
+	sort.Strings(names)
+	return names
 }
 
-func typeError(t reflect.Type, sky starlark.Value) error {
-	return fmt.Errorf("TypeError: value %s (type `%s') can't be assigned to type `%s'.", sky.String(), sky.Type(), typeName(t))
+// fieldNames returns the names of the message's fields, in the order that
+// they're defined.
+func (msg *skyProtoMessage) fieldNames() []string {
+	return msg.fields.names()
 }
 
-type protoRepeated struct {
-	// var x []T; reflect.ValueOf(x)
-	field reflect.Value
-	list  *starlark.List
+// noFieldError reports that msg has no field with the given name.
+func (msg *skyProtoMessage) noFieldError(name string) error {
+	return fmt.Errorf("AttributeError: `%s' value has no field %q", msg.Type(), name)
 }
 
-var _ starlark.Value = (*protoRepeated)(nil)
-var _ starlark.Iterable = (*protoRepeated)(nil)
-var _ starlark.Sequence = (*protoRepeated)(nil)
-var _ starlark.Indexable = (*protoRepeated)(nil)
-var _ starlark.HasAttrs = (*protoRepeated)(nil)
-var _ starlark.HasSetIndex = (*protoRepeated)(nil)
-var _ starlark.HasBinary = (*protoRepeated)(nil)
-
-func (r *protoRepeated) Attr(name string) (starlark.Value, error) {
-	wrapper, ok := listMethods[name]
-	if !ok {
-		return nil, nil
+func (msg *skyProtoMessage) SetField(name string, sky starlark.Value) error {
+	if _, err := msg.checkOneof(name, sky); err != nil {
+		return err
 	}
-	if wrapper != nil {
-		return wrapper(r), nil
+	if err := msg.setField(name, sky); err != nil {
+		return err
 	}
-	return r.list.Attr(name)
-}
-
-func (r *protoRepeated) AttrNames() []string                 { return r.list.AttrNames() }
-func (r *protoRepeated) Freeze()                             { r.list.Freeze() }
-func (r *protoRepeated) Hash() (uint32, error)               { return r.list.Hash() }
-func (r *protoRepeated) Index(i int) starlark.Value          { return r.list.Index(i) }
-func (r *protoRepeated) Iterate() starlark.Iterator          { return r.list.Iterate() }
-func (r *protoRepeated) Len() int                            { return r.list.Len() }
-func (r *protoRepeated) Slice(x, y, step int) starlark.Value { return r.list.Slice(x, y, step) }
-func (r *protoRepeated) String() string                      { return r.list.String() }
-func (r *protoRepeated) Truth() starlark.Bool                { return r.list.Truth() }
-
-func (r *protoRepeated) Type() string {
-	return fmt.Sprintf("list<%s>", typeName(r.field.Type().Elem()))
-}
-
-func (r *protoRepeated) wrapClear() starlark.Value {
-	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-		if err := starlark.UnpackPositionalArgs("clear", args, kwargs, 0); err != nil {
-			return nil, err
-		}
-		if err := r.Clear(); err != nil {
-			return nil, err
-		}
-		return starlark.None, nil
+	if msg.unknownJSON != nil {
+		msg.unknownJSON = msg.unknownJSON.without(name)
 	}
-	return starlark.NewBuiltin("clear", impl).BindReceiver(r)
-}
-
-func (r *protoRepeated) wrapAppend() starlark.Value {
-	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-		var val starlark.Value
-		if err := starlark.UnpackPositionalArgs("append", args, kwargs, 1, &val); err != nil {
-			return nil, err
-		}
-		if err := r.Append(val); err != nil {
-			return nil, err
-		}
-		return starlark.None, nil
+	origin := ""
+	if sky != starlark.None {
+		origin = assignmentOrigin(msg.thread)
 	}
-	return starlark.NewBuiltin("append", impl).BindReceiver(r)
+	msg.setFieldOrigin(name, origin)
+	return nil
 }
 
-func (r *protoRepeated) wrapExtend() starlark.Value {
-	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-		var val starlark.Iterable
-		if err := starlark.UnpackPositionalArgs("extend", args, kwargs, 1, &val); err != nil {
-			return nil, err
-		}
-		if err := r.implExtend(thread, val); err != nil {
-			return nil, err
-		}
-		return starlark.None, nil
+// setFieldOrigin records where a field was assigned, or forgets it if
+// origin is "".
+func (msg *skyProtoMessage) setFieldOrigin(name string, origin string) {
+	if origin == "" {
+		delete(msg.fieldSetAt, name)
+		return
 	}
-	return starlark.NewBuiltin("extend", impl).BindReceiver(r)
-}
-
-var listMethods = map[string]func(*protoRepeated) starlark.Value{
-	"clear":  (*protoRepeated).wrapClear,
-	"append": (*protoRepeated).wrapAppend,
-	"extend": (*protoRepeated).wrapExtend,
-	// "insert": (*protoRepeated).wrapInsert,
-	// "pop":    (*protoRepeated).wrapPop,
-	// "remove": (*protoRepeated).wrapRemove,
-}
-
-func (r *protoRepeated) Clear() error {
-	if err := r.list.Clear(); err != nil {
-		return err
+	if msg.fieldSetAt == nil {
+		msg.fieldSetAt = make(map[string]string)
 	}
-	r.field.SetLen(0)
-	return nil
+	msg.fieldSetAt[name] = origin
 }
 
-func (r *protoRepeated) Append(v starlark.Value) error {
-	itemType := r.field.Type().Elem()
-	if v == starlark.None {
-		return typeError(itemType, v)
+// assignmentOrigin describes where the thread is assigning to a field, or
+// returns "" if it isn't running Starlark code. The interpreter only keeps
+// the positions of calls, so an assignment is described by the function
+// making it and where that function was called from.
+func assignmentOrigin(t *starlark.Thread) string {
+	if t == nil || t.TopFrame() == nil {
+		return ""
 	}
-	goVal, err := valueFromStarlark(itemType, v)
-	if err != nil {
-		return err
+	fn, ok := t.TopFrame().Callable().(*starlark.Function)
+	if !ok {
+		return ""
 	}
-	if err := r.list.Append(v); err != nil {
-		return err
+	if t.Caller() == nil {
+		return fmt.Sprintf("at the top level of %s", fn.Position().Filename())
 	}
-	r.field.Set(reflect.Append(r.field, goVal))
-	return nil
+	return fmt.Sprintf("in %s(), called at %s", fn.Name(), t.Caller().Position())
 }
 
-func (r *protoRepeated) implExtend(t *starlark.Thread, iterable starlark.Iterable) error {
-	itemType := r.field.Type().Elem()
-	var skyValues []starlark.Value
-	var goValues []reflect.Value
-	iter := iterable.Iterate()
-	defer iter.Done()
-	var skyVal starlark.Value
-	for iter.Next(&skyVal) {
-		if skyVal == starlark.None {
-			return typeError(itemType, skyVal)
-		}
-		goVal, err := valueFromStarlark(itemType, skyVal)
-		if err != nil {
-			return err
-		}
-		skyValues = append(skyValues, skyVal)
-		goValues = append(goValues, goVal)
+func (msg *skyProtoMessage) setField(name string, sky starlark.Value) error {
+	fd := msg.fields.descriptor(name)
+	if fd == nil {
+		return msg.fieldErrors.record(unknownFieldError(msg.Type(), joinFieldPath(msg.path, name), sky, "AttributeError: `%s' value has no field %q", msg.Type(), name))
 	}
-
-	listExtend, _ := r.list.Attr("extend")
-	args := starlark.Tuple([]starlark.Value{
-		starlark.NewList(skyValues),
-	})
-	if _, err := starlark.Call(t, listExtend, args, nil); err != nil {
-		return err
-	}
-	r.field.Set(reflect.Append(r.field, goValues...))
-	return nil
+	ref := fieldRef{msg.Type(), fd, joinFieldPath(msg.path, name), msg.fieldErrors}
+	return ref.wrap(msg.fields.set(msg, name, sky), "")
 }
 
-func (r *protoRepeated) SetIndex(i int, v starlark.Value) error {
-	itemType := r.field.Type().Elem()
-	if v == starlark.None {
-		return typeError(itemType, v)
+// clearField resets a field to its default value. For a oneof member, the
+// oneof is only cleared if that member is the one that's set.
+func (msg *skyProtoMessage) clearField(name string) error {
+	if msg.unknownJSON != nil {
+		msg.unknownJSON = msg.unknownJSON.without(name)
 	}
-	goVal, err := valueFromStarlark(itemType, v)
-	if err != nil {
-		return err
+	if msg.fields.descriptor(name) == nil {
+		return msg.noFieldError(name)
 	}
-	if err := r.list.SetIndex(i, v); err != nil {
+	if err := msg.checkMutable("clear field of"); err != nil {
 		return err
 	}
-	r.field.Index(i).Set(goVal)
+	msg.fields.clear(msg, name)
+	delete(msg.fieldSetAt, name)
 	return nil
 }
 
-func (r *protoRepeated) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
-	if op == syntax.PLUS {
-		if side == starlark.Left {
-			switch y := y.(type) {
-			case *starlark.List:
-				return starlark.Binary(op, r.list, y)
-			case *protoRepeated:
-				return starlark.Binary(op, r.list, y.list)
-			}
-			return nil, nil
-		}
-		if side == starlark.Right {
-			if _, ok := y.(*starlark.List); ok {
-				return starlark.Binary(op, y, r.list)
-			}
-			return nil, nil
-		}
+// hasField reports whether a field with explicit presence is set. Fields
+// have presence if they're submessages, proto2 scalars, proto3 `optional`
+// scalars, or members of a oneof.
+func (msg *skyProtoMessage) hasField(name string) (bool, error) {
+	if msg.fields.descriptor(name) == nil {
+		return false, msg.noFieldError(name)
 	}
-	return nil, nil
-}
-
-type protoMap struct {
-	field reflect.Value
-	dict  *starlark.Dict
+	isSet, ok := msg.fields.has(name)
+	if !ok {
+		return false, fmt.Errorf("ValueError: field %q of `%s' doesn't track presence; compare it to its default value instead", name, msg.Type())
+	}
+	return isSet, nil
 }
 
-var _ starlark.Value = (*protoMap)(nil)
-var _ starlark.Iterable = (*protoMap)(nil)
-var _ starlark.Sequence = (*protoMap)(nil)
-var _ starlark.HasAttrs = (*protoMap)(nil)
-var _ starlark.HasSetKey = (*protoMap)(nil)
-
-func (m *protoMap) Attr(name string) (starlark.Value, error) {
-	wrapper, ok := dictMethods[name]
-	if !ok {
+// Binary implements `"field" in msg`, which reports whether a field is set.
+func (msg *skyProtoMessage) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	if op != syntax.IN || side != starlark.Right {
 		return nil, nil
 	}
-	if wrapper != nil {
-		return wrapper(m), nil
+	name, ok := y.(starlark.String)
+	if !ok {
+		return nil, fmt.Errorf("'in <%s>' requires string as left operand, not %s", msg.Type(), y.Type())
 	}
-	return m.dict.Attr(name)
-}
-
-func (m *protoMap) AttrNames() []string                                { return m.dict.AttrNames() }
-func (m *protoMap) Freeze()                                            { m.dict.Freeze() }
-func (m *protoMap) Hash() (uint32, error)                              { return m.dict.Hash() }
-func (m *protoMap) Get(k starlark.Value) (starlark.Value, bool, error) { return m.dict.Get(k) }
-func (m *protoMap) Iterate() starlark.Iterator                         { return m.dict.Iterate() }
-func (m *protoMap) Len() int                                           { return m.dict.Len() }
-func (m *protoMap) String() string                                     { return m.dict.String() }
-func (m *protoMap) Truth() starlark.Bool                               { return m.dict.Truth() }
-
-func (m *protoMap) Type() string {
-	t := m.field.Type()
-	return fmt.Sprintf("map<%s, %s>", typeName(t.Key()), typeName(t.Elem()))
-}
-
-func (m *protoMap) wrapClear() starlark.Value {
-	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-		if err := starlark.UnpackPositionalArgs("clear", args, kwargs, 0); err != nil {
-			return nil, err
-		}
-		if err := m.dict.Clear(); err != nil {
-			return nil, err
-		}
-		m.field.Set(reflect.MakeMap(m.field.Type()))
-		return starlark.None, nil
+	isSet, err := msg.isSet(string(name))
+	if err != nil {
+		return nil, err
 	}
-	return starlark.NewBuiltin("clear", impl).BindReceiver(m)
+	return starlark.Bool(isSet), nil
 }
 
-func (m *protoMap) wrapSetDefault() starlark.Value {
-	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-		var key, defaultValue starlark.Value = nil, starlark.None
-		if err := starlark.UnpackPositionalArgs("setdefault", args, kwargs, 1, &key, &defaultValue); err != nil {
-			return nil, err
-		}
-		if val, ok, err := m.dict.Get(key); err != nil {
-			return nil, err
-		} else if ok {
-			return val, nil
-		}
-		return defaultValue, m.SetKey(key, defaultValue)
-	}
-	return starlark.NewBuiltin("setdefault", impl).BindReceiver(m)
-}
-
-func (m *protoMap) wrapUpdate() starlark.Value {
-	keyType := m.field.Type().Key()
-	itemType := m.field.Type().Elem()
-	impl := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-		// Use the underlying starlark `dict.update()` to get a Dict containing
-		// all the new values, so we don't have to recreate the API here. After
-		// the temp dict is constructed, type check.
-		tempDict := &starlark.Dict{}
-		tempUpdate, _ := tempDict.Attr("update")
-		if _, err := starlark.Call(thread, tempUpdate, args, kwargs); err != nil {
-			return nil, err
-		}
-		for _, item := range tempDict.Items() {
-			if item[0] == starlark.None {
-				return nil, typeError(keyType, item[0])
-			}
-			if item[1] == starlark.None {
-				return nil, typeError(itemType, item[1])
-			}
-		}
-		tempMap, err := valueFromStarlark(m.field.Type(), tempDict)
-		if err != nil {
-			return nil, err
-		}
-
-		// tempMap is a reflected Go map containing items of the correct type.
-		// Update the Dict first to catch potential immutability.
-		for _, item := range tempDict.Items() {
-			if err := m.dict.SetKey(item[0], item[1]); err != nil {
-				return nil, err
-			}
-		}
-
-		if m.field.IsNil() {
-			m.field.Set(reflect.MakeMap(m.field.Type()))
-		}
-		for _, key := range tempMap.MapKeys() {
-			m.field.SetMapIndex(key, tempMap.MapIndex(key))
-		}
-		return starlark.None, nil
+// isSet reports whether a field is set. Fields with explicit presence are
+// set if they've been assigned, even to their default value. Other fields
+// are set if they have a non-default value, or for repeated and map fields,
+// if they're non-empty.
+func (msg *skyProtoMessage) isSet(name string) (bool, error) {
+	if msg.fields.descriptor(name) == nil {
+		return false, msg.noFieldError(name)
 	}
-	return starlark.NewBuiltin("update", impl).BindReceiver(m)
+	return msg.fields.isSet(name), nil
 }
 
-func (m *protoMap) SetKey(k, v starlark.Value) error {
-	keyType := m.field.Type().Key()
-	itemType := m.field.Type().Elem()
-	if k == starlark.None {
-		return typeError(keyType, k)
-	}
-	if v == starlark.None {
-		return typeError(itemType, v)
-	}
-	goKey, err := valueFromStarlark(keyType, k)
-	if err != nil {
-		return err
-	}
-	goVal, err := valueFromStarlark(itemType, v)
-	if err != nil {
-		return err
-	}
-	if err := m.dict.SetKey(k, v); err != nil {
-		return err
+// enumRangeError describes an int being assigned to an enum field that
+// isn't a number of the enum, or returns "". Enum fields are assigned
+// named values, so other ints are type errors.
+func enumRangeError(ed protoreflect.EnumDescriptor, sky starlark.Value) string {
+	skyInt, ok := sky.(starlark.Int)
+	if !ok {
+		return ""
 	}
-	if m.field.IsNil() {
-		m.field.Set(reflect.MakeMap(m.field.Type()))
+	if n, ok := skyInt.Int64(); ok && n >= math.MinInt32 && n <= math.MaxInt32 && ed.Values().ByNumber(protoreflect.EnumNumber(n)) != nil {
+		return ""
 	}
-	m.field.SetMapIndex(goKey, goVal)
-	return nil
-}
-
-var dictMethods = map[string]func(*protoMap) starlark.Value{
-	"clear": (*protoMap).wrapClear,
-	"get":   nil,
-	"items": nil,
-	"keys":  nil,
-	// "pop":        (*protoMap).wrapPop,
-	// "popitem":    (*protoMap).wrapPopItem,
-	"setdefault": (*protoMap).wrapSetDefault,
-	"update":     (*protoMap).wrapUpdate,
-	"values":     nil,
+	return fmt.Sprintf("ValueError: value %s is out of range for enum `%s'.", skyInt, ed.FullName())
 }
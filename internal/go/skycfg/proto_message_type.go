@@ -25,6 +25,8 @@ import (
 	"github.com/golang/protobuf/proto"
 	descriptor_pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
 	"go.starlark.net/starlark"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
 )
 
 // NewMessageType creates a Starlark value representing a named Protobuf message type.
@@ -37,6 +39,15 @@ func newMessageType(registry ProtoRegistry, name string) (starlark.Value, error)
 		return nil, err
 	}
 	if goType == nil {
+		if descRegistry, ok := registry.(protoDescriptorRegistry); ok {
+			msgDesc, err := descRegistry.UnstableProtoMessageDescriptor(name)
+			if err != nil {
+				return nil, err
+			}
+			if msgDesc != nil {
+				return newDynamicMessageType(registry, msgDesc), nil
+			}
+		}
 		return nil, fmt.Errorf("Protobuf message type %q not found", name)
 	}
 
@@ -69,6 +80,16 @@ func newMessageType(registry ProtoRegistry, name string) (starlark.Value, error)
 
 }
 
+// newDynamicMessageType creates a message type for a descriptor that has
+// no generated Go code. Its messages are dynamic messages.
+func newDynamicMessageType(registry ProtoRegistry, msgDesc protoreflect.MessageDescriptor) *skyProtoMessageType {
+	return &skyProtoMessageType{
+		registry: registry,
+		desc:     msgDesc,
+		emptyMsg: dynamicpb.NewMessage(msgDesc),
+	}
+}
+
 // A Starlark built-in type representing a Protobuf message type. This is the
 // message type itself rather than any particular message value.
 type skyProtoMessageType struct {
@@ -76,6 +97,10 @@ type skyProtoMessageType struct {
 	fileDesc *descriptor_pb.FileDescriptorProto
 	msgDesc  *descriptor_pb.DescriptorProto
 
+	// The descriptor of a dynamic message type, which has no fileDesc or
+	// msgDesc.
+	desc protoreflect.MessageDescriptor
+
 	// An empty protobuf message of the appropriate type.
 	emptyMsg proto.Message
 }
@@ -98,6 +123,18 @@ func (mt *skyProtoMessageType) Name() string {
 }
 
 func (mt *skyProtoMessageType) Attr(attrName string) (starlark.Value, error) {
+	if mt.desc != nil {
+		if enumDesc := mt.desc.Enums().ByName(protoreflect.Name(attrName)); enumDesc != nil {
+			return &skyProtoEnumType{
+				name:     string(enumDesc.FullName()),
+				valueMap: enumValueMap(enumDesc),
+			}, nil
+		}
+		if msgDesc := mt.desc.Messages().ByName(protoreflect.Name(attrName)); msgDesc != nil {
+			return newDynamicMessageType(mt.registry, msgDesc), nil
+		}
+		return nil, fmt.Errorf("Protobuf message type %q not found", mt.Name()+"."+attrName)
+	}
 	msgName := fmt.Sprintf("%s.%s", mt.msgDesc.GetName(), attrName)
 	enumName := strings.Replace(msgName, ".", "_", -1)
 	if pkg := mt.fileDesc.GetPackage(); pkg != "" {
@@ -139,6 +176,7 @@ func (mt *skyProtoMessageType) CallInternal(thread *starlark.Thread, args starla
 	}
 
 	wrapper := NewSkyProtoMessage(proto.Clone(mt.emptyMsg))
+	wrapper.setOrigin(thread)
 
 	// Parse the kwarg set into a map[string]starlark.Value, containing one
 	// entry for each provided kwarg. Keys are the original protobuf field names.
@@ -147,14 +185,38 @@ func (mt *skyProtoMessageType) CallInternal(thread *starlark.Thread, args starla
 	var parserPairs []interface{}
 	parsedKwargs := make(map[string]*starlark.Value, len(kwargs))
 
-	for _, field := range wrapper.fields {
+	for _, name := range wrapper.fieldNames() {
 		v := new(starlark.Value)
-		parsedKwargs[field.OrigName] = v
-		parserPairs = append(parserPairs, field.OrigName+"?", v)
+		parsedKwargs[name] = v
+		parserPairs = append(parserPairs, name+"?", v)
+	}
+	for _, kwarg := range kwargs {
+		name := string(kwarg[0].(starlark.String))
+		if _, ok := parsedKwargs[name]; !ok {
+			return nil, wrapper.fieldErrors.record(unknownFieldError(mt.Name(), name, kwarg[1], "%s: unexpected keyword argument %q", mt.Name(), name))
+		}
 	}
 	if err := starlark.UnpackArgs(mt.Name(), nil, kwargs, parserPairs...); err != nil {
 		return nil, err
 	}
+
+	// Fields are set in no particular order, so setting more than one
+	// member of a oneof wouldn't reliably pick either.
+	oneofKwargs := make(map[string]string)
+	for _, kwarg := range kwargs {
+		name := string(kwarg[0].(starlark.String))
+		if kwarg[1] == starlark.None {
+			continue
+		}
+		oneof, _, ok := wrapper.oneofOf(name)
+		if !ok {
+			continue
+		}
+		if prev, ok := oneofKwargs[oneof]; ok {
+			return nil, fmt.Errorf("%s: fields %q and %q are members of the same oneof %q; set at most one of them", mt.Name(), prev, name, oneof)
+		}
+		oneofKwargs[oneof] = name
+	}
 	for fieldName, starlarkValue := range parsedKwargs {
 		if *starlarkValue == nil {
 			continue
@@ -163,5 +225,12 @@ func (mt *skyProtoMessageType) CallInternal(thread *starlark.Thread, args starla
 			return nil, err
 		}
 	}
+	if wrapper.pos.IsValid() {
+		for fieldName, starlarkValue := range parsedKwargs {
+			if *starlarkValue != nil && *starlarkValue != starlark.None {
+				wrapper.setFieldOrigin(fieldName, "at "+wrapper.pos.String())
+			}
+		}
+	}
 	return wrapper, nil
 }
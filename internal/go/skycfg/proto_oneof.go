@@ -0,0 +1,99 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+)
+
+// SetStrictOneofs sets whether messages created by a thread reject setting
+// a member of a oneof while a different member is set. By default the new
+// member replaces the old one, as in other protobuf implementations.
+func SetStrictOneofs(t *starlark.Thread, strict bool) {
+	t.SetLocal("strict_oneofs", strict)
+}
+
+func strictOneofs(t *starlark.Thread) bool {
+	if t == nil {
+		return false
+	}
+	strict, _ := t.Local("strict_oneofs").(bool)
+	return strict
+}
+
+// Implementation of the `proto.which_oneof()` built-in function.
+// Returns the name of the field that's set in a oneof, or None if no
+// field of the oneof is set.
+//
+//  def proto.which_oneof(msg, oneof_name)
+func fnProtoWhichOneof(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var val starlark.Value
+	var name string
+	if err := starlark.UnpackPositionalArgs("proto.which_oneof", args, kwargs, 2, &val, &name); err != nil {
+		return nil, err
+	}
+	msg, ok := val.(*skyProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.Message", "proto.which_oneof", val.Type())
+	}
+	field, err := msg.whichOneof(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", "proto.which_oneof", err)
+	}
+	if field == "" {
+		return starlark.None, nil
+	}
+	return starlark.String(field), nil
+}
+
+// whichOneof returns the name of the field that's set in a oneof, or ""
+// if none is.
+func (msg *skyProtoMessage) whichOneof(oneof string) (string, error) {
+	field, ok := msg.fields.whichOneof(oneof)
+	if !ok {
+		return "", fmt.Errorf("AttributeError: `%s' value has no oneof %q", msg.Type(), oneof)
+	}
+	return field, nil
+}
+
+// oneofOf returns the name of the oneof that a field is a member of, and
+// the name of the oneof's currently set field. It returns false if the
+// field isn't a member of a oneof.
+func (msg *skyProtoMessage) oneofOf(name string) (oneof, current string, ok bool) {
+	return msg.fields.oneofOf(name)
+}
+
+// checkOneof returns an error if setting a field would replace a different
+// member of its oneof, and the message rejects that. It returns the name
+// of the field's oneof, or "" if it isn't a member of one.
+func (msg *skyProtoMessage) checkOneof(name string, sky starlark.Value) (string, error) {
+	oneof, current, ok := msg.oneofOf(name)
+	if !ok {
+		return "", nil
+	}
+	if !msg.strictOneofs || msg.frozen || sky == starlark.None || current == "" || current == name {
+		return oneof, nil
+	}
+	where := ""
+	if origin, ok := msg.fieldSetAt[current]; ok {
+		where = fmt.Sprintf(" (%s)", origin)
+	}
+	return "", fmt.Errorf("ValueError: can't set field %q of `%s': field %q of the same oneof %q is already set%s; unset it with proto.clear() first",
+		name, msg.Type(), current, oneof, where)
+}
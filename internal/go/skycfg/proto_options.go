@@ -0,0 +1,183 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Implementation of the `proto.options()` built-in function. Returns the
+// options of a message type, of one of its fields, or of the file that
+// defines it, such as a google.protobuf.MessageOptions. Custom options are
+// read from it with proto.get_extension().
+//
+//  def proto.options(type, field=None, file=False)
+func fnProtoOptions(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msgType starlark.Value
+	var field string
+	var file bool
+	if err := starlark.UnpackArgs("proto.options", args, kwargs, "type", &msgType, "field?", &field, "file?", &file); err != nil {
+		return nil, err
+	}
+	protoMsgType, ok := msgType.(*skyProtoMessageType)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.MessageType", "proto.options", msgType.Type())
+	}
+	desc := proto.MessageV2(protoMsgType.emptyMsg).ProtoReflect().Descriptor()
+	switch {
+	case field != "" && file:
+		return nil, fmt.Errorf("%s: only one of `field' and `file' may be set", "proto.options")
+	case field != "":
+		fd := desc.Fields().ByName(protoreflect.Name(field))
+		if fd == nil {
+			return nil, fmt.Errorf("%s: `%s' has no field %q", "proto.options", desc.FullName(), field)
+		}
+		return descriptorOptions(fd), nil
+	case file:
+		return descriptorOptions(desc.ParentFile()), nil
+	}
+	return descriptorOptions(desc), nil
+}
+
+// Implementation of the `proto.get_extension()` built-in function. Returns
+// the value of an extension field of a message, such as a custom option,
+// by its full name. Returns None if it isn't set.
+//
+//  def proto.get_extension(msg, name)
+func fnProtoGetExtension(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var val starlark.Value
+	var name string
+	if err := starlark.UnpackPositionalArgs("proto.get_extension", args, kwargs, 2, &val, &name); err != nil {
+		return nil, err
+	}
+	msg, ok := val.(*skyProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.Message", "proto.get_extension", val.Type())
+	}
+	var result starlark.Value = starlark.None
+	proto.MessageV2(msg.msg).ProtoReflect().Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if !fd.IsExtension() || string(fd.FullName()) != name {
+			return true
+		}
+		if fd.IsList() {
+			list := v.List()
+			items := make([]starlark.Value, list.Len())
+			for ii := range items {
+				items[ii] = reflectToStarlark(fd, list.Get(ii))
+			}
+			result = starlark.NewList(items)
+		} else {
+			result = reflectToStarlark(fd, v)
+		}
+		return false
+	})
+	result.Freeze()
+	return result, nil
+}
+
+// descriptorOptions returns the options of a descriptor, such as a
+// google.protobuf.MethodOptions, as a frozen message. Custom options
+// declared by the descriptor's file or its imports are resolved, even if
+// they have no generated Go code.
+func descriptorOptions(desc protoreflect.Descriptor) starlark.Value {
+	opts := desc.Options().ProtoReflect()
+	if !opts.IsValid() {
+		// Descriptors without options return a typed nil message.
+		opts = opts.Type().New()
+	}
+	msg := NewSkyProtoMessage(proto.MessageV1(resolveOptions(desc.ParentFile(), opts).Interface()))
+	msg.Freeze()
+	return msg
+}
+
+// resolveOptions returns opts with the custom options that were decoded as
+// unknown fields, because their extensions weren't in the global registry,
+// decoded with the extensions that file and its imports declare.
+//
+// Extensions linked into the binary take precedence, even for the files of
+// an isolated registry: go-protobuf has already decoded them by the time
+// the options reach Skycfg.
+func resolveOptions(file protoreflect.FileDescriptor, opts protoreflect.Message) protoreflect.Message {
+	if len(opts.GetUnknown()) == 0 || file == nil {
+		return opts
+	}
+	types := new(protoregistry.Types)
+	seen := make(map[string]bool)
+	var addFile func(file protoreflect.FileDescriptor)
+	addFile = func(file protoreflect.FileDescriptor) {
+		if seen[file.Path()] {
+			return
+		}
+		seen[file.Path()] = true
+		addExtensions(types, opts.Descriptor().FullName(), file.Extensions(), file.Messages())
+		imports := file.Imports()
+		for ii := 0; ii < imports.Len(); ii++ {
+			addFile(imports.Get(ii).FileDescriptor)
+		}
+	}
+	addFile(file)
+	data, err := protov2.Marshal(opts.Interface())
+	if err != nil {
+		return opts
+	}
+	resolved := opts.Type().New()
+	if err := (protov2.UnmarshalOptions{Resolver: optionsResolver{types}}).Unmarshal(data, resolved.Interface()); err != nil {
+		return opts
+	}
+	return resolved
+}
+
+// addExtensions registers the extensions of an options message among exts,
+// and those nested in msgs.
+func addExtensions(types *protoregistry.Types, extendee protoreflect.FullName, exts protoreflect.ExtensionDescriptors, msgs protoreflect.MessageDescriptors) {
+	for ii := 0; ii < exts.Len(); ii++ {
+		if ext := exts.Get(ii); ext.ContainingMessage().FullName() == extendee {
+			// Conflicting declarations are left undecoded.
+			_ = types.RegisterExtension(dynamicpb.NewExtensionType(ext))
+		}
+	}
+	for ii := 0; ii < msgs.Len(); ii++ {
+		addExtensions(types, extendee, msgs.Get(ii).Extensions(), msgs.Get(ii).Messages())
+	}
+}
+
+// optionsResolver resolves extensions to those found by resolveOptions,
+// falling back to those linked into the binary.
+type optionsResolver struct {
+	types *protoregistry.Types
+}
+
+func (r optionsResolver) FindExtensionByName(name protoreflect.FullName) (protoreflect.ExtensionType, error) {
+	if xt, err := protoregistry.GlobalTypes.FindExtensionByName(name); err == nil {
+		return xt, nil
+	}
+	return r.types.FindExtensionByName(name)
+}
+
+func (r optionsResolver) FindExtensionByNumber(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionType, error) {
+	if xt, err := protoregistry.GlobalTypes.FindExtensionByNumber(message, field); err == nil {
+		return xt, nil
+	}
+	return r.types.FindExtensionByNumber(message, field)
+}
@@ -19,9 +19,13 @@ package skycfg
 import (
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/golang/protobuf/proto"
 	"go.starlark.net/starlark"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
 type defaultProtoRegistry struct{}
@@ -34,6 +38,44 @@ func (*defaultProtoRegistry) UnstableEnumValueMap(name string) map[string]int32
 	return proto.EnumValueMap(name)
 }
 
+func (*defaultProtoRegistry) UnstableRangeProtoFiles(f func(protoreflect.FileDescriptor) bool) {
+	protoregistry.GlobalFiles.RangeFiles(f)
+}
+
+// A protoFileRegistry is a ProtoRegistry that can list the files that
+// define its types, so that the contents of packages can be discovered.
+// Packages of other registries are listed as empty.
+type protoFileRegistry interface {
+	// UNSTABLE iteration over the files of the registry's types, until f
+	// returns false.
+	UnstableRangeProtoFiles(f func(protoreflect.FileDescriptor) bool)
+}
+
+func rangeProtoFiles(registry ProtoRegistry, f func(protoreflect.FileDescriptor) bool) {
+	if registry == nil {
+		registry = &defaultProtoRegistry{}
+	}
+	if files, ok := registry.(protoFileRegistry); ok {
+		files.UnstableRangeProtoFiles(f)
+	}
+}
+
+// protoPackageNames returns the sorted names of the packages that a
+// registry has types in.
+func protoPackageNames(registry ProtoRegistry) []string {
+	seen := make(map[string]bool)
+	var names []string
+	rangeProtoFiles(registry, func(file protoreflect.FileDescriptor) bool {
+		if name := string(file.Package()); name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
 // NewProtoPackage creates a Starlark value representing a named Protobuf package.
 //
 // Protobuf packagess are conceptually similar to a C++ namespace or Ruby
@@ -58,12 +100,41 @@ func (pkg *skyProtoPackage) Hash() (uint32, error) {
 	return 0, fmt.Errorf("unhashable type: %s", pkg.Type())
 }
 
+// AttrNames returns the names of the message, enum, and service types
+// defined at the top level of the package, if its registry can list them.
 func (pkg *skyProtoPackage) AttrNames() []string {
-	// TODO: Implement when go-protobuf gains support for listing the
-	// registered message types in a Protobuf package.
-	//
-	// https://github.com/golang/protobuf/issues/623
-	return nil
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name protoreflect.Name) {
+		if !seen[string(name)] {
+			seen[string(name)] = true
+			names = append(names, string(name))
+		}
+	}
+	rangeProtoFiles(pkg.registry, func(file protoreflect.FileDescriptor) bool {
+		if string(file.Package()) != pkg.name {
+			return true
+		}
+		for ii := 0; ii < file.Messages().Len(); ii++ {
+			add(file.Messages().Get(ii).Name())
+		}
+		for ii := 0; ii < file.Enums().Len(); ii++ {
+			add(file.Enums().Get(ii).Name())
+		}
+		for ii := 0; ii < file.Services().Len(); ii++ {
+			add(file.Services().Get(ii).Name())
+		}
+		return true
+	})
+	if aliases, ok := pkg.registry.(*aliasProtoRegistry); ok {
+		for from := range aliases.aliases {
+			if ii := strings.LastIndex(from, "."); ii >= 0 && from[:ii] == pkg.name {
+				add(protoreflect.Name(from[ii+1:]))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
 }
 
 func (pkg *skyProtoPackage) Attr(attrName string) (starlark.Value, error) {
@@ -72,11 +143,126 @@ func (pkg *skyProtoPackage) Attr(attrName string) (starlark.Value, error) {
 	if registry == nil {
 		registry = &defaultProtoRegistry{}
 	}
+	if resolver, ok := registry.(ProtoNameResolver); ok {
+		if resolved, ok := resolver.UnstableResolveProtoName(pkg.name, attrName); ok {
+			fullName = resolved
+		}
+	}
 	if ev := registry.UnstableEnumValueMap(fullName); ev != nil {
 		return &skyProtoEnumType{
 			name:     fullName,
 			valueMap: ev,
 		}, nil
 	}
+	if svc := lookupProtoService(registry, fullName); svc != nil {
+		return newProtoService(registry, svc), nil
+	}
 	return newMessageType(registry, fullName)
 }
+
+// NewAliasProtoRegistry returns a registry that resolves the full type
+// names in aliases, such as "my.pkg.OldName", as the full names they map to,
+// and otherwise resolves names like base. A nil base resolves the types
+// registered with go-protobuf.
+func NewAliasProtoRegistry(base ProtoRegistry, aliases map[string]string) ProtoRegistry {
+	if base == nil {
+		base = &defaultProtoRegistry{}
+	}
+	copied := make(map[string]string, len(aliases))
+	for from, to := range aliases {
+		copied[from] = to
+	}
+	return &aliasProtoRegistry{ProtoRegistry: base, aliases: copied}
+}
+
+type aliasProtoRegistry struct {
+	ProtoRegistry
+	aliases map[string]string
+}
+
+func (r *aliasProtoRegistry) UnstableRangeProtoFiles(f func(protoreflect.FileDescriptor) bool) {
+	rangeProtoFiles(r.ProtoRegistry, f)
+}
+
+func (r *aliasProtoRegistry) UnstableProtoMessageDescriptor(name string) (protoreflect.MessageDescriptor, error) {
+	if descRegistry, ok := r.ProtoRegistry.(protoDescriptorRegistry); ok {
+		return descRegistry.UnstableProtoMessageDescriptor(name)
+	}
+	return nil, nil
+}
+
+func (r *aliasProtoRegistry) UnstableProtoServiceDescriptor(name string) protoreflect.ServiceDescriptor {
+	return lookupProtoService(r.ProtoRegistry, name)
+}
+
+func (r *aliasProtoRegistry) UnstableResolveProtoName(packageName, name string) (string, bool) {
+	if to, ok := r.aliases[packageName+"."+name]; ok {
+		return to, true
+	}
+	if resolver, ok := r.ProtoRegistry.(ProtoNameResolver); ok {
+		return resolver.UnstableResolveProtoName(packageName, name)
+	}
+	return "", false
+}
+
+// lookupProtoName resolves a fully-qualified Protobuf name such as
+// "google.protobuf.Timestamp" to a message or enum type. The boundary
+// between package and type name isn't known, so each possible split is
+// tried starting from the longest package name.
+func lookupProtoName(registry ProtoRegistry, name string) (starlark.Value, error) {
+	if registry == nil {
+		registry = &defaultProtoRegistry{}
+	}
+	parts := strings.Split(name, ".")
+	for ii := len(parts) - 1; ii > 0; ii-- {
+		var val starlark.Value = newProtoPackage(registry, strings.Join(parts[:ii], "."))
+		for _, attrName := range parts[ii:] {
+			hasAttrs, ok := val.(starlark.HasAttrs)
+			if !ok {
+				val = nil
+				break
+			}
+			attr, err := hasAttrs.Attr(attrName)
+			if err != nil || attr == nil {
+				val = nil
+				break
+			}
+			val = attr
+		}
+		if val != nil {
+			return val, nil
+		}
+	}
+	return nil, fmt.Errorf("Protobuf type %q not found", name)
+}
+
+// ProtoMessageDescriptor returns the descriptor of a Protobuf message type
+// by its full name.
+func ProtoMessageDescriptor(registry ProtoRegistry, name string) (protoreflect.MessageDescriptor, error) {
+	if registry == nil {
+		registry = &defaultProtoRegistry{}
+	}
+	val, err := newMessageType(registry, name)
+	if err != nil {
+		return nil, err
+	}
+	return proto.MessageV2(val.(*skyProtoMessageType).emptyMsg).ProtoReflect().Descriptor(), nil
+}
+
+// ProtoEnumValues returns the values of a Protobuf enum type, keyed by
+// their names.
+func ProtoEnumValues(registry ProtoRegistry, enumName string) (starlark.StringDict, error) {
+	val, err := lookupProtoName(registry, enumName)
+	if err != nil {
+		return nil, err
+	}
+	enumType, ok := val.(*skyProtoEnumType)
+	if !ok {
+		return nil, fmt.Errorf("%q is a %s, not a proto.EnumType", enumName, val.Type())
+	}
+	values := make(starlark.StringDict, len(enumType.valueMap))
+	for valueName := range enumType.valueMap {
+		values[valueName], _ = enumType.Attr(valueName)
+	}
+	return values, nil
+}
@@ -0,0 +1,387 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Implementation of the `proto.get_path()` built-in function. Returns the
+// value at a path of fields within a message, such as
+// "spec.template.metadata.labels.app", or `default` if a message, map
+// entry, or list element on the path isn't set. Map keys may follow a dot
+// if they're identifiers, or else be given in brackets along with list
+// indexes, as in `containers[0].env["LOG-LEVEL"]`.
+//
+//  def proto.get_path(msg, path, default=None)
+func fnProtoGetPath(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var val starlark.Value
+	var path string
+	var dflt starlark.Value = starlark.None
+	if err := starlark.UnpackArgs("proto.get_path", args, kwargs, "msg", &val, "path", &path, "default?", &dflt); err != nil {
+		return nil, err
+	}
+	msg, ok := val.(*skyProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.Message", "proto.get_path", val.Type())
+	}
+	steps, err := parseProtoPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", "proto.get_path", err)
+	}
+	container, err := walkProtoPath(msg, steps, false)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", "proto.get_path", err)
+	}
+	if container.val == nil {
+		return dflt, nil
+	}
+	got, err := container.get(steps[len(steps)-1])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", "proto.get_path", err)
+	}
+	if got == nil || got == starlark.None {
+		return dflt, nil
+	}
+	return got, nil
+}
+
+// Implementation of the `proto.set_path()` built-in function. Sets the
+// value at a path of fields within a message, creating the messages and
+// map entries that contain it if they aren't set. Paths are written as for
+// proto.get_path(); list elements must already exist.
+//
+//  def proto.set_path(msg, path, value)
+func fnProtoSetPath(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var val, value starlark.Value
+	var path string
+	if err := starlark.UnpackArgs("proto.set_path", args, kwargs, "msg", &val, "path", &path, "value", &value); err != nil {
+		return nil, err
+	}
+	msg, ok := val.(*skyProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.Message", "proto.set_path", val.Type())
+	}
+	steps, err := parseProtoPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", "proto.set_path", err)
+	}
+	container, err := walkProtoPath(msg, steps, true)
+	if err == nil {
+		err = container.set(steps[len(steps)-1], value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", "proto.set_path", err)
+	}
+	return starlark.None, nil
+}
+
+// A pathStep is a field name or map key following a dot, or a list index
+// or map key in brackets.
+type pathStep struct {
+	name  string
+	index starlark.Value
+	path  string // the path up to and including this step
+}
+
+// parseProtoPath splits a path into its steps. Field names may be any
+// identifier, including Starlark keywords such as "from", and bracketed
+// keys are quoted as in Starlark.
+func parseProtoPath(path string) ([]pathStep, error) {
+	invalid := fmt.Errorf("invalid path %q", path)
+	var steps []pathStep
+	rest := path
+	for {
+		n := identLen(rest)
+		if n == 0 {
+			return nil, invalid
+		}
+		steps = append(steps, pathStep{name: rest[:n]})
+		rest = rest[n:]
+		for strings.HasPrefix(rest, "[") {
+			end := indexEnd(rest)
+			if end < 0 {
+				return nil, invalid
+			}
+			expr, err := syntax.ParseExpr("", rest[1:end], 0)
+			if err != nil {
+				return nil, invalid
+			}
+			index, ok := pathIndex(expr)
+			if !ok {
+				return nil, invalid
+			}
+			steps = append(steps, pathStep{index: index})
+			rest = rest[end+1:]
+		}
+		if rest == "" {
+			break
+		}
+		if rest[0] != '.' {
+			return nil, invalid
+		}
+		rest = rest[1:]
+	}
+	var prefix string
+	for ii, step := range steps {
+		if step.index != nil {
+			prefix += "[" + step.index.String() + "]"
+		} else {
+			prefix = joinFieldPath(prefix, step.name)
+		}
+		steps[ii].path = prefix
+	}
+	return steps, nil
+}
+
+// identLen returns the length of the identifier that s starts with.
+func identLen(s string) int {
+	for ii := 0; ii < len(s); ii++ {
+		c := s[ii]
+		if c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || ii > 0 && '0' <= c && c <= '9' {
+			continue
+		}
+		return ii
+	}
+	return len(s)
+}
+
+// indexEnd returns the position of the bracket that closes the one that s
+// starts with, skipping over a quoted key, or -1 if there isn't one.
+func indexEnd(s string) int {
+	var quote byte
+	for ii := 1; ii < len(s); ii++ {
+		c := s[ii]
+		switch {
+		case quote != 0 && c == '\\':
+			ii++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ']':
+			return ii
+		}
+	}
+	return -1
+}
+
+// pathIndex returns the value of a bracketed list index or map key, which
+// must be a string or int literal.
+func pathIndex(expr syntax.Expr) (starlark.Value, bool) {
+	negate := false
+	if unary, ok := expr.(*syntax.UnaryExpr); ok && unary.Op == syntax.MINUS {
+		negate = true
+		expr = unary.X
+	}
+	lit, ok := expr.(*syntax.Literal)
+	if !ok {
+		return nil, false
+	}
+	switch value := lit.Value.(type) {
+	case string:
+		return starlark.String(value), !negate
+	case int64:
+		if negate {
+			value = -value
+		}
+		return starlark.MakeInt64(value), true
+	}
+	return nil, false
+}
+
+// A pathContainer is the message, map, or list that a step of a path is
+// looked up in. For maps and lists, fd is their field and owner the
+// message that has it.
+type pathContainer struct {
+	val   starlark.Value
+	fd    protoreflect.FieldDescriptor
+	owner protoreflect.Message
+}
+
+// walkProtoPath returns the container of the last step of a path. If
+// create is set, messages and map entries that aren't set are created;
+// otherwise a container with a nil val is returned.
+func walkProtoPath(msg *skyProtoMessage, steps []pathStep, create bool) (pathContainer, error) {
+	container := pathContainer{val: msg}
+	for _, step := range steps[:len(steps)-1] {
+		next, err := container.get(step)
+		if err != nil {
+			return pathContainer{}, err
+		}
+		if next == nil || next == starlark.None {
+			if !create {
+				return pathContainer{}, nil
+			}
+			if next, err = container.create(step); err != nil {
+				return pathContainer{}, err
+			}
+		}
+		if container, err = container.enter(step, next); err != nil {
+			return pathContainer{}, err
+		}
+	}
+	return container, nil
+}
+
+// enter returns the container for the value of a step.
+func (c pathContainer) enter(step pathStep, next starlark.Value) (pathContainer, error) {
+	switch next := next.(type) {
+	case *skyProtoMessage:
+		return pathContainer{val: next}, nil
+	case *protoMap, *protoRepeated:
+		msg := c.val.(*skyProtoMessage)
+		refl := proto.MessageV2(msg.msg).ProtoReflect()
+		return pathContainer{val: next, fd: refl.Descriptor().Fields().ByName(protoreflect.Name(step.name)), owner: refl}, nil
+	}
+	return pathContainer{}, fmt.Errorf("%s is a %s, not a message, map, or list", step.path, next.Type())
+}
+
+// key returns the map key named by a step, converting keys that follow a
+// dot to the map's key type.
+func (c pathContainer) key(step pathStep) (starlark.Value, error) {
+	if step.index != nil {
+		return step.index, nil
+	}
+	switch c.fd.MapKey().Kind() {
+	case protoreflect.StringKind:
+		return starlark.String(step.name), nil
+	case protoreflect.BoolKind:
+		if b, err := strconv.ParseBool(step.name); err == nil {
+			return starlark.Bool(b), nil
+		}
+	}
+	return nil, fmt.Errorf("%s: map key %q must be given in brackets", step.path, step.name)
+}
+
+// get returns the value of a step, or nil if it's an unset map entry or
+// list element.
+func (c pathContainer) get(step pathStep) (starlark.Value, error) {
+	switch val := c.val.(type) {
+	case *skyProtoMessage:
+		if step.index != nil {
+			return nil, fmt.Errorf("%s: can't index a message", step.path)
+		}
+		got, err := val.Attr(step.name)
+		if err == nil && got == nil {
+			err = fmt.Errorf("%s: `%s' value has no field %q", step.path, val.Type(), step.name)
+		}
+		return got, err
+	case *protoMap:
+		key, err := c.key(step)
+		if err != nil {
+			return nil, err
+		}
+		got, _, err := val.Get(key)
+		return got, err
+	case *protoRepeated:
+		i, err := c.listIndex(step)
+		if err != nil || i < 0 {
+			return nil, err
+		}
+		return val.Index(i), nil
+	}
+	return nil, fmt.Errorf("%s: can't look up a path in a %s", step.path, c.val.Type())
+}
+
+// listIndex returns the list index of a step, or -1 if it's out of range.
+// Negative indexes count from the end.
+func (c pathContainer) listIndex(step pathStep) (int, error) {
+	if step.index == nil {
+		return 0, fmt.Errorf("%s: repeated field must be indexed with [N]", step.path)
+	}
+	i, err := starlark.AsInt32(step.index)
+	if err != nil {
+		return 0, fmt.Errorf("%s: repeated field must be indexed with an int", step.path)
+	}
+	n := c.val.(starlark.Indexable).Len()
+	if i < 0 {
+		i += n
+	}
+	if i < 0 || i >= n {
+		return -1, nil
+	}
+	return i, nil
+}
+
+// create sets an unset message field or map entry to an empty message,
+// and returns it.
+func (c pathContainer) create(step pathStep) (starlark.Value, error) {
+	switch val := c.val.(type) {
+	case *skyProtoMessage:
+		refl := proto.MessageV2(val.msg).ProtoReflect()
+		fd := refl.Descriptor().Fields().ByName(protoreflect.Name(step.name))
+		if fd == nil || fd.Message() == nil || fd.IsList() || fd.IsMap() {
+			return nil, fmt.Errorf("%s is not set", step.path)
+		}
+		sub := NewSkyProtoMessage(proto.MessageV1(refl.NewField(fd).Message().Interface()))
+		if err := val.SetField(step.name, sub); err != nil {
+			return nil, err
+		}
+		return val.Attr(step.name)
+	case *protoMap:
+		if c.fd.MapValue().Message() == nil {
+			break
+		}
+		key, err := c.key(step)
+		if err != nil {
+			return nil, err
+		}
+		sub := NewSkyProtoMessage(proto.MessageV1(c.owner.NewField(c.fd).Map().NewValue().Message().Interface()))
+		if err := val.SetKey(key, sub); err != nil {
+			return nil, err
+		}
+		got, _, err := val.Get(key)
+		return got, err
+	}
+	return nil, fmt.Errorf("%s is not set", step.path)
+}
+
+// set sets the value of the last step of a path.
+func (c pathContainer) set(step pathStep, value starlark.Value) error {
+	switch val := c.val.(type) {
+	case *skyProtoMessage:
+		if step.index != nil {
+			return fmt.Errorf("%s: can't index a message", step.path)
+		}
+		return val.SetField(step.name, value)
+	case *protoMap:
+		key, err := c.key(step)
+		if err != nil {
+			return err
+		}
+		return val.SetKey(key, value)
+	case *protoRepeated:
+		i, err := c.listIndex(step)
+		if err != nil {
+			return err
+		}
+		if i < 0 {
+			return fmt.Errorf("%s: index out of range", step.path)
+		}
+		return val.SetIndex(i, value)
+	}
+	return fmt.Errorf("%s: can't set a path in a %s", step.path, c.val.Type())
+}
@@ -0,0 +1,533 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Field access for messages that implement the protobuf APIv2 reflection
+// interface. Values are converted to and from Starlark in the same way as
+// the fields of generated message structs, and errors name the Go types
+// that protoc-gen-go would generate for each field.
+
+// reflectFields accesses the fields of a message through the protobuf APIv2
+// reflection interface.
+type reflectFields struct {
+	refl protoreflect.Message
+}
+
+func (f *reflectFields) rebind(msg proto.Message) { f.refl = proto.MessageReflect(msg) }
+
+func (f *reflectFields) names() []string {
+	fields := f.refl.Descriptor().Fields()
+	names := make([]string, fields.Len())
+	for ii := range names {
+		names[ii] = string(fields.Get(ii).Name())
+	}
+	return names
+}
+
+func (f *reflectFields) descriptor(name string) protoreflect.FieldDescriptor {
+	return f.refl.Descriptor().Fields().ByName(protoreflect.Name(name))
+}
+
+func (f *reflectFields) get(msg *skyProtoMessage, name string) starlark.Value {
+	if msg.cow != nil && !msg.frozen {
+		// The field's value may be modified through its wrapper, so msg
+		// must be made private first.
+		msg.attrMu.Unlock()
+		msg.unshare()
+		msg.attrMu.Lock()
+	}
+	fd := f.descriptor(name)
+	switch {
+	case fd.IsList():
+		list := f.mutable(msg, fd).List()
+		return newProtoRepeated(reflectListField{f.refl, fd, list})
+	case fd.IsMap():
+		m := f.mutable(msg, fd).Map()
+		items := make([]starlark.Tuple, 0, m.Len())
+		m.Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+			items = append(items, starlark.Tuple{reflectToStarlark(fd.MapKey(), k.Value()), reflectToStarlark(fd.MapValue(), v)})
+			return true
+		})
+		return newProtoMap(reflectMapField{f.refl, fd, m}, items)
+	case fd.HasPresence() && !f.refl.Has(fd):
+		return starlark.None
+	}
+	return reflectToStarlark(fd, f.refl.Get(fd))
+}
+
+// mutable returns a list or map field that can be modified in place.
+// Frozen messages are never modified, and may be read concurrently, so
+// their fields are returned read-only.
+func (f *reflectFields) mutable(msg *skyProtoMessage, fd protoreflect.FieldDescriptor) protoreflect.Value {
+	if msg.frozen {
+		return f.refl.Get(fd)
+	}
+	return f.refl.Mutable(fd)
+}
+
+// reflectToStarlark converts a singular value, or an element of a list or
+// map, to Starlark.
+func reflectToStarlark(fd protoreflect.FieldDescriptor, val protoreflect.Value) starlark.Value {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return starlark.Bool(val.Bool())
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return starlark.MakeInt64(val.Int())
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return starlark.MakeUint64(val.Uint())
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return starlark.Float(val.Float())
+	case protoreflect.StringKind:
+		return starlark.String(val.String())
+	case protoreflect.BytesKind:
+		return starlark.String(val.Bytes())
+	case protoreflect.EnumKind:
+		return reflectEnumValue(fd.Enum(), val.Enum())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		if sky, ok := wellKnownToStarlark(val.Message()); ok {
+			return sky
+		}
+		return NewSkyProtoMessage(proto.MessageV1(val.Message().Interface()))
+	}
+	// This should be impossible, because the set of protobuf field kinds
+	// is small and fixed.
+	panic(fmt.Errorf("reflectToStarlark: unknown kind %v", fd.Kind()))
+}
+
+func reflectEnumValue(ed protoreflect.EnumDescriptor, number protoreflect.EnumNumber) *skyProtoEnumValue {
+	// Like the String() method of generated enums, unknown values are
+	// named by their number.
+	name := strconv.Itoa(int(number))
+	if value := ed.Values().ByNumber(number); value != nil {
+		name = string(value.Name())
+	}
+	return &skyProtoEnumValue{
+		typeName:  string(ed.FullName()),
+		valueName: name,
+		value:     int32(number),
+	}
+}
+
+func (f *reflectFields) set(msg *skyProtoMessage, name string, sky starlark.Value) error {
+	fd := f.descriptor(name)
+	val, err := reflectFieldFromStarlark(f.refl, fd, sky)
+	if err != nil {
+		return err
+	}
+	if err := msg.checkMutable("set field of"); err != nil {
+		return err
+	}
+	f.evict(msg, fd)
+	if val.IsValid() {
+		f.refl.Set(fd, val)
+	} else {
+		f.refl.Clear(fd)
+	}
+	return nil
+}
+
+// evict drops the cached wrapper of a field that's about to be changed.
+// Setting a oneof member clears the other members, so their wrappers are
+// dropped too.
+func (f *reflectFields) evict(msg *skyProtoMessage, fd protoreflect.FieldDescriptor) {
+	oneof := fd.ContainingOneof()
+	if oneof == nil {
+		msg.evict(string(fd.Name()))
+		return
+	}
+	for ii := 0; ii < oneof.Fields().Len(); ii++ {
+		msg.evict(string(oneof.Fields().Get(ii).Name()))
+	}
+}
+
+func (f *reflectFields) clear(msg *skyProtoMessage, name string) {
+	fd := f.descriptor(name)
+	msg.evict(name)
+	if oneof := fd.ContainingOneof(); oneof != nil && f.refl.WhichOneof(oneof) != fd {
+		return
+	}
+	f.refl.Clear(fd)
+}
+
+func (f *reflectFields) has(name string) (isSet, ok bool) {
+	fd := f.descriptor(name)
+	if !fd.HasPresence() {
+		return false, false
+	}
+	return f.refl.Has(fd), true
+}
+
+func (f *reflectFields) isSet(name string) bool {
+	return f.refl.Has(f.descriptor(name))
+}
+
+func (f *reflectFields) whichOneof(oneof string) (string, bool) {
+	od := f.refl.Descriptor().Oneofs().ByName(protoreflect.Name(oneof))
+	if od == nil || od.IsSynthetic() {
+		return "", false
+	}
+	if fd := f.refl.WhichOneof(od); fd != nil {
+		return string(fd.Name()), true
+	}
+	return "", true
+}
+
+func (f *reflectFields) oneofOf(name string) (oneof, current string, ok bool) {
+	fd := f.descriptor(name)
+	if fd == nil {
+		return "", "", false
+	}
+	od := fd.ContainingOneof()
+	if od == nil || od.IsSynthetic() {
+		return "", "", false
+	}
+	if set := f.refl.WhichOneof(od); set != nil {
+		current = string(set.Name())
+	}
+	return string(od.Name()), current, true
+}
+
+// reflectType describes the Go type that protoc-gen-go would generate for
+// a field, or for the elements of a repeated or map field.
+type reflectType struct {
+	name string
+	kind reflect.Kind
+}
+
+var reflectScalarTypes = map[protoreflect.Kind]reflectType{
+	protoreflect.BoolKind:     {"bool", reflect.Bool},
+	protoreflect.Int32Kind:    {"int32", reflect.Int32},
+	protoreflect.Sint32Kind:   {"int32", reflect.Int32},
+	protoreflect.Sfixed32Kind: {"int32", reflect.Int32},
+	protoreflect.Int64Kind:    {"int64", reflect.Int64},
+	protoreflect.Sint64Kind:   {"int64", reflect.Int64},
+	protoreflect.Sfixed64Kind: {"int64", reflect.Int64},
+	protoreflect.Uint32Kind:   {"uint32", reflect.Uint32},
+	protoreflect.Fixed32Kind:  {"uint32", reflect.Uint32},
+	protoreflect.Uint64Kind:   {"uint64", reflect.Uint64},
+	protoreflect.Fixed64Kind:  {"uint64", reflect.Uint64},
+	protoreflect.FloatKind:    {"float32", reflect.Float32},
+	protoreflect.DoubleKind:   {"float64", reflect.Float64},
+	protoreflect.StringKind:   {"string", reflect.String},
+	protoreflect.BytesKind:    {"[]uint8", reflect.Slice},
+}
+
+func reflectElemType(fd protoreflect.FieldDescriptor) reflectType {
+	switch fd.Kind() {
+	case protoreflect.EnumKind:
+		return reflectType{string(fd.Enum().FullName()), reflect.Int32}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return reflectType{string(fd.Message().FullName()), reflect.Struct}
+	}
+	return reflectScalarTypes[fd.Kind()]
+}
+
+func reflectFieldType(fd protoreflect.FieldDescriptor) reflectType {
+	switch {
+	case fd.IsMap():
+		key, elem := reflectElemType(fd.MapKey()), reflectElemType(fd.MapValue())
+		return reflectType{fmt.Sprintf("map[%s]%s", key.name, elem.name), reflect.Map}
+	case fd.IsList():
+		return reflectType{"[]" + reflectElemType(fd).name, reflect.Slice}
+	}
+	t := reflectElemType(fd)
+	// Scalars with explicit presence are generated as pointers, except
+	// within a oneof.
+	oneof := fd.ContainingOneof()
+	if fd.Message() == nil && fd.HasPresence() && (oneof == nil || oneof.IsSynthetic()) {
+		t.name = "*" + t.name
+	}
+	return t
+}
+
+func (t reflectType) errorf(sky starlark.Value, format string, args ...interface{}) error {
+	return &conversionError{
+		expectedType: t.name,
+		expectedKind: t.kind,
+		value:        sky,
+		err:          fmt.Errorf(format, args...),
+	}
+}
+
+func (t reflectType) typeError(sky starlark.Value) error {
+	return t.errorf(sky, "TypeError: value %s (type `%s') can't be assigned to type `%s'.", sky.String(), sky.Type(), t.name)
+}
+
+// reflectFieldFromStarlark converts a value to be assigned to a field of
+// parent. An invalid value means that the field should be cleared.
+func reflectFieldFromStarlark(parent protoreflect.Message, fd protoreflect.FieldDescriptor, sky starlark.Value) (protoreflect.Value, error) {
+	t := reflectFieldType(fd)
+	switch sky := sky.(type) {
+	case starlark.NoneType:
+		if fd.HasPresence() {
+			return protoreflect.Value{}, nil
+		}
+		if fd.IsList() || fd.IsMap() {
+			return protoreflect.Value{}, t.typeError(sky)
+		}
+		return protoreflect.Value{}, t.errorf(sky, "TypeError: value None can't be assigned to type `%s' in proto3 mode.", t.name)
+	case *protoRepeated:
+		return reflectFieldFromStarlark(parent, fd, sky.elements())
+	case *protoMap:
+		return reflectFieldFromStarlark(parent, fd, sky.dict)
+	case *starlark.List:
+		if fd.IsList() {
+			field := reflectListField{parent: parent, fd: fd, list: parent.NewField(fd).List()}
+			for ii := 0; ii < sky.Len(); ii++ {
+				elem, err := field.convert(sky.Index(ii))
+				if err != nil {
+					return protoreflect.Value{}, withIndex(err, fmt.Sprint(ii))
+				}
+				field.append(elem)
+			}
+			return protoreflect.ValueOfList(field.list), nil
+		}
+	case *starlark.Dict:
+		if fd.IsMap() {
+			field := reflectMapField{parent: parent, fd: fd, m: parent.NewField(fd).Map()}
+			for _, item := range sky.Items() {
+				key, err := field.convertKey(item[0])
+				if err != nil {
+					return protoreflect.Value{}, err
+				}
+				elem, err := field.convertElem(item[1])
+				if err != nil {
+					return protoreflect.Value{}, withIndex(err, item[0].String())
+				}
+				field.set(key, elem)
+			}
+			return protoreflect.ValueOfMap(field.m), nil
+		}
+	}
+	if fd.IsList() || fd.IsMap() {
+		return protoreflect.Value{}, t.typeError(sky)
+	}
+	return reflectValueFromStarlark(fd, t, func() protoreflect.Message {
+		return parent.NewField(fd).Message()
+	}, sky)
+}
+
+// reflectValueFromStarlark converts a singular value, or an element of a
+// list or map. Errors report the type t. For message fields, newMessage
+// returns an empty message of the field's type.
+func reflectValueFromStarlark(fd protoreflect.FieldDescriptor, t reflectType, newMessage func() protoreflect.Message, sky starlark.Value) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		if val, ok := sky.(starlark.Bool); ok {
+			return protoreflect.ValueOfBool(bool(val)), nil
+		}
+	case protoreflect.StringKind:
+		if val, ok := sky.(starlark.String); ok {
+			return protoreflect.ValueOfString(string(val)), nil
+		}
+	case protoreflect.BytesKind:
+		if val, ok := sky.(starlark.String); ok {
+			return protoreflect.ValueOfBytes([]byte(val)), nil
+		}
+	case protoreflect.FloatKind:
+		if val, ok := starlark.AsFloat(sky); ok {
+			return protoreflect.ValueOfFloat32(float32(val)), nil
+		}
+	case protoreflect.DoubleKind:
+		if val, ok := starlark.AsFloat(sky); ok {
+			return protoreflect.ValueOfFloat64(val), nil
+		}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		if skyInt, ok := sky.(starlark.Int); ok {
+			if val, ok := skyInt.Int64(); ok && val >= math.MinInt32 && val <= math.MaxInt32 {
+				return protoreflect.ValueOfInt32(int32(val)), nil
+			}
+			return protoreflect.Value{}, t.errorf(sky, "ValueError: value %v overflows type `int32'.", skyInt)
+		}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		if skyInt, ok := sky.(starlark.Int); ok {
+			if val, ok := skyInt.Int64(); ok {
+				return protoreflect.ValueOfInt64(val), nil
+			}
+			return protoreflect.Value{}, t.errorf(sky, "ValueError: value %v overflows type `int64'.", skyInt)
+		}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		if skyInt, ok := sky.(starlark.Int); ok {
+			if val, ok := skyInt.Uint64(); ok && val <= math.MaxUint32 {
+				return protoreflect.ValueOfUint32(uint32(val)), nil
+			}
+			return protoreflect.Value{}, t.errorf(sky, "ValueError: value %v overflows type `uint32'.", skyInt)
+		}
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		if skyInt, ok := sky.(starlark.Int); ok {
+			if val, ok := skyInt.Uint64(); ok {
+				return protoreflect.ValueOfUint64(val), nil
+			}
+			return protoreflect.Value{}, t.errorf(sky, "ValueError: value %v overflows type `uint64'.", skyInt)
+		}
+	case protoreflect.EnumKind:
+		if val, ok := sky.(*skyProtoEnumValue); ok && val.typeName == string(fd.Enum().FullName()) {
+			return protoreflect.ValueOfEnum(protoreflect.EnumNumber(val.value)), nil
+		}
+		if err := enumRangeError(fd.Enum(), sky); err != "" {
+			return protoreflect.Value{}, t.errorf(sky, "%s", err)
+		}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		if val, ok := sky.(*skyProtoMessage); ok && val.Type() == string(fd.Message().FullName()) {
+			return reflectMessageFromStarlark(t, newMessage(), val)
+		}
+		if dst, ok, err := wellKnownFromStarlark(t, fd.Message(), newMessage, sky); ok {
+			if err != nil {
+				return protoreflect.Value{}, err
+			}
+			return protoreflect.ValueOfMessage(dst), nil
+		}
+	}
+	return protoreflect.Value{}, t.typeError(sky)
+}
+
+// reflectMessageFromStarlark copies a message so that it can be stored in
+// a field whose empty value is dst.
+func reflectMessageFromStarlark(t reflectType, dst protoreflect.Message, sky *skyProtoMessage) (protoreflect.Value, error) {
+	dstMsg := proto.MessageV1(dst.Interface())
+	if reflect.TypeOf(dstMsg) == reflect.TypeOf(sky.msg) {
+		return protoreflect.ValueOfMessage(proto.MessageReflect(proto.Clone(sky.msg))), nil
+	}
+	// The message has the field's protobuf type, but a different Go type,
+	// such as a generated message assigned to a field of a dynamic message.
+	data, err := proto.Marshal(sky.msg)
+	if err == nil {
+		err = proto.Unmarshal(data, dstMsg)
+	}
+	if err != nil {
+		return protoreflect.Value{}, t.errorf(sky, "ValueError: value %s (type `%s') can't be converted to `%s': %v", sky.String(), sky.Type(), t.name, err)
+	}
+	return protoreflect.ValueOfMessage(dst), nil
+}
+
+// A reflectListField is a repeated field of an APIv2 message.
+type reflectListField struct {
+	parent protoreflect.Message
+	fd     protoreflect.FieldDescriptor
+	list   protoreflect.List
+}
+
+func (f reflectListField) elemTypeName() string { return reflectElemType(f.fd).name }
+
+func (f reflectListField) convert(v starlark.Value) (interface{}, error) {
+	t := reflectElemType(f.fd)
+	if v == starlark.None {
+		return nil, t.typeError(v)
+	}
+	return reflectValueFromStarlark(f.fd, t, func() protoreflect.Message {
+		return f.parent.NewField(f.fd).List().NewElement().Message()
+	}, v)
+}
+
+func (f reflectListField) elemToStarlark(val interface{}) starlark.Value {
+	return reflectToStarlark(f.fd, val.(protoreflect.Value))
+}
+
+func (f reflectListField) len() int                 { return f.list.Len() }
+func (f reflectListField) get(i int) starlark.Value { return reflectToStarlark(f.fd, f.list.Get(i)) }
+
+func (f reflectListField) append(vals ...interface{}) {
+	for _, val := range vals {
+		f.list.Append(val.(protoreflect.Value))
+	}
+}
+
+func (f reflectListField) insert(i int, val interface{}) {
+	n := f.list.Len()
+	if n == i {
+		f.list.Append(val.(protoreflect.Value))
+		return
+	}
+	f.list.Append(f.list.Get(n - 1))
+	for jj := n - 1; jj > i; jj-- {
+		f.list.Set(jj, f.list.Get(jj-1))
+	}
+	f.list.Set(i, val.(protoreflect.Value))
+}
+
+func (f reflectListField) delete(i int) {
+	n := f.list.Len()
+	for jj := i; jj < n-1; jj++ {
+		f.list.Set(jj, f.list.Get(jj+1))
+	}
+	f.list.Truncate(n - 1)
+}
+
+func (f reflectListField) set(i int, val interface{}) { f.list.Set(i, val.(protoreflect.Value)) }
+func (f reflectListField) clear()                     { f.list.Truncate(0) }
+
+// A reflectMapField is a map field of an APIv2 message.
+type reflectMapField struct {
+	parent protoreflect.Message
+	fd     protoreflect.FieldDescriptor
+	m      protoreflect.Map
+}
+
+func (f reflectMapField) keyTypeName() string  { return reflectElemType(f.fd.MapKey()).name }
+func (f reflectMapField) elemTypeName() string { return reflectElemType(f.fd.MapValue()).name }
+
+func (f reflectMapField) convertKey(k starlark.Value) (interface{}, error) {
+	t := reflectElemType(f.fd.MapKey())
+	if k == starlark.None {
+		return nil, t.typeError(k)
+	}
+	key, err := reflectValueFromStarlark(f.fd.MapKey(), t, nil, k)
+	if err != nil {
+		return nil, err
+	}
+	return key.MapKey(), nil
+}
+
+func (f reflectMapField) convertElem(v starlark.Value) (interface{}, error) {
+	t := reflectElemType(f.fd.MapValue())
+	if v == starlark.None {
+		return nil, t.typeError(v)
+	}
+	return reflectValueFromStarlark(f.fd.MapValue(), t, func() protoreflect.Message {
+		return f.parent.NewField(f.fd).Map().NewValue().Message()
+	}, v)
+}
+
+func (f reflectMapField) elemToStarlark(v interface{}) starlark.Value {
+	return reflectToStarlark(f.fd.MapValue(), v.(protoreflect.Value))
+}
+
+func (f reflectMapField) set(k, v interface{}) {
+	f.m.Set(k.(protoreflect.MapKey), v.(protoreflect.Value))
+}
+
+func (f reflectMapField) delete(k interface{}) { f.m.Clear(k.(protoreflect.MapKey)) }
+
+func (f reflectMapField) clear() {
+	f.m.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+		f.m.Clear(k)
+		return true
+	})
+}
@@ -0,0 +1,233 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// A ReflectionClient fetches file descriptors from a gRPC server with the
+// server reflection service (grpc.reflection.v1.ServerReflection). Each
+// method returns the serialized FileDescriptorProtos of a
+// FileDescriptorResponse, which may include files that the requested one
+// imports. If the server doesn't have the requested symbol or file, the
+// error has the gRPC status code NotFound.
+type ReflectionClient interface {
+	// FileContainingSymbol returns the file that defines a fully-qualified
+	// symbol, such as a message or service name.
+	FileContainingSymbol(ctx context.Context, symbol string) ([][]byte, error)
+
+	// FileByFilename returns the file with the given import path.
+	FileByFilename(ctx context.Context, filename string) ([][]byte, error)
+}
+
+// ReflectionRegistry is a ProtoRegistry for the types of a gRPC server,
+// which are fetched with its reflection service the first time they're
+// looked up. Types that have generated Go code linked into the binary are
+// looked up in the default registry; the others are backed by dynamicpb.
+//
+// Fetched files are cached for the registry's lifetime, as are the symbols
+// that the server reported as not found.
+type ReflectionRegistry struct {
+	client  ReflectionClient
+	timeout time.Duration
+
+	mu    sync.Mutex
+	files *protoregistry.Files
+
+	// missing holds the symbols that the server doesn't have, so that
+	// they aren't requested again.
+	missing map[string]bool
+}
+
+var _ protoDescriptorRegistry = (*ReflectionRegistry)(nil)
+
+// NewReflectionRegistry returns a registry of the types that client
+// fetches. The registry is used from code that has no context of its own,
+// so each request gets a context that expires after timeout, or never if
+// timeout is zero.
+func NewReflectionRegistry(client ReflectionClient, timeout time.Duration) *ReflectionRegistry {
+	return &ReflectionRegistry{
+		client:  client,
+		timeout: timeout,
+		files:   new(protoregistry.Files),
+		missing: make(map[string]bool),
+	}
+}
+
+// lookup returns the descriptor of a symbol, fetching the file that defines
+// it if it hasn't been fetched yet. It returns nil if the server doesn't
+// have the symbol.
+func (r *ReflectionRegistry) lookup(name string) (protoreflect.Descriptor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if desc, err := r.files.FindDescriptorByName(protoreflect.FullName(name)); err == nil {
+		return desc, nil
+	}
+	if r.missing[name] {
+		return nil, nil
+	}
+	ctx, cancel := r.context()
+	defer cancel()
+	data, err := r.client.FileContainingSymbol(ctx, name)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			r.missing[name] = true
+			return nil, nil
+		}
+		// Other failures, such as an unavailable server, may not
+		// happen again.
+		return nil, fmt.Errorf("gRPC reflection: %s: %v", name, err)
+	}
+	b, err := r.builder(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("gRPC reflection: %s: %v", name, err)
+	}
+	for path := range b.protos {
+		if _, err := b.build(path, nil); err != nil {
+			return nil, fmt.Errorf("gRPC reflection: %s: %v", name, err)
+		}
+	}
+	desc, err := r.files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("gRPC reflection: %s: not defined by the files the server returned", name)
+	}
+	return desc, nil
+}
+
+// context returns the context of a lookup's requests.
+func (r *ReflectionRegistry) context() (context.Context, context.CancelFunc) {
+	if r.timeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), r.timeout)
+}
+
+// builder returns a descriptorSetBuilder for the fetched files, with the
+// imports they're missing also fetched.
+func (r *ReflectionRegistry) builder(ctx context.Context, data [][]byte) (*descriptorSetBuilder, error) {
+	b := &descriptorSetBuilder{
+		protos: make(map[string]*descriptorpb.FileDescriptorProto),
+		files:  r.files,
+	}
+	pending := data
+	for len(pending) > 0 {
+		file := &descriptorpb.FileDescriptorProto{}
+		if err := proto.Unmarshal(pending[0], file); err != nil {
+			return nil, err
+		}
+		pending = pending[1:]
+		if _, ok := b.protos[file.GetName()]; ok {
+			continue
+		}
+		b.protos[file.GetName()] = file
+		for _, dep := range file.GetDependency() {
+			if b.has(dep) {
+				continue
+			}
+			fetched, err := r.client.FileByFilename(ctx, dep)
+			if err != nil {
+				return nil, fmt.Errorf("%s: import %q: %v", file.GetName(), dep, err)
+			}
+			pending = append(pending, fetched...)
+		}
+	}
+	return b, nil
+}
+
+// has reports whether a file doesn't need to be fetched, because it's
+// already been fetched or it's linked into the binary.
+func (b *descriptorSetBuilder) has(path string) bool {
+	if _, ok := b.protos[path]; ok {
+		return true
+	}
+	if _, err := b.files.FindFileByPath(path); err == nil {
+		return true
+	}
+	_, err := protoregistry.GlobalFiles.FindFileByPath(path)
+	return err == nil
+}
+
+func (r *ReflectionRegistry) UnstableProtoMessageType(name string) (reflect.Type, error) {
+	return proto.MessageType(name), nil
+}
+
+func (r *ReflectionRegistry) UnstableProtoMessageDescriptor(name string) (protoreflect.MessageDescriptor, error) {
+	desc, err := r.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	msgDesc, _ := desc.(protoreflect.MessageDescriptor)
+	return msgDesc, nil
+}
+
+func (r *ReflectionRegistry) UnstableProtoServiceDescriptor(name string) protoreflect.ServiceDescriptor {
+	desc, err := r.lookup(name)
+	if err != nil || desc == nil {
+		return lookupProtoService(nil, name)
+	}
+	svcDesc, _ := desc.(protoreflect.ServiceDescriptor)
+	return svcDesc
+}
+
+func (r *ReflectionRegistry) UnstableEnumValueMap(name string) map[string]int32 {
+	if values := proto.EnumValueMap(name); values != nil {
+		return values
+	}
+	desc, err := r.lookup(name)
+	if err != nil {
+		return nil
+	}
+	enumDesc, ok := desc.(protoreflect.EnumDescriptor)
+	if !ok {
+		return nil
+	}
+	return enumValueMap(enumDesc)
+}
+
+// UnstableRangeProtoFiles iterates over the files fetched so far, and then
+// those linked into the binary.
+func (r *ReflectionRegistry) UnstableRangeProtoFiles(f func(protoreflect.FileDescriptor) bool) {
+	r.mu.Lock()
+	var files []protoreflect.FileDescriptor
+	fetched := make(map[string]bool)
+	r.files.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		files = append(files, file)
+		fetched[file.Path()] = true
+		return true
+	})
+	r.mu.Unlock()
+	for _, file := range files {
+		if !f(file) {
+			return
+		}
+	}
+	protoregistry.GlobalFiles.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		return fetched[file.Path()] || f(file)
+	})
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// A protoServiceRegistry is a ProtoRegistry that can describe services.
+// For other registries, services are looked up among those linked into the
+// binary.
+type protoServiceRegistry interface {
+	// UNSTABLE lookup from full protobuf service name to its descriptor,
+	// or nil if there's no such service.
+	UnstableProtoServiceDescriptor(name string) protoreflect.ServiceDescriptor
+}
+
+func lookupProtoService(registry ProtoRegistry, name string) protoreflect.ServiceDescriptor {
+	if services, ok := registry.(protoServiceRegistry); ok {
+		return services.UnstableProtoServiceDescriptor(name)
+	}
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil
+	}
+	svcDesc, _ := desc.(protoreflect.ServiceDescriptor)
+	return svcDesc
+}
+
+// skyProtoService describes a protobuf service, such as for generating
+// routing configuration from its methods. Its message types are resolved
+// with the registry of the proto.package() it was found in.
+type skyProtoService struct {
+	registry ProtoRegistry
+	desc     protoreflect.ServiceDescriptor
+}
+
+var _ starlark.HasAttrs = (*skyProtoService)(nil)
+
+func newProtoService(registry ProtoRegistry, desc protoreflect.ServiceDescriptor) *skyProtoService {
+	return &skyProtoService{registry: registry, desc: desc}
+}
+
+func (svc *skyProtoService) String() string       { return fmt.Sprintf("<proto.Service %q>", svc.desc.FullName()) }
+func (svc *skyProtoService) Type() string         { return "proto.Service" }
+func (svc *skyProtoService) Freeze()              {}
+func (svc *skyProtoService) Truth() starlark.Bool { return starlark.True }
+func (svc *skyProtoService) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: %s", svc.Type())
+}
+
+func (svc *skyProtoService) AttrNames() []string {
+	return []string{"full_name", "methods", "name", "options"}
+}
+
+func (svc *skyProtoService) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "name":
+		return starlark.String(svc.desc.Name()), nil
+	case "full_name":
+		return starlark.String(svc.desc.FullName()), nil
+	case "methods":
+		methods := svc.desc.Methods()
+		items := make([]starlark.Value, methods.Len())
+		for ii := range items {
+			items[ii] = &skyProtoMethod{registry: svc.registry, desc: methods.Get(ii)}
+		}
+		list := starlark.NewList(items)
+		list.Freeze()
+		return list, nil
+	case "options":
+		return descriptorOptions(svc.desc), nil
+	}
+	return nil, nil
+}
+
+// skyProtoMethod describes a method of a protobuf service.
+type skyProtoMethod struct {
+	registry ProtoRegistry
+	desc     protoreflect.MethodDescriptor
+}
+
+var _ starlark.HasAttrs = (*skyProtoMethod)(nil)
+
+func (m *skyProtoMethod) String() string       { return fmt.Sprintf("<proto.Method %q>", m.desc.FullName()) }
+func (m *skyProtoMethod) Type() string         { return "proto.Method" }
+func (m *skyProtoMethod) Freeze()              {}
+func (m *skyProtoMethod) Truth() starlark.Bool { return starlark.True }
+func (m *skyProtoMethod) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: %s", m.Type())
+}
+
+func (m *skyProtoMethod) AttrNames() []string {
+	return []string{
+		"client_streaming",
+		"full_name",
+		"input_type",
+		"name",
+		"options",
+		"output_type",
+		"server_streaming",
+	}
+}
+
+func (m *skyProtoMethod) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "name":
+		return starlark.String(m.desc.Name()), nil
+	case "full_name":
+		return starlark.String(m.desc.FullName()), nil
+	case "input_type":
+		return m.messageType(m.desc.Input())
+	case "output_type":
+		return m.messageType(m.desc.Output())
+	case "client_streaming":
+		return starlark.Bool(m.desc.IsStreamingClient()), nil
+	case "server_streaming":
+		return starlark.Bool(m.desc.IsStreamingServer()), nil
+	case "options":
+		return descriptorOptions(m.desc), nil
+	}
+	return nil, nil
+}
+
+func (m *skyProtoMethod) messageType(desc protoreflect.MessageDescriptor) (starlark.Value, error) {
+	return newMessageType(m.registry, string(desc.FullName()))
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+)
+
+// With SetShareSubmessages(), assigning a frozen message, such as a
+// template defined at the top level of a module, to a message field stores
+// a pointer to it rather than a copy, so that one submessage can be shared
+// by many outputs. The field is recorded in the parent's sharedFields.
+//
+// Frozen messages are never modified, so sharing is safe until the shared
+// message is reached through a mutable parent. Wrappers of shared
+// submessages, and of their submessages in turn, have a cowRef to the
+// wrapper they were accessed through. Before one is modified, the
+// outermost shared message is replaced by a private copy (see unshare).
+// Only messages whose fields are accessed through structFields store
+// shared submessages.
+type cowRef struct {
+	// parent is nil if the submessage was detached from its parent by
+	// assigning another value to the field.
+	parent *skyProtoMessage
+	field  *proto.Properties
+}
+
+// SetShareSubmessages sets whether messages created by a thread share the
+// frozen messages assigned to their fields instead of copying them. The
+// messages that a config outputs may then have submessages in common, so
+// they mustn't be modified in place.
+func SetShareSubmessages(t *starlark.Thread, share bool) {
+	t.SetLocal("share_submessages", share)
+}
+
+func shareSubmessages(t *starlark.Thread) bool {
+	if t == nil {
+		return false
+	}
+	share, _ := t.Local("share_submessages").(bool)
+	return share
+}
+
+// sharedMessage returns the message to store in a field of type t without
+// copying it, if sky is a message that may be shared.
+func sharedMessage(t reflect.Type, sky starlark.Value) (reflect.Value, bool) {
+	msg, ok := sky.(*skyProtoMessage)
+	if !ok || t.Kind() != reflect.Ptr || reflect.TypeOf(msg.msg) != t {
+		return reflect.Value{}, false
+	}
+	if !msg.frozen && msg.cow == nil {
+		return reflect.Value{}, false
+	}
+	return reflect.ValueOf(msg.msg), true
+}
+
+// sharesField reports whether a field's value is a message that isn't
+// owned by msg, either because msg is itself shared or because a shared
+// message was assigned to the field.
+func (msg *skyProtoMessage) sharesField(name string) bool {
+	return msg.cow != nil || msg.sharedFields[name]
+}
+
+func (msg *skyProtoMessage) setShared(name string, shared bool) {
+	if shared {
+		if msg.sharedFields == nil {
+			msg.sharedFields = make(map[string]bool)
+		}
+		msg.sharedFields[name] = true
+	} else {
+		delete(msg.sharedFields, name)
+	}
+}
+
+// sharedSubmessage wraps the value of a field that sharesField() reports
+// as shared, returning false if it can't be wrapped without first making
+// msg private. Only singular message fields are wrapped lazily; repeated
+// fields, maps, and oneofs are copied when they're first accessed.
+func (f *structFields) sharedSubmessage(msg *skyProtoMessage, field *proto.Properties) (starlark.Value, bool) {
+	if _, isOneof := f.oneofs[field.OrigName]; isOneof {
+		return nil, false
+	}
+	val := f.val.FieldByName(field.Name)
+	switch val.Kind() {
+	case reflect.Ptr:
+		if val.IsNil() || val.Elem().Kind() != reflect.Struct {
+			return valueToStarlark(val), true
+		}
+		sub, ok := val.Interface().(proto.Message)
+		if !ok {
+			return nil, false
+		}
+		wrapper := NewSkyProtoMessage(sub)
+		wrapper.cow = &cowRef{parent: msg, field: field}
+		wrapper.shareSubmessages = msg.shareSubmessages
+		return wrapper, true
+	case reflect.Slice:
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			return valueToStarlark(val), true
+		}
+		return nil, false
+	case reflect.Map, reflect.Struct, reflect.Interface:
+		return nil, false
+	}
+	return valueToStarlark(val), true
+}
+
+// unshare replaces a shared message with a private copy, along with any
+// shared messages it was accessed through, so that it can be modified.
+func (msg *skyProtoMessage) unshare() {
+	if msg.cow == nil {
+		return
+	}
+	root := msg
+	for root.cow.parent != nil && root.cow.parent.cow != nil {
+		root = root.cow.parent
+	}
+	clone := proto.Clone(root.msg)
+	if parent := root.cow.parent; parent != nil {
+		parent.fields.(*structFields).val.FieldByName(root.cow.field.Name).Set(reflect.ValueOf(clone))
+		parent.setShared(root.cow.field.OrigName, false)
+	}
+	root.rebind(clone)
+}
+
+// rebind points a wrapper at a private copy of its message, and the cached
+// wrappers of its shared submessages at the corresponding parts of it.
+func (msg *skyProtoMessage) rebind(private proto.Message) {
+	msg.attrMu.Lock()
+	msg.msg = private
+	msg.fields.rebind(private)
+	msg.cow = nil
+	var subs []*skyProtoMessage
+	for _, attr := range msg.attrCache {
+		if sub, ok := attr.(*skyProtoMessage); ok && sub.cow != nil && sub.cow.parent == msg {
+			subs = append(subs, sub)
+		}
+	}
+	msg.attrMu.Unlock()
+	for _, sub := range subs {
+		sub.rebind(msg.fields.(*structFields).val.FieldByName(sub.cow.field.Name).Interface().(proto.Message))
+	}
+}
+
+// evict drops the cached wrapper of a field that's about to be changed. A
+// wrapper of a shared submessage is detached, so that it no longer refers
+// to the field, as if it had been copied.
+func (msg *skyProtoMessage) evict(name string) {
+	msg.attrMu.Lock()
+	attr := msg.attrCache[name]
+	delete(msg.attrCache, name)
+	msg.attrMu.Unlock()
+	if sub, ok := attr.(*skyProtoMessage); ok && sub.cow != nil {
+		sub.cow.parent = nil
+	}
+}
+
+// copySharedFields replaces the shared submessages in dst, a shallow copy
+// of msg, with private copies. Otherwise they could be modified through
+// the copy, which doesn't know that they're shared.
+func (msg *skyProtoMessage) copySharedFields(dst reflect.Value) {
+	for name := range msg.sharedFields {
+		val := dst.FieldByName(msg.fields.(*structFields).prop(name).Name)
+		val.Set(reflect.ValueOf(proto.Clone(val.Interface().(proto.Message))))
+	}
+}
+
+// dropSharedFields forgets which fields of msg hold shared submessages,
+// before an operation that replaces every field without modifying their
+// previous values.
+func (msg *skyProtoMessage) dropSharedFields() {
+	for name := range msg.sharedFields {
+		msg.evict(name)
+	}
+	msg.sharedFields = nil
+}
+
+// unshareFields replaces each shared submessage of msg with a private
+// copy, before an operation that may modify submessages in place.
+func (msg *skyProtoMessage) unshareFields() {
+	for name := range msg.sharedFields {
+		msg.evict(name)
+		f := msg.fields.(*structFields)
+		val := f.val.FieldByName(f.prop(name).Name)
+		val.Set(reflect.ValueOf(proto.Clone(val.Interface().(proto.Message))))
+	}
+	msg.sharedFields = nil
+}
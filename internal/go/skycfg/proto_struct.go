@@ -0,0 +1,691 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	dpb "github.com/golang/protobuf/ptypes/duration"
+	"go.starlark.net/starlark"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/runtime/protoimpl"
+)
+
+// structFields accesses the fields of a generated message struct through Go
+// reflection, for messages that don't implement the protobuf APIv2
+// reflection interface.
+type structFields struct {
+	msg    proto.Message
+	val    reflect.Value
+	props  []*proto.Properties
+	oneofs map[string]*proto.OneofProperties
+}
+
+func newStructFields(msg proto.Message) *structFields {
+	f := &structFields{
+		msg:    msg,
+		val:    reflect.ValueOf(msg).Elem(),
+		oneofs: make(map[string]*proto.OneofProperties),
+	}
+	protoProps := protoGetProperties(f.val.Type())
+	for _, prop := range protoProps.Prop {
+		if prop.Tag == 0 {
+			// Skip attributes that don't correspond to a protobuf field.
+			continue
+		}
+		f.props = append(f.props, prop)
+	}
+	for fieldName, prop := range protoProps.OneofTypes {
+		f.props = append(f.props, prop.Prop)
+		f.oneofs[fieldName] = prop
+	}
+	return f
+}
+
+func (f *structFields) rebind(msg proto.Message) {
+	f.msg = msg
+	f.val = reflect.ValueOf(msg).Elem()
+}
+
+// prop returns the properties of a field, or nil if there's no such field.
+func (f *structFields) prop(name string) *proto.Properties {
+	for _, prop := range f.props {
+		if prop.OrigName == name {
+			return prop
+		}
+	}
+	return nil
+}
+
+func (f *structFields) names() []string {
+	names := make([]string, 0, len(f.props))
+	for _, prop := range f.props {
+		names = append(names, prop.OrigName)
+	}
+	return names
+}
+
+// descriptor looks up a field's descriptor by its number. Messages
+// generated by gogo-protobuf embed their file descriptors, from which the
+// protobuf runtime builds a descriptor of the message.
+func (f *structFields) descriptor(name string) protoreflect.FieldDescriptor {
+	prop := f.prop(name)
+	if prop == nil {
+		return nil
+	}
+	return protoimpl.X.MessageDescriptorOf(f.msg).Fields().ByNumber(protoreflect.FieldNumber(prop.Tag))
+}
+
+func (f *structFields) get(msg *skyProtoMessage, name string) starlark.Value {
+	prop := f.prop(name)
+	if msg.sharesField(name) {
+		if shared, ok := f.sharedSubmessage(msg, prop); ok {
+			return shared
+		}
+		if !msg.frozen {
+			// The field's value may be modified through its wrapper, so
+			// msg must be made private first.
+			msg.attrMu.Unlock()
+			msg.unshare()
+			msg.attrMu.Lock()
+		}
+	}
+	if oneofProp, isOneof := f.oneofs[name]; isOneof {
+		return f.getOneofField(oneofProp)
+	}
+	return valueToStarlark(f.val.FieldByName(prop.Name))
+}
+
+func (f *structFields) getOneofField(prop *proto.OneofProperties) starlark.Value {
+	ifaceField := f.val.Field(prop.Field)
+	if ifaceField.IsNil() {
+		return starlark.None
+	}
+	if ifaceField.Elem().Type() == prop.Type {
+		return valueToStarlark(ifaceField.Elem().Elem().Field(0))
+	}
+	return starlark.None
+}
+
+func (f *structFields) set(msg *skyProtoMessage, name string, sky starlark.Value) error {
+	if oneofProp, isOneof := f.oneofs[name]; isOneof {
+		return f.setOneofField(msg, name, oneofProp, sky)
+	}
+	return f.setSingleField(msg, f.prop(name), sky)
+}
+
+func (f *structFields) setOneofField(msg *skyProtoMessage, name string, prop *proto.OneofProperties, sky starlark.Value) error {
+	field, ok := prop.Type.Elem().FieldByName(prop.Prop.Name)
+	if !ok {
+		return fmt.Errorf("InternalError: field %q not found in generated type %v", name, prop.Type)
+	}
+	val, err := valueFromStarlark(field.Type, sky)
+	if err != nil {
+		return err
+	}
+	if err := msg.checkMutable("set field of"); err != nil {
+		return err
+	}
+
+	// Oneofs are stored in a two-part format, where `f.val` has a field of an intermediate interface
+	// type that can be constructed from the property type.
+	ifaceField := f.val.Field(prop.Field)
+
+	// Construct the intermediate per-field struct.
+	box := reflect.New(prop.Type.Elem())
+	box.Elem().Field(0).Set(val)
+
+	msg.evict(name)
+	ifaceField.Set(box)
+	return nil
+}
+
+func (f *structFields) setSingleField(msg *skyProtoMessage, prop *proto.Properties, sky starlark.Value) error {
+	field, ok := f.val.Type().FieldByName(prop.Name)
+	if !ok {
+		return fmt.Errorf("InternalError: field %q not found in generated type %v", prop.OrigName, f.val.Type())
+	}
+
+	var val reflect.Value
+	var shared bool
+	if msg.shareSubmessages {
+		val, shared = sharedMessage(field.Type, sky)
+	}
+	if !shared {
+		var err error
+		if val, err = valueFromStarlark(field.Type, sky); err != nil {
+			return err
+		}
+	}
+	if err := msg.checkMutable("set field of"); err != nil {
+		return err
+	}
+	msg.evict(prop.OrigName)
+	f.val.FieldByName(prop.Name).Set(val)
+	msg.setShared(prop.OrigName, shared)
+	return nil
+}
+
+func (f *structFields) clear(msg *skyProtoMessage, name string) {
+	msg.evict(name)
+	msg.setShared(name, false)
+	if oneofProp, isOneof := f.oneofs[name]; isOneof {
+		ifaceField := f.val.Field(oneofProp.Field)
+		if !ifaceField.IsNil() && ifaceField.Elem().Type() == oneofProp.Type {
+			ifaceField.Set(reflect.Zero(ifaceField.Type()))
+		}
+		return
+	}
+	field := f.val.FieldByName(f.prop(name).Name)
+	field.Set(reflect.Zero(field.Type()))
+}
+
+// has reports whether a field is set if it tracks presence, which fields
+// do if they're stored as pointers (submessages, proto2 scalars, and
+// proto3 `optional` scalars) or are members of a oneof.
+func (f *structFields) has(name string) (isSet, ok bool) {
+	if oneofProp, isOneof := f.oneofs[name]; isOneof {
+		ifaceField := f.val.Field(oneofProp.Field)
+		return !ifaceField.IsNil() && ifaceField.Elem().Type() == oneofProp.Type, true
+	}
+	field := f.val.FieldByName(f.prop(name).Name)
+	if field.Kind() != reflect.Ptr {
+		return false, false
+	}
+	return !field.IsNil(), true
+}
+
+func (f *structFields) isSet(name string) bool {
+	if _, isOneof := f.oneofs[name]; isOneof {
+		isSet, _ := f.has(name)
+		return isSet
+	}
+	field := f.val.FieldByName(f.prop(name).Name)
+	switch field.Kind() {
+	case reflect.Ptr:
+		return !field.IsNil()
+	case reflect.Slice, reflect.Map:
+		return field.Len() > 0
+	}
+	return !reflect.DeepEqual(field.Interface(), reflect.Zero(field.Type()).Interface())
+}
+
+func (f *structFields) whichOneof(oneof string) (string, bool) {
+	typ := f.val.Type()
+	for ii := 0; ii < typ.NumField(); ii++ {
+		if typ.Field(ii).Tag.Get("protobuf_oneof") == oneof {
+			return f.oneofMember(ii), true
+		}
+	}
+	return "", false
+}
+
+// oneofMember returns the name of the field that's set in the oneof
+// stored in a struct field, or "" if none is.
+func (f *structFields) oneofMember(structField int) string {
+	iface := f.val.Field(structField)
+	if iface.IsNil() {
+		return ""
+	}
+	for name, prop := range f.oneofs {
+		if prop.Field == structField && iface.Elem().Type() == prop.Type {
+			return name
+		}
+	}
+	return ""
+}
+
+func (f *structFields) oneofOf(name string) (oneof, current string, ok bool) {
+	prop, ok := f.oneofs[name]
+	if !ok {
+		return "", "", false
+	}
+	oneof = f.val.Type().Field(prop.Field).Tag.Get("protobuf_oneof")
+	return oneof, f.oneofMember(prop.Field), true
+}
+
+// fieldType returns the Go type of a field's value. For oneof members, this
+// is the type of the value stored in the oneof wrapper struct.
+func (f *structFields) fieldType(name string) (reflect.Type, bool) {
+	if prop, isOneof := f.oneofs[name]; isOneof {
+		field, ok := prop.Type.Elem().FieldByName(prop.Prop.Name)
+		return field.Type, ok
+	}
+	if prop := f.prop(name); prop != nil {
+		field, ok := f.val.Type().FieldByName(prop.Name)
+		return field.Type, ok
+	}
+	return nil, false
+}
+
+func valueToStarlark(val reflect.Value) starlark.Value {
+	if scalar := scalarToStarlark(val); scalar != nil {
+		return scalar
+	}
+	iface := val.Interface()
+	if msg, ok := iface.(proto.Message); ok {
+		if m, ok := msg.(protoreflect.ProtoMessage); ok {
+			if sky, ok := wellKnownToStarlark(m.ProtoReflect()); ok {
+				return sky
+			}
+		}
+		return NewSkyProtoMessage(msg)
+	}
+	t := val.Type()
+	if t.Kind() == reflect.Struct {
+		// Might have been generated by gogo-protobuf
+		//
+		// Need to check if this is a non-pointer map value, which
+		// cannot be addressed and therefore can never become a
+		// `proto.Message`.
+		if val.CanAddr() {
+			if msg, ok := val.Addr().Interface().(proto.Message); ok {
+				return NewSkyProtoMessage(msg)
+			}
+		}
+	}
+	// Handle []byte ([]uint8) -> string special case.
+	if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+		return starlark.String(string(val.Interface().([]byte)))
+	}
+	if t.Kind() == reflect.Slice {
+		return newProtoRepeated(sliceField{val})
+	}
+	if t.Kind() == reflect.Map {
+		items := make([]starlark.Tuple, 0, val.Len())
+		for _, keyVal := range val.MapKeys() {
+			items = append(items, starlark.Tuple{valueToStarlark(keyVal), valueToStarlark(val.MapIndex(keyVal))})
+		}
+		return newProtoMap(goMapField{val}, items)
+	}
+	// This should be impossible, because the set of types present
+	// in a generated protobuf struct is small and limited.
+	panic(fmt.Errorf("valueToStarlark: unknown type %v", val.Type()))
+}
+
+func scalarToStarlark(val reflect.Value) starlark.Value {
+	if val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return starlark.None
+		}
+		val = val.Elem()
+	}
+	iface := val.Interface()
+	switch f := iface.(type) {
+	case int32:
+		return starlark.MakeInt64(int64(f))
+	case int64:
+		return starlark.MakeInt64(f)
+	case uint32:
+		return starlark.MakeUint64(uint64(f))
+	case uint64:
+		return starlark.MakeUint64(f)
+	case float32:
+		return starlark.Float(f)
+	case float64:
+		return starlark.Float(f)
+	case string:
+		return starlark.String(f)
+	case bool:
+		return starlark.Bool(f)
+	case time.Duration:
+		return NewSkyProtoMessage(ptypes.DurationProto(f))
+	}
+	if enum, ok := iface.(protoEnum); ok {
+		return &skyProtoEnumValue{
+			typeName:  enumTypeName(enum),
+			valueName: enum.String(),
+			value:     val.Convert(reflect.TypeOf(int32(0))).Interface().(int32),
+		}
+	}
+	return nil
+}
+
+func valueFromStarlark(t reflect.Type, sky starlark.Value) (reflect.Value, error) {
+	if val, ok, err := wellKnownGoFromStarlark(t, sky); ok {
+		return val, err
+	}
+	switch sky := sky.(type) {
+	case starlark.Int, starlark.Float, starlark.String, starlark.Bool:
+		if s, ok := sky.(starlark.String); ok && t == reflect.TypeOf(time.Duration(0)) {
+			d, err := time.ParseDuration(string(s))
+			if err != nil {
+				return reflect.Value{}, newConversionError(t, sky, "ValueError: value %s can't be converted to `time.Duration': %v", sky.String(), err)
+			}
+			return reflect.ValueOf(d), nil
+		}
+		scalar, err := scalarFromStarlark(t, sky)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+
+		// Handle the use of typedefs in Kubernetes and "string" ->
+		// "bytes" conversion.
+		if scalarType := scalar.Type(); !scalarType.AssignableTo(t) {
+			if scalarType.Kind() != reflect.String || !scalarType.ConvertibleTo(t) {
+				return reflect.Value{}, typeError(t, sky)
+			}
+			scalar = scalar.Convert(t)
+		}
+		return scalar, nil
+	case starlark.NoneType:
+		if t.Kind() == reflect.Ptr {
+			return reflect.Zero(t), nil
+		}
+		// Give a better error message for true type mismatch, instead of
+		// "pointer or non-pointer" caused by Go's different representation
+		// of proto3 messages.
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Map {
+			return reflect.Value{}, typeError(t, sky)
+		}
+		return reflect.Value{}, newConversionError(t, sky, "TypeError: value None can't be assigned to type `%s' in proto3 mode.", t)
+	case *skyProtoEnumValue:
+		return enumFromStarlark(t, sky)
+	case *skyProtoMessage:
+		if _, isV2 := sky.msg.(protoreflect.ProtoMessage); isV2 && reflect.TypeOf(sky.msg) == t {
+			// APIv2 messages can't be copied by value.
+			return reflect.ValueOf(proto.Clone(sky.msg)), nil
+		}
+		if sky.frozen && (reflect.TypeOf(sky.msg) == t || reflect.TypeOf(sky.msg) == reflect.PtrTo(t)) {
+			// A shallow copy would let the frozen message's submessages
+			// be modified through the copy.
+			val := reflect.ValueOf(proto.Clone(sky.msg))
+			if t.Kind() != reflect.Ptr {
+				val = val.Elem()
+			}
+			return val, nil
+		}
+		if reflect.TypeOf(sky.msg) == t {
+			val := reflect.New(t.Elem())
+			val.Elem().Set(reflect.ValueOf(sky.msg).Elem())
+			sky.copySharedFields(val.Elem())
+			return val, nil
+		}
+		if reflect.TypeOf(sky.msg) == reflect.PtrTo(t) {
+			val := reflect.New(t)
+			val.Elem().Set(reflect.ValueOf(sky.msg).Elem())
+			sky.copySharedFields(val.Elem())
+			return val.Elem(), nil
+		}
+
+		dpb, ok := sky.msg.(*dpb.Duration)
+		if ok && t == reflect.TypeOf(time.Duration(0)) {
+			d, err := ptypes.Duration(dpb)
+			if err != nil {
+				return reflect.Value{}, newConversionError(t, sky, "ValueError: %v (type `%s') can't be coverted to `time.Duration': %v", dpb, reflect.TypeOf(dpb), err)
+			}
+
+			return reflect.ValueOf(d), nil
+		}
+	case *protoRepeated:
+		return valueFromStarlark(t, sky.elements())
+	case *starlark.List:
+		if t.Kind() == reflect.Slice {
+			elemType := t.Elem()
+			val := reflect.MakeSlice(t, sky.Len(), sky.Len())
+			for ii := 0; ii < sky.Len(); ii++ {
+				elem, err := valueFromStarlark(elemType, sky.Index(ii))
+				if err != nil {
+					return reflect.Value{}, withIndex(err, fmt.Sprint(ii))
+				}
+				val.Index(ii).Set(elem)
+			}
+			return val, nil
+		}
+	case *protoMap:
+		return valueFromStarlark(t, sky.dict)
+	case *starlark.Dict:
+		if t.Kind() == reflect.Map {
+			keyType := t.Key()
+			elemType := t.Elem()
+			val := reflect.MakeMapWithSize(t, sky.Len())
+			for _, item := range sky.Items() {
+				key, err := valueFromStarlark(keyType, item[0])
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				elem, err := valueFromStarlark(elemType, item[1])
+				if err != nil {
+					return reflect.Value{}, withIndex(err, item[0].String())
+				}
+				val.SetMapIndex(key, elem)
+			}
+			return val, nil
+		}
+	}
+	return reflect.Value{}, typeError(t, sky)
+}
+
+func scalarFromStarlark(t reflect.Type, sky starlark.Value) (reflect.Value, error) {
+	k := t.Kind()
+	// Handling special case of Starlark string to []byte (aka []uint8 aka
+	// proto "bytes") assigment.
+	if k == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+		val, ok := sky.(starlark.String)
+		if !ok {
+			return reflect.Value{}, typeError(t, sky)
+		}
+		return reflect.ValueOf([]byte(val)), nil
+	}
+
+	switch k {
+	case reflect.Ptr:
+		val := reflect.New(t.Elem())
+		elem, err := scalarFromStarlark(t.Elem(), sky)
+		if err != nil {
+			// Recompute the type error based on the pointer type.
+			return reflect.Value{}, typeError(t, sky)
+		}
+		if !elem.Type().AssignableTo(t.Elem()) {
+			// Such as an int for a proto2 enum field, whose type is
+			// named by the element type.
+			return reflect.Value{}, typeError(t.Elem(), sky)
+		}
+		val.Elem().Set(elem)
+		return val, nil
+	case reflect.Bool:
+		if val, ok := sky.(starlark.Bool); ok {
+			return reflect.ValueOf(bool(val)), nil
+		}
+	case reflect.String:
+		if val, ok := sky.(starlark.String); ok {
+			return reflect.ValueOf(string(val)), nil
+		}
+	case reflect.Float64:
+		if val, ok := starlark.AsFloat(sky); ok {
+			return reflect.ValueOf(val), nil
+		}
+	case reflect.Float32:
+		if val, ok := starlark.AsFloat(sky); ok {
+			return reflect.ValueOf(float32(val)), nil
+		}
+	case reflect.Int64:
+		if skyInt, ok := sky.(starlark.Int); ok {
+			if val, ok := skyInt.Int64(); ok {
+				return reflect.ValueOf(val), nil
+			}
+			return reflect.Value{}, newConversionError(t, sky, "ValueError: value %v overflows type `int64'.", skyInt)
+		}
+	case reflect.Uint64:
+		if skyInt, ok := sky.(starlark.Int); ok {
+			if val, ok := skyInt.Uint64(); ok {
+				return reflect.ValueOf(val), nil
+			}
+			return reflect.Value{}, newConversionError(t, sky, "ValueError: value %v overflows type `uint64'.", skyInt)
+		}
+	case reflect.Int32:
+		if skyInt, ok := sky.(starlark.Int); ok {
+			if val, ok := skyInt.Int64(); ok && val >= math.MinInt32 && val <= math.MaxInt32 {
+				return reflect.ValueOf(int32(val)), nil
+			}
+			return reflect.Value{}, newConversionError(t, sky, "ValueError: value %v overflows type `int32'.", skyInt)
+		}
+	case reflect.Uint32:
+		if skyInt, ok := sky.(starlark.Int); ok {
+			if val, ok := skyInt.Uint64(); ok && val <= math.MaxUint32 {
+				return reflect.ValueOf(uint32(val)), nil
+			}
+			return reflect.Value{}, newConversionError(t, sky, "ValueError: value %v overflows type `uint32'.", skyInt)
+		}
+	}
+	return reflect.Value{}, typeError(t, sky)
+}
+
+func enumFromStarlark(t reflect.Type, sky *skyProtoEnumValue) (reflect.Value, error) {
+	if t.Kind() == reflect.Ptr {
+		val := reflect.New(t.Elem())
+		elem, err := enumFromStarlark(t.Elem(), sky)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		val.Elem().Set(elem)
+		return val, nil
+	}
+	if t.Kind() == reflect.Int32 {
+		if enum, ok := reflect.Zero(t).Interface().(protoEnum); ok {
+			if enumTypeName(enum) == sky.typeName {
+				return reflect.ValueOf(sky.value).Convert(t), nil
+			}
+		}
+	}
+	return reflect.Value{}, typeError(t, sky)
+}
+
+func typeName(t reflect.Type) string {
+	// Special-case protobuf types to get more useful error messages when
+	// the wrong protobuf type is assigned.
+	messageType := reflect.TypeOf((*proto.Message)(nil)).Elem()
+	if t.Implements(messageType) {
+		return messageTypeName(reflect.Zero(t).Interface().(proto.Message))
+	}
+	enumType := reflect.TypeOf((*protoEnum)(nil)).Elem()
+	if t.Implements(enumType) {
+		return enumTypeName(reflect.Zero(t).Interface().(protoEnum))
+	}
+	if t.PkgPath() == "" {
+		return t.String()
+	}
+	return fmt.Sprintf("%q.%s", t.PkgPath(), t.Name())
+}
+
+func typeError(t reflect.Type, sky starlark.Value) error {
+	elemType := t
+	if elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	if enum, ok := reflect.Zero(elemType).Interface().(protoEnum); ok {
+		if err := enumRangeError(protoimpl.X.EnumDescriptorOf(enum), sky); err != "" {
+			return newConversionError(t, sky, "%s", err)
+		}
+	}
+	return newConversionError(t, sky, "TypeError: value %s (type `%s') can't be assigned to type `%s'.", sky.String(), sky.Type(), typeName(t))
+}
+
+// A sliceField is a repeated field of a generated message struct.
+type sliceField struct {
+	// var x []T; reflect.ValueOf(x)
+	val reflect.Value
+}
+
+func (f sliceField) elemTypeName() string { return typeName(f.val.Type().Elem()) }
+
+func (f sliceField) convert(v starlark.Value) (interface{}, error) {
+	itemType := f.val.Type().Elem()
+	if v == starlark.None {
+		return nil, typeError(itemType, v)
+	}
+	return valueFromStarlark(itemType, v)
+}
+
+func (f sliceField) elemToStarlark(val interface{}) starlark.Value {
+	return valueToStarlark(val.(reflect.Value))
+}
+
+func (f sliceField) len() int                 { return f.val.Len() }
+func (f sliceField) get(i int) starlark.Value { return valueToStarlark(f.val.Index(i)) }
+
+func (f sliceField) append(vals ...interface{}) {
+	for _, val := range vals {
+		f.val.Set(reflect.Append(f.val, val.(reflect.Value)))
+	}
+}
+
+func (f sliceField) insert(i int, val interface{}) {
+	n := f.val.Len()
+	f.val.Set(reflect.Append(f.val, reflect.Zero(f.val.Type().Elem())))
+	reflect.Copy(f.val.Slice(i+1, n+1), f.val.Slice(i, n))
+	f.val.Index(i).Set(val.(reflect.Value))
+}
+
+func (f sliceField) delete(i int) {
+	n := f.val.Len()
+	reflect.Copy(f.val.Slice(i, n-1), f.val.Slice(i+1, n))
+	// Clear the removed element, so that the slice's backing array doesn't
+	// keep it alive.
+	f.val.Index(n - 1).Set(reflect.Zero(f.val.Type().Elem()))
+	f.val.SetLen(n - 1)
+}
+
+func (f sliceField) set(i int, val interface{}) { f.val.Index(i).Set(val.(reflect.Value)) }
+func (f sliceField) clear()                     { f.val.SetLen(0) }
+
+// A goMapField is a map field of a generated message struct.
+type goMapField struct {
+	val reflect.Value
+}
+
+func (f goMapField) keyTypeName() string  { return typeName(f.val.Type().Key()) }
+func (f goMapField) elemTypeName() string { return typeName(f.val.Type().Elem()) }
+
+func (f goMapField) convertKey(k starlark.Value) (interface{}, error) {
+	return f.convert(f.val.Type().Key(), k)
+}
+
+func (f goMapField) convertElem(v starlark.Value) (interface{}, error) {
+	return f.convert(f.val.Type().Elem(), v)
+}
+
+func (f goMapField) convert(t reflect.Type, sky starlark.Value) (interface{}, error) {
+	if sky == starlark.None {
+		return nil, typeError(t, sky)
+	}
+	return valueFromStarlark(t, sky)
+}
+
+func (f goMapField) elemToStarlark(v interface{}) starlark.Value {
+	return valueToStarlark(v.(reflect.Value))
+}
+
+func (f goMapField) set(k, v interface{}) {
+	if f.val.IsNil() {
+		f.val.Set(reflect.MakeMap(f.val.Type()))
+	}
+	f.val.SetMapIndex(k.(reflect.Value), v.(reflect.Value))
+}
+
+func (f goMapField) delete(k interface{}) {
+	if !f.val.IsNil() {
+		f.val.SetMapIndex(k.(reflect.Value), reflect.Value{})
+	}
+}
+
+func (f goMapField) clear() { f.val.Set(reflect.MakeMap(f.val.Type())) }
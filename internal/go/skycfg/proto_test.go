@@ -30,6 +30,12 @@ import (
 	"github.com/kylelemons/godebug/pretty"
 	"go.starlark.net/resolve"
 	"go.starlark.net/starlark"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	_ "github.com/gogo/protobuf/types"
 
@@ -127,6 +133,275 @@ func TestProtoClearV2(t *testing.T) {
 	}
 }
 
+func TestProtoClearFields(t *testing.T) {
+	globals := starlark.StringDict{
+		"proto": NewProtoModule(nil),
+		"template": NewSkyProtoMessage(&pb.MessageV3{
+			FString: "some string",
+			FInt32:  123,
+			FSubmsg: &pb.MessageV3{FString: "nested"},
+			FOneof:  &pb.MessageV3_FOneofA{FOneofA: "a"},
+			RString: []string{"a", "b"},
+		}),
+	}
+	globals["template"].Freeze()
+
+	val, err := starlark.Eval(&starlark.Thread{}, "", `proto.clear(template, "f_string", "f_submsg", "f_oneof_a", "r_string")`, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotMsg := val.(*skyProtoMessage).msg
+	wantMsg := &pb.MessageV3{FInt32: 123}
+	if diff := ProtoDiff(wantMsg, gotMsg); diff != "" {
+		t.Fatalf("diff from expected message:\n%s", diff)
+	}
+	if template := globals["template"].(*skyProtoMessage).msg.(*pb.MessageV3); template.FString != "some string" {
+		t.Errorf("expected original message to be unchanged, got %v", template)
+	}
+
+	msg, err := starlark.Eval(&starlark.Thread{}, "", `proto.clone(template)`, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	globals["msg"] = msg
+	val, err = starlark.Eval(&starlark.Thread{}, "", `proto.clear(msg, "f_string")`, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val == msg {
+		t.Errorf("expected proto.clear() to return a copy of the message")
+	}
+	if got := msg.(*skyProtoMessage).msg.(*pb.MessageV3); got.FString != "some string" {
+		t.Errorf("expected mutable message to be unchanged, got %v", got)
+	}
+
+	_, err = starlark.Eval(&starlark.Thread{}, "", `proto.clear(msg, "no_such_field")`, globals)
+	if err == nil || !strings.Contains(err.Error(), `has no field "no_such_field"`) {
+		t.Errorf("expected error clearing unknown field, got %v", err)
+	}
+}
+
+func TestProtoDefault(t *testing.T) {
+	globals := starlark.StringDict{"proto": NewProtoModule(nil)}
+	src := `
+pb = proto.package("skycfg.test_proto")
+default = proto.default(pb.MessageV3)
+msg = pb.MessageV3(f_int32 = 0, f_string = "x")
+results = [
+	proto.equal(msg, default),
+	proto.equal(proto.clear(msg, "f_string"), default),
+	proto.has(proto.default(pb.MessageV2), "f_string"),
+	proto.clone(default).f_int32,
+]
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, results := `[False, True, False, 0]`, got["results"].String(); results != want {
+		t.Errorf("expected %s, got %s", want, results)
+	}
+
+	globals["default"] = got["default"]
+	globals["pb"] = got["pb"]
+	for src, wantErr := range map[string]string{
+		"proto.default(pb.MessageV3())": "proto.default: for parameter 1: got skycfg.test_proto.MessageV3, want proto.MessageType",
+		"default.f_int32 = 1":           "frozen",
+	} {
+		_, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("exec(%q): expected error %q, got %v", src, wantErr, err)
+		}
+	}
+}
+
+func TestProtoPath(t *testing.T) {
+	globals := starlark.StringDict{"proto": NewProtoModule(nil)}
+	src := `
+pb = proto.package("skycfg.test_proto")
+msg = pb.MessageV3(r_submsg = [pb.MessageV3()])
+proto.set_path(msg, "f_submsg.f_submsg.f_string", "deep")
+proto.set_path(msg, "f_submsg.map_string.app", "web")
+proto.set_path(msg, 'map_submsg["a-b"].map_string["app.kubernetes.io/name"]', "db")
+proto.set_path(msg, "r_submsg[-1].f_int32", 3)
+results = [
+	msg.f_submsg.f_submsg.f_string,
+	proto.get_path(msg, "f_submsg.map_string.app"),
+	proto.get_path(msg, 'map_submsg["a-b"].map_string["app.kubernetes.io/name"]'),
+	proto.get_path(msg, "r_submsg[0].f_int32"),
+	proto.get_path(msg, "f_submsg.f_submsg.f_submsg.f_string", "unset"),
+	proto.get_path(msg, "map_submsg.missing.f_string"),
+	proto.get_path(msg, "r_submsg[1].f_int32", -1),
+]
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, results := `["deep", "web", "db", 3, "unset", None, -1]`, got["results"].String(); results != want {
+		t.Errorf("expected %s, got %s", want, results)
+	}
+
+	globals["msg"] = got["msg"]
+	for src, wantErr := range map[string]string{
+		`proto.set_path(msg, "f_submsg.f_nope.f_string", "x")`: `f_submsg.f_nope: ` + "`skycfg.test_proto.MessageV3'" + ` value has no field "f_nope"`,
+		`proto.set_path(msg, "f_submsg.f_int32", "x")`:         "TypeError: value \"x\" (type `string') can't be assigned to type `int32'.",
+		`proto.set_path(msg, "r_submsg[5].f_int32", 1)`:        "r_submsg[5] is not set",
+		`proto.set_path(msg, "r_submsg.f_int32", 1)`:           "repeated field must be indexed with [N]",
+		`proto.set_path(msg, "f_string.x", 1)`:                 "f_string is a string, not a message, map, or list",
+		`proto.get_path(msg, "f_submsg[")`:                     `invalid path "f_submsg["`,
+		`proto.get_path(msg, "f_submsg[x]")`:                   `invalid path "f_submsg[x]"`,
+	} {
+		_, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("exec(%q): expected error %q, got %v", src, wantErr, err)
+		}
+	}
+}
+
+// TestProtoDiffKeywords checks diffs of fields named after Starlark
+// keywords.
+func TestProtoDiffKeywords(t *testing.T) {
+	registry, err := NewDescriptorSetRegistry(TestdataDescriptorSet(t, "example/keywords.proto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	globals := starlark.StringDict{"proto": NewProtoModule(registry)}
+	src := `
+kw = proto.package("example.keywords")
+a = kw.Ingress()
+b = kw.Ingress()
+proto.set_path(b, "from", [kw.Peer(cidr = "10.0.0.0/8")])
+results = [[d.path, d.old, d.new] for d in proto.diff(a, b)]
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, results := `[["from", None, [<example.keywords.Peer cidr:"10.0.0.0/8" >]]]`, got["results"].String(); results != want {
+		t.Errorf("expected %s, got %s", want, results)
+	}
+}
+
+// TestProtoPathKeywords checks paths through fields named after Starlark
+// keywords.
+func TestProtoPathKeywords(t *testing.T) {
+	registry, err := NewDescriptorSetRegistry(TestdataDescriptorSet(t, "example/keywords.proto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	globals := starlark.StringDict{"proto": NewProtoModule(registry)}
+	src := `
+kw = proto.package("example.keywords")
+msg = kw.Policy(spec = kw.Spec(ingress = [kw.Ingress()]))
+proto.set_path(msg, "spec.ingress[0].from", [kw.Peer(cidr = "10.0.0.0/8")])
+proto.set_path(msg, 'spec.ingress[0].if["web"].not', True)
+results = [
+	proto.get_path(msg, "spec.ingress[0].from[0].cidr"),
+	proto.get_path(msg, "spec.ingress[0].if['web'].not"),
+]
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, results := `["10.0.0.0/8", True]`, got["results"].String(); results != want {
+		t.Errorf("expected %s, got %s", want, results)
+	}
+
+	globals["msg"] = got["msg"]
+	for _, path := range []string{"spec.", ".spec", "spec..ingress", "spec.ingress[0]from", "spec.ingress[0", `spec.ingress["]"`, "spec.1ingress", "spec ingress"} {
+		src := fmt.Sprintf("proto.get_path(msg, %q)", path)
+		_, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+		if want := fmt.Sprintf("invalid path %q", path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("exec(%q): expected error %q, got %v", src, want, err)
+		}
+	}
+}
+
+func TestProtoDiff(t *testing.T) {
+	globals := starlark.StringDict{"proto": NewProtoModule(nil)}
+	src := `
+pb = proto.package("skycfg.test_proto")
+a = pb.MessageV3(f_int32 = 1, f_string = "a", f_submsg = pb.MessageV3(f_string = "x"))
+b = pb.MessageV3(f_int32 = 2, f_string = "a", f_submsg = pb.MessageV3(f_string = "y"), r_string = ["z"])
+diffs = proto.diff(a, b)
+paths = [d.path for d in diffs]
+first = [diffs[0].old, diffs[0].new]
+added = [diffs[-1].old, diffs[-1].new]
+same = proto.diff(a, proto.clone(a))
+
+def diff_locals():
+  return proto.diff(pb.MessageV3(), pb.MessageV3(r_string = ["z"]))
+local_diffs = diff_locals()
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"paths": `["f_int32", "f_submsg.f_string", "r_string"]`,
+		"first": `[1, 2]`,
+		"added": `[None, ["z"]]`,
+		"same":  `[]`,
+	} {
+		if got := got[name].String(); got != want {
+			t.Errorf("%s: expected %s, got %s", name, want, got)
+		}
+	}
+
+	// The values of diffs in a module's globals are frozen with it, even
+	// when the compared messages aren't.
+	globals["local_diffs"] = got["local_diffs"]
+	if _, err := starlark.ExecFile(&starlark.Thread{}, "", `local_diffs[0].new.append("w")`, globals); err == nil || !strings.Contains(err.Error(), "frozen") {
+		t.Errorf("expected error appending to frozen diff value, got %v", err)
+	}
+
+	globals["a"] = got["a"]
+	for src, wantErr := range map[string]string{
+		`proto.diff(a, 1)`: "proto.diff: for parameter 2: got int, want proto.Message",
+		`proto.diff(a, proto.package("skycfg.test_proto").MessageV2())`: "proto.diff: can't compare a skycfg.test_proto.MessageV3 to a skycfg.test_proto.MessageV2",
+	} {
+		_, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("exec(%q): expected error %q, got %v", src, wantErr, err)
+		}
+	}
+}
+
+func TestProtoPackageDiscovery(t *testing.T) {
+	names := skyEval(t, `dir(proto.package("skycfg.test_proto"))`).(*starlark.List)
+	for _, want := range []string{"MessageV2", "MessageV3", "ToplevelEnumV3"} {
+		found := false
+		for ii := 0; ii < names.Len(); ii++ {
+			found = found || names.Index(ii) == starlark.String(want)
+		}
+		if !found {
+			t.Errorf("expected dir() of package to include %q, got %s", want, names)
+		}
+	}
+	if got := skyEval(t, `dir(gogo_proto.package("skycfg.test_proto"))`).String(); got != "[]" {
+		t.Errorf("expected registries that can't list types to have empty packages, got %s", got)
+	}
+	if got := skyEval(t, `"skycfg.test_proto" in proto.list_packages()`); got != starlark.True {
+		t.Errorf("expected proto.list_packages() to include skycfg.test_proto")
+	}
+	if got := skyEval(t, `proto.message_type("skycfg.test_proto.MessageV3.NestedMessage")`).String(); got != `<proto.MessageType "skycfg.test_proto.MessageV3.NestedMessage">` {
+		t.Errorf("unexpected nested message type %s", got)
+	}
+
+	globals := starlark.StringDict{"proto": NewProtoModule(nil)}
+	for src, wantErr := range map[string]string{
+		`proto.message_type("skycfg.test_proto.ToplevelEnumV3")`: `proto.message_type: "skycfg.test_proto.ToplevelEnumV3" is a proto.EnumType, not a proto.MessageType`,
+		`proto.message_type("skycfg.test_proto.NoSuchType")`:     `proto.message_type: Protobuf type "skycfg.test_proto.NoSuchType" not found`,
+	} {
+		_, err := starlark.Eval(&starlark.Thread{}, "", src, globals)
+		if err == nil || err.Error() != wantErr {
+			t.Errorf("eval(%q): expected error %q, got %v", src, wantErr, err)
+		}
+	}
+}
+
 func TestProtoClearV3(t *testing.T) {
 	val := skyEval(t, `proto.clear(proto.package("skycfg.test_proto").MessageV3(
 		f_string = "some string",
@@ -287,6 +562,33 @@ func TestProtoToJsonFull(t *testing.T) {
 	}
 }
 
+func TestProtoToJsonOptions(t *testing.T) {
+	msg := `proto.package("skycfg.test_proto").MessageV3(
+		f_string = "some string",
+		f_toplevel_enum = proto.package("skycfg.test_proto").ToplevelEnumV3.TOPLEVEL_ENUM_V3_B,
+	)`
+	tests := []struct {
+		kwargs string
+		want   string
+	}{
+		{"", `{"f_string":"some string","f_toplevel_enum":"TOPLEVEL_ENUM_V3_B"}`},
+		{"use_proto_names = False", `{"fString":"some string","fToplevelEnum":"TOPLEVEL_ENUM_V3_B"}`},
+		{"enums_as_ints = True", `{"f_string":"some string","f_toplevel_enum":1}`},
+		{"indent = '  '", "{\n  \"f_string\": \"some string\",\n  \"f_toplevel_enum\": \"TOPLEVEL_ENUM_V3_B\"\n}"},
+	}
+	for _, test := range tests {
+		val := skyEval(t, fmt.Sprintf("proto.to_json(%s, %s)", msg, test.kwargs))
+		if got := string(val.(starlark.String)); got != test.want {
+			t.Errorf("to_json(%s): wanted %q, got %q", test.kwargs, test.want, got)
+		}
+	}
+
+	val := skyEval(t, fmt.Sprintf("proto.to_json(%s, emit_defaults = True)", msg))
+	if got := string(val.(starlark.String)); !strings.Contains(got, `"f_int32":0`) {
+		t.Errorf("to_json(emit_defaults = True): missing default f_int32 in %q", got)
+	}
+}
+
 func TestProtoToYaml(t *testing.T) {
 	val := skyEval(t, `proto.to_yaml(proto.package("skycfg.test_proto").MessageV3(
 		f_string = "some string",
@@ -787,187 +1089,1612 @@ func TestAttrValidation(t *testing.T) {
 	}
 }
 
-func TestListMutation(t *testing.T) {
-	tests := []struct {
-		src     string
-		want    []string
-		wantErr string
-	}{
-		{
-			src:  `msg.r_string.clear()`,
-			want: []string{},
-		},
-		{
-			src:  `msg.r_string.append('d')`,
-			want: []string{"a", "b", "c", "d"},
-		},
-		{
-			src:     `msg.r_string.append(None)`,
-			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `string'.",
-		},
-		{
-			src:     `msg.r_submsg.append(None)`,
-			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `skycfg.test_proto.MessageV2'.",
-		},
-		{
-			src:  `msg.r_string.extend(['d'])`,
-			want: []string{"a", "b", "c", "d"},
-		},
-		{
-			src:     `msg.r_string.extend([None])`,
-			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `string'.",
-		},
-		{
-			src:     `msg.r_submsg.extend([None])`,
-			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `skycfg.test_proto.MessageV2'.",
-		},
+func TestFieldError(t *testing.T) {
+	msg := NewSkyProtoMessage(&pb.MessageV3{
+		FSubmsg: &pb.MessageV3{},
+	})
+	globals := starlark.StringDict{
+		"proto": NewProtoModule(nil),
+		"msg":   msg,
 	}
-	for _, test := range tests {
-		msg := &pb.MessageV2{
-			RString: []string{"a", "b", "c"},
-		}
-		globals := starlark.StringDict{
-			"msg": NewSkyProtoMessage(msg),
-		}
-		_, err := starlark.Eval(&starlark.Thread{}, "", test.src, globals)
-		if test.wantErr != "" {
-			if err == nil {
-				t.Errorf("eval(%q): expected error", test.src)
-			} else if test.wantErr != err.Error() {
-				t.Errorf("eval(%q): expected error %q, got %q", test.src, test.wantErr, err.Error())
-			}
-		} else if err != nil {
-			t.Errorf("eval(%q): %v", test.src, err)
-			continue
-		} else if !reflect.DeepEqual(msg.RString, test.want) {
-			t.Errorf("eval(%q): expected msg.r_string = %v, got %v", test.src, test.want, msg.RString)
-		}
+
+	sub, err := msg.Attr("f_submsg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sub.(*skyProtoMessage).SetField("r_string", starlark.NewList([]starlark.Value{
+		starlark.String("a"),
+		starlark.MakeInt(1),
+	}))
+	fieldErr, ok := err.(*FieldError)
+	if !ok {
+		t.Fatalf("expected *FieldError, got %#v", err)
+	}
+	if fieldErr.MessageType != "skycfg.test_proto.MessageV3" ||
+		fieldErr.Field.Name() != "r_string" ||
+		fieldErr.Path != "f_submsg.r_string[1]" ||
+		fieldErr.ExpectedType != "string" ||
+		fieldErr.ExpectedKind != reflect.String ||
+		fieldErr.Value != starlark.MakeInt(1) {
+		t.Errorf("unexpected field error details: %+v", fieldErr)
+	}
+
+	// Fields of gogo-protobuf messages are described by the descriptors
+	// embedded in their generated code.
+	err = NewSkyProtoMessage(&pb.MessageGogo{}).SetField("f_string", starlark.MakeInt(1))
+	if fieldErr, ok := err.(*FieldError); !ok || fieldErr.Field.Name() != "f_string" || fieldErr.Field.Number() != 7 {
+		t.Errorf("expected *FieldError for f_string, got %#v", err)
 	}
-}
 
-func TestMapMutation(t *testing.T) {
 	tests := []struct {
 		src     string
-		want    map[string]string
 		wantErr string
 	}{
 		{
-			src:  `msg.map_string.clear()`,
-			want: map[string]string{},
-		},
-		{
-			src: `msg.map_string.setdefault('a', 'Z')`,
-			want: map[string]string{
-				"a": "A",
-				"b": "B",
-				"c": "C",
-			},
-		},
-		{
-			src: `msg.map_string.setdefault('d', 'D')`,
-			want: map[string]string{
-				"a": "A",
-				"b": "B",
-				"c": "C",
-				"d": "D",
-			},
-		},
-		{
-			src:     `msg.map_string.setdefault('d', None)`,
-			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `string'.",
-		},
-		{
-			src:     `msg.map_submsg.setdefault('d', None)`,
-			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `skycfg.test_proto.MessageV2'.",
-		},
-		{
-			src: `msg.map_string.update({'a': 'Z', 'd': 'D'})`,
-			want: map[string]string{
-				"a": "Z",
-				"b": "B",
-				"c": "C",
-				"d": "D",
-			},
+			src:     `msg.f_submsg.f_int32 = ""`,
+			wantErr: "TypeError: value \"\" (type `string') can't be assigned to type `int32'. (field f_submsg.f_int32)",
 		},
 		{
-			src:     `msg.map_string.update({'a': None})`,
-			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `string'.",
+			src:     `msg.f_submsg.r_string.append(1)`,
+			wantErr: "TypeError: value 1 (type `int') can't be assigned to type `string'. (field f_submsg.r_string[0])",
 		},
 		{
-			src:     `msg.map_submsg.update({'a': None})`,
-			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `skycfg.test_proto.MessageV2'.",
+			src:     `msg.map_string.update({"a": 1})`,
+			wantErr: "TypeError: value 1 (type `int') can't be assigned to type `string'.",
 		},
 	}
 	for _, test := range tests {
-		msg := &pb.MessageV2{
-			MapString: map[string]string{
-				"a": "A",
-				"b": "B",
-				"c": "C",
-			},
-		}
-		globals := starlark.StringDict{
-			"msg": NewSkyProtoMessage(msg),
-		}
-		_, err := starlark.Eval(&starlark.Thread{}, "", test.src, globals)
-		if test.wantErr != "" {
-			if err == nil {
-				t.Errorf("eval(%q): expected error", test.src)
-			} else if test.wantErr != err.Error() {
-				t.Errorf("eval(%q): expected error %q, got %q", test.src, test.wantErr, err.Error())
-			}
-		} else if err != nil {
-			t.Errorf("eval(%q): %v", test.src, err)
+		_, err := starlark.ExecFile(&starlark.Thread{}, "", test.src, globals)
+		if err == nil {
+			t.Errorf("eval(%q): expected error", test.src)
 			continue
-		} else if !reflect.DeepEqual(msg.MapString, test.want) {
-			t.Errorf("eval(%q): expected msg.r_string = %v, got %v", test.src, test.want, msg.MapString)
+		}
+		if test.wantErr != err.Error() {
+			t.Errorf("eval(%q): expected error %q, got %q", test.src, test.wantErr, err.Error())
 		}
 	}
 }
 
-func TestUnsetProto2Fields(t *testing.T) {
-	// Proto v2 distinguishes between unset and set-to-empty.
-	msg := skyEval(t, `proto.package("skycfg.test_proto").MessageV2(
-		f_string = None,
-	)`)
-	got := msg.String()
-	want := `<skycfg.test_proto.MessageV2 >`
-	if want != got {
-		t.Fatalf("wanted %q, got %q", want, got)
+// optionalV3 mimics the struct generated for a proto3 message with
+// `optional` fields, which track presence like proto2 scalars.
+type optionalV3 struct {
+	FInt32  *int32  `protobuf:"varint,1,opt,name=f_int32,json=fInt32,proto3,oneof" json:"f_int32,omitempty"`
+	FString *string `protobuf:"bytes,2,opt,name=f_string,json=fString,proto3,oneof" json:"f_string,omitempty"`
+}
+
+func (m *optionalV3) Reset()                { *m = optionalV3{} }
+func (m *optionalV3) String() string        { return proto.CompactTextString(m) }
+func (*optionalV3) ProtoMessage()           {}
+func (*optionalV3) XXX_MessageName() string { return "skycfg.test_proto.OptionalV3" }
+
+func TestFieldPresence(t *testing.T) {
+	msg := &optionalV3{}
+	globals := starlark.StringDict{
+		"proto": NewProtoModule(nil),
+		"msg":   NewSkyProtoMessage(msg),
+		"v2":    NewSkyProtoMessage(&pb.MessageV2{}),
+		"v3":    NewSkyProtoMessage(&pb.MessageV3{}),
 	}
+	src := `
+results = []
+results.append(proto.has(msg, "f_int32"))
+results.append(msg.f_int32)
+msg.f_int32 = 0
+results.append(proto.has(msg, "f_int32"))
+results.append(msg.f_int32)
+results.append(proto.to_json(msg))
+msg.f_int32 = None
+results.append(proto.has(msg, "f_int32"))
+results.append(proto.to_json(msg))
 
-	field, err := msg.(starlark.HasAttrs).Attr("f_string")
+v2.f_int32 = 0
+results.append(proto.has(v2, "f_int32"))
+results.append(proto.has(v3, "f_submsg"))
+v3.f_oneof_a = ""
+results.append(proto.has(v3, "f_oneof_a"))
+results.append(proto.has(v3, "f_oneof_b"))
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
 	if err != nil {
-		t.Fatalf(`msg.Attr("f_string"): %v`, err)
+		t.Fatal(err)
 	}
-	if _, isNone := field.(starlark.NoneType); !isNone {
-		t.Fatalf("field set to None should be returned as None")
+	want := `[False, None, True, 0, "{\"f_int32\":0}", False, "{}", True, False, True, False]`
+	if results := got["results"].String(); results != want {
+		t.Errorf("expected %s, got %s", want, results)
 	}
-}
-
-func TestProtoFromText(t *testing.T) {
-	val := skyEval(t, `proto.from_text(proto.package("skycfg.test_proto").MessageV3, "f_int32: 1010").f_int32`)
-	got := val.String()
-	want := "1010"
-	if want != got {
-		t.Fatalf("from_text: wanted %q, got %q", want, got)
+	if msg.FInt32 != nil {
+		t.Errorf("expected f_int32 to be cleared, got %v", *msg.FInt32)
 	}
-}
 
-func TestProtoFromJson(t *testing.T) {
-	val := skyEval(t, `proto.from_json(proto.package("skycfg.test_proto").MessageV3, "{\"f_int32\": 1010}").f_int32`)
-	got := val.String()
-	want := "1010"
-	if want != got {
-		t.Fatalf("from_json: wanted %q, got %q", want, got)
+	_, err = starlark.Eval(&starlark.Thread{}, "", `proto.has(v3, "f_int32")`, globals)
+	if err == nil || !strings.Contains(err.Error(), "doesn't track presence") {
+		t.Errorf("expected error checking presence of a proto3 scalar, got %v", err)
 	}
 }
 
-func TestProtoFromYaml(t *testing.T) {
-	val := skyEval(t, `proto.from_yaml(proto.package("skycfg.test_proto").MessageV3, "f_int32: 1010").f_int32`)
+// TestFieldPresenceDynamic checks proto3 `optional` fields of messages
+// without generated structs, whose presence is tracked by a synthetic oneof.
+func TestFieldPresenceDynamic(t *testing.T) {
+	msg := newTestdataMessage(t, "skycfg/test_proto/optional.proto", "skycfg.test_proto.Optional")
+	globals := starlark.StringDict{
+		"proto": NewProtoModule(nil),
+		"msg":   NewSkyProtoMessage(proto.MessageV1(msg)),
+	}
+	src := `
+results = []
+results.append([msg.replicas, proto.has(msg, "replicas")])
+msg.replicas = 0
+results.append([msg.replicas, proto.has(msg, "replicas"), proto.to_json(msg)])
+cleared = proto.clear(msg, "replicas")
+results.append(proto.has(cleared, "replicas"))
+msg.replicas = None
+results.append([msg.replicas, proto.has(msg, "replicas"), proto.to_json(msg)])
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[[None, False], [0, True, "{\"replicas\":0}"], False, [None, False, "{}"]]`
+	if results := got["results"].String(); results != want {
+		t.Errorf("expected %s, got %s", want, results)
+	}
+
+	for src, wantErr := range map[string]string{
+		`proto.has(msg, "name")`: "doesn't track presence",
+		`msg.name = None`:        "TypeError: value None can't be assigned to type `string' in proto3 mode.",
+	} {
+		_, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("exec(%q): expected error %q, got %v", src, wantErr, err)
+		}
+	}
+}
+
+func TestInOperator(t *testing.T) {
+	globals := starlark.StringDict{
+		"msg": NewSkyProtoMessage(&pb.MessageV3{
+			FInt32:    1,
+			FSubmsg:   &pb.MessageV3{},
+			FOneof:    &pb.MessageV3_FOneofA{FOneofA: ""},
+			RString:   []string{"a"},
+			MapString: map[string]string{"key": "value"},
+		}),
+	}
+	src := `
+results = [
+	"f_int32" in msg,
+	"f_int64" in msg,
+	"f_string" in msg,
+	"f_submsg" in msg,
+	"f_oneof_a" in msg,
+	"f_oneof_b" in msg,
+	"r_string" in msg,
+	"r_submsg" in msg,
+	"key" in msg.map_string,
+	"other" in msg.map_string,
+	"f_submsg" not in msg,
+]
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[True, False, False, True, True, False, True, False, True, False, False]"
+	if results := got["results"].String(); results != want {
+		t.Errorf("expected %s, got %s", want, results)
+	}
+
+	_, err = starlark.Eval(&starlark.Thread{}, "", `"no_such_field" in msg`, globals)
+	if err == nil || !strings.Contains(err.Error(), `has no field "no_such_field"`) {
+		t.Errorf("expected error checking unknown field, got %v", err)
+	}
+}
+
+func TestProtoTypeChecks(t *testing.T) {
+	globals := starlark.StringDict{"proto": NewProtoModule(nil)}
+	src := `
+pb = proto.package("skycfg.test_proto")
+results = [
+	proto.is_instance(pb.MessageV3(), pb.MessageV3),
+	proto.is_instance(pb.MessageV2(), pb.MessageV3),
+	proto.is_instance(pb.MessageV3.NestedMessage(), pb.MessageV3.NestedMessage),
+	proto.is_instance(pb.ToplevelEnumV3.TOPLEVEL_ENUM_V3_B, pb.ToplevelEnumV3),
+	proto.is_instance(pb.ToplevelEnumV3.TOPLEVEL_ENUM_V3_B, pb.ToplevelEnumV2),
+	proto.is_instance("skycfg.test_proto.MessageV3", pb.MessageV3),
+	proto.type_name(pb.MessageV3()),
+	proto.type_name(pb.MessageV3.NestedMessage),
+	proto.type_name(pb.MessageV3.NestedEnum.NESTED_ENUM_B),
+]
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[True, False, True, True, False, False, "skycfg.test_proto.MessageV3", "skycfg.test_proto.MessageV3.NestedMessage", "skycfg.test_proto.MessageV3.NestedEnum"]`
+	if results := got["results"].String(); results != want {
+		t.Errorf("expected %s, got %s", want, results)
+	}
+
+	errs := map[string]string{
+		`proto.is_instance(1, "skycfg.test_proto.MessageV3")`: "proto.is_instance: for parameter 2: got string, want proto.MessageType or proto.EnumType",
+		`proto.type_name("skycfg.test_proto.MessageV3")`:      "proto.type_name: for parameter 1: got string, want proto.Message or proto.MessageType",
+	}
+	for src, wantErr := range errs {
+		_, err := starlark.Eval(&starlark.Thread{}, "", src, globals)
+		if err == nil || err.Error() != wantErr {
+			t.Errorf("eval(%q): expected error %q, got %v", src, wantErr, err)
+		}
+	}
+}
+
+func TestProtoAny(t *testing.T) {
+	globals := starlark.StringDict{"proto": NewProtoModule(nil)}
+	src := `
+pb = proto.package("skycfg.test_proto")
+packed = proto.pack_any(pb.MessageV3(f_string = "some string", r_string = ["a", "b"]))
+unpacked = proto.unpack_any(packed, pb.MessageV3)
+results = [
+	proto.type_name(packed),
+	packed.type_url,
+	unpacked.f_string,
+	unpacked.r_string,
+	proto.unpack_any(proto.pack_any(pb.MessageV2(f_int64 = 5)), pb.MessageV2).f_int64,
+]
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `["google.protobuf.Any", "type.googleapis.com/skycfg.test_proto.MessageV3", "some string", ["a", "b"], 5]`
+	if results := got["results"].String(); results != want {
+		t.Errorf("expected %s, got %s", want, results)
+	}
+
+	globals["pb"] = got["pb"]
+	globals["packed"] = got["packed"]
+	errs := map[string]string{
+		`proto.unpack_any(packed, pb.MessageV2)`:                                                  "proto.unpack_any: TypeError: type URL \"type.googleapis.com/skycfg.test_proto.MessageV3\" names `skycfg.test_proto.MessageV3', not `skycfg.test_proto.MessageV2'",
+		`proto.unpack_any(pb.MessageV3(), pb.MessageV3)`:                                          "proto.unpack_any: for parameter 1: got skycfg.test_proto.MessageV3, want google.protobuf.Any",
+		`proto.unpack_any(proto.package("google.protobuf").Any(type_url = "junk"), pb.MessageV3)`: "proto.unpack_any: ValueError: invalid type URL \"junk\"",
+		`proto.unpack_any(packed, "skycfg.test_proto.MessageV3")`:                                 "proto.unpack_any: for parameter 2: got string, want proto.MessageType",
+		`proto.pack_any("skycfg.test_proto.MessageV3")`:                                           "proto.pack_any: for parameter 1: got string, want proto.Message",
+	}
+	for src, wantErr := range errs {
+		_, err := starlark.Eval(&starlark.Thread{}, "", src, globals)
+		if err == nil || err.Error() != wantErr {
+			t.Errorf("eval(%q): expected error %q, got %v", src, wantErr, err)
+		}
+	}
+}
+
+func TestProtoEqualAndHash(t *testing.T) {
+	globals := starlark.StringDict{
+		"proto":      NewProtoModule(nil),
+		"gogo_proto": NewProtoModule(&gogoRegistry{}),
+	}
+	src := `
+pb = proto.package("skycfg.test_proto")
+a = pb.MessageV3(f_string = "x", r_string = ["a"], map_string = {"k": "v", "j": "w"})
+b = pb.MessageV3(f_string = "x", r_string = ["a"], map_string = {"j": "w", "k": "v"})
+c = pb.MessageV3(f_string = "y")
+deduped = {proto.freeze(msg): True for msg in [a, b, c, pb.MessageV3(f_string = "y"), pb.MessageV2(f_string = "y")]}
+gogo = gogo_proto.package("skycfg.test_proto")
+results = [
+	proto.equal(a, b),
+	proto.equal(a, c),
+	proto.equal(c, pb.MessageV2(f_string = "y")),
+	a == b,
+	a != c,
+	len(deduped),
+	gogo.MessageGogo(f_string = "x") == gogo.MessageGogo(f_string = "x"),
+	len({proto.freeze(msg): True for msg in [gogo.MessageGogo(f_string = "x"), gogo.MessageGogo(f_string = "x")]}),
+]
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[True, False, False, True, True, 3, True, 1]`
+	if results := got["results"].String(); results != want {
+		t.Errorf("expected %s, got %s", want, results)
+	}
+
+	globals["pb"] = got["pb"]
+	errs := map[string]string{
+		`proto.equal(pb.MessageV3(), "x")`: "proto.equal: for parameter 2: got string, want proto.Message",
+		`pb.MessageV3() < pb.MessageV3()`:  "skycfg.test_proto.MessageV3 < skycfg.test_proto.MessageV3 not implemented",
+		`{pb.MessageV3(): True}`:           "unhashable type: skycfg.test_proto.MessageV3 (use proto.freeze() to make it a key)",
+	}
+	for src, wantErr := range errs {
+		_, err := starlark.Eval(&starlark.Thread{}, "", src, globals)
+		if err == nil || err.Error() != wantErr {
+			t.Errorf("eval(%q): expected error %q, got %v", src, wantErr, err)
+		}
+	}
+}
+
+func TestProtoNameResolver(t *testing.T) {
+	registry := NewAliasProtoRegistry(nil, map[string]string{
+		"skycfg.test_proto.OldMessage": "skycfg.test_proto.MessageV3",
+		"skycfg.test_proto.OldEnum":    "skycfg.test_proto.ToplevelEnumV3",
+	})
+	globals := starlark.StringDict{"proto": NewProtoModule(registry)}
+	src := `
+pb = proto.package("skycfg.test_proto")
+results = [
+	proto.type_name(pb.OldMessage(f_string = "x")),
+	pb.OldMessage(f_string = "x").f_string,
+	pb.OldEnum.TOPLEVEL_ENUM_V3_B,
+	proto.type_name(pb.MessageV2()),
+]
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `["skycfg.test_proto.MessageV3", "x", <skycfg.test_proto.ToplevelEnumV3 TOPLEVEL_ENUM_V3_B=1>, "skycfg.test_proto.MessageV2"]`
+	if results := got["results"].String(); results != want {
+		t.Errorf("expected %s, got %s", want, results)
+	}
+
+	values, err := ProtoEnumValues(registry, "skycfg.test_proto.OldEnum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := values["TOPLEVEL_ENUM_V3_A"]; !ok {
+		t.Errorf("ProtoEnumValues: got %v, want values of ToplevelEnumV3", values)
+	}
+}
+
+func TestProtoFieldMask(t *testing.T) {
+	globals := starlark.StringDict{"proto": NewProtoModule(nil)}
+	src := `
+pb = proto.package("skycfg.test_proto")
+mask = proto.field_mask(["f_string", "f_submsg.f_int64"], pb.MessageV3)
+msg = pb.MessageV3(
+	f_string = "x",
+	f_int32 = 5,
+	f_submsg = pb.MessageV3(f_int64 = 6, f_string = "nested"),
+	r_string = ["a"],
+)
+masked = proto.apply_mask(msg, mask)
+masked.f_submsg.f_int64 = 7
+results = [
+	proto.type_name(mask),
+	mask.paths,
+	masked,
+	msg.f_submsg.f_int64,
+	proto.apply_mask(msg, ["r_string", "f_submsg"]),
+	proto.apply_mask(pb.MessageV2(f_string = "a", f_int64 = 1), ["f_string"]),
+]
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `["google.protobuf.FieldMask", ["f_string", "f_submsg.f_int64"], <skycfg.test_proto.MessageV3 f_string:"x" f_submsg:<f_int64:7 > >, 6, <skycfg.test_proto.MessageV3 f_submsg:<f_int64:6 f_string:"nested" > r_string:"a" >, <skycfg.test_proto.MessageV2 f_string:"a" >]`
+	if results := got["results"].String(); results != want {
+		t.Errorf("expected %s, got %s", want, results)
+	}
+
+	globals["pb"] = got["pb"]
+	errs := map[string]string{
+		`proto.field_mask(["f_nope"], pb.MessageV3)`:            "proto.field_mask: ValueError: field mask path \"f_nope\": `skycfg.test_proto.MessageV3' has no field \"f_nope\"",
+		`proto.field_mask(["r_submsg.f_string"], pb.MessageV3)`: "proto.field_mask: ValueError: field mask path \"r_submsg.f_string\": field \"r_submsg\" of `skycfg.test_proto.MessageV3' isn't a singular message",
+		`proto.field_mask([1])`:                                 "proto.field_mask: for parameter 1: got int in paths, want string",
+		`proto.apply_mask(pb.MessageV3(), ["f_string.x"])`:      "proto.apply_mask: ValueError: field mask path \"f_string.x\": field \"f_string\" of `skycfg.test_proto.MessageV3' isn't a singular message",
+		`proto.apply_mask(pb.MessageV3(), pb.MessageV3())`:      "proto.apply_mask: for parameter 2: got skycfg.test_proto.MessageV3, want google.protobuf.FieldMask",
+	}
+	for src, wantErr := range errs {
+		_, err := starlark.Eval(&starlark.Thread{}, "", src, globals)
+		if err == nil || err.Error() != wantErr {
+			t.Errorf("eval(%q): expected error %q, got %v", src, wantErr, err)
+		}
+	}
+}
+
+func TestProtoWhichOneof(t *testing.T) {
+	globals := starlark.StringDict{
+		"proto": NewProtoModule(nil),
+		"gogo":  NewProtoModule(&gogoRegistry{}),
+	}
+	src := `
+pb = proto.package("skycfg.test_proto")
+gogo_pb = gogo.package("skycfg.test_proto")
+v2 = pb.MessageV2(f_oneof_a = "a")
+v3 = pb.MessageV3()
+v3.f_oneof_a = "a"
+v3.f_oneof_b = "b"
+gogo_msg = gogo_pb.MessageGogo(f_oneof_b = "b")
+results = [
+	proto.which_oneof(v2, "f_oneof"),
+	proto.which_oneof(v3, "f_oneof"),
+	proto.which_oneof(pb.MessageV3(), "f_oneof"),
+	proto.which_oneof(gogo_msg, "f_oneof"),
+	proto.which_oneof(gogo_pb.MessageGogo(), "f_oneof"),
+]
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `["f_oneof_a", "f_oneof_b", None, "f_oneof_b", None]`
+	if results := got["results"].String(); results != want {
+		t.Errorf("expected %s, got %s", want, results)
+	}
+
+	globals["pb"] = got["pb"]
+	errs := map[string]string{
+		`proto.which_oneof(pb.MessageV3(), "f_nope")`:    "proto.which_oneof: AttributeError: `skycfg.test_proto.MessageV3' value has no oneof \"f_nope\"",
+		`proto.which_oneof(1, "f_oneof")`:                "proto.which_oneof: for parameter 1: got int, want proto.Message",
+		`pb.MessageV3(f_oneof_a = "a", f_oneof_b = "b")`: "skycfg.test_proto.MessageV3: fields \"f_oneof_a\" and \"f_oneof_b\" are members of the same oneof \"f_oneof\"; set at most one of them",
+	}
+	for src, wantErr := range errs {
+		_, err := starlark.Eval(&starlark.Thread{}, "", src, globals)
+		if err == nil || err.Error() != wantErr {
+			t.Errorf("eval(%q): expected error %q, got %v", src, wantErr, err)
+		}
+	}
+}
+
+func TestStrictOneofs(t *testing.T) {
+	thread := &starlark.Thread{}
+	SetStrictOneofs(thread, true)
+	globals := starlark.StringDict{
+		"proto": NewProtoModule(nil),
+		"gogo":  NewProtoModule(&gogoRegistry{}),
+	}
+	src := `
+pb = proto.package("skycfg.test_proto")
+gogo_pb = gogo.package("skycfg.test_proto")
+
+v3_a = pb.MessageV3(f_oneof_a = "a")
+v3_a.f_oneof_a = "a2"
+v3 = proto.clear(v3_a, "f_oneof_a")
+v3.f_oneof_b = "b"
+`
+	got, err := starlark.ExecFile(thread, "main.sky", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := got["v3"].String(); got != `<skycfg.test_proto.MessageV3 f_oneof_b:"b" >` {
+		t.Errorf("unexpected message %s", got)
+	}
+
+	globals["pb"] = got["pb"]
+	globals["gogo_pb"] = got["gogo_pb"]
+	errs := map[string]string{
+		"msg = pb.MessageV3(\n\tf_oneof_a = 'a')\nmsg.f_oneof_b = 'b'\n":                                     "can't set field \"f_oneof_b\" of `skycfg.test_proto.MessageV3': field \"f_oneof_a\" of the same oneof \"f_oneof\" is already set (at main.sky:1); unset it with proto.clear() first",
+		"msg = gogo_pb.MessageGogo()\nmsg.f_oneof_a = 'a'\nmsg.f_oneof_b = 'b'\n":                            "can't set field \"f_oneof_b\" of `skycfg.test_proto.MessageGogo': field \"f_oneof_a\" of the same oneof \"f_oneof\" is already set (at the top level of main.sky); unset it with proto.clear() first",
+		"msg = pb.MessageV3()\nmsg.f_submsg = pb.MessageV3(f_oneof_a = 'a')\nmsg.f_submsg.f_oneof_b = 'b'\n": "can't set field \"f_oneof_b\" of `skycfg.test_proto.MessageV3': field \"f_oneof_a\" of the same oneof \"f_oneof\" is already set",
+	}
+	for src, wantErr := range errs {
+		_, err := starlark.ExecFile(thread, "main.sky", src, globals)
+		evalErr, ok := err.(*starlark.EvalError)
+		if !ok || !strings.Contains(evalErr.Error(), wantErr) || !strings.Contains(evalErr.Backtrace(), "main.sky:3: in <toplevel>") {
+			t.Errorf("exec(%q): expected error %q, got %v", src, wantErr, err)
+		}
+	}
+}
+
+func TestProtoEnumIntrospection(t *testing.T) {
+	globals := starlark.StringDict{"proto": NewProtoModule(nil)}
+	src := `
+pb = proto.package("skycfg.test_proto")
+msg = pb.MessageV3(f_nested_enum = pb.MessageV3.NestedEnum.NESTED_ENUM_B)
+results = [
+	[v.name for v in proto.enum_values(pb.ToplevelEnumV3)],
+	proto.enum_value(pb.ToplevelEnumV3, "TOPLEVEL_ENUM_V3_B"),
+	proto.enum_value(pb.ToplevelEnumV3, 0),
+	msg.f_nested_enum.name,
+	msg.f_nested_enum.number,
+	proto.enum_value(pb.MessageV3.NestedEnum, msg.f_nested_enum.number).name,
+]
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[["TOPLEVEL_ENUM_V3_A", "TOPLEVEL_ENUM_V3_B"], <skycfg.test_proto.ToplevelEnumV3 TOPLEVEL_ENUM_V3_B=1>, <skycfg.test_proto.ToplevelEnumV3 TOPLEVEL_ENUM_V3_A=0>, "NESTED_ENUM_B", 1, "NESTED_ENUM_B"]`
+	if results := got["results"].String(); results != want {
+		t.Errorf("expected %s, got %s", want, results)
+	}
+
+	globals["pb"] = got["pb"]
+	errs := map[string]string{
+		`proto.enum_values(pb.MessageV3)`:              "proto.enum_values: for parameter 1: got proto.MessageType, want proto.EnumType",
+		`proto.enum_value(pb.ToplevelEnumV3, "BOGUS")`: "proto.enum_value: \"BOGUS\" is not a value of enum `skycfg.test_proto.ToplevelEnumV3'",
+		`proto.enum_value(pb.ToplevelEnumV3, 7)`:       "proto.enum_value: 7 is not a number of enum `skycfg.test_proto.ToplevelEnumV3'",
+		`proto.enum_value(pb.ToplevelEnumV3, 1.0)`:     "proto.enum_value: for parameter 2: got float, want string or int",
+	}
+	for src, wantErr := range errs {
+		_, err := starlark.Eval(&starlark.Thread{}, "", src, globals)
+		if err == nil || err.Error() != wantErr {
+			t.Errorf("eval(%q): expected error %q, got %v", src, wantErr, err)
+		}
+	}
+}
+
+func TestProtoDict(t *testing.T) {
+	msg := &pb.MessageV2{
+		FInt32:        proto.Int32(0),
+		FString:       proto.String("some string"),
+		FSubmsg:       &pb.MessageV2{FString: proto.String("nested")},
+		RString:       []string{"a", "b"},
+		RSubmsg:       []*pb.MessageV2{{FInt64: proto.Int64(1)}},
+		MapSubmsg:     map[string]*pb.MessageV2{"key": {FBool: proto.Bool(true)}},
+		FToplevelEnum: pb.ToplevelEnumV2_TOPLEVEL_ENUM_V2_B.Enum(),
+		FOneof:        &pb.MessageV2_FOneofA{FOneofA: "a"},
+	}
+	globals := starlark.StringDict{
+		"proto": NewProtoModule(nil),
+		"pb":    newProtoPackage(&defaultProtoRegistry{}, "skycfg.test_proto"),
+		"msg":   NewSkyProtoMessage(msg),
+	}
+	src := `
+d = proto.to_dict(msg)
+roundtrip = proto.from_dict(pb.MessageV2, d)
+by_number = proto.from_dict(pb.MessageV2, {"f_toplevel_enum": 1})
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDict := `{"f_int32": 0, "f_string": "some string", "f_submsg": {"f_string": "nested"}, ` +
+		`"r_string": ["a", "b"], "r_submsg": [{"f_int64": 1}], "map_submsg": {"key": {"f_bool": True}}, ` +
+		`"f_toplevel_enum": "TOPLEVEL_ENUM_V2_B", "f_oneof_a": "a"}`
+	if d := got["d"].String(); d != wantDict {
+		t.Errorf("to_dict: expected %s, got %s", wantDict, d)
+	}
+	if diff := ProtoDiff(msg, got["roundtrip"].(*skyProtoMessage).msg); diff != "" {
+		t.Errorf("from_dict: diff from expected message:\n%s", diff)
+	}
+	wantEnum := &pb.MessageV2{FToplevelEnum: pb.ToplevelEnumV2_TOPLEVEL_ENUM_V2_B.Enum()}
+	if diff := ProtoDiff(wantEnum, got["by_number"].(*skyProtoMessage).msg); diff != "" {
+		t.Errorf("from_dict: diff from expected message:\n%s", diff)
+	}
+
+	globals["dynamic"] = newDynamicMessageType(&defaultProtoRegistry{}, proto.MessageReflect(&pb.MessageV3{}).Descriptor())
+	for src, wantErr := range map[string]string{
+		`proto.from_dict(pb.MessageV2, {"no_such_field": 1})`:           `has no field "no_such_field"`,
+		`proto.from_dict(pb.MessageV2, {"f_toplevel_enum": "BOGUS"})`:   `"BOGUS" is not a value of enum`,
+		`proto.from_dict(pb.MessageV2, {"f_submsg": {"f_int32": "x"}})`: "(field f_submsg.f_int32)",
+
+		// Errors within nested dicts and lists name the field.
+		`proto.from_dict(pb.MessageV2, {"r_submsg": [{}, {"nope": 1}]})`:                   `has no field "nope" (field r_submsg[1].nope)`,
+		`proto.from_dict(pb.MessageV2, {"map_submsg": {"k": {"f_toplevel_enum": "X"}}})`:   `"X" is not a value of enum ` + "`skycfg.test_proto.ToplevelEnumV2' " + `(field map_submsg["k"].f_toplevel_enum)`,
+		`proto.from_dict(pb.MessageV2, {"f_submsg": {"r_submsg": [1]}})`:                   "(field f_submsg.r_submsg[0])",
+		`proto.from_dict(pb.MessageV2, {"f_submsg": {1: "x"}})`:                            "must be field names, got int (field f_submsg)",
+		`proto.from_dict(dynamic, {"r_submsg": [{}, {"nope": 1}]})`:                        `has no field "nope" (field r_submsg[1].nope)`,
+		`proto.from_dict(dynamic, {"map_submsg": {"k": {"f_toplevel_enum": "X"}}})`:        `(field map_submsg["k"].f_toplevel_enum)`,
+		`proto.from_dict(dynamic, {"f_submsg": {"r_submsg": [{"f_toplevel_enum": "X"}]}})`: "(field f_submsg.r_submsg[0].f_toplevel_enum)",
+	} {
+		_, err := starlark.Eval(&starlark.Thread{}, "", src, globals)
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("eval(%q): expected error containing %q, got %v", src, wantErr, err)
+		}
+	}
+}
+
+func TestProtoDictWellKnownTypes(t *testing.T) {
+	msg := newWellKnownMessage(t)
+	globals := starlark.StringDict{
+		"proto":     NewProtoModule(nil),
+		"msg":       NewSkyProtoMessage(msg),
+		"WellKnown": newDynamicMessageType(&defaultProtoRegistry{}, msg.Descriptor()),
+	}
+	src := `
+msg.timeout = "1m30.5s"
+msg.created = "2020-01-02T03:04:05.5Z"
+msg.replicas = 3
+msg.name = "web"
+msg.retries = ["1s", "-1.5s"]
+msg.labels = {"app": "web"}
+d = proto.to_dict(msg)
+roundtrip = proto.equal(proto.from_dict(WellKnown, d), msg)
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"timeout": "1m30.5s", "created": "2020-01-02T03:04:05.5Z", "replicas": 3, "name": "web", ` +
+		`"retries": ["1s", "-1.5s"], "labels": {"app": "web"}}`
+	if d := got["d"].String(); d != want {
+		t.Errorf("to_dict: expected %s, got %s", want, d)
+	}
+	if got["roundtrip"] != starlark.True {
+		t.Errorf("from_dict(to_dict(msg)) != msg")
+	}
+}
+
+func TestListMutation(t *testing.T) {
+	tests := []struct {
+		src     string
+		want    []string
+		wantErr string
+	}{
+		{
+			src:  `msg.r_string.clear()`,
+			want: []string{},
+		},
+		{
+			src:  `msg.r_string.append('d')`,
+			want: []string{"a", "b", "c", "d"},
+		},
+		{
+			src:     `msg.r_string.append(None)`,
+			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `string'.",
+		},
+		{
+			src:     `msg.r_submsg.append(None)`,
+			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `skycfg.test_proto.MessageV2'.",
+		},
+		{
+			src:  `msg.r_string.extend(['d'])`,
+			want: []string{"a", "b", "c", "d"},
+		},
+		{
+			src:     `msg.r_string.extend([None])`,
+			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `string'.",
+		},
+		{
+			src:     `msg.r_submsg.extend([None])`,
+			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `skycfg.test_proto.MessageV2'.",
+		},
+		{
+			src:  `msg.r_string.insert(1, 'd')`,
+			want: []string{"a", "d", "b", "c"},
+		},
+		{
+			src:  `msg.r_string.insert(-1, 'd')`,
+			want: []string{"a", "b", "d", "c"},
+		},
+		{
+			src:  `msg.r_string.insert(10, 'd')`,
+			want: []string{"a", "b", "c", "d"},
+		},
+		{
+			src:     `msg.r_string.insert(0, None)`,
+			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `string'.",
+		},
+		{
+			src:  `msg.r_string.pop()`,
+			want: []string{"a", "b"},
+		},
+		{
+			src:  `msg.r_string.pop(0)`,
+			want: []string{"b", "c"},
+		},
+		{
+			src:  `msg.r_string.pop(-2)`,
+			want: []string{"a", "c"},
+		},
+		{
+			src:     `msg.r_string.pop(3)`,
+			wantErr: "pop: index 3 is out of range [0:3]",
+		},
+		{
+			src:  `msg.r_string.remove('b')`,
+			want: []string{"a", "c"},
+		},
+		{
+			src:     `msg.r_string.remove('d')`,
+			wantErr: "remove: element not found",
+		},
+	}
+	for _, test := range tests {
+		msg := &pb.MessageV2{
+			RString: []string{"a", "b", "c"},
+		}
+		globals := starlark.StringDict{
+			"msg": NewSkyProtoMessage(msg),
+		}
+		_, err := starlark.Eval(&starlark.Thread{}, "", test.src, globals)
+		if test.wantErr != "" {
+			if err == nil {
+				t.Errorf("eval(%q): expected error", test.src)
+			} else if test.wantErr != err.Error() {
+				t.Errorf("eval(%q): expected error %q, got %q", test.src, test.wantErr, err.Error())
+			}
+		} else if err != nil {
+			t.Errorf("eval(%q): %v", test.src, err)
+			continue
+		} else if !reflect.DeepEqual(msg.RString, test.want) {
+			t.Errorf("eval(%q): expected msg.r_string = %v, got %v", test.src, test.want, msg.RString)
+		}
+	}
+}
+
+func TestRepeatedListSemantics(t *testing.T) {
+	globals := starlark.StringDict{
+		"proto": NewProtoModule(nil),
+		"gogo":  NewProtoModule(&gogoRegistry{}),
+	}
+	src := `
+pb = proto.package("skycfg.test_proto")
+
+msg = pb.MessageV2()
+msg.r_submsg.append(pb.MessageV2(f_string = "a"))
+msg.r_submsg[0].f_string = "changed"
+msg.r_submsg.extend([pb.MessageV2(f_string = "c")])
+msg.r_submsg.insert(1, pb.MessageV2())
+msg.r_submsg[1].f_string = "b"
+msg.r_string += ["x", "y"]
+msg.r_string.remove("x")
+results = [msg.r_string[:1], len(msg.r_submsg), msg.r_submsg.pop().f_string, msg.r_string.index("y")]
+
+# Repeated fields of gogo messages are Go slices rather than APIv2 lists.
+gogo_msg = gogo.package("skycfg.test_proto").MessageGogo(r_string = ["a", "c", "d"])
+gogo_msg.r_string.insert(1, "b")
+gogo_msg.r_string.remove("c")
+gogo_popped = gogo_msg.r_string.pop(0)
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMsg := &pb.MessageV2{
+		RSubmsg: []*pb.MessageV2{
+			{FString: proto.String("changed")},
+			{FString: proto.String("b")},
+		},
+		RString: []string{"y"},
+	}
+	if msg := got["msg"].(*skyProtoMessage).msg; !proto.Equal(msg, wantMsg) {
+		t.Errorf("expected %v, got %v", wantMsg, msg)
+	}
+	if want, results := `[["y"], 3, "c", 0]`, got["results"].String(); results != want {
+		t.Errorf("expected %s, got %s", want, results)
+	}
+	gogoMsg := got["gogo_msg"].(*skyProtoMessage).msg.(*pb.MessageGogo)
+	if want := []string{"b", "d"}; !reflect.DeepEqual(gogoMsg.RString, want) || got["gogo_popped"] != starlark.String("a") {
+		t.Errorf("expected gogo r_string = %v, got %v (popped %v)", want, gogoMsg.RString, got["gogo_popped"])
+	}
+
+	globals["frozen"] = got["msg"]
+	for _, src := range []string{`frozen.r_string.insert(0, "a")`, `frozen.r_string.pop()`, `frozen.r_string.remove("y")`} {
+		_, err := starlark.Eval(&starlark.Thread{}, "", src, globals)
+		if err == nil || !strings.Contains(err.Error(), "frozen") {
+			t.Errorf("eval(%q): expected frozen error, got %v", src, err)
+		}
+	}
+}
+
+func TestRepeatedLazyConversion(t *testing.T) {
+	input := &pb.MessageV2{}
+	for ii := 0; ii < 1000; ii++ {
+		input.RSubmsg = append(input.RSubmsg, &pb.MessageV2{FInt32: proto.Int32(int32(ii))})
+	}
+	globals := starlark.StringDict{"input": NewSkyProtoMessage(input)}
+	src := `
+def find(msgs, n):
+	for msg in msgs:
+		if msg.f_int32 == n:
+			return msg
+	return None
+
+def iterate_and_append(msgs):
+	for msg in msgs:
+		msgs.append(msg)
+
+found = find(input.r_submsg, 2)
+found.f_string = "found"
+results = [found.f_int32, input.r_submsg[2].f_string, input.r_submsg[999].f_int32, len(input.r_submsg)]
+`
+	thread := &starlark.Thread{}
+	got, err := starlark.ExecFile(thread, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, results := `[2, "found", 999, 1000]`, got["results"].String(); results != want {
+		t.Errorf("expected %s, got %s", want, results)
+	}
+	repeated, _ := globals["input"].(*skyProtoMessage).Attr("r_submsg")
+	r := repeated.(*protoRepeated)
+	converted := 0
+	for _, elem := range r.converted() {
+		if elem != nil {
+			converted++
+		}
+	}
+	if r.list != nil || converted != 4 {
+		t.Errorf("expected 4 elements to be converted without building a list, got %d (list %v)", converted, r.list != nil)
+	}
+
+	_, err = starlark.Call(thread, got["iterate_and_append"], starlark.Tuple{repeated}, nil)
+	if err == nil || !strings.Contains(err.Error(), "cannot append to list during iteration") {
+		t.Errorf("expected iteration error, got %v", err)
+	}
+	if n := repeated.(*protoRepeated).Len(); n != 1000 {
+		t.Errorf("expected 1000 elements after failed append, got %d", n)
+	}
+}
+
+func TestMapMutation(t *testing.T) {
+	tests := []struct {
+		src     string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			src:  `msg.map_string.clear()`,
+			want: map[string]string{},
+		},
+		{
+			src: `msg.map_string.setdefault('a', 'Z')`,
+			want: map[string]string{
+				"a": "A",
+				"b": "B",
+				"c": "C",
+			},
+		},
+		{
+			src: `msg.map_string.setdefault('d', 'D')`,
+			want: map[string]string{
+				"a": "A",
+				"b": "B",
+				"c": "C",
+				"d": "D",
+			},
+		},
+		{
+			src:     `msg.map_string.setdefault('d', None)`,
+			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `string'.",
+		},
+		{
+			src:     `msg.map_submsg.setdefault('d', None)`,
+			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `skycfg.test_proto.MessageV2'.",
+		},
+		{
+			src: `msg.map_string.update({'a': 'Z', 'd': 'D'})`,
+			want: map[string]string{
+				"a": "Z",
+				"b": "B",
+				"c": "C",
+				"d": "D",
+			},
+		},
+		{
+			src:     `msg.map_string.update({'a': None})`,
+			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `string'.",
+		},
+		{
+			src:     `msg.map_submsg.update({'a': None})`,
+			wantErr: "TypeError: value None (type `NoneType') can't be assigned to type `skycfg.test_proto.MessageV2'.",
+		},
+		{
+			src: `msg.map_string.pop('a')`,
+			want: map[string]string{
+				"b": "B",
+				"c": "C",
+			},
+		},
+		{
+			src: `msg.map_string.pop('d', None)`,
+			want: map[string]string{
+				"a": "A",
+				"b": "B",
+				"c": "C",
+			},
+		},
+		{
+			src:     `msg.map_string.pop('d')`,
+			wantErr: "pop: missing key",
+		},
+		{
+			src: `msg.map_string.popitem()`,
+			want: map[string]string{
+				"b": "B",
+				"c": "C",
+			},
+		},
+	}
+	for _, test := range tests {
+		msg := &pb.MessageV2{
+			MapString: map[string]string{
+				"a": "A",
+				"b": "B",
+				"c": "C",
+			},
+		}
+		globals := starlark.StringDict{
+			"msg": NewSkyProtoMessage(msg),
+		}
+		_, err := starlark.Eval(&starlark.Thread{}, "", test.src, globals)
+		if test.wantErr != "" {
+			if err == nil {
+				t.Errorf("eval(%q): expected error", test.src)
+			} else if test.wantErr != err.Error() {
+				t.Errorf("eval(%q): expected error %q, got %q", test.src, test.wantErr, err.Error())
+			}
+		} else if err != nil {
+			t.Errorf("eval(%q): %v", test.src, err)
+			continue
+		} else if !reflect.DeepEqual(msg.MapString, test.want) {
+			t.Errorf("eval(%q): expected msg.r_string = %v, got %v", test.src, test.want, msg.MapString)
+		}
+	}
+}
+
+func TestMapFieldOrder(t *testing.T) {
+	strs := make(map[string]string)
+	for ii := 0; ii < 20; ii++ {
+		strs[fmt.Sprintf("k%02d", ii)] = "v"
+	}
+	for _, msg := range []proto.Message{
+		&pb.MessageV2{MapString: strs},
+		&pb.MessageGogo{MapString: strs},
+	} {
+		globals := starlark.StringDict{"msg": NewSkyProtoMessage(msg)}
+		val, err := starlark.Eval(&starlark.Thread{}, "", `list(msg.map_string) == sorted(msg.map_string)`, globals)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != starlark.True {
+			t.Errorf("%T: expected map keys in sorted order", msg)
+		}
+	}
+}
+
+func TestMapDictSemantics(t *testing.T) {
+	globals := starlark.StringDict{
+		"proto": NewProtoModule(nil),
+		"gogo":  NewProtoModule(&gogoRegistry{}),
+	}
+	src := `
+pb = proto.package("skycfg.test_proto")
+gogo_pb = gogo.package("skycfg.test_proto")
+
+def build(msg_type, submsg_type):
+	msg = msg_type()
+	msg.map_submsg["a"] = submsg_type(f_string = "a")
+	msg.map_submsg["a"].f_string = "changed"
+	msg.map_submsg.update(b = submsg_type())
+	msg.map_submsg["b"].f_string = "b"
+	msg.map_submsg.setdefault("c", submsg_type()).f_string = "c"
+	popped = msg.map_submsg.pop("c")
+	msg.map_string.update({"x": "1", "y": "2"})
+	return [
+		msg,
+		popped.f_string,
+		"a" in msg.map_submsg,
+		"c" in msg.map_submsg,
+		msg.map_string.get("x"),
+		msg.map_string.get("z", "default"),
+		sorted(msg.map_string.items()),
+		msg.map_string.popitem(),
+	]
+
+v2 = build(pb.MessageV2, pb.MessageV2)
+gogo_results = build(gogo_pb.MessageGogo, pb.MessageV2)
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSubmsgs := map[string]*pb.MessageV2{
+		"a": {FString: proto.String("changed")},
+		"b": {FString: proto.String("b")},
+	}
+	wantStrings := map[string]string{"y": "2"}
+	want := `["c", True, False, "1", "default", [("x", "1"), ("y", "2")], ("x", "1")]`
+	for name, wantMsg := range map[string]proto.Message{
+		"v2":           &pb.MessageV2{MapSubmsg: wantSubmsgs, MapString: wantStrings},
+		"gogo_results": &pb.MessageGogo{MapSubmsg: wantSubmsgs, MapString: wantStrings},
+	} {
+		results := got[name].(*starlark.List)
+		if msg := results.Index(0).(*skyProtoMessage).msg; !proto.Equal(msg, wantMsg) {
+			t.Errorf("%s: expected %v, got %v", name, wantMsg, msg)
+		}
+		if rest := results.Slice(1, results.Len(), 1).String(); rest != want {
+			t.Errorf("%s: expected %s, got %s", name, want, rest)
+		}
+	}
+
+	frozen := got["v2"].(*starlark.List).Index(0)
+	frozen.Freeze()
+	globals["frozen"] = frozen
+	_, err = starlark.Eval(&starlark.Thread{}, "", `frozen.map_string.pop("y")`, globals)
+	if err == nil || !strings.Contains(err.Error(), "frozen") {
+		t.Errorf("expected error popping from frozen map, got %v", err)
+	}
+}
+
+func TestUnsetProto2Fields(t *testing.T) {
+	// Proto v2 distinguishes between unset and set-to-empty.
+	msg := skyEval(t, `proto.package("skycfg.test_proto").MessageV2(
+		f_string = None,
+	)`)
+	got := msg.String()
+	want := `<skycfg.test_proto.MessageV2 >`
+	if want != got {
+		t.Fatalf("wanted %q, got %q", want, got)
+	}
+
+	field, err := msg.(starlark.HasAttrs).Attr("f_string")
+	if err != nil {
+		t.Fatalf(`msg.Attr("f_string"): %v`, err)
+	}
+	if _, isNone := field.(starlark.NoneType); !isNone {
+		t.Fatalf("field set to None should be returned as None")
+	}
+}
+
+func TestProtoFromText(t *testing.T) {
+	val := skyEval(t, `proto.from_text(proto.package("skycfg.test_proto").MessageV3, "f_int32: 1010").f_int32`)
+	got := val.String()
+	want := "1010"
+	if want != got {
+		t.Fatalf("from_text: wanted %q, got %q", want, got)
+	}
+}
+
+func TestProtoFromJson(t *testing.T) {
+	val := skyEval(t, `proto.from_json(proto.package("skycfg.test_proto").MessageV3, "{\"f_int32\": 1010}").f_int32`)
+	got := val.String()
+	want := "1010"
+	if want != got {
+		t.Fatalf("from_json: wanted %q, got %q", want, got)
+	}
+}
+
+func TestProtoFromYaml(t *testing.T) {
+	val := skyEval(t, `proto.from_yaml(proto.package("skycfg.test_proto").MessageV3, "f_int32: 1010").f_int32`)
 	got := val.String()
 	want := "1010"
 	if want != got {
 		t.Fatalf("from_yaml: wanted %q, got %q", want, got)
 	}
 }
+
+func TestProtoUnknownFields(t *testing.T) {
+	// A newer version of MessageV3 with field 100, which this binary's
+	// version doesn't have.
+	known, err := proto.Marshal(&pb.MessageV3{FInt32: 1, FSubmsg: &pb.MessageV3{FString: "sub"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire := append(known, 0xa0, 0x06, 0x2a) // field 100, varint 42
+
+	globals := starlark.StringDict{
+		"proto": NewProtoModule(nil),
+		"wire":  starlark.String(wire),
+	}
+	src := `
+pb = proto.package("skycfg.test_proto")
+
+decoded = proto.decode(pb.MessageV3, wire)
+decoded.f_string = "changed"
+
+doc = '{"f_int32": 1, "f_new": {"a": [1, 2]}, "f_submsg": {"f_string": "sub", "f_newer": true}, "r_submsg": [{}, {"f_newest": "x"}]}'
+from_json = proto.from_json(pb.MessageV3, doc, preserve_unknown = True)
+from_json.f_int32 = 2
+replaced = proto.clone(from_json)
+replaced.f_submsg = pb.MessageV3(f_string = "replaced")
+
+elems_doc = '{"r_submsg": [{"f_string": "a"}, {"f_newest": "x"}], "map_submsg": {"k": {"f_newest": "y"}, "j": {"f_newest": "z"}}}'
+moved = proto.from_json(pb.MessageV3, elems_doc, preserve_unknown = True)
+moved.r_submsg.insert(0, pb.MessageV3(f_string = "inserted"))
+moved.r_submsg.pop(1)
+moved.map_submsg["j"] = pb.MessageV3()
+
+results = [
+	proto.decode(pb.MessageV3, proto.encode(decoded)).f_string,
+	proto.to_json(from_json),
+	proto.to_json(from_json.f_submsg),
+	proto.to_json(replaced),
+	proto.to_yaml(proto.from_yaml(pb.MessageV3, "f_int32: 3\nf_new: 4\n", preserve_unknown = True)),
+	proto.to_json(proto.from_json(pb.MessageV3, doc, strict = False)),
+	proto.to_json(moved),
+	proto.to_json(moved.r_submsg[1]),
+	proto.to_json(moved.map_submsg["k"]),
+]
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown wire fields are kept in the message, so they're also in
+	// messages passed back to Go.
+	decoded := got["decoded"].(*skyProtoMessage).msg
+	if unknown := proto.MessageV2(decoded).ProtoReflect().GetUnknown(); string(unknown) != "\xa0\x06\x2a" {
+		t.Errorf("expected decoded message to keep unknown field, got %q", unknown)
+	}
+
+	results := got["results"].(*starlark.List)
+	wantResults := []string{
+		`"changed"`,
+		`"{\"f_int32\":2,\"f_submsg\":{\"f_string\":\"sub\",\"f_newer\":true},\"r_submsg\":[{},{\"f_newest\":\"x\"}],\"f_new\":{\"a\":[1,2]}}"`,
+		`"{\"f_string\":\"sub\",\"f_newer\":true}"`,
+		`"{\"f_int32\":2,\"f_submsg\":{\"f_string\":\"replaced\"},\"r_submsg\":[{},{\"f_newest\":\"x\"}],\"f_new\":{\"a\":[1,2]}}"`,
+		`"f_int32: 3\nf_new: 4\n"`,
+		`"{\"f_int32\":1,\"f_submsg\":{\"f_string\":\"sub\"},\"r_submsg\":[{},{}]}"`,
+		`"{\"r_submsg\":[{\"f_string\":\"inserted\"},{\"f_newest\":\"x\"}],\"map_submsg\":{\"j\":{},\"k\":{\"f_newest\":\"y\"}}}"`,
+		`"{\"f_newest\":\"x\"}"`,
+		`"{\"f_newest\":\"y\"}"`,
+	}
+	for ii, want := range wantResults {
+		if got := results.Index(ii).String(); got != want {
+			t.Errorf("results[%d]: expected %s, got %s", ii, want, got)
+		}
+	}
+
+	globals["pb"] = got["pb"]
+	for src, wantErr := range map[string]string{
+		`proto.decode(pb.MessageV3, wire, strict = True)`:                                                                    "proto.decode: message of type `skycfg.test_proto.MessageV3' has unknown fields",
+		`proto.decode(pb.MessageV3, proto.encode(pb.MessageV3(f_submsg = proto.decode(pb.MessageV3, wire))), strict = True)`: "proto.decode: f_submsg of type `skycfg.test_proto.MessageV3' has unknown fields",
+		`proto.from_json(pb.MessageV3, '{"f_new": 1}')`:                                                                      `unknown field "f_new" in skycfg.test_proto.MessageV3`,
+	} {
+		_, err := starlark.Eval(&starlark.Thread{}, "", src, globals)
+		if err == nil || err.Error() != wantErr {
+			t.Errorf("eval(%q): expected error %q, got %v", src, wantErr, err)
+		}
+	}
+}
+
+func TestProtoFromJsonYamlStrict(t *testing.T) {
+	globals := starlark.StringDict{
+		"proto":     NewProtoModule(nil),
+		"MessageV3": skyEval(t, `proto.package("skycfg.test_proto").MessageV3`),
+	}
+	for _, src := range []string{
+		`proto.from_json(MessageV3, '{"f_int32": 1, "f_unknown": 2}')`,
+		`proto.from_json(MessageV3, '{"f_int32": 1, "f_unknown": 2}', strict = True)`,
+		`proto.from_yaml(MessageV3, "f_int32: 1\nf_unknown: 2")`,
+	} {
+		if _, err := starlark.Eval(&starlark.Thread{}, "", src, globals); err == nil {
+			t.Errorf("eval(%q): expected error", src)
+		}
+	}
+
+	for _, src := range []string{
+		`proto.from_json(MessageV3, '{"f_int32": 1010, "f_unknown": 2}', strict = False).f_int32`,
+		`proto.from_yaml(MessageV3, "f_int32: 1010\nf_unknown: {a: 1}", strict = False).f_int32`,
+		// Later YAML keys replace earlier ones, whether or not decoding
+		// is strict.
+		`proto.from_yaml(MessageV3, "f_int32: 1\nf_int32: 1010").f_int32`,
+		`proto.from_yaml(MessageV3, "f_int32: 1\nf_int32: 1010", strict = False).f_int32`,
+		`proto.from_yaml(type = MessageV3, value = "f_int32: 1010").f_int32`,
+	} {
+		val, err := starlark.Eval(&starlark.Thread{}, "", src, globals)
+		if err != nil {
+			t.Errorf("eval(%q): %v", src, err)
+			continue
+		}
+		if got, want := val.String(), "1010"; got != want {
+			t.Errorf("eval(%q): wanted %q, got %q", src, want, got)
+		}
+	}
+}
+
+func TestProtoMessagePosition(t *testing.T) {
+	globals := starlark.StringDict{
+		"proto": NewProtoModule(nil),
+	}
+	src := `pb = proto.package("skycfg.test_proto")
+
+msg = pb.MessageV3(f_string = "some string")
+cloned = proto.clone(msg)
+`
+	got, err := starlark.ExecFile(&starlark.Thread{}, "test.sky", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, wantLine := range map[string]int32{"msg": 3, "cloned": 4} {
+		pos, ok := ValuePosition(got[name])
+		if !ok {
+			t.Errorf("%s: expected a position", name)
+			continue
+		}
+		if pos.Filename() != "test.sky" || pos.Line != wantLine {
+			t.Errorf("%s: expected position test.sky:%d, got %v", name, wantLine, pos)
+		}
+	}
+	if _, ok := ValuePosition(NewSkyProtoMessage(&pb.MessageV3{})); ok {
+		t.Errorf("messages created from Go should not have a position")
+	}
+}
+
+func TestSharedSubmessages(t *testing.T) {
+	globals := starlark.StringDict{
+		"proto": NewProtoModule(nil),
+	}
+	templates, err := starlark.ExecFile(&starlark.Thread{}, "templates.sky", `pb = proto.package("skycfg.test_proto")
+TEMPLATE = pb.MessageV3(f_string = "template", f_submsg = pb.MessageV3(f_string = "nested"))
+`, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates.Freeze()
+	globals["pb"] = templates["pb"]
+	globals["TEMPLATE"] = templates["TEMPLATE"]
+
+	src := `
+a = pb.MessageV3(f_submsg = TEMPLATE)
+b = pb.MessageV3()
+b.f_submsg = TEMPLATE
+
+c = pb.MessageV3(f_submsg = TEMPLATE)
+nested = c.f_submsg.f_submsg
+nested.f_string = "changed"
+unchanged = a.f_submsg.f_submsg.f_string
+
+d = pb.MessageV3(f_submsg = TEMPLATE)
+detached = d.f_submsg
+d.f_submsg = None
+detached.f_string = "detached"
+
+e = pb.MessageV3(f_submsg = TEMPLATE)
+proto.merge(e.f_submsg, pb.MessageV3(f_int32 = 1))
+`
+	template, _ := ToProtoMessage(templates["TEMPLATE"])
+	want := &pb.MessageV3{FString: "template", FSubmsg: &pb.MessageV3{FString: "nested"}}
+
+	// Without SetShareSubmessages(), templates are copied.
+	got, err := starlark.ExecFile(&starlark.Thread{}, "main.sky", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := ToProtoMessage(got["a"]); m.(*pb.MessageV3).FSubmsg == template {
+		t.Errorf("expected assigned templates to be copied by default")
+	}
+	if got := got["unchanged"].(starlark.String); got != "nested" {
+		t.Errorf("a.f_submsg.f_submsg.f_string: got %q, want \"nested\"", got)
+	}
+	if !proto.Equal(template, want) {
+		t.Errorf("template was modified: %v", template)
+	}
+
+	thread := &starlark.Thread{}
+	SetShareSubmessages(thread, true)
+	got, err = starlark.ExecFile(thread, "main.sky", src, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := func(name string) *pb.MessageV3 {
+		m, _ := ToProtoMessage(got[name])
+		return m.(*pb.MessageV3)
+	}
+
+	if msg("a").FSubmsg != template || msg("b").FSubmsg != template {
+		t.Errorf("expected assigned templates to be shared")
+	}
+	if got := msg("c").FSubmsg.FSubmsg.FString; got != "changed" {
+		t.Errorf("c.f_submsg.f_submsg.f_string: got %q, want \"changed\"", got)
+	}
+	if got := got["unchanged"].(starlark.String); got != "nested" {
+		t.Errorf("a.f_submsg.f_submsg.f_string: got %q, want \"nested\"", got)
+	}
+	if msg("d").FSubmsg != nil {
+		t.Errorf("d.f_submsg: expected nil, got %v", msg("d").FSubmsg)
+	}
+	if detached, _ := ToProtoMessage(got["detached"]); detached.(*pb.MessageV3).FString != "detached" {
+		t.Errorf("detached: got %v", detached)
+	}
+	if got := msg("e").FSubmsg; got.FInt32 != 1 || got.FString != "template" {
+		t.Errorf("e.f_submsg: got %v", got)
+	}
+	if !proto.Equal(template, want) {
+		t.Errorf("template was modified: %v", template)
+	}
+}
+
+// newDynamicMessage returns an empty message of the same type as msg that
+// has no generated Go struct.
+func newDynamicMessage(msg proto.Message) *dynamicpb.Message {
+	return dynamicpb.NewMessage(proto.MessageReflect(msg).Descriptor())
+}
+
+func TestDynamicMessage(t *testing.T) {
+	msg := newDynamicMessage(&pb.MessageV3{})
+	globals := starlark.StringDict{
+		"proto": NewProtoModule(nil),
+		"msg":   NewSkyProtoMessage(msg),
+	}
+	_, err := starlark.ExecFile(&starlark.Thread{}, "", `
+pb = proto.package("skycfg.test_proto")
+msg.f_int32 = 1010
+msg.f_string = "some string"
+msg.f_submsg = pb.MessageV3(f_string = "string in submsg")
+msg.f_submsg.f_int64 = 1020
+msg.r_string = ["r_string1"]
+msg.r_string.append("r_string2")
+msg.r_submsg = [pb.MessageV3(f_string = "string in r_submsg")]
+msg.map_string = {"map_string key": "map_string val"}
+msg.map_string["other key"] = "other val"
+msg.f_toplevel_enum = pb.ToplevelEnumV3.TOPLEVEL_ENUM_V3_B
+msg.f_oneof_b = "string in oneof"
+msg.f_bytes = "also some string"
+`, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &pb.MessageV3{}
+	if err := proto.Unmarshal(data, got); err != nil {
+		t.Fatal(err)
+	}
+	want := &pb.MessageV3{
+		FInt32:  1010,
+		FString: "some string",
+		FSubmsg: &pb.MessageV3{
+			FInt64:  1020,
+			FString: "string in submsg",
+		},
+		RString: []string{"r_string1", "r_string2"},
+		RSubmsg: []*pb.MessageV3{
+			{FString: "string in r_submsg"},
+		},
+		MapString: map[string]string{
+			"map_string key": "map_string val",
+			"other key":      "other val",
+		},
+		FToplevelEnum: pb.ToplevelEnumV3_TOPLEVEL_ENUM_V3_B,
+		FOneof:        &pb.MessageV3_FOneofB{FOneofB: "string in oneof"},
+		FBytes:        []byte("also some string"),
+	}
+	if diff := ProtoDiff(want, got); diff != "" {
+		t.Fatalf("diff from expected message:\n%s", diff)
+	}
+
+	exprs := map[string]string{
+		`msg.f_int32`:                    `1010`,
+		`msg.f_submsg.f_string`:          `"string in submsg"`,
+		`msg.f_toplevel_enum`:            `<skycfg.test_proto.ToplevelEnumV3 TOPLEVEL_ENUM_V3_B=1>`,
+		`msg.f_oneof_a`:                  `None`,
+		`msg.f_bytes`:                    `"also some string"`,
+		`type(msg)`:                      `"skycfg.test_proto.MessageV3"`,
+		`type(msg.r_string)`:             `"list<string>"`,
+		`type(msg.map_submsg)`:           `"map<string, skycfg.test_proto.MessageV3>"`,
+		`"f_oneof_b" in msg`:             `True`,
+		`proto.has(msg, "f_submsg")`:     `True`,
+		`proto.to_dict(msg)["r_string"]`: `["r_string1", "r_string2"]`,
+	}
+	for expr, want := range exprs {
+		val, err := starlark.Eval(&starlark.Thread{}, "", expr, globals)
+		if err != nil {
+			t.Errorf("eval(%q): %v", expr, err)
+			continue
+		}
+		if got := val.String(); got != want {
+			t.Errorf("eval(%q): expected %s, got %s", expr, want, got)
+		}
+	}
+
+	errs := map[string]string{
+		`msg.f_int32 = ""`:                "TypeError: value \"\" (type `string') can't be assigned to type `int32'.",
+		`msg.f_int32 = None`:              "TypeError: value None can't be assigned to type `int32' in proto3 mode.",
+		`msg.f_submsg.r_string.append(1)`: "TypeError: value 1 (type `int') can't be assigned to type `string'. (field f_submsg.r_string[0])",
+		`msg.map_string.update({"a": 1})`: "TypeError: value 1 (type `int') can't be assigned to type `string'.",
+		`msg.f_submsg = pb.MessageV2()`:   "TypeError: value <skycfg.test_proto.MessageV2 > (type `skycfg.test_proto.MessageV2') can't be assigned to type `skycfg.test_proto.MessageV3'.",
+		`proto.has(msg, "f_int32")`:       "proto.has: ValueError: field \"f_int32\" of `skycfg.test_proto.MessageV3' doesn't track presence; compare it to its default value instead",
+	}
+	for src, wantErr := range errs {
+		_, err := starlark.ExecFile(&starlark.Thread{}, "", "pb = proto.package(\"skycfg.test_proto\")\n"+src, globals)
+		if err == nil {
+			t.Errorf("eval(%q): expected error", src)
+			continue
+		}
+		if err.Error() != wantErr {
+			t.Errorf("eval(%q): expected error %q, got %q", src, wantErr, err.Error())
+		}
+	}
+}
+
+// newWellKnownMessage returns a dynamic message with fields of the
+// well-known types.
+func newWellKnownMessage(t *testing.T) *dynamicpb.Message {
+	return newTestdataMessage(t, "skycfg/test_proto/well_known.proto", "skycfg.test_proto.WellKnown")
+}
+
+func TestWellKnownTypeConversions(t *testing.T) {
+	msg := newWellKnownMessage(t)
+	globals := starlark.StringDict{
+		"proto": NewProtoModule(nil),
+		"msg":   NewSkyProtoMessage(msg),
+	}
+	_, err := starlark.ExecFile(&starlark.Thread{}, "", `
+msg.timeout = "1m30.5s"
+msg.created = "2020-01-02T03:04:05.5Z"
+msg.replicas = 3
+msg.name = "web"
+msg.ratio = 1
+msg.retries = ["1s", proto.package("google.protobuf").Duration(seconds = 2)]
+msg.retries.append("-1.5s")
+`, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := msg.Descriptor().Fields()
+	get := func(name string) proto.Message {
+		return proto.MessageV1(msg.Get(fields.ByName(protoreflect.Name(name))).Message().Interface())
+	}
+	checks := []struct {
+		field string
+		want  proto.Message
+	}{
+		{"timeout", durationpb.New(90*time.Second + 500*time.Millisecond)},
+		{"created", timestamppb.New(time.Date(2020, 1, 2, 3, 4, 5, 500000000, time.UTC))},
+		{"replicas", wrapperspb.Int32(3)},
+		{"name", wrapperspb.String("web")},
+		{"ratio", wrapperspb.Double(1)},
+	}
+	for _, check := range checks {
+		got := get(check.field)
+		data, err := proto.Marshal(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Dynamic messages don't encode their fields in a fixed order,
+		// so the field is compared after decoding it.
+		decoded := proto.Clone(check.want)
+		decoded.Reset()
+		if err := proto.Unmarshal(data, decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(decoded, check.want) {
+			t.Errorf("%s: got %v, want %v", check.field, got, check.want)
+		}
+	}
+	retries := msg.Get(fields.ByName("retries")).List()
+	if retries.Len() != 3 {
+		t.Fatalf("retries: got %d elements, want 3", retries.Len())
+	}
+	last := retries.Get(2).Message()
+	lastFields := last.Descriptor().Fields()
+	if got, want := last.Get(lastFields.ByName("seconds")).Int(), int64(-1); got != want {
+		t.Errorf("retries[2].seconds: got %d, want %d", got, want)
+	}
+	if got, want := last.Get(lastFields.ByName("nanos")).Int(), int64(-500000000); got != want {
+		t.Errorf("retries[2].nanos: got %d, want %d", got, want)
+	}
+
+	_, err = starlark.ExecFile(&starlark.Thread{}, "", `msg.created = 1577934245`, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := msg.Get(fields.ByName("created")).Message()
+	if got, want := created.Get(created.Descriptor().Fields().ByName("seconds")).Int(), int64(1577934245); got != want {
+		t.Errorf("created.seconds: got %d, want %d", got, want)
+	}
+
+	errs := map[string]string{
+		`msg.timeout = "soon"`:          "ValueError: value \"soon\" can't be converted",
+		`msg.timeout = 30`:              "can't be assigned to type `google.protobuf.Duration'",
+		`msg.created = "yesterday"`:     "can't be converted to `google.protobuf.Timestamp'",
+		`msg.replicas = 10000000000`:    "overflows type `int32'",
+		`msg.replicas = "three"`:        "can't be assigned to type `google.protobuf.Int32Value'",
+		`msg.retries = ["1s", "later"]`: "invalid duration \"later\"",
+	}
+	for src, wantErr := range errs {
+		_, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("exec(%q): expected error containing %q, got %v", src, wantErr, err)
+		}
+	}
+}
+
+func TestStructConversions(t *testing.T) {
+	msg := newWellKnownMessage(t)
+	globals := starlark.StringDict{
+		"msg": NewSkyProtoMessage(msg),
+	}
+	out, err := starlark.ExecFile(&starlark.Thread{}, "", `
+msg.labels = {"app": "web", "replicas": 3, "ratio": 0.5, "tags": ["a", None], "nested": {"on": True}}
+msg.setting = "fast"
+msg.args = ["--verbose", 2]
+results = [msg.labels, msg.labels["tags"], msg.setting, msg.args]
+msg.setting = {"x": 1}
+results.append(msg.setting)
+msg.setting = 1.5
+results.append(msg.setting)
+`, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := out["results"].(*starlark.List)
+	want := []string{
+		`{"app": "web", "nested": {"on": True}, "ratio": 0.5, "replicas": 3, "tags": ["a", None]}`,
+		`["a", None]`,
+		`"fast"`,
+		`["--verbose", 2]`,
+		`{"x": 1}`,
+		`1.5`,
+	}
+	for ii, w := range want {
+		if got := results.Index(ii).String(); got != w {
+			t.Errorf("results[%d]: got %s, want %s", ii, got, w)
+		}
+	}
+
+	fields := msg.Descriptor().Fields()
+	labels := &structpb.Struct{}
+	data, err := proto.Marshal(proto.MessageV1(msg.Get(fields.ByName("labels")).Message().Interface()))
+	if err == nil {
+		err = proto.Unmarshal(data, labels)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := labels.Fields["replicas"].GetNumberValue(), float64(3); got != want {
+		t.Errorf("labels.replicas: got %v, want %v", got, want)
+	}
+	if got := labels.Fields["tags"].GetListValue().GetValues()[1].GetNullValue(); got != structpb.NullValue_NULL_VALUE {
+		t.Errorf("labels.tags[1]: got %v, want NULL_VALUE", got)
+	}
+
+	out, err = starlark.ExecFile(&starlark.Thread{}, "", `
+d = proto.to_dict(msg)
+d["labels"]["app"] = "db"
+msg.labels = d["labels"]
+results = [msg.labels, msg.args]
+`, starlark.StringDict{"proto": NewProtoModule(nil), "msg": NewSkyProtoMessage(msg)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results = out["results"].(*starlark.List)
+	if got, want := results.String(), `[{"app": "db", "nested": {"on": True}, "ratio": 0.5, "replicas": 3, "tags": ["a", None]}, ["--verbose", 2]]`; got != want {
+		t.Errorf("to_dict(msg): got %s, want %s", got, want)
+	}
+
+	errs := map[string]string{
+		`msg.labels = {1: "a"}`:                 "keys of a `google.protobuf.Struct' must be strings",
+		`msg.labels = {"a": 10000000000000000}`: "can't be represented exactly",
+		`msg.args = [msg]`:                      "can't be converted to `google.protobuf.Value'",
+		`msg.labels = ["a"]`:                    "can't be assigned to type `google.protobuf.Struct'",
+		`msg.labels["app"] = "db"`:              "frozen",
+	}
+	for src, wantErr := range errs {
+		_, err := starlark.ExecFile(&starlark.Thread{}, "", src, globals)
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("exec(%q): expected error containing %q, got %v", src, wantErr, err)
+		}
+	}
+}
+
+func TestGogoDurationFromString(t *testing.T) {
+	val := skyEval(t, `gogo_proto.package("skycfg.test_proto").MessageGogo(f_duration = "1m30s").f_duration`)
+	if got, want := val.String(), `<google.protobuf.Duration seconds:90 >`; got != want {
+		t.Errorf("f_duration: got %s, want %s", got, want)
+	}
+}
+
+func TestValidationFormats(t *testing.T) {
+	tests := []struct {
+		kind, format, value string
+		want                bool
+	}{
+		{"string", "email", "a@example.com", true},
+		{"string", "email", "Alice <a@example.com>", false},
+		{"string", "email", "a@-example.com", false},
+		{"string", "hostname", "db-1.example.com", true},
+		{"string", "hostname", "127.0.0.1", false},
+		{"string", "ipv4", "127.0.0.1", true},
+		{"string", "ipv4", "::1", false},
+		{"string", "ipv6", "::1", true},
+		{"string", "uri", "https://example.com/a", true},
+		{"string", "uri", "/a", false},
+		{"string", "uri_ref", "/a", true},
+		{"string", "address", "example.com", true},
+		{"string", "uuid", "0b9c7a9e-4f3a-4a53-9f2b-6a3d5c1e8f00", true},
+		{"string", "tuuid", "0b9c7a9e4f3a4a539f2b6a3d5c1e8f00", true},
+		{"string", "ipv4_with_prefixlen", "10.1.2.3/8", true},
+		{"string", "ipv4_prefix", "10.1.2.3/8", false},
+		{"string", "ipv4_prefix", "10.0.0.0/8", true},
+		{"string", "host_and_port", "example.com:443", true},
+		{"string", "host_and_port", "[::1]:8080", true},
+		{"string", "host_and_port", "example.com:65536", false},
+		{"bytes", "ipv4", "\x7f\x00\x00\x01", true},
+		{"bytes", "ipv6", "\x7f\x00\x00\x01", false},
+	}
+	for _, test := range tests {
+		if got := hasFormat(test.kind, test.format, test.value); got != test.want {
+			t.Errorf("hasFormat(%q, %q, %q): got %v, want %v", test.kind, test.format, test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,518 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Implementation of the `proto.encode()` built-in function. Returns the
+// protobuf wire encoding of a message, including the unknown fields it
+// was decoded with. Map entries are sorted if `deterministic` is True,
+// which is the default if the config was loaded or executed with
+// deterministic encoding.
+//
+//  def proto.encode(msg, deterministic=False) -> str
+func fnProtoEncode(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var val starlark.Value
+	deterministic := isDeterministic(t)
+	if err := starlark.UnpackArgs("proto.encode", args, kwargs, "msg", &val, "deterministic?", &deterministic); err != nil {
+		return nil, err
+	}
+	msg, ok := val.(*skyProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.Message", "proto.encode", val.Type())
+	}
+	data, err := protov2.MarshalOptions{Deterministic: deterministic}.Marshal(proto.MessageV2(msg.msg))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", "proto.encode", err)
+	}
+	return starlark.String(data), nil
+}
+
+// Implementation of the `proto.decode()` built-in function. Returns the
+// message for its protobuf wire encoding. Fields that the message type
+// doesn't have, such as those added by a newer version of its schema, are
+// kept so that proto.encode() writes them back out; with `strict = True`
+// they're an error instead.
+//
+//  def proto.decode(type, value, strict=False)
+func fnProtoDecode(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msgType starlark.Value
+	var value starlark.String
+	var strict bool
+	if err := starlark.UnpackArgs("proto.decode", args, kwargs, "type", &msgType, "value", &value, "strict?", &strict); err != nil {
+		return nil, err
+	}
+	protoMsgType, ok := msgType.(*skyProtoMessageType)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.MessageType", "proto.decode", msgType.Type())
+	}
+	msg := proto.Clone(protoMsgType.emptyMsg)
+	msg.Reset()
+	if err := proto.Unmarshal([]byte(value), msg); err != nil {
+		return nil, fmt.Errorf("%s: %v", "proto.decode", err)
+	}
+	if strict {
+		if path, ok := findUnknownFields(proto.MessageV2(msg).ProtoReflect(), ""); ok {
+			if path == "" {
+				path = "message"
+			}
+			return nil, fmt.Errorf("%s: %s of type `%s' has unknown fields", "proto.decode", path, protoMsgType.Name())
+		}
+	}
+	wrapper := NewSkyProtoMessage(msg)
+	wrapper.setOrigin(t)
+	return wrapper, nil
+}
+
+// findUnknownFields returns the path to the first message within m that
+// has unknown fields, if any.
+func findUnknownFields(m protoreflect.Message, path string) (string, bool) {
+	if len(m.GetUnknown()) > 0 {
+		return path, true
+	}
+	var found string
+	var ok bool
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		name := joinFieldPath(path, string(fd.Name()))
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() == nil {
+				return true
+			}
+			v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+				found, ok = findUnknownFields(v.Message(), fmt.Sprintf("%s[%v]", name, k.Interface()))
+				return !ok
+			})
+		case fd.IsList():
+			if fd.Message() == nil {
+				return true
+			}
+			list := v.List()
+			for ii := 0; ii < list.Len() && !ok; ii++ {
+				found, ok = findUnknownFields(list.Get(ii).Message(), fmt.Sprintf("%s[%d]", name, ii))
+			}
+		case fd.Message() != nil:
+			found, ok = findUnknownFields(v.Message(), name)
+		}
+		return !ok
+	})
+	return found, ok
+}
+
+// unknownJSON holds the keys of a JSON object that aren't fields of the
+// message it was decoded as, so that they can be written back out when the
+// message is encoded as JSON. Unknown keys within the message's fields are
+// kept in the field's own unknownJSON.
+//
+// Values are shared between messages, such as by proto.clone(), so they
+// must not be modified once they're created.
+type unknownJSON struct {
+	keys   []string // in the order they were decoded
+	values map[string]json.RawMessage
+
+	// fields are keyed by both the proto name and JSON name of the field.
+	fields map[string]*unknownJSONField
+}
+
+type unknownJSONField struct {
+	msg  *unknownJSON
+	list []*unknownJSON          // for repeated fields, by index
+	dict map[string]*unknownJSON // for map fields, by JSON key
+}
+
+// without returns u without the unknown keys within a field, such as when
+// the field is set to a new value.
+func (u *unknownJSON) without(name string) *unknownJSON {
+	field, ok := u.fields[name]
+	if !ok {
+		return u
+	}
+	copied := &unknownJSON{keys: u.keys, values: u.values, fields: make(map[string]*unknownJSONField)}
+	for key, other := range u.fields {
+		if other != field {
+			copied.fields[key] = other
+		}
+	}
+	if len(copied.keys) == 0 && len(copied.fields) == 0 {
+		return nil
+	}
+	return copied
+}
+
+// attach gives the wrapper of a field the unknown keys within it. The
+// elements of a repeated or map field each get their own keys, so that
+// they stay with the elements when the field is changed.
+func (u *unknownJSON) attach(name string, val starlark.Value) {
+	if u == nil {
+		return
+	}
+	field, ok := u.fields[name]
+	if !ok {
+		return
+	}
+	switch val := val.(type) {
+	case *skyProtoMessage:
+		val.unknownJSON = field.msg
+	case *protoRepeated:
+		val.unknown = field.list
+	case *protoMap:
+		for _, item := range val.dict.Items() {
+			if sub, ok := item[1].(*skyProtoMessage); ok {
+				sub.unknownJSON = field.dict[jsonMapKey(item[0])]
+			}
+		}
+	}
+}
+
+// currentUnknownJSON returns the unknown keys of msg as it is now. Keys
+// within fields whose wrappers are cached are taken from the wrappers, in
+// case the fields' elements have been moved or replaced.
+func (msg *skyProtoMessage) currentUnknownJSON() *unknownJSON {
+	if msg.unknownJSON == nil {
+		return nil
+	}
+	msg.attrMu.Lock()
+	cached := make(map[string]starlark.Value, len(msg.attrCache))
+	for name, attr := range msg.attrCache {
+		cached[name] = attr
+	}
+	msg.attrMu.Unlock()
+	u := &unknownJSON{keys: msg.unknownJSON.keys, values: msg.unknownJSON.values, fields: make(map[string]*unknownJSONField)}
+	for key, field := range msg.unknownJSON.fields {
+		u.fields[key] = field
+	}
+	for name, attr := range cached {
+		old, ok := msg.unknownJSON.fields[name]
+		if !ok {
+			continue
+		}
+		var field *unknownJSONField
+		switch attr := attr.(type) {
+		case *skyProtoMessage:
+			if sub := attr.currentUnknownJSON(); sub != nil {
+				field = &unknownJSONField{msg: sub}
+			}
+		case *protoRepeated:
+			field = attr.currentUnknownJSON()
+		case *protoMap:
+			field = attr.currentUnknownJSON()
+		default:
+			continue
+		}
+		for key, other := range u.fields {
+			if other != old {
+				continue
+			}
+			if field == nil {
+				delete(u.fields, key)
+			} else {
+				u.fields[key] = field
+			}
+		}
+	}
+	if len(u.keys) == 0 && len(u.fields) == 0 {
+		return nil
+	}
+	return u
+}
+
+func (r *protoRepeated) currentUnknownJSON() *unknownJSONField {
+	items := r.converted()
+	list := make([]*unknownJSON, r.Len())
+	found := false
+	for ii := range list {
+		if ii < len(items) && items[ii] != nil {
+			if sub, ok := items[ii].(*skyProtoMessage); ok {
+				list[ii] = sub.currentUnknownJSON()
+			}
+		} else if ii < len(r.unknown) {
+			// Elements are only left unconverted until the field is
+			// changed, so this one is still at its original index.
+			list[ii] = r.unknown[ii]
+		}
+		found = found || list[ii] != nil
+	}
+	if !found {
+		return nil
+	}
+	return &unknownJSONField{list: list}
+}
+
+func (m *protoMap) currentUnknownJSON() *unknownJSONField {
+	var dict map[string]*unknownJSON
+	for _, item := range m.dict.Items() {
+		sub, ok := item[1].(*skyProtoMessage)
+		if !ok {
+			continue
+		}
+		if u := sub.currentUnknownJSON(); u != nil {
+			if dict == nil {
+				dict = make(map[string]*unknownJSON)
+			}
+			dict[jsonMapKey(item[0])] = u
+		}
+	}
+	if dict == nil {
+		return nil
+	}
+	return &unknownJSONField{dict: dict}
+}
+
+// jsonMapKey returns the JSON object key of a map field's key.
+func jsonMapKey(k starlark.Value) string {
+	switch k := k.(type) {
+	case starlark.String:
+		return string(k)
+	case starlark.Bool:
+		if k {
+			return "true"
+		}
+		return "false"
+	}
+	return k.String()
+}
+
+// collectUnknownJSON returns the keys of a JSON object, and of the objects
+// of its message fields, that aren't fields of the message type, or nil if
+// there aren't any. Well-known types have their own JSON encodings, so
+// they're never searched.
+func collectUnknownJSON(md protoreflect.MessageDescriptor, data json.RawMessage) (*unknownJSON, error) {
+	if strings.HasPrefix(string(md.FullName()), "google.protobuf.") {
+		return nil, nil
+	}
+	keys, values, err := decodeJSONObject(data)
+	if err != nil || keys == nil {
+		return nil, err
+	}
+	u := &unknownJSON{values: make(map[string]json.RawMessage), fields: make(map[string]*unknownJSONField)}
+	for _, key := range keys {
+		fd := md.Fields().ByName(protoreflect.Name(key))
+		if fd == nil {
+			fd = md.Fields().ByJSONName(key)
+		}
+		if fd == nil {
+			if strings.HasPrefix(key, "[") {
+				// Extensions are decoded by name.
+				continue
+			}
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, values[key]); err != nil {
+				return nil, err
+			}
+			u.keys = append(u.keys, key)
+			u.values[key] = compact.Bytes()
+			continue
+		}
+		field, err := collectUnknownJSONField(fd, values[key])
+		if err != nil {
+			return nil, err
+		}
+		if field != nil {
+			u.fields[string(fd.Name())] = field
+			u.fields[fd.JSONName()] = field
+		}
+	}
+	if len(u.keys) == 0 && len(u.fields) == 0 {
+		return nil, nil
+	}
+	return u, nil
+}
+
+func collectUnknownJSONField(fd protoreflect.FieldDescriptor, data json.RawMessage) (*unknownJSONField, error) {
+	field := &unknownJSONField{}
+	switch {
+	case fd.IsMap():
+		if fd.MapValue().Message() == nil {
+			return nil, nil
+		}
+		keys, values, err := decodeJSONObject(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			u, err := collectUnknownJSON(fd.MapValue().Message(), values[key])
+			if err != nil {
+				return nil, err
+			}
+			if u != nil {
+				if field.dict == nil {
+					field.dict = make(map[string]*unknownJSON)
+				}
+				field.dict[key] = u
+			}
+		}
+		if field.dict == nil {
+			return nil, nil
+		}
+	case fd.IsList():
+		if fd.Message() == nil {
+			return nil, nil
+		}
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, nil
+		}
+		found := false
+		field.list = make([]*unknownJSON, len(items))
+		for ii, item := range items {
+			u, err := collectUnknownJSON(fd.Message(), item)
+			if err != nil {
+				return nil, err
+			}
+			field.list[ii] = u
+			found = found || u != nil
+		}
+		if !found {
+			return nil, nil
+		}
+	case fd.Message() != nil:
+		u, err := collectUnknownJSON(fd.Message(), data)
+		if err != nil || u == nil {
+			return nil, err
+		}
+		field.msg = u
+	default:
+		return nil, nil
+	}
+	return field, nil
+}
+
+// mergeUnknownJSON adds the unknown keys in u to the JSON encoding of a
+// message. Keys that the encoding already has are left alone.
+func mergeUnknownJSON(data []byte, u *unknownJSON) ([]byte, error) {
+	if u == nil {
+		return data, nil
+	}
+	keys, values, err := decodeJSONObject(data)
+	if err != nil || keys == nil {
+		return data, err
+	}
+	for _, key := range keys {
+		field, ok := u.fields[key]
+		if !ok {
+			continue
+		}
+		merged, err := field.merge(values[key])
+		if err != nil {
+			return nil, err
+		}
+		values[key] = merged
+	}
+	for _, key := range u.keys {
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+			values[key] = u.values[key]
+		}
+	}
+	return encodeJSONObject(keys, values), nil
+}
+
+func (field *unknownJSONField) merge(data json.RawMessage) (json.RawMessage, error) {
+	switch {
+	case field.dict != nil:
+		keys, values, err := decodeJSONObject(data)
+		if err != nil || keys == nil {
+			return data, err
+		}
+		for _, key := range keys {
+			if values[key], err = mergeUnknownJSON(values[key], field.dict[key]); err != nil {
+				return nil, err
+			}
+		}
+		return encodeJSONObject(keys, values), nil
+	case field.list != nil:
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return data, nil
+		}
+		var buf bytes.Buffer
+		buf.WriteByte('[')
+		for ii, item := range items {
+			if ii > 0 {
+				buf.WriteByte(',')
+			}
+			if ii < len(field.list) {
+				merged, err := mergeUnknownJSON(item, field.list[ii])
+				if err != nil {
+					return nil, err
+				}
+				item = merged
+			}
+			buf.Write(item)
+		}
+		buf.WriteByte(']')
+		return buf.Bytes(), nil
+	}
+	return mergeUnknownJSON(data, field.msg)
+}
+
+// decodeJSONObject returns the keys of a JSON object in order, and their
+// values. It returns nil keys if data isn't an object.
+func decodeJSONObject(data []byte) ([]string, map[string]json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+	if tok != json.Delim('{') {
+		return nil, nil, nil
+	}
+	keys := []string{}
+	values := make(map[string]json.RawMessage)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = value
+	}
+	return keys, values, nil
+}
+
+func encodeJSONObject(keys []string, values map[string]json.RawMessage) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for ii, key := range keys {
+		if ii > 0 {
+			buf.WriteByte(',')
+		}
+		encodedKey, _ := json.Marshal(key)
+		buf.Write(encodedKey)
+		buf.WriteByte(':')
+		buf.Write(values[key])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
@@ -27,6 +27,7 @@ import (
 	"github.com/golang/protobuf/descriptor"
 	"github.com/golang/protobuf/proto"
 	descriptor_pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 func mustParseFileDescriptor(gzBytes []byte) *descriptor_pb.FileDescriptorProto {
@@ -49,6 +50,9 @@ func mustParseFileDescriptor(gzBytes []byte) *descriptor_pb.FileDescriptorProto
 }
 
 func messageTypeName(msg proto.Message) string {
+	if m, ok := msg.(protoreflect.ProtoMessage); ok {
+		return string(m.ProtoReflect().Descriptor().FullName())
+	}
 	if hasName, ok := msg.(interface {
 		XXX_MessageName() string
 	}); ok {
@@ -0,0 +1,991 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+	"google.golang.org/protobuf/encoding/protowire"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Validation rules are read from the options of protovalidate
+// (buf.validate.field, .oneof and .message) and its predecessor
+// protoc-gen-validate (validate.rules, .required, .disabled and .ignored),
+// which number most of their rules the same way. The options are decoded
+// from the wire format, so neither needs to be linked into the binary.
+//
+// Only the standard rules of scalar, enum, repeated and map fields, and of
+// required fields and oneofs, are checked. Rules that need protovalidate
+// itself, such as CEL expressions and the rules of well-known types like
+// google.protobuf.Duration, are skipped.
+const (
+	protovalidateOption = 1159
+	pgvOption           = 1071
+	pgvIgnoredOption    = 1072
+)
+
+// A RuleViolation reports a field whose value breaks one of its validation
+// rules.
+type RuleViolation struct {
+	// Path locates the field within the validated message, such as
+	// "f_submsg.r_string[2]".
+	Path string
+
+	// Rule names the broken rule, such as "string.min_len".
+	Rule string
+
+	Message string
+
+	// Origin describes where the field, or the field that contains it, was
+	// assigned, such as "at main.sky:12", if it's known.
+	Origin string
+}
+
+func (v RuleViolation) String() string {
+	if v.Origin != "" {
+		return fmt.Sprintf("%s: %s [%s] (set %s)", v.Path, v.Message, v.Rule, v.Origin)
+	}
+	return fmt.Sprintf("%s: %s [%s]", v.Path, v.Message, v.Rule)
+}
+
+// A RuleError reports that a message breaks the validation rules declared
+// by its schema.
+type RuleError struct {
+	// MessageType is the full name of the validated message's type.
+	MessageType string
+
+	// Pos is where the message was created, if it was created by a
+	// Starlark call.
+	Pos syntax.Position
+
+	Violations []RuleViolation
+}
+
+func (e *RuleError) Error() string {
+	var buf strings.Builder
+	if e.Pos.IsValid() {
+		fmt.Fprintf(&buf, "%s: ", e.Pos)
+	}
+	fmt.Fprintf(&buf, "%s breaks its validation rules: ", e.MessageType)
+	for ii, v := range e.Violations {
+		if ii > 0 {
+			buf.WriteString("; ")
+		}
+		buf.WriteString(v.String())
+	}
+	return buf.String()
+}
+
+// Implementation of the `proto.validate()` built-in function. Fails if a
+// message breaks the standard validation rules declared in its schema
+// with protovalidate or protoc-gen-validate, reporting every broken rule.
+// Rules that aren't standard, such as CEL expressions, are skipped.
+//
+//  def proto.validate(msg)
+func fnProtoValidate(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msg *skyProtoMessage
+	if err := wantSingleProtoMessage("proto.validate", args, kwargs, &msg); err != nil {
+		return nil, err
+	}
+	if err := ValidateMessage(msg); err != nil {
+		return nil, fmt.Errorf("%s: %v", "proto.validate", err)
+	}
+	return starlark.None, nil
+}
+
+// ValidateMessage returns a *RuleError if a message value breaks the
+// standard validation rules declared in its schema, or nil if it doesn't
+// or isn't a message.
+func ValidateMessage(val starlark.Value) error {
+	msg, ok := val.(*skyProtoMessage)
+	if !ok {
+		return nil
+	}
+	return ValidateProtoMessage(msg.msg, msg)
+}
+
+// ValidateProtoMessage is ValidateMessage for a Go message that was made
+// from val, such as by expanding its placeholders. If val is a message,
+// the positions it recorded are reported.
+func ValidateProtoMessage(msg proto.Message, val starlark.Value) error {
+	var violations []RuleViolation
+	validateMessage(proto.MessageV2(msg).ProtoReflect(), "", &violations)
+	if len(violations) == 0 {
+		return nil
+	}
+	ruleErr := &RuleError{MessageType: proto.MessageName(msg), Violations: violations}
+	if sky, ok := val.(*skyProtoMessage); ok {
+		ruleErr.Pos = sky.pos
+		origins := make(map[string]string)
+		fieldOrigins(sky, "", origins)
+		for ii := range violations {
+			violations[ii].Origin = originOf(origins, violations[ii].Path)
+		}
+	}
+	return ruleErr
+}
+
+// fieldOrigins records where the fields of a message value and its
+// submessages were assigned, by their paths. Submessages are only found if
+// their wrappers are cached.
+func fieldOrigins(val starlark.Value, path string, origins map[string]string) {
+	switch val := val.(type) {
+	case *skyProtoMessage:
+		for name, origin := range val.fieldSetAt {
+			origins[joinFieldPath(path, name)] = origin
+		}
+		val.attrMu.Lock()
+		cached := make(map[string]starlark.Value, len(val.attrCache))
+		for name, attr := range val.attrCache {
+			cached[name] = attr
+		}
+		val.attrMu.Unlock()
+		for name, attr := range cached {
+			fieldOrigins(attr, joinFieldPath(path, name), origins)
+		}
+	case *protoRepeated:
+		for ii, elem := range val.converted() {
+			if elem != nil {
+				fieldOrigins(elem, fmt.Sprintf("%s[%d]", path, ii), origins)
+			}
+		}
+	case *protoMap:
+		for _, item := range val.dict.Items() {
+			var key interface{} = item[0]
+			switch k := item[0].(type) {
+			case starlark.String:
+				key = string(k)
+			case starlark.Bool:
+				key = bool(k)
+			}
+			fieldOrigins(item[1], mapEntryPath(path, key), origins)
+		}
+	}
+}
+
+// originOf returns where the field at path was assigned, or failing that
+// the nearest field containing it.
+func originOf(origins map[string]string, path string) string {
+	for {
+		if origin, ok := origins[path]; ok {
+			return origin
+		}
+		ii := strings.LastIndexAny(path, ".[")
+		if ii < 0 {
+			return ""
+		}
+		path = path[:ii]
+	}
+}
+
+// mapEntryPath returns the path of a map field's entry.
+func mapEntryPath(path string, key interface{}) string {
+	if str, ok := key.(string); ok {
+		return fmt.Sprintf("%s[%q]", path, str)
+	}
+	return fmt.Sprintf("%s[%v]", path, key)
+}
+
+func validateMessage(m protoreflect.Message, path string, violations *[]RuleViolation) {
+	msgRules := messageRulesOf(m.Descriptor())
+	if msgRules.disabled {
+		return
+	}
+	for _, oneof := range msgRules.requiredOneofs {
+		if m.WhichOneof(oneof) == nil {
+			*violations = append(*violations, RuleViolation{Path: joinFieldPath(path, string(oneof.Name())), Rule: "required", Message: "exactly one field is required in oneof"})
+		}
+	}
+	fields := m.Descriptor().Fields()
+	for ii := 0; ii < fields.Len(); ii++ {
+		fd := fields.Get(ii)
+		rules := fieldRulesOf(fd)
+		name := joinFieldPath(path, string(fd.Name()))
+		// Fields without presence are unpopulated if they're zero or
+		// empty. The rules of those that are scalars still apply to
+		// their zero value, and those of repeated and map fields to
+		// their emptiness.
+		if !m.Has(fd) {
+			if rules != nil && rules.required {
+				*violations = append(*violations, RuleViolation{Path: name, Rule: "required", Message: "value is required"})
+				continue
+			}
+			if fd.HasPresence() || (rules != nil && rules.ignoreEmpty) {
+				continue
+			}
+		}
+		v := m.Get(fd)
+		switch {
+		case fd.IsList():
+			list := v.List()
+			if rules != nil {
+				rules.checkCount(name, "repeated", "items", list.Len(), violations)
+				// Messages are compared by CEL, so their uniqueness
+				// isn't checked.
+				if rules.unique && fd.Message() == nil {
+					checkUnique(list, name, violations)
+				}
+			}
+			for jj := 0; jj < list.Len(); jj++ {
+				elemPath := fmt.Sprintf("%s[%d]", name, jj)
+				if rules != nil && rules.items != nil && !rules.items.skipsElem(fd, list.Get(jj)) {
+					rules.items.checkValue(fd, list.Get(jj), elemPath, violations)
+				}
+				if fd.Message() != nil {
+					validateMessage(list.Get(jj).Message(), elemPath, violations)
+				}
+			}
+		case fd.IsMap():
+			m := v.Map()
+			if rules != nil {
+				rules.checkCount(name, "map", "pairs", m.Len(), violations)
+			}
+			rangeMapSorted(m, func(k protoreflect.MapKey, v protoreflect.Value) bool {
+				entryPath := mapEntryPath(name, k.Interface())
+				if rules != nil && rules.keys != nil && !rules.keys.skipsElem(fd.MapKey(), k.Value()) {
+					rules.keys.checkValue(fd.MapKey(), k.Value(), entryPath, violations)
+				}
+				if rules != nil && rules.values != nil && !rules.values.skipsElem(fd.MapValue(), v) {
+					rules.values.checkValue(fd.MapValue(), v, entryPath, violations)
+				}
+				if fd.MapValue().Message() != nil {
+					validateMessage(v.Message(), entryPath, violations)
+				}
+				return true
+			})
+		default:
+			if rules != nil && !(rules.ignoreDefault && v.Equal(fd.Default())) {
+				rules.checkValue(fd, v, name, violations)
+			}
+			if fd.Message() != nil {
+				validateMessage(v.Message(), name, violations)
+			}
+		}
+	}
+}
+
+// rangeMapSorted is Range for a map field, in key order, so that
+// violations are reported in the same order every time.
+func rangeMapSorted(m protoreflect.Map, f func(protoreflect.MapKey, protoreflect.Value) bool) {
+	keys := make([]protoreflect.MapKey, 0, m.Len())
+	m.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+		keys = append(keys, k)
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		switch a := keys[i].Interface().(type) {
+		case bool:
+			return !a && keys[j].Bool()
+		case int32, int64:
+			return keys[i].Int() < keys[j].Int()
+		case uint32, uint64:
+			return keys[i].Uint() < keys[j].Uint()
+		}
+		return keys[i].String() < keys[j].String()
+	})
+	for _, k := range keys {
+		if !f(k, m.Get(k)) {
+			return
+		}
+	}
+}
+
+// checkUnique checks the "repeated.unique" rule of a list of scalars.
+func checkUnique(list protoreflect.List, path string, violations *[]RuleViolation) {
+	seen := make(map[interface{}]bool, list.Len())
+	for ii := 0; ii < list.Len(); ii++ {
+		key := list.Get(ii).Interface()
+		if b, ok := key.([]byte); ok {
+			key = string(b)
+		}
+		if seen[key] {
+			*violations = append(*violations, RuleViolation{Path: path, Rule: "repeated.unique", Message: "repeated value must contain unique items"})
+			return
+		}
+		seen[key] = true
+	}
+}
+
+// messageRules are the validation rules of a message type, rather than of
+// its fields.
+type messageRules struct {
+	disabled       bool
+	requiredOneofs []protoreflect.OneofDescriptor
+}
+
+var messageRulesCache sync.Map // protoreflect.MessageDescriptor -> *messageRules
+
+func messageRulesOf(md protoreflect.MessageDescriptor) *messageRules {
+	if cached, ok := messageRulesCache.Load(md); ok {
+		return cached.(*messageRules)
+	}
+	rules := &messageRules{}
+	rangeOptions(md.Options(), func(num protowire.Number, typ protowire.Type, value []byte) {
+		switch {
+		case num == protovalidateOption && typ == protowire.BytesType:
+			rangeFields(value, func(num protowire.Number, typ protowire.Type, value []byte) {
+				// Other rules, such as CEL expressions, are skipped.
+				if num == 1 { // disabled
+					rules.disabled = decodeVarint(value) != 0
+				}
+			})
+		case (num == pgvOption || num == pgvIgnoredOption) && typ == protowire.VarintType:
+			// protoc-gen-validate's disabled and ignored options.
+			rules.disabled = rules.disabled || decodeVarint(value) != 0
+		}
+	})
+	oneofs := md.Oneofs()
+	for ii := 0; ii < oneofs.Len(); ii++ {
+		oneof := oneofs.Get(ii)
+		required := false
+		rangeOptions(oneof.Options(), func(num protowire.Number, typ protowire.Type, value []byte) {
+			switch {
+			case num == protovalidateOption && typ == protowire.BytesType:
+				rangeFields(value, func(num protowire.Number, typ protowire.Type, value []byte) {
+					if num == 1 {
+						required = decodeVarint(value) != 0
+					}
+				})
+			case num == pgvOption && typ == protowire.VarintType:
+				required = decodeVarint(value) != 0
+			}
+		})
+		if required {
+			rules.requiredOneofs = append(rules.requiredOneofs, oneof)
+		}
+	}
+	messageRulesCache.Store(md, rules)
+	return rules
+}
+
+// fieldRules are the validation rules of a field, or of the elements of a
+// repeated or map field.
+type fieldRules struct {
+	required bool
+
+	// ignoreEmpty skips the rules of an unpopulated field, or of an
+	// element that's zero. ignoreDefault also skips the rules of a field
+	// that's set to its default value.
+	ignoreEmpty   bool
+	ignoreDefault bool
+
+	// kind is the type of the rules, such as "string" or "int32", and
+	// scalar holds the decoded rules of that type.
+	kind   string
+	scalar *scalarRules
+
+	// counts of elements for "repeated" and "map" rules.
+	minCount, maxCount *uint64
+	unique             bool
+	items, keys        *fieldRules
+	values             *fieldRules
+
+	// pgv is whether the rules are protoc-gen-validate's, whose
+	// ignore_empty rules have numbers that protovalidate uses for others.
+	pgv bool
+}
+
+type scalarRules struct {
+	// bounds and allowed values for numbers, and the lengths of strings
+	// and bytes.
+	constant         *big.Float
+	lt, lte, gt, gte *big.Float
+	in, notIn        []*big.Float
+	finite           bool
+	boolConst        *bool
+	minLen, maxLen   *uint64
+	exactLen         *uint64
+	minBytes         *uint64
+	maxBytes         *uint64
+	exactBytes       *uint64
+	strConst         *string
+	prefix, suffix   *string
+	contains         *string
+	notContains      *string
+	pattern          *regexp.Regexp
+	strIn, strNotIn  []string
+	definedOnly      bool
+	invalidPattern   string
+
+	// format is a well-known format that strings or bytes must have,
+	// such as "email" or "ipv4".
+	format string
+}
+
+var fieldRulesCache sync.Map // protoreflect.FieldDescriptor -> *fieldRules
+
+// fieldRulesOf returns the validation rules of a field, or nil if it has
+// none.
+func fieldRulesOf(fd protoreflect.FieldDescriptor) *fieldRules {
+	if cached, ok := fieldRulesCache.Load(fd); ok {
+		return cached.(*fieldRules)
+	}
+	var rules *fieldRules
+	rangeOptions(fd.Options(), func(num protowire.Number, typ protowire.Type, value []byte) {
+		if (num == protovalidateOption || num == pgvOption) && typ == protowire.BytesType {
+			rules = decodeFieldRules(value, num == pgvOption)
+		}
+	})
+	fieldRulesCache.Store(fd, rules)
+	return rules
+}
+
+// rangeOptions calls f for each field in the wire encoding of a
+// descriptor's options, as rangeFields does.
+func rangeOptions(opts protoreflect.ProtoMessage, f func(num protowire.Number, typ protowire.Type, value []byte)) {
+	if opts == nil || !opts.ProtoReflect().IsValid() {
+		return
+	}
+	data, err := protov2.Marshal(opts)
+	if err != nil {
+		return
+	}
+	rangeFields(data, f)
+}
+
+// ruleKinds are the names of the FieldRules fields that hold the rules of
+// each type.
+var ruleKinds = map[protowire.Number]string{
+	1: "float", 2: "double", 3: "int32", 4: "int64", 5: "uint32", 6: "uint64",
+	7: "sint32", 8: "sint64", 9: "fixed32", 10: "fixed64", 11: "sfixed32", 12: "sfixed64",
+	13: "bool", 14: "string", 15: "bytes", 16: "enum", 18: "repeated", 19: "map",
+}
+
+// rangeFields calls f for each field in the wire encoding of a message.
+// Bytes fields are passed their contents, and other fields their raw
+// value.
+func rangeFields(data []byte, f func(num protowire.Number, typ protowire.Type, value []byte)) {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return
+		}
+		data = data[n:]
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return
+		}
+		value := data[:n]
+		if typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(value)
+		}
+		f(num, typ, value)
+		data = data[n:]
+	}
+}
+
+// decodeFieldRules decodes a FieldRules message, skipping the rules that
+// aren't supported, such as those of well-known types (any, duration and
+// timestamp) and CEL expressions.
+func decodeFieldRules(data []byte, pgv bool) *fieldRules {
+	rules := &fieldRules{pgv: pgv}
+	ignore := false
+	rangeFields(data, func(num protowire.Number, typ protowire.Type, value []byte) {
+		switch {
+		case num == 25 && typ == protowire.VarintType: // required
+			rules.required = decodeVarint(value) != 0
+		case num == 27 && typ == protowire.VarintType: // ignore
+			switch decodeVarint(value) {
+			case 1: // IGNORE_IF_UNPOPULATED
+				rules.ignoreEmpty = true
+			case 2: // IGNORE_IF_DEFAULT_VALUE
+				rules.ignoreEmpty = true
+				rules.ignoreDefault = true
+			case 3: // IGNORE_ALWAYS
+				ignore = true
+			}
+		case num == 24 && typ == protowire.VarintType && !pgv: // skipped, which ignore replaced
+			ignore = decodeVarint(value) != 0
+		case num == 26 && typ == protowire.VarintType && !pgv: // ignore_empty, which ignore replaced
+			rules.ignoreEmpty = decodeVarint(value) != 0
+		case num == 17 && typ == protowire.BytesType && pgv: // message
+			rangeFields(value, func(num protowire.Number, typ protowire.Type, value []byte) {
+				switch num {
+				case 1: // skip
+					ignore = decodeVarint(value) != 0
+				case 2: // required
+					rules.required = decodeVarint(value) != 0
+				}
+			})
+		case typ == protowire.BytesType && ruleKinds[num] != "":
+			rules.kind = ruleKinds[num]
+			rules.decodeKind(value)
+		}
+	})
+	if ignore {
+		return &fieldRules{}
+	}
+	return rules
+}
+
+// decodeKind decodes the rules of the rules' kind, skipping those that
+// aren't supported.
+func (rules *fieldRules) decodeKind(data []byte) {
+	switch rules.kind {
+	case "repeated", "map":
+		rangeFields(data, func(num protowire.Number, typ protowire.Type, value []byte) {
+			switch {
+			case num == 1 && typ == protowire.VarintType:
+				n := decodeVarint(value)
+				rules.minCount = &n
+			case num == 2 && typ == protowire.VarintType:
+				n := decodeVarint(value)
+				rules.maxCount = &n
+			case num == 3 && typ == protowire.VarintType && rules.kind == "repeated":
+				rules.unique = decodeVarint(value) != 0
+			case num == 4 && typ == protowire.BytesType && rules.kind == "repeated":
+				rules.items = decodeFieldRules(value, rules.pgv)
+			case num == 4 && typ == protowire.BytesType:
+				rules.keys = decodeFieldRules(value, rules.pgv)
+			case num == 5 && typ == protowire.BytesType && rules.kind == "map":
+				rules.values = decodeFieldRules(value, rules.pgv)
+			case rules.pgv && typ == protowire.VarintType && (rules.kind == "repeated" && num == 5 || rules.kind == "map" && num == 6):
+				rules.ignoreEmpty = decodeVarint(value) != 0
+			}
+		})
+		return
+	}
+	s := &scalarRules{}
+	rules.scalar = s
+	rangeFields(data, func(num protowire.Number, typ protowire.Type, value []byte) {
+		switch rules.kind {
+		case "string", "bytes":
+			rules.decodeString(num, typ, value)
+		case "bool":
+			switch num {
+			case 1:
+				b := decodeVarint(value) != 0
+				s.boolConst = &b
+			}
+		case "enum":
+			switch num {
+			case 1:
+				s.constant = rules.decodeNumbers(typ, value)[0]
+			case 2:
+				s.definedOnly = decodeVarint(value) != 0
+			case 3:
+				s.in = append(s.in, rules.decodeNumbers(typ, value)...)
+			case 4:
+				s.notIn = append(s.notIn, rules.decodeNumbers(typ, value)...)
+			}
+		default:
+			if num == 8 {
+				switch {
+				case rules.pgv: // ignore_empty
+					rules.ignoreEmpty = decodeVarint(value) != 0
+				case rules.kind == "float" || rules.kind == "double":
+					s.finite = decodeVarint(value) != 0
+				}
+				return
+			}
+			numbers := rules.decodeNumbers(typ, value)
+			if len(numbers) == 0 {
+				return
+			}
+			switch num {
+			case 1:
+				s.constant = numbers[0]
+			case 2:
+				s.lt = numbers[0]
+			case 3:
+				s.lte = numbers[0]
+			case 4:
+				s.gt = numbers[0]
+			case 5:
+				s.gte = numbers[0]
+			case 6:
+				s.in = append(s.in, numbers...)
+			case 7:
+				s.notIn = append(s.notIn, numbers...)
+			}
+		}
+	})
+}
+
+// decodeString decodes a rule of StringRules or BytesRules. Rules that
+// aren't supported, such as well_known_regex, are skipped.
+func (rules *fieldRules) decodeString(num protowire.Number, typ protowire.Type, value []byte) {
+	s := rules.scalar
+	// StringRules and BytesRules number their rules differently.
+	lengths := map[protowire.Number]**uint64{19: &s.exactLen, 2: &s.minLen, 3: &s.maxLen, 20: &s.exactBytes, 4: &s.minBytes, 5: &s.maxBytes}
+	patternNum, prefixNum, suffixNum, containsNum, notContainsNum, inNum, notInNum := protowire.Number(6), protowire.Number(7), protowire.Number(8), protowire.Number(9), protowire.Number(23), protowire.Number(10), protowire.Number(11)
+	formats, ignoreEmptyNum := stringFormats, protowire.Number(26)
+	if rules.kind == "bytes" {
+		lengths = map[protowire.Number]**uint64{13: &s.exactLen, 2: &s.minLen, 3: &s.maxLen}
+		patternNum, prefixNum, suffixNum, containsNum, notContainsNum, inNum, notInNum = 4, 5, 6, 7, 0, 8, 9
+		formats, ignoreEmptyNum = bytesFormats, 14
+	}
+	if dst, ok := lengths[num]; ok && typ == protowire.VarintType {
+		n := decodeVarint(value)
+		*dst = &n
+		return
+	}
+	// protoc-gen-validate has no formats numbered above uuid.
+	if format, ok := formats[num]; ok && typ == protowire.VarintType && (!rules.pgv || num <= 22) {
+		if decodeVarint(value) != 0 {
+			s.format = format
+		}
+		return
+	}
+	if rules.pgv && num == ignoreEmptyNum && typ == protowire.VarintType {
+		rules.ignoreEmpty = decodeVarint(value) != 0
+		return
+	}
+	if typ != protowire.BytesType {
+		return
+	}
+	str := string(value)
+	switch num {
+	case 1:
+		s.strConst = &str
+	case patternNum:
+		re, err := regexp.Compile(str)
+		if err != nil {
+			s.invalidPattern = str
+			return
+		}
+		s.pattern = re
+	case prefixNum:
+		s.prefix = &str
+	case suffixNum:
+		s.suffix = &str
+	case containsNum:
+		s.contains = &str
+	case notContainsNum:
+		s.notContains = &str
+	case inNum:
+		s.strIn = append(s.strIn, str)
+	case notInNum:
+		s.strNotIn = append(s.strNotIn, str)
+	}
+}
+
+func decodeVarint(value []byte) uint64 {
+	v, _ := protowire.ConsumeVarint(value)
+	return v
+}
+
+// decodeNumbers decodes a number rule, or the packed numbers of a repeated
+// rule, according to the type of the rules.
+func (rules *fieldRules) decodeNumbers(typ protowire.Type, value []byte) []*big.Float {
+	var numbers []*big.Float
+	decode := func(typ protowire.Type, data []byte) int {
+		switch {
+		case typ == protowire.Fixed32Type && rules.kind == "float":
+			v, n := protowire.ConsumeFixed32(data)
+			numbers = append(numbers, bigFloat(float64(math.Float32frombits(v))))
+			return n
+		case typ == protowire.Fixed64Type && rules.kind == "double":
+			v, n := protowire.ConsumeFixed64(data)
+			numbers = append(numbers, bigFloat(math.Float64frombits(v)))
+			return n
+		case typ == protowire.Fixed32Type && rules.kind == "fixed32":
+			v, n := protowire.ConsumeFixed32(data)
+			numbers = append(numbers, new(big.Float).SetUint64(uint64(v)))
+			return n
+		case typ == protowire.Fixed32Type && rules.kind == "sfixed32":
+			v, n := protowire.ConsumeFixed32(data)
+			numbers = append(numbers, new(big.Float).SetInt64(int64(int32(v))))
+			return n
+		case typ == protowire.Fixed64Type && rules.kind == "fixed64":
+			v, n := protowire.ConsumeFixed64(data)
+			numbers = append(numbers, new(big.Float).SetUint64(v))
+			return n
+		case typ == protowire.Fixed64Type && rules.kind == "sfixed64":
+			v, n := protowire.ConsumeFixed64(data)
+			numbers = append(numbers, new(big.Float).SetInt64(int64(v)))
+			return n
+		case typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			switch rules.kind {
+			case "uint32", "uint64":
+				numbers = append(numbers, new(big.Float).SetUint64(v))
+			case "int32", "enum":
+				numbers = append(numbers, new(big.Float).SetInt64(int64(int32(v))))
+			case "sint32", "sint64":
+				numbers = append(numbers, new(big.Float).SetInt64(protowire.DecodeZigZag(v)))
+			case "int64":
+				numbers = append(numbers, new(big.Float).SetInt64(int64(v)))
+			default:
+				return -1
+			}
+			return n
+		}
+		return -1
+	}
+	if typ != protowire.BytesType {
+		decode(typ, value)
+		return numbers
+	}
+	packedType := protowire.VarintType
+	switch rules.kind {
+	case "float", "fixed32", "sfixed32":
+		packedType = protowire.Fixed32Type
+	case "double", "fixed64", "sfixed64":
+		packedType = protowire.Fixed64Type
+	}
+	for len(value) > 0 {
+		n := decode(packedType, value)
+		if n < 0 {
+			break
+		}
+		value = value[n:]
+	}
+	return numbers
+}
+
+func bigFloat(f float64) *big.Float {
+	if math.IsNaN(f) {
+		return nil
+	}
+	return big.NewFloat(f)
+}
+
+func (rules *fieldRules) checkCount(path, kind, noun string, count int, violations *[]RuleViolation) {
+	if rules.kind != kind {
+		return
+	}
+	if rules.minCount != nil && uint64(count) < *rules.minCount {
+		*violations = append(*violations, RuleViolation{Path: path, Rule: kind + ".min_" + noun, Message: fmt.Sprintf("value must contain at least %d %s", *rules.minCount, noun)})
+	}
+	if rules.maxCount != nil && uint64(count) > *rules.maxCount {
+		*violations = append(*violations, RuleViolation{Path: path, Rule: kind + ".max_" + noun, Message: fmt.Sprintf("value must contain at most %d %s", *rules.maxCount, noun)})
+	}
+}
+
+// checkValue checks a singular value, or an element of a repeated or map
+// field.
+func (rules *fieldRules) checkValue(fd protoreflect.FieldDescriptor, v protoreflect.Value, path string, violations *[]RuleViolation) {
+	s := rules.scalar
+	if s == nil {
+		return
+	}
+	violate := func(rule, format string, args ...interface{}) {
+		*violations = append(*violations, RuleViolation{Path: path, Rule: rules.kind + "." + rule, Message: fmt.Sprintf(format, args...)})
+	}
+	switch rules.kind {
+	case "string", "bytes":
+		var str string
+		var length uint64
+		unit := "characters"
+		if rules.kind == "string" {
+			str = v.String()
+			length = uint64(utf8.RuneCountInString(str))
+		} else {
+			str = string(v.Bytes())
+			length = uint64(len(str))
+			unit = "bytes"
+		}
+		if s.strConst != nil && str != *s.strConst {
+			violate("const", "value must equal %q", *s.strConst)
+		}
+		if s.exactLen != nil && length != *s.exactLen {
+			violate("len", "value length must be %d %s", *s.exactLen, unit)
+		}
+		if s.minLen != nil && length < *s.minLen {
+			violate("min_len", "value length must be at least %d %s", *s.minLen, unit)
+		}
+		if s.maxLen != nil && length > *s.maxLen {
+			violate("max_len", "value length must be at most %d %s", *s.maxLen, unit)
+		}
+		if s.exactBytes != nil && uint64(len(str)) != *s.exactBytes {
+			violate("len_bytes", "value length must be %d bytes", *s.exactBytes)
+		}
+		if s.minBytes != nil && uint64(len(str)) < *s.minBytes {
+			violate("min_bytes", "value length must be at least %d bytes", *s.minBytes)
+		}
+		if s.maxBytes != nil && uint64(len(str)) > *s.maxBytes {
+			violate("max_bytes", "value length must be at most %d bytes", *s.maxBytes)
+		}
+		if s.prefix != nil && !strings.HasPrefix(str, *s.prefix) {
+			violate("prefix", "value does not have prefix %q", *s.prefix)
+		}
+		if s.suffix != nil && !strings.HasSuffix(str, *s.suffix) {
+			violate("suffix", "value does not have suffix %q", *s.suffix)
+		}
+		if s.contains != nil && !strings.Contains(str, *s.contains) {
+			violate("contains", "value does not contain %q", *s.contains)
+		}
+		if s.notContains != nil && strings.Contains(str, *s.notContains) {
+			violate("not_contains", "value contains %q", *s.notContains)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			violate("pattern", "value does not match regex pattern %q", s.pattern.String())
+		}
+		if s.invalidPattern != "" {
+			violate("pattern", "invalid regex pattern %q", s.invalidPattern)
+		}
+		if len(s.strIn) > 0 && !containsStr(s.strIn, str) {
+			violate("in", "value must be in list %q", s.strIn)
+		}
+		if containsStr(s.strNotIn, str) {
+			violate("not_in", "value must not be in list %q", s.strNotIn)
+		}
+		if s.format != "" && !hasFormat(rules.kind, s.format, str) {
+			violate(s.format, "value must be a valid %s", formatDescriptions[s.format])
+		}
+	case "bool":
+		if s.boolConst != nil && v.Bool() != *s.boolConst {
+			violate("const", "value must equal %t", *s.boolConst)
+		}
+	case "enum":
+		n := new(big.Float).SetInt64(int64(v.Enum()))
+		if s.definedOnly && fd.Enum() != nil && fd.Enum().Values().ByNumber(v.Enum()) == nil {
+			violate("defined_only", "value must be one of the defined enum values")
+		}
+		s.checkNumber(n, violate)
+	default:
+		var n *big.Float
+		switch fd.Kind() {
+		case protoreflect.FloatKind, protoreflect.DoubleKind:
+			n = bigFloat(v.Float())
+		case protoreflect.Uint32Kind, protoreflect.Uint64Kind, protoreflect.Fixed32Kind, protoreflect.Fixed64Kind:
+			n = new(big.Float).SetUint64(v.Uint())
+		case protoreflect.Int32Kind, protoreflect.Int64Kind, protoreflect.Sint32Kind, protoreflect.Sint64Kind,
+			protoreflect.Sfixed32Kind, protoreflect.Sfixed64Kind:
+			n = new(big.Float).SetInt64(v.Int())
+		default:
+			return
+		}
+		if s.finite && (n == nil || n.IsInf()) {
+			violate("finite", "value must be finite")
+			return
+		}
+		if n == nil {
+			// NaN breaks every rule that compares it.
+			if rule := s.numberRule(); rule != "" {
+				violate(rule, "value must be a number")
+			}
+			return
+		}
+		s.checkNumber(n, violate)
+	}
+}
+
+func (s *scalarRules) checkNumber(n *big.Float, violate func(rule, format string, args ...interface{})) {
+	if s.constant != nil && n.Cmp(s.constant) != 0 {
+		violate("const", "value must equal %s", s.constant.Text('g', -1))
+	}
+	lower, lowerRule, lowerOK := s.gt, "gt", func(c int) bool { return c > 0 }
+	if s.gte != nil {
+		lower, lowerRule, lowerOK = s.gte, "gte", func(c int) bool { return c >= 0 }
+	}
+	upper, upperRule, upperOK := s.lt, "lt", func(c int) bool { return c < 0 }
+	if s.lte != nil {
+		upper, upperRule, upperOK = s.lte, "lte", func(c int) bool { return c <= 0 }
+	}
+	describe := map[string]string{"gt": "greater than", "gte": "greater than or equal to", "lt": "less than", "lte": "less than or equal to"}
+	switch {
+	case lower != nil && upper != nil && lower.Cmp(upper) > 0:
+		// A lower bound above the upper bound excludes the range between
+		// them.
+		if !lowerOK(n.Cmp(lower)) && !upperOK(n.Cmp(upper)) {
+			violate(lowerRule, "value must be %s %s or %s %s", describe[lowerRule], lower.Text('g', -1), describe[upperRule], upper.Text('g', -1))
+		}
+	case lower != nil && upper != nil:
+		if !lowerOK(n.Cmp(lower)) || !upperOK(n.Cmp(upper)) {
+			violate(lowerRule, "value must be %s %s and %s %s", describe[lowerRule], lower.Text('g', -1), describe[upperRule], upper.Text('g', -1))
+		}
+	case lower != nil:
+		if !lowerOK(n.Cmp(lower)) {
+			violate(lowerRule, "value must be %s %s", describe[lowerRule], lower.Text('g', -1))
+		}
+	case upper != nil:
+		if !upperOK(n.Cmp(upper)) {
+			violate(upperRule, "value must be %s %s", describe[upperRule], upper.Text('g', -1))
+		}
+	}
+	if len(s.in) > 0 && !containsNumber(s.in, n) {
+		violate("in", "value must be in list %s", numberList(s.in))
+	}
+	if containsNumber(s.notIn, n) {
+		violate("not_in", "value must not be in list %s", numberList(s.notIn))
+	}
+}
+
+// numberRule returns the name of the first rule that compares numbers, or
+// "" if there are none.
+func (s *scalarRules) numberRule() string {
+	switch {
+	case s.constant != nil:
+		return "const"
+	case s.gt != nil:
+		return "gt"
+	case s.gte != nil:
+		return "gte"
+	case s.lt != nil:
+		return "lt"
+	case s.lte != nil:
+		return "lte"
+	case len(s.in) > 0:
+		return "in"
+	}
+	return ""
+}
+
+// skipsElem reports whether the rules of a repeated field's items, or a
+// map field's keys or values, ignore an element.
+func (rules *fieldRules) skipsElem(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+	return (rules.ignoreEmpty || rules.ignoreDefault) && isZeroValue(fd, v)
+}
+
+func isZeroValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+	if fd.Message() != nil {
+		return false
+	}
+	return v.Equal(fd.Default()) || v.Equal(protoreflect.ValueOf(fd.Default().Interface()))
+}
+
+func containsStr(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsNumber(items []*big.Float, n *big.Float) bool {
+	for _, item := range items {
+		if item != nil && item.Cmp(n) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func numberList(items []*big.Float) string {
+	strs := make([]string, 0, len(items))
+	for _, item := range items {
+		if item != nil {
+			strs = append(strs, item.Text('g', -1))
+		}
+	}
+	return "[" + strings.Join(strs, ", ") + "]"
+}
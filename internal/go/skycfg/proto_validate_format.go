@@ -0,0 +1,164 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+
+package skycfg
+
+import (
+	"net"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// stringFormats are the StringRules fields that require a well-known
+// format, by their field numbers.
+var stringFormats = map[protowire.Number]string{
+	12: "email", 13: "hostname", 14: "ip", 15: "ipv4", 16: "ipv6", 17: "uri",
+	18: "uri_ref", 21: "address", 22: "uuid", 26: "ip_with_prefixlen",
+	27: "ipv4_with_prefixlen", 28: "ipv6_with_prefixlen", 29: "ip_prefix",
+	30: "ipv4_prefix", 31: "ipv6_prefix", 32: "host_and_port", 33: "tuuid",
+}
+
+// bytesFormats are the BytesRules fields that require an address.
+var bytesFormats = map[protowire.Number]string{10: "ip", 11: "ipv4", 12: "ipv6"}
+
+var formatDescriptions = map[string]string{
+	"email":               "email address",
+	"hostname":            "hostname",
+	"ip":                  "IP address",
+	"ipv4":                "IPv4 address",
+	"ipv6":                "IPv6 address",
+	"uri":                 "URI",
+	"uri_ref":             "URI reference",
+	"address":             "hostname or IP address",
+	"uuid":                "UUID",
+	"tuuid":               "UUID without dashes",
+	"ip_with_prefixlen":   "IP address with prefix length",
+	"ipv4_with_prefixlen": "IPv4 address with prefix length",
+	"ipv6_with_prefixlen": "IPv6 address with prefix length",
+	"ip_prefix":           "IP prefix",
+	"ipv4_prefix":         "IPv4 prefix",
+	"ipv6_prefix":         "IPv6 prefix",
+	"host_and_port":       "host and port pair",
+}
+
+var (
+	uuidPattern  = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	tuuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+)
+
+// hasFormat reports whether a string, or the contents of a bytes field,
+// has a well-known format.
+func hasFormat(kind, format, s string) bool {
+	if kind == "bytes" {
+		switch format {
+		case "ip":
+			return len(s) == net.IPv4len || len(s) == net.IPv6len
+		case "ipv4":
+			return len(s) == net.IPv4len
+		case "ipv6":
+			return len(s) == net.IPv6len
+		}
+		return false
+	}
+	switch format {
+	case "email":
+		addr, err := mail.ParseAddress(s)
+		if err != nil || addr.Name != "" || addr.Address != s {
+			return false
+		}
+		return isHostname(s[strings.LastIndexByte(s, '@')+1:])
+	case "hostname":
+		return isHostname(s)
+	case "ip", "ipv4", "ipv6":
+		addr, err := netip.ParseAddr(s)
+		return err == nil && ipVersionIs(format, addr)
+	case "uri":
+		u, err := url.Parse(s)
+		return err == nil && u.Scheme != ""
+	case "uri_ref":
+		_, err := url.Parse(s)
+		return err == nil
+	case "address":
+		_, err := netip.ParseAddr(s)
+		return err == nil || isHostname(s)
+	case "uuid":
+		return uuidPattern.MatchString(s)
+	case "tuuid":
+		return tuuidPattern.MatchString(s)
+	case "ip_with_prefixlen", "ipv4_with_prefixlen", "ipv6_with_prefixlen":
+		prefix, err := netip.ParsePrefix(s)
+		return err == nil && ipVersionIs(strings.TrimSuffix(format, "_with_prefixlen"), prefix.Addr())
+	case "ip_prefix", "ipv4_prefix", "ipv6_prefix":
+		// The address of a prefix has no bits set after its length.
+		prefix, err := netip.ParsePrefix(s)
+		return err == nil && prefix.Masked() == prefix && ipVersionIs(strings.TrimSuffix(format, "_prefix"), prefix.Addr())
+	case "host_and_port":
+		host, port, err := net.SplitHostPort(s)
+		if err != nil {
+			return false
+		}
+		if n, err := strconv.ParseUint(port, 10, 16); err != nil || strconv.FormatUint(n, 10) != port {
+			return false
+		}
+		if strings.HasPrefix(s, "[") {
+			addr, err := netip.ParseAddr(host)
+			return err == nil && addr.Is6()
+		}
+		addr, err := netip.ParseAddr(host)
+		return (err == nil && addr.Is4()) || isHostname(host)
+	}
+	return false
+}
+
+// ipVersionIs reports whether an address is of the version that a format
+// requires: "ip" for either, or "ipv4" or "ipv6".
+func ipVersionIs(version string, addr netip.Addr) bool {
+	switch version {
+	case "ipv4":
+		return addr.Is4()
+	case "ipv6":
+		return addr.Is6()
+	}
+	return true
+}
+
+// isHostname reports whether s is a hostname as defined by RFC 1123. Its
+// last label may not be numeric, so that IPv4 addresses aren't hostnames.
+func isHostname(s string) bool {
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	labels := strings.Split(s, ".")
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	_, err := strconv.ParseUint(labels[len(labels)-1], 10, 64)
+	return err != nil
+}
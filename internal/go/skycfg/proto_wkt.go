@@ -0,0 +1,388 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// A wellKnownConverter sets the fields of dst, an empty message of a
+// well-known type, from a Starlark value. It returns false if the type has
+// no conversion from values of sky's type.
+type wellKnownConverter func(t reflectType, dst protoreflect.Message, sky starlark.Value) (bool, error)
+
+// wellKnownConverterFor returns the conversion for a well-known type, or
+// nil. Conversions let fields of those types be assigned from the values
+// they represent, so that configs can write `timeout = "30s"` instead of
+// constructing a google.protobuf.Duration, or assign a dict to a
+// google.protobuf.Struct.
+func wellKnownConverterFor(name protoreflect.FullName) wellKnownConverter {
+	switch name {
+	case "google.protobuf.Duration":
+		return durationFromStarlark
+	case "google.protobuf.Timestamp":
+		return timestampFromStarlark
+	case "google.protobuf.DoubleValue", "google.protobuf.FloatValue",
+		"google.protobuf.Int64Value", "google.protobuf.UInt64Value",
+		"google.protobuf.Int32Value", "google.protobuf.UInt32Value",
+		"google.protobuf.BoolValue", "google.protobuf.StringValue",
+		"google.protobuf.BytesValue":
+		return wrapperFromStarlark
+	case "google.protobuf.Struct", "google.protobuf.Value", "google.protobuf.ListValue":
+		return structFromStarlark
+	}
+	return nil
+}
+
+// wellKnownFromStarlark converts a Starlark value to a message of a
+// well-known type, using newMessage to create it. It returns false if the
+// message type has no conversion from the value.
+func wellKnownFromStarlark(t reflectType, desc protoreflect.MessageDescriptor, newMessage func() protoreflect.Message, sky starlark.Value) (protoreflect.Message, bool, error) {
+	convert := wellKnownConverterFor(desc.FullName())
+	if convert == nil {
+		return nil, false, nil
+	}
+	switch sky.(type) {
+	case starlark.Int, starlark.Float, starlark.String, starlark.Bool:
+	case *starlark.Dict, *starlark.List, starlark.Tuple, *protoMap, *protoRepeated:
+	default:
+		return nil, false, nil
+	}
+	dst := newMessage()
+	ok, err := convert(t, dst, sky)
+	return dst, ok, err
+}
+
+// wellKnownGoFromStarlark is like wellKnownFromStarlark, for fields of
+// generated messages.
+func wellKnownGoFromStarlark(t reflect.Type, sky starlark.Value) (reflect.Value, bool, error) {
+	if t.Kind() != reflect.Ptr {
+		return reflect.Value{}, false, nil
+	}
+	msg, ok := reflect.New(t.Elem()).Interface().(protoreflect.ProtoMessage)
+	if !ok {
+		return reflect.Value{}, false, nil
+	}
+	kind := t.Elem().Kind()
+	dst, ok, err := wellKnownFromStarlark(reflectType{typeName(t), kind}, msg.ProtoReflect().Descriptor(), msg.ProtoReflect, sky)
+	if !ok || err != nil {
+		return reflect.Value{}, ok, err
+	}
+	return reflect.ValueOf(dst.Interface()), true, nil
+}
+
+// Durations are written like "1m30s", as accepted by time.ParseDuration.
+func durationFromStarlark(t reflectType, dst protoreflect.Message, sky starlark.Value) (bool, error) {
+	s, ok := sky.(starlark.String)
+	if !ok {
+		return false, nil
+	}
+	d, err := time.ParseDuration(string(s))
+	if err != nil {
+		return true, t.errorf(sky, "ValueError: value %s can't be converted to `%s': %v", sky.String(), t.name, err)
+	}
+	setSecondsNanos(dst, int64(d/time.Second), int32(d%time.Second))
+	return true, nil
+}
+
+// Timestamps are written as RFC 3339 strings, or as seconds since the Unix
+// epoch.
+func timestampFromStarlark(t reflectType, dst protoreflect.Message, sky starlark.Value) (bool, error) {
+	switch sky := sky.(type) {
+	case starlark.String:
+		ts, err := time.Parse(time.RFC3339Nano, string(sky))
+		if err != nil {
+			return true, t.errorf(sky, "ValueError: value %s can't be converted to `%s': %v", sky.String(), t.name, err)
+		}
+		setSecondsNanos(dst, ts.Unix(), int32(ts.Nanosecond()))
+		return true, nil
+	case starlark.Int:
+		seconds, ok := sky.Int64()
+		if !ok {
+			return true, t.errorf(sky, "ValueError: value %v overflows type `int64'.", sky)
+		}
+		setSecondsNanos(dst, seconds, 0)
+		return true, nil
+	}
+	return false, nil
+}
+
+func setSecondsNanos(dst protoreflect.Message, seconds int64, nanos int32) {
+	fields := dst.Descriptor().Fields()
+	if seconds != 0 {
+		dst.Set(fields.ByName("seconds"), protoreflect.ValueOfInt64(seconds))
+	}
+	if nanos != 0 {
+		dst.Set(fields.ByName("nanos"), protoreflect.ValueOfInt32(nanos))
+	}
+}
+
+// Wrappers are written as the value they wrap.
+func wrapperFromStarlark(t reflectType, dst protoreflect.Message, sky starlark.Value) (bool, error) {
+	fd := dst.Descriptor().Fields().ByName("value")
+	val, err := reflectValueFromStarlark(fd, t, nil, sky)
+	if err != nil {
+		return true, err
+	}
+	dst.Set(fd, val)
+	return true, nil
+}
+
+// wellKnownToDictValue converts a Duration, Timestamp, or wrapper message
+// into the value that fields of its type are assigned from, for
+// proto.to_dict(). It returns false for messages of other types, and for
+// durations too long to be written as a string.
+func wellKnownToDictValue(msg protoreflect.Message) (starlark.Value, bool) {
+	fields := msg.Descriptor().Fields()
+	switch msg.Descriptor().FullName() {
+	case "google.protobuf.Duration":
+		seconds := msg.Get(fields.ByName("seconds")).Int()
+		nanos := msg.Get(fields.ByName("nanos")).Int()
+		if seconds > math.MaxInt64/int64(time.Second)-1 || seconds < math.MinInt64/int64(time.Second)+1 {
+			return nil, false
+		}
+		d := time.Duration(seconds)*time.Second + time.Duration(nanos)
+		return starlark.String(d.String()), true
+	case "google.protobuf.Timestamp":
+		seconds := msg.Get(fields.ByName("seconds")).Int()
+		nanos := msg.Get(fields.ByName("nanos")).Int()
+		ts := time.Unix(seconds, nanos).UTC()
+		return starlark.String(ts.Format(time.RFC3339Nano)), true
+	}
+	if wellKnownConverterFor(msg.Descriptor().FullName()) == nil || isStructType(msg.Descriptor().FullName()) {
+		return nil, false
+	}
+	fd := fields.ByName("value")
+	return reflectToStarlark(fd, msg.Get(fd)), true
+}
+
+// isStructType reports whether messages of the named type are converted to
+// and from dicts, lists, and scalars rather than by field.
+func isStructType(name protoreflect.FullName) bool {
+	switch name {
+	case "google.protobuf.Struct", "google.protobuf.Value", "google.protobuf.ListValue":
+		return true
+	}
+	return false
+}
+
+// Structs, values, and lists of values are written as the dicts, lists,
+// and scalars they represent, as in JSON. None is a null value within a
+// dict or list; assigning None to a field clears it.
+func structFromStarlark(t reflectType, dst protoreflect.Message, sky starlark.Value) (bool, error) {
+	var src proto.Message
+	switch dst.Descriptor().FullName() {
+	case "google.protobuf.Struct":
+		dict, ok := starlarkDict(sky)
+		if !ok {
+			return false, nil
+		}
+		fields, err := structFieldsFromStarlark(t, dict)
+		if err != nil {
+			return true, err
+		}
+		src = &structpb.Struct{Fields: fields}
+	case "google.protobuf.ListValue":
+		values, ok, err := structListFromStarlark(t, sky)
+		if !ok || err != nil {
+			return ok, err
+		}
+		src = &structpb.ListValue{Values: values}
+	default:
+		val, err := structValueFromStarlark(t, sky)
+		if err != nil {
+			return true, err
+		}
+		src = val
+	}
+	// dst may be a dynamic message, so it's set by value rather than
+	// by Go type.
+	data, err := proto.Marshal(src)
+	if err == nil {
+		err = proto.Unmarshal(data, proto.MessageV1(dst.Interface()))
+	}
+	if err != nil {
+		return true, t.errorf(sky, "ValueError: value %s can't be converted to `%s': %v", sky.String(), t.name, err)
+	}
+	return true, nil
+}
+
+func starlarkDict(sky starlark.Value) (*starlark.Dict, bool) {
+	switch sky := sky.(type) {
+	case *starlark.Dict:
+		return sky, true
+	case *protoMap:
+		return sky.dict, true
+	}
+	return nil, false
+}
+
+func structFieldsFromStarlark(t reflectType, dict *starlark.Dict) (map[string]*structpb.Value, error) {
+	fields := make(map[string]*structpb.Value, dict.Len())
+	for _, item := range dict.Items() {
+		key, ok := item[0].(starlark.String)
+		if !ok {
+			return nil, t.errorf(item[0], "TypeError: keys of a `google.protobuf.Struct' must be strings, got %s", item[0].Type())
+		}
+		val, err := structValueFromStarlark(t, item[1])
+		if err != nil {
+			return nil, withIndex(err, item[0].String())
+		}
+		fields[string(key)] = val
+	}
+	return fields, nil
+}
+
+func structListFromStarlark(t reflectType, sky starlark.Value) ([]*structpb.Value, bool, error) {
+	var seq starlark.Indexable
+	switch sky := sky.(type) {
+	case *starlark.List:
+		seq = sky
+	case starlark.Tuple:
+		seq = sky
+	case *protoRepeated:
+		seq = sky
+	default:
+		return nil, false, nil
+	}
+	values := make([]*structpb.Value, seq.Len())
+	for ii := range values {
+		val, err := structValueFromStarlark(t, seq.Index(ii))
+		if err != nil {
+			return nil, true, withIndex(err, fmt.Sprint(ii))
+		}
+		values[ii] = val
+	}
+	return values, true, nil
+}
+
+func structValueFromStarlark(t reflectType, sky starlark.Value) (*structpb.Value, error) {
+	switch v := sky.(type) {
+	case starlark.NoneType:
+		return structpb.NewNullValue(), nil
+	case starlark.Bool:
+		return structpb.NewBoolValue(bool(v)), nil
+	case starlark.Int:
+		i, ok := v.Int64()
+		if !ok || i < -maxSafeJSONInt || i > maxSafeJSONInt {
+			return nil, t.errorf(sky, "ValueError: value %v can't be represented exactly by a `google.protobuf.Value' number.", v)
+		}
+		return structpb.NewNumberValue(float64(i)), nil
+	case starlark.Float:
+		return structpb.NewNumberValue(float64(v)), nil
+	case starlark.String:
+		return structpb.NewStringValue(string(v)), nil
+	}
+	if dict, ok := starlarkDict(sky); ok {
+		fields, err := structFieldsFromStarlark(t, dict)
+		if err != nil {
+			return nil, err
+		}
+		return structpb.NewStructValue(&structpb.Struct{Fields: fields}), nil
+	}
+	values, ok, err := structListFromStarlark(t, sky)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return structpb.NewListValue(&structpb.ListValue{Values: values}), nil
+	}
+	return nil, t.errorf(sky, "TypeError: value %s (type `%s') can't be converted to `google.protobuf.Value'.", sky.String(), sky.Type())
+}
+
+// wellKnownToStarlark converts a google.protobuf.Struct, Value, or
+// ListValue read from a field into the dict, list, or scalar it represents.
+// The result is frozen, since changes to it wouldn't affect the field. It
+// returns false for messages of other types.
+func wellKnownToStarlark(msg protoreflect.Message) (starlark.Value, bool) {
+	var val starlark.Value
+	switch msg.Descriptor().FullName() {
+	case "google.protobuf.Struct":
+		val = structToStarlark(msg)
+	case "google.protobuf.Value":
+		val = structValueToStarlark(msg)
+	case "google.protobuf.ListValue":
+		val = structListToStarlark(msg)
+	default:
+		return nil, false
+	}
+	val.Freeze()
+	return val, true
+}
+
+// structToStarlark converts a google.protobuf.Struct, with keys sorted so
+// that its output is deterministic.
+func structToStarlark(msg protoreflect.Message) *starlark.Dict {
+	fields := msg.Get(msg.Descriptor().Fields().ByName("fields")).Map()
+	keys := make([]string, 0, fields.Len())
+	fields.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+		keys = append(keys, k.String())
+		return true
+	})
+	sort.Strings(keys)
+	dict := &starlark.Dict{}
+	for _, key := range keys {
+		val := fields.Get(protoreflect.ValueOfString(key).MapKey())
+		dict.SetKey(starlark.String(key), structValueToStarlark(val.Message()))
+	}
+	return dict
+}
+
+func structListToStarlark(msg protoreflect.Message) *starlark.List {
+	values := msg.Get(msg.Descriptor().Fields().ByName("values")).List()
+	items := make([]starlark.Value, values.Len())
+	for ii := range items {
+		items[ii] = structValueToStarlark(values.Get(ii).Message())
+	}
+	return starlark.NewList(items)
+}
+
+// structValueToStarlark converts a google.protobuf.Value. Numbers that are
+// integers are converted to ints.
+func structValueToStarlark(msg protoreflect.Message) starlark.Value {
+	fd := msg.WhichOneof(msg.Descriptor().Oneofs().ByName("kind"))
+	if fd == nil {
+		return starlark.None
+	}
+	val := msg.Get(fd)
+	switch fd.Name() {
+	case "number_value":
+		f := val.Float()
+		if f == math.Trunc(f) && math.Abs(f) <= maxSafeJSONInt {
+			return starlark.MakeInt64(int64(f))
+		}
+		return starlark.Float(f)
+	case "string_value":
+		return starlark.String(val.String())
+	case "bool_value":
+		return starlark.Bool(val.Bool())
+	case "struct_value":
+		return structToStarlark(val.Message())
+	case "list_value":
+		return structListToStarlark(val.Message())
+	}
+	return starlark.None
+}
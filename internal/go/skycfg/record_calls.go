@@ -0,0 +1,54 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"go.starlark.net/starlark"
+)
+
+// RecordCalls returns a copy of val in which every builtin function,
+// including those in modules and structs, calls record before it's called.
+// The name passed to record is the dotted path from val, which is bound to
+// name, to the builtin; for example "k8s.get" for the builtin `get` of a
+// module bound to "k8s".
+//
+// Other values are returned unchanged.
+func RecordCalls(val starlark.Value, name string, record func(name string)) starlark.Value {
+	return wrapCalls(val, name, func(t *starlark.Thread, name string) error {
+		record(name)
+		return nil
+	})
+}
+
+// GuardCalls returns a copy of val in which every builtin function,
+// including those in modules and structs, calls check before it's called.
+// If check returns an error, the call fails with that error instead. Names
+// are passed to check as by RecordCalls().
+func GuardCalls(val starlark.Value, name string, check func(t *starlark.Thread, name string) error) starlark.Value {
+	return wrapCalls(val, name, check)
+}
+
+func wrapCalls(val starlark.Value, name string, before func(t *starlark.Thread, name string) error) starlark.Value {
+	return wrapBuiltins(val, name, func(b *starlark.Builtin, name string) *starlark.Builtin {
+		return replaceBuiltin(b, func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := before(t, name); err != nil {
+				return nil, err
+			}
+			return b.CallInternal(t, args, kwargs)
+		})
+	})
+}
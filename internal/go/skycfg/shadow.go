@@ -0,0 +1,65 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// A LoadShadowing is a name bound by a load() statement that hides a global
+// builtin, or a name bound by an earlier load() in the same module.
+type LoadShadowing struct {
+	Name string
+	Pos  syntax.Position
+	msg  string
+}
+
+func (s LoadShadowing) String() string {
+	return fmt.Sprintf("%v: load() of %q %s", s.Pos, s.Name, s.msg)
+}
+
+// FindLoadShadowing reports load() statements in a module that shadow a
+// predeclared global, a universal builtin such as `len`, or a symbol loaded
+// earlier in the same module.
+func FindLoadShadowing(f *syntax.File, predeclared starlark.StringDict) []LoadShadowing {
+	var found []LoadShadowing
+	loaded := make(map[string]syntax.Position)
+	for _, stmt := range f.Stmts {
+		load, ok := stmt.(*syntax.LoadStmt)
+		if !ok {
+			continue
+		}
+		for _, to := range load.To {
+			shadow := LoadShadowing{Name: to.Name, Pos: to.NamePos}
+			if prev, ok := loaded[to.Name]; ok {
+				shadow.msg = fmt.Sprintf("shadows the symbol loaded at %v", prev)
+			} else if _, ok := predeclared[to.Name]; ok {
+				shadow.msg = "shadows a global builtin"
+			} else if _, ok := starlark.Universe[to.Name]; ok {
+				shadow.msg = "shadows a universal builtin"
+			} else {
+				loaded[to.Name] = to.NamePos
+				continue
+			}
+			found = append(found, shadow)
+		}
+	}
+	return found
+}
@@ -17,15 +17,33 @@
 package skycfg_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
 	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/descriptorpb"
 
 	"github.com/stripe/skycfg"
+	impl "github.com/stripe/skycfg/internal/go/skycfg"
 	pb "github.com/stripe/skycfg/test_proto"
 )
 
@@ -84,6 +102,122 @@ def main(ctx):
 # Main does not return protos
 def main(ctx):
 	return ["str1", "str2"]
+`,
+	"test7.sky": `
+# Enum values exposed by WithGlobalsFromProto
+test_proto = proto.package("skycfg.test_proto")
+
+def main(ctx):
+	return [test_proto.MessageV3(
+		f_toplevel_enum = TOPLEVEL_ENUM_V3_B,
+		f_nested_enum = NESTED_ENUM_B,
+	)]
+`,
+	"test8.sky": `
+load("test9.sky", "TEMPLATE", "LABELS", "CHECKS")
+
+def main(ctx):
+	if ctx.vars["mutate"] == "message":
+		TEMPLATE.f_string = "changed"
+	elif ctx.vars["mutate"] == "dict":
+		LABELS["key"] = "changed"
+	elif ctx.vars["mutate"] == "list":
+		CHECKS.append({})
+	elif ctx.vars["mutate"] == "nested":
+		CHECKS[0].update(name = "changed")
+	elif ctx.vars["mutate"] == "proto_freeze":
+		msg = proto.freeze(proto.clone(TEMPLATE))
+		msg.map_string["key"] = "changed"
+	else:
+		checks = CHECKS
+		checks.append({})
+	return []
+`,
+	"test9.sky": `
+test_proto = proto.package("skycfg.test_proto")
+
+TEMPLATE = test_proto.MessageV3()
+LABELS = {}
+CHECKS = [{"name": "check"}]
+`,
+	"test10.sky": `
+def main(ctx):
+	if ctx.flags.enabled("new_feature"):
+		return []
+	fail("new_feature should be enabled")
+`,
+	"test11.sky": `
+log.debug("loading")
+
+def main(ctx):
+	ctx.log.warn("deprecated field", 1, field = "f_string")
+	return []
+`,
+	"test12.sky": `
+load("test3.sky", json = "helper3")
+
+def main(ctx):
+	return []
+`,
+	"test14.sky": `
+pb = proto.package("skycfg.test_proto")
+
+TEMPLATE = pb.MessageV2(f_string = "template")
+
+def main(ctx):
+	return [
+		annotate(pb.MessageV2(f_int64 = 1), cluster = "us-east-1", wave = "1"),
+		pb.MessageV2(f_int64 = 2),
+		annotate(annotate(pb.MessageV2(f_int64 = 3), cluster = "us-west-2"), wave = "2"),
+	]
+
+def annotate_frozen(ctx):
+	annotate(TEMPLATE, cluster = "us-east-1")
+`,
+	"test15.sky": `
+pb = proto.package("skycfg.test_proto")
+
+def main(ctx):
+	for ii in range(2):
+		ctx.emit(pb.MessageV2(f_int64 = ii))
+	return [annotate(pb.MessageV2(f_int64 = 2), wave = "last")]
+`,
+	"test16.sky": `
+def test_scale_up(ctx):
+	cluster = ctx.fixtures("prod_cluster")
+	cluster.f_int32 = cluster.f_int32 * 2
+	if cluster.f_int32 != 6:
+		fail("expected 6 replicas, got %d" % cluster.f_int32)
+
+def test_fixture_is_copied(ctx):
+	if ctx.fixtures("prod_cluster").f_int32 != 3:
+		fail("fixture was modified by another test")
+	if ctx.vars["env"] != "test":
+		fail("missing vars")
+
+def test_missing_fixture(ctx):
+	ctx.fixtures("staging_cluster")
+
+def helper(ctx):
+	fail("not a test")
+`,
+	"test17.sky": `
+pb = proto.package("skycfg.test_proto")
+
+def main(ctx):
+	env = ctx.vars["env"]
+	replicas = ctx.vars.get("replicas", 3)
+	if "region" in ctx.vars:
+		env = env + "-" + ctx.vars["region"]
+	return [pb.MessageV3(f_string = env, f_int32 = replicas)]
+`,
+	"test13.sky": `
+load("@builtin//strutil", "shout")
+
+def main(ctx):
+	if shout("hi") != "HI!":
+		fail("unexpected result from builtin module")
+	return []
 `,
 }
 
@@ -204,3 +338,2881 @@ func TestSkycfgEndToEnd(t *testing.T) {
 		}
 	}
 }
+
+func TestWithGlobalsFromProto(t *testing.T) {
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "test7.sky",
+		skycfg.WithFileReader(&testLoader{}),
+		skycfg.WithGlobalsFromProto(
+			"skycfg.test_proto.ToplevelEnumV3",
+			"skycfg.test_proto.MessageV3.NestedEnum",
+		),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protos, err := config.Main(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []proto.Message{&pb.MessageV3{
+		FToplevelEnum: pb.ToplevelEnumV3_TOPLEVEL_ENUM_V3_B,
+		FNestedEnum:   pb.MessageV3_NESTED_ENUM_B,
+	}}
+	if !reflect.DeepEqual(protos, want) {
+		t.Errorf("expected %v, got %v", want, protos)
+	}
+
+	_, err = skycfg.Load(ctx, "test7.sky",
+		skycfg.WithFileReader(&testLoader{}),
+		skycfg.WithGlobalsFromProto("skycfg.test_proto.MessageV3"),
+	)
+	if err == nil {
+		t.Error("expected error when passing a message type to WithGlobalsFromProto")
+	}
+}
+
+func TestFrozenErrorProvenance(t *testing.T) {
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "test8.sky", skycfg.WithFileReader(&testLoader{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string][]string{
+		"message":      {"created at test9.sky:4", `frozen when module "test9.sky" finished loading`},
+		"dict":         {"cannot insert into frozen hash table (global LABELS created at test9.sky:5, " + `frozen when module "test9.sky" finished loading;`, "make a copy"},
+		"list":         {"cannot append to frozen list (global CHECKS created at test9.sky:6, " + `frozen when module "test9.sky" finished loading;`},
+		"nested":       {"cannot insert into frozen hash table (part of global CHECKS created at test9.sky:6, "},
+		"local":        {"cannot append to frozen list (values defined at the top level"},
+		"proto_freeze": {"cannot insert into frozen hash table (", "proto.freeze()"},
+	}
+	for mutate, wantErrs := range tests {
+		_, err := config.Main(ctx, skycfg.WithVars(starlark.StringDict{
+			"mutate": starlark.String(mutate),
+		}))
+		if err == nil {
+			t.Errorf("%s: expected error mutating frozen value", mutate)
+			continue
+		}
+		for _, want := range wantErrs {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: expected error containing %q, got %q", mutate, want, err.Error())
+			}
+		}
+	}
+}
+
+func TestProtoFreeze(t *testing.T) {
+	ctx := context.Background()
+	files := map[string][]byte{
+		"lib.sky": []byte(`pb = proto.package("skycfg.test_proto")
+
+BASE = proto.freeze(pb.MessageV3(f_string = "base", f_submsg = pb.MessageV3(f_int32 = 1)))
+
+def env(name, base = pb.MessageV3(f_string = "default")):
+	return base
+`),
+		"main.sky": []byte(`load("lib.sky", "BASE", "env", "pb")
+
+def main(ctx):
+	if ctx.vars.get("mutate") == "default":
+		env("prod").f_string = "prod"
+	prod = proto.clone(BASE)
+	prod.f_string = "prod"
+	parent = pb.MessageV3(f_submsg = BASE)
+	parent.f_submsg.f_string = "copied"
+	return [prod, parent, BASE]
+`),
+		"early.sky": []byte(`pb = proto.package("skycfg.test_proto")
+
+BASE = proto.freeze(pb.MessageV3(f_string = "base"))
+STAGING = BASE
+STAGING.f_submsg = pb.MessageV3()
+`),
+		"frozen.sky": []byte(`pb = proto.package("skycfg.test_proto")
+
+BASE = pb.MessageV3(f_submsg = pb.MessageV3())
+SUB = BASE.f_submsg
+FROZEN = proto.freeze(BASE)
+RESULTS = [proto.is_frozen(FROZEN), proto.is_frozen(SUB), proto.is_frozen(proto.clone(FROZEN)), FROZEN == BASE]
+`),
+	}
+	opts := []skycfg.LoadOption{skycfg.WithFileReader(skycfg.MapFileReader(files))}
+	config, err := skycfg.Load(ctx, "main.sky", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := config.Main(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msgs[0].(*pb.MessageV3).GetFString(); got != "prod" {
+		t.Errorf("expected clone to be modifiable, got f_string = %q", got)
+	}
+	if got := msgs[1].(*pb.MessageV3).GetFSubmsg().GetFString(); got != "copied" {
+		t.Errorf("expected submessage to be copied on write, got f_string = %q", got)
+	}
+	if got := msgs[2].(*pb.MessageV3).GetFString(); got != "base" {
+		t.Errorf("expected frozen template to be unchanged, got f_string = %q", got)
+	}
+
+	// Function defaults are frozen with the module that defines them.
+	_, err = config.Main(ctx, skycfg.WithVars(starlark.StringDict{"mutate": starlark.String("default")}))
+	if err == nil || !strings.Contains(err.Error(), "cannot set field of frozen message (created at lib.sky:5)") {
+		t.Errorf("expected error mutating function default, got %v", err)
+	}
+
+	_, err = skycfg.Load(ctx, "early.sky", opts...)
+	if err == nil || !strings.Contains(err.Error(), "cannot set field of frozen message (created at early.sky:3, frozen by proto.freeze() at early.sky:3)") {
+		t.Errorf("expected error mutating frozen template while loading, got %v", err)
+	}
+
+	config, err = skycfg.Load(ctx, "frozen.sky", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := config.Locals()["RESULTS"].String(), "[True, True, False, True]"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestWithCtxAttrs(t *testing.T) {
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "test10.sky", skycfg.WithFileReader(&testLoader{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enabled := starlark.NewBuiltin("enabled", func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var flag string
+		if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &flag); err != nil {
+			return nil, err
+		}
+		return starlark.Bool(flag == "new_feature"), nil
+	})
+	flags := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"enabled": enabled,
+	})
+	if _, err := config.Main(ctx, skycfg.WithCtxAttrs(starlark.StringDict{"flags": flags})); err != nil {
+		t.Error(err)
+	}
+	if _, err := config.Main(ctx); err == nil {
+		t.Error("expected ctx attrs to be scoped to a single Main call")
+	}
+	for _, key := range []string{"vars", "fixtures", "test"} {
+		if _, err := config.Main(ctx, skycfg.WithCtxAttrs(starlark.StringDict{key: flags})); err == nil {
+			t.Errorf("expected error overriding ctx.%s", key)
+		}
+	}
+}
+
+func TestWithProtoVars(t *testing.T) {
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+def main(ctx):
+	current = ctx.vars["current"]
+	msg = proto.clone(current)
+	msg.f_int64 = current.f_int64 + 1
+	return [msg]
+`),
+		"mutate.sky": []byte(`
+def main(ctx):
+	ctx.vars["current"].f_int64 = 5
+	return []
+`),
+	})
+	ctx := context.Background()
+	current := &pb.MessageV3{FString: "web", FInt64: 2}
+	vars := skycfg.WithProtoVars(map[string]proto.Message{"current": current})
+
+	config, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := config.Main(ctx, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &pb.MessageV3{FString: "web", FInt64: 3}
+	if len(msgs) != 1 || !proto.Equal(msgs[0], want) {
+		t.Errorf("Main(): got %v, want [%v]", msgs, want)
+	}
+
+	config, err = skycfg.Load(ctx, "mutate.sky", skycfg.WithFileReader(reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Main(ctx, vars); err == nil || !strings.Contains(err.Error(), "frozen") {
+		t.Errorf("expected frozen error modifying a proto var, got %v", err)
+	}
+	if current.FInt64 != 2 {
+		t.Errorf("proto var was modified: %v", current)
+	}
+
+	if _, err := config.Main(ctx, skycfg.WithProtoVars(map[string]proto.Message{"current": nil})); err == nil {
+		t.Error("expected error for a nil proto var")
+	}
+}
+
+func TestOptionFuncs(t *testing.T) {
+	ctx := context.Background()
+	var wrapped skycfg.FileReader
+	wrapReader := skycfg.LoadOptionFunc(func(s *skycfg.LoadSettings) {
+		if _, ok := s.Globals()["proto"]; !ok {
+			t.Error("expected default globals to be visible")
+		}
+		wrapped = s.FileReader()
+		s.Apply(skycfg.WithFileReader(skycfg.CachingFileReader(wrapped, 0)))
+	})
+	config, err := skycfg.Load(ctx, "test1.sky", skycfg.WithFileReader(&testLoader{}), wrapReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := wrapped.(*testLoader); !ok {
+		t.Errorf("expected LoadOptionFunc to see the earlier FileReader, got %T", wrapped)
+	}
+
+	requireVar := func(name string) skycfg.ExecOption {
+		return skycfg.ExecOptionFunc(func(s *skycfg.ExecSettings) {
+			if _, found, _ := s.Vars().Get(starlark.String(name)); !found {
+				s.Fail(fmt.Errorf("ctx.vars[%q] is required", name))
+			}
+		})
+	}
+	if _, err := config.Main(ctx, requireVar("var_key")); err == nil {
+		t.Error("expected error from ExecOptionFunc")
+	}
+	if _, err := config.Main(ctx, skycfg.WithVars(starlark.StringDict{"var_key": starlark.String("var_value")}), requireVar("var_key")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadAll(t *testing.T) {
+	root, err := ioutil.TempDir("", "skycfg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		"a/main.sky":   "def main(ctx):\n  return [proto.package(\"skycfg.test_proto\").MessageV3(f_string = ctx.vars[\"env\"])]\n",
+		"b/main.sky":   "def main(ctx):\n  fail(\"broken\")\n",
+		"b/helper.sky": "def helper():\n  pass\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := skycfg.LoadAll(context.Background(), root, "main.sky",
+		skycfg.WithExecOptions(skycfg.WithVars(starlark.StringDict{"env": starlark.String("prod")})),
+		skycfg.WithConcurrency(2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	if results[0].Err != nil {
+		t.Errorf("%s: %v", results[0].Filename, results[0].Err)
+	} else if want := (&pb.MessageV3{FString: "prod"}); !proto.Equal(results[0].Messages[0], want) {
+		t.Errorf("%s: expected %v, got %v", results[0].Filename, want, results[0].Messages[0])
+	}
+	if results[1].Err == nil || !strings.Contains(results[1].Err.Error(), "broken") {
+		t.Errorf("%s: expected failure, got %v", results[1].Filename, results[1].Err)
+	}
+}
+
+func TestWithLoadFilter(t *testing.T) {
+	ctx := context.Background()
+	var loaded []string
+	allowAll := skycfg.WithLoadFilter(func(moduleName, fromPath string) error {
+		loaded = append(loaded, fromPath+" -> "+moduleName)
+		return nil
+	})
+	if _, err := skycfg.Load(ctx, "test1.sky", skycfg.WithFileReader(&testLoader{}), allowAll); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"test1.sky -> test2.sky", "test2.sky -> test3.sky"}
+	if !reflect.DeepEqual(loaded, want) {
+		t.Errorf("expected filter calls %v, got %v", want, loaded)
+	}
+
+	denyTest3 := skycfg.WithLoadFilter(func(moduleName, fromPath string) error {
+		if moduleName == "test3.sky" {
+			return fmt.Errorf("module not allowed")
+		}
+		return nil
+	})
+	_, err := skycfg.Load(ctx, "test1.sky", skycfg.WithFileReader(&testLoader{}), denyTest3)
+	if err == nil || !strings.Contains(err.Error(), "module not allowed") {
+		t.Errorf("expected load filter error, got %v", err)
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	ctx := context.Background()
+	var entries []skycfg.LogEntry
+	logger := skycfg.WithLogger(func(entry skycfg.LogEntry) {
+		entries = append(entries, entry)
+	})
+	config, err := skycfg.Load(ctx, "test11.sky", skycfg.WithFileReader(&testLoader{}), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Main(ctx, logger); err != nil {
+		t.Fatal(err)
+	}
+	want := []skycfg.LogEntry{
+		{Level: "debug", Message: "loading", Filename: "test11.sky", Line: 2},
+		{Level: "warn", Message: "deprecated field 1", Fields: map[string]string{"field": "f_string"}, Filename: "test11.sky", Line: 5},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("expected log entries %+v, got %+v", want, entries)
+	}
+}
+
+func TestShadowPolicy(t *testing.T) {
+	ctx := context.Background()
+	var entries []skycfg.LogEntry
+	logger := skycfg.WithLogger(func(entry skycfg.LogEntry) {
+		entries = append(entries, entry)
+	})
+	if _, err := skycfg.Load(ctx, "test12.sky", skycfg.WithFileReader(&testLoader{}), logger); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no warnings by default, got %+v", entries)
+	}
+
+	if _, err := skycfg.Load(ctx, "test12.sky", skycfg.WithFileReader(&testLoader{}), logger, skycfg.WithShadowPolicy(skycfg.ShadowWarn)); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Level != "warn" || !strings.Contains(entries[0].Message, "shadows a global builtin") {
+		t.Errorf("expected shadowing warning with ShadowWarn, got %+v", entries)
+	}
+
+	_, err := skycfg.Load(ctx, "test12.sky", skycfg.WithFileReader(&testLoader{}), skycfg.WithShadowPolicy(skycfg.ShadowError))
+	if err == nil || !strings.Contains(err.Error(), `load() of "json" shadows a global builtin`) {
+		t.Errorf("expected shadowing error, got %v", err)
+	}
+}
+
+func TestWithLoadWorkers(t *testing.T) {
+	files := map[string][]byte{
+		"main.sky": []byte(`
+load("a.sky", "A")
+load("b.sky", "B")
+load("c.sky", "C")
+
+def main(ctx):
+	if A + B + C != 6:
+		fail("unexpected values")
+	return []
+`),
+		"a.sky":      []byte("load(\"common.sky\", \"ONE\")\nA = ONE\n"),
+		"b.sky":      []byte("load(\"common.sky\", \"ONE\")\nB = ONE * 2\n"),
+		"c.sky":      []byte("load(\"common.sky\", \"ONE\")\nC = ONE * 3\n"),
+		"common.sky": []byte("ONE = 1\n"),
+		"cycle1.sky": []byte("load(\"cycle2.sky\", \"X\")\n"),
+		"cycle2.sky": []byte("load(\"cycle3.sky\", \"X\")\n"),
+		"cycle3.sky": []byte("load(\"cycle1.sky\", \"X\")\n"),
+	}
+	ctx := context.Background()
+	for _, workers := range []int{1, 4} {
+		config, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(skycfg.MapFileReader(files)), skycfg.WithLoadWorkers(workers))
+		if err != nil {
+			t.Errorf("workers=%d: %v", workers, err)
+			continue
+		}
+		if _, err := config.Main(ctx); err != nil {
+			t.Errorf("workers=%d: %v", workers, err)
+		}
+		_, err = skycfg.Load(ctx, "cycle1.sky", skycfg.WithFileReader(skycfg.MapFileReader(files)), skycfg.WithLoadWorkers(workers))
+		if err == nil || !strings.Contains(err.Error(), "cycle in load graph") {
+			t.Errorf("workers=%d: expected cycle error, got %v", workers, err)
+		}
+		cycle, ok := err.(*skycfg.LoadCycleError)
+		if !ok {
+			t.Errorf("workers=%d: expected a LoadCycleError, got %T", workers, err)
+			continue
+		}
+		wantChain := []string{"cycle1.sky", "cycle2.sky", "cycle3.sky", "cycle1.sky"}
+		if !reflect.DeepEqual(cycle.Chain, wantChain) || cycle.Pos.Filename() != "cycle3.sky" {
+			t.Errorf("workers=%d: got cycle %v at %s, want %v at cycle3.sky", workers, cycle.Chain, cycle.Pos, wantChain)
+		}
+	}
+}
+
+func TestConfigDependencies(t *testing.T) {
+	config, err := skycfg.Load(context.Background(), "test1.sky", skycfg.WithFileReader(&testLoader{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := func(name string) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(testFiles[name])))
+	}
+	want := []skycfg.Dependency{
+		{From: "", Name: "test1.sky", Path: "test1.sky", Hash: hash("test1.sky")},
+		{From: "test1.sky", Name: "test2.sky", Path: "test2.sky", Hash: hash("test2.sky")},
+		{From: "test2.sky", Name: "test3.sky", Path: "test3.sky", Hash: hash("test3.sky")},
+	}
+	if got := config.Dependencies(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected dependencies %+v, got %+v", want, got)
+	}
+}
+
+func TestWithModule(t *testing.T) {
+	ctx := context.Background()
+	shout := starlark.NewBuiltin("shout", func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var s string
+		if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &s); err != nil {
+			return nil, err
+		}
+		return starlark.String(strings.ToUpper(s) + "!"), nil
+	})
+	config, err := skycfg.Load(ctx, "test13.sky",
+		skycfg.WithFileReader(&testLoader{}),
+		skycfg.WithModule("strutil", starlark.StringDict{"shout": shout}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := config.Globals()["shout"]; ok {
+		t.Error("expected builtin module members to stay out of the global namespace")
+	}
+	if _, err := config.Main(ctx); err != nil {
+		t.Error(err)
+	}
+
+	_, err = skycfg.Load(ctx, "test13.sky", skycfg.WithFileReader(&testLoader{}))
+	if err == nil || !strings.Contains(err.Error(), "no such builtin module") {
+		t.Errorf("expected error loading unregistered module, got %v", err)
+	}
+}
+
+func TestBuiltinPanic(t *testing.T) {
+	ctx := context.Background()
+	explode := starlark.NewBuiltin("explode", func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var m map[string]int
+		m["boom"] = 1
+		return starlark.None, nil
+	})
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+load("@builtin//bad", "explode")
+
+def main(ctx):
+	explode()
+	return []
+`),
+	})
+	config, err := skycfg.Load(ctx, "main.sky",
+		skycfg.WithFileReader(reader),
+		skycfg.WithModule("bad", starlark.StringDict{"explode": explode}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.Main(ctx)
+	if err == nil {
+		t.Fatal("expected error from panicking builtin")
+	}
+	for _, want := range []string{"explode: panic in Go builtin: assignment to entry in nil map", "TestBuiltinPanic"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to contain %q, got %v", want, err)
+		}
+	}
+}
+
+// urlLoader loads files from a map keyed by URL. Relative module names are
+// resolved against the importing module's URL.
+type urlLoader map[string]string
+
+func (loader urlLoader) Resolve(ctx context.Context, name, fromPath string) (string, error) {
+	if strings.Contains(name, "://") || fromPath == "" {
+		return name, nil
+	}
+	return fromPath[:strings.LastIndex(fromPath, "/")+1] + name, nil
+}
+
+func (loader urlLoader) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	if source, ok := loader[path]; ok {
+		return []byte(source), nil
+	}
+	return nil, fmt.Errorf("File %s not found", path)
+}
+
+func TestVendor(t *testing.T) {
+	ctx := context.Background()
+	loader := urlLoader{
+		"https://example.com/cfg/main.sky": `
+load("lib/common.sky", "ONE")
+load("https://other.example/shared/util.sky", "TWO")
+load("@builtin//strutil", "shout")
+RESULT = shout("%d" % (ONE + TWO))
+`,
+		"https://example.com/cfg/lib/common.sky": "ONE = 1\n",
+		"https://other.example/shared/util.sky": `
+load("https://example.com/cfg/lib/common.sky", "ONE")
+TWO = ONE * 2
+`,
+	}
+	shout := starlark.NewBuiltin("shout", func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var s string
+		if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &s); err != nil {
+			return nil, err
+		}
+		return starlark.String(s + "!"), nil
+	})
+	strutil := skycfg.WithModule("strutil", starlark.StringDict{"shout": shout})
+
+	dir, err := ioutil.TempDir("", "skycfg-vendor-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Vendor accepts the same options as Load, including globals.
+	globals := skycfg.WithGlobals(starlark.StringDict{"shout": shout})
+	root, err := skycfg.Vendor(ctx, "https://example.com/cfg/main.sky", dir, skycfg.WithFileReader(loader), globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "main.sky"); root != want {
+		t.Errorf("Vendor: got root %q, want %q", root, want)
+	}
+	for _, name := range []string{"lib/common.sky", "https/other.example/shared/util.sky"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("expected vendored module %s: %v", name, err)
+		}
+	}
+
+	config, err := skycfg.Load(ctx, root, strutil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Locals()["RESULT"]; got != starlark.String("3!") {
+		t.Errorf("vendored config: got RESULT = %v, want \"3!\"", got)
+	}
+
+	_, err = skycfg.Vendor(ctx, "https://example.com/cfg/main.sky", dir, skycfg.WithFileReader(loader), skycfg.WithProtoDescriptorSet([]byte("junk")))
+	if err == nil || !strings.Contains(err.Error(), "WithProtoDescriptorSet") {
+		t.Errorf("expected invalid option error, got %v", err)
+	}
+}
+
+func TestLoadPins(t *testing.T) {
+	ctx := context.Background()
+	libSource := "HELPER = 1\n"
+	otherSource := "OTHER = 2\n"
+	libHash := fmt.Sprintf("%x", sha256.Sum256([]byte(libSource)))
+	otherHash := fmt.Sprintf("%x", sha256.Sum256([]byte(otherSource)))
+	wrongHash := strings.Repeat("0", 64)
+
+	files := map[string][]byte{
+		"lib.sky":   []byte(libSource),
+		"other.sky": []byte(otherSource),
+		"a.sky":     []byte("load(\"lib.sky\", \"HELPER\")\nA = HELPER\n"),
+		"pinned.sky": []byte(fmt.Sprintf(`
+load("lib.sky", "HELPER", _sha256 = "%s")
+load(
+    "other.sky",
+    _sha256 = "%s",
+    "OTHER",
+)
+RESULT = HELPER + OTHER
+`, libHash, otherHash)),
+		"wrong.sky": []byte(fmt.Sprintf("load(\"lib.sky\", \"HELPER\", _sha256 = %q)\n", wrongHash)),
+		"late.sky": []byte(fmt.Sprintf(`
+load("a.sky", "A")
+load("lib.sky", "HELPER", _sha256 = %q)
+`, wrongHash)),
+		"bad.sky": []byte("load(\"lib.sky\", \"HELPER\", _sha256 = \"abc\")\n"),
+	}
+	reader := skycfg.WithFileReader(skycfg.MapFileReader(files))
+
+	config, err := skycfg.Load(ctx, "pinned.sky", reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Locals()["RESULT"]; got == nil || got.String() != "3" {
+		t.Errorf("got RESULT = %v, want 3", got)
+	}
+	if _, ok := config.Locals()["_sha256"]; ok {
+		t.Error("expected _sha256 pin not to be bound as a global")
+	}
+
+	for _, filename := range []string{"wrong.sky", "late.sky"} {
+		_, err := skycfg.Load(ctx, filename, reader)
+		if err == nil || !strings.Contains(err.Error(), "doesn't match _sha256 pinned in") {
+			t.Errorf("Load(%q): expected pin mismatch, got %v", filename, err)
+		}
+	}
+	_, err = skycfg.Load(ctx, "bad.sky", reader)
+	if err == nil || !strings.Contains(err.Error(), "must be a lowercase hex SHA-256 digest") {
+		t.Errorf("expected invalid pin error, got %v", err)
+	}
+}
+
+func TestExports(t *testing.T) {
+	ctx := context.Background()
+	files := map[string][]byte{
+		"lib.sky": []byte(`
+exports = ["public"]
+
+def _helper():
+	return 1
+
+def internal():
+	return 2
+
+def public():
+	return _helper() + internal()
+`),
+		"good.sky":     []byte("load(\"lib.sky\", \"public\")\nRESULT = public()\n"),
+		"bad.sky":      []byte("load(\"lib.sky\", \"public\", \"internal\")\n"),
+		"exports.sky":  []byte("load(\"lib.sky\", \"exports\")\n"),
+		"invalid.sky":  []byte("exports = [\"missing\"]\n"),
+		"uses_bad.sky": []byte("load(\"invalid.sky\", \"missing\")\n"),
+	}
+	reader := skycfg.WithFileReader(skycfg.MapFileReader(files))
+
+	config, err := skycfg.Load(ctx, "good.sky", reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Locals()["RESULT"]; got == nil || got.String() != "3" {
+		t.Errorf("got RESULT = %v, want 3", got)
+	}
+
+	for _, filename := range []string{"bad.sky", "exports.sky"} {
+		_, err := skycfg.Load(ctx, filename, reader)
+		if err == nil || !strings.Contains(err.Error(), "is not exported by lib.sky") {
+			t.Errorf("Load(%q): expected export error, got %v", filename, err)
+		}
+	}
+	_, err = skycfg.Load(ctx, "uses_bad.sky", reader)
+	if err == nil || !strings.Contains(err.Error(), `exports lists "missing", which isn't defined`) {
+		t.Errorf("expected invalid exports error, got %v", err)
+	}
+}
+
+func TestReExportPolicy(t *testing.T) {
+	ctx := context.Background()
+	files := map[string][]byte{
+		"base.sky":     []byte("def helper():\n\treturn 1\n"),
+		"lib.sky":      []byte("load(\"base.sky\", \"helper\")\ndef wrapper():\n\treturn helper() + 1\n"),
+		"explicit.sky": []byte("load(\"base.sky\", \"helper\")\nexports = [\"helper\"]\n"),
+		"direct.sky":   []byte("load(\"lib.sky\", \"wrapper\")\nRESULT = wrapper()\n"),
+		"indirect.sky": []byte("load(\"lib.sky\", \"helper\")\nRESULT = helper()\n"),
+		"reexport.sky": []byte("load(\"explicit.sky\", \"helper\")\nRESULT = helper()\n"),
+	}
+	reader := skycfg.WithFileReader(skycfg.MapFileReader(files))
+
+	for _, filename := range []string{"direct.sky", "indirect.sky", "reexport.sky"} {
+		if _, err := skycfg.Load(ctx, filename, reader); err != nil {
+			t.Errorf("Load(%q) with default policy: %v", filename, err)
+		}
+	}
+
+	var warnings []string
+	logger := skycfg.WithLogger(func(entry skycfg.LogEntry) {
+		warnings = append(warnings, entry.Message)
+	})
+	_, err := skycfg.Load(ctx, "indirect.sky", reader, logger, skycfg.WithReExportPolicy(skycfg.ReExportWarn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `"helper" is re-exported by lib.sky`) {
+		t.Errorf("expected re-export warning, got %q", warnings)
+	}
+
+	strict := skycfg.WithReExportPolicy(skycfg.ReExportError)
+	for _, filename := range []string{"direct.sky", "reexport.sky"} {
+		if _, err := skycfg.Load(ctx, filename, reader, strict); err != nil {
+			t.Errorf("Load(%q) with ReExportError: %v", filename, err)
+		}
+	}
+	_, err = skycfg.Load(ctx, "indirect.sky", reader, strict)
+	if err == nil || !strings.Contains(err.Error(), `indirect.sky:1:18: load("lib.sky"): "helper" is re-exported by lib.sky`) {
+		t.Errorf("expected re-export error, got %v", err)
+	}
+}
+
+func TestOneofPolicy(t *testing.T) {
+	reader := skycfg.WithFileReader(skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+test_proto = proto.package("skycfg.test_proto")
+
+def main(ctx):
+	msg = test_proto.MessageV3(f_oneof_a = "a")
+	msg.f_oneof_b = "b"
+	return [msg]
+`),
+		"helper.sky": []byte(`
+test_proto = proto.package("skycfg.test_proto")
+
+def set_a(msg):
+	msg.f_oneof_a = "a"
+
+def main(ctx):
+	msg = test_proto.MessageV3()
+	set_a(msg)
+	msg.f_oneof_b = "b"
+	return [msg]
+`),
+	}))
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "main.sky", reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := config.Main(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msgs[0].(*pb.MessageV3).GetFOneofB(); got != "b" {
+		t.Errorf("expected f_oneof_b to replace f_oneof_a, got %v", msgs[0])
+	}
+
+	config, err = skycfg.Load(ctx, "main.sky", reader, skycfg.WithOneofPolicy(skycfg.OneofError))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.Main(ctx)
+	want := `field "f_oneof_a" of the same oneof "f_oneof" is already set (at main.sky:5)`
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected oneof error, got %v", err)
+	}
+	config, err = skycfg.Load(ctx, "helper.sky", reader, skycfg.WithOneofPolicy(skycfg.OneofError))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.Main(ctx)
+	want = `field "f_oneof_a" of the same oneof "f_oneof" is already set (in set_a(), called at helper.sky:9)`
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected oneof error, got %v", err)
+	}
+}
+
+func TestWithLoadTimeout(t *testing.T) {
+	files := map[string][]byte{
+		"main.sky": []byte("load(\"hang.sky\", \"X\")\n"),
+		"hang.sky": []byte("def spin():\n\tfor i in range(100000):\n\t\tfor j in range(100000):\n\t\t\tpass\n\treturn 1\n\nX = spin()\n"),
+		"ok.sky":   []byte("X = 1\n"),
+	}
+	reader := skycfg.WithFileReader(skycfg.MapFileReader(files))
+	timeout := skycfg.WithLoadTimeout(50 * time.Millisecond)
+
+	if _, err := skycfg.Load(context.Background(), "ok.sky", reader, timeout); err != nil {
+		t.Errorf("Load(ok.sky): %v", err)
+	}
+
+	goroutines := runtime.NumGoroutine()
+	start := time.Now()
+	_, err := skycfg.Load(context.Background(), "main.sky", reader, timeout)
+	if err == nil || !strings.Contains(err.Error(), "hang.sky: module execution timed out after 50ms") {
+		t.Errorf("expected module timeout, got %v", err)
+	}
+	// The interrupted module stops soon after Load() returns.
+	for runtime.NumGoroutine() > goroutines && time.Since(start) < 5*time.Second {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("expected the timed out module to stop, got %d goroutines (was %d)", n, goroutines)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = skycfg.Load(ctx, "main.sky", reader, skycfg.WithLoadWorkers(4))
+	if err == nil || !strings.Contains(err.Error(), ".sky: context deadline exceeded") {
+		t.Errorf("expected cancellation error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Load took %v to give up", elapsed)
+	}
+}
+
+func TestInterruptibleRange(t *testing.T) {
+	files := map[string][]byte{
+		"main.sky": []byte(`
+R = range(10)
+
+def main(ctx):
+	if ctx.vars.get("spin"):
+		for i in range(100000):
+			for j in range(100000):
+				pass
+	return []
+
+CHECKS = [
+	type(R),
+	str(R),
+	len(R),
+	3 in R,
+	10 not in R,
+	list(R[2:8:2]),
+	R == range(10),
+	R != range(0, 10, 2),
+	sorted(range(3), reverse = True),
+	[x for x in R],
+]
+`),
+	}
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(skycfg.MapFileReader(files)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `["range", "range(10)", 10, True, True, [2, 4, 6], True, True, [2, 1, 0], [0, 1, 2, 3, 4, 5, 6, 7, 8, 9]]`
+	if got := config.Locals()["CHECKS"].String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = config.Main(timeoutCtx, skycfg.WithVars(starlark.StringDict{"spin": starlark.True}))
+	var timeoutErr *skycfg.TimeoutError
+	if !errors.As(err, &timeoutErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a TimeoutError, got %#v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("main() took %v to stop", elapsed)
+	}
+}
+
+// TestInterruptibleRangeFromGo checks that the ranges of a config compare
+// with ranges created in Go, in either order.
+func TestInterruptibleRangeFromGo(t *testing.T) {
+	thread := &starlark.Thread{}
+	goRange, err := starlark.Call(thread, starlark.Universe["range"], starlark.Tuple{starlark.MakeInt(10)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configRange, err := starlark.Call(thread, impl.Range(), starlark.Tuple{starlark.MakeInt(10)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eq, err := starlark.Equal(configRange, goRange); err != nil || !eq {
+		t.Errorf("expected range() == Go range, got %v, %v", eq, err)
+	}
+
+	files := map[string][]byte{
+		"main.sky": []byte(`
+CHECKS = [
+	GO_R == range(10),
+	range(10) == GO_R,
+	GO_R != range(3),
+	list(GO_R[8:]),
+]
+
+def main(ctx):
+	if ctx.vars["r"] != range(10) or range(10) != ctx.vars["r"]:
+		fail("ctx.vars range doesn't match")
+	return []
+`),
+	}
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "main.sky",
+		skycfg.WithFileReader(skycfg.MapFileReader(files)),
+		skycfg.WithGlobals(starlark.StringDict{"GO_R": goRange}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := `[True, True, True, [8, 9]]`, config.Locals()["CHECKS"].String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if _, err := config.Main(ctx, skycfg.WithVars(starlark.StringDict{"r": goRange})); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	files := map[string][]byte{
+		"parse.sky":     []byte("load(\"syntax.sky\", \"X\")\n"),
+		"syntax.sky":    []byte("X = (\n"),
+		"undefined.sky": []byte("X = undefined_name\n"),
+		"missing.sky":   []byte("load(\"nope.sky\", \"X\")\n"),
+		"cycle1.sky":    []byte("load(\"cycle2.sky\", \"X\")\n"),
+		"cycle2.sky":    []byte("load(\"cycle1.sky\", \"X\")\n"),
+		"cycle_via.sky": []byte("load(\"cycle1.sky\", \"X\")\n"),
+		"exec.sky":      []byte("load(\"fail.sky\", \"X\")\n"),
+		"fail.sky":      []byte("X = 1 // 0\n"),
+		"hang.sky":      []byte("def spin():\n\tfor i in range(100000):\n\t\tfor j in range(100000):\n\t\t\tpass\n\treturn 1\n\nX = spin()\n"),
+		"no_main.sky":   []byte("X = 1\n"),
+		"bad_main.sky":  []byte("def main(ctx):\n\treturn \"x\"\n"),
+		"bad_item.sky":  []byte("def main(ctx):\n\treturn [1]\n"),
+		"fail_main.sky": []byte("def main(ctx):\n\treturn [1 // 0]\n"),
+		"cancel.sky":    []byte("def main(ctx):\n\tcancel_and_fail()\n\treturn []\n"),
+	}
+	reader := skycfg.WithFileReader(skycfg.MapFileReader(files))
+	ctx := context.Background()
+
+	var (
+		parseErr      *skycfg.ParseError
+		loadErr       *skycfg.LoadError
+		execErr       *skycfg.ExecError
+		timeoutErr    *skycfg.TimeoutError
+		validationErr *skycfg.ValidationError
+	)
+	loadErrs := []struct {
+		filename string
+		target   interface{}
+	}{
+		{"parse.sky", &parseErr},
+		{"syntax.sky", &parseErr},
+		{"undefined.sky", &parseErr},
+		{"missing.sky", &loadErr},
+		{"cycle1.sky", &loadErr},
+		{"exec.sky", &execErr},
+		{"fail.sky", &execErr},
+	}
+	for _, test := range loadErrs {
+		_, err := skycfg.Load(ctx, test.filename, reader)
+		if err == nil || !errors.As(err, test.target) {
+			t.Errorf("Load(%q): expected %T, got %#v", test.filename, test.target, err)
+		}
+	}
+	for _, filename := range []string{"cycle1.sky", "cycle_via.sky"} {
+		if _, err := skycfg.Load(ctx, filename, reader); err != nil {
+			if _, ok := err.(*skycfg.LoadCycleError); !ok {
+				t.Errorf("Load(%q): expected a LoadCycleError, got %T", filename, err)
+			}
+		}
+	}
+	if _, err := skycfg.Load(ctx, "missing.sky", reader); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load(missing.sky): expected the cause to be kept, got %#v", err)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err := skycfg.Load(timeoutCtx, "hang.sky", reader)
+	if !errors.As(err, &timeoutErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Load(hang.sky): expected a TimeoutError, got %#v", err)
+	}
+
+	mainErrs := []struct {
+		filename string
+		target   interface{}
+	}{
+		{"no_main.sky", &validationErr},
+		{"bad_main.sky", &validationErr},
+		{"bad_item.sky", &validationErr},
+		{"fail_main.sky", &execErr},
+	}
+	for _, test := range mainErrs {
+		config, err := skycfg.Load(ctx, test.filename, reader)
+		if err != nil {
+			t.Fatalf("Load(%q): %v", test.filename, err)
+		}
+		_, err = config.Main(ctx)
+		if err == nil || !errors.As(err, test.target) {
+			t.Errorf("Main(%q): expected %T, got %#v", test.filename, test.target, err)
+		}
+	}
+
+	// A failure that the context didn't cause isn't a timeout, even if the
+	// context is done by the time main() returns.
+	mainCtx, cancelMain := context.WithCancel(ctx)
+	defer cancelMain()
+	cancelAndFail := starlark.NewBuiltin("cancel_and_fail", func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		cancelMain()
+		return nil, fmt.Errorf("backend unavailable")
+	})
+	config, err := skycfg.Load(ctx, "cancel.sky", reader, skycfg.WithGlobals(starlark.StringDict{"cancel_and_fail": cancelAndFail}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.Main(mainCtx)
+	if !errors.As(err, &execErr) || errors.As(err, &timeoutErr) {
+		t.Errorf("Main(cancel.sky): expected an ExecError, got %#v", err)
+	}
+}
+
+func TestAnalyzeCoverage(t *testing.T) {
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`load("lib.sky", "classify", "unused")
+
+def main(ctx):
+	results = []
+	for n in [1, 5]:
+		results.append(classify(n))
+	if len(results) > 10: return []
+	return []
+
+def test_classify(ctx):
+	if classify(0) != "zero":
+		fail("classify(0)")
+`),
+		"lib.sky": []byte(`def classify(n):
+	if n == 0:
+		return "zero"
+	elif n < 3:
+		return "small"
+	elif n < 100:
+		for _ in range(1):
+			pass
+		return "medium"
+	else:
+		return "large"
+
+def unused():
+	return None
+`),
+	})
+	report, err := skycfg.AnalyzeCoverage(context.Background(), "main.sky", []skycfg.LoadOption{skycfg.WithFileReader(reader)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.FailedTests) != 0 {
+		t.Errorf("FailedTests: got %v, want none", report.FailedTests)
+	}
+	if got, want := len(report.Blocks), 12; got != want {
+		t.Errorf("got %d blocks, want %d", got, want)
+	}
+	var got []string
+	for _, block := range report.Unexecuted() {
+		got = append(got, block.String())
+	}
+	want := []string{
+		"lib.sky:10:2: else branch in classify",
+		"lib.sky:13:1: function unused",
+		"main.sky:7:2: if branch in main",
+		"main.sky:11:2: if branch in test_classify",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexecuted():\ngot  %q\nwant %q", got, want)
+	}
+	for _, block := range report.Blocks {
+		if block.Path == "lib.sky" && block.Line == 1 && block.Hits != 3 {
+			t.Errorf("classify: got %d hits, want 3", block.Hits)
+		}
+	}
+
+	// Errors are reported on the lines where they occur.
+	reader = skycfg.MapFileReader(map[string][]byte{
+		"broken.sky": []byte("def main(ctx):\n\tif True:\n\t\tx = 1 // 0\n\treturn []\n"),
+	})
+	_, err = skycfg.AnalyzeCoverage(context.Background(), "broken.sky", []skycfg.LoadOption{skycfg.WithFileReader(reader)})
+	var evalErr *starlark.EvalError
+	if !errors.As(err, &evalErr) || !strings.Contains(evalErr.Backtrace(), "broken.sky:3:") {
+		t.Errorf("expected error on line 3, got %v", err)
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+test_proto = proto.package("skycfg.test_proto")
+
+def main(ctx):
+	return [test_proto.MessageV3(f_string = ctx.vars["name"] * ctx.vars["repeat"])]
+`),
+	})
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := skycfg.WithVarsFromGo(map[string]interface{}{
+		"name":   "abcdefghij",
+		"repeat": 1,
+	})
+	if _, err := config.Main(ctx, vars, skycfg.WithMaxVarSize(10), skycfg.WithMaxMessageSize(12)); err != nil {
+		t.Errorf("Main() within limits: %v", err)
+	}
+
+	var validationErr *skycfg.ValidationError
+	_, err = config.Main(ctx, vars, skycfg.WithMaxVarSize(5))
+	if !errors.As(err, &validationErr) || !strings.Contains(err.Error(), `ctx.vars["name"] is 10 bytes, more than the limit of 5`) {
+		t.Errorf("expected var size error, got %v", err)
+	}
+	big := skycfg.WithVarsFromGo(map[string]interface{}{"repeat": 100})
+	_, err = config.Main(ctx, vars, big, skycfg.WithMaxMessageSize(100))
+	if !errors.As(err, &validationErr) || !strings.Contains(err.Error(), "skycfg.test_proto.MessageV3 of 1003 bytes, more than the limit of 100") {
+		t.Errorf("expected message size error, got %v", err)
+	}
+
+	if _, err := config.Main(ctx, skycfg.WithMaxVarSize(0)); err == nil || !strings.Contains(err.Error(), "WithMaxVarSize: limit must be positive, got 0") {
+		t.Errorf("expected WithMaxVarSize(0) to fail, got %v", err)
+	}
+	if _, err := config.Main(ctx, skycfg.WithMaxMessageSize(-1)); err == nil || !strings.Contains(err.Error(), "WithMaxMessageSize: limit must be positive, got -1") {
+		t.Errorf("expected WithMaxMessageSize(-1) to fail, got %v", err)
+	}
+}
+
+func TestExecPool(t *testing.T) {
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+test_proto = proto.package("skycfg.test_proto")
+
+def main(ctx):
+	ctx.emit(test_proto.MessageV3(f_string = ctx.vars["env"]))
+	return [test_proto.MessageV3(f_string = ctx.vars["name"], f_int32 = len(ctx.vars))]
+`),
+		"no_main.sky": []byte("X = 1\n"),
+	})
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := config.NewExecPool(skycfg.WithVars(starlark.StringDict{"env": starlark.String("prod")}))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for ii := 0; ii < 40; ii++ {
+		wg.Add(1)
+		go func(ii int) {
+			defer wg.Done()
+			name := fmt.Sprintf("name-%d", ii)
+			vars := starlark.StringDict{"name": starlark.String(name)}
+			if ii%2 == 0 {
+				// Vars of one execution don't leak into the next.
+				vars["extra"] = starlark.True
+			}
+			msgs, err := pool.Main(ctx, vars)
+			if err != nil {
+				errs <- err
+				return
+			}
+			want := []proto.Message{
+				&pb.MessageV3{FString: "prod"},
+				&pb.MessageV3{FString: name, FInt32: int32(len(vars) + 1)},
+			}
+			if len(msgs) != len(want) || !proto.Equal(msgs[0], want[0]) || !proto.Equal(msgs[1], want[1]) {
+				errs <- fmt.Errorf("Main(%s): got %v, want %v", name, msgs, want)
+			}
+		}(ii)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	_, err = pool.Main(ctx, nil)
+	if err == nil || !strings.Contains(err.Error(), `key "name" not in dict`) {
+		t.Errorf("expected missing var error, got %v", err)
+	}
+
+	noMain, err := skycfg.Load(ctx, "no_main.sky", skycfg.WithFileReader(reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var validationErr *skycfg.ValidationError
+	if _, err := noMain.NewExecPool().Main(ctx, nil); !errors.As(err, &validationErr) {
+		t.Errorf("expected a ValidationError, got %v", err)
+	}
+
+	// Each execution records its own capabilities.
+	recorder := skycfg.NewCapabilityRecorder()
+	pool = config.NewExecPool(skycfg.WithCapabilityRecorder(recorder))
+	for _, env := range []string{"staging", "prod"} {
+		vars := starlark.StringDict{"env": starlark.String(env), "name": starlark.String(env)}
+		if _, err := pool.Main(ctx, vars); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := pool.Main(ctx, starlark.StringDict{"env": starlark.String("dev")}); err == nil {
+		t.Fatal("expected missing var error")
+	}
+	wantVars := []skycfg.VarUsage{
+		{Name: "env", Types: []string{"string"}, Required: true, Set: true},
+		{Name: "name", Required: true},
+	}
+	if got := recorder.Report().Vars; !reflect.DeepEqual(got, wantVars) {
+		t.Errorf("Vars: got %+v, want %+v", got, wantVars)
+	}
+}
+
+func TestExecAnnotations(t *testing.T) {
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "test14.sky", skycfg.WithFileReader(&testLoader{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := config.Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Messages) != 3 {
+		t.Fatalf("expected 3 messages, got %v", result.Messages)
+	}
+	want := []map[string]string{
+		{"cluster": "us-east-1", "wave": "1"},
+		nil,
+		{"cluster": "us-west-2", "wave": "2"},
+	}
+	if !reflect.DeepEqual(result.Annotations, want) {
+		t.Errorf("expected annotations %v, got %v", want, result.Annotations)
+	}
+
+	annotateFrozen := config.Locals()["annotate_frozen"].(starlark.Callable)
+	_, err = starlark.Call(&starlark.Thread{}, annotateFrozen, starlark.Tuple{starlark.None}, nil)
+	if err == nil || !strings.Contains(err.Error(), "cannot annotate frozen message") {
+		t.Errorf("expected error annotating a frozen message, got %v", err)
+	}
+}
+
+func TestWithMessageHandler(t *testing.T) {
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "test15.sky", skycfg.WithFileReader(&testLoader{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []proto.Message{
+		&pb.MessageV2{FInt64: proto.Int64(0)},
+		&pb.MessageV2{FInt64: proto.Int64(1)},
+		&pb.MessageV2{FInt64: proto.Int64(2)},
+	}
+
+	msgs, err := config.Main(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("expected %v, got %v", want, msgs)
+	}
+
+	var handled []proto.Message
+	var annotations []map[string]string
+	result, err := config.Exec(ctx, skycfg.WithMessageHandler(func(msg proto.Message, ann map[string]string) error {
+		handled = append(handled, msg)
+		annotations = append(annotations, ann)
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Messages) != 0 {
+		t.Errorf("expected handled messages not to be collected, got %v", result.Messages)
+	}
+	if !reflect.DeepEqual(handled, want) {
+		t.Errorf("expected %v, got %v", want, handled)
+	}
+	if wantAnn := []map[string]string{nil, nil, {"wave": "last"}}; !reflect.DeepEqual(annotations, wantAnn) {
+		t.Errorf("expected annotations %v, got %v", wantAnn, annotations)
+	}
+
+	handled = nil
+	_, err = config.Main(ctx, skycfg.WithMessageHandler(func(msg proto.Message, ann map[string]string) error {
+		handled = append(handled, msg)
+		return fmt.Errorf("output is full")
+	}))
+	if err == nil || !strings.Contains(err.Error(), "output is full") {
+		t.Errorf("expected handler error to stop execution, got %v", err)
+	}
+	if len(handled) != 1 {
+		t.Errorf("expected execution to stop after the first message, got %d", len(handled))
+	}
+
+	if _, err := config.Main(ctx, skycfg.WithMessageHandler(nil)); err == nil || !strings.Contains(err.Error(), "WithMessageHandler: nil handler") {
+		t.Errorf("expected error for nil handler, got %v", err)
+	}
+
+	// A list from the module's globals is frozen, so it isn't released.
+	config, err = skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`OUT = [proto.package("skycfg.test_proto").MessageV2(f_int64 = 0)]
+
+def main(ctx):
+	return OUT
+`),
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled = nil
+	if _, err := config.Main(ctx, skycfg.WithMessageHandler(func(msg proto.Message, ann map[string]string) error {
+		handled = append(handled, msg)
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(handled, want[:1]) {
+		t.Errorf("expected %v, got %v", want[:1], handled)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	// Local modules are watched for filesystem events, so the interval
+	// doesn't matter.
+	t.Run("events", func(t *testing.T) {
+		testWatch(t, time.Hour, func(dir string) skycfg.FileReader {
+			return skycfg.LocalFileReader(dir)
+		})
+	})
+	t.Run("polling", func(t *testing.T) {
+		testWatch(t, 10*time.Millisecond, func(dir string) skycfg.FileReader {
+			return struct{ skycfg.FileReader }{skycfg.LocalFileReader(dir)}
+		})
+	})
+}
+
+func testWatch(t *testing.T, interval time.Duration, reader func(dir string) skycfg.FileReader) {
+	dir, err := ioutil.TempDir("", "skycfg-watch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile := func(name, content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("main.sky", "load(\"lib.sky\", \"VALUE\")\nRESULT = VALUE\n")
+	writeFile("lib.sky", "VALUE = 1\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logged := make(chan skycfg.LogEntry, 10)
+	configs, err := skycfg.Watch(ctx, filepath.Join(dir, "main.sky"),
+		skycfg.WithFileReader(reader(dir)),
+		skycfg.WithWatchInterval(interval),
+		skycfg.WithLogger(func(entry skycfg.LogEntry) { logged <- entry }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() *skycfg.Config {
+		t.Helper()
+		select {
+		case config := <-configs:
+			return config
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for config")
+		}
+		return nil
+	}
+	if got := next().Locals()["RESULT"].String(); got != "1" {
+		t.Errorf("initial config: got RESULT = %s, want 1", got)
+	}
+
+	writeFile("lib.sky", "VALUE = 2\n")
+	if got := next().Locals()["RESULT"].String(); got != "2" {
+		t.Errorf("reloaded config: got RESULT = %s, want 2", got)
+	}
+
+	writeFile("lib.sky", "VALUE = \n")
+	select {
+	case entry := <-logged:
+		if !strings.Contains(entry.Message, "reloading config failed") {
+			t.Errorf("unexpected log entry %+v", entry)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for reload error")
+	}
+
+	writeFile("lib.sky", "VALUE = 3\n")
+	if got := next().Locals()["RESULT"].String(); got != "3" {
+		t.Errorf("reloaded config: got RESULT = %s, want 3", got)
+	}
+
+	cancel()
+	for range configs {
+	}
+}
+
+func TestConfigTests(t *testing.T) {
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "test16.sky", skycfg.WithFileReader(&testLoader{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtures := skycfg.WithFixtures(map[string]proto.Message{
+		"prod_cluster": &pb.MessageV3{FInt32: 3},
+	})
+	vars := skycfg.WithTestExecOptions(skycfg.WithVars(starlark.StringDict{"env": starlark.String("test")}))
+
+	var names []string
+	failures := make(map[string]string)
+	for _, test := range config.Tests() {
+		names = append(names, test.Name())
+		result, err := test.Run(ctx, fixtures, vars)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Failure != nil {
+			failures[test.Name()] = result.Failure.Error()
+		}
+	}
+	wantNames := []string{"test_fixture_is_copied", "test_missing_fixture", "test_scale_up"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("Tests(): got %v, want %v", names, wantNames)
+	}
+	if len(failures) != 1 || !strings.Contains(failures["test_missing_fixture"], `ctx.fixtures: no fixture named "staging_cluster"`) {
+		t.Errorf("unexpected failures: %v", failures)
+	}
+}
+
+func TestRestrictedGlobals(t *testing.T) {
+	now := starlark.NewBuiltin("now", func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return starlark.MakeInt(1234), nil
+	})
+	clock := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{"now": now})
+	files := map[string][]byte{
+		"main.sky": []byte(`
+test_proto = proto.package("skycfg.test_proto")
+
+def main(ctx):
+	return [test_proto.MessageV3(f_int64 = clock.now())]
+
+def test_clock(ctx):
+	if clock.now() != 1234:
+		fail("unexpected time")
+`),
+		"load_time.sky": []byte("START = clock.now()\n"),
+	}
+	ctx := context.Background()
+	opts := []skycfg.LoadOption{
+		skycfg.WithFileReader(skycfg.MapFileReader(files)),
+		skycfg.WithRestrictedGlobals(starlark.StringDict{"clock": clock}),
+	}
+	config, err := skycfg.Load(ctx, "main.sky", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Granting a capability to tests doesn't grant it to main(), and vice
+	// versa.
+	testGrant := skycfg.WithTestExecOptions(skycfg.GrantCapabilities("clock"))
+	if _, err := config.Main(ctx); err == nil || !strings.Contains(err.Error(), `clock.now: capability "clock" is not granted`) {
+		t.Errorf("main() without grant: expected capability error, got %v", err)
+	}
+	result, err := config.Tests()[0].Run(ctx, testGrant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Failure != nil {
+		t.Errorf("test with grant: unexpected failure: %v", result.Failure)
+	}
+	result, err = config.Tests()[0].Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Failure == nil || !strings.Contains(result.Failure.Error(), `capability "clock" is not granted`) {
+		t.Errorf("test without grant: expected capability error, got %v", result.Failure)
+	}
+	msgs, err := config.Main(ctx, skycfg.GrantCapabilities("clock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msgs[0].(*pb.MessageV3).GetFInt64(); got != 1234 {
+		t.Errorf("main() with grant: got f_int64 = %d, want 1234", got)
+	}
+
+	// Modules can't use restricted globals while loading.
+	_, err = skycfg.Load(ctx, "load_time.sky", opts...)
+	if err == nil || !strings.Contains(err.Error(), `capability "clock" is not granted`) {
+		t.Errorf("load: expected capability error, got %v", err)
+	}
+}
+
+func TestTestArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skycfg-artifacts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+test_proto = proto.package("skycfg.test_proto")
+
+def test_render(ctx):
+	out = ctx.test.output_file("rendered.yaml")
+	out.write(proto.to_yaml(test_proto.MessageV3(f_string = "rendered")))
+	out.write("---\n")
+	fail("rendering differs")
+
+def test_bad_name(ctx):
+	ctx.test.output_file("../escape")
+`),
+	})
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make(map[string]*skycfg.TestResult)
+	for _, test := range config.Tests() {
+		result, err := test.Run(ctx, skycfg.WithArtifactsDir(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		results[test.Name()] = result
+	}
+
+	want := "f_string: rendered\n---\n"
+	render := results["test_render"]
+	if render.Failure == nil || string(render.Artifacts["rendered.yaml"]) != want {
+		t.Errorf("unexpected result of test_render: %+v", render)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "test_render", "rendered.yaml"))
+	if err != nil || string(data) != want {
+		t.Errorf("expected artifact %q on disk, got (%q, %v)", want, data, err)
+	}
+	if failure := results["test_bad_name"].Failure; failure == nil || !strings.Contains(failure.Error(), `invalid file name "../escape"`) {
+		t.Errorf("expected invalid name error, got %v", failure)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test_bad_name")); !os.IsNotExist(err) {
+		t.Errorf("expected no artifacts for test_bad_name, got %v", err)
+	}
+}
+
+func TestVarsUsage(t *testing.T) {
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "test17.sky", skycfg.WithFileReader(&testLoader{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := config.VarsUsage(ctx, skycfg.WithVars(starlark.StringDict{"env": starlark.String("prod")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []skycfg.VarUsage{
+		{Name: "env", Types: []string{"string"}, Required: true, Set: true},
+		{Name: "region", Required: true},
+		{Name: "replicas", Types: []string{"int"}, Defaults: []string{"3"}},
+	}
+	if !reflect.DeepEqual(report.Vars, want) {
+		t.Errorf("VarsUsage(): got %+v, want %+v", report.Vars, want)
+	}
+
+	wantDoc := "# Vars of `test17.sky`\n\n" +
+		"| Name | Type | Default |\n" +
+		"|------|------|---------|\n" +
+		"| `env` | string | required |\n" +
+		"| `region` | unknown | required |\n" +
+		"| `replicas` | int | `3` |\n"
+	if got := report.Markdown(); got != wantDoc {
+		t.Errorf("Markdown(): got\n%s\nwant\n%s", got, wantDoc)
+	}
+
+	if _, err := config.VarsUsage(ctx); err == nil {
+		t.Error("expected an error when a required var is missing")
+	}
+
+	// The recorder isn't a dict, so comparing it with one mustn't treat it
+	// as one.
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+def main(ctx):
+	if {} == ctx.vars or ctx.vars == {}:
+		fail("vars compared equal to a dict")
+	if dir(ctx.vars) != dir({}):
+		fail("vars methods differ from a dict's")
+	return []
+`),
+	})
+	config, err = skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.VarsUsage(ctx, skycfg.WithVars(starlark.StringDict{"env": starlark.String("prod")})); err != nil {
+		t.Errorf("VarsUsage(): %v", err)
+	}
+}
+
+func TestAuditCapabilities(t *testing.T) {
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+load("lib.sky", "render")
+load("@builtin//secrets", "read_secret")
+
+def main(ctx):
+	if ctx.vars.get("debug", False):
+		ctx.lookup("unused")
+	return render(read_secret("db"), ctx.lookup("region"))
+`),
+		"lib.sky": []byte(`
+load("@builtin//secrets", "read_secret")
+
+DEFAULT = read_secret("default")
+
+def render(secret, region):
+	return [proto.package("skycfg.test_proto").MessageV3(f_string = secret + region)]
+`),
+	})
+	echo := starlark.NewBuiltin("echo", func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return args[0], nil
+	})
+	unused := starlark.NewBuiltin("unused", func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return starlark.None, nil
+	})
+
+	ctx := context.Background()
+	report, err := skycfg.AuditCapabilities(ctx, "main.sky",
+		[]skycfg.LoadOption{
+			skycfg.WithFileReader(reader),
+			skycfg.WithModule("secrets", starlark.StringDict{"read_secret": echo}),
+			skycfg.WithGlobals(starlark.StringDict{"unused_global": unused}),
+		},
+		skycfg.WithCtxAttrs(starlark.StringDict{"lookup": echo}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(report.Modules), 2; got != want {
+		t.Errorf("Modules: got %d, want %d: %+v", got, want, report.Modules)
+	}
+	if want := []string{"secrets"}; !reflect.DeepEqual(report.BuiltinModules, want) {
+		t.Errorf("BuiltinModules: got %v, want %v", report.BuiltinModules, want)
+	}
+	wantBuiltins := []skycfg.BuiltinCalls{
+		{Name: "@builtin//secrets.read_secret", Calls: 2},
+		{Name: "ctx.lookup", Calls: 1},
+	}
+	if !reflect.DeepEqual(report.Builtins, wantBuiltins) {
+		t.Errorf("Builtins: got %+v, want %+v", report.Builtins, wantBuiltins)
+	}
+	wantVars := []skycfg.VarUsage{
+		{Name: "debug", Types: []string{"bool"}, Defaults: []string{"False"}},
+	}
+	if !reflect.DeepEqual(report.Vars, wantVars) {
+		t.Errorf("Vars: got %+v, want %+v", report.Vars, wantVars)
+	}
+	data, err := report.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Name": "ctx.lookup"`) {
+		t.Errorf("JSON(): missing ctx.lookup in\n%s", data)
+	}
+
+	// A failed execution still reports what ran before the failure.
+	report, err = skycfg.AuditCapabilities(ctx, "main.sky",
+		[]skycfg.LoadOption{
+			skycfg.WithFileReader(reader),
+			skycfg.WithModule("secrets", starlark.StringDict{"read_secret": echo}),
+		},
+	)
+	if err == nil {
+		t.Fatal("expected an error when ctx.lookup is missing")
+	}
+	if want := []skycfg.BuiltinCalls{{Name: "@builtin//secrets.read_secret", Calls: 2}}; !reflect.DeepEqual(report.Builtins, want) {
+		t.Errorf("Builtins after failure: got %+v, want %+v", report.Builtins, want)
+	}
+}
+
+func TestIndexSymbols(t *testing.T) {
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"apps/web.sky": []byte(`
+load("lib/k8s.sky", "make_deployment")
+
+def main(ctx):
+	return [make_deployment("web")]
+`),
+		"apps/worker.sky": []byte(`
+load("lib/common.sky", deploy = "make_deployment", "REPLICAS")
+
+def main(ctx):
+	make_deployment = None
+	return [deploy("worker", REPLICAS)]
+`),
+		"lib/common.sky": []byte(`
+load("lib/k8s.sky", "make_deployment")
+
+REPLICAS = 3
+`),
+		"lib/k8s.sky": []byte(`
+exports = ["make_deployment"]
+
+def make_deployment(name, replicas = 1):
+	return _label(name)
+
+def _label(name):
+	return name
+`),
+	})
+	ctx := context.Background()
+	// IndexSymbols accepts the same options as Load, including globals.
+	globals := skycfg.WithGlobals(starlark.StringDict{"REPLICAS": starlark.MakeInt(1)})
+	idx, err := skycfg.IndexSymbols(ctx, []string{"apps/web.sky", "apps/worker.sky"}, skycfg.WithFileReader(reader), globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var symbols []string
+	for _, sym := range idx.Symbols() {
+		symbols = append(symbols, fmt.Sprintf("%s:%s", sym.Module, sym.Name))
+	}
+	wantSymbols := []string{
+		"apps/web.sky:main",
+		"apps/worker.sky:main",
+		"lib/common.sky:REPLICAS",
+		"lib/k8s.sky:make_deployment",
+	}
+	if !reflect.DeepEqual(symbols, wantSymbols) {
+		t.Errorf("Symbols(): got %v, want %v", symbols, wantSymbols)
+	}
+
+	var uses []string
+	for _, use := range idx.Uses("lib/k8s.sky", "make_deployment") {
+		uses = append(uses, fmt.Sprintf("%s:%d %s load=%v", use.Module, use.Pos.Line, use.Name, use.Load))
+	}
+	wantUses := []string{
+		"apps/web.sky:2 make_deployment load=true",
+		"apps/web.sky:5 make_deployment load=false",
+		"apps/worker.sky:2 deploy load=true",
+		"apps/worker.sky:6 deploy load=false",
+		"lib/common.sky:2 make_deployment load=true",
+	}
+	if !reflect.DeepEqual(uses, wantUses) {
+		t.Errorf("Uses(make_deployment): got %v, want %v", uses, wantUses)
+	}
+	if uses := idx.Uses("lib/common.sky", "make_deployment"); len(uses) != 0 {
+		t.Errorf("re-exported uses should be attributed to the defining module, got %v", uses)
+	}
+
+	_, err = skycfg.IndexSymbols(ctx, []string{"apps/web.sky"}, skycfg.WithFileReader(reader), skycfg.WithProtoDescriptorSet([]byte("junk")))
+	if err == nil || !strings.Contains(err.Error(), "WithProtoDescriptorSet") {
+		t.Errorf("expected invalid option error, got %v", err)
+	}
+}
+
+func TestLoadGraph(t *testing.T) {
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+load("lib/k8s.sky", "make_deployment")
+load("lib/common.sky", "REPLICAS")
+
+def main(ctx):
+	return [make_deployment("web", REPLICAS)]
+`),
+		"lib/common.sky": []byte(`REPLICAS = 3
+`),
+		"lib/k8s.sky": []byte(`
+load("lib/common.sky", "REPLICAS")
+
+def make_deployment(name, replicas = REPLICAS):
+	return proto.package("skycfg.test_proto").MessageV3(f_string = name, f_int32 = replicas)
+`),
+	})
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph := config.LoadGraph()
+	graph.Symbols, err = skycfg.IndexSymbols(ctx, []string{"main.sky"}, skycfg.WithFileReader(reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dot bytes.Buffer
+	if err := graph.WriteDOT(&dot); err != nil {
+		t.Fatal(err)
+	}
+	wantDOT := `digraph skycfg {
+	"lib/common.sky" [shape=box];
+	"lib/k8s.sky" [shape=box];
+	"main.sky" [shape=box];
+	"lib/common.sky:REPLICAS" [label="REPLICAS"];
+	"lib/k8s.sky:make_deployment" [label="make_deployment"];
+	"lib/k8s.sky" -> "lib/common.sky";
+	"main.sky" -> "lib/common.sky";
+	"main.sky" -> "lib/k8s.sky";
+	"lib/common.sky" -> "lib/common.sky:REPLICAS" [style=dashed];
+	"lib/k8s.sky" -> "lib/common.sky:REPLICAS";
+	"main.sky" -> "lib/common.sky:REPLICAS";
+	"lib/k8s.sky" -> "lib/k8s.sky:make_deployment" [style=dashed];
+	"main.sky" -> "lib/k8s.sky:make_deployment";
+}
+`
+	if got := dot.String(); got != wantDOT {
+		t.Errorf("WriteDOT(): got\n%s\nwant\n%s", got, wantDOT)
+	}
+
+	var graphML bytes.Buffer
+	if err := config.LoadGraph().WriteGraphML(&graphML); err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		Nodes []struct {
+			ID string `xml:"id,attr"`
+		} `xml:"graph>node"`
+		Edges []struct {
+			Source string `xml:"source,attr"`
+			Target string `xml:"target,attr"`
+		} `xml:"graph>edge"`
+	}
+	if err := xml.Unmarshal(graphML.Bytes(), &parsed); err != nil {
+		t.Fatalf("WriteGraphML() wrote invalid XML: %v\n%s", err, graphML.String())
+	}
+	if len(parsed.Nodes) != 3 || len(parsed.Edges) != 3 || parsed.Edges[0].Source != "lib/k8s.sky" || parsed.Edges[0].Target != "lib/common.sky" {
+		t.Errorf("WriteGraphML(): unexpected graph\n%s", graphML.String())
+	}
+	if !strings.Contains(graphML.String(), `<data key="hash">sha256:`) {
+		t.Errorf("WriteGraphML(): expected module hashes\n%s", graphML.String())
+	}
+}
+
+func TestProtoServices(t *testing.T) {
+	ctx := context.Background()
+	set := impl.TestdataDescriptorSet(t, "example/api.proto")
+	registry, err := skycfg.NewDescriptorSetRegistry(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+svc = proto.package("example").ItemService
+routes = [
+	(
+		"/%s/%s" % (svc.full_name, method.name),
+		proto.type_name(method.input_type),
+		proto.type_name(method.output_type),
+		method.client_streaming,
+		method.server_streaming,
+		method.options.deprecated,
+	)
+	for method in svc.methods
+]
+`),
+	})
+	config, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(reader), skycfg.WithProtoRegistry(registry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[("/example.ItemService/Get", "example.GetRequest", "example.Item", False, False, True), ` +
+		`("/example.ItemService/Watch", "example.GetRequest", "example.Item", False, True, None)]`
+	if got := config.Locals()["routes"].String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if got := config.Locals()["svc"].String(); got != `<proto.Service "example.ItemService">` {
+		t.Errorf("unexpected service %s", got)
+	}
+}
+
+func TestDescriptorSetRegistry(t *testing.T) {
+	ctx := context.Background()
+	set := impl.TestdataDescriptorSet(t, "example/deploy.proto")
+	registry, err := skycfg.NewDescriptorSetRegistry(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+example = proto.package("example")
+
+def main(ctx):
+	return [example.Deployment(
+		name = "web",
+		replicas = 3,
+		labels = {"app": "web"},
+		strategy = example.Deployment.Strategy.ROLLING,
+		timeout = proto.package("google.protobuf").Duration(seconds = 30),
+		containers = [example.Deployment.Container(image = "nginx")],
+	)]
+`),
+	})
+	config, err := skycfg.Load(ctx, "main.sky",
+		skycfg.WithFileReader(reader),
+		skycfg.WithProtoRegistry(registry),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := config.Main(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	got, err := (&jsonpb.Marshaler{OrigName: true}).MarshalToString(msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"name":"web","replicas":3,"labels":{"app":"web"},"strategy":"ROLLING","timeout":"30s","containers":[{"image":"nginx"}]}`
+	if got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	set.File = append(set.File, set.File[0])
+	if _, err := skycfg.NewDescriptorSetRegistry(set); err == nil {
+		t.Error("expected error for duplicate file in descriptor set")
+	}
+}
+
+func TestProtoFiles(t *testing.T) {
+	ctx := context.Background()
+	files := map[string][]byte{
+		"main.sky": []byte(`
+example = proto.package("example")
+
+def main(ctx):
+	return [example.Deployment(
+		name = "web",
+		strategy = example.Strategy.ROLLING,
+		timeout = proto.package("google.protobuf").Duration(seconds = 30),
+		labels = {"app": "web"},
+	)]
+`),
+		"example/deploy.proto": []byte(`
+syntax = "proto3";
+package example;
+
+import "example/strategy.proto";
+import "google/protobuf/duration.proto";
+
+message Deployment {
+	string name = 1;
+	Strategy strategy = 2;
+	google.protobuf.Duration timeout = 3;
+	map<string, string> labels = 4;
+}
+`),
+		"example/strategy.proto": []byte(`
+syntax = "proto3";
+package example;
+
+enum Strategy {
+	RECREATE = 0;
+	ROLLING = 1;
+}
+`),
+		"broken.proto": []byte(`
+syntax = "proto3";
+message Broken { Missing field = 1; }
+`),
+	}
+	reader := skycfg.MapFileReader(files)
+	config, err := skycfg.Load(ctx, "main.sky",
+		skycfg.WithFileReader(reader),
+		skycfg.WithProtoFiles("example/deploy.proto"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := config.Main(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	got, err := (&jsonpb.Marshaler{OrigName: true}).MarshalToString(msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"name":"web","strategy":"ROLLING","timeout":"30s","labels":{"app":"web"}}`
+	if got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	_, err = skycfg.Load(ctx, "main.sky",
+		skycfg.WithFileReader(reader),
+		skycfg.WithProtoFiles("broken.proto"),
+	)
+	if err == nil || !strings.Contains(err.Error(), `broken.proto:3:18: field Broken.field: unknown type Missing`) {
+		t.Errorf("expected compile error, got %v", err)
+	}
+	if _, err := skycfg.Load(ctx, "main.sky",
+		skycfg.WithFileReader(reader),
+		skycfg.WithProtoFiles("missing.proto"),
+	); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected missing file error, got %v", err)
+	}
+}
+
+func TestOutputSchema(t *testing.T) {
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+msg = proto.package("skycfg.test_proto").MessageV3(f_string = "a")
+OUT = [proto.to_json(msg), json.marshal({"msg": msg})]
+
+def main(ctx):
+	return []
+`),
+	})
+	ctx := context.Background()
+	lock := &skycfg.Lockfile{}
+	config, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(reader), skycfg.WithLockfile(lock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := config.OutputSchema(), "1"; got != want {
+		t.Errorf("OutputSchema(): got %q, want %q", got, want)
+	}
+	if got, want := lock.OutputSchema, "1"; got != want {
+		t.Errorf("lock.OutputSchema: got %q, want %q", got, want)
+	}
+	want := `["{\"f_string\":\"a\"}", "{\"msg\": {\"f_string\":\"a\"}}"]`
+	if got := config.Locals()["OUT"].String(); got != want {
+		t.Errorf("OUT: got %s, want %s", got, want)
+	}
+
+	lock.OutputSchema = "0"
+	_, err = skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(reader), skycfg.WithLockfileVerification(lock))
+	if err == nil || !strings.Contains(err.Error(), `unknown output schema "0"`) {
+		t.Errorf("expected unknown schema error, got %v", err)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected WithOutputSchema to panic on an unknown version")
+		}
+	}()
+	skycfg.WithOutputSchema("0")
+}
+
+func TestPartialResults(t *testing.T) {
+	files := map[string][]byte{
+		"main.sky": []byte(`
+test_proto = proto.package("skycfg.test_proto")
+
+def render(ctx, cluster):
+	ctx.emit(test_proto.MessageV3(f_string = cluster + "-emitted"))
+	if cluster == "bad":
+		fail("cannot render " + cluster)
+	return [test_proto.MessageV3(f_string = cluster)]
+
+def main(ctx):
+	msgs = []
+	for cluster in ["east", "bad", "west"]:
+		msgs += ctx.isolate(cluster, render, ctx, cluster = cluster) or []
+	return msgs
+`),
+	}
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(skycfg.MapFileReader(files)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without partial results, the first failure stops execution.
+	msgs, err := config.Main(ctx)
+	var execErr *skycfg.ExecError
+	if msgs != nil || !errors.As(err, &execErr) || !strings.Contains(err.Error(), "cannot render bad") {
+		t.Errorf("expected ExecError, got (%v, %v)", msgs, err)
+	}
+
+	msgs, err = config.Main(ctx, skycfg.WithPartialResults())
+	var got []string
+	for _, msg := range msgs {
+		got = append(got, msg.(*pb.MessageV3).GetFString())
+	}
+	if want := []string{"east-emitted", "west-emitted", "east", "west"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected messages %q, got %q", want, got)
+	}
+	var partialErr *skycfg.PartialError
+	if !errors.As(err, &partialErr) || len(partialErr.Errs) != 1 {
+		t.Fatalf("expected PartialError with one error, got %v", err)
+	}
+	if isolated := partialErr.Errs[0]; isolated.Name != "bad" || !strings.Contains(isolated.Err.Error(), "cannot render bad") {
+		t.Errorf("unexpected isolated error %v", isolated)
+	}
+	var evalErr *starlark.EvalError
+	if !errors.As(err, &evalErr) {
+		t.Errorf("expected PartialError to wrap the EvalError, got %#v", err)
+	}
+}
+
+func TestPlaceholderExpansion(t *testing.T) {
+	files := map[string][]byte{
+		"main.sky": []byte(`
+test_proto = proto.package("skycfg.test_proto")
+
+TEMPLATE = test_proto.MessageV3(f_string = "${REGION}")
+
+def main(ctx):
+	return [test_proto.MessageV3(
+		f_string = "${REGION}/${ZONE}",
+		r_string = ["${SKYCFG_TEST_HOME_DIR}", "$REGION"],
+		map_string = {"zone": "${ZONE}"},
+		f_submsg = TEMPLATE,
+		r_submsg = [test_proto.MessageV3(f_string = "${SECRET}")],
+	)]
+`),
+	}
+	ctx := context.Background()
+	config, err := skycfg.Load(ctx, "main.sky", skycfg.WithFileReader(skycfg.MapFileReader(files)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SKYCFG_TEST_HOME_DIR", "/home/skycfg")
+	defer os.Unsetenv("SKYCFG_TEST_HOME_DIR")
+	policy := skycfg.PlaceholderPolicy{
+		Fields: []string{
+			"skycfg.test_proto.MessageV3.f_string",
+			"skycfg.test_proto.MessageV3.r_string",
+			"skycfg.test_proto.MessageV3.map_string",
+		},
+		Vars: []string{"REGION", "ZONE"},
+		Env:  []string{"SKYCFG_TEST_HOME_DIR"},
+	}
+	vars := skycfg.WithVars(starlark.StringDict{
+		"REGION": starlark.String("us-west"),
+		"ZONE":   starlark.String("a"),
+		"SECRET": starlark.String("hunter2"),
+	})
+	msgs, err := config.Main(ctx, vars, skycfg.WithPlaceholderExpansion(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &pb.MessageV3{
+		FString:   "us-west/a",
+		RString:   []string{"/home/skycfg", "$REGION"},
+		MapString: map[string]string{"zone": "a"},
+		FSubmsg:   &pb.MessageV3{FString: "us-west"},
+		RSubmsg:   []*pb.MessageV3{{FString: "${SECRET}"}},
+	}
+	if !proto.Equal(msgs[0], want) {
+		t.Errorf("expected %v, got %v", want, msgs[0])
+	}
+
+	// Templates shared with the output aren't modified.
+	msgs, err = config.Main(ctx, skycfg.WithPlaceholderExpansion(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msgs[0].(*pb.MessageV3).GetFSubmsg().GetFString(); got != "${REGION}" {
+		t.Errorf("expected unexpanded template, got %q", got)
+	}
+
+	policy.Strict = true
+	_, err = config.Main(ctx, vars, skycfg.WithPlaceholderExpansion(policy))
+	var validationErr *skycfg.ValidationError
+	if !errors.As(err, &validationErr) || !strings.Contains(err.Error(), "unknown placeholder ${SECRET} in field skycfg.test_proto.MessageV3.f_string") {
+		t.Errorf("expected strict policy to reject ${SECRET}, got %v", err)
+	}
+
+	// The vars and environment variables that placeholders read are
+	// capabilities of the config.
+	policy.Strict = false
+	report, err := skycfg.AuditCapabilities(ctx, "main.sky",
+		[]skycfg.LoadOption{skycfg.WithFileReader(skycfg.MapFileReader(files))},
+		vars, skycfg.WithPlaceholderExpansion(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"SKYCFG_TEST_HOME_DIR"}; !reflect.DeepEqual(report.Env, want) {
+		t.Errorf("Env: got %v, want %v", report.Env, want)
+	}
+	var varNames []string
+	for _, usage := range report.Vars {
+		varNames = append(varNames, usage.Name)
+	}
+	if want := []string{"REGION", "ZONE"}; !reflect.DeepEqual(varNames, want) {
+		t.Errorf("Vars: got %v, want %v", varNames, want)
+	}
+}
+
+func TestWithSharedSubmessages(t *testing.T) {
+	files := map[string][]byte{
+		"main.sky": []byte(`
+pb = proto.package("skycfg.test_proto")
+TEMPLATE = pb.MessageV3(f_string = "template")
+
+def main(ctx):
+	return [pb.MessageV3(f_submsg = TEMPLATE), pb.MessageV3(f_submsg = TEMPLATE)]
+`),
+	}
+	ctx := context.Background()
+	reader := skycfg.WithFileReader(skycfg.MapFileReader(files))
+	for _, share := range []bool{false, true} {
+		opts := []skycfg.LoadOption{reader}
+		if share {
+			opts = append(opts, skycfg.WithSharedSubmessages())
+		}
+		config, err := skycfg.Load(ctx, "main.sky", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs, err := config.Main(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, second := msgs[0].(*pb.MessageV3).FSubmsg, msgs[1].(*pb.MessageV3).FSubmsg
+		if (first == second) != share {
+			t.Errorf("share=%v: got shared submessage %v", share, first == second)
+		}
+	}
+}
+
+func TestProtoCustomOptions(t *testing.T) {
+	ctx := context.Background()
+	set := impl.TestdataDescriptorSet(t, "example/annotated.proto")
+	registry, err := skycfg.NewDescriptorSetRegistry(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+example = proto.package("example")
+
+RESULTS = [
+	proto.get_extension(proto.options(example.Service), "example.tier"),
+	proto.get_extension(proto.options(example.Service, field = "owner_email"), "example.classification"),
+	proto.options(example.Service, field = "owner_email").deprecated,
+	proto.get_extension(proto.options(example.Service, file = True), "example.team"),
+	proto.get_extension(proto.options(example.Service), "example.team"),
+]
+`),
+	})
+	config, err := skycfg.Load(ctx, "main.sky",
+		skycfg.WithFileReader(reader),
+		skycfg.WithProtoRegistry(registry),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `["critical", "pii", True, "payments", None]`
+	if got := config.Locals()["RESULTS"].String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestGenerateWrappers(t *testing.T) {
+	source, err := skycfg.GenerateWrappers(nil, "test_proto", skycfg.WrapperSpec{
+		Type:     "skycfg.test_proto.MessageV3",
+		Fields:   []string{"f_int32", "f_string", "f_submsg", "r_string"},
+		Required: []string{"f_string"},
+		Defaults: map[string]string{"f_int32": "1"},
+	}, skycfg.WrapperSpec{
+		Type: "skycfg.test_proto.MessageV3.NestedMessage",
+		Name: "nested",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(source, []byte("def message_v3(f_string, f_int32 = 1, f_submsg = None, r_string = None):")) {
+		t.Errorf("unexpected helper signature in:\n%s", source)
+	}
+	files := map[string][]byte{
+		"lib/test_proto.sky": source,
+		"main.sky": []byte(`
+load("lib/test_proto.sky", "test_proto")
+
+def main(ctx):
+	return [test_proto.message_v3("web", r_string = ["a"], f_submsg = test_proto.message_v3("sub", f_int32 = 2))]
+`),
+		"bad_type.sky":    []byte("load(\"lib/test_proto.sky\", \"test_proto\")\n\ndef main(ctx):\n\treturn [test_proto.message_v3(\"web\", f_int32 = \"1\")]\n"),
+		"bad_missing.sky": []byte("load(\"lib/test_proto.sky\", \"test_proto\")\n\ndef main(ctx):\n\treturn [test_proto.message_v3(None)]\n"),
+	}
+	ctx := context.Background()
+	reader := skycfg.WithFileReader(skycfg.MapFileReader(files))
+	config, err := skycfg.Load(ctx, "main.sky", reader)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, source)
+	}
+	msgs, err := config.Main(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &pb.MessageV3{
+		FInt32:  1,
+		FString: "web",
+		RString: []string{"a"},
+		FSubmsg: &pb.MessageV3{FInt32: 2, FString: "sub"},
+	}
+	if !proto.Equal(msgs[0], want) {
+		t.Errorf("expected %v, got %v", want, msgs[0])
+	}
+	for filename, wantErr := range map[string]string{
+		"bad_type.sky":    "message_v3: for parameter f_int32: got string, want int",
+		"bad_missing.sky": "message_v3: parameter f_string is required",
+	} {
+		config, err := skycfg.Load(ctx, filename, reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := config.Main(ctx); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: expected error %q, got %v", filename, wantErr, err)
+		}
+	}
+
+	for _, spec := range []skycfg.WrapperSpec{
+		{Type: "skycfg.test_proto.NoSuchType"},
+		{Type: "skycfg.test_proto.MessageV3", Fields: []string{"no_such_field"}},
+		{Type: "skycfg.test_proto.MessageV3", Fields: []string{"f_int32"}, Defaults: map[string]string{"f_int32": "("}},
+	} {
+		if _, err := skycfg.GenerateWrappers(nil, "", spec); err == nil {
+			t.Errorf("GenerateWrappers(%+v): expected error", spec)
+		}
+	}
+
+	// Fields and packages may have the same names as the module's own
+	// definitions and locals.
+	registry, err := skycfg.NewDescriptorSetRegistry(impl.TestdataDescriptorSet(t, "example/wrapped.proto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err = skycfg.GenerateWrappers(registry, "wrapped", skycfg.WrapperSpec{
+		Type:     "example.wrapped.Envelope",
+		Fields:   []string{"msg", "fail", "payload"},
+		Required: []string{"fail"},
+	}, skycfg.WrapperSpec{
+		Type: "example_wrapped.Payload",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader = skycfg.WithFileReader(skycfg.MapFileReader(map[string][]byte{
+		"lib/wrapped.sky": source,
+		"main.sky": []byte(`
+load("lib/wrapped.sky", "wrapped")
+
+def main(ctx):
+	return [wrapped.envelope(msg = "m", fail = "f", payload = wrapped.payload(msg = "p"))]
+`),
+	}))
+	config, err = skycfg.Load(ctx, "main.sky", reader, skycfg.WithProtoRegistry(registry))
+	if err != nil {
+		t.Fatalf("%v\n%s", err, source)
+	}
+	msgs, err = config.Main(ctx)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, source)
+	}
+	if got, want := proto.CompactTextString(msgs[0]), `msg:"m" fail:"f" payload:<msg:"p" > `; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	for _, spec := range []skycfg.WrapperSpec{
+		{Type: "example.wrapped.Envelope", Fields: []string{"_hidden"}},
+		{Type: "example.wrapped.Envelope", Name: "_envelope"},
+	} {
+		if _, err := skycfg.GenerateWrappers(registry, "", spec); err == nil || !strings.Contains(err.Error(), "is reserved") {
+			t.Errorf("GenerateWrappers(%+v): expected reserved name error, got %v", spec, err)
+		}
+	}
+}
+
+// fakeReflectionClient serves the files of a descriptor set, as a gRPC
+// server's reflection service would.
+type fakeReflectionClient struct {
+	files    map[string]*descriptorpb.FileDescriptorProto
+	requests []string
+
+	// err, if set, is returned instead of the requested symbol.
+	err error
+}
+
+func (c *fakeReflectionClient) FileContainingSymbol(ctx context.Context, symbol string) ([][]byte, error) {
+	c.requests = append(c.requests, "symbol:"+symbol)
+	if c.err != nil {
+		return nil, c.err
+	}
+	for _, file := range c.files {
+		prefix := file.GetPackage() + "."
+		if !strings.HasPrefix(symbol, prefix) {
+			continue
+		}
+		name := strings.Split(strings.TrimPrefix(symbol, prefix), ".")[0]
+		for _, msg := range file.GetMessageType() {
+			if msg.GetName() == name {
+				return c.encode(file)
+			}
+		}
+		for _, svc := range file.GetService() {
+			if svc.GetName() == name {
+				return c.encode(file)
+			}
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "symbol not found: %s", symbol)
+}
+
+func (c *fakeReflectionClient) FileByFilename(ctx context.Context, filename string) ([][]byte, error) {
+	c.requests = append(c.requests, "file:"+filename)
+	if file, ok := c.files[filename]; ok {
+		return c.encode(file)
+	}
+	return nil, status.Errorf(codes.NotFound, "file not found: %s", filename)
+}
+
+func (c *fakeReflectionClient) encode(file *descriptorpb.FileDescriptorProto) ([][]byte, error) {
+	data, err := proto.Marshal(file)
+	return [][]byte{data}, err
+}
+
+func TestReflectionRegistry(t *testing.T) {
+	ctx := context.Background()
+	client := &fakeReflectionClient{files: make(map[string]*descriptorpb.FileDescriptorProto)}
+	for _, file := range impl.TestdataDescriptorSet(t, "example/user_service.proto").File {
+		client.files[file.GetName()] = file
+	}
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+example = proto.package("example")
+
+def main(ctx):
+	method = example.Users.methods[0]
+	return [method.input_type(user = example.User(name = "alice"))]
+`),
+	})
+	config, err := skycfg.Load(ctx, "main.sky",
+		skycfg.WithFileReader(reader),
+		skycfg.WithProtoRegistry(skycfg.NewReflectionRegistry(client, 0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ii := 0; ii < 2; ii++ {
+		msgs, err := config.Main(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := (&jsonpb.Marshaler{OrigName: true}).MarshalToString(msgs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `{"user":{"name":"alice"}}`; got != want {
+			t.Errorf("expected %s, got %s", want, got)
+		}
+	}
+	// The linked google/protobuf/duration.proto isn't fetched, and files are
+	// fetched only once.
+	want := []string{"symbol:example.Users", "file:example/user.proto"}
+	if !reflect.DeepEqual(client.requests, want) {
+		t.Errorf("expected requests %q, got %q", want, client.requests)
+	}
+
+	// Symbols that the server doesn't have are requested once, but other
+	// failures are retried.
+	registry := skycfg.NewReflectionRegistry(client, 0).(*impl.ReflectionRegistry)
+	client.requests = nil
+	for ii := 0; ii < 2; ii++ {
+		if desc, err := registry.UnstableProtoMessageDescriptor("example.Missing"); desc != nil || err != nil {
+			t.Errorf("expected no descriptor, got %v, %v", desc, err)
+		}
+	}
+	client.err = status.Error(codes.Unavailable, "connection refused")
+	for ii := 0; ii < 2; ii++ {
+		if _, err := registry.UnstableProtoMessageDescriptor("example.User"); err == nil || !strings.Contains(err.Error(), "connection refused") {
+			t.Errorf("expected unavailable error, got %v", err)
+		}
+	}
+	want = []string{"symbol:example.Missing", "symbol:example.User", "symbol:example.User"}
+	if !reflect.DeepEqual(client.requests, want) {
+		t.Errorf("expected requests %q, got %q", want, client.requests)
+	}
+}
+
+func TestWithProtoDescriptorSet(t *testing.T) {
+	ctx := context.Background()
+	file := impl.TestdataDescriptorSet(t, "example/app.proto").File[0]
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := skycfg.WithFileReader(skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte("def main(ctx):\n\treturn [proto.package(\"example\").App(name = \"web\")]\n"),
+	}))
+
+	// A file may be repeated across sets.
+	config, err := skycfg.Load(ctx, "main.sky", reader, skycfg.WithProtoDescriptorSet(data, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := config.Main(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := (&jsonpb.Marshaler{}).MarshalToString(msgs[0]); got != `{"name":"web"}` {
+		t.Errorf("unexpected message %s", got)
+	}
+
+	changed := proto.Clone(file).(*descriptorpb.FileDescriptorProto)
+	changed.MessageType[0].Name = proto.String("Service")
+	changedData, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{changed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, sets := range map[string][][]byte{
+		"conflicting": {data, changedData},
+		"malformed":   {[]byte("not a descriptor set")},
+	} {
+		if _, err := skycfg.Load(ctx, "main.sky", reader, skycfg.WithProtoDescriptorSet(sets...)); err == nil || !strings.HasPrefix(err.Error(), "WithProtoDescriptorSet: ") {
+			t.Errorf("%s: expected WithProtoDescriptorSet error, got %v", name, err)
+		}
+	}
+}
+
+func TestIsolatedProtoRegistry(t *testing.T) {
+	ctx := context.Background()
+	// A later version of MessageV3, which is also linked into the binary,
+	// that has a new field.
+	set := impl.TestdataDescriptorSet(t, "skycfg/test_proto/next.proto")
+	registry, err := skycfg.NewDescriptorSetRegistry(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := skycfg.WithFileReader(skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+pb = proto.package("skycfg.test_proto")
+
+def main(ctx):
+	return [pb.MessageV3(f_string = "web", f_next = 1)]
+`),
+		"any.sky": []byte(`
+pb = proto.package("skycfg.test_proto")
+packed = proto.from_json(proto.package("google.protobuf").Any, '{"@type": "type.googleapis.com/skycfg.test_proto.MessageV3", "fNext": 2}')
+next = proto.unpack_any(packed, pb.MessageV3).f_next
+encoded = proto.to_json(packed)
+
+def main(ctx):
+	return [pb.MessageV3(f_string = proto.to_json(packed))]
+`),
+	}))
+
+	// Without isolation, the generated type is used.
+	config, err := skycfg.Load(ctx, "main.sky", reader, skycfg.WithProtoRegistry(registry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Main(ctx); err == nil || !strings.Contains(err.Error(), `unexpected keyword argument "f_next"`) {
+		t.Errorf("expected error setting f_next of the generated type, got %v", err)
+	}
+
+	config, err = skycfg.Load(ctx, "main.sky", reader, skycfg.WithProtoRegistry(registry), skycfg.WithIsolatedProtoRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := config.Main(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msgs[0].(*pb.MessageV3); ok {
+		t.Errorf("expected a dynamic message, got the generated type")
+	}
+	if got, _ := (&jsonpb.Marshaler{OrigName: true}).MarshalToString(msgs[0]); got != `{"f_string":"web","f_next":1}` {
+		t.Errorf("unexpected message %s", got)
+	}
+
+	// The types of Any values decoded from and encoded as JSON are resolved
+	// with the registry too, both while loading and in main().
+	config, err = skycfg.Load(ctx, "any.sky", reader, skycfg.WithProtoRegistry(registry), skycfg.WithIsolatedProtoRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Locals()["next"].String(); got != "2" {
+		t.Errorf("expected f_next of 2, got %s", got)
+	}
+	wantJSON := `{"@type":"type.googleapis.com/skycfg.test_proto.MessageV3","f_next":2}`
+	if got, _ := starlark.AsString(config.Locals()["encoded"]); got != wantJSON {
+		t.Errorf("expected %s, got %s", wantJSON, got)
+	}
+	msgs, err = config.Main(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := proto.MessageReflect(msgs[0]).Get(proto.MessageReflect(msgs[0]).Descriptor().Fields().ByName("f_string")).String(); got != wantJSON {
+		t.Errorf("expected %s from main(), got %s", wantJSON, got)
+	}
+}
+
+func TestDeterministicEncoding(t *testing.T) {
+	ctx := context.Background()
+	reader := skycfg.WithFileReader(skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+pb = proto.package("skycfg.test_proto")
+msg = pb.MessageV3(map_string = {"k%d" % i: "v" for i in range(50)})
+
+def main(ctx):
+	return [
+		pb.MessageV3(f_bytes = proto.encode(msg)),
+		pb.MessageV3(f_bytes = proto.pack_any(msg).value),
+	]
+`),
+	}))
+	want := &pb.MessageV3{MapString: make(map[string]string)}
+	for ii := 0; ii < 50; ii++ {
+		want.MapString[fmt.Sprintf("k%d", ii)] = "v"
+	}
+	buf := proto.NewBuffer(nil)
+	buf.SetDeterministic(true)
+	if err := buf.Marshal(want); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, opts := range map[string]struct {
+		load []skycfg.LoadOption
+		exec []skycfg.ExecOption
+	}{
+		"load": {load: []skycfg.LoadOption{reader, skycfg.WithDeterministicEncoding()}},
+		"exec": {load: []skycfg.LoadOption{reader}, exec: []skycfg.ExecOption{skycfg.WithDeterministicEncoding()}},
+	} {
+		config, err := skycfg.Load(ctx, "main.sky", opts.load...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Go randomizes map iteration, so encoding repeatedly would
+		// eventually catch a nondeterministic order.
+		for ii := 0; ii < 5; ii++ {
+			msgs, err := config.Main(ctx, opts.exec...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range msgs {
+				if got := msg.(*pb.MessageV3).FBytes; !bytes.Equal(got, buf.Bytes()) {
+					t.Fatalf("%s: encoding isn't deterministic", name)
+				}
+			}
+		}
+	}
+}
+
+func TestLenientDecoding(t *testing.T) {
+	ctx := context.Background()
+	reader := skycfg.WithFileReader(skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+pb = proto.package("skycfg.test_proto")
+loaded = proto.from_yaml(pb.MessageV3, "f_string: a\nf_removed: 1\n")
+
+def main(ctx):
+	return [loaded, proto.from_json(pb.MessageV3, '{"f_string": "b", "f_removed": 1}')]
+`),
+		"strict.sky": []byte(`
+proto.from_json(proto.package("skycfg.test_proto").MessageV3, '{"f_removed": 1}', strict = True)
+`),
+	}))
+
+	if _, err := skycfg.Load(ctx, "main.sky", reader); err == nil || !strings.Contains(err.Error(), "f_removed") {
+		t.Errorf("expected error for unknown field, got %v", err)
+	}
+
+	config, err := skycfg.Load(ctx, "main.sky", reader, skycfg.WithLenientDecoding())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := config.Main(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ii, want := range []string{"a", "b"} {
+		if got := msgs[ii].(*pb.MessageV3).FString; got != want {
+			t.Errorf("message %d: expected f_string %q, got %q", ii, want, got)
+		}
+	}
+
+	if _, err := skycfg.Load(ctx, "strict.sky", reader, skycfg.WithLenientDecoding()); err == nil || !strings.Contains(err.Error(), "f_removed") {
+		t.Errorf("expected error for unknown field with strict = True, got %v", err)
+	}
+}
+
+func TestValidationRules(t *testing.T) {
+	ctx := context.Background()
+	set := impl.TestdataDescriptorSet(t, "example/validated.proto")
+	registry, err := skycfg.NewDescriptorSetRegistry(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+example = proto.package("example.validated")
+
+def valid():
+	return example.Service(name = "svc-web", replicas = 3, tags = ["a"], owner = example.Owner(email = "a@b"))
+
+def main(ctx):
+	proto.validate(valid())
+	if ctx.vars.get("broken"):
+		return [example.Service(name = "w", replicas = 11, tags = ["a", "", "c"], owner = example.Owner(email = "a"))]
+	return [valid(), example.Service(name = "svc-db", replicas = 1, owner = example.Owner(email = "db@example.com"))]
+`),
+		"check.sky": []byte(`
+example = proto.package("example.validated")
+
+def main(ctx):
+	proto.validate(example.Service(name = "svc-web", replicas = 0))
+	return []
+`),
+	})
+	opts := []skycfg.LoadOption{skycfg.WithFileReader(reader), skycfg.WithProtoRegistry(registry)}
+	config, err := skycfg.Load(ctx, "main.sky", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs, err := config.Main(ctx, skycfg.WithStandardValidationRules()); err != nil || len(msgs) != 2 {
+		t.Fatalf("expected valid messages, got (%v, %v)", msgs, err)
+	}
+	// Rules are only enforced on output when asked for.
+	broken := skycfg.WithVars(starlark.StringDict{"broken": starlark.True})
+	if _, err := config.Main(ctx, broken); err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.Main(ctx, broken, skycfg.WithStandardValidationRules())
+	var validationErr *skycfg.ValidationError
+	var ruleErr *skycfg.RuleError
+	if !errors.As(err, &validationErr) || !errors.As(err, &ruleErr) {
+		t.Fatalf("expected ValidationError with RuleError, got %v", err)
+	}
+	if got := ruleErr.Pos.String(); got != "main.sky:10" {
+		t.Errorf("expected position main.sky:10, got %s", got)
+	}
+	var got []string
+	for _, v := range ruleErr.Violations {
+		got = append(got, v.Path+" "+v.Rule)
+	}
+	want := []string{
+		"name string.min_len",
+		"name string.prefix",
+		"replicas int32.gte",
+		"tags repeated.max_items",
+		"tags[1] string.min_len",
+		"owner.email string.pattern",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected violations %q, got %q", want, got)
+	}
+
+	config, err = skycfg.Load(ctx, "check.sky", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.Main(ctx)
+	if err == nil || !strings.Contains(err.Error(), "proto.validate: check.sky:5: example.validated.Service breaks its validation rules: replicas: value must be greater than or equal to 1 and less than or equal to 10 [int32.gte] (set at check.sky:5); owner: value is required [required]") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestValidationRulesOfUnpopulatedFields(t *testing.T) {
+	ctx := context.Background()
+	set := impl.TestdataDescriptorSet(t, "example/validated.proto")
+	registry, err := skycfg.NewDescriptorSetRegistry(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := skycfg.MapFileReader(map[string][]byte{
+		"main.sky": []byte(`
+example = proto.package("example.validated")
+
+def fill(limits):
+	limits.offset = -6
+
+def main(ctx):
+	limits = example.Limits(zones = [], enabled = False, ids = ["a", "a"], contact = "not-an-email")
+	fill(limits)
+	return [limits]
+`),
+		"unsupported.sky": []byte(`
+example = proto.package("example.validated")
+
+def main(ctx):
+	return [getattr(example, ctx.vars["type"])(name = ctx.vars["name"])]
+`),
+	})
+	opts := []skycfg.LoadOption{skycfg.WithFileReader(reader), skycfg.WithProtoRegistry(registry)}
+	config, err := skycfg.Load(ctx, "main.sky", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.Main(ctx, skycfg.WithStandardValidationRules())
+	var ruleErr *skycfg.RuleError
+	if !errors.As(err, &ruleErr) {
+		t.Fatalf("expected RuleError, got %v", err)
+	}
+	var got []string
+	for _, v := range ruleErr.Violations {
+		got = append(got, fmt.Sprintf("%s %s (%s)", v.Path, v.Rule, v.Origin))
+	}
+	want := []string{
+		"target required ()",
+		"region required ()",
+		"zones required (at main.sky:8)",
+		"quotas required ()",
+		"offset sint32.gte (in fill(), called at main.sky:9)",
+		"enabled bool.const (at main.sky:8)",
+		"ids repeated.unique (at main.sky:8)",
+		"contact string.email (at main.sky:8)",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected violations %q, got %q", want, got)
+	}
+
+	// Rules that can't be checked are skipped, but the other rules of the
+	// same field are still checked.
+	config, err = skycfg.Load(ctx, "unsupported.sky", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range []string{"Scripted", "Header"} {
+		vars := skycfg.WithVars(starlark.StringDict{"type": starlark.String(typ), "name": starlark.String("x-ok")})
+		if _, err := config.Main(ctx, vars, skycfg.WithStandardValidationRules()); err != nil {
+			t.Errorf("%s: expected unsupported rules to be skipped, got %v", typ, err)
+		}
+		vars = skycfg.WithVars(starlark.StringDict{"type": starlark.String(typ), "name": starlark.String("x")})
+		want := fmt.Sprintf("example.validated.%s breaks its validation rules: name: value length must be at least 2 characters [string.min_len]", typ)
+		if _, err := config.Main(ctx, vars, skycfg.WithStandardValidationRules()); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected error %q, got %v", typ, want, err)
+		}
+	}
+}
+
+func TestFieldErrorPositions(t *testing.T) {
+	ctx := context.Background()
+	files := map[string][]byte{
+		"main.sky": []byte(`pb = proto.package("skycfg.test_proto")
+
+def wrong_type():
+	msg = pb.MessageV3(f_submsg = pb.MessageV3())
+	msg.f_submsg.f_string = 1
+
+def unknown_field():
+	return pb.MessageV3(f_int32 = 1,  f_nope = 2)
+
+def enum_range():
+	return pb.MessageV2(f_toplevel_enum = 99)
+
+def proto2_enum_int():
+	return pb.MessageV2(f_toplevel_enum = 1)
+
+def main(ctx):
+	return [globals()[ctx.vars["case"]]()]
+`),
+		"toplevel.sky": []byte("pb = proto.package(\"skycfg.test_proto\")\n\nMSG = pb.MessageV3()\nMSG.r_string = [\"a\", 2]\n"),
+	}
+	files["main.sky"] = bytes.Replace(files["main.sky"], []byte("globals()[ctx.vars[\"case\"]]()"), []byte(
+		"{\"wrong_type\": wrong_type, \"unknown_field\": unknown_field, \"enum_range\": enum_range, \"proto2_enum_int\": proto2_enum_int}[ctx.vars[\"case\"]]()"), 1)
+	reader := skycfg.WithFileReader(skycfg.MapFileReader(files))
+	config, err := skycfg.Load(ctx, "main.sky", reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name         string
+		pos          string
+		path         string
+		expectedType string
+		msg          string
+	}{
+		{"wrong_type", "main.sky:5:15", "f_submsg.f_string", "string", "TypeError: value 1 (type `int') can't be assigned to type `string'."},
+		{"unknown_field", "main.sky:8:36", "f_nope", "", `skycfg.test_proto.MessageV3: unexpected keyword argument "f_nope"`},
+		{"enum_range", "main.sky:11:22", "f_toplevel_enum", "skycfg.test_proto.ToplevelEnumV2", "ValueError: value 99 is out of range for enum `skycfg.test_proto.ToplevelEnumV2'."},
+		{"proto2_enum_int", "main.sky:14:22", "f_toplevel_enum", "skycfg.test_proto.ToplevelEnumV2", "TypeError: value 1 (type `int') can't be assigned to type `skycfg.test_proto.ToplevelEnumV2'."},
+	} {
+		_, err := config.Main(ctx, skycfg.WithVars(starlark.StringDict{"case": starlark.String(test.name)}))
+		var execErr *skycfg.ExecError
+		var fieldErr *skycfg.FieldError
+		var evalErr *starlark.EvalError
+		if !errors.As(err, &execErr) || !errors.As(err, &fieldErr) || !errors.As(err, &evalErr) {
+			t.Errorf("%s: expected ExecError with FieldError and EvalError, got %v", test.name, err)
+			continue
+		}
+		if got := fieldErr.Pos.String(); got != test.pos {
+			t.Errorf("%s: expected position %s, got %s", test.name, test.pos, got)
+		}
+		if fieldErr.Path != test.path || fieldErr.ExpectedType != test.expectedType {
+			t.Errorf("%s: unexpected field error details: %+v", test.name, fieldErr)
+		}
+		if !strings.HasPrefix(err.Error(), test.pos+": "+test.msg) {
+			t.Errorf("%s: unexpected error message %q", test.name, err)
+		}
+	}
+
+	_, err = skycfg.Load(ctx, "toplevel.sky", reader)
+	var fieldErr *skycfg.FieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Pos.String() != "toplevel.sky:4:5" || fieldErr.Path != "r_string[1]" {
+		t.Errorf("expected field error at toplevel.sky:4:5, got %v", err)
+	}
+}
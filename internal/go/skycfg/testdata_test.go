@@ -0,0 +1,118 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// testdataFiles holds the descriptors of the .proto files in testdata,
+// which define messages that tests use without generated code. They're
+// compiled once, for all tests.
+var testdataFiles = sync.OnceValues(func() (map[string]*descriptorpb.FileDescriptorProto, error) {
+	var paths []string
+	err := filepath.WalkDir("testdata", func(name string, entry fs.DirEntry, err error) error {
+		if err == nil && path.Ext(name) == ".proto" {
+			rel, _ := filepath.Rel("testdata", name)
+			paths = append(paths, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	readFile := func(ctx context.Context, name string) ([]byte, error) {
+		return ioutil.ReadFile(filepath.Join("testdata", filepath.FromSlash(name)))
+	}
+	set, err := CompileProtoFiles(context.Background(), readFile, paths)
+	if err != nil {
+		return nil, err
+	}
+	// Round-trip the descriptors through the wire format, so that custom
+	// options are unknown fields of the options messages, as they are when
+	// a descriptor set produced by protoc is decoded.
+	data, err := proto.Marshal(set)
+	if err != nil {
+		return nil, err
+	}
+	set = &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, err
+	}
+	files := make(map[string]*descriptorpb.FileDescriptorProto)
+	for _, file := range set.File {
+		files[file.GetName()] = file
+	}
+	return files, nil
+})
+
+// TestdataDescriptorSet returns the descriptors of .proto files in
+// testdata, along with those of the files they import, in dependency
+// order. Imports of the well-known types are left out.
+func TestdataDescriptorSet(t testing.TB, paths ...string) *descriptorpb.FileDescriptorSet {
+	t.Helper()
+	files, err := testdataFiles()
+	if err != nil {
+		t.Fatalf("compiling testdata: %v", err)
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := make(map[string]bool)
+	var add func(name string)
+	add = func(name string) {
+		file, ok := files[name]
+		if !ok || seen[name] {
+			return
+		}
+		seen[name] = true
+		for _, dep := range file.GetDependency() {
+			add(dep)
+		}
+		set.File = append(set.File, proto.Clone(file).(*descriptorpb.FileDescriptorProto))
+	}
+	for _, name := range paths {
+		if _, ok := files[name]; !ok {
+			t.Fatalf("no file %q in testdata", name)
+		}
+		add(name)
+	}
+	return set
+}
+
+// newTestdataMessage returns an empty dynamic message of a type defined
+// in testdata.
+func newTestdataMessage(t testing.TB, path, name string) *dynamicpb.Message {
+	t.Helper()
+	registry, err := NewDescriptorSetRegistry(TestdataDescriptorSet(t, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := registry.UnstableProtoMessageDescriptor(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dynamicpb.NewMessage(desc)
+}
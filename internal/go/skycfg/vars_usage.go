@@ -0,0 +1,182 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+// A VarUsage describes how a config reads one key of ctx.vars.
+type VarUsage struct {
+	Name string
+
+	// Types are the Starlark types of the values the config received for
+	// the key, or of the defaults it used when the key wasn't set.
+	Types []string
+
+	// Defaults are the defaults passed to ctx.vars.get() for the key, in
+	// Starlark syntax.
+	Defaults []string
+
+	// Required is true if the config read the key without a default, for
+	// example as `ctx.vars[key]` or `key in ctx.vars`.
+	Required bool
+
+	// Set is true if the key was set by the ExecOptions.
+	Set bool
+}
+
+// A VarsRecorder stands in for the ctx.vars dict, recording which keys a
+// config reads. It supports reading keys, iteration, and the dict methods
+// that don't modify it. It has its own type, "vars", rather than claiming to
+// be a dict, since it can't be compared with one.
+type VarsRecorder struct {
+	dict *starlark.Dict
+
+	mu       sync.Mutex
+	usages   map[string]*VarUsage
+	iterated bool
+}
+
+var _ starlark.Mapping = (*VarsRecorder)(nil)
+var _ starlark.Iterable = (*VarsRecorder)(nil)
+var _ starlark.Sequence = (*VarsRecorder)(nil)
+var _ starlark.HasAttrs = (*VarsRecorder)(nil)
+
+// NewVarsRecorder returns a VarsRecorder for the given vars.
+func NewVarsRecorder(dict *starlark.Dict) *VarsRecorder {
+	return &VarsRecorder{
+		dict:   dict,
+		usages: make(map[string]*VarUsage),
+	}
+}
+
+// Usages returns the keys read so far, sorted by name.
+func (r *VarsRecorder) Usages() []VarUsage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	usages := make([]VarUsage, 0, len(r.usages))
+	for _, usage := range r.usages {
+		usages = append(usages, *usage)
+	}
+	sort.Slice(usages, func(i, j int) bool { return usages[i].Name < usages[j].Name })
+	return usages
+}
+
+// Iterated reports whether the config iterated over ctx.vars, in which case
+// it may depend on keys that don't appear in Usages().
+func (r *VarsRecorder) Iterated() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.iterated
+}
+
+func (r *VarsRecorder) String() string        { return r.dict.String() }
+func (r *VarsRecorder) Type() string          { return "vars" }
+func (r *VarsRecorder) Freeze()               { r.dict.Freeze() }
+func (r *VarsRecorder) Truth() starlark.Bool  { return r.dict.Truth() }
+func (r *VarsRecorder) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: vars") }
+func (r *VarsRecorder) Len() int              { return r.dict.Len() }
+
+func (r *VarsRecorder) Get(key starlark.Value) (starlark.Value, bool, error) {
+	val, found, err := r.dict.Get(key)
+	r.record(key, val, found, nil)
+	return val, found, err
+}
+
+func (r *VarsRecorder) Iterate() starlark.Iterator {
+	r.setIterated()
+	return r.dict.Iterate()
+}
+
+func (r *VarsRecorder) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "get":
+		return starlark.NewBuiltin("get", r.fnGet), nil
+	case "keys", "items", "values":
+		r.setIterated()
+	}
+	return r.dict.Attr(name)
+}
+
+func (r *VarsRecorder) AttrNames() []string {
+	return r.dict.AttrNames()
+}
+
+func (r *VarsRecorder) fnGet(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key starlark.Value
+	var dflt starlark.Value = starlark.None
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &key, &dflt); err != nil {
+		return nil, err
+	}
+	val, found, err := r.dict.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	r.record(key, val, found, dflt)
+	if !found {
+		return dflt, nil
+	}
+	return val, nil
+}
+
+func (r *VarsRecorder) setIterated() {
+	r.mu.Lock()
+	r.iterated = true
+	r.mu.Unlock()
+}
+
+// record notes a read of key. dflt is nil if the key was read without a
+// default.
+func (r *VarsRecorder) record(key, val starlark.Value, found bool, dflt starlark.Value) {
+	name := key.String()
+	if s, ok := key.(starlark.String); ok {
+		name = string(s)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	usage, ok := r.usages[name]
+	if !ok {
+		usage = &VarUsage{Name: name}
+		r.usages[name] = usage
+	}
+	usage.Set = usage.Set || found
+	if dflt == nil {
+		usage.Required = true
+	} else {
+		usage.Defaults = appendUnique(usage.Defaults, dflt.String())
+	}
+	switch {
+	case found:
+		usage.Types = appendUnique(usage.Types, val.Type())
+	case dflt != nil && dflt != starlark.None:
+		usage.Types = appendUnique(usage.Types, dflt.Type())
+	}
+}
+
+func appendUnique(items []string, item string) []string {
+	for _, existing := range items {
+		if existing == item {
+			return items
+		}
+	}
+	return append(items, item)
+}
@@ -36,18 +36,26 @@ func YamlModule() starlark.Value {
 // yamlMarshal returns a Starlark function for marshaling plain values
 // (dicts, lists, etc) to YAML.
 //
-//  def yaml.marshal(value) -> str
+//  def yaml.marshal(value, big_ints_as_strings=False, float_precision=-1, allow_nan=True) -> str
+//
+// Integers beyond 2^53 lose precision in parsers that decode numbers as
+// floats; big_ints_as_strings writes them as quoted strings instead.
+// float_precision sets the number of significant digits of floats, and
+// allow_nan=False rejects NaN and infinities, which are otherwise written
+// as .nan and .inf.
 func yamlMarshal() starlark.Callable {
 	return starlark.NewBuiltin("yaml.marshal", fnYamlMarshal)
 }
 
 func fnYamlMarshal(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var v starlark.Value
-	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "value", &v); err != nil {
+	opts, err := unpackJSONArgs(t, fn, args, kwargs, &v)
+	if err != nil {
 		return nil, err
 	}
+	opts.yaml = true
 	var buf bytes.Buffer
-	if err := writeJSON(&buf, v); err != nil {
+	if err := writeJSON(&buf, v, &opts); err != nil {
 		return nil, err
 	}
 	var jsonObj interface{}
@@ -85,3 +85,57 @@ k:
 		}
 	}
 }
+
+func TestSkyToYamlNumbers(t *testing.T) {
+	thread := new(starlark.Thread)
+	env := starlark.StringDict{
+		"yaml": YamlModule(),
+	}
+
+	testCases := []YamlTestCase{
+		YamlTestCase{
+			skyExpr: `[float("nan"), float("inf"), -float("inf")]`,
+			expOutput: `- .nan
+- .inf
+- -.inf
+`,
+		},
+		YamlTestCase{
+			skyExpr: `[1, 1180591620717411303424], big_ints_as_strings = True`,
+			expOutput: `- 1
+- "1180591620717411303424"
+`,
+		},
+		YamlTestCase{
+			skyExpr: `[1.0 / 3], float_precision = 2`,
+			expOutput: `- 0.33
+`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		v, err := starlark.Eval(
+			thread,
+			"<expr>",
+			fmt.Sprintf("yaml.marshal(%s)", testCase.skyExpr),
+			env,
+		)
+		if err != nil {
+			t.Error("Error from eval", "\nExpected nil", "\nGot", err)
+		}
+		exp := starlark.String(testCase.expOutput)
+		if v != exp {
+			t.Error(
+				"Bad return value from yaml.marshal",
+				"\nExpected",
+				exp,
+				"\nGot",
+				v,
+			)
+		}
+	}
+
+	if _, err := starlark.Eval(thread, "<expr>", `yaml.marshal(float("nan"), allow_nan = False)`, env); err == nil {
+		t.Error("Expected error from yaml.marshal with allow_nan = False")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+)
+
+// WithMaxVarSize limits the size of each value in ctx.vars to n bytes, so
+// that an oversized input is rejected before main() runs. Exec() and
+// Test.Run() fail with a ValidationError naming the var if it's exceeded.
+//
+// A string's size is its length, and a message's is the size of its wire
+// encoding. A dict or list's size is the total of its contents.
+func WithMaxVarSize(n int) ExecOption {
+	return fnExecOption(func(opts *execOptions) {
+		if n <= 0 {
+			opts.err = fmt.Errorf("WithMaxVarSize: limit must be positive, got %d", n)
+			return
+		}
+		opts.maxVarSize = n
+	})
+}
+
+// WithMaxMessageSize limits the size of the wire encoding of each message
+// produced by main() to n bytes, so that a mistakenly inlined blob is
+// caught when the config is rendered. Exec() fails with a ValidationError
+// if it's exceeded.
+func WithMaxMessageSize(n int) ExecOption {
+	return fnExecOption(func(opts *execOptions) {
+		if n <= 0 {
+			opts.err = fmt.Errorf("WithMaxMessageSize: limit must be positive, got %d", n)
+			return
+		}
+		opts.maxMessageSize = n
+	})
+}
+
+func checkVarSizes(opts *execOptions) error {
+	if opts.maxVarSize == 0 {
+		return nil
+	}
+	for _, item := range opts.vars.Items() {
+		if size := valueSize(item[1]); size > opts.maxVarSize {
+			return &ValidationError{Err: fmt.Errorf("ctx.vars[%s] is %d bytes, more than the limit of %d", item[0], size, opts.maxVarSize)}
+		}
+	}
+	return nil
+}
+
+func checkMessageSize(opts *execOptions, msg proto.Message) error {
+	if opts.maxMessageSize == 0 {
+		return nil
+	}
+	if size := proto.Size(msg); size > opts.maxMessageSize {
+		return &ValidationError{Err: fmt.Errorf("`main' returned a %s of %d bytes, more than the limit of %d", proto.MessageName(msg), size, opts.maxMessageSize)}
+	}
+	return nil
+}
+
+// valueSize approximates the size of a value in bytes.
+func valueSize(val starlark.Value) int {
+	if msg, ok := AsProtoMessage(val); ok {
+		return proto.Size(msg)
+	}
+	switch val := val.(type) {
+	case starlark.String:
+		return len(val)
+	case *starlark.Dict:
+		size := 0
+		for _, item := range val.Items() {
+			size += valueSize(item[0]) + valueSize(item[1])
+		}
+		return size
+	case starlark.Indexable:
+		size := 0
+		for ii := 0; ii < val.Len(); ii++ {
+			size += valueSize(val.Index(ii))
+		}
+		return size
+	}
+	return len(val.String())
+}
@@ -0,0 +1,144 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// A LoadAllOption adjusts details of how LoadAll() loads and executes
+// configs.
+type LoadAllOption interface {
+	applyLoadAll(*loadAllOptions)
+}
+
+type loadAllOptions struct {
+	loadOpts    []LoadOption
+	execOpts    []ExecOption
+	concurrency int
+}
+
+type fnLoadAllOption func(*loadAllOptions)
+
+func (fn fnLoadAllOption) applyLoadAll(opts *loadAllOptions) { fn(opts) }
+
+// WithLoadOptions sets the options passed to Load() for each config.
+func WithLoadOptions(opts ...LoadOption) LoadAllOption {
+	return fnLoadAllOption(func(parsed *loadAllOptions) {
+		parsed.loadOpts = append(parsed.loadOpts, opts...)
+	})
+}
+
+// WithExecOptions sets the options passed to Main() for each config.
+func WithExecOptions(opts ...ExecOption) LoadAllOption {
+	return fnLoadAllOption(func(parsed *loadAllOptions) {
+		parsed.execOpts = append(parsed.execOpts, opts...)
+	})
+}
+
+// WithConcurrency sets how many configs LoadAll() may load and execute at
+// the same time. The default is 1.
+func WithConcurrency(n int) LoadAllOption {
+	if n < 1 {
+		panic("WithConcurrency: concurrency must be at least 1")
+	}
+	return fnLoadAllOption(func(parsed *loadAllOptions) {
+		parsed.concurrency = n
+	})
+}
+
+// A LoadAllResult is the outcome of loading and executing one config found
+// by LoadAll(). If loading failed, Config is nil.
+type LoadAllResult struct {
+	Filename string
+	Config   *Config
+	Messages []proto.Message
+	Err      error
+}
+
+// LoadAll finds every file under root matching pattern, then loads each one
+// and executes its main(). The pattern uses filepath.Match syntax; if it
+// contains a path separator it's matched against the path relative to root,
+// otherwise against the file's base name.
+//
+// Errors from individual configs are reported in their results, which are
+// sorted by filename. The returned error is non-nil only if root couldn't be
+// searched.
+func LoadAll(ctx context.Context, root, pattern string, opts ...LoadAllOption) ([]LoadAllResult, error) {
+	parsedOpts := &loadAllOptions{concurrency: 1}
+	for _, opt := range opts {
+		opt.applyLoadAll(parsedOpts)
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	var filenames []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		if strings.ContainsRune(pattern, filepath.Separator) {
+			if name, err = filepath.Rel(root, path); err != nil {
+				return err
+			}
+		}
+		if matched, _ := filepath.Match(pattern, name); matched {
+			filenames = append(filenames, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]LoadAllResult, len(filenames))
+	sem := make(chan struct{}, parsedOpts.concurrency)
+	var wg sync.WaitGroup
+	for ii, filename := range filenames {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(result *LoadAllResult, filename string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result.Filename = filename
+			if err := ctx.Err(); err != nil {
+				result.Err = err
+				return
+			}
+			config, err := Load(ctx, filename, parsedOpts.loadOpts...)
+			if err != nil {
+				result.Err = err
+				return
+			}
+			result.Config = config
+			result.Messages, result.Err = config.Main(ctx, parsedOpts.execOpts...)
+		}(&results[ii], filename)
+	}
+	wg.Wait()
+	return results, nil
+}
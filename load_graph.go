@@ -0,0 +1,222 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A LoadGraph is the module load graph of a config, which can be written
+// in formats read by graph visualization tools such as Graphviz.
+type LoadGraph struct {
+	Modules      []Module
+	Dependencies []Dependency
+
+	// Symbols, if set, adds the symbols that modules use from each other
+	// to the graph. Each used symbol is a node, with an edge from the
+	// module that defines it and an edge from each module that uses it,
+	// which approximates the config's call graph.
+	Symbols *SymbolIndex
+}
+
+// LoadGraph returns the config's load graph. Its Symbols aren't set; they
+// may be added with IndexSymbols().
+func (c *Config) LoadGraph() *LoadGraph {
+	return &LoadGraph{Modules: c.Modules(), Dependencies: c.Dependencies()}
+}
+
+type graphNode struct {
+	id    string
+	label string
+	kind  string // "module" or "symbol"
+	hash  string
+}
+
+type graphEdge struct {
+	from, to string
+	label    string
+	kind     string // "load", "defines", or "uses"
+}
+
+// build returns the graph's nodes and edges, in a deterministic order.
+func (g *LoadGraph) build() ([]graphNode, []graphEdge) {
+	var nodes []graphNode
+	var edges []graphEdge
+	seen := make(map[string]bool)
+	addModule := func(path, hash string) {
+		if !seen[path] {
+			seen[path] = true
+			nodes = append(nodes, graphNode{id: path, label: path, kind: "module", hash: hash})
+		}
+	}
+	for _, module := range g.Modules {
+		addModule(module.Path, module.Hash)
+	}
+	for _, dep := range g.Dependencies {
+		// The top-level module is recorded as a dependency with no From.
+		if dep.From == "" {
+			continue
+		}
+		addModule(dep.From, "")
+		addModule(dep.Path, dep.Hash)
+		edge := graphEdge{from: dep.From, to: dep.Path, kind: "load"}
+		if dep.Name != dep.Path {
+			edge.label = dep.Name
+		}
+		edges = append(edges, edge)
+	}
+	if g.Symbols == nil {
+		return nodes, edges
+	}
+	for _, sym := range g.Symbols.Symbols() {
+		id := sym.Module + ":" + sym.Name
+		usedBy := make(map[string]bool)
+		for _, use := range g.Symbols.Uses(sym.Module, sym.Name) {
+			if use.Load || usedBy[use.Module] {
+				continue
+			}
+			if len(usedBy) == 0 {
+				addModule(sym.Module, "")
+				nodes = append(nodes, graphNode{id: id, label: sym.Name, kind: "symbol"})
+				edges = append(edges, graphEdge{from: sym.Module, to: id, kind: "defines"})
+			}
+			usedBy[use.Module] = true
+			addModule(use.Module, "")
+			edges = append(edges, graphEdge{from: use.Module, to: id, kind: "uses"})
+		}
+	}
+	return nodes, edges
+}
+
+// WriteDOT writes the graph in the DOT language of Graphviz. Modules are
+// drawn as boxes, and symbols as ellipses.
+func (g *LoadGraph) WriteDOT(w io.Writer) error {
+	nodes, edges := g.build()
+	buf := bufio.NewWriter(w)
+	buf.WriteString("digraph skycfg {\n")
+	for _, node := range nodes {
+		if node.kind == "module" {
+			fmt.Fprintf(buf, "\t%s [shape=box];\n", dotQuote(node.id))
+		} else {
+			fmt.Fprintf(buf, "\t%s [label=%s];\n", dotQuote(node.id), dotQuote(node.label))
+		}
+	}
+	for _, edge := range edges {
+		var attrs []string
+		if edge.label != "" {
+			attrs = append(attrs, "label="+dotQuote(edge.label))
+		}
+		if edge.kind == "defines" {
+			attrs = append(attrs, "style=dashed")
+		}
+		fmt.Fprintf(buf, "\t%s -> %s", dotQuote(edge.from), dotQuote(edge.to))
+		if len(attrs) > 0 {
+			fmt.Fprintf(buf, " [%s]", strings.Join(attrs, ", "))
+		}
+		buf.WriteString(";\n")
+	}
+	buf.WriteString("}\n")
+	return buf.Flush()
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID       string `xml:"id,attr"`
+	For      string `xml:"for,attr"`
+	AttrName string `xml:"attr.name,attr"`
+	AttrType string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// WriteGraphML writes the graph in GraphML. Nodes and edges have a "kind"
+// attribute of "module" or "symbol", and of "load", "defines", or "uses"
+// respectively. Modules also have a "hash" attribute with their content
+// hash, if it's known.
+func (g *LoadGraph) WriteGraphML(w io.Writer) error {
+	nodes, edges := g.build()
+	doc := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{ID: "kind", For: "all", AttrName: "kind", AttrType: "string"},
+			{ID: "label", For: "all", AttrName: "label", AttrType: "string"},
+			{ID: "hash", For: "node", AttrName: "hash", AttrType: "string"},
+		},
+		Graph: graphMLGraph{ID: "skycfg", EdgeDefault: "directed"},
+	}
+	for _, node := range nodes {
+		data := []graphMLData{{"kind", node.kind}, {"label", node.label}}
+		if node.hash != "" {
+			data = append(data, graphMLData{"hash", node.hash})
+		}
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{ID: node.id, Data: data})
+	}
+	for _, edge := range edges {
+		data := []graphMLData{{"kind", edge.kind}}
+		if edge.label != "" {
+			data = append(data, graphMLData{"label", edge.label})
+		}
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{Source: edge.from, Target: edge.to, Data: data})
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
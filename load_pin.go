@@ -0,0 +1,120 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"strings"
+
+	"go.starlark.net/syntax"
+)
+
+// loadPinArg is the load() argument that pins a module to a content hash:
+//
+//  load("lib.sky", "helper", _sha256 = "<hex digest>")
+//
+// The loader checks the pin before the loaded module is executed. Starlark
+// parses the pin as an ordinary load binding, so it's removed from the
+// source before the importing module is executed.
+const loadPinArg = "_sha256"
+
+// stripLoadPins removes pin arguments from the load() statements in
+// source, returning the pinned hash of each module name and the updated
+// source. Pins are replaced by whitespace, so positions in the rest of the
+// file are unchanged.
+func stripLoadPins(source []byte, f *syntax.File) (map[string]string, []byte, error) {
+	pins := make(map[string]string)
+	var out []byte
+	lines := lineOffsets(source)
+	for _, stmt := range f.Stmts {
+		load, ok := stmt.(*syntax.LoadStmt)
+		if !ok {
+			continue
+		}
+		moduleName := load.Module.Value.(string)
+		for ii, to := range load.To {
+			if to.Name != loadPinArg {
+				continue
+			}
+			hash := load.From[ii].Name
+			if !isSHA256Hex(hash) {
+				return nil, nil, fmt.Errorf("%s: load(%q): %s must be a lowercase hex SHA-256 digest", load.Load, moduleName, loadPinArg)
+			}
+			if len(load.To) == 1 {
+				return nil, nil, fmt.Errorf("%s: load(%q): load statement must import at least 1 symbol", load.Load, moduleName)
+			}
+			if prev, ok := pins[moduleName]; ok && prev != "sha256:"+hash {
+				return nil, nil, fmt.Errorf("%s: load(%q): module is pinned to more than one hash", load.Load, moduleName)
+			}
+			pins[moduleName] = "sha256:" + hash
+
+			if out == nil {
+				out = append([]byte(nil), source...)
+			}
+			start := byteOffset(source, lines, to.NamePos)
+			// The hash literal starts one byte before the From ident.
+			end := byteOffset(source, lines, load.From[ii].NamePos) + len(hash) + 1
+			if comma := precedingComma(source, start); comma >= 0 {
+				start = comma
+			} else if comma := followingComma(source, end); comma >= 0 {
+				end = comma + 1
+			}
+			for jj := start; jj < end; jj++ {
+				if out[jj] != '\n' {
+					out[jj] = ' '
+				}
+			}
+		}
+	}
+	if out == nil {
+		return pins, source, nil
+	}
+	return pins, out, nil
+}
+
+func isSHA256Hex(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	return strings.Trim(s, "0123456789abcdef") == ""
+}
+
+func precedingComma(source []byte, offset int) int {
+	for ii := offset - 1; ii >= 0; ii-- {
+		switch source[ii] {
+		case ',':
+			return ii
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return -1
+	}
+	return -1
+}
+
+func followingComma(source []byte, offset int) int {
+	for ii := offset; ii < len(source); ii++ {
+		switch source[ii] {
+		case ',':
+			return ii
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return -1
+	}
+	return -1
+}
@@ -0,0 +1,577 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+
+	impl "github.com/stripe/skycfg/internal/go/skycfg"
+)
+
+// WithLoadWorkers sets how many modules may be read or executed at the same
+// time while loading a config. Modules are loaded in parallel only when
+// they don't depend on each other. The default is 1.
+//
+// With more than one worker, the FileReader, load filters, and logger may
+// be called concurrently.
+func WithLoadWorkers(n int) LoadOption {
+	if n < 1 {
+		panic("WithLoadWorkers: worker count must be at least 1")
+	}
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.loadWorkers = n
+	})
+}
+
+// WithLoadTimeout limits how long each module may take to be read, and
+// then to be executed, while loading a config. Time spent loading the
+// modules it depends on isn't counted.
+//
+// When a module times out, or the context passed to Load is cancelled
+// while it's running, Load returns a TimeoutError immediately and the
+// module is interrupted: loops over the predeclared range() stop early, and
+// the module's result is discarded. Only those loops can be interrupted.
+// Other long-running code, such as a loop over a list or deep recursion,
+// runs to completion in the background, and holds its load worker until it
+// finishes.
+func WithLoadTimeout(timeout time.Duration) LoadOption {
+	if timeout <= 0 {
+		panic("WithLoadTimeout: timeout must be positive")
+	}
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.loadTimeout = timeout
+	})
+}
+
+// A Dependency is an edge in a config's load graph, recording that the
+// module at From loaded the module at Path.
+type Dependency struct {
+	// From is the resolved path of the loading module.
+	From string
+
+	// Name is the module name as written in the load() statement.
+	Name string
+
+	// Path is the resolved path of the loaded module, as returned by the
+	// FileReader.
+	Path string
+
+	// Hash is a digest of the loaded module's content, of the form
+	// "sha256:<hex>".
+	Hash string
+}
+
+// A Module is a module that was read while loading a config.
+type Module struct {
+	// Path is the resolved path of the module, as returned by the
+	// FileReader.
+	Path string
+
+	// Hash is a digest of the module's content, of the form
+	// "sha256:<hex>". It identifies exactly which version of the module
+	// the config was loaded with, even if configs loaded through other
+	// FileReaders have a different module at the same path.
+	Hash string
+}
+
+type moduleEntry struct {
+	done    chan struct{}
+	globals starlark.StringDict
+	err     error
+
+	// exported is the subset of globals that other modules may load, or
+	// nil if the module doesn't restrict its exports.
+	exported starlark.StringDict
+
+	// imported is the set of globals bound by the module's load()
+	// statements.
+	imported map[string]bool
+}
+
+// A loader executes the modules in a config's load graph. Before a module
+// is executed, its load() statements are resolved and the modules they name
+// are loaded, so independent modules can be read and executed concurrently.
+type loader struct {
+	ctx  context.Context
+	opts *loadOptions
+	sem  chan struct{}
+
+	mu      sync.Mutex
+	modules map[string]*moduleEntry
+	deps    map[string][]string // resolved path -> resolved paths it loads
+	edges   []Dependency
+	hashes  map[string]string    // resolved path -> content hash
+	pins    map[string][]loadPin // resolved path -> pins on that path
+}
+
+// A LoadCycleError is returned by Load() if modules load each other in a
+// cycle.
+type LoadCycleError struct {
+	// Pos is the position of the load() statement that closes the cycle.
+	Pos syntax.Position
+
+	// Chain lists the resolved paths of the modules in the cycle, each of
+	// which loads the next. It starts and ends with the same module.
+	Chain []string
+}
+
+func (e *LoadCycleError) Error() string {
+	return fmt.Sprintf("%s: cycle in load graph: %s", e.Pos, strings.Join(e.Chain, " -> "))
+}
+
+// A loadPin records that a module pinned the content hash of a module it
+// loads.
+type loadPin struct {
+	from string
+	hash string
+}
+
+func loadImpl(ctx context.Context, opts *loadOptions, filename string) (starlark.StringDict, []Dependency, error) {
+	workers := opts.loadWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	// Cancelled on return, so modules still waiting to be loaded stop once
+	// the result is known.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	l := &loader{
+		ctx:     ctx,
+		opts:    opts,
+		sem:     make(chan struct{}, workers),
+		modules: make(map[string]*moduleEntry),
+		deps:    make(map[string][]string),
+		hashes:  make(map[string]string),
+		pins:    make(map[string][]loadPin),
+	}
+	modulePath, err := opts.fileReader.Resolve(ctx, filename, "")
+	if err != nil {
+		return nil, nil, &LoadError{Err: err}
+	}
+	l.edges = append(l.edges, Dependency{Name: filename, Path: modulePath})
+	e := l.start(modulePath)
+	<-e.done
+	if e.err != nil {
+		// The cycle error reaches the top-level module wrapped in the
+		// errors of each module that loads it, so it's returned directly
+		// instead.
+		var cycle *LoadCycleError
+		if errors.As(e.err, &cycle) {
+			return nil, nil, cycle
+		}
+		return nil, nil, e.err
+	}
+	return e.globals, l.dependencies(), nil
+}
+
+func (l *loader) dependencies() []Dependency {
+	deps := make([]Dependency, len(l.edges))
+	for ii, edge := range l.edges {
+		edge.Hash = l.hashes[edge.Path]
+		deps[ii] = edge
+	}
+	sort.SliceStable(deps, func(i, j int) bool {
+		if deps[i].From != deps[j].From {
+			return deps[i].From < deps[j].From
+		}
+		return deps[i].Name < deps[j].Name
+	})
+	return deps
+}
+
+// start returns the entry for a module, loading it if this is the first
+// time it's been requested.
+func (l *loader) start(modulePath string) *moduleEntry {
+	l.mu.Lock()
+	e, ok := l.modules[modulePath]
+	if !ok {
+		e = &moduleEntry{done: make(chan struct{})}
+		l.modules[modulePath] = e
+	}
+	l.mu.Unlock()
+	if ok {
+		return e
+	}
+	load := func() {
+		defer close(e.done)
+		e.globals, e.imported, e.err = l.load(modulePath)
+		if e.err == nil {
+			e.exported, e.err = moduleExports(modulePath, e.globals)
+			if e.err != nil {
+				e.err = &LoadError{Err: e.err}
+			}
+		}
+	}
+	if cap(l.sem) > 1 {
+		go load()
+	} else {
+		load()
+	}
+	return e
+}
+
+// addDep records that `from` loads `to`, returning an error if that would
+// create a cycle in the load graph.
+func (l *loader) addDep(from, name, to string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen := make(map[string]bool)
+	var chain []string
+	var reaches func(path string) bool
+	reaches = func(path string) bool {
+		if seen[path] {
+			return false
+		}
+		seen[path] = true
+		chain = append(chain, path)
+		if path == from {
+			return true
+		}
+		for _, dep := range l.deps[path] {
+			if reaches(dep) {
+				return true
+			}
+		}
+		chain = chain[:len(chain)-1]
+		return false
+	}
+	if reaches(to) {
+		return &LoadCycleError{Chain: append(chain, to)}
+	}
+	l.deps[from] = append(l.deps[from], to)
+	l.edges = append(l.edges, Dependency{From: from, Name: name, Path: to})
+	return nil
+}
+
+func (l *loader) newThread() *starlark.Thread {
+	thread := &starlark.Thread{
+		Print: skyPrint,
+	}
+	impl.SetContext(thread, l.ctx)
+	impl.SetOutputSchema(thread, l.opts.outputSchema)
+	impl.SetStrictOneofs(thread, l.opts.oneofPolicy == OneofError)
+	impl.SetDeterministic(thread, l.opts.deterministic)
+	impl.SetShareSubmessages(thread, l.opts.shareMessages)
+	impl.SetProtoRegistry(thread, l.opts.protoRegistry)
+	impl.SetLenientDecoding(thread, l.opts.lenient)
+	impl.RecordFieldErrors(thread)
+	if l.opts.logger != nil {
+		impl.SetLogger(thread, l.opts.logger)
+	}
+	return thread
+}
+
+func (l *loader) load(modulePath string) (starlark.StringDict, map[string]bool, error) {
+	opts := l.opts
+	if err := l.acquire(modulePath); err != nil {
+		return nil, nil, err
+	}
+	readCtx, cancel := l.moduleContext()
+	moduleSource, err := opts.fileReader.ReadFile(readCtx, modulePath)
+	timedOut := readCtx.Err() != nil
+	cancel()
+	l.release()
+	if err != nil {
+		if timedOut {
+			return nil, nil, &TimeoutError{Err: err}
+		}
+		return nil, nil, &LoadError{Err: err}
+	}
+	hash := moduleHash(moduleSource)
+	l.mu.Lock()
+	l.hashes[modulePath] = hash
+	pins := l.pins[modulePath]
+	l.mu.Unlock()
+	for _, pin := range pins {
+		if err := checkLoadPin(modulePath, hash, pin); err != nil {
+			return nil, nil, &LoadError{Err: err}
+		}
+	}
+	if opts.lockfile != nil {
+		if opts.verifyLockfile {
+			err = opts.lockfile.verify(modulePath, moduleSource)
+		} else {
+			opts.lockfile.record(modulePath, moduleSource)
+		}
+		if err != nil {
+			return nil, nil, &LoadError{Err: err}
+		}
+	}
+
+	thread := l.newThread()
+
+	// A cached program is stored with the module's load() statements, so
+	// its source doesn't need to be parsed.
+	var f *syntax.File
+	var loadPins map[string]string
+	var prog *starlark.Program
+	var cacheKey string
+	if opts.programCache != nil {
+		cacheKey = programCacheKey(modulePath, moduleSource, opts.globals)
+		f, loadPins, prog = l.cachedProgramFor(thread, cacheKey, modulePath)
+	}
+
+	// Syntax errors are reported when the module is compiled, so a module
+	// that fails to parse is executed without first loading its
+	// dependencies.
+	if f == nil {
+		if parsed, err := syntax.Parse(modulePath, moduleSource, 0); err == nil {
+			loadPins, moduleSource, err = stripLoadPins(moduleSource, parsed)
+			if err != nil {
+				return nil, nil, &ParseError{Err: err}
+			}
+			if len(loadPins) > 0 {
+				if parsed, err = syntax.Parse(modulePath, moduleSource, 0); err != nil {
+					return nil, nil, &ParseError{Err: err}
+				}
+			}
+			f = parsed
+		}
+	}
+	var loadStmts []*syntax.LoadStmt
+	imported := make(map[string]bool)
+	if f != nil {
+		if opts.shadowPolicy != ShadowAllow {
+			for _, shadow := range impl.FindLoadShadowing(f, opts.globals) {
+				if opts.shadowPolicy == ShadowError {
+					return nil, nil, &LoadError{Err: fmt.Errorf("%v", shadow)}
+				}
+				impl.Log(thread, "warn", shadow.String(), nil, shadow.Pos)
+			}
+		}
+		for _, stmt := range f.Stmts {
+			if load, ok := stmt.(*syntax.LoadStmt); ok {
+				loadStmts = append(loadStmts, load)
+				for _, to := range load.To {
+					imported[to.Name] = true
+				}
+			}
+		}
+	}
+
+	type loadResult struct {
+		entry *moduleEntry
+		path  string
+		err   error
+	}
+	loads := make(map[string]*loadResult)
+	for _, stmt := range loadStmts {
+		moduleName := stmt.Module.Value.(string)
+		if _, ok := loads[moduleName]; ok {
+			continue
+		}
+		result := &loadResult{}
+		loads[moduleName] = result
+		result.entry, result.path, result.err = l.startDep(moduleName, modulePath, loadPins[moduleName])
+		if cycle, ok := result.err.(*LoadCycleError); ok {
+			cycle.Pos = stmt.Load
+		}
+	}
+	for moduleName, result := range loads {
+		if result.entry == nil {
+			continue
+		}
+		<-result.entry.done
+		// The module may have been loaded before this pin was recorded.
+		if pin, ok := loadPins[moduleName]; ok && result.err == nil && result.entry.err == nil {
+			l.mu.Lock()
+			hash := l.hashes[result.path]
+			l.mu.Unlock()
+			result.err = checkLoadPin(result.path, hash, loadPin{from: modulePath, hash: pin})
+		}
+	}
+
+	for _, stmt := range loadStmts {
+		result := loads[stmt.Module.Value.(string)]
+		if result.err != nil || result.entry.err != nil {
+			continue
+		}
+		result.err = checkExports(stmt, result.path, result.entry.exported)
+		if result.err != nil || opts.reExportPolicy == ReExportAllow {
+			continue
+		}
+		for _, from := range findReExports(stmt, result.entry.imported, result.entry.exported) {
+			msg := fmt.Sprintf("load(%q): %q is re-exported by %s, which loads it from another module", stmt.Module.Value, from.Name, result.path)
+			if opts.reExportPolicy == ReExportError {
+				result.err = fmt.Errorf("%s: %s", from.NamePos, msg)
+				break
+			}
+			impl.Log(thread, "warn", msg, nil, from.NamePos)
+		}
+	}
+
+	// loadErr is the cause of the first failed load(), which an error
+	// from executing the module is classified by.
+	var loadErr error
+	thread.Load = func(thread *starlark.Thread, moduleName string) (starlark.StringDict, error) {
+		result, ok := loads[moduleName]
+		if !ok {
+			return nil, fmt.Errorf("load(%q): module was not resolved", moduleName)
+		}
+		if result.err != nil {
+			if loadErr == nil {
+				loadErr = &LoadError{Err: result.err}
+			}
+			return nil, result.err
+		}
+		if result.entry.err != nil && loadErr == nil {
+			loadErr = result.entry.err
+		}
+		if result.entry.exported != nil {
+			return result.entry.exported, result.entry.err
+		}
+		return result.entry.globals, result.entry.err
+	}
+	if f != nil && opts.coverage != nil {
+		moduleSource = opts.coverage.instrument(f, modulePath, moduleSource)
+	}
+	if err := l.acquire(modulePath); err != nil {
+		return nil, imported, err
+	}
+	compiled := false
+	if prog == nil {
+		if _, prog, err = starlark.SourceProgram(modulePath, moduleSource, opts.globals.Has); err != nil {
+			l.release()
+			return nil, imported, &ParseError{Err: err}
+		}
+		compiled = true
+	}
+	if compiled && opts.programCache != nil {
+		l.cacheProgram(thread, cacheKey, modulePath, loadStmts, loadPins, prog)
+	}
+	globals, err := l.exec(thread, modulePath, prog)
+	opts.frozen.MarkFrozen(globals, modulePath, f)
+	if err != nil {
+		if _, ok := err.(*TimeoutError); !ok {
+			err = recoverFieldError(thread, impl.AddFrozenErrorHint(err, opts.frozen), func(path string) []byte {
+				if path == modulePath {
+					return moduleSource
+				}
+				return nil
+			})
+			err = classifyAs(err, loadErr)
+		}
+	}
+	return globals, imported, err
+}
+
+// acquire waits for a worker to become available.
+func (l *loader) acquire(modulePath string) error {
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-l.ctx.Done():
+		return &TimeoutError{Err: fmt.Errorf("%s: %w", modulePath, l.ctx.Err())}
+	}
+}
+
+func (l *loader) release() {
+	<-l.sem
+}
+
+// moduleContext returns the context for a single step of loading a module,
+// applying the load timeout if one is set.
+func (l *loader) moduleContext() (context.Context, context.CancelFunc) {
+	if l.opts.loadTimeout > 0 {
+		return context.WithTimeout(l.ctx, l.opts.loadTimeout)
+	}
+	return context.WithCancel(l.ctx)
+}
+
+// exec runs a module's top-level code with the worker acquired by the
+// caller, returning early if its context is done. The module stops soon
+// after (see impl.SetContext), and holds the worker until it has.
+func (l *loader) exec(thread *starlark.Thread, modulePath string, prog *starlark.Program) (starlark.StringDict, error) {
+	type execResult struct {
+		globals starlark.StringDict
+		err     error
+	}
+	ctx, cancel := l.moduleContext()
+	impl.SetContext(thread, ctx)
+	done := make(chan execResult, 1)
+	go func() {
+		defer l.release()
+		defer cancel()
+		globals, err := prog.Init(thread, l.opts.globals)
+		globals.Freeze()
+		done <- execResult{globals, err}
+	}()
+	select {
+	case result := <-done:
+		if !impl.Interrupted(thread) {
+			return result.globals, result.err
+		}
+	case <-ctx.Done():
+	}
+	if l.ctx.Err() != nil {
+		return nil, &TimeoutError{Err: fmt.Errorf("%s: %w", modulePath, l.ctx.Err())}
+	}
+	return nil, &TimeoutError{Err: fmt.Errorf("%s: module execution timed out after %v", modulePath, l.opts.loadTimeout)}
+}
+
+// builtinModulePrefix marks load() names that refer to modules registered
+// with WithModule, rather than files.
+const builtinModulePrefix = "@builtin//"
+
+func (l *loader) startDep(moduleName, fromPath, pin string) (*moduleEntry, string, error) {
+	for _, filter := range l.opts.loadFilters {
+		if err := filter(moduleName, fromPath); err != nil {
+			return nil, "", fmt.Errorf("load(%q): %v", moduleName, err)
+		}
+	}
+	if strings.HasPrefix(moduleName, builtinModulePrefix) {
+		if pin != "" {
+			return nil, "", fmt.Errorf("load(%q): builtin modules can't be pinned with %s", moduleName, loadPinArg)
+		}
+		members, ok := l.opts.modules[strings.TrimPrefix(moduleName, builtinModulePrefix)]
+		if !ok {
+			return nil, "", fmt.Errorf("load(%q): no such builtin module", moduleName)
+		}
+		e := &moduleEntry{done: make(chan struct{}), globals: members}
+		close(e.done)
+		return e, "", nil
+	}
+	modulePath, err := l.opts.fileReader.Resolve(l.ctx, moduleName, fromPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := l.addDep(fromPath, moduleName, modulePath); err != nil {
+		return nil, "", err
+	}
+	if pin != "" {
+		l.mu.Lock()
+		l.pins[modulePath] = append(l.pins[modulePath], loadPin{from: fromPath, hash: pin})
+		l.mu.Unlock()
+	}
+	return l.start(modulePath), modulePath, nil
+}
+
+func checkLoadPin(modulePath, hash string, pin loadPin) error {
+	if hash != pin.hash {
+		return fmt.Errorf("load(%q): module hash %s doesn't match %s pinned in %s (want %s)", modulePath, hash, loadPinArg, pin.from, pin.hash)
+	}
+	return nil
+}
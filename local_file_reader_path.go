@@ -0,0 +1,92 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type localFileReaderPath struct {
+	roots []*localFileReader
+}
+
+// LocalFileReaderPath returns a FileReader that resolves modules against an
+// ordered list of directories, like a search path. A module name resolves
+// to the file in the first directory that contains it, so a project
+// directory listed first can override modules of the shared library
+// directories after it.
+//
+// Module names starting with "./" or "../" aren't searched for. They're
+// resolved relative to the module that loads them, within the directory
+// that contains it.
+func LocalFileReaderPath(roots ...string) FileReader {
+	if len(roots) == 0 {
+		panic("LocalFileReaderPath: no root paths")
+	}
+	r := &localFileReaderPath{}
+	for _, root := range roots {
+		if root == "" {
+			panic("LocalFileReaderPath: empty root path")
+		}
+		r.roots = append(r.roots, &localFileReader{root: root})
+	}
+	return r
+}
+
+func (r *localFileReaderPath) Resolve(ctx context.Context, name, fromPath string) (string, error) {
+	if fromPath == "" {
+		return name, nil
+	}
+	if strings.HasPrefix(name, "./") || strings.HasPrefix(name, "../") {
+		for _, root := range r.roots {
+			if rel, err := filepath.Rel(root.root, fromPath); err == nil && !strings.HasPrefix(filepath.ToSlash(rel), "../") {
+				return root.Resolve(ctx, name, fromPath)
+			}
+		}
+		return "", fmt.Errorf("load(%q): %s is not within the search path", name, fromPath)
+	}
+	for _, root := range r.roots {
+		resolved, err := root.Resolve(ctx, name, fromPath)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(resolved); err == nil {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("load(%q): module not found in search path %s", name, r.searchPath())
+}
+
+func (r *localFileReaderPath) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	return r.roots[0].ReadFile(ctx, path)
+}
+
+func (r *localFileReaderPath) Stat(ctx context.Context, path string) (FileInfo, error) {
+	return r.roots[0].Stat(ctx, path)
+}
+
+func (r *localFileReaderPath) searchPath() string {
+	roots := make([]string, len(r.roots))
+	for ii, root := range r.roots {
+		roots[ii] = root.root
+	}
+	return strings.Join(roots, string(filepath.ListSeparator))
+}
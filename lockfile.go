@@ -0,0 +1,152 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A Lockfile records the content hash of every module read while loading a
+// config, keyed by resolved path. It can be saved alongside the config and
+// used to verify that later loads read exactly the same modules.
+type Lockfile struct {
+	// Modules maps resolved module paths to hashes of the form
+	// "sha256:<hex>".
+	Modules map[string]string `json:"modules"`
+
+	// OutputSchema is the output schema that the config was loaded with.
+	// Loads verified against the lockfile use the same schema, so that
+	// upgrading Skycfg doesn't change the config's output.
+	OutputSchema string `json:"output_schema,omitempty"`
+
+	mu sync.Mutex
+}
+
+// ParseLockfile parses a lockfile written by Lockfile.Marshal().
+func ParseLockfile(data []byte) (*Lockfile, error) {
+	lock := &Lockfile{}
+	if err := json.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("ParseLockfile: %v", err)
+	}
+	if lock.Modules == nil {
+		lock.Modules = make(map[string]string)
+	}
+	return lock, nil
+}
+
+// Marshal encodes the lockfile as JSON, with modules sorted by path.
+func (lock *Lockfile) Marshal() ([]byte, error) {
+	lock.mu.Lock()
+	defer lock.mu.Unlock()
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func moduleHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (lock *Lockfile) record(path string, content []byte) {
+	lock.mu.Lock()
+	defer lock.mu.Unlock()
+	if lock.Modules == nil {
+		lock.Modules = make(map[string]string)
+	}
+	lock.Modules[path] = moduleHash(content)
+}
+
+func (lock *Lockfile) verify(path string, content []byte) error {
+	lock.mu.Lock()
+	defer lock.mu.Unlock()
+	want, ok := lock.Modules[path]
+	if !ok {
+		return fmt.Errorf("load(%q): module is not in the lockfile", path)
+	}
+	if got := moduleHash(content); got != want {
+		return fmt.Errorf("load(%q): module hash %s doesn't match lockfile (want %s)", path, got, want)
+	}
+	return nil
+}
+
+// Changed returns the paths of modules in the lockfile whose content, as
+// read through r, no longer matches their recorded hash. Modules are
+// compared using the hash reported by r.Stat() if r is a FileStater that
+// knows it, and are otherwise read in full.
+func (lock *Lockfile) Changed(ctx context.Context, r FileReader) ([]string, error) {
+	lock.mu.Lock()
+	modules := make(map[string]string, len(lock.Modules))
+	for path, hash := range lock.Modules {
+		modules[path] = hash
+	}
+	lock.mu.Unlock()
+
+	var changed []string
+	for path, want := range modules {
+		info, err := statFile(ctx, r, path)
+		if err != nil {
+			return nil, err
+		}
+		got := info.Hash
+		if got == "" {
+			content, err := r.ReadFile(ctx, path)
+			if err != nil {
+				return nil, err
+			}
+			got = moduleHash(content)
+		}
+		if got != want {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// WithLockfile records the resolved path and content hash of every module
+// read during Load() into lock, along with the config's output schema.
+func WithLockfile(lock *Lockfile) LoadOption {
+	if lock == nil {
+		panic("WithLockfile: nil lockfile")
+	}
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.lockfile = lock
+		opts.verifyLockfile = false
+	})
+}
+
+// WithLockfileVerification causes Load() to fail if any module it reads is
+// missing from lock, or has different content than when lock was recorded.
+// The config uses the output schema recorded in lock, if any.
+func WithLockfileVerification(lock *Lockfile) LoadOption {
+	if lock == nil {
+		panic("WithLockfileVerification: nil lockfile")
+	}
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.lockfile = lock
+		opts.verifyLockfile = true
+	})
+}
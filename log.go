@@ -0,0 +1,65 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"go.starlark.net/syntax"
+
+	impl "github.com/stripe/skycfg/internal/go/skycfg"
+)
+
+// A LogEntry is a message logged by a config using the `log` module, which
+// is available both as a global and as `ctx.log` in main().
+type LogEntry struct {
+	// Level is one of "debug", "info", "warn", or "error".
+	Level   string
+	Message string
+
+	// Fields holds any keyword arguments passed to the log function.
+	Fields map[string]string
+
+	Filename string
+	Line     int
+}
+
+// A LoggerOption can be passed to both Load() and Main().
+type LoggerOption interface {
+	LoadOption
+	ExecOption
+}
+
+type loggerOption impl.LogFunc
+
+func (o loggerOption) applyLoad(opts *loadOptions) { opts.logger = impl.LogFunc(o) }
+func (o loggerOption) applyExec(opts *execOptions) { opts.logger = impl.LogFunc(o) }
+
+// WithLogger routes messages from the `log` module to fn, instead of
+// printing them to stderr.
+func WithLogger(fn func(LogEntry)) LoggerOption {
+	if fn == nil {
+		panic("WithLogger: nil function")
+	}
+	return loggerOption(func(level, msg string, fields map[string]string, pos syntax.Position) {
+		fn(LogEntry{
+			Level:    level,
+			Message:  msg,
+			Fields:   fields,
+			Filename: pos.Filename(),
+			Line:     int(pos.Line),
+		})
+	})
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+)
+
+type mapFileReader struct {
+	files map[string][]byte
+}
+
+// MapFileReader returns a FileReader that resolves and loads files from an
+// in-memory map of slash-separated paths to file contents. The map is copied,
+// so later changes to it won't affect the reader.
+func MapFileReader(files map[string][]byte) FileReader {
+	copied := make(map[string][]byte, len(files))
+	for name, content := range files {
+		copied[cleanMapPath(name)] = content
+	}
+	return &mapFileReader{copied}
+}
+
+func cleanMapPath(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+func (r *mapFileReader) Resolve(ctx context.Context, name, fromPath string) (string, error) {
+	return cleanMapPath(name), nil
+}
+
+func (r *mapFileReader) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	content, ok := r.files[path]
+	if !ok {
+		return nil, fmt.Errorf("open %s: %w", path, fs.ErrNotExist)
+	}
+	return content, nil
+}
+
+func (r *mapFileReader) Stat(ctx context.Context, path string) (FileInfo, error) {
+	content, ok := r.files[path]
+	if !ok {
+		return FileInfo{}, fmt.Errorf("open %s: %w", path, fs.ErrNotExist)
+	}
+	return FileInfo{Size: int64(len(content)), Hash: moduleHash(content)}, nil
+}
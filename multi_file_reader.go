@@ -0,0 +1,119 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+type multiFileReader struct {
+	schemes  map[string]FileReader
+	fallback FileReader
+
+	mu       sync.Mutex
+	resolved map[string]FileReader // resolved path -> reader
+}
+
+// MultiFileReader returns a FileReader that dispatches to other readers
+// based on the URL scheme of the module name, so that for example
+// load("https://...") and load("s3://...") can be used in the same config.
+//
+// Names without a scheme are resolved by the reader of the module that
+// loaded them, or by the fallback reader for the root module and modules
+// loaded from it. The fallback may be nil, in which case such names are
+// an error.
+func MultiFileReader(schemes map[string]FileReader, fallback FileReader) FileReader {
+	copied := make(map[string]FileReader, len(schemes))
+	for scheme, r := range schemes {
+		if r == nil {
+			panic(fmt.Sprintf("MultiFileReader: nil reader for scheme %q", scheme))
+		}
+		copied[strings.ToLower(scheme)] = r
+	}
+	return &multiFileReader{
+		schemes:  copied,
+		fallback: fallback,
+		resolved: make(map[string]FileReader),
+	}
+}
+
+// urlScheme returns the scheme of a URL-like module name. Single-letter
+// schemes are ignored, so Windows drive letters aren't mistaken for them.
+func urlScheme(name string) string {
+	idx := strings.Index(name, "://")
+	if idx < 2 {
+		return ""
+	}
+	return strings.ToLower(name[:idx])
+}
+
+func (r *multiFileReader) readerFor(name, fromPath string) (FileReader, error) {
+	if scheme := urlScheme(name); scheme != "" {
+		if reader, ok := r.schemes[scheme]; ok {
+			return reader, nil
+		}
+		return nil, fmt.Errorf("load(%q): no reader for URL scheme %q", name, scheme)
+	}
+	r.mu.Lock()
+	reader, ok := r.resolved[fromPath]
+	r.mu.Unlock()
+	if ok {
+		return reader, nil
+	}
+	if r.fallback == nil {
+		return nil, fmt.Errorf("load(%q): module name has no URL scheme", name)
+	}
+	return r.fallback, nil
+}
+
+func (r *multiFileReader) Resolve(ctx context.Context, name, fromPath string) (string, error) {
+	reader, err := r.readerFor(name, fromPath)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := reader.Resolve(ctx, name, fromPath)
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	r.resolved[resolved] = reader
+	r.mu.Unlock()
+	return resolved, nil
+}
+
+func (r *multiFileReader) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	r.mu.Lock()
+	reader, ok := r.resolved[path]
+	r.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("MultiFileReader: path %q was not returned by Resolve()", path)
+	}
+	return reader.ReadFile(ctx, path)
+}
+
+func (r *multiFileReader) Stat(ctx context.Context, path string) (FileInfo, error) {
+	r.mu.Lock()
+	reader, ok := r.resolved[path]
+	r.mu.Unlock()
+	if !ok {
+		return FileInfo{}, fmt.Errorf("MultiFileReader: path %q was not returned by Resolve()", path)
+	}
+	return statFile(ctx, reader, path)
+}
@@ -0,0 +1,329 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An ObjectStoreOption adjusts details of how S3FileReader and
+// GCSFileReader fetch modules.
+type ObjectStoreOption interface {
+	applyObjectStore(*objectStoreReader)
+}
+
+type fnObjectStoreOption func(*objectStoreReader)
+
+func (fn fnObjectStoreOption) applyObjectStore(r *objectStoreReader) { fn(r) }
+
+// WithObjectStoreEndpoint overrides the base URL of the storage service,
+// for example to use an S3-compatible server. Objects are addressed as
+// "<endpoint>/<bucket>/<key>".
+func WithObjectStoreEndpoint(endpoint string) ObjectStoreOption {
+	return fnObjectStoreOption(func(r *objectStoreReader) {
+		r.endpoint = strings.TrimSuffix(endpoint, "/")
+	})
+}
+
+// WithObjectStoreHTTPClient changes the client used to fetch objects. The
+// default is http.DefaultClient.
+func WithObjectStoreHTTPClient(client *http.Client) ObjectStoreOption {
+	if client == nil {
+		panic("WithObjectStoreHTTPClient: nil client")
+	}
+	return fnObjectStoreOption(func(r *objectStoreReader) {
+		r.client = client
+	})
+}
+
+// WithObjectStoreRetries sets how many times a failed request is retried
+// (with exponential backoff) after a network error or a 5xx/429 response.
+// The default is 3.
+func WithObjectStoreRetries(retries int) ObjectStoreOption {
+	return fnObjectStoreOption(func(r *objectStoreReader) {
+		r.retries = retries
+	})
+}
+
+type objectStoreReader struct {
+	scheme   string
+	bucket   string
+	endpoint string
+	client   *http.Client
+	retries  int
+
+	objectURL func(key string) string
+	authorize func(ctx context.Context, req *http.Request) error
+}
+
+var _ FileStater = (*objectStoreReader)(nil)
+
+func newObjectStoreReader(scheme, bucket string, opts []ObjectStoreOption) *objectStoreReader {
+	if bucket == "" {
+		panic(fmt.Sprintf("%s FileReader: empty bucket name", scheme))
+	}
+	r := &objectStoreReader{
+		scheme:  scheme,
+		bucket:  bucket,
+		client:  http.DefaultClient,
+		retries: 3,
+	}
+	for _, opt := range opts {
+		opt.applyObjectStore(r)
+	}
+	return r
+}
+
+// AWSCredentials are used by S3FileReader to sign requests.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// S3FileReader returns a FileReader that loads modules from an Amazon S3
+// bucket. Module names are object keys, optionally written as full
+// "s3://bucket/key" URLs. The credentials function is called for every
+// request, so it may return short-lived credentials.
+func S3FileReader(bucket, region string, credentials func(ctx context.Context) (AWSCredentials, error), opts ...ObjectStoreOption) FileReader {
+	if credentials == nil {
+		panic("S3FileReader: nil credentials")
+	}
+	r := newObjectStoreReader("s3", bucket, opts)
+	r.objectURL = func(key string) string {
+		if r.endpoint != "" {
+			return fmt.Sprintf("%s/%s/%s", r.endpoint, bucket, awsURIEncode(key))
+		}
+		return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, region, awsURIEncode(key))
+	}
+	r.authorize = func(ctx context.Context, req *http.Request) error {
+		creds, err := credentials(ctx)
+		if err != nil {
+			return err
+		}
+		signAWSRequest(req, creds, region, "s3", time.Now().UTC())
+		return nil
+	}
+	return r
+}
+
+// GCSFileReader returns a FileReader that loads modules from a Google Cloud
+// Storage bucket. Module names are object names, optionally written as full
+// "gs://bucket/name" URLs. The token function should return an OAuth2
+// access token, and is called for every request.
+func GCSFileReader(bucket string, token func(ctx context.Context) (string, error), opts ...ObjectStoreOption) FileReader {
+	if token == nil {
+		panic("GCSFileReader: nil token source")
+	}
+	r := newObjectStoreReader("gs", bucket, opts)
+	r.objectURL = func(key string) string {
+		endpoint := r.endpoint
+		if endpoint == "" {
+			endpoint = "https://storage.googleapis.com"
+		}
+		return fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", endpoint, bucket, url.PathEscape(key))
+	}
+	r.authorize = func(ctx context.Context, req *http.Request) error {
+		tok, err := token(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+		return nil
+	}
+	return r
+}
+
+func (r *objectStoreReader) Resolve(ctx context.Context, name, fromPath string) (string, error) {
+	prefix := r.scheme + "://"
+	if strings.HasPrefix(name, prefix) {
+		bucketAndKey := strings.TrimPrefix(name, prefix)
+		if !strings.HasPrefix(bucketAndKey, r.bucket+"/") {
+			return "", fmt.Errorf("load(%q): bucket must be %q", name, r.bucket)
+		}
+		name = strings.TrimPrefix(bucketAndKey, r.bucket+"/")
+	}
+	return fmt.Sprintf("%s%s/%s", prefix, r.bucket, path.Clean("/" + name)[1:]), nil
+}
+
+func (r *objectStoreReader) ReadFile(ctx context.Context, filename string) ([]byte, error) {
+	body, _, err := r.request(ctx, "GET", filename)
+	return body, err
+}
+
+// Stat sends a HEAD request for the object, and reports its ETag,
+// modification time, and size.
+func (r *objectStoreReader) Stat(ctx context.Context, filename string) (FileInfo, error) {
+	_, header, err := r.request(ctx, "HEAD", filename)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info := FileInfo{ETag: header.Get("ETag")}
+	if modTime, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+		info.Size, _ = strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	}
+	return info, nil
+}
+
+func (r *objectStoreReader) request(ctx context.Context, method, filename string) ([]byte, http.Header, error) {
+	key := strings.TrimPrefix(filename, fmt.Sprintf("%s://%s/", r.scheme, r.bucket))
+	var lastErr error
+	backoff := 100 * time.Millisecond
+	for attempt := 0; attempt <= r.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		body, header, retry, err := r.fetch(ctx, method, key)
+		if err == nil {
+			return body, header, nil
+		}
+		lastErr = fmt.Errorf("%s: %w", filename, err)
+		if !retry {
+			break
+		}
+	}
+	return nil, nil, lastErr
+}
+
+func (r *objectStoreReader) fetch(ctx context.Context, method, key string) (body []byte, header http.Header, retry bool, err error) {
+	req, err := http.NewRequest(method, r.objectURL(key), nil)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	req = req.WithContext(ctx)
+	if err := r.authorize(ctx, req); err != nil {
+		return nil, nil, false, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, nil, ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, nil, false, fmt.Errorf("%s %s: %s: %w", method, req.URL, resp.Status, fs.ErrNotExist)
+		}
+		return nil, nil, retry, fmt.Errorf("%s %s: %s", method, req.URL, resp.Status)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	return body, resp.Header, err != nil, err
+}
+
+// awsURIEncode escapes an S3 object key according to the AWS Signature
+// Version 4 rules, which differ slightly from url.PathEscape.
+func awsURIEncode(key string) string {
+	var buf strings.Builder
+	for _, b := range []byte(key) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || b == '/' {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+// signAWSRequest adds AWS Signature Version 4 headers to a request with an
+// empty body.
+func signAWSRequest(req *http.Request, creds AWSCredentials, region, service string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := hex.EncodeToString(sha256Sum(nil))
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key := range req.Header {
+		lower := strings.ToLower(key)
+		if strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(key))
+		}
+	}
+	var headerNames []string
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(sha256Sum([]byte(canonicalRequest))),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
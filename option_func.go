@@ -0,0 +1,111 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"go.starlark.net/starlark"
+)
+
+// LoadSettings is a view of the settings built up by the LoadOptions passed
+// to Load(), for use by options defined with LoadOptionFunc.
+type LoadSettings struct {
+	opts *loadOptions
+}
+
+// Globals returns a copy of the global symbols configured so far.
+func (s *LoadSettings) Globals() starlark.StringDict {
+	globals := make(starlark.StringDict, len(s.opts.globals))
+	for key, value := range s.opts.globals {
+		globals[key] = value
+	}
+	return globals
+}
+
+// FileReader returns the FileReader configured so far.
+func (s *LoadSettings) FileReader() FileReader {
+	return s.opts.fileReader
+}
+
+// Apply applies other options, in order.
+func (s *LoadSettings) Apply(opts ...LoadOption) {
+	for _, opt := range opts {
+		opt.applyLoad(s.opts)
+	}
+}
+
+// LoadOptionFunc returns a LoadOption that calls fn when it's applied. This
+// lets other packages define options that inspect or build on the settings
+// of earlier options, for example by wrapping the current FileReader.
+func LoadOptionFunc(fn func(*LoadSettings)) LoadOption {
+	if fn == nil {
+		panic("LoadOptionFunc: nil function")
+	}
+	return fnLoadOption(func(opts *loadOptions) {
+		fn(&LoadSettings{opts})
+	})
+}
+
+// ExecSettings is a view of the settings built up by the ExecOptions passed
+// to Main(), for use by options defined with ExecOptionFunc.
+type ExecSettings struct {
+	opts *execOptions
+}
+
+// Vars returns a copy of the ctx.vars dict configured so far.
+func (s *ExecSettings) Vars() *starlark.Dict {
+	vars := &starlark.Dict{}
+	for _, item := range s.opts.vars.Items() {
+		vars.SetKey(item[0], item[1])
+	}
+	return vars
+}
+
+// CtxAttrs returns a copy of the extra ctx attributes configured so far.
+func (s *ExecSettings) CtxAttrs() starlark.StringDict {
+	attrs := make(starlark.StringDict, len(s.opts.ctxAttrs))
+	for key, value := range s.opts.ctxAttrs {
+		attrs[key] = value
+	}
+	return attrs
+}
+
+// Apply applies other options, in order.
+func (s *ExecSettings) Apply(opts ...ExecOption) {
+	for _, opt := range opts {
+		opt.applyExec(s.opts)
+	}
+}
+
+// Fail causes Main() to return err without executing main(). Only the first
+// failure is reported.
+func (s *ExecSettings) Fail(err error) {
+	if s.opts.err == nil {
+		s.opts.err = err
+	}
+}
+
+// ExecOptionFunc returns an ExecOption that calls fn when it's applied. This
+// lets other packages define options that inspect or build on the settings
+// of earlier options.
+func ExecOptionFunc(fn func(*ExecSettings)) ExecOption {
+	if fn == nil {
+		panic("ExecOptionFunc: nil function")
+	}
+	return fnExecOption(func(opts *execOptions) {
+		fn(&ExecSettings{opts})
+	})
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"strings"
+
+	"go.starlark.net/starlark"
+
+	impl "github.com/stripe/skycfg/internal/go/skycfg"
+)
+
+// WithPartialResults lets main() run to completion when some of its parts
+// fail, such as rendering one cluster out of many. Each part is run with
+// ctx.isolate(name, fn, *args, **kwargs): if fn fails, its error is
+// recorded and ctx.isolate() returns None, so that main() can carry on
+// with the other parts. Messages that fn passed to ctx.emit() are
+// discarded, unless they were already streamed to a WithMessageHandler()
+// handler.
+//
+// If any part failed, Exec() returns the messages of the others along with
+// a *PartialError. Errors outside of ctx.isolate(), and timeouts, stop
+// execution as usual. Without this option, ctx.isolate() calls fn directly.
+func WithPartialResults() ExecOption {
+	return fnExecOption(func(opts *execOptions) {
+		opts.partialResults = true
+	})
+}
+
+// An IsolatedError reports that a part of main() run with ctx.isolate()
+// failed.
+type IsolatedError struct {
+	// Name is the name passed to ctx.isolate().
+	Name string
+	Err  error
+}
+
+func (e *IsolatedError) Error() string { return fmt.Sprintf("%s: %v", e.Name, e.Err) }
+func (e *IsolatedError) Unwrap() error { return e.Err }
+
+// A PartialError reports that main() ran to completion with
+// WithPartialResults(), but some of its isolated parts failed. The
+// messages of the other parts are returned with it.
+type PartialError struct {
+	Errs []*IsolatedError
+}
+
+func (e *PartialError) Error() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%d isolated part(s) of `main' failed:", len(e.Errs))
+	for _, err := range e.Errs {
+		buf.WriteString("\n")
+		buf.WriteString(err.Error())
+	}
+	return buf.String()
+}
+
+func (e *PartialError) Unwrap() []error {
+	errs := make([]error, len(e.Errs))
+	for ii, err := range e.Errs {
+		errs[ii] = err
+	}
+	return errs
+}
+
+// isolate implements ctx.isolate() for the state's executions.
+func (s *execState) isolate(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("%s: got %d arguments, want at least 2", fn.Name(), len(args))
+	}
+	name, ok := starlark.AsString(args[0])
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want string", fn.Name(), args[0].Type())
+	}
+	callable, ok := args[1].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter 2: got %s, want callable", fn.Name(), args[1].Type())
+	}
+	if !s.opts.partialResults {
+		return starlark.Call(t, callable, args[2:], kwargs)
+	}
+	emitted := len(s.result.Messages)
+	val, err := starlark.Call(t, callable, args[2:], kwargs)
+	if err == nil {
+		return val, nil
+	}
+	if impl.Interrupted(t) {
+		return nil, err
+	}
+	s.result.Messages = s.result.Messages[:emitted]
+	s.result.Annotations = s.result.Annotations[:emitted]
+	s.isolated = append(s.isolated, &IsolatedError{Name: name, Err: impl.AddFrozenErrorHint(err, s.config.frozen)})
+	return starlark.None, nil
+}
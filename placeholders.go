@@ -0,0 +1,209 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// A PlaceholderPolicy says which fields WithPlaceholderExpansion() expands,
+// and where the values of their placeholders may come from.
+type PlaceholderPolicy struct {
+	// Fields are the full names of the string fields to expand, such as
+	// "k8s.io.api.core.v1.EnvVar.value". Repeated fields and map values
+	// are expanded element by element.
+	Fields []string
+
+	// Vars are the names of the ctx.vars that placeholders may refer to,
+	// which must be strings. They take precedence over Env.
+	Vars []string
+
+	// Env are the names of the environment variables that placeholders
+	// may refer to.
+	Env []string
+
+	// Strict fails execution on a placeholder that isn't allowed, or that
+	// refers to a var or environment variable that isn't set. Otherwise
+	// such placeholders are left as they are.
+	Strict bool
+}
+
+// WithPlaceholderExpansion replaces `${NAME}` placeholders in the fields of
+// the messages produced by main() that the policy names, after main() has
+// rendered them. It's a replacement for running envsubst over the output,
+// limited to the fields and values the policy allows.
+//
+// Messages are copied before they're expanded, so templates that they
+// share submessages with are left unchanged. Exec() fails with a
+// ValidationError if a strict policy rejects a placeholder.
+func WithPlaceholderExpansion(policy PlaceholderPolicy) ExecOption {
+	return fnExecOption(func(opts *execOptions) {
+		if len(policy.Fields) == 0 {
+			opts.err = fmt.Errorf("WithPlaceholderExpansion: no fields to expand")
+			return
+		}
+		p := &placeholderExpander{
+			fields: make(map[protoreflect.FullName]bool),
+			vars:   make(map[string]bool),
+			env:    make(map[string]bool),
+			strict: policy.Strict,
+		}
+		for _, name := range policy.Fields {
+			p.fields[protoreflect.FullName(name)] = true
+		}
+		for _, name := range policy.Vars {
+			p.vars[name] = true
+		}
+		for _, name := range policy.Env {
+			p.env[name] = true
+		}
+		opts.placeholders = p
+	})
+}
+
+var placeholderPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+type placeholderExpander struct {
+	fields    map[protoreflect.FullName]bool
+	vars, env map[string]bool
+	strict    bool
+}
+
+// expandPlaceholders returns a copy of msg with the placeholders in its
+// fields expanded, or msg itself if the execution doesn't expand them.
+func expandPlaceholders(opts *execOptions, msg proto.Message) (proto.Message, error) {
+	p := opts.placeholders
+	if p == nil {
+		return msg, nil
+	}
+	msg = proto.Clone(msg)
+	if err := p.expandMessage(opts, proto.MessageV2(msg).ProtoReflect()); err != nil {
+		return nil, &ValidationError{Err: fmt.Errorf("`main' returned a %s with %v", proto.MessageName(msg), err)}
+	}
+	return msg, nil
+}
+
+func (p *placeholderExpander) expandMessage(opts *execOptions, m protoreflect.Message) error {
+	var err error
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		err = p.expandField(opts, m, fd, v)
+		return err == nil
+	})
+	return err
+}
+
+func (p *placeholderExpander) expandField(opts *execOptions, m protoreflect.Message, fd protoreflect.FieldDescriptor, v protoreflect.Value) error {
+	if fd.IsMap() {
+		valueDesc := fd.MapValue()
+		var err error
+		v.Map().Range(func(key protoreflect.MapKey, item protoreflect.Value) bool {
+			if valueDesc.Message() != nil {
+				err = p.expandMessage(opts, item.Message())
+			} else if valueDesc.Kind() == protoreflect.StringKind && p.fields[fd.FullName()] {
+				var s string
+				if s, err = p.expand(opts, fd, item.String()); err == nil {
+					v.Map().Set(key, protoreflect.ValueOfString(s))
+				}
+			}
+			return err == nil
+		})
+		return err
+	}
+	if fd.IsList() {
+		list := v.List()
+		for ii := 0; ii < list.Len(); ii++ {
+			if fd.Message() != nil {
+				if err := p.expandMessage(opts, list.Get(ii).Message()); err != nil {
+					return err
+				}
+			} else if fd.Kind() == protoreflect.StringKind && p.fields[fd.FullName()] {
+				s, err := p.expand(opts, fd, list.Get(ii).String())
+				if err != nil {
+					return err
+				}
+				list.Set(ii, protoreflect.ValueOfString(s))
+			}
+		}
+		return nil
+	}
+	if fd.Message() != nil {
+		return p.expandMessage(opts, v.Message())
+	}
+	if fd.Kind() == protoreflect.StringKind && p.fields[fd.FullName()] {
+		s, err := p.expand(opts, fd, v.String())
+		if err != nil {
+			return err
+		}
+		m.Set(fd, protoreflect.ValueOfString(s))
+	}
+	return nil
+}
+
+// expand returns s with its placeholders replaced by their values.
+func (p *placeholderExpander) expand(opts *execOptions, fd protoreflect.FieldDescriptor, s string) (string, error) {
+	var err error
+	expanded := placeholderPattern.ReplaceAllStringFunc(s, func(placeholder string) string {
+		if err != nil {
+			return placeholder
+		}
+		name := placeholderPattern.FindStringSubmatch(placeholder)[1]
+		value, ok, lookupErr := p.lookup(opts, name)
+		if lookupErr != nil {
+			err = fmt.Errorf("placeholder %s in field %s: %v", placeholder, fd.FullName(), lookupErr)
+			return placeholder
+		}
+		if !ok {
+			if p.strict {
+				err = fmt.Errorf("unknown placeholder %s in field %s", placeholder, fd.FullName())
+			}
+			return placeholder
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// lookup returns the value of an allowed var or environment variable.
+func (p *placeholderExpander) lookup(opts *execOptions, name string) (string, bool, error) {
+	if p.vars[name] {
+		var vars starlark.Mapping = opts.vars
+		if opts.capabilities != nil {
+			vars = opts.capabilities.varsView(opts.vars)
+		}
+		if val, found, _ := vars.Get(starlark.String(name)); found {
+			s, ok := starlark.AsString(val)
+			if !ok {
+				return "", false, fmt.Errorf("ctx.vars[%q] is a %s, not a string", name, val.Type())
+			}
+			return s, true, nil
+		}
+	}
+	if p.env[name] {
+		if opts.capabilities != nil {
+			opts.capabilities.recordEnv(name)
+		}
+		value, ok := os.LookupEnv(name)
+		return value, ok, nil
+	}
+	return "", false, nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+
+	impl "github.com/stripe/skycfg/internal/go/skycfg"
+)
+
+// WithProgramCache stores each module's compiled program in cache, keyed by
+// the module's path and content, so that later calls to Load() can skip
+// parsing and compiling modules that haven't changed. Use DirCache() to
+// share compiled modules between processes.
+//
+// Because the content is part of the key, configs that read different
+// versions of a module at the same path, such as through different
+// FileReaders, can share a cache without seeing each other's programs.
+// Config.Modules() reports the content hash of each module that was used.
+//
+// Cache errors are logged, and the module is compiled from source.
+func WithProgramCache(cache Cache) LoadOption {
+	if cache == nil {
+		panic("WithProgramCache: nil cache")
+	}
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.programCache = cache
+	})
+}
+
+// cachedProgram is the cached form of a compiled module. The module's
+// load() statements are stored with it, since the loader inspects them
+// before executing the program.
+type cachedProgram struct {
+	Loads   []cachedLoad      `json:"loads,omitempty"`
+	Pins    map[string]string `json:"pins,omitempty"`
+	Program []byte            `json:"program"`
+}
+
+type cachedLoad struct {
+	Pos    cachedPos     `json:"pos"`
+	Module string        `json:"module"`
+	Raw    string        `json:"raw"`
+	ModPos cachedPos     `json:"module_pos"`
+	From   []cachedIdent `json:"from"`
+	To     []cachedIdent `json:"to"`
+}
+
+type cachedIdent struct {
+	Name string    `json:"name"`
+	Pos  cachedPos `json:"pos"`
+}
+
+type cachedPos struct {
+	Line int32 `json:"line"`
+	Col  int32 `json:"col"`
+}
+
+// programCacheKey identifies a compiled module. Compilation depends on the
+// module's source, its filename (which is recorded in positions), the
+// names of the predeclared globals, and the version of the compiler.
+func programCacheKey(modulePath string, source []byte, predeclared starlark.StringDict) string {
+	names := make([]string, 0, len(predeclared))
+	for name := range predeclared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return CacheKey(
+		[]byte("skycfg.program"),
+		[]byte(strconv.Itoa(starlark.CompilerVersion)),
+		[]byte(modulePath),
+		source,
+		[]byte(strings.Join(names, "\n")),
+	)
+}
+
+func encodeProgram(loads []*syntax.LoadStmt, pins map[string]string, prog *starlark.Program) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := prog.Write(&buf); err != nil {
+		return nil, err
+	}
+	cached := cachedProgram{Pins: pins, Program: buf.Bytes()}
+	if len(pins) == 0 {
+		cached.Pins = nil
+	}
+	for _, load := range loads {
+		cached.Loads = append(cached.Loads, cachedLoad{
+			Pos:    cachedPos{load.Load.Line, load.Load.Col},
+			Module: load.Module.Value.(string),
+			Raw:    load.Module.Raw,
+			ModPos: cachedPos{load.Module.TokenPos.Line, load.Module.TokenPos.Col},
+			From:   encodeIdents(load.From),
+			To:     encodeIdents(load.To),
+		})
+	}
+	return json.Marshal(cached)
+}
+
+func encodeIdents(idents []*syntax.Ident) []cachedIdent {
+	out := make([]cachedIdent, len(idents))
+	for ii, ident := range idents {
+		out[ii] = cachedIdent{ident.Name, cachedPos{ident.NamePos.Line, ident.NamePos.Col}}
+	}
+	return out
+}
+
+// decodeProgram returns a module's compiled program, its pins, and a file
+// containing only its load() statements.
+func decodeProgram(modulePath string, data []byte) (*syntax.File, map[string]string, *starlark.Program, error) {
+	var cached cachedProgram
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, nil, nil, err
+	}
+	prog, err := starlark.CompiledProgram(bytes.NewReader(cached.Program))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	filename := modulePath
+	pos := func(p cachedPos) syntax.Position {
+		return syntax.MakePosition(&filename, p.Line, p.Col)
+	}
+	idents := func(in []cachedIdent) []*syntax.Ident {
+		out := make([]*syntax.Ident, len(in))
+		for ii, ident := range in {
+			out[ii] = &syntax.Ident{NamePos: pos(ident.Pos), Name: ident.Name}
+		}
+		return out
+	}
+	f := &syntax.File{}
+	for _, load := range cached.Loads {
+		f.Stmts = append(f.Stmts, &syntax.LoadStmt{
+			Load: pos(load.Pos),
+			Module: &syntax.Literal{
+				Token:    syntax.STRING,
+				TokenPos: pos(load.ModPos),
+				Raw:      load.Raw,
+				Value:    load.Module,
+			},
+			From: idents(load.From),
+			To:   idents(load.To),
+		})
+	}
+	pins := cached.Pins
+	if pins == nil {
+		pins = make(map[string]string)
+	}
+	return f, pins, prog, nil
+}
+
+// cachedProgramFor returns a module's compiled program from the program
+// cache, or nil if it isn't cached.
+func (l *loader) cachedProgramFor(thread *starlark.Thread, key, modulePath string) (*syntax.File, map[string]string, *starlark.Program) {
+	data, ok, err := l.opts.programCache.Get(l.ctx, key)
+	if err != nil {
+		l.logCacheError(thread, modulePath, err)
+	}
+	if !ok {
+		return nil, nil, nil
+	}
+	f, pins, prog, err := decodeProgram(modulePath, data)
+	if err != nil {
+		l.logCacheError(thread, modulePath, err)
+		return nil, nil, nil
+	}
+	return f, pins, prog
+}
+
+func (l *loader) cacheProgram(thread *starlark.Thread, key, modulePath string, loads []*syntax.LoadStmt, pins map[string]string, prog *starlark.Program) {
+	data, err := encodeProgram(loads, pins, prog)
+	if err == nil {
+		err = l.opts.programCache.Put(l.ctx, key, data)
+	}
+	if err != nil {
+		l.logCacheError(thread, modulePath, err)
+	}
+}
+
+func (l *loader) logCacheError(thread *starlark.Thread, modulePath string, err error) {
+	impl.Log(thread, "warn", "program cache: "+err.Error(), map[string]string{
+		"module": modulePath,
+	}, syntax.Position{})
+}
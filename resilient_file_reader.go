@@ -0,0 +1,238 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// A ResilientFileReaderOption adjusts how a ResilientFileReader handles
+// slow or failing calls.
+type ResilientFileReaderOption interface {
+	applyResilient(*resilientFileReader)
+}
+
+type fnResilientFileReaderOption func(*resilientFileReader)
+
+func (fn fnResilientFileReaderOption) applyResilient(r *resilientFileReader) { fn(r) }
+
+// WithCallTimeout limits how long each call to the inner reader may take,
+// including each retry. The default is 30 seconds.
+func WithCallTimeout(timeout time.Duration) ResilientFileReaderOption {
+	if timeout <= 0 {
+		panic("WithCallTimeout: timeout must be positive")
+	}
+	return fnResilientFileReaderOption(func(r *resilientFileReader) {
+		r.timeout = timeout
+	})
+}
+
+// WithRetries sets how many times a failed call is retried, and the delay
+// before the first retry. The delay doubles after each retry. The default
+// is 2 retries, starting at 100 milliseconds.
+func WithRetries(retries int, backoff time.Duration) ResilientFileReaderOption {
+	if retries < 0 {
+		panic("WithRetries: retries must not be negative")
+	}
+	if backoff < 0 {
+		panic("WithRetries: backoff must not be negative")
+	}
+	return fnResilientFileReaderOption(func(r *resilientFileReader) {
+		r.retries = retries
+		r.backoff = backoff
+	})
+}
+
+// WithCircuitBreaker makes calls fail immediately, without calling the
+// inner reader, once `failures` calls in a row have failed. After the
+// cooldown, one call is let through; the breaker closes again if it
+// succeeds. The default is to open after 5 failures, for 30 seconds.
+func WithCircuitBreaker(failures int, cooldown time.Duration) ResilientFileReaderOption {
+	if failures <= 0 {
+		panic("WithCircuitBreaker: failures must be positive")
+	}
+	if cooldown <= 0 {
+		panic("WithCircuitBreaker: cooldown must be positive")
+	}
+	return fnResilientFileReaderOption(func(r *resilientFileReader) {
+		r.threshold = failures
+		r.cooldown = cooldown
+	})
+}
+
+// A Clock tells a ResilientFileReader the time, and waits between retries.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// WithClock replaces the system clock used for retry backoff and the
+// circuit breaker's cooldown, so that tests can control time.
+func WithClock(clock Clock) ResilientFileReaderOption {
+	if clock == nil {
+		panic("WithClock: nil clock")
+	}
+	return fnResilientFileReaderOption(func(r *resilientFileReader) {
+		r.clock = clock
+	})
+}
+
+type resilientFileReader struct {
+	inner     FileReader
+	timeout   time.Duration
+	retries   int
+	backoff   time.Duration
+	threshold int
+	cooldown  time.Duration
+	clock     Clock
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+var _ FileStater = (*resilientFileReader)(nil)
+
+// ResilientFileReader returns a FileReader that applies a timeout to each
+// call to inner, retries failed calls with exponential backoff, and stops
+// calling inner for a while after repeated failures. It's intended to wrap
+// readers of remote module sources, so that an unavailable source makes
+// Load() fail promptly rather than hang.
+//
+// Files that don't exist aren't retried, and don't count as failures.
+func ResilientFileReader(inner FileReader, opts ...ResilientFileReaderOption) FileReader {
+	if inner == nil {
+		panic("ResilientFileReader: nil reader")
+	}
+	r := &resilientFileReader{
+		inner:     inner,
+		timeout:   30 * time.Second,
+		retries:   2,
+		backoff:   100 * time.Millisecond,
+		threshold: 5,
+		cooldown:  30 * time.Second,
+		clock:     systemClock{},
+	}
+	for _, opt := range opts {
+		opt.applyResilient(r)
+	}
+	return r
+}
+
+func (r *resilientFileReader) Resolve(ctx context.Context, name, fromPath string) (string, error) {
+	var resolved string
+	err := r.call(ctx, func(ctx context.Context) (err error) {
+		resolved, err = r.inner.Resolve(ctx, name, fromPath)
+		return err
+	})
+	return resolved, err
+}
+
+func (r *resilientFileReader) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	var content []byte
+	err := r.call(ctx, func(ctx context.Context) (err error) {
+		content, err = r.inner.ReadFile(ctx, path)
+		return err
+	})
+	return content, err
+}
+
+// Stat returns the inner reader's metadata for a file, if it's a
+// FileStater.
+func (r *resilientFileReader) Stat(ctx context.Context, path string) (FileInfo, error) {
+	var info FileInfo
+	err := r.call(ctx, func(ctx context.Context) (err error) {
+		info, err = statFile(ctx, r.inner, path)
+		return err
+	})
+	return info, err
+}
+
+func (r *resilientFileReader) call(ctx context.Context, fn func(context.Context) error) error {
+	if err := r.allow(); err != nil {
+		return err
+	}
+	backoff := r.backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		err = fn(callCtx)
+		cancel()
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			r.record(true)
+			return err
+		}
+		if attempt == r.retries || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-r.clock.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+	}
+	// Cancellation by the caller says nothing about the inner reader.
+	if ctx.Err() != nil {
+		r.mu.Lock()
+		r.probing = false
+		r.mu.Unlock()
+		return err
+	}
+	r.record(false)
+	return err
+}
+
+// allow returns an error if the circuit breaker is open. Once the cooldown
+// has passed, a single call is allowed through to probe the inner reader.
+func (r *resilientFileReader) allow() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.openUntil.IsZero() {
+		return nil
+	}
+	if r.clock.Now().Before(r.openUntil) || r.probing {
+		return fmt.Errorf("file reader unavailable after %d consecutive failures", r.failures)
+	}
+	r.probing = true
+	return nil
+}
+
+func (r *resilientFileReader) record(ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.probing = false
+	if ok {
+		r.failures = 0
+		r.openUntil = time.Time{}
+		return
+	}
+	r.failures++
+	if r.failures >= r.threshold {
+		r.openUntil = r.clock.Now().Add(r.cooldown)
+	}
+}
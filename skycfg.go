@@ -26,11 +26,14 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
+	"google.golang.org/protobuf/types/descriptorpb"
 
 	impl "github.com/stripe/skycfg/internal/go/skycfg"
 )
@@ -49,17 +52,70 @@ type FileReader interface {
 	ReadFile(ctx context.Context, path string) ([]byte, error)
 }
 
+// A LocalFileReaderOption adjusts details of how a LocalFileReader resolves
+// modules.
+type LocalFileReaderOption interface {
+	applyLocal(*localFileReader)
+}
+
+type fnLocalFileReaderOption func(*localFileReader)
+
+func (fn fnLocalFileReaderOption) applyLocal(r *localFileReader) { fn(r) }
+
+// WithRootRelativeLoads resolves every load() name relative to the root
+// directory, including names starting with "./" or "../".
+func WithRootRelativeLoads() LocalFileReaderOption {
+	return fnLocalFileReaderOption(func(r *localFileReader) {
+		r.rootRelative = true
+	})
+}
+
+// WithContainment makes a LocalFileReader refuse to read or stat any file
+// whose path, after following symlinks, is outside of the root directory.
+// This applies to the top-level module passed to Load() as well as the
+// modules it loads.
+//
+// The check is made immediately before each read, so it doesn't guard
+// against symlinks being changed concurrently by another process.
+func WithContainment() LocalFileReaderOption {
+	return fnLocalFileReaderOption(func(r *localFileReader) {
+		r.contained = true
+	})
+}
+
+// WithReadAudit calls audit after every attempt by a LocalFileReader to
+// read a file, with the path that was read and the error, if any.
+func WithReadAudit(audit func(path string, err error)) LocalFileReaderOption {
+	if audit == nil {
+		panic("WithReadAudit: nil audit func")
+	}
+	return fnLocalFileReaderOption(func(r *localFileReader) {
+		r.audit = audit
+	})
+}
+
 type localFileReader struct {
-	root string
+	root         string
+	rootRelative bool
+	contained    bool
+	audit        func(path string, err error)
 }
 
 // LocalFileReader returns a FileReader that resolves and loads files from
 // within a given filesystem directory.
-func LocalFileReader(root string) FileReader {
+//
+// Module names starting with "./" or "../" are resolved relative to the
+// directory of the module that loads them, and may not refer to files
+// outside of root. Other names are resolved relative to root.
+func LocalFileReader(root string, opts ...LocalFileReaderOption) FileReader {
 	if root == "" {
 		panic("LocalFileReader: empty root path")
 	}
-	return &localFileReader{root}
+	r := &localFileReader{root: root}
+	for _, opt := range opts {
+		opt.applyLocal(r)
+	}
+	return r
 }
 
 func (r *localFileReader) Resolve(ctx context.Context, name, fromPath string) (string, error) {
@@ -69,16 +125,76 @@ func (r *localFileReader) Resolve(ctx context.Context, name, fromPath string) (s
 	if filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator) {
 		return "", fmt.Errorf("load(%q): invalid character in module name", name)
 	}
-	resolved := filepath.Join(r.root, filepath.FromSlash(path.Clean("/"+name)))
+	relName := name
+	if !r.rootRelative && (strings.HasPrefix(name, "./") || strings.HasPrefix(name, "../")) {
+		fromDir, err := filepath.Rel(r.root, filepath.Dir(fromPath))
+		if err != nil {
+			return "", fmt.Errorf("load(%q): %v", name, err)
+		}
+		relName = path.Join(filepath.ToSlash(fromDir), name)
+		if relName == ".." || strings.HasPrefix(relName, "../") {
+			return "", fmt.Errorf("load(%q): path is outside of %s", name, r.root)
+		}
+	}
+	resolved := filepath.Join(r.root, filepath.FromSlash(path.Clean("/"+relName)))
 	return resolved, nil
 }
 
 func (r *localFileReader) ReadFile(ctx context.Context, path string) ([]byte, error) {
-	return ioutil.ReadFile(path)
+	var content []byte
+	err := r.checkContained(path)
+	if err == nil {
+		content, err = ioutil.ReadFile(path)
+	}
+	if r.audit != nil {
+		r.audit(path, err)
+	}
+	return content, err
+}
+
+func (r *localFileReader) Stat(ctx context.Context, path string) (FileInfo, error) {
+	if err := r.checkContained(path); err != nil {
+		return FileInfo{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{ModTime: info.ModTime(), Size: info.Size()}, nil
+}
+
+// checkContained returns an error if WithContainment is set and path is
+// outside of the root directory once symlinks are followed.
+func (r *localFileReader) checkContained(path string) error {
+	if !r.contained {
+		return nil
+	}
+	root, err := filepath.EvalSymlinks(r.root)
+	if err != nil {
+		return err
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return err
+	}
+	if real, err = filepath.Abs(real); err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s: path is outside of %s", path, r.root)
+	}
+	return nil
 }
 
 // NewProtoMessage returns a Starlark value representing the given Protobuf
 // message. It can be returned back to a proto.Message() via AsProtoMessage().
+//
+// The message may be generated by protoc-gen-go or gogo-protobuf, or be a
+// dynamic message such as a *dynamicpb.Message.
 func NewProtoMessage(msg proto.Message) starlark.Value {
 	return impl.NewSkyProtoMessage(msg)
 }
@@ -90,12 +206,53 @@ func AsProtoMessage(v starlark.Value) (proto.Message, bool) {
 	return impl.ToProtoMessage(v)
 }
 
+// A FieldError reports a value that couldn't be assigned to a Protobuf
+// field, or a field that the message doesn't have, with details such as
+// the path to the field and the expected type. When Starlark code makes
+// the assignment, Load() and Main() return the FieldError with its Pos set
+// to the file, line, and column of the assignment, and it unwraps to the
+// *starlark.EvalError with the backtrace.
+type FieldError = impl.FieldError
+
+// A RuleError reports the validation rules that a message produced by
+// main() breaks, with the position where the message was created and,
+// for each violation, where the field was assigned. It's returned within
+// a ValidationError when WithStandardValidationRules() is set.
+type RuleError = impl.RuleError
+
+// A RuleViolation is a field of a RuleError's message that breaks one of
+// its validation rules.
+type RuleViolation = impl.RuleViolation
+
+// PositionOf returns the source position at which a value was created during
+// evaluation, if known. This is best-effort: positions are recorded for
+// Protobuf messages constructed by Starlark code and for functions, but not
+// for plain values such as dicts or lists.
+func PositionOf(v starlark.Value) (file string, line int, ok bool) {
+	pos, ok := impl.ValuePosition(v)
+	if !ok {
+		return "", 0, false
+	}
+	return pos.Filename(), int(pos.Line), true
+}
+
 // A Config is a Skycfg config file that has been fully loaded and is ready
 // for execution.
 type Config struct {
-	filename string
-	globals  starlark.StringDict
-	locals   starlark.StringDict
+	filename      string
+	globals       starlark.StringDict
+	locals        starlark.StringDict
+	dependencies  []Dependency
+	outputSchema  string
+	oneofPolicy   OneofPolicy
+	deterministic bool
+	lenient       bool
+	shareMessages bool
+	frozen        *impl.FrozenValues
+	protoRegistry impl.ProtoRegistry
+
+	// fileReader is kept to report the columns of field errors.
+	fileReader FileReader
 }
 
 // A LoadOption adjusts details of how Skycfg configs are loaded.
@@ -107,6 +264,43 @@ type loadOptions struct {
 	globals       starlark.StringDict
 	fileReader    FileReader
 	protoRegistry impl.ProtoRegistry
+	protoFiles    []string
+	protoEnums    []string
+	isolateProtos bool
+	deterministic bool
+	shareMessages bool
+
+	lockfile       *Lockfile
+	verifyLockfile bool
+	outputSchema   string
+
+	loadFilters    []func(moduleName, fromPath string) error
+	logger         impl.LogFunc
+	shadowPolicy   ShadowPolicy
+	reExportPolicy ReExportPolicy
+	oneofPolicy    OneofPolicy
+	lenient        bool
+	loadWorkers    int
+	modules        map[string]starlark.StringDict
+	programCache   Cache
+	loadTimeout    time.Duration
+
+	watchInterval time.Duration
+
+	// hostGlobals holds the names of globals added by WithGlobals.
+	hostGlobals  map[string]bool
+	capabilities *CapabilityRecorder
+	coverage     *CoverageRecorder
+
+	// protoModule is the "proto" global, whose registry is set once the
+	// options have been applied.
+	protoModule *impl.ProtoModule
+
+	// frozen records where the values of loaded modules were defined.
+	frozen *impl.FrozenValues
+
+	// err is an error in the options, reported by Load().
+	err error
 }
 
 type fnLoadOption func(*loadOptions)
@@ -119,14 +313,121 @@ type unstableProtoRegistry interface {
 
 // WithGlobals adds additional global symbols to the Starlark environment
 // when loading a Skycfg config.
+//
+// Builtin functions in globals, including those in modules and structs,
+// are wrapped so that a panic is returned as an error from the call rather
+// than crashing the process. This also applies to WithModule() and
+// WithCtxAttrs(). Ranges are wrapped like those of the config's range(),
+// so that the two can be compared; this also applies to WithVars().
 func WithGlobals(globals starlark.StringDict) LoadOption {
 	return fnLoadOption(func(opts *loadOptions) {
 		for key, value := range globals {
-			opts.globals[key] = value
+			opts.globals[key] = impl.WrapRange(impl.RecoverPanics(value))
+			if opts.hostGlobals == nil {
+				opts.hostGlobals = make(map[string]bool)
+			}
+			opts.hostGlobals[key] = true
+		}
+	})
+}
+
+// WithRestrictedGlobals adds global symbols like WithGlobals(), but their
+// builtin functions may only be called by a main() or test that has been
+// granted the global's capability with GrantCapabilities(). A global's
+// capability is its name.
+//
+// Calls that weren't granted fail, including calls made while the config
+// is loading, so conveniences meant for tests, such as reading the current
+// time, can't change what main() renders.
+func WithRestrictedGlobals(globals starlark.StringDict) LoadOption {
+	return fnLoadOption(func(opts *loadOptions) {
+		for key, value := range globals {
+			capability := key
+			opts.globals[key] = impl.GuardCalls(impl.WrapRange(impl.RecoverPanics(value)), key, func(t *starlark.Thread, name string) error {
+				granted, _ := t.Local("capabilities").(map[string]bool)
+				if !granted[capability] {
+					return fmt.Errorf("%s: capability %q is not granted", name, capability)
+				}
+				return nil
+			})
+			if opts.hostGlobals == nil {
+				opts.hostGlobals = make(map[string]bool)
+			}
+			opts.hostGlobals[key] = true
 		}
 	})
 }
 
+// WithGlobalsFromProto adds the values of the named Protobuf enums as global
+// symbols, so configs can write `ROUND_ROBIN` instead of spelling out the
+// full proto.package() path. Enum names must be fully qualified, for example
+// "envoy.api.v2.Cluster.LbPolicy".
+func WithGlobalsFromProto(enumNames ...string) LoadOption {
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.protoEnums = append(opts.protoEnums, enumNames...)
+	})
+}
+
+// WithModule registers a module defined in Go, which configs can load with
+// `load("@builtin//name", "symbol")`. This keeps helper libraries out of the
+// global namespace. The members are frozen when the option is applied.
+func WithModule(name string, members starlark.StringDict) LoadOption {
+	if name == "" {
+		panic("WithModule: empty module name")
+	}
+	return fnLoadOption(func(opts *loadOptions) {
+		copied := make(starlark.StringDict, len(members))
+		for key, value := range members {
+			value = impl.WrapRange(impl.RecoverPanics(value))
+			value.Freeze()
+			copied[key] = value
+		}
+		if opts.modules == nil {
+			opts.modules = make(map[string]starlark.StringDict)
+		}
+		opts.modules[name] = copied
+	})
+}
+
+// WithOutputSchema pins the JSON encoding of messages by proto.to_json(),
+// proto.to_yaml(), json.marshal(), and yaml.marshal() to a named version,
+// so that upgrading Skycfg or the protobuf runtime doesn't change a
+// config's output. The default is the latest version. Pins can also be
+// stored in a Lockfile.
+//
+// The only version is currently "1": field names from the .proto file,
+// enums as names, and default values omitted.
+func WithOutputSchema(version string) LoadOption {
+	if err := impl.CheckOutputSchema(version); err != nil {
+		panic("WithOutputSchema: " + err.Error())
+	}
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.outputSchema = version
+	})
+}
+
+// A DeterministicOption can be passed to both Load() and Exec().
+type DeterministicOption interface {
+	LoadOption
+	ExecOption
+}
+
+type deterministicOption struct{}
+
+func (deterministicOption) applyLoad(opts *loadOptions) { opts.deterministic = true }
+func (deterministicOption) applyExec(opts *execOptions) { opts.deterministic = true }
+
+// WithDeterministicEncoding makes the messages that a config encodes, with
+// proto.encode() or proto.pack_any(), have their map entries written in a
+// deterministic order, so that hashes of its output only change when the
+// output does. Unknown fields are written in the order they were decoded.
+// JSON, YAML, and text encodings always sort map keys.
+//
+// Passed to Load(), it also applies to every execution of the config.
+func WithDeterministicEncoding() DeterministicOption {
+	return deterministicOption{}
+}
+
 // WithFileReader changes the implementation of load() when loading a
 // Skycfg config.
 func WithFileReader(r FileReader) LoadOption {
@@ -140,6 +441,10 @@ func WithFileReader(r FileReader) LoadOption {
 
 // WithProtoRegistry is an EXPERIMENTAL and UNSTABLE option to override
 // how Protobuf message type names are mapped to Go types.
+//
+// If the registry also has an UnstableResolveProtoName method, it's used to
+// resolve the names of types in a proto.package() (see
+// NewAliasProtoRegistry).
 func WithProtoRegistry(r unstableProtoRegistry) LoadOption {
 	if r == nil {
 		panic("WithProtoRegistry: nil registry")
@@ -149,78 +454,387 @@ func WithProtoRegistry(r unstableProtoRegistry) LoadOption {
 	})
 }
 
+// NewDescriptorSetRegistry returns a registry of the message and enum types
+// in a FileDescriptorSet, for use with WithProtoRegistry(). Types that have
+// no generated Go code linked into the binary are backed by dynamic
+// messages (see google.golang.org/protobuf/types/dynamicpb).
+func NewDescriptorSetRegistry(set *descriptorpb.FileDescriptorSet) (unstableProtoRegistry, error) {
+	registry, err := impl.NewDescriptorSetRegistry(set)
+	if err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// A ReflectionClient fetches file descriptors from a gRPC server's
+// reflection service, for NewReflectionRegistry(). See package
+// github.com/stripe/skycfg/grpcreflection for one that uses a gRPC
+// connection.
+type ReflectionClient = impl.ReflectionClient
+
+// NewReflectionRegistry returns a registry for use with WithProtoRegistry()
+// of the types that a gRPC server describes with its reflection service,
+// so that configs can construct request messages for services whose
+// generated code isn't linked into the binary. Descriptors are fetched
+// when a type is first looked up, and cached; each request is cancelled
+// after timeout, unless it's zero.
+func NewReflectionRegistry(client ReflectionClient, timeout time.Duration) unstableProtoRegistry {
+	if client == nil {
+		panic("NewReflectionRegistry: nil client")
+	}
+	return impl.NewReflectionRegistry(client, timeout)
+}
+
+// WithProtoDescriptorSet makes the types in serialized FileDescriptorSets,
+// such as those written by `protoc --descriptor_set_out`, available to
+// configs, so that their schemas don't need generated Go code. It replaces
+// the registry of WithProtoRegistry(); see NewDescriptorSetRegistry().
+//
+// A file may appear in more than one set if its descriptors are the same
+// in each. Load() fails if a set can't be decoded or its files can't be
+// linked.
+func WithProtoDescriptorSet(sets ...[]byte) LoadOption {
+	return fnLoadOption(func(opts *loadOptions) {
+		merged := &descriptorpb.FileDescriptorSet{}
+		seen := make(map[string]*descriptorpb.FileDescriptorProto)
+		for ii, data := range sets {
+			set := &descriptorpb.FileDescriptorSet{}
+			if err := proto.Unmarshal(data, set); err != nil {
+				opts.err = fmt.Errorf("WithProtoDescriptorSet: set %d: %v", ii, err)
+				return
+			}
+			for _, file := range set.GetFile() {
+				if prev, ok := seen[file.GetName()]; ok {
+					if !proto.Equal(prev, file) {
+						opts.err = fmt.Errorf("WithProtoDescriptorSet: set %d: file %q differs from an earlier set", ii, file.GetName())
+						return
+					}
+					continue
+				}
+				seen[file.GetName()] = file
+				merged.File = append(merged.File, file)
+			}
+		}
+		registry, err := impl.NewDescriptorSetRegistry(merged)
+		if err != nil {
+			opts.err = fmt.Errorf("WithProtoDescriptorSet: %v", err)
+			return
+		}
+		opts.protoRegistry = registry
+	})
+}
+
+// WithProtoFiles compiles .proto source files when the config is loaded,
+// and makes their types available to it like WithProtoDescriptorSet(), so
+// that new message types don't need generated Go code. It replaces the
+// registry of WithProtoRegistry() and WithProtoDescriptorSet().
+//
+// The files, and the files they import, are read with the Load's
+// FileReader, resolving each path like a load() of it from the top-level
+// config. Imports that the FileReader can't find, such as the well-known
+// types, are resolved to the files linked into the binary. Load() fails if
+// a file doesn't compile.
+func WithProtoFiles(paths ...string) LoadOption {
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.protoFiles = append(opts.protoFiles, paths...)
+	})
+}
+
+// compileProtoFiles returns a registry of the types in the .proto files of
+// WithProtoFiles().
+func compileProtoFiles(ctx context.Context, filename string, opts *loadOptions) (impl.ProtoRegistry, error) {
+	readFile := func(ctx context.Context, path string) ([]byte, error) {
+		resolved, err := opts.fileReader.Resolve(ctx, path, filename)
+		if err != nil {
+			return nil, err
+		}
+		return opts.fileReader.ReadFile(ctx, resolved)
+	}
+	set, err := impl.CompileProtoFiles(ctx, readFile, opts.protoFiles)
+	if err != nil {
+		return nil, err
+	}
+	return impl.NewDescriptorSetRegistry(set)
+}
+
+// WithSharedSubmessages makes assigning a frozen message to a message
+// field, such as a template defined at the top level of a module, store
+// the frozen message instead of a copy of it. When many outputs are built
+// from the same templates, this saves copying them and the memory that the
+// copies would use.
+//
+// The messages returned by Main() may then have submessages in common with
+// each other, so they mustn't be modified in place. Use proto.Clone() to
+// get a message that can be.
+func WithSharedSubmessages() LoadOption {
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.shareMessages = true
+	})
+}
+
+// WithIsolatedProtoRegistry keeps the Protobuf types of a Load separate from
+// those of other Loads in the same process, such as when one binary
+// evaluates configs for several versions of a schema. Message types that
+// the registry of WithProtoRegistry() or WithProtoDescriptorSet() describes
+// with descriptors are backed by those descriptors, as dynamic messages,
+// even if generated code for a type of the same name is linked into the
+// binary. Other types are resolved as usual, so the option has no effect
+// without a registry that has descriptors.
+//
+// The isolation doesn't extend to the text and binary encodings of
+// google.protobuf.Any values, which resolve their types with those linked
+// into the binary, nor to extensions, for which those linked into the
+// binary take precedence.
+func WithIsolatedProtoRegistry() LoadOption {
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.isolateProtos = true
+	})
+}
+
+// NewAliasProtoRegistry returns a registry for use with WithProtoRegistry()
+// that resolves each full type name in aliases as the name it maps to, and
+// otherwise resolves names like r. A nil r resolves the types linked into
+// the binary.
+//
+// For example, after the message type my.pkg.OldName is renamed to NewName,
+// an alias from "my.pkg.OldName" to "my.pkg.NewName" lets configs that
+// still use proto.package("my.pkg").OldName keep working until they're
+// migrated.
+func NewAliasProtoRegistry(r unstableProtoRegistry, aliases map[string]string) unstableProtoRegistry {
+	return impl.NewAliasProtoRegistry(r, aliases)
+}
+
+// WithLoadFilter restricts which modules a config may load. The filter is
+// called for each load() statement with the module name as written and the
+// path of the loading module; if it returns an error, the load fails. The
+// top-level file passed to Load() isn't filtered.
+func WithLoadFilter(filter func(moduleName, fromPath string) error) LoadOption {
+	if filter == nil {
+		panic("WithLoadFilter: nil filter")
+	}
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.loadFilters = append(opts.loadFilters, filter)
+	})
+}
+
+// A ShadowPolicy controls what happens when a load() statement binds a name
+// that shadows a global builtin (such as `json`), or a name bound by an
+// earlier load() in the same module.
+type ShadowPolicy int
+
+const (
+	// ShadowAllow permits shadowing silently. This is the default.
+	ShadowAllow ShadowPolicy = iota
+	// ShadowWarn logs a warning for each shadowed name.
+	ShadowWarn
+	// ShadowError causes the load to fail.
+	ShadowError
+)
+
+// WithShadowPolicy sets how load() statements that shadow other names are
+// reported. Shadowing is allowed unless this option opts in to warnings or
+// errors.
+func WithShadowPolicy(policy ShadowPolicy) LoadOption {
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.shadowPolicy = policy
+	})
+}
+
+// A ReExportPolicy controls whether a module's importers may load symbols
+// that the module itself loaded from another module, rather than defined.
+// Modules that list such a symbol in their exports always re-export it.
+type ReExportPolicy int
+
+const (
+	// ReExportAllow permits loading any global of a module. This is the
+	// default.
+	ReExportAllow ReExportPolicy = iota
+	// ReExportWarn logs a warning for each load() of a re-exported symbol.
+	ReExportWarn
+	// ReExportError causes the load to fail.
+	ReExportError
+)
+
+// WithReExportPolicy sets how load() statements that import a symbol
+// through a module that didn't define it are reported.
+func WithReExportPolicy(policy ReExportPolicy) LoadOption {
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.reExportPolicy = policy
+	})
+}
+
+// A OneofPolicy controls what happens when a config sets a field of a
+// message while a different member of the same oneof is already set.
+// Passing two members of a oneof to a message constructor is always an
+// error.
+type OneofPolicy int
+
+const (
+	// OneofReplace clears the other member, as in other protobuf
+	// implementations. This is the default.
+	OneofReplace OneofPolicy = iota
+	// OneofError fails the assignment, reporting the field that's
+	// already set. The other member must be cleared with proto.clear()
+	// first.
+	OneofError
+)
+
+// WithOneofPolicy sets how assignments to a oneof that already has a
+// different member set are handled, both while loading and executing the
+// config.
+func WithOneofPolicy(policy OneofPolicy) LoadOption {
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.oneofPolicy = policy
+	})
+}
+
+// WithLenientDecoding makes proto.from_json() and proto.from_yaml() ignore
+// fields that the message type doesn't have, both while loading and
+// executing the config, such as while migrating documents written for
+// another version of a schema. By default they're an error. A call can
+// still choose either mode with `strict`.
+func WithLenientDecoding() LoadOption {
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.lenient = true
+	})
+}
+
 // Load reads a Skycfg config file from the filesystem.
+//
+// A load() statement may pin the content of the module it loads by passing
+// its SHA-256 digest as `_sha256 = "<hex>"`. Load fails, without executing
+// the loaded module, if the content doesn't match.
+//
+// A module may restrict which of its symbols other modules can load by
+// setting the global `exports` to a list of their names.
 func Load(ctx context.Context, filename string, opts ...LoadOption) (*Config, error) {
+	parsedOpts, err := parseLoadOptions(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	return loadParsed(ctx, filename, parsedOpts)
+}
+
+func parseLoadOptions(filename string, opts []LoadOption) (*loadOptions, error) {
 	protoModule := impl.NewProtoModule(nil /* TODO: registry from options */)
 	parsedOpts := &loadOptions{
 		globals: starlark.StringDict{
-			"fail":   starlark.NewBuiltin("fail", skyFail),
-			"hash":   impl.HashModule(),
-			"json":   impl.JsonModule(),
-			"proto":  protoModule,
-			"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
-			"yaml":   impl.YamlModule(),
-			"url":    impl.UrlModule(),
+			"annotate": impl.Annotate(),
+			"fail":     starlark.NewBuiltin("fail", skyFail),
+			"hash":     impl.HashModule(),
+			"json":     impl.JsonModule(),
+			"log":      impl.LogModule(),
+			"proto":    protoModule,
+			"range":    impl.Range(),
+			"struct":   starlark.NewBuiltin("struct", starlarkstruct.Make),
+			"yaml":     impl.YamlModule(),
+			"url":      impl.UrlModule(),
 		},
-		fileReader: LocalFileReader(filepath.Dir(filename)),
+		fileReader:    LocalFileReader(filepath.Dir(filename)),
+		watchInterval: defaultWatchInterval,
+		protoModule:   protoModule,
+		frozen:        impl.NewFrozenValues(),
 	}
 	for _, opt := range opts {
 		opt.applyLoad(parsedOpts)
 	}
-	protoModule.Registry = parsedOpts.protoRegistry
-	configLocals, err := loadImpl(ctx, parsedOpts, filename)
-	if err != nil {
-		return nil, err
+	if parsedOpts.err != nil {
+		return nil, parsedOpts.err
 	}
-	return &Config{
-		filename: filename,
-		globals:  parsedOpts.globals,
-		locals:   configLocals,
-	}, nil
+	return parsedOpts, nil
 }
 
-func loadImpl(ctx context.Context, opts *loadOptions, filename string) (starlark.StringDict, error) {
-	reader := opts.fileReader
-
-	type cacheEntry struct {
-		globals starlark.StringDict
-		err     error
-	}
-	cache := make(map[string]*cacheEntry)
-
-	var load func(thread *starlark.Thread, moduleName string) (starlark.StringDict, error)
-	load = func(thread *starlark.Thread, moduleName string) (starlark.StringDict, error) {
-		var fromPath string
-		if thread.TopFrame() != nil {
-			fromPath = thread.TopFrame().Position().Filename()
+// loadParsed loads a config with options from parseLoadOptions(). The
+// options can't be reused, since loading modifies them.
+func loadParsed(ctx context.Context, filename string, parsedOpts *loadOptions) (*Config, error) {
+	if len(parsedOpts.protoFiles) > 0 {
+		registry, err := compileProtoFiles(ctx, filename, parsedOpts)
+		if err != nil {
+			return nil, &LoadError{Err: fmt.Errorf("WithProtoFiles: %w", err)}
 		}
-		modulePath, err := reader.Resolve(ctx, moduleName, fromPath)
+		parsedOpts.protoRegistry = registry
+	}
+	if parsedOpts.isolateProtos {
+		parsedOpts.protoRegistry = impl.NewIsolatedProtoRegistry(parsedOpts.protoRegistry)
+	}
+	parsedOpts.protoModule.Registry = parsedOpts.protoRegistry
+	for _, enumName := range parsedOpts.protoEnums {
+		values, err := impl.ProtoEnumValues(parsedOpts.protoRegistry, enumName)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("WithGlobalsFromProto: %v", err)
+		}
+		for name, value := range values {
+			parsedOpts.globals[name] = value
 		}
+	}
+	if err := resolveOutputSchema(parsedOpts); err != nil {
+		return nil, &LoadError{Err: err}
+	}
+	if parsedOpts.capabilities != nil {
+		parsedOpts.capabilities.instrumentLoad(filename, parsedOpts)
+	}
+	if parsedOpts.coverage != nil {
+		parsedOpts.coverage.instrumentLoad(filename, parsedOpts)
+	}
+	configLocals, deps, err := loadImpl(ctx, parsedOpts, filename)
+	if err != nil {
+		return nil, err
+	}
+	if parsedOpts.capabilities != nil {
+		parsedOpts.capabilities.recordModules(deps)
+	}
+	return &Config{
+		filename:      filename,
+		globals:       parsedOpts.globals,
+		locals:        configLocals,
+		dependencies:  deps,
+		outputSchema:  parsedOpts.outputSchema,
+		oneofPolicy:   parsedOpts.oneofPolicy,
+		deterministic: parsedOpts.deterministic,
+		lenient:       parsedOpts.lenient,
+		shareMessages: parsedOpts.shareMessages,
+		frozen:        parsedOpts.frozen,
+		protoRegistry: parsedOpts.protoRegistry,
+		fileReader:    parsedOpts.fileReader,
+	}, nil
+}
 
-		e, ok := cache[modulePath]
-		if e != nil {
-			return e.globals, e.err
+// resolveOutputSchema picks the output schema of a Load(): the one set by
+// WithOutputSchema(), or else the one in a verified lockfile, or else the
+// latest. A lockfile being recorded stores the schema.
+func resolveOutputSchema(opts *loadOptions) error {
+	lock := opts.lockfile
+	if lock == nil {
+		if opts.outputSchema == "" {
+			opts.outputSchema = impl.LatestOutputSchema
 		}
-		if ok {
-			return nil, fmt.Errorf("cycle in load graph")
+		return nil
+	}
+	lock.mu.Lock()
+	defer lock.mu.Unlock()
+	if opts.verifyLockfile && lock.OutputSchema != "" {
+		if err := impl.CheckOutputSchema(lock.OutputSchema); err != nil {
+			return fmt.Errorf("lockfile: %v", err)
 		}
-		moduleSource, err := reader.ReadFile(ctx, modulePath)
-		if err != nil {
-			cache[modulePath] = &cacheEntry{nil, err}
-			return nil, err
+		if opts.outputSchema != "" && opts.outputSchema != lock.OutputSchema {
+			return fmt.Errorf("output schema %q doesn't match lockfile (want %q)", opts.outputSchema, lock.OutputSchema)
 		}
-
-		cache[modulePath] = nil
-		globals, err := starlark.ExecFile(thread, modulePath, moduleSource, opts.globals)
-		cache[modulePath] = &cacheEntry{globals, err}
-		return globals, err
+		opts.outputSchema = lock.OutputSchema
+		return nil
 	}
-	return load(&starlark.Thread{
-		Print: skyPrint,
-		Load:  load,
-	}, filename)
+	if opts.outputSchema == "" {
+		opts.outputSchema = impl.LatestOutputSchema
+	}
+	if !opts.verifyLockfile {
+		lock.OutputSchema = opts.outputSchema
+	}
+	return nil
+}
+
+// OutputSchema returns the name of the output schema the config was loaded
+// with. See WithOutputSchema().
+func (c *Config) OutputSchema() string {
+	return c.outputSchema
 }
 
 // Filename returns the original filename passed to Load().
@@ -240,6 +854,30 @@ func (c *Config) Locals() starlark.StringDict {
 	return c.locals
 }
 
+// Dependencies returns the edges of the config's load graph, sorted by the
+// path of the loading module and then by module name. The first edge is
+// always the top-level module, which has an empty From.
+func (c *Config) Dependencies() []Dependency {
+	return c.dependencies
+}
+
+// Modules returns the modules that were read while loading the config,
+// including the config file itself, sorted by path. Builtin modules
+// registered with WithModule() aren't included.
+func (c *Config) Modules() []Module {
+	seen := make(map[string]bool)
+	var modules []Module
+	for _, dep := range c.dependencies {
+		if seen[dep.Path] {
+			continue
+		}
+		seen[dep.Path] = true
+		modules = append(modules, Module{Path: dep.Path, Hash: dep.Hash})
+	}
+	sort.Slice(modules, func(i, j int) bool { return modules[i].Path < modules[j].Path })
+	return modules
+}
+
 // An ExecOption adjusts details of how a Skycfg config's main function is
 // executed.
 type ExecOption interface {
@@ -247,7 +885,54 @@ type ExecOption interface {
 }
 
 type execOptions struct {
-	vars *starlark.Dict
+	vars      *starlark.Dict
+	ctxAttrs  starlark.StringDict
+	liveState impl.LiveStateFunc
+	logger    impl.LogFunc
+	handler   MessageHandler
+	err       error
+
+	maxVarSize     int
+	maxMessageSize int
+
+	// wrapVars, if set, replaces the ctx.vars dict with a view of it.
+	wrapVars func(*starlark.Dict) starlark.Value
+
+	// granted holds the capabilities of WithRestrictedGlobals() that the
+	// execution may use.
+	granted map[string]bool
+
+	// partialResults, if set, records the errors of ctx.isolate() calls
+	// rather than stopping execution.
+	partialResults bool
+
+	// placeholders, if set, expands the placeholders in the messages that
+	// main() produces.
+	placeholders *placeholderExpander
+
+	// validateRules checks the messages that main() produces against the
+	// standard validation rules declared in their schema.
+	validateRules bool
+
+	// deterministic sorts map entries when messages are encoded.
+	deterministic bool
+
+	// shareMessages shares frozen submessages instead of copying them, as
+	// set by WithSharedSubmessages() when the config was loaded.
+	shareMessages bool
+
+	// protoRegistry is the registry the config was loaded with, which
+	// resolves the types of Any values encoded as JSON.
+	protoRegistry impl.ProtoRegistry
+
+	// outputSchema, oneofPolicy, and lenient are those the config was
+	// loaded with, as set by WithOutputSchema(), WithOneofPolicy(), and
+	// WithLenientDecoding().
+	outputSchema string
+	oneofPolicy  OneofPolicy
+	lenient      bool
+
+	capabilities *CapabilityRecorder
 }
 
 type fnExecOption func(*execOptions)
@@ -258,61 +943,357 @@ func (fn fnExecOption) applyExec(opts *execOptions) { fn(opts) }
 func WithVars(vars starlark.StringDict) ExecOption {
 	return fnExecOption(func(opts *execOptions) {
 		for key, value := range vars {
-			opts.vars.SetKey(starlark.String(key), value)
+			opts.vars.SetKey(starlark.String(key), impl.WrapRange(value))
+		}
+	})
+}
+
+// WithVarsFromGo adds key:value pairs to the ctx.vars dict passed to main(),
+// converting nested Go maps, slices, and structs to Starlark dicts and lists.
+// Struct fields are named according to their `json` tags, if present.
+func WithVarsFromGo(vars map[string]interface{}) ExecOption {
+	return fnExecOption(func(opts *execOptions) {
+		for key, value := range vars {
+			skyValue, err := impl.ValueFromGo(value)
+			if err != nil {
+				opts.err = fmt.Errorf("WithVarsFromGo: ctx.vars[%q]: %v", key, err)
+				return
+			}
+			opts.vars.SetKey(starlark.String(key), skyValue)
+		}
+	})
+}
+
+// WithProtoVars adds Protobuf messages to the ctx.vars dict passed to
+// main(), such as the live state of the objects a config renders, so that
+// it can reconcile against them. The messages are copied and frozen, so
+// the config can read them but not modify them.
+func WithProtoVars(vars map[string]proto.Message) ExecOption {
+	return fnExecOption(func(opts *execOptions) {
+		for key, msg := range vars {
+			if msg == nil {
+				opts.err = fmt.Errorf("WithProtoVars: ctx.vars[%q]: nil message", key)
+				return
+			}
+			skyValue := NewProtoMessage(proto.Clone(msg))
+			skyValue.Freeze()
+			opts.vars.SetKey(starlark.String(key), skyValue)
+		}
+	})
+}
+
+// WithCtxAttrs adds attributes to the ctx value passed to main(), for
+// capabilities scoped to a single execution such as a per-request client.
+// The "vars", "log", "emit", "isolate", "fixtures", and "test" attributes
+// are reserved.
+func WithCtxAttrs(attrs starlark.StringDict) ExecOption {
+	return fnExecOption(func(opts *execOptions) {
+		for key, value := range attrs {
+			if key == "vars" || key == "log" || key == "emit" || key == "isolate" || key == "fixtures" || key == "test" {
+				opts.err = fmt.Errorf("WithCtxAttrs: ctx.%s is reserved", key)
+				return
+			}
+			opts.ctxAttrs[key] = impl.WrapRange(impl.RecoverPanics(value))
+		}
+	})
+}
+
+// GrantCapabilities lets main() call the builtins of the globals added
+// with WithRestrictedGlobals() of the given names. Tests are granted
+// capabilities separately, by passing this option to WithTestExecOptions(),
+// so that tests can be given conveniences that main() isn't.
+func GrantCapabilities(names ...string) ExecOption {
+	return fnExecOption(func(opts *execOptions) {
+		if opts.granted == nil {
+			opts.granted = make(map[string]bool)
+		}
+		for _, name := range names {
+			opts.granted[name] = true
+		}
+	})
+}
+
+// A LiveStateGetter fetches the current state of a rendered object from a
+// live system, such as a Kubernetes API server. It should return (nil, nil)
+// if the object doesn't exist.
+type LiveStateGetter func(ctx context.Context, msg proto.Message) (proto.Message, error)
+
+// WithLiveStateGetter adds ctx.assert_live() to the context passed to main(),
+// which fails if a rendered message has drifted from its live counterpart.
+func WithLiveStateGetter(getter LiveStateGetter) ExecOption {
+	if getter == nil {
+		panic("WithLiveStateGetter: nil getter")
+	}
+	return fnExecOption(func(opts *execOptions) {
+		opts.liveState = impl.LiveStateFunc(getter)
+	})
+}
+
+// A MessageHandler receives messages produced by a config as they're
+// converted, along with any annotations attached with annotate(). Returning
+// an error stops execution.
+type MessageHandler func(msg proto.Message, annotations map[string]string) error
+
+// WithMessageHandler streams the messages produced by main() to handler,
+// instead of collecting them in the ExecResult. Messages passed to
+// ctx.emit() are handled immediately, so main() can produce large outputs
+// without building a list, and the handler can apply backpressure by
+// blocking. Messages in the list returned by main() are handled afterwards,
+// and released from the list as they're handled so they can be garbage
+// collected.
+func WithMessageHandler(handler MessageHandler) ExecOption {
+	return fnExecOption(func(opts *execOptions) {
+		if handler == nil {
+			opts.err = fmt.Errorf("WithMessageHandler: nil handler")
+			return
 		}
+		opts.handler = handler
+	})
+}
+
+// WithStandardValidationRules checks each message produced by main()
+// against the standard validation rules declared in its schema with
+// protovalidate or protoc-gen-validate, failing with a ValidationError that
+// wraps a *RuleError if any are broken. Configs can check messages
+// themselves with proto.validate().
+//
+// Rules are read from the field, oneof, and message options, so the rule
+// schemas needn't be linked into the binary. The rules that are checked are
+// those of scalar, string, bytes, enum, repeated, and map fields, including
+// the well-known string formats such as email, and required fields and
+// oneofs. Other rules are skipped: CEL expressions, the rules of well-known
+// types such as google.protobuf.Duration, well_known_regex, and the
+// uniqueness of repeated messages. Use protovalidate itself to enforce them.
+func WithStandardValidationRules() ExecOption {
+	return fnExecOption(func(opts *execOptions) {
+		opts.validateRules = true
 	})
 }
 
 // Main executes main() from the top-level Skycfg config module, which is
 // expected to return either None or a list of Protobuf messages.
+//
+// With WithPartialResults(), Main may return messages along with a
+// *PartialError.
 func (c *Config) Main(ctx context.Context, opts ...ExecOption) ([]proto.Message, error) {
-	parsedOpts := &execOptions{
-		vars: &starlark.Dict{},
+	result, err := c.Exec(ctx, opts...)
+	if result == nil {
+		return nil, err
 	}
-	for _, opt := range opts {
-		opt.applyExec(parsedOpts)
+	return result.Messages, err
+}
+
+// ExecResult holds the output of a config's main function.
+type ExecResult struct {
+	Messages []proto.Message
+
+	// Annotations[i] holds the metadata attached to Messages[i] with
+	// annotate(), or nil if it wasn't annotated.
+	Annotations []map[string]string
+}
+
+// Exec executes main() like Main, and also returns the annotations that
+// were attached to each message.
+//
+// main() may also pass messages to ctx.emit(), in which case they precede
+// the messages it returns.
+func (c *Config) Exec(ctx context.Context, opts ...ExecOption) (*ExecResult, error) {
+	parsedOpts, err := parseExecOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	main, err := c.mainFunc()
+	if err != nil {
+		return nil, err
 	}
+	return c.newExecState(parsedOpts).run(ctx, main)
+}
+
+// mainFunc returns the config's main() function.
+func (c *Config) mainFunc() (starlark.Callable, error) {
 	mainVal, ok := c.locals["main"]
 	if !ok {
-		return nil, fmt.Errorf("no `main' function found in %q", c.filename)
+		return nil, &ValidationError{Err: fmt.Errorf("no `main' function found in %q", c.filename)}
 	}
 	main, ok := mainVal.(starlark.Callable)
 	if !ok {
-		return nil, fmt.Errorf("`main' must be a function (got a %s)", mainVal.Type())
+		return nil, &ValidationError{Err: fmt.Errorf("`main' must be a function (got a %s)", mainVal.Type())}
 	}
+	return main, nil
+}
 
-	thread := &starlark.Thread{
-		Print: skyPrint,
+// An execState holds what's needed to call main(), which can be reused by
+// later calls with the same options.
+type execState struct {
+	config  *Config
+	opts    *execOptions
+	thread  *starlark.Thread
+	mainCtx *impl.Module
+
+	// result collects the messages of the current call, and isolated the
+	// errors of its ctx.isolate() calls.
+	result   *ExecResult
+	isolated []*IsolatedError
+}
+
+func (c *Config) newExecState(opts *execOptions) *execState {
+	opts.deterministic = opts.deterministic || c.deterministic
+	opts.shareMessages = c.shareMessages
+	opts.protoRegistry = c.protoRegistry
+	opts.outputSchema = c.outputSchema
+	opts.oneofPolicy = c.oneofPolicy
+	opts.lenient = c.lenient
+	s := &execState{
+		config:  c,
+		opts:    opts,
+		thread:  newExecThread(context.Background(), opts),
+		mainCtx: newCtxModule(opts),
 	}
-	thread.SetLocal("context", ctx)
-	mainCtx := &impl.Module{
-		Name: "skycfg_ctx",
-		Attrs: starlark.StringDict(map[string]starlark.Value{
-			"vars": parsedOpts.vars,
-		}),
+	s.mainCtx.Attrs["emit"] = starlark.NewBuiltin("ctx.emit", func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var val starlark.Value
+		if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &val); err != nil {
+			return nil, err
+		}
+		if _, ok := AsProtoMessage(val); !ok {
+			return nil, fmt.Errorf("%s: for parameter 1: got %s, want proto.Message", fn.Name(), val.Type())
+		}
+		return starlark.None, s.emit(val)
+	})
+	s.mainCtx.Attrs["isolate"] = starlark.NewBuiltin("ctx.isolate", s.isolate)
+	return s
+}
+
+func (s *execState) emit(val starlark.Value) error {
+	msg, ok := AsProtoMessage(val)
+	if !ok {
+		return &ValidationError{Err: fmt.Errorf("`main' returned something that's not a protobuf (a %s)", val.Type())}
 	}
-	args := starlark.Tuple([]starlark.Value{mainCtx})
-	mainVal, err := starlark.Call(thread, main, args, nil)
+	msg, err := expandPlaceholders(s.opts, msg)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if err := checkMessageSize(s.opts, msg); err != nil {
+		return err
+	}
+	if s.opts.validateRules {
+		if err := impl.ValidateProtoMessage(msg, val); err != nil {
+			return &ValidationError{Err: err}
+		}
+	}
+	annotations := impl.MessageAnnotations(val)
+	if s.opts.handler != nil {
+		return s.opts.handler(msg, annotations)
+	}
+	s.result.Messages = append(s.result.Messages, msg)
+	s.result.Annotations = append(s.result.Annotations, annotations)
+	return nil
+}
+
+// run calls main() with the state's options.
+func (s *execState) run(ctx context.Context, main starlark.Callable) (*ExecResult, error) {
+	impl.SetContext(s.thread, ctx)
+	s.result = &ExecResult{}
+	s.isolated = nil
+	defer func() { s.result, s.isolated = nil, nil }()
+	mainVal, err := starlark.Call(s.thread, main, starlark.Tuple{s.mainCtx}, nil)
+	if impl.Interrupted(s.thread) {
+		return nil, &TimeoutError{Err: fmt.Errorf("main: %w", ctx.Err())}
+	}
+	if err != nil {
+		err = recoverFieldError(s.thread, impl.AddFrozenErrorHint(err, s.config.frozen), func(path string) []byte {
+			return s.config.moduleSource(ctx, path)
+		})
+		return nil, &ExecError{Err: err}
 	}
 	mainList, ok := mainVal.(*starlark.List)
 	if !ok {
 		if _, isNone := mainVal.(starlark.NoneType); isNone {
-			return nil, nil
+			return s.partialResult()
 		}
-		return nil, fmt.Errorf("`main' didn't return a list (got a %s)", mainVal.Type())
+		return nil, &ValidationError{Err: fmt.Errorf("`main' didn't return a list (got a %s)", mainVal.Type())}
 	}
-	var msgs []proto.Message
+	// Frozen lists can't be released, but they're also kept alive by the
+	// module that defined them.
+	release := s.opts.handler != nil && mainList.Len() > 0 && mainList.SetIndex(0, mainList.Index(0)) == nil
 	for ii := 0; ii < mainList.Len(); ii++ {
-		maybeMsg := mainList.Index(ii)
-		msg, ok := AsProtoMessage(maybeMsg)
-		if !ok {
-			return nil, fmt.Errorf("`main' returned something that's not a protobuf (a %s)", maybeMsg.Type())
+		if err := s.emit(mainList.Index(ii)); err != nil {
+			return nil, err
+		}
+		if release {
+			if err := mainList.SetIndex(ii, starlark.None); err != nil {
+				return nil, &ExecError{Err: err}
+			}
 		}
-		msgs = append(msgs, msg)
 	}
-	return msgs, nil
+	return s.partialResult()
+}
+
+// partialResult returns the result of a call that ran to completion, with
+// a *PartialError if any of its isolated parts failed.
+func (s *execState) partialResult() (*ExecResult, error) {
+	if len(s.isolated) > 0 {
+		return s.result, &PartialError{Errs: s.isolated}
+	}
+	return s.result, nil
+}
+
+func parseExecOptions(opts []ExecOption) (*execOptions, error) {
+	parsedOpts := &execOptions{
+		vars:     &starlark.Dict{},
+		ctxAttrs: make(starlark.StringDict),
+	}
+	for _, opt := range opts {
+		opt.applyExec(parsedOpts)
+	}
+	if parsedOpts.err != nil {
+		return nil, parsedOpts.err
+	}
+	return parsedOpts, checkVarSizes(parsedOpts)
+}
+
+func newExecThread(ctx context.Context, opts *execOptions) *starlark.Thread {
+	thread := &starlark.Thread{
+		Print: skyPrint,
+	}
+	impl.SetContext(thread, ctx)
+	thread.SetLocal("capabilities", opts.granted)
+	impl.SetOutputSchema(thread, opts.outputSchema)
+	impl.SetStrictOneofs(thread, opts.oneofPolicy == OneofError)
+	impl.SetDeterministic(thread, opts.deterministic)
+	impl.SetShareSubmessages(thread, opts.shareMessages)
+	impl.SetProtoRegistry(thread, opts.protoRegistry)
+	impl.SetLenientDecoding(thread, opts.lenient)
+	impl.RecordFieldErrors(thread)
+	if opts.logger != nil {
+		impl.SetLogger(thread, opts.logger)
+	}
+	return thread
+}
+
+// newCtxModule returns the ctx value passed to main() and tests, without
+// the attributes specific to either.
+func newCtxModule(opts *execOptions) *impl.Module {
+	var vars starlark.Value = opts.vars
+	if opts.wrapVars != nil {
+		vars = opts.wrapVars(opts.vars)
+	}
+	ctxModule := &impl.Module{
+		Name: "skycfg_ctx",
+		Attrs: starlark.StringDict(map[string]starlark.Value{
+			"vars": vars,
+			"log":  impl.LogModule(),
+		}),
+	}
+	if opts.liveState != nil {
+		ctxModule.Attrs["assert_live"] = impl.AssertLive(opts.liveState)
+	}
+	for key, value := range opts.ctxAttrs {
+		ctxModule.Attrs[key] = value
+	}
+	if opts.capabilities != nil {
+		opts.capabilities.instrumentCtx(ctxModule)
+	}
+	return ctxModule
 }
 
 func skyPrint(t *starlark.Thread, msg string) {
@@ -0,0 +1,310 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/syntax"
+)
+
+// A Symbol is a top-level name defined by a module, which other modules
+// may load. Module is the path of the defining module, as resolved by the
+// FileReader.
+type Symbol struct {
+	Module string
+	Name   string
+	Pos    syntax.Position
+}
+
+// A SymbolUse is a reference to a Symbol from another module. Name is the
+// name the symbol is bound to in that module, which differs from the
+// symbol's own name if it was renamed by load().
+type SymbolUse struct {
+	Module string
+	Name   string
+	Pos    syntax.Position
+
+	// Load is true for the load() binding itself, and false for references
+	// to the bound name.
+	Load bool
+}
+
+// A SymbolIndex records where each symbol of a set of modules is used.
+type SymbolIndex struct {
+	symbols []Symbol
+	uses    map[symbolKey][]SymbolUse
+}
+
+type symbolKey struct {
+	module, name string
+}
+
+// Symbols returns every symbol that may be loaded from an indexed module,
+// sorted by module path and then by name. Symbols that a module only
+// re-exports are attributed to the module that defines them.
+func (idx *SymbolIndex) Symbols() []Symbol {
+	return idx.symbols
+}
+
+// Uses returns the uses of a symbol, sorted by module path and position.
+// Uses through a module that re-exports the symbol are included.
+func (idx *SymbolIndex) Uses(modulePath, name string) []SymbolUse {
+	return idx.uses[symbolKey{modulePath, name}]
+}
+
+// IndexSymbols reads the modules at filenames, and every module they load,
+// and returns an index of where each symbol is used. Modules are read
+// through the FileReader in opts, which defaults to a LocalFileReader for
+// the directory of the first filename, but they aren't executed. Options
+// are parsed as by Load, so an invalid option is an error.
+//
+// Uses are found syntactically: a reference counts if it resolves to the
+// module-level name bound by load(), so locals that shadow it are ignored,
+// but uses of a value after it has been passed elsewhere are not tracked.
+func IndexSymbols(ctx context.Context, filenames []string, opts ...LoadOption) (*SymbolIndex, error) {
+	var first string
+	if len(filenames) > 0 {
+		first = filenames[0]
+	}
+	parsedOpts, err := parseLoadOptions(first, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	modules := make(map[string]*indexedModule)
+	var queue []string
+	for _, filename := range filenames {
+		modulePath, err := parsedOpts.fileReader.Resolve(ctx, filename, "")
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := modules[modulePath]; !ok {
+			modules[modulePath] = nil
+			queue = append(queue, modulePath)
+		}
+	}
+	for len(queue) > 0 {
+		modulePath := queue[0]
+		queue = queue[1:]
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		module, err := indexModule(ctx, parsedOpts.fileReader, modulePath)
+		if err != nil {
+			return nil, err
+		}
+		modules[modulePath] = module
+		for _, load := range module.loads {
+			if _, ok := modules[load.from.module]; !ok {
+				modules[load.from.module] = nil
+				queue = append(queue, load.from.module)
+			}
+		}
+	}
+
+	idx := &SymbolIndex{uses: make(map[symbolKey][]SymbolUse)}
+	for modulePath, module := range modules {
+		for name, pos := range module.defs {
+			if module.exported(name) {
+				idx.symbols = append(idx.symbols, Symbol{Module: modulePath, Name: name, Pos: pos})
+			}
+		}
+		for _, load := range module.loads {
+			origin, err := originOf(modules, load.from, nil)
+			if err != nil {
+				return nil, err
+			}
+			uses := append(idx.uses[origin], SymbolUse{
+				Module: modulePath,
+				Name:   load.to,
+				Pos:    load.pos,
+				Load:   true,
+			})
+			for _, pos := range module.refs[load.to] {
+				uses = append(uses, SymbolUse{Module: modulePath, Name: load.to, Pos: pos})
+			}
+			idx.uses[origin] = uses
+		}
+	}
+	sort.Slice(idx.symbols, func(i, j int) bool {
+		a, b := idx.symbols[i], idx.symbols[j]
+		if a.Module != b.Module {
+			return a.Module < b.Module
+		}
+		return a.Name < b.Name
+	})
+	for _, uses := range idx.uses {
+		sort.Slice(uses, func(i, j int) bool {
+			a, b := uses[i], uses[j]
+			if a.Module != b.Module {
+				return a.Module < b.Module
+			}
+			return a.Pos.Line < b.Pos.Line || (a.Pos.Line == b.Pos.Line && a.Pos.Col < b.Pos.Col)
+		})
+	}
+	return idx, nil
+}
+
+type indexedModule struct {
+	defs    map[string]syntax.Position   // names defined in the module
+	loads   []indexedLoad                // names bound by load()
+	refs    map[string][]syntax.Position // references to module-level names
+	exports map[string]bool              // nil if the module exports everything
+}
+
+type indexedLoad struct {
+	from symbolKey // the loaded module's resolved path, and the name in it
+	to   string
+	pos  syntax.Position
+}
+
+func (m *indexedModule) exported(name string) bool {
+	if m.exports != nil {
+		return m.exports[name]
+	}
+	return name != exportsGlobal && !strings.HasPrefix(name, "_")
+}
+
+// indexModule parses a module and resolves its identifiers, without
+// executing it.
+func indexModule(ctx context.Context, reader FileReader, modulePath string) (*indexedModule, error) {
+	source, err := reader.ReadFile(ctx, modulePath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := syntax.Parse(modulePath, source, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, stripped, err := stripLoadPins(source, f); err != nil {
+		return nil, err
+	} else if f, err = syntax.Parse(modulePath, stripped, 0); err != nil {
+		return nil, err
+	}
+	// Predeclared names depend on the options the module is loaded with,
+	// so any name that isn't bound by the module is assumed to exist.
+	isPredeclared := func(string) bool { return true }
+	isUniversal := func(string) bool { return false }
+	if err := resolve.File(f, isPredeclared, isUniversal); err != nil {
+		return nil, err
+	}
+
+	module := &indexedModule{
+		defs: make(map[string]syntax.Position),
+		refs: make(map[string][]syntax.Position),
+	}
+	bindings := make(map[*syntax.Ident]bool)
+	for _, stmt := range f.Stmts {
+		load, ok := stmt.(*syntax.LoadStmt)
+		if !ok {
+			continue
+		}
+		moduleName := load.Module.Value.(string)
+		if strings.HasPrefix(moduleName, builtinModulePrefix) {
+			continue
+		}
+		depPath, err := reader.Resolve(ctx, moduleName, modulePath)
+		if err != nil {
+			return nil, err
+		}
+		for ii, to := range load.To {
+			bindings[to] = true
+			module.loads = append(module.loads, indexedLoad{
+				from: symbolKey{depPath, load.From[ii].Name},
+				to:   to.Name,
+				pos:  to.NamePos,
+			})
+		}
+	}
+	loaded := make(map[string]bool)
+	for _, load := range module.loads {
+		loaded[load.to] = true
+	}
+	for _, global := range f.Globals {
+		if !bindings[global] && !loaded[global.Name] {
+			module.defs[global.Name] = global.NamePos
+		}
+	}
+	syntax.Walk(f, func(n syntax.Node) bool {
+		id, ok := n.(*syntax.Ident)
+		if ok && !bindings[id] && resolve.Scope(id.Scope) == resolve.Global {
+			module.refs[id.Name] = append(module.refs[id.Name], id.NamePos)
+		}
+		return true
+	})
+	module.exports = staticExports(f)
+	return module, nil
+}
+
+// staticExports returns the names in a module's exports list, if it's
+// assigned a list literal of strings at the top level.
+func staticExports(f *syntax.File) map[string]bool {
+	for _, stmt := range f.Stmts {
+		assign, ok := stmt.(*syntax.AssignStmt)
+		if !ok || assign.Op != syntax.EQ {
+			continue
+		}
+		lhs, ok := assign.LHS.(*syntax.Ident)
+		if !ok || lhs.Name != exportsGlobal {
+			continue
+		}
+		list, ok := assign.RHS.(*syntax.ListExpr)
+		if !ok {
+			return nil
+		}
+		exports := make(map[string]bool)
+		for _, elem := range list.List {
+			lit, ok := elem.(*syntax.Literal)
+			if !ok || lit.Token != syntax.STRING {
+				return nil
+			}
+			exports[lit.Value.(string)] = true
+		}
+		return exports
+	}
+	return nil
+}
+
+// originOf follows a loaded name through modules that re-export it, and
+// returns the module and name of its definition.
+func originOf(modules map[string]*indexedModule, key symbolKey, seen map[symbolKey]bool) (symbolKey, error) {
+	module := modules[key.module]
+	if _, ok := module.defs[key.name]; ok {
+		return key, nil
+	}
+	for _, load := range module.loads {
+		if load.to != key.name {
+			continue
+		}
+		if seen[key] {
+			return symbolKey{}, fmt.Errorf("%s: cycle re-exporting %s", key.module, key.name)
+		}
+		if seen == nil {
+			seen = make(map[symbolKey]bool)
+		}
+		seen[key] = true
+		return originOf(modules, load.from, seen)
+	}
+	// Not defined by the module; attribute uses to the name as loaded, so
+	// they're still found.
+	return key, nil
+}
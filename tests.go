@@ -0,0 +1,255 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+
+	impl "github.com/stripe/skycfg/internal/go/skycfg"
+)
+
+// A Test is a function in a config's top-level module whose name starts
+// with "test_". It's called with a ctx value like the one passed to main(),
+// and passes if it returns without an error. Tests can also save artifacts
+// for debugging with ctx.test.output_file(name).write(content).
+type Test struct {
+	name          string
+	callable      starlark.Callable
+	outputSchema  string
+	oneofPolicy   OneofPolicy
+	deterministic bool
+	lenient       bool
+	shareMessages bool
+	frozen        *impl.FrozenValues
+	protoRegistry impl.ProtoRegistry
+}
+
+// Name returns the name of the test function.
+func (t *Test) Name() string {
+	return t.name
+}
+
+// Tests returns the tests defined in the config's top-level module, sorted
+// by name.
+func (c *Config) Tests() []*Test {
+	var tests []*Test
+	for name, val := range c.locals {
+		if !strings.HasPrefix(name, "test_") {
+			continue
+		}
+		if callable, ok := val.(starlark.Callable); ok {
+			tests = append(tests, &Test{name: name, callable: callable, outputSchema: c.outputSchema, oneofPolicy: c.oneofPolicy, deterministic: c.deterministic, lenient: c.lenient, shareMessages: c.shareMessages, frozen: c.frozen, protoRegistry: c.protoRegistry})
+		}
+	}
+	sort.Slice(tests, func(i, j int) bool { return tests[i].name < tests[j].name })
+	return tests
+}
+
+// A TestOption adjusts details of how a Test is run.
+type TestOption interface {
+	applyTest(*testOptions)
+}
+
+type testOptions struct {
+	execOpts     []ExecOption
+	fixtures     map[string]proto.Message
+	artifactsDir string
+}
+
+type fnTestOption func(*testOptions)
+
+func (fn fnTestOption) applyTest(opts *testOptions) { fn(opts) }
+
+// WithTestExecOptions sets options for the ctx value passed to the test,
+// such as its vars, in the same way they're set for main().
+func WithTestExecOptions(opts ...ExecOption) TestOption {
+	return fnTestOption(func(parsed *testOptions) {
+		parsed.execOpts = append(parsed.execOpts, opts...)
+	})
+}
+
+// WithFixtures registers messages that tests can retrieve by name with
+// ctx.fixtures("name"), so they can run against realistic inputs without
+// constructing them in Starlark. Each call to ctx.fixtures() returns a new
+// copy of the message.
+func WithFixtures(fixtures map[string]proto.Message) TestOption {
+	for name, msg := range fixtures {
+		if msg == nil {
+			panic(fmt.Sprintf("WithFixtures: nil message for fixture %q", name))
+		}
+	}
+	return fnTestOption(func(opts *testOptions) {
+		if opts.fixtures == nil {
+			opts.fixtures = make(map[string]proto.Message)
+		}
+		for name, msg := range fixtures {
+			opts.fixtures[name] = msg
+		}
+	})
+}
+
+// WithArtifactsDir sets a directory to write the test's artifacts to, so
+// they can be inspected after a failure in CI. Each test's artifacts are
+// written to a subdirectory named after the test, whether or not it passed.
+func WithArtifactsDir(dir string) TestOption {
+	if dir == "" {
+		panic("WithArtifactsDir: empty directory")
+	}
+	return fnTestOption(func(opts *testOptions) {
+		opts.artifactsDir = dir
+	})
+}
+
+// A TestResult is the outcome of running a Test. Failure is nil if the test
+// passed.
+//
+// Artifacts holds the contents of the files the test wrote with
+// ctx.test.output_file(name), such as rendered manifests or diffs, keyed
+// by name.
+type TestResult struct {
+	TestName  string
+	Failure   error
+	Duration  time.Duration
+	Artifacts map[string][]byte
+}
+
+// Run calls the test function. Errors raised by the test are reported in
+// the result's Failure; the returned error is non-nil only if the test
+// couldn't be run.
+func (t *Test) Run(ctx context.Context, opts ...TestOption) (*TestResult, error) {
+	parsedOpts := &testOptions{}
+	for _, opt := range opts {
+		opt.applyTest(parsedOpts)
+	}
+	execOpts, err := parseExecOptions(parsedOpts.execOpts)
+	if err != nil {
+		return nil, err
+	}
+	execOpts.deterministic = execOpts.deterministic || t.deterministic
+	execOpts.shareMessages = t.shareMessages
+	execOpts.protoRegistry = t.protoRegistry
+	execOpts.outputSchema = t.outputSchema
+	execOpts.oneofPolicy = t.oneofPolicy
+	execOpts.lenient = t.lenient
+	thread := newExecThread(ctx, execOpts)
+	testCtx := newCtxModule(execOpts)
+	testCtx.Attrs["fixtures"] = starlark.NewBuiltin("ctx.fixtures", func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var name string
+		if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &name); err != nil {
+			return nil, err
+		}
+		msg, ok := parsedOpts.fixtures[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: no fixture named %q", fn.Name(), name)
+		}
+		return impl.NewSkyProtoMessage(proto.Clone(msg)), nil
+	})
+	artifacts := make(map[string]*bytes.Buffer)
+	testCtx.Attrs["test"] = &impl.Module{
+		Name: "skycfg_test",
+		Attrs: starlark.StringDict{
+			"output_file": starlark.NewBuiltin("ctx.test.output_file", func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				var name string
+				if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &name); err != nil {
+					return nil, err
+				}
+				if !filepath.IsLocal(name) || filepath.Base(name) != name {
+					return nil, fmt.Errorf("%s: invalid file name %q", fn.Name(), name)
+				}
+				buf, ok := artifacts[name]
+				if !ok {
+					buf = new(bytes.Buffer)
+					artifacts[name] = buf
+				}
+				return newTestOutputFile(name, buf), nil
+			}),
+		},
+	}
+
+	start := time.Now()
+	_, err = starlark.Call(thread, t.callable, starlark.Tuple{testCtx}, nil)
+	if impl.Interrupted(thread) {
+		return nil, &TimeoutError{Err: fmt.Errorf("%s: %w", t.name, ctx.Err())}
+	}
+	result := &TestResult{
+		TestName: t.name,
+		Failure:  impl.AddFrozenErrorHint(err, t.frozen),
+		Duration: time.Since(start),
+	}
+	if len(artifacts) > 0 {
+		result.Artifacts = make(map[string][]byte, len(artifacts))
+		for name, buf := range artifacts {
+			result.Artifacts[name] = buf.Bytes()
+		}
+	}
+	if parsedOpts.artifactsDir != "" {
+		if err := writeArtifacts(filepath.Join(parsedOpts.artifactsDir, t.name), result.Artifacts); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// newTestOutputFile returns the value of ctx.test.output_file(name), whose
+// write() method appends a string to the file's contents.
+func newTestOutputFile(name string, buf *bytes.Buffer) *impl.Module {
+	return &impl.Module{
+		Name: "skycfg_test_output_file",
+		Attrs: starlark.StringDict{
+			"name": starlark.String(name),
+			"write": starlark.NewBuiltin("write", func(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				var data string
+				if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &data); err != nil {
+					return nil, err
+				}
+				buf.WriteString(data)
+				return starlark.None, nil
+			}),
+		},
+	}
+}
+
+// writeArtifacts writes a test's artifacts to dir, replacing any that were
+// written by an earlier run of the test.
+func writeArtifacts(dir string, artifacts map[string][]byte) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if len(artifacts) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, data := range artifacts {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+
+	impl "github.com/stripe/skycfg/internal/go/skycfg"
+)
+
+// A VarUsage describes how a config reads one key of ctx.vars.
+type VarUsage = impl.VarUsage
+
+// A VarsReport lists the keys of ctx.vars that a config's main() reads.
+type VarsReport struct {
+	Filename string
+	Vars     []VarUsage
+
+	// Iterated is true if main() iterated over ctx.vars, in which case it
+	// may depend on keys that aren't listed.
+	Iterated bool
+}
+
+// VarsUsage executes main() with the given options, recording every key of
+// ctx.vars that it reads. Only the code paths taken with these vars are
+// recorded, so it may be worth running it with several sets of vars and
+// merging the reports.
+//
+// If main() fails, VarsUsage returns the keys read before the failure along
+// with the error. This is typically because it requires a var that wasn't
+// set.
+func (c *Config) VarsUsage(ctx context.Context, opts ...ExecOption) (*VarsReport, error) {
+	var recorder *impl.VarsRecorder
+	record := fnExecOption(func(opts *execOptions) {
+		opts.handler = func(msg proto.Message, annotations map[string]string) error { return nil }
+		opts.wrapVars = func(vars *starlark.Dict) starlark.Value {
+			recorder = impl.NewVarsRecorder(vars)
+			return recorder
+		}
+	})
+	_, err := c.Exec(ctx, append(opts, record)...)
+	if recorder == nil {
+		return nil, err
+	}
+	report := &VarsReport{
+		Filename: c.filename,
+		Iterated: recorder.Iterated(),
+	}
+	report.Vars = recorder.Usages()
+	return report, err
+}
+
+// Merge adds the vars of another report of the same config, for example
+// one recorded with different vars.
+func (r *VarsReport) Merge(other *VarsReport) {
+	index := make(map[string]int, len(r.Vars))
+	for ii, usage := range r.Vars {
+		index[usage.Name] = ii
+	}
+	for _, usage := range other.Vars {
+		ii, ok := index[usage.Name]
+		if !ok {
+			index[usage.Name] = len(r.Vars)
+			r.Vars = append(r.Vars, usage)
+			continue
+		}
+		merged := &r.Vars[ii]
+		merged.Types = mergeStrings(merged.Types, usage.Types)
+		merged.Defaults = mergeStrings(merged.Defaults, usage.Defaults)
+		merged.Required = merged.Required || usage.Required
+		merged.Set = merged.Set || usage.Set
+	}
+	sort.Slice(r.Vars, func(i, j int) bool { return r.Vars[i].Name < r.Vars[j].Name })
+	r.Iterated = r.Iterated || other.Iterated
+}
+
+func mergeStrings(a, b []string) []string {
+	seen := make(map[string]bool, len(a))
+	for _, s := range a {
+		seen[s] = true
+	}
+	for _, s := range b {
+		if !seen[s] {
+			seen[s] = true
+			a = append(a, s)
+		}
+	}
+	return a
+}
+
+// Markdown renders the report as a reference table of the config's vars.
+func (r *VarsReport) Markdown() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "# Vars of `%s`\n\n", r.Filename)
+	if len(r.Vars) == 0 {
+		buf.WriteString("This config doesn't read any vars.\n")
+	} else {
+		buf.WriteString("| Name | Type | Default |\n")
+		buf.WriteString("|------|------|---------|\n")
+		for _, usage := range r.Vars {
+			types := "unknown"
+			if len(usage.Types) > 0 {
+				types = strings.Join(usage.Types, ", ")
+			}
+			var defaults []string
+			for _, dflt := range usage.Defaults {
+				defaults = append(defaults, "`"+dflt+"`")
+			}
+			if usage.Required {
+				defaults = append(defaults, "required")
+			}
+			fmt.Fprintf(&buf, "| `%s` | %s | %s |\n", usage.Name, types, strings.Join(defaults, ", "))
+		}
+	}
+	if r.Iterated {
+		buf.WriteString("\nThis config also iterates over its vars, so it may read keys not listed here.\n")
+	}
+	return buf.String()
+}
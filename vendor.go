@@ -0,0 +1,262 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go.starlark.net/syntax"
+)
+
+// Vendor copies the module at filename, and every module it loads, into
+// destDir so that the config can be loaded offline with LocalFileReader.
+// Modules are read through the FileReader and load filters given in opts,
+// without being executed. Options are parsed as by Load, so an invalid
+// option is an error.
+//
+// Each module is written to a path derived from its resolved path, and the
+// load() statements in the copies are rewritten to refer to those paths.
+// Modules that were local to the root module's directory keep their layout.
+// Loads of modules registered with WithModule are left unchanged.
+//
+// Returns the path of the vendored root module, which may be passed to Load.
+func Vendor(ctx context.Context, filename, destDir string, opts ...LoadOption) (string, error) {
+	parsedOpts, err := parseLoadOptions(filename, opts)
+	if err != nil {
+		return "", err
+	}
+	rootPath, err := parsedOpts.fileReader.Resolve(ctx, filename, "")
+	if err != nil {
+		return "", err
+	}
+	v := &vendorer{
+		ctx:     ctx,
+		opts:    parsedOpts,
+		rootDir: vendorRootDir(filepath.ToSlash(rootPath)),
+		paths:   make(map[string]string),
+		taken:   make(map[string]bool),
+		hashes:  make(map[string]string),
+		pins:    make(map[string][]loadPin),
+	}
+	rootRel := v.assignPath(rootPath, true)
+
+	queue := []string{rootPath}
+	queued := map[string]bool{rootPath: true}
+	sources := make(map[string][]byte)
+	for len(queue) > 0 {
+		modulePath := queue[0]
+		queue = queue[1:]
+		source, deps, err := v.rewrite(modulePath)
+		if err != nil {
+			return "", err
+		}
+		sources[modulePath] = source
+		for _, dep := range deps {
+			if !queued[dep] {
+				queued[dep] = true
+				queue = append(queue, dep)
+			}
+		}
+	}
+
+	for modulePath, pins := range v.pins {
+		for _, pin := range pins {
+			if err := checkLoadPin(modulePath, v.hashes[modulePath], pin); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	for modulePath, source := range sources {
+		dest := filepath.Join(destDir, filepath.FromSlash(v.paths[modulePath]))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(dest, source, 0644); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(destDir, filepath.FromSlash(rootRel)), nil
+}
+
+type vendorer struct {
+	ctx     context.Context
+	opts    *loadOptions
+	rootDir string            // the root module's directory, with a trailing slash
+	paths   map[string]string // resolved path -> vendored path
+	taken   map[string]bool
+	hashes  map[string]string    // resolved path -> original content hash
+	pins    map[string][]loadPin // resolved path -> pins on that path
+}
+
+// rewrite reads a module and replaces the names in its load() statements
+// with vendored paths, dropping any content hash pins since the vendored
+// modules are themselves rewritten. Pins are checked once every module has
+// been read. It returns the rewritten source and the resolved
+// paths of the modules it loads.
+func (v *vendorer) rewrite(modulePath string) ([]byte, []string, error) {
+	source, err := v.opts.fileReader.ReadFile(v.ctx, modulePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	v.hashes[modulePath] = moduleHash(source)
+	f, err := syntax.Parse(modulePath, source, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	loadPins, source, err := stripLoadPins(source, f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type edit struct {
+		start, end int
+		text       string
+	}
+	var edits []edit
+	var deps []string
+	lines := lineOffsets(source)
+	for _, stmt := range f.Stmts {
+		load, ok := stmt.(*syntax.LoadStmt)
+		if !ok {
+			continue
+		}
+		moduleName := load.Module.Value.(string)
+		for _, filter := range v.opts.loadFilters {
+			if err := filter(moduleName, modulePath); err != nil {
+				return nil, nil, fmt.Errorf("load(%q): %v", moduleName, err)
+			}
+		}
+		if strings.HasPrefix(moduleName, builtinModulePrefix) {
+			continue
+		}
+		depPath, err := v.opts.fileReader.Resolve(v.ctx, moduleName, modulePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		deps = append(deps, depPath)
+		if pin, ok := loadPins[moduleName]; ok {
+			v.pins[depPath] = append(v.pins[depPath], loadPin{from: modulePath, hash: pin})
+		}
+		start := byteOffset(source, lines, load.Module.TokenPos)
+		edits = append(edits, edit{
+			start: start,
+			end:   start + len(load.Module.Raw),
+			text:  strconv.Quote(v.assignPath(depPath, false)),
+		})
+	}
+
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	out := append([]byte(nil), source...)
+	for _, e := range edits {
+		out = append(out[:e.start], append([]byte(e.text), out[e.end:]...)...)
+	}
+	return out, deps, nil
+}
+
+// assignPath returns the vendored path of a module, relative to the
+// destination directory. The root module is placed at the top level, so
+// that LocalFileReader resolves load() names relative to the destination.
+func (v *vendorer) assignPath(modulePath string, isRoot bool) string {
+	if rel, ok := v.paths[modulePath]; ok {
+		return rel
+	}
+	slashPath := filepath.ToSlash(modulePath)
+	var rel string
+	if isRoot {
+		rel = sanitizeVendorComponent(path.Base(slashPath))
+	} else if v.rootDir != "" && strings.HasPrefix(slashPath, v.rootDir) {
+		rel = sanitizeVendorPath(strings.TrimPrefix(slashPath, v.rootDir))
+	} else if v.rootDir == "" && !strings.Contains(slashPath, "://") && !path.IsAbs(slashPath) {
+		rel = sanitizeVendorPath(slashPath)
+	} else {
+		rel = sanitizeVendorPath(strings.Replace(slashPath, "://", "/", 1))
+	}
+	if v.taken[rel] {
+		sum := sha256.Sum256([]byte(modulePath))
+		dir, base := path.Split(rel)
+		rel = dir + hex.EncodeToString(sum[:4]) + "_" + base
+	}
+	v.taken[rel] = true
+	v.paths[modulePath] = rel
+	return rel
+}
+
+// vendorRootDir returns everything up to the last slash of the root
+// module's path. Unlike path.Dir, it preserves URL schemes such as
+// "https://".
+func vendorRootDir(rootPath string) string {
+	return rootPath[:strings.LastIndex(rootPath, "/")+1]
+}
+
+func sanitizeVendorPath(p string) string {
+	var parts []string
+	for _, part := range strings.Split(p, "/") {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		parts = append(parts, sanitizeVendorComponent(part))
+	}
+	if len(parts) == 0 {
+		return "_"
+	}
+	return strings.Join(parts, "/")
+}
+
+func sanitizeVendorComponent(part string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		case r == '.' || r == '-' || r == '_':
+			return r
+		}
+		return '_'
+	}, part)
+}
+
+func lineOffsets(source []byte) []int {
+	offsets := []int{0}
+	for ii, b := range source {
+		if b == '\n' {
+			offsets = append(offsets, ii+1)
+		}
+	}
+	return offsets
+}
+
+// byteOffset converts a position, whose column counts runes, into an
+// offset into the source.
+func byteOffset(source []byte, lines []int, pos syntax.Position) int {
+	offset := lines[pos.Line-1]
+	for col := int32(1); col < pos.Col; col++ {
+		_, size := utf8.DecodeRune(source[offset:])
+		offset += size
+	}
+	return offset
+}
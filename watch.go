@@ -0,0 +1,234 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+
+	impl "github.com/stripe/skycfg/internal/go/skycfg"
+)
+
+const defaultWatchInterval = time.Second
+
+// WithWatchInterval sets how often Watch() polls the modules of a config for
+// changes, if they can't be watched for filesystem events. The default is
+// one second. It has no effect on Load().
+func WithWatchInterval(interval time.Duration) LoadOption {
+	if interval <= 0 {
+		panic("WithWatchInterval: interval must be positive")
+	}
+	return fnLoadOption(func(opts *loadOptions) {
+		opts.watchInterval = interval
+	})
+}
+
+// Watch loads a config, and then loads it again whenever any module in its
+// load graph changes. The returned channel receives the initial config, and
+// then each reloaded config. It's closed when ctx is done.
+//
+// If the FileReader is a LocalFileReader, the directories of the modules
+// are watched for filesystem events with fsnotify. Otherwise, or if the
+// directories can't be watched, the FileReader is polled. Readers that
+// implement FileStater are checked with Stat(), and only read if they
+// report a new version; other readers are read on every check, and their
+// content hash compared to the loaded version.
+//
+// If the initial load fails, Watch returns its error. Later failures are
+// logged (see WithLogger), and the previous config stays current until a
+// module changes again. Only the modules of the current config are
+// watched, so a module that only a failed version loads isn't.
+func Watch(ctx context.Context, filename string, opts ...LoadOption) (<-chan *Config, error) {
+	parsedOpts, err := parseLoadOptions(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	w := &watcher{
+		filename: filename,
+		reader:   parsedOpts.fileReader,
+		logger:   parsedOpts.logger,
+	}
+	interval := parsedOpts.watchInterval
+	config, err := loadParsed(ctx, filename, parsedOpts)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := w.reader.(*localFileReader); ok {
+		if fs, err := fsnotify.NewWatcher(); err == nil {
+			w.fs = fs
+			w.dirs = make(map[string]bool)
+		} else {
+			w.logError("watching modules failed, polling instead", err)
+		}
+	}
+	w.snapshot(config)
+
+	configs := make(chan *Config, 1)
+	configs <- config
+	go func() {
+		defer close(configs)
+		defer w.close()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			var tick <-chan time.Time
+			var events <-chan fsnotify.Event
+			var errs <-chan error
+			if w.fs == nil {
+				tick = ticker.C
+			} else {
+				events, errs = w.fs.Events, w.fs.Errors
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+			case event := <-events:
+				if _, ok := w.modules[filepath.Clean(event.Name)]; !ok {
+					continue
+				}
+			case err := <-errs:
+				w.logError("watching modules failed", err)
+				continue
+			}
+			if !w.changed(ctx) {
+				continue
+			}
+			config, err := Load(ctx, filename, opts...)
+			if err != nil {
+				if ctx.Err() == nil {
+					w.logError("reloading config failed", err)
+				}
+				continue
+			}
+			w.snapshot(config)
+			select {
+			case configs <- config:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return configs, nil
+}
+
+type watchedModule struct {
+	hash string
+	info FileInfo
+}
+
+type watcher struct {
+	filename string
+	reader   FileReader
+	logger   impl.LogFunc
+
+	// The modules of the current config. A module's hash is updated when it
+	// changes, even if reloading the config then fails, so that a broken
+	// module isn't reloaded until it changes again.
+	modules map[string]watchedModule
+
+	// fs watches the directories of the modules for events, if the reader
+	// is a LocalFileReader. Directories are watched rather than files, so
+	// that files replaced by renaming another file over them are still
+	// watched.
+	fs   *fsnotify.Watcher
+	dirs map[string]bool
+}
+
+// snapshot records the versions of the modules a config was loaded from.
+// Their FileInfo isn't known until the next check, since a module might
+// have changed after Load() read it.
+func (w *watcher) snapshot(config *Config) {
+	w.modules = make(map[string]watchedModule)
+	for _, dep := range config.Dependencies() {
+		w.modules[filepath.Clean(dep.Path)] = watchedModule{hash: dep.Hash}
+	}
+	if w.fs != nil {
+		w.watchDirs()
+	}
+}
+
+// watchDirs updates the watched directories to those of the current
+// modules. If one can't be watched, the watcher falls back to polling.
+func (w *watcher) watchDirs() {
+	dirs := make(map[string]bool)
+	for path := range w.modules {
+		dirs[filepath.Dir(path)] = true
+	}
+	for dir := range w.dirs {
+		if !dirs[dir] {
+			w.fs.Remove(dir)
+		}
+	}
+	for dir := range dirs {
+		if w.dirs[dir] {
+			continue
+		}
+		if err := w.fs.Add(dir); err != nil {
+			w.logError("watching modules failed, polling instead", err)
+			w.close()
+			return
+		}
+	}
+	w.dirs = dirs
+}
+
+func (w *watcher) close() {
+	if w.fs != nil {
+		w.fs.Close()
+		w.fs, w.dirs = nil, nil
+	}
+}
+
+// changed reports whether any module differs from its snapshot, and
+// updates the snapshot. A module that can't be read counts as changed the
+// first time.
+func (w *watcher) changed(ctx context.Context) bool {
+	changed := false
+	for path, module := range w.modules {
+		info, err := statFile(ctx, w.reader, path)
+		if err == nil && sameVersion(module.info, info) {
+			continue
+		}
+		var hash string
+		if content, err := w.reader.ReadFile(ctx, path); err == nil {
+			hash = moduleHash(content)
+		}
+		if hash != module.hash {
+			changed = true
+			module.hash = hash
+		}
+		module.info = info
+		w.modules[path] = module
+	}
+	return changed
+}
+
+func (w *watcher) logError(msg string, err error) {
+	thread := &starlark.Thread{}
+	if w.logger != nil {
+		impl.SetLogger(thread, w.logger)
+	}
+	impl.Log(thread, "error", msg+": "+err.Error(), map[string]string{
+		"filename": w.filename,
+	}, syntax.Position{})
+}
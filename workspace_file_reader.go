@@ -0,0 +1,163 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type workspaceFileReader struct {
+	roots map[string]string
+}
+
+// WorkspaceFileReader returns a FileReader that resolves Bazel-style labels
+// such as "@workspace//path/to:lib.sky". The roots map repository names
+// (without the leading "@") to directories on the local filesystem; the main
+// repository, used for labels starting with "//", has the empty name.
+//
+// As in Bazel, a label without a repository refers to the repository of the
+// module that loaded it, and a label of the form ":lib.sky" refers to a file
+// in the same package as the module that loaded it.
+func WorkspaceFileReader(roots map[string]string) FileReader {
+	copied := make(map[string]string, len(roots))
+	for name, root := range roots {
+		if root == "" {
+			panic(fmt.Sprintf("WorkspaceFileReader: empty root path for repository %q", name))
+		}
+		copied[strings.TrimPrefix(name, "@")] = root
+	}
+	return &workspaceFileReader{copied}
+}
+
+type workspaceLabel struct {
+	repo, pkg, target string
+}
+
+func (l workspaceLabel) String() string {
+	repo := ""
+	if l.repo != "" {
+		repo = "@" + l.repo
+	}
+	return fmt.Sprintf("%s//%s:%s", repo, l.pkg, l.target)
+}
+
+// parseWorkspaceLabel parses a label, filling in the repository and package
+// from `from` if they're omitted.
+func parseWorkspaceLabel(name string, from *workspaceLabel) (workspaceLabel, error) {
+	var label workspaceLabel
+	rest := name
+	switch {
+	case strings.HasPrefix(rest, "@"):
+		idx := strings.Index(rest, "//")
+		if idx < 0 {
+			return label, fmt.Errorf("load(%q): label must contain \"//\"", name)
+		}
+		label.repo, rest = rest[1:idx], rest[idx:]
+	case strings.HasPrefix(rest, ":"):
+		if from == nil {
+			return label, fmt.Errorf("load(%q): relative label used outside of a workspace module", name)
+		}
+		label.repo, label.pkg = from.repo, from.pkg
+		label.target = rest[1:]
+		return label, label.validate(name)
+	case strings.HasPrefix(rest, "//"):
+		if from != nil {
+			label.repo = from.repo
+		}
+	default:
+		return label, fmt.Errorf("load(%q): module names must be labels like \"//pkg:file.sky\"", name)
+	}
+
+	rest = strings.TrimPrefix(rest, "//")
+	if idx := strings.LastIndex(rest, ":"); idx >= 0 {
+		label.pkg, label.target = rest[:idx], rest[idx+1:]
+	} else {
+		// "//pkg/file.sky" is accepted as shorthand for "//pkg:file.sky".
+		label.pkg, label.target = path.Dir(rest), path.Base(rest)
+		if label.pkg == "." {
+			label.pkg = ""
+		}
+	}
+	return label, label.validate(name)
+}
+
+func (l workspaceLabel) validate(name string) error {
+	if l.target == "" {
+		return fmt.Errorf("load(%q): empty target name", name)
+	}
+	for _, part := range strings.Split(l.pkg+"/"+l.target, "/") {
+		if part == "." || part == ".." {
+			return fmt.Errorf("load(%q): label must not contain %q", name, part)
+		}
+	}
+	return nil
+}
+
+func (r *workspaceFileReader) Resolve(ctx context.Context, name, fromPath string) (string, error) {
+	var from *workspaceLabel
+	if fromPath != "" {
+		if fromLabel, err := parseWorkspaceLabel(fromPath, nil); err == nil {
+			from = &fromLabel
+		}
+	}
+	label, err := parseWorkspaceLabel(name, from)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := r.roots[label.repo]; !ok {
+		return "", fmt.Errorf("load(%q): unknown repository %q", name, "@"+label.repo)
+	}
+	return label.String(), nil
+}
+
+func (r *workspaceFileReader) ReadFile(ctx context.Context, filename string) ([]byte, error) {
+	localPath, err := r.localPath(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(localPath)
+}
+
+func (r *workspaceFileReader) Stat(ctx context.Context, filename string) (FileInfo, error) {
+	localPath, err := r.localPath(filename)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{ModTime: info.ModTime(), Size: info.Size()}, nil
+}
+
+func (r *workspaceFileReader) localPath(filename string) (string, error) {
+	label, err := parseWorkspaceLabel(filename, nil)
+	if err != nil {
+		return "", err
+	}
+	root, ok := r.roots[label.repo]
+	if !ok {
+		return "", fmt.Errorf("load(%q): unknown repository %q", filename, "@"+label.repo)
+	}
+	return filepath.Join(root, filepath.FromSlash(label.pkg), filepath.FromSlash(label.target)), nil
+}
@@ -0,0 +1,322 @@
+// Copyright 2018 The Skycfg Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package skycfg
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"go.starlark.net/syntax"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	impl "github.com/stripe/skycfg/internal/go/skycfg"
+)
+
+// A WrapperSpec describes a constructor helper for a message type, to be
+// generated by GenerateWrappers().
+type WrapperSpec struct {
+	// Type is the full name of the message type, such as
+	// "k8s.io.api.apps.v1.Deployment".
+	Type string
+
+	// Name is the name of the helper. If empty, it's the type's name in
+	// snake_case, such as "deployment".
+	Name string
+
+	// Fields are the fields that the helper takes as parameters, in order.
+	// If empty, it takes all of the type's fields.
+	Fields []string
+
+	// Required are the parameters that must be passed, and can't be None.
+	// They come before the others.
+	Required []string
+
+	// Defaults holds Starlark expressions for the default values of
+	// parameters, such as "1". Parameters without one default to None,
+	// which leaves the field unset.
+	Defaults map[string]string
+}
+
+// GenerateWrappers returns the source of a Starlark module that defines a
+// constructor helper for each spec, for publishing as a library that's
+// simpler and safer to use than constructing the messages directly. Each
+// helper checks the types of its arguments, and fails with a message
+// naming the helper and parameter.
+//
+// If namespace isn't empty, the helpers are also collected into a struct
+// of that name, so that a config can load them together:
+//
+//	load("//lib/k8s.sky", "k8s")
+//
+//	def main(ctx):
+//		return [k8s.deployment(name = "web", replicas = 3)]
+//
+// Names starting with an underscore are reserved for the module itself, so
+// they can't be used for helpers or their parameters.
+//
+// Types are looked up in registry, or among those linked into the binary
+// if it's nil.
+func GenerateWrappers(registry unstableProtoRegistry, namespace string, specs ...WrapperSpec) ([]byte, error) {
+	g := &wrapperGenerator{packages: make(map[string]string), aliases: make(map[string]bool)}
+	var defs bytes.Buffer
+	var names []string
+	for _, spec := range specs {
+		desc, err := impl.ProtoMessageDescriptor(registry, spec.Type)
+		if err != nil {
+			return nil, fmt.Errorf("GenerateWrappers: %v", err)
+		}
+		name, err := g.writeHelper(&defs, desc, spec)
+		if err != nil {
+			return nil, fmt.Errorf("GenerateWrappers: %s: %v", spec.Type, err)
+		}
+		names = append(names, name)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# Code generated by skycfg.GenerateWrappers. DO NOT EDIT.\n\n")
+	var pkgs []string
+	for pkg := range g.packages {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	for _, pkg := range pkgs {
+		fmt.Fprintf(&buf, "%s = proto.package(%q)\n", g.packages[pkg], pkg)
+	}
+	buf.WriteString(wrapperCheck)
+	buf.Write(defs.Bytes())
+	if namespace != "" {
+		if err := checkWrapperIdent(namespace); err != nil {
+			return nil, fmt.Errorf("GenerateWrappers: namespace: %v", err)
+		}
+		fmt.Fprintf(&buf, "\n%s = struct(\n", namespace)
+		for _, name := range names {
+			fmt.Fprintf(&buf, "\t%s = %s,\n", name, name)
+		}
+		buf.WriteString(")\n")
+	}
+	if _, err := syntax.Parse("wrappers.sky", buf.Bytes(), 0); err != nil {
+		return nil, fmt.Errorf("GenerateWrappers: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+const wrapperCheck = `
+def _check(fn, param, value, types):
+	if value != None and types and type(value) not in types:
+		fail("%s: for parameter %s: got %s, want %s" % (fn, param, type(value), " or ".join(types)))
+
+def _require(fn, param, value):
+	if value == None:
+		fail("%s: parameter %s is required" % (fn, param))
+`
+
+type wrapperGenerator struct {
+	// packages maps the packages of the types to the names they're bound
+	// to in the generated module, and aliases holds those names.
+	packages map[string]string
+	aliases  map[string]bool
+}
+
+// writeHelper writes the def of a helper, and returns its name.
+func (g *wrapperGenerator) writeHelper(buf *bytes.Buffer, desc protoreflect.MessageDescriptor, spec WrapperSpec) (string, error) {
+	name := spec.Name
+	if name == "" {
+		name = snakeCase(string(desc.Name()))
+	}
+	if err := checkWrapperIdent(name); err != nil {
+		return "", err
+	}
+	fieldNames := spec.Fields
+	if len(fieldNames) == 0 {
+		for ii := 0; ii < desc.Fields().Len(); ii++ {
+			fieldNames = append(fieldNames, string(desc.Fields().Get(ii).Name()))
+		}
+	}
+	required := make(map[string]bool)
+	for _, field := range spec.Required {
+		required[field] = true
+	}
+	var fields []protoreflect.FieldDescriptor
+	for _, field := range fieldNames {
+		fd := desc.Fields().ByName(protoreflect.Name(field))
+		if fd == nil {
+			return "", fmt.Errorf("no field %q", field)
+		}
+		if err := checkWrapperIdent(field); err != nil {
+			return "", err
+		}
+		fields = append(fields, fd)
+	}
+	for field := range required {
+		if !containsString(fieldNames, field) {
+			return "", fmt.Errorf("required field %q isn't a parameter", field)
+		}
+	}
+	for field := range spec.Defaults {
+		if !containsString(fieldNames, field) {
+			return "", fmt.Errorf("default for field %q, which isn't a parameter", field)
+		}
+		if required[field] {
+			return "", fmt.Errorf("required field %q can't have a default", field)
+		}
+	}
+	sort.SliceStable(fields, func(i, j int) bool {
+		return required[string(fields[i].Name())] && !required[string(fields[j].Name())]
+	})
+
+	var params []string
+	for _, fd := range fields {
+		field := string(fd.Name())
+		switch {
+		case required[field]:
+			params = append(params, field)
+		case spec.Defaults[field] != "":
+			params = append(params, field+" = "+spec.Defaults[field])
+		default:
+			params = append(params, field+" = None")
+		}
+	}
+	fmt.Fprintf(buf, "\ndef %s(%s):\n", name, strings.Join(params, ", "))
+	fmt.Fprintf(buf, "\t\"\"\"Returns a %s.\n", desc.FullName())
+	if len(fields) > 0 {
+		buf.WriteString("\n\tArgs:\n")
+		for _, fd := range fields {
+			types := wrapperTypes(fd)
+			if types == nil {
+				types = []string{string(fd.Message().FullName())}
+			}
+			fmt.Fprintf(buf, "\t  %s: %s\n", fd.Name(), strings.Join(types, " or "))
+		}
+	}
+	buf.WriteString("\t\"\"\"\n")
+	for _, fd := range fields {
+		field := string(fd.Name())
+		if required[field] {
+			fmt.Fprintf(buf, "\t_require(%q, %q, %s)\n", name, field, field)
+		}
+		fmt.Fprintf(buf, "\t_check(%q, %q, %s, %s)\n", name, field, field, starlarkStringList(wrapperTypes(fd)))
+	}
+	fmt.Fprintf(buf, "\t_msg = %s()\n", g.typeExpr(desc))
+	for _, fd := range fields {
+		fmt.Fprintf(buf, "\tif %s != None:\n", fd.Name())
+		fmt.Fprintf(buf, "\t\t_msg.%s = %s\n", fd.Name(), fd.Name())
+	}
+	buf.WriteString("\treturn _msg\n")
+	return name, nil
+}
+
+// typeExpr returns the expression for a message type in the generated
+// module, such as `_k8s_io_api_apps_v1.Deployment`. Packages whose names
+// only differ in their dots and underscores get numbered aliases.
+func (g *wrapperGenerator) typeExpr(desc protoreflect.MessageDescriptor) string {
+	pkg := string(desc.ParentFile().Package())
+	alias, ok := g.packages[pkg]
+	if !ok {
+		base := "_" + strings.Replace(pkg, ".", "_", -1)
+		alias = base
+		for ii := 2; g.aliases[alias]; ii++ {
+			alias = fmt.Sprintf("%s_%d", base, ii)
+		}
+		g.packages[pkg] = alias
+		g.aliases[alias] = true
+	}
+	return alias + "." + strings.TrimPrefix(string(desc.FullName()), pkg+".")
+}
+
+// wrapperTypes returns the Starlark types that a helper accepts for a
+// field, or nil if it doesn't check them. Well-known types are set from
+// other types too, so they aren't checked.
+func wrapperTypes(fd protoreflect.FieldDescriptor) []string {
+	switch {
+	case fd.IsMap():
+		return []string{"dict"}
+	case fd.IsList():
+		return []string{"list"}
+	}
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return []string{"bool"}
+	case protoreflect.StringKind, protoreflect.BytesKind:
+		return []string{"string"}
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return []string{"float", "int"}
+	case protoreflect.EnumKind:
+		return []string{string(fd.Enum().FullName())}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		if strings.HasPrefix(string(fd.Message().FullName()), "google.protobuf.") {
+			return nil
+		}
+		return []string{string(fd.Message().FullName())}
+	}
+	return []string{"int"}
+}
+
+func starlarkStringList(items []string) string {
+	quoted := make([]string, len(items))
+	for ii, item := range items {
+		quoted[ii] = fmt.Sprintf("%q", item)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// checkIdent returns an error if name can't be used as a Starlark
+// identifier, such as a keyword.
+func checkIdent(name string) error {
+	expr, err := syntax.ParseExpr("", name, 0)
+	if _, ok := expr.(*syntax.Ident); err != nil || !ok {
+		return fmt.Errorf("%q isn't a valid Starlark identifier", name)
+	}
+	return nil
+}
+
+// checkWrapperIdent is like checkIdent, and also rejects the names
+// reserved for the generated module's own definitions and locals.
+func checkWrapperIdent(name string) error {
+	if strings.HasPrefix(name, "_") {
+		return fmt.Errorf("%q is reserved, since it starts with an underscore", name)
+	}
+	return checkIdent(name)
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// snakeCase converts a CamelCase name such as "MessageV3" to snake_case.
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var buf strings.Builder
+	for ii, r := range runes {
+		if ii > 0 && unicode.IsUpper(r) {
+			prev := runes[ii-1]
+			nextLower := ii+1 < len(runes) && unicode.IsLower(runes[ii+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				buf.WriteByte('_')
+			}
+		}
+		buf.WriteRune(unicode.ToLower(r))
+	}
+	return buf.String()
+}